@@ -0,0 +1,171 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/internal/auth/app_passwords"
+	"github.com/spf13/cobra"
+)
+
+func NewAppPasswordCmd() *cobra.Command {
+	appPassCmd := &cobra.Command{
+		Use:   "app-password",
+		Short: "Application-specific passwords management",
+		Long: `These subcommands can be used to manage application-specific passwords
+stored by auth.app_passwords module.
+
+App passwords let users whose primary credentials cannot be typed into a mail
+client (e.g. wallet signatures) to log in. Each password is generated randomly,
+can be restricted to IMAP or Submission and can be revoked individually.
+
+By default, the module configuration block should be named app_passwords,
+this can be changed using --cfg-block flag.`,
+	}
+
+	createCmd := &cobra.Command{
+		Use:   "create USERNAME NAME",
+		Short: "Generate a new app password",
+		Args:  cobra.ExactArgs(2),
+		RunE:  appPasswordCreate,
+	}
+	createCmd.Flags().String("cfg-block", "app_passwords", "Module configuration block to use")
+	createCmd.Flags().StringSlice("scope", nil, "Restrict the password to the service ("+strings.Join(app_passwords.Scopes, ", ")+"), can be repeated")
+
+	listCmd := &cobra.Command{
+		Use:   "list [USERNAME]",
+		Short: "List app passwords of the user or users having app passwords",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  appPasswordList,
+	}
+	listCmd.Flags().String("cfg-block", "app_passwords", "Module configuration block to use")
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke USERNAME NAME",
+		Short: "Revoke the app password",
+		Args:  cobra.ExactArgs(2),
+		RunE:  appPasswordRevoke,
+	}
+	revokeCmd.Flags().String("cfg-block", "app_passwords", "Module configuration block to use")
+	revokeCmd.Flags().BoolP("yes", "y", false, "Don't ask for confirmation")
+
+	appPassCmd.AddCommand(createCmd, listCmd, revokeCmd)
+	return appPassCmd
+}
+
+func openAppPasswords(cmd *cobra.Command) (*app_passwords.Auth, error) {
+	globals, mod, err := getCfgBlockModule(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	appPass, ok := mod.Instance.(*app_passwords.Auth)
+	if !ok {
+		cfgBlock, _ := cmd.Flags().GetString("cfg-block")
+		return nil, fmt.Errorf("configuration block %s is not auth.app_passwords", cfgBlock)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return appPass, nil
+}
+
+func appPasswordCreate(cmd *cobra.Command, args []string) error {
+	be, err := openAppPasswords(cmd)
+	if err != nil {
+		return err
+	}
+	defer closeIfNeeded(be)
+
+	scopes, _ := cmd.Flags().GetStringSlice("scope")
+	pass, err := be.CreateAppPassword(args[0], args[1], scopes)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Use the following password in the mail client, it will not be shown again:")
+	fmt.Println(pass)
+	return nil
+}
+
+func appPasswordList(cmd *cobra.Command, args []string) error {
+	be, err := openAppPasswords(cmd)
+	if err != nil {
+		return err
+	}
+	defer closeIfNeeded(be)
+
+	if len(args) == 0 {
+		users, err := be.ListUsers()
+		if err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			fmt.Fprintln(os.Stderr, "No app passwords.")
+		}
+		for _, user := range users {
+			fmt.Println(user)
+		}
+		return nil
+	}
+
+	list, err := be.ListAppPasswords(args[0])
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(os.Stderr, "No app passwords.")
+	}
+	for _, p := range list {
+		scopes := "all"
+		if len(p.Scopes) != 0 {
+			scopes = strings.Join(p.Scopes, ",")
+		}
+		lastUsed := "never used"
+		if !p.LastUsed.IsZero() {
+			lastUsed = "last used " + p.LastUsed.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%s\tcreated %s\t%s\n", p.Name, scopes, p.Created.Local().Format(time.RFC3339), lastUsed)
+	}
+	return nil
+}
+
+func appPasswordRevoke(cmd *cobra.Command, args []string) error {
+	be, err := openAppPasswords(cmd)
+	if err != nil {
+		return err
+	}
+	defer closeIfNeeded(be)
+
+	yes, _ := cmd.Flags().GetBool("yes")
+	if !yes {
+		if !Confirmation("Are you sure you want to revoke this app password?", false) {
+			return fmt.Errorf("cancelled")
+		}
+	}
+
+	return be.RevokeAppPassword(args[0], args[1])
+}
@@ -0,0 +1,118 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/internal/authguard"
+	"github.com/spf13/cobra"
+)
+
+func NewBanCmd() *cobra.Command {
+	banCmd := &cobra.Command{
+		Use:   "ban",
+		Short: "Authentication failure bans management",
+		Long: `These subcommands can be used to inspect and remove bans issued by
+the auth_guard module for clients failing authentication too often.
+
+Changes are picked up by the running server within a few seconds.`,
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List active bans",
+		Args:  cobra.NoArgs,
+		RunE:  banList,
+	}
+	listCmd.Flags().String("state-file", "", "auth_guard state file to use (default is derived from state_dir)")
+
+	removeCmd := &cobra.Command{
+		Use:     "remove IP|USERNAME",
+		Aliases: []string{"rm"},
+		Short:   "Remove the ban for the IP address or username",
+		Long: `Remove the ban for the IP address or username.
+
+Ban history is removed too, so the next ban will not be longer than ban_time.
+IPv6 addresses are banned by /64 network, either the network or any address
+within it can be specified.`,
+		Args: cobra.ExactArgs(1),
+		RunE: banRemove,
+	}
+	removeCmd.Flags().String("state-file", "", "auth_guard state file to use (default is derived from state_dir)")
+
+	banCmd.AddCommand(listCmd, removeCmd)
+	return banCmd
+}
+
+func banStatePath(cmd *cobra.Command) (string, error) {
+	statePath, _ := cmd.Flags().GetString("state-file")
+	if statePath != "" {
+		return statePath, nil
+	}
+	stateDir, err := readStateDir()
+	if err != nil {
+		return "", err
+	}
+	return authguard.DefaultStatePath(stateDir), nil
+}
+
+func banList(cmd *cobra.Command, _ []string) error {
+	statePath, err := banStatePath(cmd)
+	if err != nil {
+		return err
+	}
+
+	bans, err := authguard.ReadBans(statePath)
+	if err != nil {
+		return err
+	}
+	if len(bans) == 0 {
+		fmt.Fprintln(os.Stderr, "No active bans.")
+		return nil
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	for _, b := range bans {
+		fmt.Printf("%s\t%s\tban #%d\tuntil %s\n", b.Kind, b.Key, b.Count,
+			b.Until.Local().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func banRemove(cmd *cobra.Command, args []string) error {
+	statePath, err := banStatePath(cmd)
+	if err != nil {
+		return err
+	}
+
+	removed, err := authguard.RemoveBan(statePath, args[0])
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return fmt.Errorf("no ban for %s", args[0])
+	}
+	return nil
+}
@@ -24,7 +24,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/term"
 
@@ -46,6 +48,10 @@ type logOut struct {
 	log.Output
 }
 
+func (l logOut) WriteEntry(e log.Entry) {
+	log.WriteEntry(l.Output, e)
+}
+
 func logOutput(_ *config.Map, node config.Node) (interface{}, error) {
 	if len(node.Args) == 0 {
 		return nil, config.NodeErr(node, "expected at least 1 argument")
@@ -71,29 +77,50 @@ func LogOutputOption(args []string) (log.Output, error) {
 				return nil, fmt.Errorf("failed to connect to syslog daemon: %v", err)
 			}
 			outs = append(outs, syslogOut)
+		case "json":
+			outs = append(outs, log.JSONWriterOutput(os.Stderr))
+		case "otlp":
+			outs = append(outs, log.OTLPOutput(otlpLogsEndpoint(), "sirrmeshd"))
 		case "off":
 			if len(args) != 1 {
 				return nil, errors.New("'off' can't be combined with other log targets")
 			}
 			return log.NopOutput{}, nil
 		default:
+			if endpoint, ok := strings.CutPrefix(arg, "otlp:"); ok {
+				outs = append(outs, log.OTLPOutput(endpoint, "sirrmeshd"))
+				continue
+			}
+			path, isJSON := strings.CutPrefix(arg, "json:")
+			if !isJSON {
+				path = arg
+			}
+
 			// Log file paths are converted to absolute to make sure
 			// we will be able to recreate them in right location
 			// after changing working directory to the state dir.
-			absPath, err := filepath.Abs(arg)
+			absPath, err := filepath.Abs(path)
 			if err != nil {
 				return nil, err
 			}
 			// We change the actual argument, so logOut object will
 			// keep the absolute path for reinitialization.
-			args[i] = absPath
+			if isJSON {
+				args[i] = "json:" + absPath
+			} else {
+				args[i] = absPath
+			}
 
 			w, err := os.OpenFile(absPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
 			if err != nil {
 				return nil, fmt.Errorf("failed to create log file: %v", err)
 			}
 
-			outs = append(outs, log.WriteCloserOutput(w, true))
+			if isJSON {
+				outs = append(outs, log.JSONWriteCloserOutput(w))
+			} else {
+				outs = append(outs, log.WriteCloserOutput(w, true))
+			}
 		}
 	}
 
@@ -103,6 +130,34 @@ func LogOutputOption(args []string) (log.Output, error) {
 	return logOut{args, log.MultiOutput(outs...)}, nil
 }
 
+// otlpLogsEndpoint returns the OTLP/HTTP logs endpoint configured using
+// the standard OpenTelemetry environment variables or the default local
+// collector address.
+func otlpLogsEndpoint() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/") + "/v1/logs"
+	}
+	return "http://localhost:4318/v1/logs"
+}
+
+func logSampling(_ *config.Map, node config.Node) (interface{}, error) {
+	var cfg log.Sampling
+	m := config.NewMap(nil, node)
+	m.Int("first", false, false, 100, &cfg.First)
+	m.Int("thereafter", false, false, 100, &cfg.Thereafter)
+	m.Duration("interval", false, false, time.Second, &cfg.Interval)
+	if _, err := m.Process(); err != nil {
+		return nil, err
+	}
+	if cfg.First < 0 || cfg.Thereafter < 0 {
+		return nil, config.NodeErr(node, "first and thereafter can't be negative")
+	}
+	return cfg, nil
+}
+
 func defaultLogOutput() (interface{}, error) {
 	return log.DefaultLogger.Out, nil
 }
@@ -270,6 +325,11 @@ submission tls://0.0.0.0:465 tcp://0.0.0.0:587 {
     limits {
         # Up to 50 msgs/sec across any amount of SMTP connections.
         all rate 50 1s
+
+        # Per-user quotas for authenticated senders, see
+        # 'sirrmeshd limits usage'.
+        # user messages 500 24h
+        # user recipients 2000 24h
     }
 
     auth &blockchain_atuh
@@ -0,0 +1,245 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+
+	parser "github.com/sirrchat/SirrMesh/framework/cfgparser"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/spf13/cobra"
+)
+
+// Global directives with values inherited by module blocks. Other global
+// directives are used by the server itself.
+var inheritedGlobals = map[string]bool{
+	"hostname":                 true,
+	"autogenerated_msg_domain": true,
+	"tls":                      true,
+	"tls_client":               true,
+	"storage_perdomain":        true,
+	"auth_perdomain":           true,
+	"auth_domains":             true,
+	"auth_map_normalize":       true,
+	"auth_map":                 true,
+}
+
+// Directives of the global configuration filled with default values by the
+// last ReadGlobals call.
+var globalsFilled []config.Node
+
+var locatedErr = regexp.MustCompile(`^\S+:\d+: `)
+
+// validationResult contains all problems found in the configuration.
+type validationResult struct {
+	cfg      []config.Node
+	errors   []error
+	warnings []error
+}
+
+func (res *validationResult) errorAt(node config.Node, err error) {
+	if !locatedErr.MatchString(err.Error()) {
+		err = config.NodeErr(node, "%v", err)
+	}
+	res.errors = append(res.errors, err)
+}
+
+// validateConfig reads the configuration file and initializes all modules
+// in the dry run mode. Unlike the server startup, it does not stop at the
+// first error.
+func validateConfig(path string) (*validationResult, error) {
+	cfg, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	res := &validationResult{cfg: cfg}
+
+	module.DryRun = true
+	module.NoRun = true
+	config.RecordFilled()
+
+	globals, modBlocks, err := ReadGlobals(cfg)
+	if err != nil {
+		res.errors = append(res.errors, err)
+		return res, nil
+	}
+	// Module logs are not useful here and the log directive might point
+	// to the server log.
+	log.DefaultLogger.Out = log.NopOutput{}
+
+	// Relative paths in the configuration are relative to the state
+	// directory, see InitDirs. It is not created here.
+	if err := os.Chdir(config.StateDirectory); err != nil {
+		res.warnings = append(res.warnings, fmt.Errorf("state directory is not accessible, relative paths are resolved against the current directory: %w", err))
+	}
+
+	var endpoints, mods []ModInfo
+	for _, block := range modBlocks {
+		info, isEndpoint, err := registerBlock(globals, block)
+		if err != nil {
+			res.errorAt(block, err)
+			continue
+		}
+		if isEndpoint {
+			endpoints = append(endpoints, info)
+		} else {
+			mods = append(mods, info)
+		}
+	}
+	if len(endpoints) == 0 {
+		res.errors = append(res.errors, errors.New("at least one endpoint should be configured"))
+	}
+
+	for _, endp := range endpoints {
+		if err := module.InitInstance(endp.Instance, config.NewMap(globals, endp.Cfg)); err != nil {
+			res.errorAt(endp.Cfg, err)
+		}
+	}
+	// Blocks might be referenced by the part of the configuration that was
+	// not processed due to errors.
+	reportUnused := len(res.errors) == 0
+	for _, inst := range mods {
+		name := inst.Instance.InstanceName()
+		if module.IsInitialized(name) {
+			continue
+		}
+		if reportUnused {
+			res.errors = append(res.errors, config.NodeErr(inst.Cfg, "unused configuration block: %s (%s)", name, inst.Instance.Name()))
+		}
+		// Still check the block itself.
+		if _, err := module.GetInstance(name); err != nil {
+			res.errorAt(inst.Cfg, err)
+		}
+	}
+
+	for _, node := range globalNodes(cfg) {
+		if inheritedGlobals[node.Name] && !config.GlobalUsed(node.Name) {
+			res.warnings = append(res.warnings, config.NodeErr(node, "global directive %s is not used by any module", node.Name))
+		}
+	}
+
+	return res, nil
+}
+
+// withFilled returns a copy of nodes with directives filled by modules with
+// default values added to each block.
+func withFilled(nodes []config.Node) []config.Node {
+	res := make([]config.Node, 0, len(nodes))
+	for _, node := range nodes {
+		filled := config.FilledDirectives(node)
+		if node.Children != nil || len(filled) != 0 {
+			children := withFilled(node.Children)
+			node.Children = append(children, filled...)
+		}
+		res = append(res, node)
+	}
+	return res
+}
+
+func runConfigValidate(cmd *cobra.Command, args []string) error {
+	res, err := validateConfig(configPath)
+	if err != nil {
+		return err
+	}
+
+	for _, err := range res.errors {
+		fmt.Println("error:", err)
+	}
+	for _, warn := range res.warnings {
+		fmt.Println("warning:", warn)
+	}
+	fmt.Printf("%d error(s), %d warning(s)\n", len(res.errors), len(res.warnings))
+
+	strict, _ := cmd.Flags().GetBool("strict")
+	if len(res.errors) != 0 || (strict && len(res.warnings) != 0) {
+		// Problems are already listed.
+		cmd.SilenceUsage = true
+		cmd.SilenceErrors = true
+		return fmt.Errorf("configuration is invalid")
+	}
+	return nil
+}
+
+func runConfigDump(cmd *cobra.Command, args []string) error {
+	res, err := validateConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if len(res.errors) != 0 {
+		for _, err := range res.errors {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+		cmd.SilenceUsage = true
+		cmd.SilenceErrors = true
+		return fmt.Errorf("configuration is invalid")
+	}
+
+	var nodes []config.Node
+	for _, node := range globalsFilled {
+		present := false
+		for _, n := range res.cfg {
+			if n.Name == node.Name {
+				present = true
+				break
+			}
+		}
+		if !present {
+			nodes = append(nodes, node)
+		}
+	}
+	nodes = append(nodes, withFilled(res.cfg)...)
+
+	return parser.Write(os.Stdout, nodes)
+}
+
+func NewConfigCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Configuration file tools",
+	}
+
+	validateCmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Check the configuration file",
+		Long: `Read the configuration file and initialize all modules without binding
+sockets, opening databases or generating keys. All errors are reported with
+their location in the configuration file, global directives not used by any
+module are reported as warnings.`,
+		RunE: runConfigValidate,
+	}
+	validateCmd.Flags().Bool("strict", false, "treat warnings as errors")
+
+	dumpCmd := &cobra.Command{
+		Use:   "dump",
+		Short: "Print the effective configuration",
+		Long: `Print the configuration with imports, snippets, macros and environment
+variables expanded and directives omitted in the configuration filled with
+their default values. Values that can't be written as directive arguments
+(e.g. references to other modules) are not filled.`,
+		RunE: runConfigDump,
+	}
+
+	cmd.AddCommand(validateCmd, dumpCmd)
+	return cmd
+}
@@ -24,6 +24,7 @@ import (
 	"strings"
 
 	"github.com/sirrchat/SirrMesh/internal/auth/pass_table"
+	"github.com/sirrchat/SirrMesh/internal/auth/saslscram"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -61,6 +62,8 @@ flag for subcommands.`,
 	createCmd.Flags().StringP("password", "p", "", "Use PASSWORD instead of reading password from stdin")
 	createCmd.Flags().String("hash", "bcrypt", "Hash algorithm to use")
 	createCmd.Flags().Int("bcrypt-cost", bcrypt.DefaultCost, "Bcrypt cost value")
+	createCmd.Flags().Bool("scram", false, "Also store SCRAM-SHA-256 keys")
+	createCmd.Flags().Int("scram-iterations", saslscram.MinIterations, "PBKDF2 iterations for SCRAM-SHA-256 keys")
 
 	// Remove subcommand
 	removeCmd := &cobra.Command{
@@ -81,8 +84,12 @@ flag for subcommands.`,
 	}
 	passwordCmd.Flags().String("cfg-block", "local_authdb", "Module configuration block to use")
 	passwordCmd.Flags().StringP("password", "p", "", "Use PASSWORD instead of reading password from stdin")
+	passwordCmd.Flags().String("hash", "bcrypt", "Hash algorithm to use")
+	passwordCmd.Flags().Int("bcrypt-cost", bcrypt.DefaultCost, "Bcrypt cost value")
+	passwordCmd.Flags().Bool("scram", false, "Also store SCRAM-SHA-256 keys (kept if already present)")
+	passwordCmd.Flags().Int("scram-iterations", saslscram.MinIterations, "PBKDF2 iterations for SCRAM-SHA-256 keys")
 
-	credsCmd.AddCommand(listCmd, createCmd, removeCmd, passwordCmd)
+	credsCmd.AddCommand(listCmd, createCmd, removeCmd, passwordCmd, NewAppPasswordCmd(), NewTOTPCmd())
 	return credsCmd
 }
 
@@ -131,17 +138,34 @@ func credsCreate(cmd *cobra.Command, args []string) error {
 
 	if beHash, ok := be.(*pass_table.Auth); ok {
 		hashAlgo, _ := cmd.Flags().GetString("hash")
-		bcryptCost, _ := cmd.Flags().GetInt("bcrypt-cost")
-		return beHash.CreateUserHash(username, pass, hashAlgo, pass_table.HashOpts{
-			BcryptCost: bcryptCost,
-		})
-	} else if cmd.Flags().Changed("hash") || cmd.Flags().Changed("bcrypt-cost") {
+		return beHash.CreateUserHash(username, pass, hashAlgo, credsHashOpts(cmd))
+	} else if hashFlagsChanged(cmd) {
 		return fmt.Errorf("--hash cannot be used with non-pass_table credentials DB")
 	} else {
 		return be.CreateUser(username, pass)
 	}
 }
 
+func hashFlagsChanged(cmd *cobra.Command) bool {
+	for _, flag := range []string{"hash", "bcrypt-cost", "scram", "scram-iterations"} {
+		if cmd.Flags().Changed(flag) {
+			return true
+		}
+	}
+	return false
+}
+
+func credsHashOpts(cmd *cobra.Command) pass_table.HashOpts {
+	bcryptCost, _ := cmd.Flags().GetInt("bcrypt-cost")
+	withSCRAM, _ := cmd.Flags().GetBool("scram")
+	scramIterations, _ := cmd.Flags().GetInt("scram-iterations")
+	return pass_table.HashOpts{
+		BcryptCost:      bcryptCost,
+		SCRAMIterations: scramIterations,
+		WithSCRAM:       withSCRAM,
+	}
+}
+
 func credsRemove(cmd *cobra.Command, args []string) error {
 	be, err := openUserDB(cmd)
 	if err != nil {
@@ -181,6 +205,12 @@ func credsPassword(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	if beHash, ok := be.(*pass_table.Auth); ok {
+		hashAlgo, _ := cmd.Flags().GetString("hash")
+		return beHash.SetUserPasswordHash(username, pass, hashAlgo, credsHashOpts(cmd))
+	} else if hashFlagsChanged(cmd) {
+		return fmt.Errorf("--hash cannot be used with non-pass_table credentials DB")
+	}
 	return be.SetUserPassword(username, pass)
 }
 
@@ -0,0 +1,124 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/internal/dmarc/report"
+	"github.com/spf13/cobra"
+)
+
+func NewDMARCReportsCmd() *cobra.Command {
+	reportsCmd := &cobra.Command{
+		Use:   "dmarc-reports",
+		Short: "DMARC aggregate reports inspection",
+		Long: `These subcommands can be used to inspect DMARC evaluation results
+recorded by the dmarc_reports module before they are sent.`,
+	}
+	reportsCmd.PersistentFlags().String("store-dir", "", "Reports directory to use (default is derived from state_dir)")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List policy domains with pending reports",
+		Args:  cobra.NoArgs,
+		RunE:  dmarcReportsList,
+	}
+	reportsCmd.AddCommand(listCmd)
+
+	previewCmd := &cobra.Command{
+		Use:   "preview DOMAIN",
+		Short: "Print the aggregate report XML that would be sent for DOMAIN",
+		Args:  cobra.ExactArgs(1),
+		RunE:  dmarcReportsPreview,
+	}
+	previewCmd.Flags().String("org-name", "preview", "Organization name to put into the report")
+	previewCmd.Flags().String("email", "postmaster@localhost", "Contact address to put into the report")
+	reportsCmd.AddCommand(previewCmd)
+
+	return reportsCmd
+}
+
+func openReportsStore(cmd *cobra.Command) (*report.Store, error) {
+	storeDir, _ := cmd.Flags().GetString("store-dir")
+	if storeDir == "" {
+		stateDir, err := readStateDir()
+		if err != nil {
+			return nil, err
+		}
+		storeDir = report.DefaultStoreDir(stateDir)
+	}
+	if _, err := os.Stat(storeDir); err != nil {
+		return nil, err
+	}
+	return report.NewStore(storeDir)
+}
+
+func dmarcReportsList(cmd *cobra.Command, args []string) error {
+	store, err := openReportsStore(cmd)
+	if err != nil {
+		return err
+	}
+	domains, err := store.Domains()
+	if err != nil {
+		return err
+	}
+	if len(domains) == 0 {
+		fmt.Fprintln(os.Stderr, "No pending reports.")
+		return nil
+	}
+	for _, domain := range domains {
+		entries, err := store.Read(domain)
+		if err != nil {
+			return err
+		}
+		since := "-"
+		if len(entries) != 0 {
+			since = entries[0].Time.Local().Format(time.RFC3339)
+		}
+		fmt.Printf("%s\t%d messages\tsince %s\n", domain, len(entries), since)
+	}
+	return nil
+}
+
+func dmarcReportsPreview(cmd *cobra.Command, args []string) error {
+	store, err := openReportsStore(cmd)
+	if err != nil {
+		return err
+	}
+	orgName, _ := cmd.Flags().GetString("org-name")
+	email, _ := cmd.Flags().GetString("email")
+
+	fb, err := report.Preview(store, report.Metadata{
+		OrgName:  orgName,
+		Email:    email,
+		ReportID: "preview",
+	}, args[0], time.Now())
+	if err != nil {
+		return err
+	}
+	blob, err := fb.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(blob)
+	return err
+}
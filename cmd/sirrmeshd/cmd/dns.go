@@ -13,11 +13,16 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	parser "github.com/sirrchat/SirrMesh/framework/cfgparser"
+	"github.com/sirrchat/SirrMesh/framework/config"
 	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/endpoint/mtasts"
+	"github.com/sirrchat/SirrMesh/internal/modify/dkim"
 	"github.com/spf13/cobra"
 )
 
@@ -27,8 +32,113 @@ type DNSConfig struct {
 	ServerIP        string
 	ServerIPv6      string
 	DKIMPublicKey   string
+	DKIMKeys        []DKIMKeyRecord // 启用密钥轮换时的所有已发布选择器
 	PostmasterEmail string
-	DMARCPolicy     string // none, quarantine, reject
+	DMARCPolicy     string         // none, quarantine, reject
+	MTASTSPolicy    *mtasts.Policy // 由mta_sts端点提供的策略，未配置时为nil
+	ClientEndpoints []module.ClientEndpoint // imap和submission端点的监听地址，用于SRV记录
+}
+
+// SRVRecord is an RFC 6186 service record for mail clients.
+type SRVRecord struct {
+	Name     string // e.g. _imaps._tcp.example.org
+	Priority int
+	Weight   int
+	Port     int
+	Target   string
+}
+
+// srvRecords returns SRV records for the configured imap and submission
+// endpoints. Implicit TLS endpoints get a higher priority (RFC 8314).
+func (cfg *DNSConfig) srvRecords() []SRVRecord {
+	records := make([]SRVRecord, 0, len(cfg.ClientEndpoints))
+	for _, e := range cfg.ClientEndpoints {
+		priority := 10
+		if e.TLS {
+			priority = 0
+		}
+		records = append(records, SRVRecord{
+			Name:     e.SRVName() + "." + cfg.PrimaryDomain,
+			Priority: priority,
+			Weight:   1,
+			Port:     e.Port,
+			Target:   cfg.Hostname,
+		})
+	}
+	return records
+}
+
+// clientEndpointsFromConfig returns listeners of the imap and submission
+// endpoint blocks.
+func clientEndpointsFromConfig(nodes []config.Node) []module.ClientEndpoint {
+	var endps []module.ClientEndpoint
+	for _, node := range nodes {
+		var protocol string
+		switch node.Name {
+		case "imap":
+			protocol = module.ClientIMAP
+		case "submission":
+			protocol = module.ClientSubmission
+		default:
+			continue
+		}
+		for _, arg := range node.Args {
+			addr, err := config.ParseEndpoint(arg)
+			if err != nil {
+				continue
+			}
+			if e, ok := module.NewClientEndpoint(protocol, addr, true); ok {
+				endps = append(endps, e)
+			}
+		}
+	}
+	module.SortClientEndpoints(endps)
+	sort.SliceStable(endps, func(i, j int) bool {
+		return endps[i].Protocol < endps[j].Protocol
+	})
+	return endps
+}
+
+// mtastsRecord returns the _mta-sts TXT record value. The id follows the
+// policy served by the mta_sts endpoint, if configured.
+func (cfg *DNSConfig) mtastsRecord() string {
+	if cfg.MTASTSPolicy != nil {
+		return cfg.MTASTSPolicy.Record()
+	}
+	return "v=STSv1; id=1"
+}
+
+// DKIMKeyRecord is a DKIM selector to be published in DNS.
+type DKIMKeyRecord struct {
+	Selector string
+	Record   string
+	State    string // active, pending, retiring
+}
+
+// dkimRecords returns DKIM records to export. Keys from the modify.dkim key
+// ring are used if key rotation is enabled.
+func (cfg *DNSConfig) dkimRecords() []DKIMKeyRecord {
+	if len(cfg.DKIMKeys) != 0 {
+		return cfg.DKIMKeys
+	}
+	return []DKIMKeyRecord{{Selector: "default", Record: cfg.DKIMPublicKey, State: dkim.KeyActive}}
+}
+
+// loadDKIMKeyRing reads keys managed by modify.dkim key rotation.
+func loadDKIMKeyRing(domain string) ([]DKIMKeyRecord, error) {
+	ring, err := dkim.LoadKeyRing(dkim.KeyRingPath(filepath.Join(ConfigDirectory, "dkim_keys"), domain))
+	if err != nil {
+		return nil, err
+	}
+	records := make([]DKIMKeyRecord, 0, len(ring.Keys))
+	for _, key := range ring.Keys {
+		records = append(records, DKIMKeyRecord{
+			Selector: key.Selector,
+			Record:   key.Record,
+			State:    key.State,
+		})
+	}
+	return records, nil
 }
 
 func NewDNSCmd() *cobra.Command {
@@ -42,6 +152,7 @@ func NewDNSCmd() *cobra.Command {
 		NewDNSGuideCmd(),
 		NewDNSCheckCmd(),
 		NewDNSExportCmd(),
+		NewDNSApplyCmd(),
 	)
 
 	return cmd
@@ -56,16 +167,6 @@ func NewDNSGuideCmd() *cobra.Command {
 	}
 }
 
-func NewDNSCheckCmd() *cobra.Command {
-	return &cobra.Command{
-		Use:   "check [domain]",
-		Short: "Check DNS configuration",
-		Long:  `Verify that DNS records are correctly configured for the mail server`,
-		Args:  cobra.MaximumNArgs(1),
-		RunE:  runDNSCheck,
-	}
-}
-
 func NewDNSExportCmd() *cobra.Command {
 	return &cobra.Command{
 		Use:   "export",
@@ -270,11 +371,37 @@ func loadDNSConfig() (*DNSConfig, error) {
 		postmasterEmail = fmt.Sprintf("postmaster@%s", primaryDomain)
 	}
 
-	// 确保DKIM密钥存在，使用默认选择器"default"
-	dkimPublicKey, err := ensureDKIMKeys(primaryDomain, "default")
+	// 启用密钥轮换时使用密钥环中的选择器，否则确保默认选择器"default"的密钥存在
+	dkimKeys, err := loadDKIMKeyRing(primaryDomain)
 	if err != nil {
-		log.Printf("Warning: Failed to ensure DKIM keys: %v", err)
-		dkimPublicKey = "YOUR_DKIM_PUBLIC_KEY"
+		log.Printf("Warning: Failed to read DKIM key ring: %v", err)
+	}
+	dkimPublicKey := ""
+	for _, key := range dkimKeys {
+		if key.State == dkim.KeyActive {
+			dkimPublicKey = key.Record
+			break
+		}
+	}
+	if dkimPublicKey == "" {
+		dkimPublicKey, err = ensureDKIMKeys(primaryDomain, "default")
+		if err != nil {
+			log.Printf("Warning: Failed to ensure DKIM keys: %v", err)
+			dkimPublicKey = "YOUR_DKIM_PUBLIC_KEY"
+		}
+	}
+
+	// 读取mta_sts端点的策略以生成对应的_mta-sts记录ID
+	var mtastsPolicy *mtasts.Policy
+	for _, node := range cfg {
+		if node.Name != "mta_sts" {
+			continue
+		}
+		mtastsPolicy, err = mtasts.ReadPolicy(map[string]interface{}{"hostname": hostname}, node)
+		if err != nil {
+			log.Printf("Warning: Failed to read mta_sts policy: %v", err)
+		}
+		break
 	}
 
 	return &DNSConfig{
@@ -283,7 +410,10 @@ func loadDNSConfig() (*DNSConfig, error) {
 		ServerIP:        serverIP,
 		ServerIPv6:      serverIPv6,
 		DKIMPublicKey:   dkimPublicKey,
+		DKIMKeys:        dkimKeys,
 		PostmasterEmail: postmasterEmail,
+		MTASTSPolicy:    mtastsPolicy,
+		ClientEndpoints: clientEndpointsFromConfig(cfg),
 	}, nil
 }
 
@@ -497,8 +627,10 @@ func runDNSGuide(cmd *cobra.Command, args []string) error {
 	
 	// DKIM记录
 	fmt.Println("; === DKIM记录 - 邮件签名验证 ===")
-	dkimHost := fmt.Sprintf("default._domainkey.%s", cfg.PrimaryDomain)
-	printDNSRecord(dkimHost, "TXT", fmt.Sprintf("\"%s\"", cfg.DKIMPublicKey), "")
+	for _, key := range cfg.dkimRecords() {
+		dkimHost := fmt.Sprintf("%s._domainkey.%s", key.Selector, cfg.PrimaryDomain)
+		printDNSRecord(dkimHost, "TXT", fmt.Sprintf("\"%s\"", key.Record), key.State)
+	}
 	fmt.Println()
 	
 	// DMARC记录
@@ -515,7 +647,7 @@ func runDNSGuide(cmd *cobra.Command, args []string) error {
 	// MTA-STS和TLSRPT记录
 	fmt.Println("; === MTA-STS和TLSRPT记录 - 强制TLS传输（推荐） ===")
 	mtastsHost := fmt.Sprintf("_mta-sts.%s", cfg.PrimaryDomain)
-	printDNSRecord(mtastsHost, "TXT", "\"v=STSv1; id=1\"", "MTA-STS策略声明")
+	printDNSRecord(mtastsHost, "TXT", "\""+cfg.mtastsRecord()+"\"", "MTA-STS策略声明")
 	
 	tlsrptHost := fmt.Sprintf("_smtp._tls.%s", cfg.PrimaryDomain)
 	tlsrptValue := fmt.Sprintf("\"v=TLSRPTv1; rua=mailto:%s\"", cfg.PostmasterEmail)
@@ -529,13 +661,23 @@ func runDNSGuide(cmd *cobra.Command, args []string) error {
 	fmt.Printf("   联系服务器提供商设置 IP %s 的PTR记录为: %s\n", cfg.ServerIP, cfg.Hostname)
 	
 	fmt.Println("\n2. MTA-STS策略文件:")
-	fmt.Printf("   在 https://mta-sts.%s/.well-known/mta-sts.txt 提供以下内容:\n", cfg.PrimaryDomain)
-	fmt.Println("   ---")
-	fmt.Println("   version: STSv1")
-	fmt.Println("   mode: enforce")
-	fmt.Printf("   mx: %s\n", cfg.Hostname)
-	fmt.Println("   max_age: 604800")
-	fmt.Println("   ---")
+	if cfg.MTASTSPolicy != nil {
+		fmt.Printf("   mta_sts 端点在 https://mta-sts.%s/.well-known/mta-sts.txt 提供以下内容:\n", cfg.PrimaryDomain)
+		fmt.Println("   ---")
+		for _, line := range strings.Split(strings.TrimSpace(cfg.MTASTSPolicy.String()), "\r\n") {
+			fmt.Printf("   %s\n", line)
+		}
+		fmt.Println("   ---")
+		fmt.Printf("   请将 mta-sts.%s 解析到本服务器，并加入ACME的 extra_names\n", cfg.PrimaryDomain)
+	} else {
+		fmt.Printf("   在 https://mta-sts.%s/.well-known/mta-sts.txt 提供以下内容（或配置 mta_sts 端点）:\n", cfg.PrimaryDomain)
+		fmt.Println("   ---")
+		fmt.Println("   version: STSv1")
+		fmt.Println("   mode: enforce")
+		fmt.Printf("   mx: %s\n", cfg.Hostname)
+		fmt.Println("   max_age: 604800")
+		fmt.Println("   ---")
+	}
 	
 	fmt.Println("\n3. 防火墙端口:")
 	fmt.Println("   确保开放: 25 (SMTP), 465 (SMTPS), 587 (Submission), 143 (IMAP), 993 (IMAPS)")
@@ -553,457 +695,6 @@ func runDNSGuide(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-type DNSRecord struct {
-	RecordType string   // 记录类型: A, AAAA, MX, TXT等
-	Name       string   // 记录名称/主机名
-	Content    []string // 记录内容
-	Priority   uint16   // MX记录优先级
-	Status     string   // 查询状态: OK, NOT_FOUND, ERROR
-	Error      string   // 错误信息
-}
-
-func runDNSCheck(cmd *cobra.Command, args []string) error {
-	var domain string
-	
-	if len(args) > 0 {
-		domain = args[0]
-	} else {
-		cfg, err := loadDNSConfig()
-		if err != nil {
-			return fmt.Errorf("请指定域名或确保配置文件存在: %v", err)
-		}
-		domain = cfg.PrimaryDomain
-	}
-
-	fmt.Printf("\n正在检查域名 %s 的DNS配置...\n", domain)
-	fmt.Println("================================================================================")
-
-	var records []DNSRecord
-	
-	// 检查A记录
-	fmt.Printf("查询 A 记录...")
-	aIPs := []string{}
-	ips, err := net.LookupIP(domain)
-	if err != nil {
-		records = append(records, DNSRecord{
-			RecordType: "A",
-			Name:       domain,
-			Status:     "ERROR",
-			Error:      err.Error(),
-		})
-		fmt.Println(" ❌")
-	} else {
-		for _, ip := range ips {
-			if ip.To4() != nil {
-				aIPs = append(aIPs, ip.String())
-			}
-		}
-		if len(aIPs) > 0 {
-			records = append(records, DNSRecord{
-				RecordType: "A",
-				Name:       domain,
-				Content:    aIPs,
-				Status:     "OK",
-			})
-			fmt.Println(" ✅")
-		} else {
-			records = append(records, DNSRecord{
-				RecordType: "A",
-				Name:       domain,
-				Status:     "NOT_FOUND",
-				Error:      "未找到IPv4地址",
-			})
-			fmt.Println(" ❌")
-		}
-	}
-	
-	// 检查AAAA记录
-	fmt.Printf("查询 AAAA 记录...")
-	aaaaIPs := []string{}
-	for _, ip := range ips {
-		if ip.To4() == nil && ip.To16() != nil {
-			aaaaIPs = append(aaaaIPs, ip.String())
-		}
-	}
-	if len(aaaaIPs) > 0 {
-		records = append(records, DNSRecord{
-			RecordType: "AAAA",
-			Name:       domain,
-			Content:    aaaaIPs,
-			Status:     "OK",
-		})
-		fmt.Println(" ✅")
-	} else {
-		fmt.Println(" ⚪ (可选)")
-	}
-
-	// 检查MX记录
-	fmt.Printf("查询 MX 记录...")
-	mxHosts := []string{}
-	mxRecords, err := net.LookupMX(domain)
-	if err != nil {
-		records = append(records, DNSRecord{
-			RecordType: "MX",
-			Name:       domain,
-			Status:     "ERROR",
-			Error:      err.Error(),
-		})
-		fmt.Println(" ❌")
-	} else if len(mxRecords) == 0 {
-		records = append(records, DNSRecord{
-			RecordType: "MX",
-			Name:       domain,
-			Status:     "NOT_FOUND",
-			Error:      "未找到MX记录",
-		})
-		fmt.Println(" ❌")
-	} else {
-		for _, mx := range mxRecords {
-			mxHost := strings.TrimSuffix(mx.Host, ".")
-			mxHosts = append(mxHosts, mxHost)
-			records = append(records, DNSRecord{
-				RecordType: "MX",
-				Name:       domain,
-				Content:    []string{mxHost},
-				Priority:   mx.Pref,
-				Status:     "OK",
-			})
-		}
-		fmt.Println(" ✅")
-	}
-	
-	// 检查MX主机的A/AAAA记录
-	for _, mxHost := range mxHosts {
-		fmt.Printf("查询 %s 的 A/AAAA 记录...", mxHost)
-		mxIPs, err := net.LookupIP(mxHost)
-		if err != nil {
-			records = append(records, DNSRecord{
-				RecordType: "A (MX主机)",
-				Name:       mxHost,
-				Status:     "ERROR",
-				Error:      err.Error(),
-			})
-			fmt.Println(" ❌")
-		} else {
-			mxA := []string{}
-			mxAAAA := []string{}
-			for _, ip := range mxIPs {
-				if ip.To4() != nil {
-					mxA = append(mxA, ip.String())
-				} else if ip.To16() != nil {
-					mxAAAA = append(mxAAAA, ip.String())
-				}
-			}
-			if len(mxA) > 0 {
-				records = append(records, DNSRecord{
-					RecordType: "A (MX主机)",
-					Name:       mxHost,
-					Content:    mxA,
-					Status:     "OK",
-				})
-			}
-			if len(mxAAAA) > 0 {
-				records = append(records, DNSRecord{
-					RecordType: "AAAA (MX主机)",
-					Name:       mxHost,
-					Content:    mxAAAA,
-					Status:     "OK",
-				})
-			}
-			if len(mxA) > 0 || len(mxAAAA) > 0 {
-				fmt.Println(" ✅")
-			} else {
-				records = append(records, DNSRecord{
-					RecordType: "A/AAAA (MX主机)",
-					Name:       mxHost,
-					Status:     "NOT_FOUND",
-					Error:      "MX主机无IP地址",
-				})
-				fmt.Println(" ❌")
-			}
-		}
-		
-		// 检查MX主机的SPF记录
-		fmt.Printf("查询 %s 的 SPF 记录...", mxHost)
-		mxTxt, _ := net.LookupTXT(mxHost)
-		mxSpfFound := false
-		for _, txt := range mxTxt {
-			if strings.HasPrefix(txt, "v=spf1") {
-				records = append(records, DNSRecord{
-					RecordType: "TXT (MX SPF)",
-					Name:       mxHost,
-					Content:    []string{txt},
-					Status:     "OK",
-				})
-				mxSpfFound = true
-				break
-			}
-		}
-		if mxSpfFound {
-			fmt.Println(" ✅")
-		} else {
-			fmt.Println(" ⚪ (推荐)")
-		}
-	}
-
-	// 检查TXT记录（SPF）
-	fmt.Printf("查询 SPF 记录...")
-	txtRecords, _ := net.LookupTXT(domain)
-	spfFound := false
-	for _, txt := range txtRecords {
-		if strings.HasPrefix(txt, "v=spf1") {
-			records = append(records, DNSRecord{
-				RecordType: "TXT (SPF)",
-				Name:       domain,
-				Content:    []string{txt},
-				Status:     "OK",
-			})
-			spfFound = true
-		}
-	}
-	if spfFound {
-		fmt.Println(" ✅")
-	} else {
-		records = append(records, DNSRecord{
-			RecordType: "TXT (SPF)",
-			Name:       domain,
-			Status:     "NOT_FOUND",
-			Error:      "未找到SPF记录",
-		})
-		fmt.Println(" ❌")
-	}
-
-	// 检查DKIM记录
-	fmt.Printf("查询 DKIM 记录...")
-	dkimDomain := fmt.Sprintf("default._domainkey.%s", domain)
-	dkimTxt, err := net.LookupTXT(dkimDomain)
-	dkimFound := false
-	if err == nil && len(dkimTxt) > 0 {
-		for _, txt := range dkimTxt {
-			if strings.Contains(txt, "DKIM1") || strings.Contains(txt, "k=rsa") {
-				// 截断过长的DKIM公钥显示
-				displayTxt := txt
-				if len(txt) > 100 {
-					displayTxt = txt[:97] + "..."
-				}
-				records = append(records, DNSRecord{
-					RecordType: "TXT (DKIM)",
-					Name:       dkimDomain,
-					Content:    []string{displayTxt},
-					Status:     "OK",
-				})
-				dkimFound = true
-				break
-			}
-		}
-	}
-	if dkimFound {
-		fmt.Println(" ✅")
-	} else {
-		records = append(records, DNSRecord{
-			RecordType: "TXT (DKIM)",
-			Name:       dkimDomain,
-			Status:     "NOT_FOUND",
-			Error:      "未找到DKIM记录",
-		})
-		fmt.Println(" ❌")
-	}
-
-	// 检查DMARC记录
-	fmt.Printf("查询 DMARC 记录...")
-	dmarcDomain := fmt.Sprintf("_dmarc.%s", domain)
-	dmarcTxt, err := net.LookupTXT(dmarcDomain)
-	dmarcFound := false
-	if err == nil && len(dmarcTxt) > 0 {
-		for _, txt := range dmarcTxt {
-			if strings.Contains(txt, "DMARC1") {
-				records = append(records, DNSRecord{
-					RecordType: "TXT (DMARC)",
-					Name:       dmarcDomain,
-					Content:    []string{txt},
-					Status:     "OK",
-				})
-				dmarcFound = true
-				break
-			}
-		}
-	}
-	if dmarcFound {
-		fmt.Println(" ✅")
-	} else {
-		records = append(records, DNSRecord{
-			RecordType: "TXT (DMARC)",
-			Name:       dmarcDomain,
-			Status:     "NOT_FOUND",
-			Error:      "未找到DMARC记录",
-		})
-		fmt.Println(" ❌")
-	}
-
-	// 检查MTA-STS记录
-	fmt.Printf("查询 MTA-STS 记录...")
-	mtastsDomain := fmt.Sprintf("_mta-sts.%s", domain)
-	mtastsTxt, err := net.LookupTXT(mtastsDomain)
-	mtastsFound := false
-	if err == nil && len(mtastsTxt) > 0 {
-		for _, txt := range mtastsTxt {
-			if strings.Contains(txt, "STSv1") {
-				records = append(records, DNSRecord{
-					RecordType: "TXT (MTA-STS)",
-					Name:       mtastsDomain,
-					Content:    []string{txt},
-					Status:     "OK",
-				})
-				mtastsFound = true
-				break
-			}
-		}
-	}
-	if mtastsFound {
-		fmt.Println(" ✅")
-	} else {
-		fmt.Println(" ⚪ (推荐)")
-	}
-	
-	// 检查TLSRPT记录
-	fmt.Printf("查询 TLSRPT 记录...")
-	tlsrptDomain := fmt.Sprintf("_smtp._tls.%s", domain)
-	tlsrptTxt, err := net.LookupTXT(tlsrptDomain)
-	tlsrptFound := false
-	if err == nil && len(tlsrptTxt) > 0 {
-		for _, txt := range tlsrptTxt {
-			if strings.Contains(txt, "TLSRPTv1") {
-				records = append(records, DNSRecord{
-					RecordType: "TXT (TLSRPT)",
-					Name:       tlsrptDomain,
-					Content:    []string{txt},
-					Status:     "OK",
-				})
-				tlsrptFound = true
-				break
-			}
-		}
-	}
-	if tlsrptFound {
-		fmt.Println(" ✅")
-	} else {
-		fmt.Println(" ⚪ (推荐)")
-	}
-
-	// 检查PTR记录（反向DNS）
-	if len(aIPs) > 0 {
-		fmt.Printf("查询 PTR 记录...")
-		ptrFound := false
-		for _, ip := range aIPs {
-			names, err := net.LookupAddr(ip)
-			if err == nil && len(names) > 0 {
-				records = append(records, DNSRecord{
-					RecordType: "PTR",
-					Name:       ip,
-					Content:    names,
-					Status:     "OK",
-				})
-				ptrFound = true
-				break
-			}
-		}
-		if ptrFound {
-			fmt.Println(" ✅")
-		} else {
-			records = append(records, DNSRecord{
-				RecordType: "PTR",
-				Name:       aIPs[0],
-				Status:     "NOT_FOUND",
-				Error:      "未配置反向DNS",
-			})
-			fmt.Println(" ⚠️")
-		}
-	}
-
-	// 打印详细结果表格
-	fmt.Println("\n================================================================================")
-	fmt.Println("DNS查询详细结果:")
-	fmt.Println("================================================================================")
-	fmt.Printf("%-12s %-8s %-35s %s\n", "记录类型", "状态", "名称", "内容")
-	fmt.Println("--------------------------------------------------------------------------------")
-	
-	allPass := true
-	warningCount := 0
-	for _, record := range records {
-		statusSymbol := "✅"
-		statusText := "正常"
-		if record.Status == "NOT_FOUND" {
-			statusSymbol = "❌"
-			statusText = "缺失"
-			if record.RecordType != "PTR" {
-				allPass = false
-			} else {
-				warningCount++
-			}
-		} else if record.Status == "ERROR" {
-			statusSymbol = "❌"
-			statusText = "错误"
-			allPass = false
-		}
-		
-		// 格式化名称，截断过长的部分
-		displayName := record.Name
-		if len(displayName) > 33 {
-			displayName = displayName[:30] + "..."
-		}
-		
-		// 打印记录
-		if len(record.Content) > 0 {
-			for i, content := range record.Content {
-				if i == 0 {
-					if record.RecordType == "MX" && record.Priority > 0 {
-						fmt.Printf("%-12s %s %-6s %-35s 优先级:%d %s\n", 
-							record.RecordType, statusSymbol, statusText, displayName, record.Priority, content)
-					} else {
-						fmt.Printf("%-12s %s %-6s %-35s %s\n", 
-							record.RecordType, statusSymbol, statusText, displayName, content)
-					}
-				} else {
-					// 多个内容的记录，后续行缩进显示
-					fmt.Printf("%-12s %-8s %-35s %s\n", "", "", "", content)
-				}
-			}
-		} else {
-			// 没有内容的记录（错误或未找到）
-			errorMsg := record.Error
-			if errorMsg == "" {
-				errorMsg = "无数据"
-			}
-			fmt.Printf("%-12s %s %-6s %-35s %s\n", 
-				record.RecordType, statusSymbol, statusText, displayName, errorMsg)
-		}
-	}
-	
-	fmt.Println("================================================================================")
-	
-	// 打印总结
-	fmt.Println("\n检查总结:")
-	fmt.Println("--------------------------------------------------------------------------------")
-	if allPass && warningCount == 0 {
-		fmt.Println("✅ 所有DNS记录配置正确！邮件服务器DNS配置完整。")
-	} else if allPass && warningCount > 0 {
-		fmt.Println("⚠️  基本DNS记录已配置，但建议配置反向DNS(PTR)记录以提高邮件送达率。")
-		fmt.Println("   请联系您的服务器提供商设置PTR记录。")
-	} else {
-		fmt.Println("❌ 部分必要的DNS记录缺失或配置错误。")
-		fmt.Println("   运行 'sirrmeshd dns guide' 查看完整配置指南。")
-		fmt.Println("\n缺失的记录:")
-		for _, record := range records {
-			if record.Status == "NOT_FOUND" && record.RecordType != "PTR" {
-				fmt.Printf("   - %s (%s)\n", record.RecordType, record.Name)
-			}
-		}
-	}
-	fmt.Println("================================================================================")
-
-	return nil
-}
-
 func runDNSExport(cmd *cobra.Command, args []string) error {
 	cfg, err := loadDNSConfig()
 	if err != nil {
@@ -1097,6 +788,7 @@ func promptForConfiguration(cfg *DNSConfig, reader *bufio.Reader) *DNSConfig {
 	// 如果域名或主机名发生变化，重新生成DKIM密钥
 	if newCfg.PrimaryDomain != cfg.PrimaryDomain || newCfg.Hostname != cfg.Hostname {
 		fmt.Printf("4. 检测到域名变化，重新生成DKIM密钥...\n")
+		newCfg.DKIMKeys = nil
 		if dkimKey, err := ensureDKIMKeys(newCfg.PrimaryDomain, "default"); err == nil {
 			newCfg.DKIMPublicKey = dkimKey
 			fmt.Printf("   ✅ 已生成新的DKIM密钥\n")
@@ -1113,6 +805,7 @@ func promptForConfiguration(cfg *DNSConfig, reader *bufio.Reader) *DNSConfig {
 		}
 		if input := readInput(reader); input != "" {
 			newCfg.DKIMPublicKey = input
+			newCfg.DKIMKeys = nil
 		}
 	}
 	
@@ -1255,8 +948,10 @@ func exportStandardZoneFormat(cfg *DNSConfig) {
 
 	// DKIM Records
 	fmt.Println("; TXT Records (DKIM)")
-	dkimHost := fmt.Sprintf("default._domainkey.%s.", cfg.PrimaryDomain)
-	fmt.Printf("%-40s IN  TXT    \"%s\"\n", dkimHost, cfg.DKIMPublicKey)
+	for _, key := range cfg.dkimRecords() {
+		dkimHost := fmt.Sprintf("%s._domainkey.%s.", key.Selector, cfg.PrimaryDomain)
+		fmt.Printf("%-40s IN  TXT    \"%s\" ; %s\n", dkimHost, key.Record, key.State)
+	}
 	fmt.Println()
 
 	// DMARC Records
@@ -1272,10 +967,19 @@ func exportStandardZoneFormat(cfg *DNSConfig) {
 	// MTA-STS and TLSRPT Records
 	fmt.Println("; TXT Records (MTA-STS & TLSRPT)")
 	mtastsHost := fmt.Sprintf("_mta-sts.%s.", cfg.PrimaryDomain)
-	fmt.Printf("%-40s IN  TXT    \"v=STSv1; id=1\"\n", mtastsHost)
+	fmt.Printf("%-40s IN  TXT    \"%s\"\n", mtastsHost, cfg.mtastsRecord())
 	tlsrptHost := fmt.Sprintf("_smtp._tls.%s.", cfg.PrimaryDomain)
 	fmt.Printf("%-40s IN  TXT    \"v=TLSRPTv1; rua=mailto:%s\"\n", tlsrptHost, cfg.PostmasterEmail)
 
+	// SRV Records (RFC 6186)
+	if srv := cfg.srvRecords(); len(srv) != 0 {
+		fmt.Println()
+		fmt.Println("; SRV Records (Mail Client Discovery)")
+		for _, rec := range srv {
+			fmt.Printf("%-40s IN  SRV    %d %d %d %s.\n", rec.Name+".", rec.Priority, rec.Weight, rec.Port, rec.Target)
+		}
+	}
+
 	fmt.Println("\n; ================================================================================")
 }
 
@@ -1301,7 +1005,9 @@ func exportBINDFormat(cfg *DNSConfig) {
 	fmt.Printf("%s.    IN    TXT    \"v=spf1 a ~all\"\n", cfg.Hostname)
 	fmt.Println()
 	fmt.Println("; DKIM record")
-	fmt.Printf("default._domainkey.%s.    IN    TXT    \"%s\"\n", cfg.PrimaryDomain, cfg.DKIMPublicKey)
+	for _, key := range cfg.dkimRecords() {
+		fmt.Printf("%s._domainkey.%s.    IN    TXT    \"%s\" ; %s\n", key.Selector, cfg.PrimaryDomain, key.Record, key.State)
+	}
 	fmt.Println()
 	fmt.Println("; DMARC record")
 	dmarcPolicy := cfg.DMARCPolicy
@@ -1311,8 +1017,15 @@ func exportBINDFormat(cfg *DNSConfig) {
 	fmt.Printf("_dmarc.%s.    IN    TXT    \"v=DMARC1; p=%s; ruf=mailto:%s\"\n", cfg.PrimaryDomain, dmarcPolicy, cfg.PostmasterEmail)
 	fmt.Println()
 	fmt.Println("; MTA-STS and TLSRPT records")
-	fmt.Printf("_mta-sts.%s.    IN    TXT    \"v=STSv1; id=1\"\n", cfg.PrimaryDomain)
+	fmt.Printf("_mta-sts.%s.    IN    TXT    \"%s\"\n", cfg.PrimaryDomain, cfg.mtastsRecord())
 	fmt.Printf("_smtp._tls.%s.    IN    TXT    \"v=TLSRPTv1; rua=mailto:%s\"\n", cfg.PrimaryDomain, cfg.PostmasterEmail)
+	if srv := cfg.srvRecords(); len(srv) != 0 {
+		fmt.Println()
+		fmt.Println("; SRV records for mail clients (RFC 6186)")
+		for _, rec := range srv {
+			fmt.Printf("%s.    IN    SRV    %d %d %d %s.\n", rec.Name, rec.Priority, rec.Weight, rec.Port, rec.Target)
+		}
+	}
 }
 
 func exportCloudFlareFormat(cfg *DNSConfig) {
@@ -1341,7 +1054,9 @@ func exportCloudFlareFormat(cfg *DNSConfig) {
 	// TXT Records - All in one section
 	fmt.Println(";; TXT Records")
 	// DKIM
-	fmt.Printf("default._domainkey.%s.\t1\tIN\tTXT\t\"%s\"\n", cfg.PrimaryDomain, cfg.DKIMPublicKey)
+	for _, key := range cfg.dkimRecords() {
+		fmt.Printf("%s._domainkey.%s.\t1\tIN\tTXT\t\"%s\"\n", key.Selector, cfg.PrimaryDomain, key.Record)
+	}
 	// SPF
 	fmt.Printf("%s.\t1\tIN\tTXT\t\"v=spf1 mx ~all\"\n", cfg.PrimaryDomain)
 	fmt.Printf("%s.\t1\tIN\tTXT\t\"v=spf1 a ~all\"\n", cfg.Hostname)
@@ -1352,10 +1067,18 @@ func exportCloudFlareFormat(cfg *DNSConfig) {
 	}
 	fmt.Printf("_dmarc.%s.\t1\tIN\tTXT\t\"v=DMARC1; p=%s; ruf=mailto:%s\"\n", cfg.PrimaryDomain, dmarcPolicy, cfg.PostmasterEmail)
 	// MTA-STS and TLSRPT
-	fmt.Printf("_mta-sts.%s.\t1\tIN\tTXT\t\"v=STSv1; id=1\"\n", cfg.PrimaryDomain)
+	fmt.Printf("_mta-sts.%s.\t1\tIN\tTXT\t\"%s\"\n", cfg.PrimaryDomain, cfg.mtastsRecord())
 	fmt.Printf("_smtp._tls.%s.\t1\tIN\tTXT\t\"v=TLSRPTv1; rua=mailto:%s\"\n", cfg.PrimaryDomain, cfg.PostmasterEmail)
 	fmt.Println()
 
+	if srv := cfg.srvRecords(); len(srv) != 0 {
+		fmt.Println(";; SRV Records")
+		for _, rec := range srv {
+			fmt.Printf("%s.\t1\tIN\tSRV\t%d %d %d %s.\n", rec.Name, rec.Priority, rec.Weight, rec.Port, rec.Target)
+		}
+		fmt.Println()
+	}
+
 	// Print reminder after the records
 	fmt.Println(";; IMPORTANT: After import, edit the A record for the mail server")
 	fmt.Println(";; and DISABLE the Cloudflare proxy (change orange cloud to grey).")
@@ -1379,7 +1102,9 @@ func exportGenericFormat(cfg *DNSConfig) {
 	fmt.Println("安全相关记录:")
 	fmt.Printf("SPF记录 (主域名TXT):\n  主机: %s\n  值: v=spf1 mx ~all\n", cfg.PrimaryDomain)
 	fmt.Printf("\nSPF记录 (MX主机TXT):\n  主机: %s\n  值: v=spf1 a ~all\n", cfg.Hostname)
-	fmt.Printf("\nDKIM记录 (TXT):\n  主机: default._domainkey.%s\n  值: %s\n", cfg.PrimaryDomain, cfg.DKIMPublicKey)
+	for _, key := range cfg.dkimRecords() {
+		fmt.Printf("\nDKIM记录 (TXT, %s):\n  主机: %s._domainkey.%s\n  值: %s\n", key.State, key.Selector, cfg.PrimaryDomain, key.Record)
+	}
 	dmarcPolicy := cfg.DMARCPolicy
 	if dmarcPolicy == "" {
 		dmarcPolicy = "quarantine"
@@ -1387,7 +1112,14 @@ func exportGenericFormat(cfg *DNSConfig) {
 	fmt.Printf("\nDMARC记录 (TXT):\n  主机: _dmarc.%s\n  值: v=DMARC1; p=%s; ruf=mailto:%s\n", cfg.PrimaryDomain, dmarcPolicy, cfg.PostmasterEmail)
 	fmt.Println("\n--------------------------------------------------------------------------------")
 	fmt.Println("TLS安全记录 (推荐):")
-	fmt.Printf("MTA-STS记录 (TXT):\n  主机: _mta-sts.%s\n  值: v=STSv1; id=1\n", cfg.PrimaryDomain)
+	fmt.Printf("MTA-STS记录 (TXT):\n  主机: _mta-sts.%s\n  值: %s\n", cfg.PrimaryDomain, cfg.mtastsRecord())
 	fmt.Printf("\nTLSRPT记录 (TXT):\n  主机: _smtp._tls.%s\n  值: v=TLSRPTv1; rua=mailto:%s\n", cfg.PrimaryDomain, cfg.PostmasterEmail)
+	if srv := cfg.srvRecords(); len(srv) != 0 {
+		fmt.Println("\n--------------------------------------------------------------------------------")
+		fmt.Println("邮件客户端自动发现记录 (SRV, RFC 6186):")
+		for _, rec := range srv {
+			fmt.Printf("\nSRV记录:\n  主机: %s\n  优先级: %d\n  权重: %d\n  端口: %d\n  目标: %s\n", rec.Name, rec.Priority, rec.Weight, rec.Port, rec.Target)
+		}
+	}
 	fmt.Println("================================================================================")
 }
\ No newline at end of file
@@ -0,0 +1,264 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	sirrlibdns "github.com/sirrchat/SirrMesh/internal/libdns"
+	"github.com/spf13/cobra"
+	"golang.org/x/net/publicsuffix"
+)
+
+func NewDNSApplyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "apply",
+		Short: "Publish DNS records using the DNS provider",
+		Long: `Compare records printed by 'dns export' with records in the zone and
+create or update them using the libdns provider configured in the top-level
+configuration block, e.g.:
+
+  libdns.cloudflare dns_provider {
+      api_token "..."
+  }
+
+TXT records with the same name and v= tag and MX records pointing to the
+mail server are replaced. Other records in the zone, including other
+records with the same name and type (e.g. backup MX), are not changed. The
+provider should support listing zone records.`,
+		Args: cobra.NoArgs,
+		RunE: runDNSApply,
+	}
+	cmd.Flags().String("cfg-block", "dns_provider", "Module configuration block to use")
+	cmd.Flags().String("zone", "", "DNS zone to update (default is the registered domain of the primary domain)")
+	cmd.Flags().Duration("ttl", time.Hour, "TTL of created records")
+	cmd.Flags().String("ip", "", "IPv4 address for the mail server A record (default is detected)")
+	cmd.Flags().String("ipv6", "", "IPv6 address for the mail server AAAA record (default is detected)")
+	cmd.Flags().String("tlsa-cert", "", "Publish a DANE-EE TLSA record for the certificate in the PEM file")
+	cmd.Flags().Bool("dry-run", false, "Only show changes")
+	cmd.Flags().BoolP("yes", "y", false, "Don't ask for confirmation")
+	return cmd
+}
+
+func openDNSProvider(cmd *cobra.Command) (*sirrlibdns.ProviderModule, error) {
+	globals, mod, err := getCfgBlockModule(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	p, ok := mod.Instance.(*sirrlibdns.ProviderModule)
+	if !ok {
+		cfgBlock, _ := cmd.Flags().GetString("cfg-block")
+		return nil, fmt.Errorf("configuration block %s is not a libdns provider", cfgBlock)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return p, nil
+}
+
+// readCertificate reads the first certificate in the PEM file.
+func readCertificate(certPath string) (*x509.Certificate, error) {
+	blob, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(blob)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s: no certificate found", certPath)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", certPath, err)
+	}
+	return cert, nil
+}
+
+// tlsaRecord returns the "3 1 1" TLSA record value for the first
+// certificate in the PEM file.
+func tlsaRecord(certPath string) (string, error) {
+	cert, err := readCertificate(certPath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "3 1 1 " + hex.EncodeToString(sum[:]), nil
+}
+
+func dmarcRecordValue(cfg *DNSConfig) string {
+	dmarcPolicy := cfg.DMARCPolicy
+	if dmarcPolicy == "" {
+		dmarcPolicy = "quarantine"
+	}
+	return fmt.Sprintf("v=DMARC1; p=%s; ruf=mailto:%s", dmarcPolicy, cfg.PostmasterEmail)
+}
+
+// desiredDNSRecords returns records from 'dns export' with names relative to
+// the zone. Names outside of the zone are returned separately.
+func desiredDNSRecords(cfg *DNSConfig, zone string, ttl time.Duration, tlsa string) (recs []libdns.Record, outside []string) {
+	add := func(typ, fqdn, value string, prio uint) {
+		fqdn = strings.ToLower(strings.TrimSuffix(fqdn, "."))
+		zoneName := strings.ToLower(strings.TrimSuffix(zone, "."))
+		var name string
+		switch {
+		case fqdn == zoneName:
+			name = "@"
+		case strings.HasSuffix(fqdn, "."+zoneName):
+			name = libdns.RelativeName(fqdn, zone)
+		default:
+			outside = append(outside, typ+" "+fqdn)
+			return
+		}
+		recs = append(recs, libdns.Record{Type: typ, Name: name, Value: value, TTL: ttl, Priority: prio})
+	}
+
+	if isValidIPv4(cfg.ServerIP) && !isPrivateIP(cfg.ServerIP) {
+		add("A", cfg.Hostname, cfg.ServerIP, 0)
+	}
+	if isValidIPv6(cfg.ServerIPv6) {
+		add("AAAA", cfg.Hostname, cfg.ServerIPv6, 0)
+	}
+	add("MX", cfg.PrimaryDomain, cfg.Hostname+".", 10)
+	add("TXT", cfg.PrimaryDomain, "v=spf1 mx ~all", 0)
+	add("TXT", cfg.Hostname, "v=spf1 a ~all", 0)
+	for _, key := range cfg.dkimRecords() {
+		add("TXT", key.Selector+"._domainkey."+cfg.PrimaryDomain, key.Record, 0)
+	}
+	add("TXT", "_dmarc."+cfg.PrimaryDomain, dmarcRecordValue(cfg), 0)
+	add("TXT", "_mta-sts."+cfg.PrimaryDomain, cfg.mtastsRecord(), 0)
+	add("TXT", "_smtp._tls."+cfg.PrimaryDomain, "v=TLSRPTv1; rua=mailto:"+cfg.PostmasterEmail, 0)
+	if tlsa != "" {
+		add("TLSA", "_25._tcp."+cfg.Hostname, tlsa, 0)
+	}
+	return recs, outside
+}
+
+func formatDNSRecord(rec libdns.Record) string {
+	value := rec.Value
+	if strings.EqualFold(rec.Type, "MX") && rec.Priority != 0 {
+		value = fmt.Sprintf("%d %s", rec.Priority, value)
+	}
+	return fmt.Sprintf("%s\t%s\t%s", rec.Name, rec.Type, value)
+}
+
+func runDNSApply(cmd *cobra.Command, _ []string) error {
+	cfg, err := loadDNSConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+	if cfg.Hostname == cfg.PrimaryDomain || !strings.Contains(cfg.Hostname, ".") {
+		cfg.Hostname = fmt.Sprintf("mx1.%s", cfg.PrimaryDomain)
+	}
+	if ip, _ := cmd.Flags().GetString("ip"); ip != "" {
+		cfg.ServerIP = ip
+	}
+	if ip, _ := cmd.Flags().GetString("ipv6"); ip != "" {
+		cfg.ServerIPv6 = ip
+	}
+
+	zone, _ := cmd.Flags().GetString("zone")
+	if zone == "" {
+		zone, err = publicsuffix.EffectiveTLDPlusOne(cfg.PrimaryDomain)
+		if err != nil {
+			return fmt.Errorf("cannot determine the zone, use --zone: %w", err)
+		}
+	}
+	zone = strings.TrimSuffix(zone, ".") + "."
+
+	var tlsa string
+	if certPath, _ := cmd.Flags().GetString("tlsa-cert"); certPath != "" {
+		tlsa, err = tlsaRecord(certPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	ttl, _ := cmd.Flags().GetDuration("ttl")
+	desired, outside := desiredDNSRecords(cfg, zone, ttl, tlsa)
+	for _, rec := range outside {
+		fmt.Fprintf(os.Stderr, "Skipping %s: not in zone %s\n", rec, zone)
+	}
+
+	provider, err := openDNSProvider(cmd)
+	if err != nil {
+		return err
+	}
+	defer closeIfNeeded(provider)
+
+	ctx := context.Background()
+	changes, err := sirrlibdns.Plan(ctx, provider, zone, desired)
+	if err != nil {
+		if errors.Is(err, sirrlibdns.ErrGetRecordsUnsupported) {
+			return fmt.Errorf("%w, use 'sirrmeshd dns export' and add records manually", err)
+		}
+		return err
+	}
+
+	pending := 0
+	for _, c := range changes {
+		switch c.Action {
+		case sirrlibdns.ActionNone:
+			fmt.Printf("ok\t%s\n", formatDNSRecord(c.Desired))
+		case sirrlibdns.ActionCreate:
+			fmt.Printf("create\t%s\n", formatDNSRecord(c.Desired))
+			pending++
+		case sirrlibdns.ActionUpdate:
+			fmt.Printf("update\t%s\n", formatDNSRecord(c.Desired))
+			for _, rec := range c.Existing {
+				fmt.Printf("\t(was %s)\n", formatDNSRecord(rec))
+			}
+			pending++
+		}
+		for _, rec := range c.Kept {
+			fmt.Printf("\t(keeping %s)\n", formatDNSRecord(rec))
+		}
+	}
+
+	if pending == 0 {
+		fmt.Fprintln(os.Stderr, "All records are up to date.")
+		return nil
+	}
+	if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+		return nil
+	}
+	if yes, _ := cmd.Flags().GetBool("yes"); !yes {
+		if !Confirmation(fmt.Sprintf("Apply %d changes to zone %s?", pending, zone), false) {
+			return fmt.Errorf("cancelled")
+		}
+	}
+
+	if err := sirrlibdns.Apply(ctx, provider, zone, changes); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Applied %d changes.\n", pending)
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/dns"
+	"github.com/sirrchat/SirrMesh/internal/dnscheck"
+	"github.com/spf13/cobra"
+)
+
+func NewDNSCheckCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "check [domain]",
+		Short: "Check DNS configuration",
+		Long: `Verify that DNS records are correctly configured for the mail server.
+
+Lookups use the same resolver as the server, with DNSSEC status reported for
+each record. Published DKIM keys are compared with the local key files, TLSA
+records with the certificate presented by the SMTP endpoint (or --tls-cert),
+and the MTA-STS policy is fetched and matched against MX records.
+
+The command exits with a non-zero status if any check fails (or, with
+--strict, produces a warning), making it usable for monitoring.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: runDNSCheck,
+	}
+	cmd.Flags().StringP("output", "o", "text", "Output format: text or json")
+	cmd.Flags().String("lang", "", "Message language: en or zh (default is from LANG)")
+	cmd.Flags().String("dns-server", "", "Use the DNS server at IP:PORT instead of the system resolver")
+	cmd.Flags().String("smtp-host", "", "Host to probe for SMTP reachability (default is the server hostname)")
+	cmd.Flags().Int("smtp-port", 8825, "SMTP port to probe, 0 to skip")
+	cmd.Flags().String("tls-cert", "", "Compare TLSA records with the certificate in the PEM file instead of the probed one")
+	cmd.Flags().Duration("timeout", 10*time.Second, "Timeout for each lookup or connection")
+	cmd.Flags().Bool("strict", false, "Exit with non-zero status on warnings too")
+	return cmd
+}
+
+func checkLanguage(cmd *cobra.Command) string {
+	if lang, _ := cmd.Flags().GetString("lang"); lang != "" {
+		return dnscheck.NormalizeLanguage(lang)
+	}
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if v := os.Getenv(env); v != "" {
+			return dnscheck.NormalizeLanguage(v)
+		}
+	}
+	return dnscheck.Languages[0]
+}
+
+func runDNSCheck(cmd *cobra.Command, args []string) error {
+	output, _ := cmd.Flags().GetString("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unknown output format: %s", output)
+	}
+	lang := checkLanguage(cmd)
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+
+	if server, _ := cmd.Flags().GetString("dns-server"); server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return fmt.Errorf("--dns-server: %w", err)
+		}
+		dns.SetOverride(server)
+	}
+	resolver, err := dns.NewExtResolver()
+	if err != nil {
+		return fmt.Errorf("failed to initialize resolver: %w", err)
+	}
+
+	checker := &dnscheck.Checker{
+		Resolver: resolver,
+		Timeout:  timeout,
+	}
+
+	cfg, cfgErr := loadDNSConfig()
+	var domain string
+	if len(args) > 0 {
+		domain = strings.TrimSuffix(strings.ToLower(args[0]), ".")
+	} else if cfgErr != nil {
+		return fmt.Errorf("specify the domain or make sure the configuration file exists: %w", cfgErr)
+	} else {
+		domain = cfg.PrimaryDomain
+	}
+	// Local keys and hostname only apply to the domain served by this
+	// configuration.
+	if cfgErr == nil && dns.Equal(domain, cfg.PrimaryDomain) {
+		checker.Hostname = cfg.Hostname
+		for _, key := range cfg.dkimRecords() {
+			if key.Record == "" || strings.HasPrefix(key.Record, "YOUR_") {
+				continue
+			}
+			checker.DKIM = append(checker.DKIM, dnscheck.DKIMKey{Selector: key.Selector, Record: key.Record})
+		}
+	}
+
+	if certPath, _ := cmd.Flags().GetString("tls-cert"); certPath != "" {
+		checker.Certificate, err = readCertificate(certPath)
+		if err != nil {
+			return err
+		}
+	}
+	if port, _ := cmd.Flags().GetInt("smtp-port"); port != 0 {
+		host, _ := cmd.Flags().GetString("smtp-host")
+		if host == "" {
+			host = checker.Hostname
+		}
+		if host != "" {
+			checker.ProbeAddr = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+	}
+
+	report := checker.Run(context.Background(), domain)
+	report.Localize(lang)
+
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			*dnscheck.Report
+			Status dnscheck.Status `json:"status"`
+		}{report, report.Status()}); err != nil {
+			return err
+		}
+	} else {
+		printDNSCheckReport(report, lang)
+	}
+
+	strict, _ := cmd.Flags().GetBool("strict")
+	switch status := report.Status(); {
+	case status == dnscheck.StatusFail, strict && status == dnscheck.StatusWarn:
+		// The report already explains the problems.
+		cmd.SilenceUsage = true
+		cmd.SilenceErrors = true
+		return fmt.Errorf("dns check for %s: %s", domain, status)
+	}
+	return nil
+}
+
+func printDNSCheckReport(report *dnscheck.Report, lang string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, res := range report.Results {
+		dnssec := ""
+		if res.DNSSEC {
+			dnssec = "DNSSEC"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			dnscheck.StatusLabel(lang, res.Status),
+			dnscheck.Title(lang, res.Check),
+			res.Name,
+			dnssec,
+			res.Text)
+		for _, value := range res.Values {
+			fmt.Fprintf(w, "\t\t\t\t  %s\n", value)
+		}
+		if res.Error != "" {
+			fmt.Fprintf(w, "\t\t\t\t  %s\n", res.Error)
+		}
+	}
+	w.Flush()
+}
@@ -0,0 +1,406 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+// Listening socket handoff.
+//
+// Sockets are inherited from systemd (socket activation, LISTEN_FDS) or from
+// the previous server process on restart. During the restart the old process
+// starts the new one passing it all listening sockets and two pipes. The new
+// process initializes modules, starts accepting connections and reports it
+// using the ready pipe. Only then the old process stops accepting
+// connections and drains its sessions. If the new process fails to start,
+// the old one keeps running.
+//
+// The other pipe is closed when the old process exits. Until then, modules
+// owning state that must not be used by two processes at once wait for
+// module.HandoverDone.
+//
+// Restart is requested using the control socket in the runtime directory.
+// It is passed to the new process together with the listening sockets.
+
+const (
+	// Number of listening sockets passed by the previous process, they
+	// start at file descriptor 3.
+	envListenFDs = "SIRRMESHD_LISTEN_FDS"
+	// File descriptor of the pipe closed when the previous process exits.
+	envParentFD = "SIRRMESHD_PARENT_FD"
+	// File descriptor of the pipe the new process writes to once it is
+	// serving.
+	envReadyFD = "SIRRMESHD_READY_FD"
+	// File descriptor of the control socket passed by the previous
+	// process.
+	envControlFD = "SIRRMESHD_CONTROL_FD"
+)
+
+// How long the previous process waits for the new one to initialize.
+const restartTimeout = 5 * time.Minute
+
+// restartSignal is returned by handleSignals once the new process started
+// by the restart request is serving.
+var restartSignal os.Signal = restartRequest{}
+
+type restartRequest struct{}
+
+func (restartRequest) String() string { return "restart request" }
+func (restartRequest) Signal()        {}
+
+// restartRequests receives restart requests from the control socket. The
+// result is sent back to the channel in the request.
+var restartRequests = make(chan chan error)
+
+// Control socket and the channel closed once it is closed. The socket is
+// inherited from the previous process on restart. controlPassed is set
+// once the socket is passed to the new process.
+var (
+	controlListener *net.UnixListener
+	controlDone     chan struct{}
+	controlPassed   bool
+)
+
+// Write end of the pipe passed to the new process. It is kept open until
+// this process exits.
+var restartPipe *os.File
+
+// Pipes passed by the previous server process, nil if the process was not
+// started by another one.
+var handoverParent, handoverReady *os.File
+
+func fileListeners(first, count int) ([]net.Listener, error) {
+	ls := make([]net.Listener, 0, count)
+	for fd := first; fd < first+count; fd++ {
+		f := os.NewFile(uintptr(fd), "listener-"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("inherited socket %d: %w", fd, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+func envInt(name string) (int, bool) {
+	val, err := strconv.Atoi(os.Getenv(name))
+	os.Unsetenv(name)
+	return val, err == nil
+}
+
+// inheritListeners makes the listening sockets passed by systemd or by the
+// previous server process available to endpoints.
+func inheritListeners() error {
+	if pid, ok := envInt("LISTEN_PID"); ok && pid == os.Getpid() {
+		count, _ := envInt("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+		ls, err := fileListeners(3, count)
+		if err != nil {
+			return err
+		}
+		log.Debugf("inherited %d sockets from systemd", len(ls))
+		module.InheritListeners(ls)
+	}
+
+	count, ok := envInt(envListenFDs)
+	if !ok {
+		return nil
+	}
+	parentFD, ok := envInt(envParentFD)
+	if !ok {
+		return fmt.Errorf("%s is set without %s", envListenFDs, envParentFD)
+	}
+	readyFD, ok := envInt(envReadyFD)
+	if !ok {
+		return fmt.Errorf("%s is set without %s", envListenFDs, envReadyFD)
+	}
+	ls, err := fileListeners(3, count)
+	if err != nil {
+		return err
+	}
+	if controlFD, ok := envInt(envControlFD); ok {
+		f := os.NewFile(uintptr(controlFD), "control")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inherited control socket: %w", err)
+		}
+		controlListener = l.(*net.UnixListener)
+	}
+	module.InheritListeners(ls)
+	module.BeginHandover()
+	handoverParent = os.NewFile(uintptr(parentFD), "parent")
+	handoverReady = os.NewFile(uintptr(readyFD), "ready")
+
+	log.Printf("inherited %d sockets from the previous process", len(ls))
+	return nil
+}
+
+// finishHandover tells the previous server process that this one is serving
+// and ends the handover once the previous process exits. It is no-op if the
+// process was not started by another one.
+func finishHandover() {
+	if handoverReady == nil {
+		return
+	}
+	_, err := handoverReady.Write([]byte{1})
+	handoverReady.Close()
+	handoverReady = nil
+	if err != nil {
+		log.Printf("failed to notify the previous process: %v", err)
+	}
+
+	// systemd should track this process once the old one exits.
+	systemdStatus(SDStatus("MAINPID="+strconv.Itoa(os.Getpid())), "Waiting for the previous process to exit...")
+
+	go func() {
+		io.Copy(io.Discard, handoverParent)
+		handoverParent.Close()
+		log.Printf("previous process exited")
+		module.EndHandover()
+	}()
+}
+
+// startRestart checks the configuration using the current executable,
+// starts the new server process passing it all listening sockets and waits
+// for it to start serving.
+func startRestart() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	check := exec.Command(exe, "--mail-config", configPath, "config", "validate")
+	if out, err := check.CombinedOutput(); err != nil {
+		return fmt.Errorf("configuration check failed: %w\n%s", err, out)
+	}
+
+	files, err := module.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	pipeR, pipeW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pipeR.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		pipeW.Close()
+		return err
+	}
+	defer readyR.Close()
+
+	// Stdin is not passed since the new process does not read it, and
+	// reading from the terminal would stop it if it is in the background.
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, pipeR, readyW)
+	cmd.Env = append(os.Environ(),
+		envListenFDs+"="+strconv.Itoa(len(files)),
+		envParentFD+"="+strconv.Itoa(3+len(files)),
+		envReadyFD+"="+strconv.Itoa(4+len(files)),
+	)
+	if controlListener != nil {
+		controlFile, err := controlListener.File()
+		if err != nil {
+			pipeW.Close()
+			readyW.Close()
+			return err
+		}
+		defer controlFile.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, controlFile)
+		cmd.Env = append(cmd.Env, envControlFD+"="+strconv.Itoa(5+len(files)))
+	}
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		pipeW.Close()
+		return err
+	}
+	log.Printf("started new process (PID %d) with %d sockets, waiting for it to initialize", cmd.Process.Pid, len(files))
+
+	// The pipe is closed without data if the new process exits.
+	if err := readyR.SetReadDeadline(time.Now().Add(restartTimeout)); err != nil {
+		log.Printf("failed to set the restart timeout: %v", err)
+	}
+	if _, err := readyR.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		pipeW.Close()
+		if errors.Is(err, io.EOF) {
+			return errors.New("new process failed to start")
+		}
+		return fmt.Errorf("new process failed to start: %w", err)
+	}
+	restartPipe = pipeW
+	controlPassed = true
+
+	log.Printf("new process (PID %d) is serving", cmd.Process.Pid)
+	go cmd.Wait()
+	return nil
+}
+
+func controlSocketPath() string {
+	return filepath.Join(config.RuntimeDirectory, "sirrmeshd.sock")
+}
+
+// listenControl starts accepting restart requests on the control socket,
+// unless it was inherited from the previous process. The socket is
+// accessible only to the user running the server.
+func listenControl() error {
+	if controlListener == nil {
+		path := controlSocketPath()
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return fmt.Errorf("control socket %s is used by another process", path)
+		}
+		// Left by a process that crashed.
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(path, 0o600); err != nil {
+			l.Close()
+			return err
+		}
+		controlListener = l
+	}
+	// Removed by closeControl, sockets inherited from the previous
+	// process are not removed by Close.
+	controlListener.SetUnlinkOnClose(false)
+	controlDone = make(chan struct{})
+	go serveControl(controlListener, controlDone)
+	return nil
+}
+
+// closeControl stops accepting requests. The socket file is kept if it was
+// passed to the new process.
+func closeControl() {
+	if controlListener == nil {
+		return
+	}
+	close(controlDone)
+	controlListener.Close()
+	controlListener = nil
+	if !controlPassed {
+		os.Remove(controlSocketPath())
+	}
+}
+
+func serveControl(l *net.UnixListener, done <-chan struct{}) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go handleControl(conn, done)
+	}
+}
+
+// handleControl reads a single command from the connection and writes "ok"
+// or the error message back.
+func handleControl(conn net.Conn, done <-chan struct{}) {
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		return
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	switch cmd := strings.TrimSpace(line); cmd {
+	case "restart":
+		reply := make(chan error, 1)
+		select {
+		case restartRequests <- reply:
+			err = <-reply
+		case <-done:
+			err = errors.New("server is shutting down")
+		}
+	default:
+		err = fmt.Errorf("unknown command: %s", cmd)
+	}
+
+	if err != nil {
+		fmt.Fprintf(conn, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintln(conn, "ok")
+}
+
+// requestRestart asks the running server to restart and waits for the new
+// process to start serving.
+func requestRestart() error {
+	conn, err := net.Dial("unix", controlSocketPath())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(restartTimeout + time.Minute)); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, "restart\n"); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no reply from the server: %w", err)
+	}
+	reply = strings.TrimSpace(reply)
+	if reply != "ok" {
+		return errors.New(strings.TrimPrefix(reply, "error: "))
+	}
+	return nil
+}
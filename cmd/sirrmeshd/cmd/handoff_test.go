@@ -0,0 +1,67 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+)
+
+func TestControlRestart(t *testing.T) {
+	config.RuntimeDirectory = t.TempDir()
+	defer func() { config.RuntimeDirectory = "" }()
+
+	if err := listenControl(); err != nil {
+		t.Fatal(err)
+	}
+	defer closeControl()
+	info, err := os.Stat(filepath.Join(config.RuntimeDirectory, "sirrmeshd.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("control socket is accessible to other users: %v", info.Mode())
+	}
+
+	go func() {
+		(<-restartRequests) <- errors.New("new process failed to start")
+		(<-restartRequests) <- nil
+	}()
+	if err := requestRestart(); err == nil || err.Error() != "new process failed to start" {
+		t.Errorf("restart error is not reported: %v", err)
+	}
+	if err := requestRestart(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	closeControl()
+	if err := requestRestart(); err == nil {
+		t.Error("restart is requested after the control socket is closed")
+	}
+	if _, err := os.Stat(filepath.Join(config.RuntimeDirectory, "sirrmeshd.sock")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("control socket is not removed: %v", err)
+	}
+}
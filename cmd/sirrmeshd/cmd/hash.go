@@ -24,6 +24,7 @@ import (
 	"strings"
 
 	"github.com/sirrchat/SirrMesh/internal/auth/pass_table"
+	"github.com/sirrchat/SirrMesh/internal/auth/saslscram"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -41,6 +42,8 @@ func NewHashCmd() *cobra.Command {
 	hashCmd.Flags().Int("argon2-time", 3, "Time factor for Argon2id")
 	hashCmd.Flags().Int("argon2-memory", 1024, "Memory in KiB to use for Argon2id")
 	hashCmd.Flags().Int("argon2-threads", 1, "Threads to use for Argon2id")
+	hashCmd.Flags().Bool("scram", false, "Also output SCRAM-SHA-256 keys for the password")
+	hashCmd.Flags().Int("scram-iterations", saslscram.MinIterations, "PBKDF2 iterations for SCRAM-SHA-256 keys")
 
 	return hashCmd
 }
@@ -51,8 +54,7 @@ func hashCommand(cmd *cobra.Command, args []string) error {
 		hashFunc = pass_table.DefaultHash
 	}
 
-	hashCompute := pass_table.HashCompute[hashFunc]
-	if hashCompute == nil {
+	if pass_table.HashCompute[hashFunc] == nil {
 		var funcs []string
 		for k := range pass_table.HashCompute {
 			funcs = append(funcs, k)
@@ -66,6 +68,8 @@ func hashCommand(cmd *cobra.Command, args []string) error {
 		Argon2Memory:  1024,
 		Argon2Time:    2,
 		Argon2Threads: 1,
+
+		SCRAMIterations: saslscram.MinIterations,
 	}
 	if cmd.Flags().Changed("bcrypt-cost") {
 		bcryptCost, _ := cmd.Flags().GetInt("bcrypt-cost")
@@ -89,6 +93,14 @@ func hashCommand(cmd *cobra.Command, args []string) error {
 		argon2Threads, _ := cmd.Flags().GetInt("argon2-threads")
 		opts.Argon2Threads = uint8(argon2Threads)
 	}
+	if cmd.Flags().Changed("scram-iterations") {
+		scramIterations, _ := cmd.Flags().GetInt("scram-iterations")
+		if scramIterations < saslscram.MinIterations {
+			return fmt.Errorf("SCRAM iteration count %d is below minimum %d", scramIterations, saslscram.MinIterations)
+		}
+		opts.SCRAMIterations = scramIterations
+	}
+	opts.WithSCRAM, _ = cmd.Flags().GetBool("scram")
 
 	var pass string
 	if cmd.Flags().Changed("password") {
@@ -108,10 +120,10 @@ func hashCommand(cmd *cobra.Command, args []string) error {
 		fmt.Fprintln(os.Stderr, "WARNING: There is leading/trailing whitespace in the string")
 	}
 
-	hash, err := hashCompute(opts, pass)
+	hash, err := pass_table.ComputeCreds(hashFunc, opts, pass)
 	if err != nil {
 		return err
 	}
-	fmt.Println(hashFunc + ":" + hash)
+	fmt.Println(hash)
 	return nil
 }
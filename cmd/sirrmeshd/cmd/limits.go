@@ -0,0 +1,117 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	parser "github.com/sirrchat/SirrMesh/framework/cfgparser"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/internal/limits"
+	"github.com/spf13/cobra"
+)
+
+func NewLimitsCmd() *cobra.Command {
+	limitsCmd := &cobra.Command{
+		Use:   "limits",
+		Short: "Sending limits inspection",
+		Long: `These subcommands can be used to inspect the state of per-user sending
+quotas configured using 'user messages' and 'user recipients' directives
+in limits blocks.`,
+	}
+
+	usageCmd := &cobra.Command{
+		Use:   "usage [USERNAME]",
+		Short: "Show quota usage for all users or a specific user",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  limitsUsage,
+	}
+	usageCmd.Flags().String("state-file", "", "Quota state file to use (default is derived from state_dir)")
+
+	limitsCmd.AddCommand(usageCmd)
+	return limitsCmd
+}
+
+// readStateDir reads the configuration file to find out the state directory
+// used by the server.
+func readStateDir() (string, error) {
+	f, err := os.Open(configPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open config: %w", err)
+	}
+	defer f.Close()
+
+	cfgNodes, err := parser.Read(f, f.Name())
+	if err != nil {
+		return "", fmt.Errorf("failed to parse config: %w", err)
+	}
+	if _, _, err := ReadGlobals(cfgNodes); err != nil {
+		return "", err
+	}
+	return config.StateDirectory, nil
+}
+
+func limitsUsage(cmd *cobra.Command, args []string) error {
+	statePath, _ := cmd.Flags().GetString("state-file")
+	if statePath == "" {
+		stateDir, err := readStateDir()
+		if err != nil {
+			return err
+		}
+		statePath = limits.DefaultQuotaStatePath(stateDir)
+	}
+
+	usage, err := limits.ReadQuotaUsage(statePath)
+	if err != nil {
+		return err
+	}
+
+	users := make([]string, 0, len(usage))
+	if len(args) == 1 {
+		users = append(users, args[0])
+	} else {
+		for user := range usage {
+			users = append(users, user)
+		}
+		sort.Strings(users)
+	}
+
+	printed := false
+	for _, user := range users {
+		counters := usage[user]
+		sort.Slice(counters, func(i, j int) bool {
+			if counters[i].Kind != counters[j].Kind {
+				return counters[i].Kind < counters[j].Kind
+			}
+			return counters[i].WindowEnd.Before(counters[j].WindowEnd)
+		})
+		for _, c := range counters {
+			fmt.Printf("%s\t%s/%s\t%d\tresets at %s\n", user, c.Kind, c.Period, c.Used,
+				c.WindowEnd.Local().Format(time.RFC3339))
+			printed = true
+		}
+	}
+	if !printed {
+		fmt.Fprintln(os.Stderr, "No quota usage recorded.")
+	}
+	return nil
+}
@@ -21,7 +21,6 @@ package cmd
 import (
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -33,25 +32,33 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/config"
 	modconfig "github.com/sirrchat/SirrMesh/framework/config/module"
 	"github.com/sirrchat/SirrMesh/framework/config/tls"
+	"github.com/sirrchat/SirrMesh/framework/dns"
 	"github.com/sirrchat/SirrMesh/framework/hooks"
 	"github.com/sirrchat/SirrMesh/framework/log"
 	"github.com/sirrchat/SirrMesh/framework/module"
 	"github.com/sirrchat/SirrMesh/internal/authz"
+	"github.com/sirrchat/SirrMesh/internal/msgtrack"
+	"github.com/sirrchat/SirrMesh/internal/resolver"
 	"github.com/spf13/cobra"
 
 	// Import packages for side-effect of module registration.
+	_ "github.com/sirrchat/SirrMesh/internal/auth/app_passwords"
 	_ "github.com/sirrchat/SirrMesh/internal/auth/dovecot_sasl"
 	_ "github.com/sirrchat/SirrMesh/internal/auth/external"
+	_ "github.com/sirrchat/SirrMesh/internal/auth/jwt"
 	_ "github.com/sirrchat/SirrMesh/internal/auth/ldap"
 	_ "github.com/sirrchat/SirrMesh/internal/auth/netauth"
+	_ "github.com/sirrchat/SirrMesh/internal/auth/oauth2_introspect"
 	_ "github.com/sirrchat/SirrMesh/internal/auth/pam"
 	_ "github.com/sirrchat/SirrMesh/internal/auth/pass_blockchain"
 	_ "github.com/sirrchat/SirrMesh/internal/auth/pass_table"
 	_ "github.com/sirrchat/SirrMesh/internal/auth/plain_separate"
 	_ "github.com/sirrchat/SirrMesh/internal/auth/shadow"
+	_ "github.com/sirrchat/SirrMesh/internal/auth/totp"
 	_ "github.com/sirrchat/SirrMesh/internal/blockchain"
 	_ "github.com/sirrchat/SirrMesh/internal/check/authorize_sender"
 	_ "github.com/sirrchat/SirrMesh/internal/check/command"
+	_ "github.com/sirrchat/SirrMesh/internal/check/arc"
 	_ "github.com/sirrchat/SirrMesh/internal/check/dkim"
 	_ "github.com/sirrchat/SirrMesh/internal/check/dns"
 	_ "github.com/sirrchat/SirrMesh/internal/check/dnsbl"
@@ -59,14 +66,18 @@ import (
 	_ "github.com/sirrchat/SirrMesh/internal/check/requiretls"
 	_ "github.com/sirrchat/SirrMesh/internal/check/rspamd"
 	_ "github.com/sirrchat/SirrMesh/internal/check/spf"
+	_ "github.com/sirrchat/SirrMesh/internal/endpoint/adminapi"
+	_ "github.com/sirrchat/SirrMesh/internal/endpoint/autoconfig"
 	_ "github.com/sirrchat/SirrMesh/internal/endpoint/dovecot_sasld"
 	_ "github.com/sirrchat/SirrMesh/internal/endpoint/imap"
+	_ "github.com/sirrchat/SirrMesh/internal/endpoint/mtasts"
 	_ "github.com/sirrchat/SirrMesh/internal/endpoint/openmetrics"
 	_ "github.com/sirrchat/SirrMesh/internal/endpoint/smtp"
 	_ "github.com/sirrchat/SirrMesh/internal/imap_filter"
 	_ "github.com/sirrchat/SirrMesh/internal/imap_filter/command"
 	_ "github.com/sirrchat/SirrMesh/internal/libdns"
 	_ "github.com/sirrchat/SirrMesh/internal/modify"
+	_ "github.com/sirrchat/SirrMesh/internal/modify/arc"
 	_ "github.com/sirrchat/SirrMesh/internal/modify/dkim"
 	_ "github.com/sirrchat/SirrMesh/internal/storage/blob/fs"
 	_ "github.com/sirrchat/SirrMesh/internal/storage/blob/s3"
@@ -104,6 +115,10 @@ default runtime_dir: %s`,
 
 var (
 	configPath string
+
+	// messageTracking is the value of the message_tracking directive read
+	// by the last ReadGlobals call, nil if it is not set.
+	messageTracking *msgtrack.Config
 )
 
 func addMailCommands(rootCmd *cobra.Command) {
@@ -148,6 +163,13 @@ func addMailCommands(rootCmd *cobra.Command) {
 		NewImapMsgsCmd(),
 		NewImapMboxesCmd(),
 		NewDNSCmd(),
+		NewReloadCmd(),
+		NewRestartCmd(),
+		NewConfigCmd(),
+		NewLimitsCmd(),
+		NewBanCmd(),
+		NewDMARCReportsCmd(),
+		NewTraceCmd(),
 	)
 }
 
@@ -326,15 +348,30 @@ func ReadGlobals(cfg []config.Node) (map[string]interface{}, []config.Node, erro
 	globals.String("autogenerated_msg_domain", false, false, "", nil)
 	globals.Custom("tls", false, false, nil, tls.TLSDirective, nil)
 	globals.Custom("tls_client", false, false, nil, tls.TLSClientBlock, nil)
+	var dnsResolver *resolver.Resolver
+	globals.Custom("dns", false, false, nil, resolver.ConfigBlock, &dnsResolver)
 	globals.Bool("storage_perdomain", false, false, nil)
 	globals.Bool("auth_perdomain", false, false, nil)
 	globals.StringList("auth_domains", false, false, nil, nil)
 	globals.Custom("log", false, false, defaultLogOutput, logOutput, &log.DefaultLogger.Out)
-	globals.Bool("debug", false, log.DefaultLogger.Debug, &log.DefaultLogger.Debug)
+	globals.Logger(false, log.DefaultLogger.Debug, &log.DefaultLogger)
+	var sampling log.Sampling
+	globals.Custom("log_sampling", false, false, nil, logSampling, &sampling)
+	globals.Duration("drain_timeout", false, false, defaultDrainTimeout, &drainTimeout)
+	var tracking *msgtrack.Config
+	globals.Custom("message_tracking", false, false, nil, msgtrack.ConfigBlock, &tracking)
 	config.EnumMapped(globals, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto, nil)
 	modconfig.Table(globals, "auth_map", true, false, nil, nil)
 	globals.AllowUnknown()
 	unknown, err := globals.Process()
+	globalsFilled = globals.Filled
+	log.SetSampling(sampling)
+	messageTracking = tracking
+	if dnsResolver != nil {
+		// Set before any modules are created since they obtain the
+		// resolver in constructors.
+		dns.SetDefault(dnsResolver)
+	}
 	return globals.Values, unknown, err
 }
 
@@ -351,6 +388,18 @@ func moduleMain(cfg []config.Node) error {
 
 	hooks.AddHook(hooks.EventLogRotate, reinitLogging)
 
+	if messageTracking != nil {
+		store, err := msgtrack.Open(messageTracking.DBPath(config.StateDirectory))
+		if err != nil {
+			return fmt.Errorf("message_tracking: %w", err)
+		}
+		hooks.AddHook(hooks.EventShutdown, msgtrack.Start(store, messageTracking.Retention))
+	}
+
+	if err := inheritListeners(); err != nil {
+		return err
+	}
+
 	endpoints, mods, err := RegisterModules(globals, modBlocks)
 	if err != nil {
 		return err
@@ -360,13 +409,34 @@ func moduleMain(cfg []config.Node) error {
 	if err != nil {
 		return err
 	}
+	for _, addr := range module.CloseInherited() {
+		log.Printf("inherited socket %s is not used by any endpoint, closed", addr)
+	}
+	finishHandover()
+	if err := listenControl(); err != nil {
+		log.Printf("failed to open the control socket, restart is not available: %v", err)
+	}
 
-	systemdStatus(SDReady, "Listening for incoming connections...")
+	running = &runningConfig{
+		globals:     globals,
+		globalNodes: globalNodes(cfg),
+		endpoints:   endpoints,
+		mods:        mods,
+	}
+	if err := writePIDFile(); err != nil {
+		log.Printf("failed to write PID file: %v", err)
+	}
 
-	handleSignals()
+	systemdStatus(SDReady, "Listening for incoming connections...")
+	module.SetReady(true)
 
-	systemdStatus(SDStopping, "Waiting for running transactions to complete...")
+	if sig := handleSignals(); sig != restartSignal {
+		systemdStatus(SDStopping, "Waiting for running transactions to complete...")
+	}
+	closeControl()
 
+	module.SetReady(false)
+	running.shutdown()
 	hooks.RunHooks(hooks.EventShutdown)
 
 	return nil
@@ -381,80 +451,83 @@ func RegisterModules(globals map[string]interface{}, nodes []config.Node) (endpo
 	mods = make([]ModInfo, 0, len(nodes))
 
 	for _, block := range nodes {
-		var instName string
-		var modAliases []string
-		if len(block.Args) == 0 {
-			instName = block.Name
+		info, isEndpoint, err := registerBlock(globals, block)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isEndpoint {
+			endpoints = append(endpoints, info)
 		} else {
-			instName = block.Args[0]
-			modAliases = block.Args[1:]
+			mods = append(mods, info)
 		}
+	}
 
-		modName := block.Name
-
-		endpFactory := module.GetEndpoint(modName)
-		if endpFactory != nil {
-			inst, err := endpFactory(modName, block.Args)
-			if err != nil {
-				return nil, nil, err
-			}
+	if len(endpoints) == 0 {
+		return nil, nil, fmt.Errorf("at least one endpoint should be configured")
+	}
 
-			endpoints = append(endpoints, ModInfo{Instance: inst, Cfg: block})
-			continue
-		}
+	return endpoints, mods, nil
+}
 
-		factory := module.Get(modName)
-		if factory == nil {
-			return nil, nil, config.NodeErr(block, "unknown module or global directive: %s", modName)
-		}
+// registerBlock creates the endpoint or module instance for the
+// configuration block. Module instances are added to the global registry.
+func registerBlock(globals map[string]interface{}, block config.Node) (info ModInfo, isEndpoint bool, err error) {
+	var instName string
+	var modAliases []string
+	if len(block.Args) == 0 {
+		instName = block.Name
+	} else {
+		instName = block.Args[0]
+		modAliases = block.Args[1:]
+	}
 
-		if module.HasInstance(instName) {
-			return nil, nil, config.NodeErr(block, "config block named %s already exists", instName)
-		}
+	modName := block.Name
 
-		inst, err := factory(modName, instName, modAliases, nil)
+	endpFactory := module.GetEndpoint(modName)
+	if endpFactory != nil {
+		inst, err := endpFactory(modName, block.Args)
 		if err != nil {
-			return nil, nil, err
+			return ModInfo{}, false, err
 		}
 
-		module.RegisterInstance(inst, config.NewMap(globals, block))
-		for _, alias := range modAliases {
-			if module.HasInstance(alias) {
-				return nil, nil, config.NodeErr(block, "config block named %s already exists", alias)
-			}
-			module.RegisterAlias(alias, instName)
-		}
+		return ModInfo{Instance: inst, Cfg: block}, true, nil
+	}
 
-		log.Debugf("%v:%v: register config block %v %v", block.File, block.Line, instName, modAliases)
-		mods = append(mods, ModInfo{Instance: inst, Cfg: block})
+	factory := module.Get(modName)
+	if factory == nil {
+		return ModInfo{}, false, config.NodeErr(block, "unknown module or global directive: %s", modName)
 	}
 
-	if len(endpoints) == 0 {
-		return nil, nil, fmt.Errorf("at least one endpoint should be configured")
+	if module.HasInstance(instName) {
+		return ModInfo{}, false, config.NodeErr(block, "config block named %s already exists", instName)
 	}
 
-	return endpoints, mods, nil
+	inst, err := factory(modName, instName, modAliases, nil)
+	if err != nil {
+		return ModInfo{}, false, err
+	}
+
+	module.RegisterInstance(inst, config.NewMap(globals, block))
+	for _, alias := range modAliases {
+		if module.HasInstance(alias) {
+			return ModInfo{}, false, config.NodeErr(block, "config block named %s already exists", alias)
+		}
+		module.RegisterAlias(alias, instName)
+	}
+
+	log.Debugf("%v:%v: register config block %v %v", block.File, block.Line, instName, modAliases)
+	return ModInfo{Instance: inst, Cfg: block}, false, nil
 }
 
 func initModules(globals map[string]interface{}, endpoints, mods []ModInfo) error {
 	for _, endp := range endpoints {
-		if err := endp.Instance.Init(config.NewMap(globals, endp.Cfg)); err != nil {
+		if err := module.InitInstance(endp.Instance, config.NewMap(globals, endp.Cfg)); err != nil {
 			return err
 		}
-
-		if closer, ok := endp.Instance.(io.Closer); ok {
-			endp := endp
-			hooks.AddHook(hooks.EventShutdown, func() {
-				log.Debugf("close %s (%s)", endp.Instance.Name(), endp.Instance.InstanceName())
-				if err := closer.Close(); err != nil {
-					log.Printf("module %s (%s) close failed: %v", endp.Instance.Name(), endp.Instance.InstanceName(), err)
-				}
-			})
-		}
 	}
 
 	for _, inst := range mods {
-		if module.Initialized[inst.Instance.InstanceName()] {
+		if module.IsInitialized(inst.Instance.InstanceName()) {
 			continue
 		}
 
@@ -0,0 +1,472 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	parser "github.com/sirrchat/SirrMesh/framework/cfgparser"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/hooks"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/spf13/cobra"
+)
+
+const defaultDrainTimeout = 1 * time.Minute
+
+// drainTimeout is the time replaced endpoints are given to finish
+// sessions started before the configuration reload.
+var drainTimeout = defaultDrainTimeout
+
+// runningConfig is the configuration of the modules started by moduleMain.
+type runningConfig struct {
+	globals     map[string]interface{}
+	globalNodes []config.Node
+	endpoints   []ModInfo
+	mods        []ModInfo
+}
+
+var running *runningConfig
+
+// isModuleBlock reports whether the top-level node defines a module or an
+// endpoint instead of a global directive.
+func isModuleBlock(node config.Node) bool {
+	return module.Get(node.Name) != nil || module.GetEndpoint(node.Name) != nil
+}
+
+func globalNodes(cfg []config.Node) []config.Node {
+	var nodes []config.Node
+	for _, node := range cfg {
+		if !isModuleBlock(node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// nodeEqual compares configuration nodes ignoring their location.
+func nodeEqual(a, b config.Node) bool {
+	if a.Name != b.Name || len(a.Args) != len(b.Args) || len(a.Children) != len(b.Children) {
+		return false
+	}
+	for i := range a.Args {
+		if a.Args[i] != b.Args[i] {
+			return false
+		}
+	}
+	return nodesEqual(a.Children, b.Children)
+}
+
+func nodesEqual(a, b []config.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !nodeEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// endpointKey identifies the endpoint by its module name and listen
+// addresses.
+func endpointKey(block config.Node) string {
+	return block.Name + " " + strings.Join(block.Args, " ")
+}
+
+// reload applies the new configuration to the running server.
+//
+// Global directives can't be changed without a restart. Module blocks that
+// were changed or removed are replaced together with all modules and
+// endpoints that use them. New endpoint instances take over listening
+// sockets of the replaced ones, so new sessions use the new configuration
+// while existing sessions are finished by the old instances within
+// drainTimeout. Replaced modules are closed after that. Endpoints with
+// changed listen addresses are replaced the same way.
+//
+// If any new instance fails to initialize, the running configuration is
+// left intact.
+func (rc *runningConfig) reload(cfg []config.Node) error {
+	if !nodesEqual(globalNodes(cfg), rc.globalNodes) {
+		return errors.New("global directives changed, restart is required")
+	}
+
+	newBlocks := make(map[string]config.Node)
+	newEndpoints := make(map[string]config.Node)
+	var blockOrder []config.Node
+	for _, node := range cfg {
+		if !isModuleBlock(node) {
+			continue
+		}
+		blockOrder = append(blockOrder, node)
+		if module.GetEndpoint(node.Name) != nil {
+			newEndpoints[endpointKey(node)] = node
+			continue
+		}
+		instName := node.Name
+		if len(node.Args) != 0 {
+			instName = node.Args[0]
+		}
+		newBlocks[instName] = node
+	}
+
+	// Find changed module instances and everything that depends on them.
+	replaced := make(map[string]bool)
+	for _, mod := range rc.mods {
+		name := mod.Instance.InstanceName()
+		if block, ok := newBlocks[name]; !ok || !nodeEqual(block, mod.Cfg) {
+			replaced[name] = true
+		}
+	}
+	dependsOnReplaced := func(inst module.Module) bool {
+		for _, dep := range module.Dependencies(inst) {
+			if replaced[dep] {
+				return true
+			}
+		}
+		return false
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, mod := range rc.mods {
+			name := mod.Instance.InstanceName()
+			if !replaced[name] && dependsOnReplaced(mod.Instance) {
+				replaced[name] = true
+				changed = true
+			}
+		}
+	}
+
+	var keptEndpoints, oldEndpoints []ModInfo
+	keptKeys := make(map[string]bool)
+	for _, endp := range rc.endpoints {
+		key := endpointKey(endp.Cfg)
+		if block, ok := newEndpoints[key]; ok && nodeEqual(block, endp.Cfg) && !dependsOnReplaced(endp.Instance) {
+			keptEndpoints = append(keptEndpoints, endp)
+			keptKeys[key] = true
+			continue
+		}
+		oldEndpoints = append(oldEndpoints, endp)
+	}
+	var keptMods, oldMods []ModInfo
+	for _, mod := range rc.mods {
+		if replaced[mod.Instance.InstanceName()] {
+			oldMods = append(oldMods, mod)
+		} else {
+			keptMods = append(keptMods, mod)
+		}
+	}
+
+	var addedBlocks int
+	for _, block := range blockOrder {
+		if module.GetEndpoint(block.Name) != nil {
+			if !keptKeys[endpointKey(block)] {
+				addedBlocks++
+			}
+			continue
+		}
+		instName := block.Name
+		if len(block.Args) != 0 {
+			instName = block.Args[0]
+		}
+		if !module.HasInstance(instName) || replaced[instName] {
+			addedBlocks++
+		}
+	}
+	if len(oldEndpoints) == 0 && len(oldMods) == 0 && addedBlocks == 0 {
+		log.Println("configuration reload: no changes")
+		return nil
+	}
+
+	snapshot := module.SaveRegistry()
+	for _, endp := range oldEndpoints {
+		module.SetHandoff(endp.Instance, true)
+	}
+	for _, mod := range oldMods {
+		module.UnregisterInstance(mod.Instance.InstanceName())
+	}
+
+	var (
+		addedEndpoints, addedMods, initializedEndpoints []ModInfo
+		err                                             error
+	)
+	for _, block := range blockOrder {
+		var (
+			info       ModInfo
+			isEndpoint bool
+		)
+		if module.GetEndpoint(block.Name) != nil {
+			if keptKeys[endpointKey(block)] {
+				continue
+			}
+		} else {
+			instName := block.Name
+			if len(block.Args) != 0 {
+				instName = block.Args[0]
+			}
+			if module.HasInstance(instName) && !replaced[instName] {
+				continue
+			}
+		}
+
+		info, isEndpoint, err = registerBlock(rc.globals, block)
+		if err != nil {
+			break
+		}
+		if isEndpoint {
+			addedEndpoints = append(addedEndpoints, info)
+		} else {
+			addedMods = append(addedMods, info)
+		}
+	}
+	if err == nil && len(keptEndpoints)+len(addedEndpoints) == 0 {
+		err = fmt.Errorf("at least one endpoint should be configured")
+	}
+	if err == nil {
+		for _, endp := range addedEndpoints {
+			if err = module.InitInstance(endp.Instance, config.NewMap(rc.globals, endp.Cfg)); err != nil {
+				break
+			}
+			initializedEndpoints = append(initializedEndpoints, endp)
+		}
+	}
+	if err == nil {
+		for _, mod := range addedMods {
+			if !module.IsInitialized(mod.Instance.InstanceName()) {
+				err = fmt.Errorf("Unused configuration block at %s:%d - %s (%s)",
+					mod.Cfg.File, mod.Cfg.Line, mod.Instance.InstanceName(), mod.Instance.Name())
+				break
+			}
+		}
+	}
+	if err != nil {
+		for _, endp := range initializedEndpoints {
+			closeInstance(endp.Instance)
+		}
+		for _, mod := range addedMods {
+			if module.IsInitialized(mod.Instance.InstanceName()) {
+				closeInstance(mod.Instance)
+			}
+		}
+		for _, endp := range oldEndpoints {
+			module.SetHandoff(endp.Instance, false)
+		}
+		snapshot.Restore()
+		return err
+	}
+
+	// New endpoints are accepting connections, old ones should not anymore.
+	for _, endp := range oldEndpoints {
+		module.StopListening(endp.Instance)
+	}
+	// Replaced modules are still used by sessions of draining endpoints,
+	// they are closed once the endpoints are.
+	go func() {
+		drainEndpoints(oldEndpoints, drainTimeout)
+		for i := len(oldMods) - 1; i >= 0; i-- {
+			closeInstance(oldMods[i].Instance)
+		}
+	}()
+
+	rc.endpoints = append(keptEndpoints, addedEndpoints...)
+	rc.mods = append(keptMods, addedMods...)
+
+	log.Printf("configuration reloaded: %d endpoints and %d modules replaced, %d kept",
+		len(oldEndpoints), len(oldMods), len(keptEndpoints)+len(keptMods))
+	return nil
+}
+
+func closeInstance(inst module.Module) {
+	if err := module.CloseInstance(inst); err != nil {
+		log.Printf("module %s (%s) close failed: %v", inst.Name(), inst.InstanceName(), err)
+	}
+}
+
+// drainEndpoints asks clients of the endpoints that stopped listening to
+// finish their sessions, waits for connections accepted by the endpoints to
+// be closed and then closes the endpoints. Remaining connections are closed
+// after the timeout.
+func drainEndpoints(endpoints []ModInfo, timeout time.Duration) {
+	for _, endp := range endpoints {
+		if d, ok := endp.Instance.(module.Drainer); ok {
+			d.Drain()
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	for _, endp := range endpoints {
+		for module.ActiveConnections(endp.Instance) != 0 && time.Now().Before(deadline) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if n := module.ActiveConnections(endp.Instance); n != 0 {
+			log.Printf("closing %d remaining connections of endpoint %s", n, endpointKey(endp.Cfg))
+		}
+		closeInstance(endp.Instance)
+	}
+}
+
+// shutdown stops accepting connections on all endpoints and lets the
+// existing sessions finish within drain_timeout.
+func (rc *runningConfig) shutdown() {
+	for _, endp := range rc.endpoints {
+		module.StopListening(endp.Instance)
+	}
+	drainEndpoints(rc.endpoints, drainTimeout)
+}
+
+// readConfigFile reads and parses the configuration file.
+func readConfigFile(path string) ([]config.Node, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parser.Read(f, path)
+}
+
+// reloadConfig re-reads the configuration file and applies it to the
+// running server.
+func reloadConfig() error {
+	if running == nil {
+		return errors.New("server is not running")
+	}
+	cfg, err := readConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	return running.reload(cfg)
+}
+
+func pidFilePath() string {
+	return filepath.Join(config.RuntimeDirectory, "sirrmeshd.pid")
+}
+
+func writePIDFile() error {
+	path := pidFilePath()
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		return err
+	}
+	hooks.AddHook(hooks.EventShutdown, func() {
+		// Keep the file written by the new process after the restart.
+		if pid, err := readPIDFile(); err == nil && pid == os.Getpid() {
+			os.Remove(path)
+		}
+	})
+	return nil
+}
+
+func readPIDFile() (int, error) {
+	b, err := os.ReadFile(pidFilePath())
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("malformed PID file: %w", err)
+	}
+	return pid, nil
+}
+
+// checkConfig validates the configuration file the same way as
+// 'sirrmeshd config validate' does.
+func checkConfig(path string) error {
+	res, err := validateConfig(path)
+	if err != nil {
+		return err
+	}
+	return errors.Join(res.errors...)
+}
+
+func NewReloadCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "reload",
+		Short: "Reload configuration of the running server",
+		Long: `Validate the configuration file and ask the running server to apply it.
+
+Changed modules are re-initialized together with everything that uses them,
+unchanged modules and endpoints keep running. Replaced endpoints stop
+accepting connections and finish existing sessions within drain_timeout.
+Changes to global directives require a restart.
+
+The server is found using the PID file in the runtime directory. The result
+of the reload is reported in the server log.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkConfig(configPath); err != nil {
+				return fmt.Errorf("configuration is invalid: %w", err)
+			}
+
+			check, _ := cmd.Flags().GetBool("check")
+			if check {
+				fmt.Println("configuration is valid")
+				return nil
+			}
+
+			pid, err := readPIDFile()
+			if err != nil {
+				return fmt.Errorf("cannot find running server: %w", err)
+			}
+			if err := signalReload(pid); err != nil {
+				return err
+			}
+			fmt.Printf("reload requested for PID %d, see the server log for the result\n", pid)
+			return nil
+		},
+	}
+	cmd.Flags().Bool("check", false, "Only validate the configuration")
+	return cmd
+}
+
+func NewRestartCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "restart",
+		Short: "Restart the running server without refusing connections",
+		Long: `Validate the configuration file and ask the running server to start a new
+process, e.g. to upgrade the executable.
+
+The running server passes its listening sockets to the new process, stops
+accepting connections and finishes existing sessions within drain_timeout.
+The new process starts serving once the old one exits, connections made in
+between wait in the socket backlog.
+
+The request is sent to the control socket in the runtime directory and the
+command waits until the new process is serving. When run under systemd, the
+unit needs NotifyAccess=all so the new process can take over as the main
+process.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkConfig(configPath); err != nil {
+				return fmt.Errorf("configuration is invalid: %w", err)
+			}
+
+			if err := requestRestart(); err != nil {
+				return fmt.Errorf("restart failed: %w", err)
+			}
+			fmt.Println("new server process is serving")
+			return nil
+		},
+	}
+}
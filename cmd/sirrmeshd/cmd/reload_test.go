@@ -0,0 +1,323 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	parser "github.com/sirrchat/SirrMesh/framework/cfgparser"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+type reloadTestMod struct {
+	instName string
+	dep      module.Module
+	closed   atomic.Bool
+}
+
+func (m *reloadTestMod) Init(cfg *config.Map) error {
+	var (
+		depName string
+		fail    bool
+	)
+	cfg.String("dep", false, false, "", &depName)
+	cfg.String("value", false, false, "", nil)
+	cfg.Bool("fail", false, false, &fail)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if depName != "" {
+		dep, err := module.GetInstance(depName)
+		if err != nil {
+			return err
+		}
+		m.dep = dep
+	}
+	if fail {
+		return errors.New("test module init failed")
+	}
+	return nil
+}
+
+func (m *reloadTestMod) Name() string         { return "test.reload_mod" }
+func (m *reloadTestMod) InstanceName() string { return m.instName }
+
+func (m *reloadTestMod) Close() error {
+	m.closed.Store(true)
+	return nil
+}
+
+type reloadTestEndp struct {
+	addrs  []string
+	ls     []net.Listener
+	closed atomic.Bool
+}
+
+func (e *reloadTestEndp) Init(cfg *config.Map) error {
+	var mods []string
+	cfg.StringList("mods", false, false, nil, &mods)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	for _, name := range mods {
+		if _, err := module.GetInstance(name); err != nil {
+			return err
+		}
+	}
+	for _, addr := range e.addrs {
+		l, err := module.Listen(e, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		e.ls = append(e.ls, l)
+	}
+	return nil
+}
+
+func (e *reloadTestEndp) Name() string         { return "test.reload_endp" }
+func (e *reloadTestEndp) InstanceName() string { return "test.reload_endp" }
+
+func (e *reloadTestEndp) Close() error {
+	for _, l := range e.ls {
+		l.Close()
+	}
+	e.closed.Store(true)
+	return nil
+}
+
+func init() {
+	module.Register("test.reload_mod", func(_, instName string, _, _ []string) (module.Module, error) {
+		return &reloadTestMod{instName: instName}, nil
+	})
+	module.RegisterEndpoint("test.reload_endp", func(_ string, addrs []string) (module.Module, error) {
+		return &reloadTestEndp{addrs: addrs}, nil
+	})
+}
+
+func parseTestConfig(t *testing.T, text string) []config.Node {
+	t.Helper()
+	cfg, err := parser.Read(strings.NewReader(text), "test.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func startTestConfig(t *testing.T, text string) *runningConfig {
+	t.Helper()
+	cfg := parseTestConfig(t, text)
+	globals := map[string]interface{}{}
+	endpoints, mods, err := RegisterModules(globals, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &runningConfig{
+		globals:     globals,
+		globalNodes: globalNodes(cfg),
+		endpoints:   endpoints,
+		mods:        mods,
+	}
+	t.Cleanup(func() {
+		for _, endp := range rc.endpoints {
+			closeInstance(endp.Instance)
+		}
+		for _, mod := range rc.mods {
+			closeInstance(mod.Instance)
+			module.UnregisterInstance(mod.Instance.InstanceName())
+		}
+	})
+	if err := initModules(globals, endpoints, mods); err != nil {
+		t.Fatal(err)
+	}
+	return rc
+}
+
+func (rc *runningConfig) testMod(t *testing.T, name string) *reloadTestMod {
+	t.Helper()
+	for _, mod := range rc.mods {
+		if mod.Instance.InstanceName() == name {
+			return mod.Instance.(*reloadTestMod)
+		}
+	}
+	t.Fatalf("no module %s", name)
+	return nil
+}
+
+func (rc *runningConfig) testEndp(t *testing.T) *reloadTestEndp {
+	t.Helper()
+	if len(rc.endpoints) != 1 {
+		t.Fatalf("expected 1 endpoint, got %d", len(rc.endpoints))
+	}
+	return rc.endpoints[0].Instance.(*reloadTestEndp)
+}
+
+func waitClosed(t *testing.T, closed *atomic.Bool, what string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if closed.Load() {
+			return
+		}
+	}
+	t.Fatalf("%s is not closed", what)
+}
+
+const reloadTestConfig = `
+test.reload_mod a {
+	value 1
+}
+test.reload_mod b {
+	dep a
+}
+test.reload_mod c {
+}
+test.reload_endp 127.0.0.1:0 {
+	mods b c
+}
+`
+
+func TestReload_NoChanges(t *testing.T) {
+	rc := startTestConfig(t, reloadTestConfig)
+	a, endp := rc.testMod(t, "a"), rc.testEndp(t)
+
+	if err := rc.reload(parseTestConfig(t, reloadTestConfig)); err != nil {
+		t.Fatal(err)
+	}
+	if rc.testMod(t, "a") != a || rc.testEndp(t) != endp {
+		t.Error("instances are replaced without changes")
+	}
+}
+
+func TestReload_Propagation(t *testing.T) {
+	rc := startTestConfig(t, reloadTestConfig)
+	oldA, oldB, oldC := rc.testMod(t, "a"), rc.testMod(t, "b"), rc.testMod(t, "c")
+	oldEndp := rc.testEndp(t)
+
+	err := rc.reload(parseTestConfig(t, strings.Replace(reloadTestConfig, "value 1", "value 2", 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newA, newB := rc.testMod(t, "a"), rc.testMod(t, "b")
+	if newA == oldA {
+		t.Error("changed module is not replaced")
+	}
+	if newB == oldB {
+		t.Error("module using the changed module is not replaced")
+	}
+	if newB.dep != newA {
+		t.Error("replaced module uses the old dependency")
+	}
+	if rc.testMod(t, "c") != oldC {
+		t.Error("unrelated module is replaced")
+	}
+	if rc.testEndp(t) == oldEndp {
+		t.Error("endpoint using the changed module is not replaced")
+	}
+
+	waitClosed(t, &oldEndp.closed, "old endpoint")
+	waitClosed(t, &oldB.closed, "old module b")
+	waitClosed(t, &oldA.closed, "old module a")
+	if oldC.closed.Load() {
+		t.Error("unrelated module is closed")
+	}
+	if newA.closed.Load() || newB.closed.Load() {
+		t.Error("new modules are closed")
+	}
+}
+
+func TestReload_InitFailure(t *testing.T) {
+	rc := startTestConfig(t, reloadTestConfig)
+	oldA, oldB := rc.testMod(t, "a"), rc.testMod(t, "b")
+	oldEndp := rc.testEndp(t)
+	addr := oldEndp.ls[0].Addr().String()
+
+	broken := strings.Replace(reloadTestConfig, "dep a", "dep a\n\tfail yes", 1)
+	broken = strings.Replace(broken, "value 1", "value 2", 1)
+	if err := rc.reload(parseTestConfig(t, broken)); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if rc.testMod(t, "a") != oldA || rc.testMod(t, "b") != oldB || rc.testEndp(t) != oldEndp {
+		t.Error("running configuration is changed")
+	}
+	for _, name := range []string{"a", "b"} {
+		inst, err := module.GetInstance(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inst != rc.testMod(t, name) {
+			t.Errorf("registry is not restored for %s", name)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if oldA.closed.Load() || oldB.closed.Load() || oldEndp.closed.Load() {
+		t.Error("running instances are closed")
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("endpoint stopped listening:", err)
+	}
+	conn.Close()
+
+	// The next valid reload still works.
+	if err := rc.reload(parseTestConfig(t, strings.Replace(reloadTestConfig, "value 1", "value 2", 1))); err != nil {
+		t.Fatal(err)
+	}
+	if rc.testMod(t, "a") == oldA {
+		t.Error("module is not replaced")
+	}
+}
+
+func TestReload_EndpointAddress(t *testing.T) {
+	rc := startTestConfig(t, reloadTestConfig)
+	oldA := rc.testMod(t, "a")
+	oldEndp := rc.testEndp(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newAddr := l.Addr().String()
+	l.Close()
+
+	err = rc.reload(parseTestConfig(t, strings.Replace(reloadTestConfig, "127.0.0.1:0", newAddr, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newEndp := rc.testEndp(t)
+	if newEndp == oldEndp {
+		t.Fatal("endpoint is not replaced")
+	}
+	if rc.testMod(t, "a") != oldA {
+		t.Error("module is replaced")
+	}
+	conn, err := net.Dial("tcp", newAddr)
+	if err != nil {
+		t.Fatal("new address is not listened on:", err)
+	}
+	conn.Close()
+	waitClosed(t, &oldEndp.closed, "old endpoint")
+}
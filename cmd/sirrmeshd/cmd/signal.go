@@ -36,12 +36,34 @@ import (
 // (SIGTERM, SIGHUP, SIGINT) will cause this function to return.
 //
 // SIGUSR1 will call reinitLogging without returning.
+//
+// SIGUSR2 will run reload hooks and apply the changed configuration file
+// without returning.
+//
+// Restart requests from the control socket will start the new server
+// process taking over listening sockets and return restartSignal if that
+// succeeded.
 func handleSignals() os.Signal {
 	sig := make(chan os.Signal, 5)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2)
 
 	for {
-		switch s := <-sig; s {
+		var s os.Signal
+		select {
+		case s = <-sig:
+		case reply := <-restartRequests:
+			log.Printf("restart requested")
+			err := startRestart()
+			reply <- err
+			if err != nil {
+				log.Printf("restart failed, keeping the running process: %v", err)
+				continue
+			}
+			systemdStatus(SDReloading, "Restarting...")
+			return restartSignal
+		}
+
+		switch s {
 		case syscall.SIGUSR1:
 			log.Printf("signal received (%s), rotating logs", s.String())
 			systemdStatus(SDReloading, "Reopening logs...")
@@ -51,6 +73,9 @@ func handleSignals() os.Signal {
 			log.Printf("signal received (%s), reloading state", s.String())
 			systemdStatus(SDReloading, "Reloading state...")
 			hooks.RunHooks(hooks.EventReload)
+			if err := reloadConfig(); err != nil {
+				log.Printf("configuration reload failed, keeping the running configuration: %v", err)
+			}
 			systemdStatus(SDReady, "Listening for incoming connections...")
 		default:
 			go func() {
@@ -64,3 +89,8 @@ func handleSignals() os.Signal {
 		}
 	}
 }
+
+// signalReload asks the server process to reload its configuration.
+func signalReload(pid int) error {
+	return syscall.Kill(pid, syscall.SIGUSR2)
+}
@@ -22,6 +22,7 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package cmd
 
 import (
+	"errors"
 	"os"
 	"os/signal"
 	"syscall"
@@ -43,3 +44,25 @@ func handleSignals() os.Signal {
 	log.Printf("signal received (%v), next signal will force immediate shutdown.", s)
 	return s
 }
+
+func signalReload(_ int) error {
+	return errors.New("configuration reload is not supported on this platform")
+}
+
+var restartSignal os.Signal
+
+func inheritListeners() error {
+	return nil
+}
+
+func finishHandover() {}
+
+func listenControl() error {
+	return nil
+}
+
+func closeControl() {}
+
+func requestRestart() error {
+	return errors.New("restart is not supported on this platform")
+}
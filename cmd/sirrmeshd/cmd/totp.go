@@ -0,0 +1,179 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/internal/auth/totp"
+	"github.com/spf13/cobra"
+)
+
+func NewTOTPCmd() *cobra.Command {
+	totpCmd := &cobra.Command{
+		Use:   "totp",
+		Short: "Two-factor authentication management",
+		Long: `These subcommands can be used to manage TOTP secrets stored by auth.totp
+module.
+
+Users with TOTP enrolled log in using the password followed by '+' and the
+code from the authenticator app, e.g. 'secret+123456'. Mail clients that keep
+the password saved cannot do that, app passwords should be used for them
+instead.
+
+By default, the module configuration block should be named totp,
+this can be changed using --cfg-block flag.`,
+	}
+
+	enrollCmd := &cobra.Command{
+		Use:   "enroll USERNAME",
+		Short: "Generate a TOTP secret for the user",
+		Long: `Generate a TOTP secret for the user and print the otpauth:// URI for it.
+
+The URI should be added to the authenticator app (usually by converting it to
+a QR code), then the code shown by the app should be entered to confirm the
+enrollment. Existing secret of the user is replaced.`,
+		Args: cobra.ExactArgs(1),
+		RunE: totpEnroll,
+	}
+	enrollCmd.Flags().String("cfg-block", "totp", "Module configuration block to use")
+	enrollCmd.Flags().Bool("no-confirm", false, "Save the secret without asking for the code")
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List users having TOTP enrolled",
+		Args:  cobra.NoArgs,
+		RunE:  totpList,
+	}
+	listCmd.Flags().String("cfg-block", "totp", "Module configuration block to use")
+
+	removeCmd := &cobra.Command{
+		Use:   "remove USERNAME",
+		Short: "Disable TOTP for the user",
+		Args:  cobra.ExactArgs(1),
+		RunE:  totpRemove,
+	}
+	removeCmd.Flags().String("cfg-block", "totp", "Module configuration block to use")
+	removeCmd.Flags().BoolP("yes", "y", false, "Don't ask for confirmation")
+
+	totpCmd.AddCommand(enrollCmd, listCmd, removeCmd)
+	return totpCmd
+}
+
+func openTOTP(cmd *cobra.Command) (*totp.Auth, error) {
+	globals, mod, err := getCfgBlockModule(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	be, ok := mod.Instance.(*totp.Auth)
+	if !ok {
+		cfgBlock, _ := cmd.Flags().GetString("cfg-block")
+		return nil, fmt.Errorf("configuration block %s is not auth.totp", cfgBlock)
+	}
+
+	if err := mod.Instance.Init(config.NewMap(globals, mod.Cfg)); err != nil {
+		return nil, fmt.Errorf("Error: module initialization failed: %w", err)
+	}
+
+	return be, nil
+}
+
+func totpEnroll(cmd *cobra.Command, args []string) error {
+	be, err := openTOTP(cmd)
+	if err != nil {
+		return err
+	}
+	defer closeIfNeeded(be)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(os.Stderr, "Add the following URI to the authenticator app:")
+	fmt.Println(be.URI(args[0], secret))
+
+	code := ""
+	if noConfirm, _ := cmd.Flags().GetBool("no-confirm"); !noConfirm {
+		fmt.Fprint(os.Stderr, "Code shown by the app: ")
+		if !stdinScanner.Scan() {
+			if err := stdinScanner.Err(); err != nil {
+				return err
+			}
+			return errors.New("cancelled")
+		}
+		code = strings.TrimSpace(stdinScanner.Text())
+		if code == "" {
+			return errors.New("cancelled")
+		}
+	}
+
+	if err := be.Enroll(args[0], secret, code); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "TOTP enabled, log in using the password followed by '%s' and the code.\n", totp.CodeSeparator)
+	return nil
+}
+
+func totpList(cmd *cobra.Command, _ []string) error {
+	be, err := openTOTP(cmd)
+	if err != nil {
+		return err
+	}
+	defer closeIfNeeded(be)
+
+	users, err := be.ListUsers()
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		fmt.Fprintln(os.Stderr, "No users with TOTP enrolled.")
+	}
+	for _, user := range users {
+		e, err := be.Enrollment(user)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\tenrolled %s\n", user, e.Created.Local().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func totpRemove(cmd *cobra.Command, args []string) error {
+	be, err := openTOTP(cmd)
+	if err != nil {
+		return err
+	}
+	defer closeIfNeeded(be)
+
+	yes, _ := cmd.Flags().GetBool("yes")
+	if !yes {
+		if !Confirmation("Are you sure you want to disable TOTP for this user?", false) {
+			return fmt.Errorf("cancelled")
+		}
+	}
+
+	return be.Unenroll(args[0])
+}
@@ -0,0 +1,169 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/internal/msgtrack"
+	"github.com/spf13/cobra"
+)
+
+func NewTraceCmd() *cobra.Command {
+	traceCmd := &cobra.Command{
+		Use:   "trace",
+		Short: "Search message tracking records",
+		Long: `Show what happened to messages recorded by the message tracking store
+(message_tracking global directive): acceptance, check verdicts, queue
+attempts and the delivery result for each recipient.
+
+All events of messages with at least one event matching all specified filters
+are printed. --from and --to values starting with '@' match all addresses in
+the domain. --since and --until accept RFC 3339 timestamps, dates
+(2006-01-02) or durations relative to the current time (24h).`,
+		Example: `  sirrmeshd trace --from alice@example.org --to bob@example.com --since 24h
+  sirrmeshd trace --msg-id 5b3c1a5e
+  sirrmeshd trace --to @example.com --since 2026-10-17 --until 2026-10-18`,
+		Args: cobra.NoArgs,
+		RunE: traceSearch,
+	}
+	traceCmd.Flags().String("msg-id", "", "Message ID")
+	traceCmd.Flags().String("from", "", "Sender address or @domain")
+	traceCmd.Flags().String("to", "", "Recipient address or @domain")
+	traceCmd.Flags().String("since", "", "Only messages with events after this time")
+	traceCmd.Flags().String("until", "", "Only messages with events before this time")
+	traceCmd.Flags().Int("limit", 20, "Maximum number of messages to show, most recent first")
+	traceCmd.Flags().Bool("json", false, "Print events as JSON objects, one per line")
+	traceCmd.Flags().String("db", "", "Tracking database to use (default is derived from state_dir)")
+	return traceCmd
+}
+
+func openTrackingStore(cmd *cobra.Command) (*msgtrack.Store, error) {
+	path, _ := cmd.Flags().GetString("db")
+	if path == "" {
+		stateDir, err := readStateDir()
+		if err != nil {
+			return nil, err
+		}
+		if messageTracking != nil {
+			path = messageTracking.DBPath(stateDir)
+		} else {
+			path = msgtrack.DefaultPath(stateDir)
+		}
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("%w (is message_tracking enabled?)", err)
+	}
+	return msgtrack.Open(path)
+}
+
+// parseTraceTime parses the --since and --until values.
+func parseTraceTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("malformed time: %s", value)
+}
+
+func traceSearch(cmd *cobra.Command, args []string) error {
+	var (
+		f   msgtrack.Filter
+		err error
+	)
+	now := time.Now()
+	f.MsgID, _ = cmd.Flags().GetString("msg-id")
+	f.Sender, _ = cmd.Flags().GetString("from")
+	f.Rcpt, _ = cmd.Flags().GetString("to")
+	f.Limit, _ = cmd.Flags().GetInt("limit")
+	since, _ := cmd.Flags().GetString("since")
+	if f.Since, err = parseTraceTime(since, now); err != nil {
+		return err
+	}
+	until, _ := cmd.Flags().GetString("until")
+	if f.Until, err = parseTraceTime(until, now); err != nil {
+		return err
+	}
+
+	store, err := openTrackingStore(cmd)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	events, err := store.Query(f)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		fmt.Fprintln(os.Stderr, "No matching messages.")
+		return nil
+	}
+
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, ev := range events {
+			if err := enc.Encode(ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Group events by message, messages are ordered by the first event.
+	var order []string
+	byMsg := make(map[string][]msgtrack.Event)
+	for _, ev := range events {
+		if _, ok := byMsg[ev.MsgID]; !ok {
+			order = append(order, ev.MsgID)
+		}
+		byMsg[ev.MsgID] = append(byMsg[ev.MsgID], ev)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for i, msgID := range order {
+		if i != 0 {
+			fmt.Fprintln(w)
+		}
+		sender := "<>"
+		for _, ev := range byMsg[msgID] {
+			if ev.Sender != "" {
+				sender = ev.Sender
+				break
+			}
+		}
+		fmt.Fprintf(w, "Message %s from %s\n", msgID, sender)
+		for _, ev := range byMsg[msgID] {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\n", ev.Time.Local().Format(time.RFC3339),
+				ev.Kind, ev.Module, ev.Rcpt, ev.Status, ev.Detail)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,59 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// Write serializes nodes back into the configuration syntax. Arguments are
+// quoted when necessary. Snippets, imports and macros are written as is, so
+// nodes returned from Read produce a fully expanded configuration.
+func Write(w io.Writer, nodes []Node) error {
+	bw := bufio.NewWriter(w)
+	writeNodes(bw, nodes, 0)
+	return bw.Flush()
+}
+
+func writeNodes(w *bufio.Writer, nodes []Node, depth int) {
+	for _, node := range nodes {
+		w.WriteString(strings.Repeat("    ", depth))
+		w.WriteString(quoteArg(node.Name))
+		for _, arg := range node.Args {
+			w.WriteByte(' ')
+			w.WriteString(quoteArg(arg))
+		}
+		if node.Children != nil {
+			w.WriteString(" {\n")
+			writeNodes(w, node.Children, depth+1)
+			w.WriteString(strings.Repeat("    ", depth))
+			w.WriteByte('}')
+		}
+		w.WriteByte('\n')
+	}
+}
+
+func quoteArg(s string) string {
+	if s != "" && s != "{" && s != "}" && !strings.ContainsAny(s, " \t\r\n\"#") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
@@ -0,0 +1,55 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package parser
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	const cfg = `a b "c d" {
+    e "" "f#g" "h\"i"
+    j {
+    }
+}
+k
+`
+	nodes, err := Read(strings.NewReader(cfg), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := Write(&out, nodes); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != cfg {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+
+	reread, err := Read(strings.NewReader(out.String()), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(nodes, reread) {
+		t.Fatalf("tree changed after round-trip:\n%#v\n%#v", nodes, reread)
+	}
+}
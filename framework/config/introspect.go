@@ -0,0 +1,225 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Configuration introspection.
+//
+// Map records the directives it filled with default or inherited values and
+// the global directives that were inherited by module blocks. This is used
+// by 'sirrmeshd config' to show the effective configuration and find global
+// directives no module uses.
+
+var (
+	introspectLck sync.Mutex
+	// Directives filled by Map.Process keyed by the block location, nil if
+	// recording is disabled.
+	filledDirectives map[string][]Node
+	usedGlobals      = make(map[string]bool)
+)
+
+func (m *Map) setFormat(name string, format func(interface{}) []string) {
+	matcher := m.entries[name]
+	matcher.format = format
+	m.entries[name] = matcher
+}
+
+func formatString(val interface{}) []string {
+	s, _ := val.(string)
+	if s == "" {
+		return nil
+	}
+	return []string{s}
+}
+
+func formatStringList(val interface{}) []string {
+	l, _ := val.([]string)
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+func formatBool(val interface{}) []string {
+	if b, _ := val.(bool); b {
+		return []string{"yes"}
+	}
+	return []string{"no"}
+}
+
+func formatNumber(val interface{}) []string {
+	return []string{fmt.Sprint(val)}
+}
+
+func formatDuration(val interface{}) []string {
+	d, _ := val.(time.Duration)
+	return []string{d.String()}
+}
+
+func formatDataSize(val interface{}) []string {
+	size, _ := val.(int64)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"G", 1024 * 1024 * 1024},
+		{"M", 1024 * 1024},
+		{"K", 1024},
+	} {
+		if size != 0 && size%unit.size == 0 {
+			return []string{strconv.FormatInt(size/unit.size, 10) + unit.suffix}
+		}
+	}
+	return []string{strconv.FormatInt(size, 10) + "B"}
+}
+
+// mappedKey returns the first (in sorted order) key of mapped that has the
+// value val. Values that can't be compared (e.g. functions) are never found.
+func mappedKey[V any](mapped map[string]V, val V) (string, bool) {
+	keys := make([]string, 0, len(mapped))
+	for k := range mapped {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if reflect.DeepEqual(mapped[k], val) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+func formatMapped[V any](mapped map[string]V) func(interface{}) []string {
+	return func(val interface{}) []string {
+		v, ok := val.(V)
+		if !ok {
+			return nil
+		}
+		key, ok := mappedKey(mapped, v)
+		if !ok {
+			return nil
+		}
+		return []string{key}
+	}
+}
+
+func formatMappedList[V any](mapped map[string]V) func(interface{}) []string {
+	return func(val interface{}) []string {
+		values, _ := val.([]V)
+		if len(values) == 0 {
+			return nil
+		}
+		args := make([]string, 0, len(values))
+		for _, v := range values {
+			key, ok := mappedKey(mapped, v)
+			if !ok {
+				return nil
+			}
+			args = append(args, key)
+		}
+		return args
+	}
+}
+
+func blockKey(block Node) string {
+	return fmt.Sprintf("%s:%d:%s %s", block.File, block.Line, block.Name, strings.Join(block.Args, " "))
+}
+
+// RecordFilled enables recording of directives filled by Map.Process so
+// they can be later retrieved using FilledDirectives.
+func RecordFilled() {
+	introspectLck.Lock()
+	defer introspectLck.Unlock()
+	if filledDirectives == nil {
+		filledDirectives = make(map[string][]Node)
+	}
+}
+
+func recordFilled(block Node, filled []Node) {
+	// Blocks constructed in code have no location and can't be told apart.
+	if block.File == "" || len(filled) == 0 {
+		return
+	}
+
+	introspectLck.Lock()
+	defer introspectLck.Unlock()
+	if filledDirectives == nil {
+		return
+	}
+
+	key := blockKey(block)
+	for _, node := range filled {
+		dup := false
+		for _, existing := range filledDirectives[key] {
+			if existing.Name == node.Name {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			filledDirectives[key] = append(filledDirectives[key], node)
+		}
+	}
+}
+
+// FilledDirectives returns directives filled by all Map.Process calls for
+// the block since RecordFilled was called. Directives present in the block
+// itself are not returned.
+func FilledDirectives(block Node) []Node {
+	introspectLck.Lock()
+	defer introspectLck.Unlock()
+
+	var res []Node
+	for _, node := range filledDirectives[blockKey(block)] {
+		present := false
+		for _, child := range block.Children {
+			if child.Name == node.Name {
+				present = true
+				break
+			}
+		}
+		if !present {
+			res = append(res, node)
+		}
+	}
+	return res
+}
+
+func markGlobalUsed(name string) {
+	introspectLck.Lock()
+	defer introspectLck.Unlock()
+	usedGlobals[name] = true
+}
+
+// GlobalUsed reports whether the value of the global directive was
+// inherited by any configuration block processed so far.
+func GlobalUsed(name string) bool {
+	introspectLck.Lock()
+	defer introspectLck.Unlock()
+	return usedGlobals[name]
+}
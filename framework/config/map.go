@@ -22,10 +22,13 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
+
+	"github.com/sirrchat/SirrMesh/framework/log"
 )
 
 type matcher struct {
@@ -35,6 +38,9 @@ type matcher struct {
 	defaultVal    func() (interface{}, error)
 	mapper        func(*Map, Node) (interface{}, error)
 	store         *reflect.Value
+	// format converts the value back into directive arguments, see
+	// Map.Filled.
+	format func(interface{}) []string
 
 	customCallback func(*Map, Node) error
 }
@@ -63,6 +69,12 @@ type Map struct {
 	Globals map[string]interface{}
 	// Config block used by Process.
 	Block Node
+
+	// Directives missing in the processed block that got their values from
+	// defaults or the global configuration, converted back into the
+	// configuration syntax. Values that have no textual form (e.g. module
+	// references or TLS configuration) are not included. Set by Process.
+	Filled []Node
 }
 
 func NewMap(globals map[string]interface{}, block Node) *Map {
@@ -106,6 +118,7 @@ func (m *Map) EnumList(name string, inheritGlobal, required bool, allowed, defau
 
 		return node.Args, nil
 	}, store)
+	m.setFormat(name, formatStringList)
 }
 
 // Enum maps a configuration directive to a string variable.
@@ -133,6 +146,7 @@ func (m *Map) Enum(name string, inheritGlobal, required bool, allowed []string,
 
 		return nil, NodeErr(node, "invalid argument, valid values are: %v", allowed)
 	}, store)
+	m.setFormat(name, formatString)
 }
 
 // EnumMapped is similar to Map.Enum but maps a stirng to a custom type.
@@ -158,6 +172,7 @@ func EnumMapped[V any](m *Map, name string, inheritGlobal, required bool, mapped
 
 		return val, nil
 	}, store)
+	m.setFormat(name, formatMapped(mapped))
 }
 
 // EnumListMapped is similar to Map.EnumList but maps a stirng to a custom type.
@@ -186,6 +201,7 @@ func EnumListMapped[V any](m *Map, name string, inheritGlobal, required bool, ma
 		}
 		return values, nil
 	}, store)
+	m.setFormat(name, formatMappedList(mapped))
 }
 
 // Duration maps configuration directive to a time.Duration variable.
@@ -222,6 +238,7 @@ func (m *Map) Duration(name string, inheritGlobal, required bool, defaultVal tim
 
 		return dur, nil
 	}, store)
+	m.setFormat(name, formatDuration)
 }
 
 func ParseDataSize(s string) (int, error) {
@@ -304,6 +321,7 @@ func (m *Map) DataSize(name string, inheritGlobal, required bool, defaultVal int
 
 		return int64(dur), nil
 	}, store)
+	m.setFormat(name, formatDataSize)
 }
 
 func ParseBool(s string) (bool, error) {
@@ -344,6 +362,15 @@ func (m *Map) Bool(name string, inheritGlobal, defaultVal bool, store *bool) {
 		}
 		return b, nil
 	}, store)
+	m.setFormat(name, formatBool)
+}
+
+// Logger maps 'debug' and 'log_level' directives to the logger settings.
+// defaultDebug is used if neither the block nor the global configuration
+// (if inheritGlobal is true) has the 'debug' directive.
+func (m *Map) Logger(inheritGlobal, defaultDebug bool, l *log.Logger) {
+	m.Bool("debug", inheritGlobal, defaultDebug, &l.Debug)
+	EnumMapped(m, "log_level", inheritGlobal, false, log.Levels, log.LevelInfo, &l.Level)
 }
 
 // StringList maps configuration directive with the specified name to variable
@@ -367,6 +394,7 @@ func (m *Map) StringList(name string, inheritGlobal, required bool, defaultVal [
 
 		return node.Args, nil
 	}, store)
+	m.setFormat(name, formatStringList)
 }
 
 // String maps configuration directive with the specified name to variable
@@ -389,6 +417,7 @@ func (m *Map) String(name string, inheritGlobal, required bool, defaultVal strin
 
 		return node.Args[0], nil
 	}, store)
+	m.setFormat(name, formatString)
 }
 
 // Int maps configuration directive with the specified name to variable
@@ -415,6 +444,7 @@ func (m *Map) Int(name string, inheritGlobal, required bool, defaultVal int, sto
 		}
 		return i, nil
 	}, store)
+	m.setFormat(name, formatNumber)
 }
 
 // UInt maps configuration directive with the specified name to variable
@@ -441,6 +471,7 @@ func (m *Map) UInt(name string, inheritGlobal, required bool, defaultVal uint, s
 		}
 		return uint(i), nil
 	}, store)
+	m.setFormat(name, formatNumber)
 }
 
 // Int32 maps configuration directive with the specified name to variable
@@ -467,6 +498,7 @@ func (m *Map) Int32(name string, inheritGlobal, required bool, defaultVal int32,
 		}
 		return int32(i), nil
 	}, store)
+	m.setFormat(name, formatNumber)
 }
 
 // UInt32 maps configuration directive with the specified name to variable
@@ -493,6 +525,7 @@ func (m *Map) UInt32(name string, inheritGlobal, required bool, defaultVal uint3
 		}
 		return uint32(i), nil
 	}, store)
+	m.setFormat(name, formatNumber)
 }
 
 // Int64 maps configuration directive with the specified name to variable
@@ -519,6 +552,7 @@ func (m *Map) Int64(name string, inheritGlobal, required bool, defaultVal int64,
 		}
 		return i, nil
 	}, store)
+	m.setFormat(name, formatNumber)
 }
 
 // UInt64 maps configuration directive with the specified name to variable
@@ -545,6 +579,7 @@ func (m *Map) UInt64(name string, inheritGlobal, required bool, defaultVal uint6
 		}
 		return i, nil
 	}, store)
+	m.setFormat(name, formatNumber)
 }
 
 // Float maps configuration directive with the specified name to variable
@@ -568,6 +603,7 @@ func (m *Map) Float(name string, inheritGlobal, required bool, defaultVal float6
 		}
 		return f, nil
 	}, store)
+	m.setFormat(name, formatNumber)
 }
 
 // Custom maps configuration directive with the specified name to variable
@@ -654,6 +690,7 @@ func (m *Map) ProcessWith(globalCfg map[string]interface{}, block Node) (unknown
 	unknown = make([]Node, 0, len(block.Children))
 	matched := make(map[string]bool)
 	m.Values = make(map[string]interface{})
+	m.Filled = nil
 
 	for _, subnode := range block.Children {
 		matcher, ok := m.entries[subnode.Name]
@@ -700,6 +737,7 @@ func (m *Map) ProcessWith(globalCfg map[string]interface{}, block Node) (unknown
 		globalVal, ok := globalCfg[matcher.name]
 		if matcher.inheritGlobal && ok {
 			val = globalVal
+			markGlobalUsed(matcher.name)
 		} else if !matcher.required {
 			if matcher.defaultVal == nil {
 				continue
@@ -737,7 +775,17 @@ func (m *Map) ProcessWith(globalCfg map[string]interface{}, block Node) (unknown
 		if matcher.store != nil {
 			matcher.assign(val)
 		}
+		if matcher.format != nil {
+			if args := matcher.format(val); args != nil {
+				m.Filled = append(m.Filled, Node{Name: matcher.name, Args: args})
+			}
+		}
 	}
 
+	sort.Slice(m.Filled, func(i, j int) bool {
+		return m.Filled[i].Name < m.Filled[j].Name
+	})
+	recordFilled(block, m.Filled)
+
 	return unknown, nil
 }
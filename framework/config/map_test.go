@@ -19,7 +19,11 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package config
 
 import (
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/log"
 )
 
 func TestMapProcess(t *testing.T) {
@@ -493,3 +497,73 @@ func TestMap_Callback(t *testing.T) {
 		t.Error("Wrong directive returned in unmatched slice:", others[0].Name)
 	}
 }
+
+func TestMapProcess_Filled(t *testing.T) {
+	RecordFilled()
+
+	cfg := Node{
+		Name: "block",
+		File: "test",
+		Line: 1,
+		Children: []Node{
+			{Name: "set", Args: []string{"value"}},
+		},
+	}
+	m := NewMap(map[string]interface{}{"inherited": "global"}, cfg)
+	m.String("set", false, false, "", nil)
+	m.String("inherited", true, false, "", nil)
+	m.String("empty", false, false, "", nil)
+	m.Duration("timeout", false, false, 5*time.Minute, nil)
+	m.DataSize("size", false, false, 32*1024*1024, nil)
+	m.Bool("flag", false, false, nil)
+	m.Custom("custom", false, false, func() (interface{}, error) {
+		return 1, nil
+	}, nil, nil)
+	if _, err := m.Process(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Node{
+		{Name: "flag", Args: []string{"no"}},
+		{Name: "inherited", Args: []string{"global"}},
+		{Name: "size", Args: []string{"32M"}},
+		{Name: "timeout", Args: []string{"5m0s"}},
+	}
+	if !reflect.DeepEqual(m.Filled, want) {
+		t.Errorf("wrong Filled:\n%#v\nwant:\n%#v", m.Filled, want)
+	}
+	if filled := FilledDirectives(cfg); !reflect.DeepEqual(filled, want) {
+		t.Errorf("wrong FilledDirectives:\n%#v\nwant:\n%#v", filled, want)
+	}
+	if !GlobalUsed("inherited") {
+		t.Error("inherited global is not marked as used")
+	}
+}
+
+func TestMapLogger(t *testing.T) {
+	cfg := Node{
+		Children: []Node{
+			{
+				Name: "log_level",
+				Args: []string{"warn"},
+			},
+		},
+	}
+
+	m := NewMap(map[string]interface{}{"debug": true}, cfg)
+
+	var l log.Logger
+	m.Logger(true, false, &l)
+
+	_, err := m.Process()
+	if err != nil {
+		t.Fatalf("Unexpected failure: %v", err)
+	}
+
+	if !l.Debug {
+		t.Errorf("debug is not inherited from the global configuration")
+	}
+	if l.Level != log.LevelWarn {
+		t.Errorf("Incorrect log level, want %v, got %v", log.LevelWarn, l.Level)
+	}
+}
@@ -28,13 +28,11 @@ package modconfig
 
 import (
 	"fmt"
-	"io"
 	"reflect"
 	"strings"
 
 	parser "github.com/sirrchat/SirrMesh/framework/cfgparser"
 	"github.com/sirrchat/SirrMesh/framework/config"
-	"github.com/sirrchat/SirrMesh/framework/hooks"
 	"github.com/sirrchat/SirrMesh/framework/log"
 	"github.com/sirrchat/SirrMesh/framework/module"
 )
@@ -69,21 +67,7 @@ func createInlineModule(preferredNamespace, modName string, args []string) (modu
 //
 // args must contain at least one argument, otherwise initInlineModule panics.
 func initInlineModule(modObj module.Module, globals map[string]interface{}, block config.Node) error {
-	err := modObj.Init(config.NewMap(globals, block))
-	if err != nil {
-		return err
-	}
-
-	if closer, ok := modObj.(io.Closer); ok {
-		hooks.AddHook(hooks.EventShutdown, func() {
-			log.Debugf("close %s (%s)", modObj.Name(), modObj.InstanceName())
-			if err := closer.Close(); err != nil {
-				log.Printf("module %s (%s) close failed: %v", modObj.Name(), modObj.InstanceName(), err)
-			}
-		})
-	}
-
-	return nil
+	return module.InitInline(modObj, config.NewMap(globals, block))
 }
 
 // ModuleFromNode does all work to create or get existing module object with a certain type.
@@ -34,11 +34,20 @@ type TLSA = dns.TLSA
 // ExtResolver is a convenience wrapper for miekg/dns library that provides
 // access to certain low-level functionality (notably, AD flag in responses,
 // indicating whether DNSSEC verification was performed by the server).
+//
+// If the resolver set using SetDefault implements Exchanger, queries are
+// sent through it.
 type ExtResolver struct {
 	cl  *dns.Client
+	ex  Exchanger
 	Cfg *dns.ClientConfig
 }
 
+// Exchanger is implemented by resolvers that can answer raw DNS queries.
+type Exchanger interface {
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
 // RCodeError is returned by ExtResolver when the RCODE in response is not
 // NOERROR.
 type RCodeError struct {
@@ -85,6 +94,24 @@ func isLoopback(addr string) bool {
 }
 
 func (e ExtResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := e.doExchange(ctx, msg)
+	observeLookup(dns.TypeToString[msg.Question[0].Qtype], start, err)
+	return resp, err
+}
+
+func (e ExtResolver) doExchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if e.ex != nil {
+		resp, err := e.ex.Exchange(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			return nil, RCodeError{msg.Question[0].Name, resp.Rcode}
+		}
+		return resp, nil
+	}
+
 	var resp *dns.Msg
 	var lastErr error
 	for _, srv := range e.Cfg.Servers {
@@ -374,6 +401,10 @@ func (e ExtResolver) AuthLookupTLSA(ctx context.Context, service, network, domai
 }
 
 func NewExtResolver() (*ExtResolver, error) {
+	if ex, ok := defaultResolver.(Exchanger); ok && overrideServ == "" {
+		return &ExtResolver{ex: ex, Cfg: &dns.ClientConfig{}}, nil
+	}
+
 	cfg, err := dns.ClientConfigFromFile("/etc/resolv.conf")
 	if err != nil {
 		return nil, err
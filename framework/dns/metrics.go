@@ -0,0 +1,112 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lookupsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "dns",
+			Name:      "lookups_total",
+			Help:      "DNS lookups done by modules by record type and result (ok, nxdomain, error)",
+		},
+		[]string{"type", "result"},
+	)
+	lookupDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "dns",
+			Name:      "lookup_duration_seconds",
+			Help:      "Time taken by DNS lookups done by modules",
+			Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		},
+		[]string{"type"},
+	)
+)
+
+func observeLookup(typ string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+		var dnsErr *net.DNSError
+		var rcodeErr RCodeError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			result = "nxdomain"
+		} else if errors.As(err, &rcodeErr) && rcodeErr.Code == dns.RcodeNameError {
+			result = "nxdomain"
+		}
+	}
+	lookupsTotal.WithLabelValues(typ, result).Inc()
+	lookupDuration.WithLabelValues(typ).Observe(time.Since(start).Seconds())
+}
+
+// instrumentedResolver records lookup metrics for the wrapped Resolver.
+type instrumentedResolver struct {
+	Resolver
+}
+
+func (r instrumentedResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	start := time.Now()
+	names, err := r.Resolver.LookupAddr(ctx, addr)
+	observeLookup("PTR", start, err)
+	return names, err
+}
+
+func (r instrumentedResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	start := time.Now()
+	addrs, err := r.Resolver.LookupHost(ctx, host)
+	observeLookup("IP", start, err)
+	return addrs, err
+}
+
+func (r instrumentedResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	start := time.Now()
+	mxs, err := r.Resolver.LookupMX(ctx, name)
+	observeLookup("MX", start, err)
+	return mxs, err
+}
+
+func (r instrumentedResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	start := time.Now()
+	txts, err := r.Resolver.LookupTXT(ctx, name)
+	observeLookup("TXT", start, err)
+	return txts, err
+}
+
+func (r instrumentedResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	start := time.Now()
+	addrs, err := r.Resolver.LookupIPAddr(ctx, host)
+	observeLookup("IP", start, err)
+	return addrs, err
+}
+
+func init() {
+	prometheus.MustRegister(lookupsTotal)
+	prometheus.MustRegister(lookupDuration)
+}
@@ -26,6 +26,14 @@ import (
 
 var overrideServ string
 
+// SetOverride makes DefaultResolver and NewExtResolver use the DNS server at
+// the "IP:PORT" address instead of the system configuration.
+//
+// It should be called before any modules are initialized.
+func SetOverride(server string) {
+	overrideServ = server
+}
+
 // override globally overrides the used DNS server address with one provided.
 // This function is meant only for testing. It should be called before any modules are
 // initialized to have full effect.
@@ -52,10 +52,26 @@ func LookupAddr(ctx context.Context, r Resolver, ip net.IP) (string, error) {
 	return strings.TrimRight(names[0], "."), nil
 }
 
+var defaultResolver Resolver
+
+// SetDefault makes DefaultResolver return the resolver instead of the system
+// one.
+//
+// It should be called before any modules are initialized.
+func SetDefault(r Resolver) {
+	defaultResolver = r
+}
+
+// DefaultResolver returns the resolver modules should use. Lookups done
+// using it are counted in the sirrmesh_dns_lookups_total metric.
 func DefaultResolver() Resolver {
+	if defaultResolver != nil {
+		return instrumentedResolver{defaultResolver}
+	}
+
 	if overrideServ != "" && overrideServ != "system-default" {
 		override(overrideServ)
 	}
 
-	return net.DefaultResolver
+	return instrumentedResolver{net.DefaultResolver}
 }
@@ -30,9 +30,9 @@ const (
 	// signal (on POSIX platforms) and indicates the request to reload the
 	// server configuration from persistent storage.
 	//
-	// Since it is by design problematic to reload the modules configuration,
-	// this event only applies to secondary files such as aliases mapping and
-	// TLS certificates.
+	// Hooks reload secondary files such as aliases mapping and TLS
+	// certificates. Changed module configuration blocks are applied
+	// afterwards by replacing the affected module instances.
 	EventReload
 
 	// EventLogRotate is triggered when the server process receives the SIGUSR1
@@ -41,9 +41,15 @@ const (
 	EventLogRotate
 )
 
+type hook struct {
+	id uint64
+	f  func()
+}
+
 var (
-	hooks    = make(map[Event][]func())
+	hooks    = make(map[Event][]hook)
 	hooksLck sync.Mutex
+	lastID   uint64
 )
 
 func hooksToRun(eventName Event) []func() {
@@ -57,7 +63,9 @@ func hooksToRun(eventName Event) []func() {
 	// The slice is copied so hooks can be run without holding the lock what
 	// might be important since they are likely to do a lot of I/O.
 	hooksEvCpy := make([]func(), 0, len(hooksEv))
-	hooksEvCpy = append(hooksEvCpy, hooksEv...)
+	for _, h := range hooksEv {
+		hooksEvCpy = append(hooksEvCpy, h.f)
+	}
 
 	return hooksEvCpy
 }
@@ -72,9 +80,26 @@ func RunHooks(eventName Event) {
 }
 
 // AddHook installs the hook to be executed when certain event occurs.
-func AddHook(eventName Event, f func()) {
+//
+// The returned function removes the hook, it is used for modules that are
+// closed before the process stops, e.g. on configuration reload.
+func AddHook(eventName Event, f func()) (remove func()) {
 	hooksLck.Lock()
 	defer hooksLck.Unlock()
 
-	hooks[eventName] = append(hooks[eventName], f)
+	lastID++
+	id := lastID
+	hooks[eventName] = append(hooks[eventName], hook{id: id, f: f})
+
+	return func() {
+		hooksLck.Lock()
+		defer hooksLck.Unlock()
+		hooksEv := hooks[eventName]
+		for i, h := range hooksEv {
+			if h.id == id {
+				hooks[eventName] = append(hooksEv[:i:i], hooksEv[i+1:]...)
+				return
+			}
+		}
+	}
 }
@@ -0,0 +1,79 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Entry is a single log message.
+type Entry struct {
+	Time   time.Time
+	Level  Level
+	Name   string
+	Msg    string
+	Fields map[string]interface{}
+
+	// raw is set for messages written using Logger.Write, they are not
+	// followed by fields when formatted.
+	raw bool
+}
+
+// String formats the entry the way it is written by line-based outputs:
+//
+//	name: msg\t{"key":"value","key2":"value2"}
+func (e Entry) String() string {
+	formatted := strings.Builder{}
+	if e.Name != "" {
+		formatted.WriteString(e.Name)
+		formatted.WriteString(": ")
+	}
+	formatted.WriteString(e.Msg)
+	if e.raw {
+		return formatted.String()
+	}
+
+	formatted.WriteRune('\t')
+	if len(e.Fields) != 0 {
+		if err := marshalOrderedJSON(&formatted, e.Fields); err != nil {
+			// Fallback to printing the message with minimal processing.
+			return fmt.Sprintf("[BROKEN FORMATTING: %v] %v %+v", err, e.Msg, e.Fields)
+		}
+	}
+	return formatted.String()
+}
+
+// EntryOutput is implemented by outputs that format messages on their own
+// instead of writing lines produced by Entry.String.
+type EntryOutput interface {
+	Output
+	WriteEntry(e Entry)
+}
+
+// WriteEntry writes the entry to the output. If it does not implement
+// EntryOutput, the formatted line is passed to Output.Write.
+func WriteEntry(out Output, e Entry) {
+	if eo, ok := out.(EntryOutput); ok {
+		eo.WriteEntry(e)
+		return
+	}
+	out.Write(e.Time, e.Level == LevelDebug, e.String())
+}
@@ -0,0 +1,120 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// jsonReserved are keys used by jsonOutput for the message itself. Fields
+// with these names are written with "field." prefix.
+var jsonReserved = map[string]bool{
+	"ts":     true,
+	"level":  true,
+	"logger": true,
+	"msg":    true,
+}
+
+type jsonOutput struct {
+	wc io.WriteCloser
+}
+
+func (o jsonOutput) Write(stamp time.Time, debug bool, msg string) {
+	lvl := LevelInfo
+	if debug {
+		lvl = LevelDebug
+	}
+	o.WriteEntry(Entry{Time: stamp, Level: lvl, Msg: msg, raw: true})
+}
+
+func (o jsonOutput) WriteEntry(e Entry) {
+	builder := strings.Builder{}
+	builder.WriteString(`{"ts":"`)
+	builder.WriteString(e.Time.UTC().Format("2006-01-02T15:04:05.000Z"))
+	builder.WriteString(`","level":"`)
+	builder.WriteString(e.Level.String())
+	builder.WriteRune('"')
+	if e.Name != "" {
+		builder.WriteString(`,"logger":`)
+		writeJSONString(&builder, e.Name)
+	}
+	builder.WriteString(`,"msg":`)
+	writeJSONString(&builder, e.Msg)
+
+	if len(e.Fields) != 0 {
+		fields := make(map[string]interface{}, len(e.Fields))
+		for k, v := range e.Fields {
+			if jsonReserved[k] {
+				k = "field." + k
+			}
+			fields[k] = v
+		}
+
+		fieldsJSON := strings.Builder{}
+		if err := marshalOrderedJSON(&fieldsJSON, fields); err != nil {
+			builder.WriteString(`,"fields_error":`)
+			writeJSONString(&builder, err.Error())
+		} else {
+			builder.WriteRune(',')
+			// Inline the fields object without its braces.
+			builder.WriteString(fieldsJSON.String()[1 : fieldsJSON.Len()-1])
+		}
+	}
+	builder.WriteString("}\n")
+
+	if _, err := io.WriteString(o.wc, builder.String()); err != nil {
+		fmt.Fprintf(os.Stderr, "!!! Failed to write message to log: %v\n", err)
+	}
+}
+
+func (o jsonOutput) Close() error {
+	return o.wc.Close()
+}
+
+func writeJSONString(b *strings.Builder, s string) {
+	blob, err := json.Marshal(s)
+	if err != nil {
+		// Cannot happen for strings.
+		panic(err)
+	}
+	b.Write(blob)
+}
+
+// JSONWriteCloserOutput returns a log.Output implementation that writes
+// messages to the provided io.WriteCloser as JSON objects, one per line:
+//
+//	{"ts":"2006-01-02T15:04:05.000Z","level":"info","logger":"name","msg":"msg","key":"value"}
+//
+// Closing returned log.Output object will close the underlying
+// io.WriteCloser. As with WriteCloserOutput, goroutine-safety depends on the
+// io.Writer.
+func JSONWriteCloserOutput(wc io.WriteCloser) Output {
+	return jsonOutput{wc}
+}
+
+// JSONWriterOutput is similar to JSONWriteCloserOutput but closing returned
+// log.Output object will have no effect on the underlying io.Writer.
+func JSONWriterOutput(w io.Writer) Output {
+	return jsonOutput{nopCloser{w}}
+}
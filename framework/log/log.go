@@ -46,6 +46,10 @@ type Logger struct {
 	Name  string
 	Debug bool
 
+	// Level is the minimal level of written messages. Debug messages are
+	// also written if Debug is set.
+	Level Level
+
 	// Additional fields that will be added
 	// to the Msg output.
 	Fields map[string]interface{}
@@ -56,26 +60,40 @@ func (l Logger) Zap() *zap.Logger {
 	return zap.New(zapLogger{L: l})
 }
 
+// Enabled reports whether messages of the specified level are written.
+func (l Logger) Enabled(lvl Level) bool {
+	if l.Debug {
+		return true
+	}
+	return lvl >= l.Level
+}
+
 func (l Logger) Debugf(format string, val ...interface{}) {
-	if !l.Debug {
+	if !l.Enabled(LevelDebug) {
 		return
 	}
-	l.log(true, l.formatMsg(fmt.Sprintf(format, val...), nil))
+	l.log(LevelDebug, fmt.Sprintf(format, val...), nil)
 }
 
 func (l Logger) Debugln(val ...interface{}) {
-	if !l.Debug {
+	if !l.Enabled(LevelDebug) {
 		return
 	}
-	l.log(true, l.formatMsg(strings.TrimRight(fmt.Sprintln(val...), "\n"), nil))
+	l.log(LevelDebug, strings.TrimRight(fmt.Sprintln(val...), "\n"), nil)
 }
 
 func (l Logger) Printf(format string, val ...interface{}) {
-	l.log(false, l.formatMsg(fmt.Sprintf(format, val...), nil))
+	if !l.Enabled(LevelInfo) {
+		return
+	}
+	l.log(LevelInfo, fmt.Sprintf(format, val...), nil)
 }
 
 func (l Logger) Println(val ...interface{}) {
-	l.log(false, l.formatMsg(strings.TrimRight(fmt.Sprintln(val...), "\n"), nil))
+	if !l.Enabled(LevelInfo) {
+		return
+	}
+	l.log(LevelInfo, strings.TrimRight(fmt.Sprintln(val...), "\n"), nil)
 }
 
 // Msg writes an event log message in a machine-readable format (currently
@@ -94,9 +112,12 @@ func (l Logger) Println(val ...interface{}) {
 // Additionally, time.Time is written as a string in ISO 8601 format.
 // time.Duration follows fmt.Stringer rule above.
 func (l Logger) Msg(msg string, fields ...interface{}) {
+	if !l.Enabled(LevelInfo) {
+		return
+	}
 	m := make(map[string]interface{}, len(fields)/2)
 	fieldsToMap(fields, m)
-	l.log(false, l.formatMsg(msg, m))
+	l.log(LevelInfo, msg, m)
 }
 
 // Error writes an event log message in a machine-readable format (currently
@@ -113,7 +134,7 @@ func (l Logger) Msg(msg string, fields ...interface{}) {
 // context in which the error is *handled*. For example, if error leads to
 // rejection of SMTP DATA command, msg will probably be "DATA error".
 func (l Logger) Error(msg string, err error, fields ...interface{}) {
-	if err == nil {
+	if err == nil || !l.Enabled(LevelError) {
 		return
 	}
 
@@ -130,16 +151,16 @@ func (l Logger) Error(msg string, err error, fields ...interface{}) {
 	}
 	fieldsToMap(fields, allFields)
 
-	l.log(false, l.formatMsg(msg, allFields))
+	l.log(LevelError, msg, allFields)
 }
 
 func (l Logger) DebugMsg(kind string, fields ...interface{}) {
-	if !l.Debug {
+	if !l.Enabled(LevelDebug) {
 		return
 	}
 	m := make(map[string]interface{}, len(fields)/2)
 	fieldsToMap(fields, m)
-	l.log(true, l.formatMsg(kind, m))
+	l.log(LevelDebug, kind, m)
 }
 
 func fieldsToMap(fields []interface{}, out map[string]interface{}) {
@@ -162,28 +183,6 @@ func fieldsToMap(fields []interface{}, out map[string]interface{}) {
 	}
 }
 
-func (l Logger) formatMsg(msg string, fields map[string]interface{}) string {
-	formatted := strings.Builder{}
-
-	formatted.WriteString(msg)
-	formatted.WriteRune('\t')
-
-	if len(l.Fields)+len(fields) != 0 {
-		if fields == nil {
-			fields = make(map[string]interface{})
-		}
-		for k, v := range l.Fields {
-			fields[k] = v
-		}
-		if err := marshalOrderedJSON(&formatted, fields); err != nil {
-			// Fallback to printing the message with minimal processing.
-			return fmt.Sprintf("[BROKEN FORMATTING: %v] %v %+v", err, msg, fields)
-		}
-	}
-
-	return formatted.String()
-}
-
 type LogFormatter interface {
 	FormatLog() string
 }
@@ -192,7 +191,14 @@ type LogFormatter interface {
 // to it will be written as a separate log messages.
 // No line-buffering is done.
 func (l Logger) Write(s []byte) (int, error) {
-	l.log(false, strings.TrimRight(string(s), "\n"))
+	if l.Enabled(LevelInfo) {
+		l.write(Entry{
+			Level: LevelInfo,
+			Name:  l.Name,
+			Msg:   strings.TrimRight(string(s), "\n"),
+			raw:   true,
+		})
+	}
 	return len(s), nil
 }
 
@@ -200,28 +206,46 @@ func (l Logger) Write(s []byte) (int, error) {
 // but will use debug flag on messages. If Logger.Debug is false,
 // Write method of returned object will be no-op.
 func (l Logger) DebugWriter() io.Writer {
-	if !l.Debug {
+	if !l.Enabled(LevelDebug) {
 		return io.Discard
 	}
 	l.Debug = true
 	return &l
 }
 
-func (l Logger) log(debug bool, s string) {
-	if l.Name != "" {
-		s = l.Name + ": " + s
+func (l Logger) log(lvl Level, msg string, fields map[string]interface{}) {
+	if len(l.Fields) != 0 {
+		if fields == nil {
+			fields = make(map[string]interface{}, len(l.Fields))
+		}
+		for k, v := range l.Fields {
+			fields[k] = v
+		}
 	}
 
-	if l.Out != nil {
-		l.Out.Write(time.Now(), debug, s)
-		return
+	l.write(Entry{
+		Level:  lvl,
+		Name:   l.Name,
+		Msg:    msg,
+		Fields: fields,
+	})
+}
+
+func (l Logger) write(e Entry) {
+	out := l.Out
+	if out == nil {
+		out = DefaultLogger.Out
 	}
-	if DefaultLogger.Out != nil {
-		DefaultLogger.Out.Write(time.Now(), debug, s)
+	if out == nil {
+		// Logging is disabled - do nothing.
 		return
 	}
 
-	// Logging is disabled - do nothing.
+	e.Time = time.Now()
+	if !sample(e) {
+		return
+	}
+	WriteEntry(out, e)
 }
 
 // DefaultLogger is the global Logger object that is used by
@@ -0,0 +1,237 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type entryRecorder struct {
+	entries []Entry
+}
+
+func (r *entryRecorder) Write(stamp time.Time, debug bool, msg string) {
+	panic("entryRecorder.Write should not be called")
+}
+
+func (r *entryRecorder) WriteEntry(e Entry) {
+	r.entries = append(r.entries, e)
+}
+
+func (r *entryRecorder) Close() error {
+	return nil
+}
+
+func TestLogger_Levels(t *testing.T) {
+	var lines []string
+	out := FuncOutput(func(_ time.Time, debug bool, msg string) {
+		if debug {
+			msg = "[debug] " + msg
+		}
+		lines = append(lines, msg)
+	}, func() error { return nil })
+
+	l := Logger{Out: out, Name: "test"}
+	l.Debugf("a")
+	l.Printf("b")
+	l.Msg("c", "key", "value")
+	l.Error("d", errors.New("failed"))
+
+	l.Level = LevelError
+	l.Printf("e")
+	l.Error("f", errors.New("failed"))
+
+	l.Level = LevelDebug
+	l.Debugf("g")
+
+	l.Level = LevelOff
+	l.Error("h", errors.New("failed"))
+
+	want := []string{
+		"test: b\t",
+		`test: c` + "\t" + `{"key":"value"}`,
+		`test: d` + "\t" + `{"reason":"failed"}`,
+		`test: f` + "\t" + `{"reason":"failed"}`,
+		"[debug] test: g\t",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("wrong output:\n%s\nexpected:\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLogger_MultiOutputEntries(t *testing.T) {
+	rec := &entryRecorder{}
+	var lines []string
+	plain := FuncOutput(func(_ time.Time, _ bool, msg string) {
+		lines = append(lines, msg)
+	}, func() error { return nil })
+
+	l := Logger{Out: MultiOutput(rec, plain), Name: "test", Fields: map[string]interface{}{"module": "x"}}
+	l.Msg("msg", "key", 1)
+
+	if len(rec.entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(rec.entries))
+	}
+	e := rec.entries[0]
+	if e.Name != "test" || e.Msg != "msg" || e.Level != LevelInfo || e.Fields["key"] != 1 || e.Fields["module"] != "x" {
+		t.Errorf("wrong entry: %+v", e)
+	}
+	if len(lines) != 1 || lines[0] != "test: msg\t"+`{"key":1,"module":"x"}` {
+		t.Errorf("wrong lines: %q", lines)
+	}
+}
+
+type bufCloser struct {
+	strings.Builder
+}
+
+func (*bufCloser) Close() error {
+	return nil
+}
+
+func TestJSONOutput(t *testing.T) {
+	buf := &bufCloser{}
+	l := Logger{Out: JSONWriteCloserOutput(buf), Name: "smtp"}
+	l.Msg("accepted", "msg", "field", "size", 10, "delay", time.Second)
+	l.Write([]byte("raw line\n"))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+
+	var msg map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &msg); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]interface{}{
+		"level":     "info",
+		"logger":    "smtp",
+		"msg":       "accepted",
+		"field.msg": "field",
+		"size":      10.0,
+		"delay":     "1s",
+	} {
+		if msg[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, msg[k])
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, msg["ts"].(string)); err != nil {
+		t.Errorf("malformed ts: %v", err)
+	}
+	if !strings.HasPrefix(lines[0], `{"ts":`) {
+		t.Errorf("ts is not the first key: %s", lines[0])
+	}
+
+	if !strings.Contains(lines[1], `"msg":"raw line"}`) {
+		t.Errorf("wrong raw message: %s", lines[1])
+	}
+}
+
+func TestSampling(t *testing.T) {
+	s := &sampler{
+		cfg:      Sampling{First: 2, Thereafter: 3, Interval: time.Second},
+		counters: make(map[string]*sampleCounter),
+	}
+	now := time.Now()
+
+	var allowed []int
+	for i := 1; i <= 10; i++ {
+		if s.allow("a", now) {
+			allowed = append(allowed, i)
+		}
+	}
+	if want := []int{1, 2, 5, 8}; !reflect.DeepEqual(allowed, want) {
+		t.Errorf("expected %v to be allowed, got %v", want, allowed)
+	}
+
+	if !s.allow("b", now) {
+		t.Error("messages are not sampled independently")
+	}
+	if !s.allow("a", now.Add(time.Second)) {
+		t.Error("counter is not reset after the interval")
+	}
+}
+
+func TestOTLPOutput(t *testing.T) {
+	var (
+		lck  sync.Mutex
+		reqs []otlpRequest
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		blob, _ := io.ReadAll(r.Body)
+		var req otlpRequest
+		if err := json.Unmarshal(blob, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		lck.Lock()
+		reqs = append(reqs, req)
+		lck.Unlock()
+	}))
+	defer srv.Close()
+
+	out := OTLPOutput(srv.URL+"/v1/logs", "sirrmeshd")
+	l := Logger{Out: out, Name: "queue"}
+	l.Error("delivery failed", errors.New("timeout"), "attempt", 3, "retry", true)
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reqs) != 1 || len(reqs[0].ResourceLogs) != 1 {
+		t.Fatalf("expected 1 request, got %+v", reqs)
+	}
+	rl := reqs[0].ResourceLogs[0]
+	if rl.Resource.Attributes[0].Key != "service.name" || *rl.Resource.Attributes[0].Value.StringValue != "sirrmeshd" {
+		t.Errorf("wrong resource: %+v", rl.Resource)
+	}
+	rec := rl.ScopeLogs[0].LogRecords[0]
+	if rec.SeverityNumber != 17 || *rec.Body.StringValue != "delivery failed" {
+		t.Errorf("wrong record: %+v", rec)
+	}
+	attrs := make(map[string]otlpAnyValue)
+	for _, kv := range rec.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if v := attrs["logger.name"].StringValue; v == nil || *v != "queue" {
+		t.Error("missing logger.name attribute")
+	}
+	if v := attrs["attempt"].IntValue; v == nil || *v != "3" {
+		t.Error("wrong attempt attribute")
+	}
+	if v := attrs["retry"].BoolValue; v == nil || !*v {
+		t.Error("wrong retry attribute")
+	}
+	if v := attrs["reason"].StringValue; v == nil || *v != "timeout" {
+		t.Error("wrong reason attribute")
+	}
+}
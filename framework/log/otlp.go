@@ -0,0 +1,273 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// otlpBatchSize is the number of records after which the batch is sent
+	// without waiting for the flush interval.
+	otlpBatchSize = 512
+	// otlpMaxQueued is the number of records kept while the collector is
+	// unavailable, newer records are dropped.
+	otlpMaxQueued = 8192
+	otlpInterval  = time.Second
+)
+
+// otlpOut sends messages to an OpenTelemetry collector using OTLP/HTTP with
+// JSON encoding. Records are sent in batches by a separate goroutine.
+type otlpOut struct {
+	endpoint string
+	resource []otlpKeyValue
+	client   *http.Client
+
+	lck     sync.Mutex
+	queue   []otlpRecord
+	dropped int
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	SeverityNumber int            `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           otlpAnyValue   `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeLogs struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	LogRecords []otlpRecord `json:"logRecords"`
+}
+
+type otlpResourceLogs struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+func otlpString(s string) otlpAnyValue {
+	return otlpAnyValue{StringValue: &s}
+}
+
+func otlpValue(val interface{}) otlpAnyValue {
+	switch val := logValue(val).(type) {
+	case string:
+		return otlpString(val)
+	case bool:
+		return otlpAnyValue{BoolValue: &val}
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		// int64 values are strings in the JSON encoding of OTLP.
+		s := fmt.Sprint(val)
+		return otlpAnyValue{IntValue: &s}
+	case float32:
+		f := float64(val)
+		return otlpAnyValue{DoubleValue: &f}
+	case float64:
+		return otlpAnyValue{DoubleValue: &val}
+	default:
+		blob, err := json.Marshal(val)
+		if err != nil {
+			return otlpString(fmt.Sprint(val))
+		}
+		return otlpString(string(blob))
+	}
+}
+
+// otlpSeverity returns the severity number for the level as defined by the
+// OpenTelemetry log data model.
+func otlpSeverity(lvl Level) int {
+	switch lvl {
+	case LevelDebug:
+		return 5
+	case LevelWarn:
+		return 13
+	case LevelError:
+		return 17
+	default:
+		return 9
+	}
+}
+
+func (o *otlpOut) Write(stamp time.Time, debug bool, msg string) {
+	lvl := LevelInfo
+	if debug {
+		lvl = LevelDebug
+	}
+	o.WriteEntry(Entry{Time: stamp, Level: lvl, Msg: msg, raw: true})
+}
+
+func (o *otlpOut) WriteEntry(e Entry) {
+	rec := otlpRecord{
+		TimeUnixNano:   strconv.FormatInt(e.Time.UnixNano(), 10),
+		SeverityNumber: otlpSeverity(e.Level),
+		SeverityText:   e.Level.String(),
+		Body:           otlpString(e.Msg),
+	}
+	if e.Name != "" {
+		rec.Attributes = append(rec.Attributes, otlpKeyValue{Key: "logger.name", Value: otlpString(e.Name)})
+	}
+	for k, v := range e.Fields {
+		rec.Attributes = append(rec.Attributes, otlpKeyValue{Key: k, Value: otlpValue(v)})
+	}
+
+	o.lck.Lock()
+	if len(o.queue) >= otlpMaxQueued {
+		o.dropped++
+		o.lck.Unlock()
+		return
+	}
+	o.queue = append(o.queue, rec)
+	full := len(o.queue) >= otlpBatchSize
+	o.lck.Unlock()
+
+	if full {
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (o *otlpOut) run() {
+	defer close(o.done)
+
+	t := time.NewTicker(otlpInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-o.wake:
+		case <-o.stop:
+			o.flush()
+			return
+		}
+		o.flush()
+	}
+}
+
+func (o *otlpOut) flush() {
+	o.lck.Lock()
+	batch := o.queue
+	dropped := o.dropped
+	o.queue = nil
+	o.dropped = 0
+	o.lck.Unlock()
+
+	if dropped != 0 {
+		fmt.Fprintf(os.Stderr, "!!! %d log records were dropped, OTLP collector is not keeping up\n", dropped)
+	}
+	for len(batch) != 0 {
+		n := min(len(batch), otlpBatchSize)
+		if err := o.send(batch[:n]); err != nil {
+			fmt.Fprintf(os.Stderr, "!!! Failed to send log records to OTLP collector: %v\n", err)
+			return
+		}
+		batch = batch[n:]
+	}
+}
+
+func (o *otlpOut) send(recs []otlpRecord) error {
+	var rl otlpResourceLogs
+	rl.Resource.Attributes = o.resource
+	sl := otlpScopeLogs{LogRecords: recs}
+	sl.Scope.Name = "sirrmesh"
+	rl.ScopeLogs = []otlpScopeLogs{sl}
+	req := otlpRequest{ResourceLogs: []otlpResourceLogs{rl}}
+
+	blob, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client.Post(o.endpoint, "application/json", bytes.NewReader(blob))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: HTTP status %s", o.endpoint, resp.Status)
+	}
+	return nil
+}
+
+func (o *otlpOut) Close() error {
+	close(o.stop)
+	<-o.done
+	return nil
+}
+
+// OTLPOutput returns a log.Output implementation that sends messages to the
+// OpenTelemetry collector at the endpoint URL (e.g.
+// http://localhost:4318/v1/logs) using OTLP/HTTP with JSON encoding.
+//
+// Messages are sent in batches at least once per second, Close sends the
+// remaining ones. Failures are reported to stderr and the failed batch is
+// dropped.
+//
+// Returned log.Output object is goroutine-safe.
+func OTLPOutput(endpoint, serviceName string) Output {
+	resource := []otlpKeyValue{{Key: "service.name", Value: otlpString(serviceName)}}
+	if hostname, err := os.Hostname(); err == nil {
+		resource = append(resource, otlpKeyValue{Key: "host.name", Value: otlpString(hostname)})
+	}
+
+	o := &otlpOut{
+		endpoint: endpoint,
+		resource: resource,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
@@ -37,6 +37,12 @@ func (m multiOut) Write(stamp time.Time, debug bool, msg string) {
 	}
 }
 
+func (m multiOut) WriteEntry(e Entry) {
+	for _, out := range m.outs {
+		WriteEntry(out, e)
+	}
+}
+
 func (m multiOut) Close() error {
 	for _, out := range m.outs {
 		if err := out.Close(); err != nil {
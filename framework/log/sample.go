@@ -0,0 +1,97 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sampling limits the rate of repeated messages. Within each Interval, the
+// first First messages with the same logger name and text are written and
+// then every Thereafter-th one (none if Thereafter is zero).
+type Sampling struct {
+	First      int
+	Thereafter int
+	Interval   time.Duration
+}
+
+// maxSampleCounters is the number of tracked messages after which counters
+// of finished intervals are dropped.
+const maxSampleCounters = 4096
+
+type sampleCounter struct {
+	start time.Time
+	n     int
+}
+
+type sampler struct {
+	cfg      Sampling
+	lck      sync.Mutex
+	counters map[string]*sampleCounter
+}
+
+var activeSampler atomic.Pointer[sampler]
+
+// SetSampling enables sampling of messages written by all loggers. Zero
+// Interval disables it.
+func SetSampling(cfg Sampling) {
+	if cfg.Interval <= 0 {
+		activeSampler.Store(nil)
+		return
+	}
+	activeSampler.Store(&sampler{
+		cfg:      cfg,
+		counters: make(map[string]*sampleCounter),
+	})
+}
+
+// sample reports whether the entry should be written.
+func sample(e Entry) bool {
+	s := activeSampler.Load()
+	if s == nil {
+		return true
+	}
+	return s.allow(e.Name+"\x00"+e.Msg, e.Time)
+}
+
+func (s *sampler) allow(key string, now time.Time) bool {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	c := s.counters[key]
+	if c == nil || now.Sub(c.start) >= s.cfg.Interval {
+		if c == nil && len(s.counters) >= maxSampleCounters {
+			for k, c := range s.counters {
+				if now.Sub(c.start) >= s.cfg.Interval {
+					delete(s.counters, k)
+				}
+			}
+		}
+		c = &sampleCounter{start: now}
+		s.counters[key] = c
+	}
+
+	c.n++
+	if c.n <= s.cfg.First {
+		return true
+	}
+	return s.cfg.Thereafter > 0 && (c.n-s.cfg.First)%s.cfg.Thereafter == 0
+}
@@ -11,10 +11,20 @@ type zapLogger struct {
 }
 
 func (l zapLogger) Enabled(level zapcore.Level) bool {
-	if l.L.Debug {
-		return true
+	return l.L.Enabled(zapLevel(level))
+}
+
+func zapLevel(level zapcore.Level) Level {
+	switch {
+	case level <= zapcore.DebugLevel:
+		return LevelDebug
+	case level == zapcore.InfoLevel:
+		return LevelInfo
+	case level == zapcore.WarnLevel:
+		return LevelWarn
+	default:
+		return LevelError
 	}
-	return level > zapcore.DebugLevel
 }
 
 func (l zapLogger) With(fields []zapcore.Field) zapcore.Core {
@@ -48,7 +58,7 @@ func (l zapLogger) Write(entry zapcore.Entry, fields []zapcore.Field) error {
 	if entry.LoggerName != "" {
 		l.L.Name += "/" + entry.LoggerName
 	}
-	l.L.log(entry.Level == zapcore.DebugLevel, l.L.formatMsg(entry.Message, enc.Fields))
+	l.L.log(zapLevel(entry.Level), entry.Message, enc.Fields)
 	return nil
 }
 
@@ -18,13 +18,24 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package module
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 // ErrUnknownCredentials should be returned by auth. provider if supplied
 // credentials are valid for it but are not recognized (e.g. not found in
 // used DB).
 var ErrUnknownCredentials = errors.New("unknown credentials")
 
+// ErrSecondFactorRequired should be returned by auth. provider if the
+// password is correct but the one-time code required for the user is
+// missing. The code can then be requested in a separate SASL step and passed
+// to the provider appended to the password using SecondFactorSeparator.
+var ErrSecondFactorRequired = errors.New("second factor required")
+
+const SecondFactorSeparator = "+"
+
 // PlainAuth is the interface implemented by modules providing authentication using
 // username:password pairs.
 //
@@ -33,6 +44,56 @@ type PlainAuth interface {
 	AuthPlain(username, password string) error
 }
 
+// Services passed to ScopedPlainAuth.
+const (
+	AuthScopeIMAP       = "imap"
+	AuthScopeSubmission = "submission"
+)
+
+// ScopedPlainAuth is implemented by PlainAuth modules that allow to restrict
+// credentials to specific services.
+//
+// AuthPlain is used if the service is not known, implementations should
+// accept only unrestricted credentials in this case.
+type ScopedPlainAuth interface {
+	PlainAuth
+	AuthPlainScoped(scope, username, password string) error
+}
+
+// TokenAuth is the interface implemented by modules providing authentication
+// using OAuth 2.0 bearer tokens (RFC 6750), such as JWTs.
+//
+// Modules implementing this interface should be registered with "auth." prefix in name.
+type TokenAuth interface {
+	// AuthToken validates the token and returns the username it was issued
+	// for.
+	AuthToken(ctx context.Context, token string) (string, error)
+}
+
+// SCRAMCredentials are the salted password keys used by SCRAM mechanisms
+// (RFC 5802).
+type SCRAMCredentials struct {
+	Iterations int
+	Salt       []byte
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// SCRAMAuth is the interface implemented by modules that store keys for
+// SCRAM-SHA-256 authentication (RFC 7677).
+//
+// Modules implementing this interface should be registered with "auth." prefix in name.
+type SCRAMAuth interface {
+	// SCRAMSHA256Credentials returns stored keys for the user.
+	// ErrUnknownCredentials is returned if there are none.
+	SCRAMSHA256Credentials(ctx context.Context, username string) (SCRAMCredentials, error)
+
+	// SCRAMEnabled reports whether SCRAM mechanisms should be offered using
+	// this module. Clients preferring SCRAM cannot fall back to other
+	// mechanisms, so it should be set only if users have SCRAM keys.
+	SCRAMEnabled() bool
+}
+
 // PlainUserDB is a local credentials store that can be managed using sirrmeshd command
 // utility.
 type PlainUserDB interface {
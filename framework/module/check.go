@@ -110,4 +110,11 @@ type CheckResult struct {
 	// Header is the header fields that should be
 	// added to the header after all checks.
 	Header textproto.Header
+
+	// ARCSealer and ARCAuthResult contain the authentication results
+	// recorded by a trusted ARC sealer. They are used only for DMARC
+	// evaluation and are not included in the Authentication-Results
+	// header.
+	ARCSealer     string
+	ARCAuthResult []authres.Result
 }
@@ -0,0 +1,171 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+)
+
+const (
+	ClientIMAP       = "imap"
+	ClientSubmission = "submission"
+)
+
+// ClientEndpoint describes a listener mail clients connect to. Endpoint
+// modules register their listeners so client configuration can be derived
+// from them.
+type ClientEndpoint struct {
+	Protocol string // ClientIMAP or ClientSubmission
+	Port     int
+
+	// TLS is set for implicit TLS listeners (RFC 8314), StartTLS for
+	// plaintext listeners that offer STARTTLS.
+	TLS      bool
+	StartTLS bool
+}
+
+// SRVName returns the RFC 6186 (RFC 8314 for implicit TLS) service label
+// of the endpoint, such as "_imaps._tcp".
+func (e ClientEndpoint) SRVName() string {
+	name := "_" + e.Protocol
+	if e.TLS {
+		name += "s"
+	}
+	return name + "._tcp"
+}
+
+// NewClientEndpoint describes the listener address. ok is false for
+// addresses clients can't connect to: Unix sockets and loopback addresses.
+func NewClientEndpoint(protocol string, addr config.Endpoint, startTLS bool) (e ClientEndpoint, ok bool) {
+	if addr.Network() != "tcp" {
+		return ClientEndpoint{}, false
+	}
+	if ip := net.ParseIP(addr.Host); (ip != nil && ip.IsLoopback()) || addr.Host == "localhost" {
+		return ClientEndpoint{}, false
+	}
+	port, err := strconv.Atoi(addr.Port)
+	if err != nil || port <= 0 {
+		return ClientEndpoint{}, false
+	}
+	return ClientEndpoint{
+		Protocol: protocol,
+		Port:     port,
+		TLS:      addr.IsTLS(),
+		StartTLS: !addr.IsTLS() && startTLS,
+	}, true
+}
+
+// security orders endpoints from the most to the least preferred.
+func (e ClientEndpoint) security() int {
+	switch {
+	case e.TLS:
+		return 0
+	case e.StartTLS:
+		return 1
+	default:
+		return 2
+	}
+}
+
+type clientEndpointEntry struct {
+	owner Module
+	ClientEndpoint
+}
+
+var (
+	clientEndpoints     []clientEndpointEntry
+	clientEndpointsLock sync.RWMutex
+)
+
+// RegisterClientEndpoint adds the listener owned by the endpoint module to
+// the list returned by ClientEndpoints. Registering the same protocol and
+// port again replaces the previous entry of the owner.
+//
+// Endpoints should call UnregisterClientEndpoints when closed.
+func RegisterClientEndpoint(owner Module, e ClientEndpoint) {
+	clientEndpointsLock.Lock()
+	defer clientEndpointsLock.Unlock()
+
+	for i, existing := range clientEndpoints {
+		if existing.owner == owner && existing.Protocol == e.Protocol && existing.Port == e.Port {
+			clientEndpoints[i].ClientEndpoint = e
+			return
+		}
+	}
+	clientEndpoints = append(clientEndpoints, clientEndpointEntry{owner: owner, ClientEndpoint: e})
+}
+
+// UnregisterClientEndpoints removes all listeners registered by the module.
+func UnregisterClientEndpoints(owner Module) {
+	clientEndpointsLock.Lock()
+	defer clientEndpointsLock.Unlock()
+
+	kept := clientEndpoints[:0]
+	for _, e := range clientEndpoints {
+		if e.owner != owner {
+			kept = append(kept, e)
+		}
+	}
+	for i := len(kept); i < len(clientEndpoints); i++ {
+		clientEndpoints[i] = clientEndpointEntry{}
+	}
+	clientEndpoints = kept
+}
+
+// ClientEndpoints returns registered listeners of the protocol, implicit TLS
+// ones first, then ones with STARTTLS.
+//
+// During the configuration reload the same port might be registered by the
+// old and the new endpoint instance, the latest registration is used.
+func ClientEndpoints(protocol string) []ClientEndpoint {
+	clientEndpointsLock.RLock()
+	defer clientEndpointsLock.RUnlock()
+
+	var res []ClientEndpoint
+	seen := make(map[int]int)
+	for _, e := range clientEndpoints {
+		if e.Protocol != protocol {
+			continue
+		}
+		if i, ok := seen[e.Port]; ok {
+			res[i] = e.ClientEndpoint
+			continue
+		}
+		seen[e.Port] = len(res)
+		res = append(res, e.ClientEndpoint)
+	}
+	SortClientEndpoints(res)
+	return res
+}
+
+// SortClientEndpoints orders endpoints from the most to the least preferred
+// by security, then by port.
+func SortClientEndpoints(endps []ClientEndpoint) {
+	sort.SliceStable(endps, func(i, j int) bool {
+		if endps[i].security() != endps[j].security() {
+			return endps[i].security() < endps[j].security()
+		}
+		return endps[i].Port < endps[j].Port
+	})
+}
@@ -0,0 +1,58 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClientEndpoints_Reload(t *testing.T) {
+	oldEndp, newEndp := &dummyEndpoint{name: "imap"}, &dummyEndpoint{name: "imap"}
+	defer UnregisterClientEndpoints(oldEndp)
+	defer UnregisterClientEndpoints(newEndp)
+
+	RegisterClientEndpoint(oldEndp, ClientEndpoint{Protocol: ClientIMAP, Port: 993, TLS: true})
+	RegisterClientEndpoint(oldEndp, ClientEndpoint{Protocol: ClientIMAP, Port: 143})
+
+	// The new instance drops port 143 and enables STARTTLS on the other port.
+	RegisterClientEndpoint(newEndp, ClientEndpoint{Protocol: ClientIMAP, Port: 1143, StartTLS: true})
+	RegisterClientEndpoint(newEndp, ClientEndpoint{Protocol: ClientIMAP, Port: 993, TLS: true})
+
+	check := func(want []ClientEndpoint) {
+		t.Helper()
+		if got := ClientEndpoints(ClientIMAP); !reflect.DeepEqual(got, want) {
+			t.Errorf("Wrong endpoints:\ngot  %+v\nwant %+v", got, want)
+		}
+	}
+	check([]ClientEndpoint{
+		{Protocol: ClientIMAP, Port: 993, TLS: true},
+		{Protocol: ClientIMAP, Port: 1143, StartTLS: true},
+		{Protocol: ClientIMAP, Port: 143},
+	})
+
+	UnregisterClientEndpoints(oldEndp)
+	check([]ClientEndpoint{
+		{Protocol: ClientIMAP, Port: 993, TLS: true},
+		{Protocol: ClientIMAP, Port: 1143, StartTLS: true},
+	})
+
+	UnregisterClientEndpoints(newEndp)
+	check(nil)
+}
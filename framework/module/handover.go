@@ -0,0 +1,74 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import "sync"
+
+// On restart, the new server process initializes modules and starts
+// accepting connections while the previous one is still draining its
+// sessions. Modules owning state that must not be used by two processes at
+// once (e.g. scheduling of the queued messages) wait for HandoverDone
+// before touching it.
+
+var (
+	handoverLck  sync.Mutex
+	handoverDone = func() chan struct{} {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}()
+)
+
+// BeginHandover marks the process as started by the previous server process
+// that is still running.
+func BeginHandover() {
+	handoverLck.Lock()
+	defer handoverLck.Unlock()
+	handoverDone = make(chan struct{})
+}
+
+// EndHandover is called once the previous server process exited.
+func EndHandover() {
+	handoverLck.Lock()
+	defer handoverLck.Unlock()
+	select {
+	case <-handoverDone:
+	default:
+		close(handoverDone)
+	}
+}
+
+// HandoverDone returns the channel closed once the previous server process
+// exited. It is closed if the process was not started by another one.
+func HandoverDone() <-chan struct{} {
+	handoverLck.Lock()
+	defer handoverLck.Unlock()
+	return handoverDone
+}
+
+// HandoverPending reports whether the previous server process is still
+// running.
+func HandoverPending() bool {
+	select {
+	case <-HandoverDone():
+		return false
+	default:
+		return true
+	}
+}
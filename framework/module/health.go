@@ -0,0 +1,98 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// HealthChecker is implemented by modules that depend on external services
+// (databases, RPC nodes) and can check whether these are usable.
+//
+// CheckHealth is called by the readiness handler of the openmetrics
+// endpoint and should return quickly, ctx carries the deadline.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+var (
+	ready atomic.Bool
+
+	healthLck      sync.Mutex
+	healthCheckers = make(map[Module]HealthChecker)
+)
+
+// SetReady marks the server as ready to serve requests after all modules
+// are initialized or as not ready when it starts shutting down.
+func SetReady(v bool) {
+	ready.Store(v)
+}
+
+// Ready reports the value set using SetReady.
+func Ready() bool {
+	return ready.Load()
+}
+
+func trackHealth(mod Module) {
+	hc, ok := mod.(HealthChecker)
+	if !ok {
+		return
+	}
+	healthLck.Lock()
+	defer healthLck.Unlock()
+	healthCheckers[mod] = hc
+}
+
+func untrackHealth(mod Module) {
+	healthLck.Lock()
+	defer healthLck.Unlock()
+	delete(healthCheckers, mod)
+}
+
+// CheckHealth runs CheckHealth for all initialized modules implementing
+// HealthChecker concurrently and returns errors keyed by the module name
+// and instance name ("name:instance").
+func CheckHealth(ctx context.Context) map[string]error {
+	healthLck.Lock()
+	checkers := make(map[Module]HealthChecker, len(healthCheckers))
+	for mod, hc := range healthCheckers {
+		checkers[mod] = hc
+	}
+	healthLck.Unlock()
+
+	var (
+		wg     sync.WaitGroup
+		resLck sync.Mutex
+		res    = make(map[string]error, len(checkers))
+	)
+	for mod, hc := range checkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := hc.CheckHealth(ctx)
+			resLck.Lock()
+			res[mod.Name()+":"+mod.InstanceName()] = err
+			resLck.Unlock()
+		}()
+	}
+	wg.Wait()
+	return res
+}
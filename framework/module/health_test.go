@@ -0,0 +1,65 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+)
+
+type healthModule struct {
+	name string
+	err  error
+}
+
+func (m *healthModule) Init(*config.Map) error            { return nil }
+func (m *healthModule) Name() string                      { return "health" }
+func (m *healthModule) InstanceName() string              { return m.name }
+func (m *healthModule) CheckHealth(context.Context) error { return m.err }
+
+func TestCheckHealth(t *testing.T) {
+	ok := &healthModule{name: "ok"}
+	broken := &healthModule{name: "broken", err: errors.New("connection refused")}
+
+	trackHealth(ok)
+	trackHealth(broken)
+	trackHealth(&dummyEndpoint{name: "not_a_checker"})
+	defer untrackHealth(ok)
+	defer untrackHealth(broken)
+
+	res := CheckHealth(context.Background())
+	if len(res) != 2 {
+		t.Fatalf("expected 2 results, got %v", res)
+	}
+	if err := res["health:ok"]; err != nil {
+		t.Errorf("unexpected error for health:ok: %v", err)
+	}
+	if err := res["health:broken"]; err != broken.err {
+		t.Errorf("wrong error for health:broken: %v", err)
+	}
+
+	untrackHealth(broken)
+	res = CheckHealth(context.Background())
+	if _, ok := res["health:broken"]; ok {
+		t.Error("untracked module is still checked")
+	}
+}
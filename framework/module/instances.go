@@ -20,21 +20,24 @@ package module
 
 import (
 	"fmt"
-	"io"
+	"sort"
+	"sync"
 
 	"github.com/sirrchat/SirrMesh/framework/config"
-	"github.com/sirrchat/SirrMesh/framework/hooks"
-	"github.com/sirrchat/SirrMesh/framework/log"
 )
 
+// The registry is modified by the configuration reload while other
+// goroutines (e.g. admin_api handlers) read it, all accesses are guarded by
+// instancesLock. The lock is not held while modules are initialized since
+// Init calls GetInstance for dependencies.
 var (
-	instances = make(map[string]struct {
+	instancesLock sync.RWMutex
+	instances     = make(map[string]struct {
 		mod Module
 		cfg *config.Map
 	})
-	aliases = make(map[string]string)
-
-	Initialized = make(map[string]bool)
+	aliases     = make(map[string]string)
+	initialized = make(map[string]bool)
 )
 
 // RegisterInstance adds module instance to the global registry.
@@ -42,6 +45,8 @@ var (
 // Instance name must be unique. Second RegisterInstance with same instance
 // name will replace previous.
 func RegisterInstance(inst Module, cfg *config.Map) {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
 	instances[inst.InstanceName()] = struct {
 		mod Module
 		cfg *config.Map
@@ -53,10 +58,14 @@ func RegisterInstance(inst Module, cfg *config.Map) {
 // After RegisterAlias, module.GetInstance(aliasName) will return the same
 // result as module.GetInstance(instName).
 func RegisterAlias(aliasName, instName string) {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
 	aliases[aliasName] = instName
 }
 
 func HasInstance(name string) bool {
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
 	aliasedName := aliases[name]
 	if aliasedName != "" {
 		name = aliasedName
@@ -66,12 +75,21 @@ func HasInstance(name string) bool {
 	return ok
 }
 
+// IsInitialized reports whether the initialization of the registered
+// instance was started using GetInstance.
+func IsInitialized(name string) bool {
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+	return initialized[name]
+}
+
 // GetInstance returns module instance from global registry, initializing it if
 // necessary.
 //
 // Error is returned if module initialization fails or module instance does not
 // exists.
 func GetInstance(name string) (Module, error) {
+	instancesLock.Lock()
 	aliasedName := aliases[name]
 	if aliasedName != "" {
 		name = aliasedName
@@ -79,27 +97,122 @@ func GetInstance(name string) (Module, error) {
 
 	mod, ok := instances[name]
 	if !ok {
+		instancesLock.Unlock()
 		return nil, fmt.Errorf("unknown config block: %s", name)
 	}
 
 	// Break circular dependencies.
-	if Initialized[name] {
+	alreadyInit := initialized[name]
+	initialized[name] = true
+	instancesLock.Unlock()
+
+	recordDependency(name)
+	if alreadyInit {
 		return mod.mod, nil
 	}
 
-	Initialized[name] = true
-	if err := mod.mod.Init(mod.cfg); err != nil {
+	if err := InitInstance(mod.mod, mod.cfg); err != nil {
 		return mod.mod, err
 	}
 
-	if closer, ok := mod.mod.(io.Closer); ok {
-		hooks.AddHook(hooks.EventShutdown, func() {
-			log.Debugf("close %s (%s)", mod.mod.Name(), mod.mod.InstanceName())
-			if err := closer.Close(); err != nil {
-				log.Printf("module %s (%s) close failed: %v", mod.mod.Name(), mod.mod.InstanceName(), err)
-			}
+	return mod.mod, nil
+}
+
+// UnregisterInstance removes the module instance and its aliases from the
+// global registry. The module itself is not closed.
+func UnregisterInstance(name string) {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+	delete(instances, name)
+	delete(initialized, name)
+	for alias, instName := range aliases {
+		if instName == name {
+			delete(aliases, alias)
+		}
+	}
+}
+
+// RegistrySnapshot is a copy of the global registry state.
+type RegistrySnapshot struct {
+	instances map[string]struct {
+		mod Module
+		cfg *config.Map
+	}
+	aliases     map[string]string
+	initialized map[string]bool
+}
+
+// SaveRegistry returns a copy of the global registry state that can be
+// restored if the configuration reload fails.
+func SaveRegistry() *RegistrySnapshot {
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+	s := &RegistrySnapshot{
+		instances: make(map[string]struct {
+			mod Module
+			cfg *config.Map
+		}, len(instances)),
+		aliases:     make(map[string]string, len(aliases)),
+		initialized: make(map[string]bool, len(initialized)),
+	}
+	for k, v := range instances {
+		s.instances[k] = v
+	}
+	for k, v := range aliases {
+		s.aliases[k] = v
+	}
+	for k, v := range initialized {
+		s.initialized[k] = v
+	}
+	return s
+}
+
+// Restore replaces the global registry state with the snapshot.
+func (s *RegistrySnapshot) Restore() {
+	instancesLock.Lock()
+	defer instancesLock.Unlock()
+	instances = s.instances
+	aliases = s.aliases
+	initialized = s.initialized
+}
+
+// InstanceInfo describes a module instance in the global registry.
+type InstanceInfo struct {
+	Name        string   `json:"name"`
+	Module      string   `json:"module"`
+	Aliases     []string `json:"aliases,omitempty"`
+	Initialized bool     `json:"initialized"`
+}
+
+// Instances returns information about all registered module instances,
+// sorted by instance name.
+//
+// Endpoints are not module instances and are not included.
+func Instances() []InstanceInfo {
+	instancesLock.RLock()
+	defer instancesLock.RUnlock()
+
+	list := make([]InstanceInfo, 0, len(instances))
+	for name, inst := range instances {
+		list = append(list, InstanceInfo{
+			Name:        name,
+			Module:      inst.mod.Name(),
+			Initialized: initialized[name],
 		})
 	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
 
-	return mod.mod, nil
+	for alias, name := range aliases {
+		i := sort.Search(len(list), func(i int) bool { return list[i].Name >= name })
+		if i < len(list) && list[i].Name == name {
+			list[i].Aliases = append(list[i].Aliases, alias)
+		}
+	}
+	for _, info := range list {
+		sort.Strings(info.Aliases)
+	}
+
+	return list
 }
@@ -0,0 +1,164 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"io"
+	"sync"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/hooks"
+	"github.com/sirrchat/SirrMesh/framework/log"
+)
+
+// Module lifecycle tracking.
+//
+// Modules initialized using InitInstance and InitInline are recorded so the
+// configuration reload can find out which modules depend on a changed
+// instance and close replaced modules together with the modules defined
+// inline in their configuration blocks.
+
+var (
+	lifecycleLck sync.Mutex
+
+	// Modules being initialized, innermost last.
+	initStack []Module
+	// Modules defined inline in the configuration block of the key module.
+	inlineChildren = make(map[Module][]Module)
+	// Names of instances obtained using GetInstance during the
+	// initialization of the key module.
+	dependencies = make(map[Module]map[string]struct{})
+	// Initialized modules that are not closed yet, values remove the
+	// shutdown hook.
+	open = make(map[Module]func())
+)
+
+func pushInit(mod Module, inline bool) {
+	lifecycleLck.Lock()
+	defer lifecycleLck.Unlock()
+	if inline && len(initStack) != 0 {
+		parent := initStack[len(initStack)-1]
+		inlineChildren[parent] = append(inlineChildren[parent], mod)
+	}
+	initStack = append(initStack, mod)
+}
+
+func popInit() {
+	lifecycleLck.Lock()
+	defer lifecycleLck.Unlock()
+	initStack = initStack[:len(initStack)-1]
+}
+
+// recordDependency marks all modules being initialized as dependent on the
+// instance.
+func recordDependency(instName string) {
+	lifecycleLck.Lock()
+	defer lifecycleLck.Unlock()
+	for _, mod := range initStack {
+		if dependencies[mod] == nil {
+			dependencies[mod] = make(map[string]struct{})
+		}
+		dependencies[mod][instName] = struct{}{}
+	}
+}
+
+func initTracked(mod Module, cfg *config.Map, inline bool) error {
+	pushInit(mod, inline)
+	err := mod.Init(cfg)
+	popInit()
+	if err != nil {
+		return err
+	}
+
+	trackHealth(mod)
+	removeHook := func() {}
+	if _, ok := mod.(io.Closer); ok {
+		removeHook = hooks.AddHook(hooks.EventShutdown, func() {
+			if err := CloseInstance(mod); err != nil {
+				log.Printf("module %s (%s) close failed: %v", mod.Name(), mod.InstanceName(), err)
+			}
+		})
+	}
+	lifecycleLck.Lock()
+	open[mod] = removeHook
+	lifecycleLck.Unlock()
+	return nil
+}
+
+// InitInstance initializes the top-level module or endpoint and installs the
+// shutdown hook closing it.
+func InitInstance(mod Module, cfg *config.Map) error {
+	return initTracked(mod, cfg, false)
+}
+
+// InitInline initializes the module defined inline in the configuration
+// block of the module currently being initialized. It is closed by
+// CloseInstance together with that module.
+func InitInline(mod Module, cfg *config.Map) error {
+	return initTracked(mod, cfg, true)
+}
+
+// Dependencies returns the names of module instances the module or modules
+// defined inline in its configuration obtained using GetInstance during
+// initialization.
+func Dependencies(mod Module) []string {
+	lifecycleLck.Lock()
+	defer lifecycleLck.Unlock()
+	names := make([]string, 0, len(dependencies[mod]))
+	for name := range dependencies[mod] {
+		names = append(names, name)
+	}
+	return names
+}
+
+// CloseInstance closes the module if it implements io.Closer and then
+// modules defined inline in its configuration block.
+//
+// Only modules initialized using InitInstance or InitInline are closed, each
+// at most once, subsequent calls are no-op. All state kept for the module is
+// released.
+func CloseInstance(mod Module) error {
+	lifecycleLck.Lock()
+	removeHook, ok := open[mod]
+	if !ok {
+		lifecycleLck.Unlock()
+		return nil
+	}
+	delete(open, mod)
+	children := inlineChildren[mod]
+	delete(inlineChildren, mod)
+	delete(dependencies, mod)
+	lifecycleLck.Unlock()
+	removeHook()
+	untrackHealth(mod)
+	forgetConns(mod)
+
+	var err error
+	if closer, ok := mod.(io.Closer); ok {
+		log.Debugf("close %s (%s)", mod.Name(), mod.InstanceName())
+		err = closer.Close()
+	}
+	for i := len(children) - 1; i >= 0; i-- {
+		child := children[i]
+		if childErr := CloseInstance(child); childErr != nil {
+			log.Printf("module %s (%s) close failed: %v", child.Name(), child.InstanceName(), childErr)
+		}
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+)
+
+type closerModule struct {
+	dummyEndpoint
+	closes int
+}
+
+func (m *closerModule) Close() error {
+	m.closes++
+	return nil
+}
+
+func TestCloseInstance(t *testing.T) {
+	mod := &closerModule{dummyEndpoint: dummyEndpoint{name: "closer"}}
+	if err := InitInstance(mod, config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	ActiveConnections(mod)
+
+	if err := CloseInstance(mod); err != nil {
+		t.Fatal(err)
+	}
+	if err := CloseInstance(mod); err != nil {
+		t.Fatal(err)
+	}
+	if mod.closes != 1 {
+		t.Errorf("module closed %d times", mod.closes)
+	}
+
+	lifecycleLck.Lock()
+	_, isOpen := open[mod]
+	lifecycleLck.Unlock()
+	socketsLck.Lock()
+	_, hasCount := connCounts[mod]
+	socketsLck.Unlock()
+	if isOpen || hasCount {
+		t.Error("state of the closed module is kept")
+	}
+}
+
+// TestRegistryConcurrent should be run with -race.
+func TestRegistryConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			name := "concurrent_" + strconv.Itoa(i)
+			snapshot := SaveRegistry()
+			RegisterInstance(&dummyEndpoint{name: name}, config.NewMap(nil, config.Node{}))
+			RegisterAlias(name+"_alias", name)
+			UnregisterInstance(name)
+			snapshot.Restore()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			Instances()
+			HasInstance("concurrent_1")
+			IsInitialized("concurrent_1")
+		}
+	}()
+	wg.Wait()
+}
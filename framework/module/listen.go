@@ -0,0 +1,420 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Listening sockets shared between endpoint instances.
+//
+// When the configuration is reloaded, the new instance of an endpoint binds
+// the same addresses as the old one. Listen returns a handle for the socket
+// that is already open so the new instance starts accepting connections
+// before the old instance stops and no connection is refused. The socket is
+// closed when the last handle is closed.
+//
+// Sockets passed by the service manager (systemd socket activation) or by
+// the previous server process during the restart are registered using
+// InheritListeners and used instead of binding the address again.
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+type sharedSocket struct {
+	// Requested and actual address, they differ e.g. for port 0.
+	keys  []string
+	l     net.Listener
+	conns chan acceptResult
+	done  chan struct{}
+	refs  int
+}
+
+func (s *sharedSocket) acceptLoop() {
+	for {
+		conn, err := s.l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		select {
+		case s.conns <- acceptResult{conn, err}:
+		case <-s.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+	}
+}
+
+type listenerHandle struct {
+	sock  *sharedSocket
+	owner Module
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (h *listenerHandle) Accept() (net.Conn, error) {
+	select {
+	case <-h.done:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case res := <-h.sock.conns:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return newTrackedConn(h.owner, res.conn), nil
+	case <-h.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (h *listenerHandle) Close() error {
+	var err error
+	h.closeOnce.Do(func() {
+		close(h.done)
+		err = releaseSocket(h)
+	})
+	return err
+}
+
+func (h *listenerHandle) Addr() net.Addr {
+	return h.sock.l.Addr()
+}
+
+// trackedConn counts connections accepted by an owner module.
+type trackedConn struct {
+	net.Conn
+	count     *atomic.Int64
+	closeOnce sync.Once
+}
+
+func newTrackedConn(owner Module, conn net.Conn) net.Conn {
+	cnt := activeConns(owner)
+	cnt.Add(1)
+	return &trackedConn{Conn: conn, count: cnt}
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.count.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+var (
+	socketsLck sync.Mutex
+	sockets    = make(map[string]*sharedSocket)
+	handles    = make(map[Module][]*listenerHandle)
+	connCounts = make(map[Module]*atomic.Int64)
+	handoff    = make(map[Module]bool)
+	inherited  []net.Listener
+)
+
+func activeConns(owner Module) *atomic.Int64 {
+	socketsLck.Lock()
+	defer socketsLck.Unlock()
+	cnt := connCounts[owner]
+	if cnt == nil {
+		cnt = new(atomic.Int64)
+		connCounts[owner] = cnt
+	}
+	return cnt
+}
+
+// Listen returns a listener for the address owned by the endpoint module.
+//
+// If the address is already bound by another endpoint instance that allows
+// handoff (see SetHandoff), the same socket is shared and each accepted
+// connection is passed to one of the owners.
+//
+// If DryRun is set, the address is only checked to be valid and not used by
+// another endpoint, nothing is bound.
+func Listen(owner Module, network, address string) (net.Listener, error) {
+	socketsLck.Lock()
+	defer socketsLck.Unlock()
+
+	key := network + "://" + address
+	sock := sockets[key]
+	if sock != nil {
+		for owner, owned := range handles {
+			for _, h := range owned {
+				if h.sock == sock && !handoff[owner] {
+					return nil, fmt.Errorf("listen %s: address is already used by %s", key, owner.Name())
+				}
+			}
+		}
+	}
+	if sock == nil {
+		l := takeInherited(network, address)
+		if l == nil {
+			listen := net.Listen
+			if DryRun {
+				listen = dryListen
+			}
+			var err error
+			l, err = listen(network, address)
+			if err != nil {
+				return nil, err
+			}
+		}
+		sock = &sharedSocket{
+			keys:  []string{key},
+			l:     l,
+			conns: make(chan acceptResult),
+			done:  make(chan struct{}),
+		}
+		if actual := network + "://" + l.Addr().String(); actual != key {
+			sock.keys = append(sock.keys, actual)
+		}
+		for _, k := range sock.keys {
+			sockets[k] = sock
+		}
+		go sock.acceptLoop()
+	}
+	sock.refs++
+
+	h := &listenerHandle{
+		sock:  sock,
+		owner: owner,
+		done:  make(chan struct{}),
+	}
+	handles[owner] = append(handles[owner], h)
+	return h, nil
+}
+
+func releaseSocket(h *listenerHandle) error {
+	socketsLck.Lock()
+	defer socketsLck.Unlock()
+
+	owned := handles[h.owner]
+	for i, oh := range owned {
+		if oh == h {
+			handles[h.owner] = append(owned[:i], owned[i+1:]...)
+			break
+		}
+	}
+	if len(handles[h.owner]) == 0 {
+		delete(handles, h.owner)
+	}
+
+	h.sock.refs--
+	if h.sock.refs > 0 {
+		return nil
+	}
+	for _, k := range h.sock.keys {
+		delete(sockets, k)
+	}
+	close(h.sock.done)
+	return h.sock.l.Close()
+}
+
+// SetHandoff allows or disallows other endpoints to share sockets owned by
+// the module. It is allowed for endpoints that are being replaced.
+func SetHandoff(owner Module, allow bool) {
+	socketsLck.Lock()
+	defer socketsLck.Unlock()
+	if allow {
+		handoff[owner] = true
+	} else {
+		delete(handoff, owner)
+	}
+}
+
+// StopListening closes all listeners owned by the module. Connections that
+// were already accepted are not affected.
+func StopListening(owner Module) {
+	socketsLck.Lock()
+	owned := append([]*listenerHandle(nil), handles[owner]...)
+	socketsLck.Unlock()
+
+	for _, h := range owned {
+		h.Close()
+	}
+
+	socketsLck.Lock()
+	delete(handoff, owner)
+	socketsLck.Unlock()
+}
+
+// forgetConns removes the connection counter of the closed module.
+func forgetConns(owner Module) {
+	socketsLck.Lock()
+	defer socketsLck.Unlock()
+	delete(connCounts, owner)
+}
+
+// ActiveConnections returns the number of connections accepted by the
+// module listeners that are not closed yet.
+func ActiveConnections(owner Module) int {
+	return int(activeConns(owner).Load())
+}
+
+// Drainer is implemented by endpoints that can ask connected clients to
+// finish their sessions when the endpoint is stopped or replaced.
+type Drainer interface {
+	// Drain is called after the endpoint stopped accepting connections.
+	// Current transactions should be allowed to complete. Connections that
+	// are still open when the drain period ends are closed by Close.
+	Drain()
+}
+
+// InheritListeners registers listening sockets opened outside of Listen.
+// Listen uses them for the matching addresses instead of binding new
+// sockets.
+func InheritListeners(ls []net.Listener) {
+	socketsLck.Lock()
+	defer socketsLck.Unlock()
+	inherited = append(inherited, ls...)
+}
+
+func takeInherited(network, address string) net.Listener {
+	for i, l := range inherited {
+		if addrMatches(l.Addr(), network, address) {
+			inherited = append(inherited[:i], inherited[i+1:]...)
+			return l
+		}
+	}
+	return nil
+}
+
+// addrMatches reports whether the socket bound to addr can be used for the
+// endpoint address. Wildcard IPv4 and IPv6 addresses are considered equal
+// since the service manager might create a dual-stack socket for "0.0.0.0".
+func addrMatches(addr net.Addr, network, address string) bool {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		if network != "tcp" && network != "tcp4" && network != "tcp6" {
+			return false
+		}
+		want, err := net.ResolveTCPAddr(network, address)
+		if err != nil || want.Port != addr.Port {
+			return false
+		}
+		if want.IP.Equal(addr.IP) {
+			return true
+		}
+		return (want.IP == nil || want.IP.IsUnspecified()) && (addr.IP == nil || addr.IP.IsUnspecified())
+	case *net.UnixAddr:
+		return network == "unix" && addr.Name == address
+	}
+	return false
+}
+
+// CloseInherited closes inherited sockets that were not used by any
+// endpoint and returns their addresses.
+func CloseInherited() []string {
+	socketsLck.Lock()
+	defer socketsLck.Unlock()
+	addrs := make([]string, 0, len(inherited))
+	for _, l := range inherited {
+		addrs = append(addrs, l.Addr().Network()+"://"+l.Addr().String())
+		l.Close()
+	}
+	inherited = nil
+	return addrs
+}
+
+// ListenerFiles returns duplicates of the file descriptors of all open
+// listening sockets so they can be passed to another process.
+//
+// Unix sockets are no longer removed from the file system when closed since
+// the other process keeps using them.
+func ListenerFiles() ([]*os.File, error) {
+	socketsLck.Lock()
+	defer socketsLck.Unlock()
+
+	seen := make(map[*sharedSocket]bool)
+	var files []*os.File
+	for _, sock := range sockets {
+		if seen[sock] {
+			continue
+		}
+		seen[sock] = true
+
+		if ul, ok := sock.l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		filer, ok := sock.l.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := filer.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// dryListener is a listener that never accepts connections, used in DryRun
+// mode.
+type dryListener struct {
+	addr      net.Addr
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func dryListen(network, address string) (net.Listener, error) {
+	var (
+		addr net.Addr
+		err  error
+	)
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		addr, err = net.ResolveTCPAddr(network, address)
+	case "unix":
+		addr, err = net.ResolveUnixAddr(network, address)
+	default:
+		err = net.UnknownNetworkError(network)
+	}
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+	return &dryListener{addr: addr, done: make(chan struct{})}, nil
+}
+
+func (l *dryListener) Accept() (net.Conn, error) {
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *dryListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *dryListener) Addr() net.Addr {
+	return l.addr
+}
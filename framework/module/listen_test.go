@@ -0,0 +1,216 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package module
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+)
+
+type dummyEndpoint struct{ name string }
+
+func (d *dummyEndpoint) Init(*config.Map) error { return nil }
+func (d *dummyEndpoint) Name() string           { return d.name }
+func (d *dummyEndpoint) InstanceName() string   { return d.name }
+
+func acceptOne(t *testing.T, l net.Listener) <-chan net.Conn {
+	t.Helper()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(ch)
+			return
+		}
+		ch <- conn
+	}()
+	return ch
+}
+
+func TestListenHandoff(t *testing.T) {
+	oldEndp, newEndp := &dummyEndpoint{"old"}, &dummyEndpoint{"new"}
+
+	oldL, err := Listen(oldEndp, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := oldL.Addr().String()
+
+	if _, err := Listen(newEndp, "tcp", addr); err == nil {
+		t.Fatal("address shared without handoff")
+	}
+
+	SetHandoff(oldEndp, true)
+	newL, err := Listen(newEndp, "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newL.Close()
+
+	// The old endpoint accepts a connection and stops listening.
+	oldAccepted := acceptOne(t, oldL)
+	c1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	serverC1 := <-oldAccepted
+	if serverC1 == nil {
+		t.Fatal("old listener did not accept")
+	}
+	if ActiveConnections(oldEndp) != 1 {
+		t.Fatalf("expected 1 active connection, got %d", ActiveConnections(oldEndp))
+	}
+
+	StopListening(oldEndp)
+	if _, err := oldL.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed from stopped listener, got %v", err)
+	}
+
+	// The socket stays open for the new endpoint.
+	newAccepted := acceptOne(t, newL)
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	select {
+	case conn := <-newAccepted:
+		if conn == nil {
+			t.Fatal("new listener did not accept")
+		}
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("new listener did not accept in time")
+	}
+
+	// Connections accepted before are still tracked.
+	serverC1.Close()
+	if ActiveConnections(oldEndp) != 0 {
+		t.Fatalf("expected no active connections, got %d", ActiveConnections(oldEndp))
+	}
+
+	newL.Close()
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("socket is not closed after the last listener is closed")
+	}
+}
+
+func TestListenDryRun(t *testing.T) {
+	DryRun = true
+	defer func() { DryRun = false }()
+
+	a, b := &dummyEndpoint{"a"}, &dummyEndpoint{"b"}
+
+	l, err := Listen(a, "tcp", "127.0.0.1:25252")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := net.DialTimeout("tcp", "127.0.0.1:25252", time.Second); err == nil {
+		conn.Close()
+		t.Fatal("dry run listener is bound")
+	}
+	if _, err := Listen(b, "tcp", "127.0.0.1:25252"); err == nil {
+		t.Fatal("address shared without handoff")
+	}
+	if _, err := Listen(b, "tcp", "127.0.0.1:notaport"); err == nil {
+		t.Fatal("invalid address accepted")
+	}
+
+	accepted := acceptOne(t, l)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-accepted; ok {
+		t.Fatal("connection accepted")
+	}
+}
+
+func TestListenInherited(t *testing.T) {
+	endp := &dummyEndpoint{"inherit"}
+
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	InheritListeners([]net.Listener{used, unused})
+
+	l, err := Listen(endp, "tcp", used.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Addr().String() != used.Addr().String() {
+		t.Fatalf("inherited socket is not used: %v", l.Addr())
+	}
+
+	accepted := acceptOne(t, l)
+	conn, err := net.Dial("tcp", used.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if c, ok := <-accepted; !ok {
+		t.Fatal("connection not accepted")
+	} else {
+		c.Close()
+	}
+
+	files, err := ListenerFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 listener file, got %d", len(files))
+	}
+	files[0].Close()
+
+	closed := CloseInherited()
+	if len(closed) != 1 || closed[0] != "tcp://"+unused.Addr().String() {
+		t.Fatalf("unexpected unused sockets: %v", closed)
+	}
+}
+
+func TestAddrMatches(t *testing.T) {
+	for _, c := range []struct {
+		addr    net.Addr
+		network string
+		address string
+		match   bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25}, "tcp", "127.0.0.1:25", true},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25}, "tcp", "127.0.0.1:26", false},
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 25}, "tcp", "0.0.0.0:25", true},
+		{&net.TCPAddr{IP: net.IPv6unspecified, Port: 25}, "tcp", "127.0.0.1:25", false},
+		{&net.UnixAddr{Name: "/run/sock", Net: "unix"}, "unix", "/run/sock", true},
+		{&net.UnixAddr{Name: "/run/sock", Net: "unix"}, "tcp", "/run/sock", false},
+	} {
+		if got := addrMatches(c.addr, c.network, c.address); got != c.match {
+			t.Errorf("addrMatches(%v, %s, %s) = %v", c.addr, c.network, c.address, got)
+		}
+	}
+}
@@ -32,6 +32,11 @@ var (
 	// TODO: Replace it with separation of Init and Run at interface level.
 	NoRun = false
 
+	// DryRun makes modules skip side effects of the initialization: sockets
+	// are not bound, databases are not opened and keys are not generated.
+	// It is used to validate the configuration and implies NoRun.
+	DryRun = false
+
 	modules     = make(map[string]FuncNewModule)
 	endpoints   = make(map[string]FuncNewEndpoint)
 	modulesLock sync.RWMutex
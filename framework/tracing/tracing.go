@@ -0,0 +1,183 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tracing contains helpers used to emit OpenTelemetry spans for
+// message processing.
+//
+// Spans are always created using the global TracerProvider. Unless Setup is
+// called (normally by the openmetrics module), it is a no-op provider and
+// instrumentation has negligible overhead.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/sirrchat/SirrMesh"
+
+// MsgIDKey is the attribute key used to attach the message ID to spans.
+const MsgIDKey = attribute.Key("sirrmesh.msg_id")
+
+type msgIDKey struct{}
+
+// WithMsgID returns the context that carries the message ID. All spans
+// started using Start from this context (or its children) get the
+// sirrmesh.msg_id attribute.
+func WithMsgID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, msgIDKey{}, id)
+}
+
+// MsgID returns the message ID stored in ctx by WithMsgID.
+func MsgID(ctx context.Context) string {
+	id, _ := ctx.Value(msgIDKey{}).(string)
+	return id
+}
+
+// Tracer returns the tracer used for all SirrMesh spans.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start starts a new span as a child of the span in ctx.
+//
+// If ctx carries the message ID, it is added to the span attributes.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if id := MsgID(ctx); id != "" {
+		attrs = append(attrs, MsgIDKey.String(id))
+	}
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartRoot starts a new root span. If link is valid, the span is linked to
+// it. It is used for work done asynchronously on behalf of some earlier
+// trace, e.g. queued delivery attempts.
+func StartRoot(ctx context.Context, name string, link trace.SpanContext, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if id := MsgID(ctx); id != "" {
+		attrs = append(attrs, MsgIDKey.String(id))
+	}
+	opts := []trace.SpanStartOption{trace.WithNewRoot(), trace.WithAttributes(attrs...)}
+	if link.IsValid() {
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: link}))
+	}
+	return Tracer().Start(ctx, name, opts...)
+}
+
+// SetError records err on the span and marks it as failed. It is a no-op if
+// err is nil.
+func SetError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End records err (if it is not nil) and ends the span.
+func End(span trace.Span, err error) {
+	SetError(span, err)
+	span.End()
+}
+
+// Inject serializes the span context from ctx as a W3C traceparent
+// value. Empty string is returned if there is no valid span in ctx.
+func Inject(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// Extract returns the span context serialized using Inject.
+func Extract(traceparent string) trace.SpanContext {
+	if traceparent == "" {
+		return trace.SpanContext{}
+	}
+	carrier := propagation.MapCarrier{"traceparent": traceparent}
+	ctx := propagation.TraceContext{}.Extract(context.Background(), carrier)
+	return trace.SpanContextFromContext(ctx)
+}
+
+// Config describes the OTLP exporter configuration.
+type Config struct {
+	// Endpoint is the OTLP/HTTP traces URL, e.g.
+	// http://localhost:4318/v1/traces.
+	Endpoint string
+	// Headers are added to each export request.
+	Headers map[string]string
+	// SampleRatio is the fraction of root spans that are sampled.
+	SampleRatio float64
+	// ServiceName is used as the service.name resource attribute.
+	ServiceName string
+}
+
+// Setup installs the global TracerProvider that exports spans using
+// OTLP/HTTP. The returned function flushes pending spans and shuts the
+// provider down.
+func Setup(cfg Config) (func(context.Context) error, error) {
+	exp, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(cfg.Endpoint),
+		otlptracehttp.WithHeaders(cfg.Headers))
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	return install(sdktrace.NewBatchSpanProcessor(exp), cfg), nil
+}
+
+// SetupWithExporter is similar to Setup but uses the passed exporter with a
+// synchronous span processor. It is intended for tests, see
+// go.opentelemetry.io/otel/sdk/trace/tracetest.
+func SetupWithExporter(exp sdktrace.SpanExporter) func(context.Context) error {
+	return install(sdktrace.NewSimpleSpanProcessor(exp), Config{SampleRatio: 1})
+}
+
+func install(proc sdktrace.SpanProcessor, cfg Config) func(context.Context) error {
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "sirrmesh"
+	}
+	hostname, _ := os.Hostname()
+
+	prev := otel.GetTracerProvider()
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(proc),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(cfg.ServiceName),
+			semconv.HostName(hostname),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		if otel.GetTracerProvider() == tp {
+			otel.SetTracerProvider(prev)
+		}
+		return tp.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestStartRoot(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	shutdown := SetupWithExporter(exp)
+	defer shutdown(context.Background())
+
+	ctx, parent := Start(WithMsgID(context.Background(), "msg1"), "parent")
+	traceparent := Inject(ctx)
+	parent.End()
+	if traceparent == "" {
+		t.Fatal("Inject returned empty string")
+	}
+
+	_, child := StartRoot(WithMsgID(context.Background(), "msg1"), "attempt", Extract(traceparent))
+	child.End()
+
+	spans := exp.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	p, c := spans[0], spans[1]
+	if c.Parent.IsValid() {
+		t.Error("StartRoot span has a parent")
+	}
+	if c.SpanContext.TraceID() == p.SpanContext.TraceID() {
+		t.Error("StartRoot span reused the trace ID")
+	}
+	if len(c.Links) != 1 || c.Links[0].SpanContext.SpanID() != p.SpanContext.SpanID() {
+		t.Errorf("wrong links: %+v", c.Links)
+	}
+	for _, s := range spans {
+		found := false
+		for _, kv := range s.Attributes {
+			if kv.Key == MsgIDKey && kv.Value.AsString() == "msg1" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s: missing msg_id attribute", s.Name)
+		}
+	}
+}
+
+func TestExtract_Empty(t *testing.T) {
+	if Extract("").IsValid() {
+		t.Error("empty traceparent produced valid span context")
+	}
+	if Extract("garbage").IsValid() {
+		t.Error("malformed traceparent produced valid span context")
+	}
+}
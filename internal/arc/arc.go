@@ -0,0 +1,409 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package arc implements Authenticated Received Chain (RFC 8617)
+// validation and sealing.
+//
+// Only the parts of the protocol required by check.arc and modify.arc are
+// implemented: the chain is validated as a whole and new ARC Sets can be
+// added on top of it.
+package arc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/sirrchat/SirrMesh/framework/buffer"
+)
+
+const (
+	headerAAR  = "ARC-Authentication-Results"
+	headerAMS  = "ARC-Message-Signature"
+	headerSeal = "ARC-Seal"
+
+	// MaxInstance is the maximum amount of ARC Sets allowed in a message.
+	MaxInstance = 50
+)
+
+// Chain validation status values used in the cv= tag.
+const (
+	ChainNone = "none"
+	ChainPass = "pass"
+	ChainFail = "fail"
+)
+
+// Set is a single ARC Set, consisting of the ARC-Authentication-Results,
+// ARC-Message-Signature and ARC-Seal fields with the same instance number.
+type Set struct {
+	Instance int
+
+	AAR  string // raw field, including trailing CRLF
+	AMS  string
+	Seal string
+
+	amsTags  map[string]string
+	sealTags map[string]string
+}
+
+// Sealer returns the domain of the ARC-Seal signature.
+func (s *Set) Sealer() string {
+	return s.sealTags["d"]
+}
+
+// AuthResults parses the ARC-Authentication-Results field of the set.
+func (s *Set) AuthResults() (authservID string, results []authres.Result, err error) {
+	_, value, _ := strings.Cut(strings.TrimSuffix(s.AAR, crlf), ":")
+	_, value, ok := strings.Cut(value, ";")
+	if !ok {
+		return "", nil, errors.New("arc: malformed ARC-Authentication-Results")
+	}
+	value = strings.NewReplacer("\r\n", "", "\n", "").Replace(value)
+	return authres.Parse(value)
+}
+
+// Result is the result of the ARC chain validation.
+type Result struct {
+	// Value is one of none, pass, fail, temperror.
+	Value authres.ResultValue
+
+	// Reason is the human-readable explanation for non-passing results.
+	Reason string
+
+	// Err is the error that caused the validation failure, if any.
+	Err error
+
+	// Sets contains all ARC Sets present in the message, sorted by the
+	// instance number. It is populated even if validation failed.
+	Sets []*Set
+
+	// OldestPass is the lowest instance number of the set for which
+	// ARC-Message-Signature still validates. Zero if all of them pass.
+	OldestPass int
+}
+
+// Latest returns the ARC Set with the highest instance number or nil
+// if there are no sets.
+func (r *Result) Latest() *Set {
+	if len(r.Sets) == 0 {
+		return nil
+	}
+	return r.Sets[len(r.Sets)-1]
+}
+
+// rawFields returns raw header fields without the trailing CRLF
+// in the order they appear in the header.
+func rawFields(h textproto.Header) ([]string, error) {
+	res := make([]string, 0, h.Len())
+	for f := h.Fields(); f.Next(); {
+		raw, err := f.Raw()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, strings.TrimSuffix(string(raw), crlf))
+	}
+	return res, nil
+}
+
+func fieldName(raw string) string {
+	k, _, _ := strings.Cut(raw, ":")
+	return strings.TrimSpace(k)
+}
+
+func fieldValue(raw string) string {
+	_, v, _ := strings.Cut(raw, ":")
+	return v
+}
+
+func instanceOf(value string) (int, error) {
+	tag, _, _ := strings.Cut(value, ";")
+	k, v, ok := strings.Cut(tag, "=")
+	if !ok || strings.TrimSpace(k) != "i" {
+		return 0, errors.New("arc: missing instance tag")
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || i < 1 || i > MaxInstance {
+		return 0, errors.New("arc: invalid instance tag")
+	}
+	return i, nil
+}
+
+// parseSets collects the ARC Sets from the header.
+func parseSets(fields []string) ([]*Set, error) {
+	sets := map[int]*Set{}
+	get := func(i int) *Set {
+		s := sets[i]
+		if s == nil {
+			s = &Set{Instance: i}
+			sets[i] = s
+		}
+		return s
+	}
+
+	for _, raw := range fields {
+		name := fieldName(raw)
+		var dst *string
+		switch {
+		case strings.EqualFold(name, headerAAR):
+			i, err := instanceOf(fieldValue(raw))
+			if err != nil {
+				return nil, err
+			}
+			dst = &get(i).AAR
+		case strings.EqualFold(name, headerAMS):
+			tags, err := parseTags(fieldValue(raw))
+			if err != nil {
+				return nil, fmt.Errorf("arc: malformed %s: %w", headerAMS, err)
+			}
+			i, err := strconv.Atoi(tags["i"])
+			if err != nil || i < 1 || i > MaxInstance {
+				return nil, errors.New("arc: invalid instance tag")
+			}
+			get(i).amsTags = tags
+			dst = &get(i).AMS
+		case strings.EqualFold(name, headerSeal):
+			tags, err := parseTags(fieldValue(raw))
+			if err != nil {
+				return nil, fmt.Errorf("arc: malformed %s: %w", headerSeal, err)
+			}
+			i, err := strconv.Atoi(tags["i"])
+			if err != nil || i < 1 || i > MaxInstance {
+				return nil, errors.New("arc: invalid instance tag")
+			}
+			get(i).sealTags = tags
+			dst = &get(i).Seal
+		default:
+			continue
+		}
+		if *dst != "" {
+			return nil, fmt.Errorf("arc: duplicate %s field", name)
+		}
+		*dst = raw + crlf
+	}
+
+	res := make([]*Set, 0, len(sets))
+	for _, s := range sets {
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Instance < res[j].Instance
+	})
+	return res, nil
+}
+
+// Verify validates the ARC chain of the message as described in
+// RFC 8617 Section 5.2. The body is read from the buffer once per
+// ARC-Message-Signature and is never kept in memory as a whole.
+func Verify(ctx context.Context, lookup LookupTXT, h textproto.Header, body buffer.Buffer) *Result {
+	fields, err := rawFields(h)
+	if err != nil {
+		return &Result{Value: authres.ResultFail, Reason: "malformed header", Err: err}
+	}
+	sets, err := parseSets(fields)
+	if err != nil {
+		return &Result{Value: authres.ResultFail, Reason: "malformed ARC set", Err: err}
+	}
+	res := &Result{Sets: sets}
+	if len(sets) == 0 {
+		res.Value = authres.ResultNone
+		return res
+	}
+
+	fail := func(reason string, err error) *Result {
+		res.Value = authres.ResultFail
+		if IsTemporary(err) {
+			res.Value = authres.ResultTempError
+		}
+		res.Reason = reason
+		res.Err = err
+		return res
+	}
+
+	latest := sets[len(sets)-1]
+	if latest.sealTags["cv"] == ChainFail {
+		return fail("chain already failed", nil)
+	}
+
+	// Structure validation: all sets 1..N should be present and complete
+	// and only the first one has cv=none.
+	for i, s := range sets {
+		if s.Instance != i+1 {
+			return fail("missing ARC set", fmt.Errorf("arc: set %d is missing", i+1))
+		}
+		if s.AAR == "" || s.AMS == "" || s.Seal == "" {
+			return fail("incomplete ARC set", fmt.Errorf("arc: set %d is incomplete", s.Instance))
+		}
+		cv := s.sealTags["cv"]
+		if (s.Instance == 1 && cv != ChainNone) || (s.Instance != 1 && cv != ChainPass) {
+			return fail("invalid cv tag", fmt.Errorf("arc: set %d has unexpected cv=%s", s.Instance, cv))
+		}
+	}
+
+	// The most recent AMS should validate. Older ones are checked only to
+	// determine oldest-pass.
+	for i := len(sets) - 1; i >= 0; i-- {
+		err := verifyAMS(ctx, lookup, fields, sets[i], body)
+		if err == nil {
+			continue
+		}
+		if i == len(sets)-1 {
+			return fail("ARC-Message-Signature validation failed", err)
+		}
+		res.OldestPass = sets[i].Instance + 1
+		break
+	}
+
+	for i := len(sets) - 1; i >= 0; i-- {
+		if err := verifySeal(ctx, lookup, sets[:i+1]); err != nil {
+			return fail("ARC-Seal validation failed", err)
+		}
+	}
+
+	res.Value = authres.ResultPass
+	return res
+}
+
+func hashHeaders(w io.Writer, fields []string, keys []string, canon string) {
+	// Pick fields bottom-up, same as DKIM (RFC 6376 Section 5.4.2).
+	used := map[int]bool{}
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), key) {
+				continue
+			}
+			used[i] = true
+			_, _ = io.WriteString(w, canonHeader(fields[i], canon))
+			break
+		}
+	}
+}
+
+func parseCanon(c string) (headerCanon, bodyCanon string, err error) {
+	headerCanon, bodyCanon, ok := strings.Cut(c, "/")
+	if !ok {
+		bodyCanon = CanonSimple
+	}
+	if headerCanon == "" {
+		headerCanon = CanonSimple
+	}
+	for _, c := range []string{headerCanon, bodyCanon} {
+		if c != CanonSimple && c != CanonRelaxed {
+			return "", "", fmt.Errorf("arc: unknown canonicalization: %s", c)
+		}
+	}
+	return headerCanon, bodyCanon, nil
+}
+
+// bodyHashValue streams the body into the hash. I/O errors are temporary.
+func bodyHashValue(body buffer.Buffer, canon string, limit int64) (string, error) {
+	r, err := body.Open()
+	if err != nil {
+		return "", tempError{fmt.Errorf("arc: %w", err)}
+	}
+	defer r.Close()
+	h := sha256.New()
+	if err := hashBody(h, r, canon, limit); err != nil {
+		return "", tempError{fmt.Errorf("arc: %w", err)}
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+func verifyAMS(ctx context.Context, lookup LookupTXT, fields []string, s *Set, body buffer.Buffer) error {
+	tags := s.amsTags
+	for _, t := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[t] == "" {
+			return fmt.Errorf("arc: %s is missing %s= tag", headerAMS, t)
+		}
+	}
+	headerCanon, bodyCanon, err := parseCanon(tags["c"])
+	if err != nil {
+		return err
+	}
+
+	limit := int64(-1)
+	if l, ok := tags["l"]; ok {
+		limit, err = strconv.ParseInt(l, 10, 64)
+		if err != nil || limit < 0 {
+			return errors.New("arc: malformed l= tag")
+		}
+	}
+	bh, err := bodyHashValue(body, bodyCanon, limit)
+	if err != nil {
+		return err
+	}
+	if bh != stripWhitespace(tags["bh"]) {
+		return errors.New("arc: body hash mismatch")
+	}
+
+	hasher := sha256.New()
+	hashHeaders(hasher, fields, strings.Split(tags["h"], ":"), headerCanon)
+	_, _ = io.WriteString(hasher, canonSigHeader(s.AMS, headerCanon))
+
+	return checkSignature(ctx, lookup, tags, hasher.Sum(nil))
+}
+
+func verifySeal(ctx context.Context, lookup LookupTXT, sets []*Set) error {
+	latest := sets[len(sets)-1]
+	tags := latest.sealTags
+	for _, t := range []string{"a", "b", "cv", "d", "s"} {
+		if tags[t] == "" {
+			return fmt.Errorf("arc: %s is missing %s= tag", headerSeal, t)
+		}
+	}
+	if _, ok := tags["h"]; ok {
+		return fmt.Errorf("arc: h= tag is not allowed in %s", headerSeal)
+	}
+
+	hasher := sha256.New()
+	hashSeal(hasher, sets)
+	return checkSignature(ctx, lookup, tags, hasher.Sum(nil))
+}
+
+// hashSeal writes the ARC-Seal signature input for the last set in sets.
+func hashSeal(w io.Writer, sets []*Set) {
+	for i, s := range sets {
+		_, _ = io.WriteString(w, canonHeader(strings.TrimSuffix(s.AAR, crlf), CanonRelaxed))
+		_, _ = io.WriteString(w, canonHeader(strings.TrimSuffix(s.AMS, crlf), CanonRelaxed))
+		if i == len(sets)-1 {
+			_, _ = io.WriteString(w, canonSigHeader(s.Seal, CanonRelaxed))
+		} else {
+			_, _ = io.WriteString(w, canonHeader(strings.TrimSuffix(s.Seal, crlf), CanonRelaxed))
+		}
+	}
+}
+
+func checkSignature(ctx context.Context, lookup LookupTXT, tags map[string]string, hashed []byte) error {
+	pub, err := lookupKey(ctx, lookup, tags["d"], tags["s"])
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["b"]))
+	if err != nil {
+		return fmt.Errorf("arc: malformed signature: %w", err)
+	}
+	return verifySig(pub, tags["a"], hashed, sig)
+}
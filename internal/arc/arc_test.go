@@ -0,0 +1,199 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/sirrchat/SirrMesh/framework/buffer"
+)
+
+const testMsg = "From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game. Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+type testKeys map[string]string
+
+func (k testKeys) lookup(_ context.Context, name string) ([]string, error) {
+	rec, ok := k[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return []string{rec}, nil
+}
+
+func (k testKeys) add(t *testing.T, domain, selector string, signer crypto.Signer) {
+	t.Helper()
+	var rec string
+	switch pub := signer.Public().(type) {
+	case ed25519.PublicKey:
+		rec = "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	case *rsa.PublicKey:
+		blob, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec = "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(blob)
+	}
+	k[selector+"._domainkey."+domain+"."] = rec
+}
+
+func readMsg(t *testing.T, msg string) (textproto.Header, buffer.Buffer) {
+	t.Helper()
+	br := bufio.NewReader(strings.NewReader(msg))
+	h, err := textproto.ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(br); err != nil {
+		t.Fatal(err)
+	}
+	return h, buffer.MemoryBuffer{Slice: body.Bytes()}
+}
+
+func seal(t *testing.T, h *textproto.Header, body buffer.Buffer, domain string, signer crypto.Signer, cv string) {
+	t.Helper()
+	err := Seal(h, body, &SealOptions{
+		Domain:          domain,
+		Selector:        "arc",
+		Signer:          signer,
+		HeaderKeys:      []string{"From", "To", "Subject", "Date", "Message-ID"},
+		AuthServID:      "mx." + domain,
+		AuthResults:     "spf=pass smtp.mailfrom=football.example.com;\r\n dkim=pass header.d=football.example.com",
+		ChainValidation: cv,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealVerify(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeys{}
+	keys.add(t, "list.example.org", "arc", edKey)
+	keys.add(t, "forwarder.example.net", "arc", rsaKey)
+
+	h, body := readMsg(t, testMsg)
+
+	res := Verify(context.Background(), keys.lookup, h, body)
+	if res.Value != authres.ResultNone {
+		t.Fatal("Expected none for the message without ARC sets, got", res.Value)
+	}
+
+	seal(t, &h, body, "list.example.org", edKey, string(res.Value))
+	res = Verify(context.Background(), keys.lookup, h, body)
+	if res.Value != authres.ResultPass {
+		t.Fatal("Expected pass after the first seal, got", res.Value, res.Err)
+	}
+
+	// Subject is rewritten by the list, which is fine since it is re-sealed.
+	h.Set("Subject", "[list] Is dinner ready?")
+	seal(t, &h, body, "forwarder.example.net", rsaKey, ChainPass)
+	res = Verify(context.Background(), keys.lookup, h, body)
+	if res.Value != authres.ResultPass {
+		t.Fatal("Expected pass after the second seal, got", res.Value, res.Err)
+	}
+	if len(res.Sets) != 2 {
+		t.Fatal("Expected 2 sets, got", len(res.Sets))
+	}
+	if res.OldestPass != 2 {
+		t.Error("Expected oldest-pass=2, got", res.OldestPass)
+	}
+	if sealer := res.Latest().Sealer(); sealer != "forwarder.example.net" {
+		t.Error("Wrong latest sealer:", sealer)
+	}
+	authservID, results, err := res.Latest().AuthResults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authservID != "mx.forwarder.example.net" || len(results) != 2 {
+		t.Errorf("Wrong AAR content: %s %v", authservID, results)
+	}
+
+	// Body modification after the last seal breaks the chain.
+	_, tamperedBody := readMsg(t, testMsg+"P.S. Bring snacks.\r\n")
+	res = Verify(context.Background(), keys.lookup, h, tamperedBody)
+	if res.Value != authres.ResultFail {
+		t.Error("Expected fail for the modified body, got", res.Value)
+	}
+
+	// Missing key is a permanent failure.
+	delete(keys, "arc._domainkey.list.example.org.")
+	res = Verify(context.Background(), keys.lookup, h, body)
+	if res.Value != authres.ResultFail {
+		t.Error("Expected fail for the missing key, got", res.Value)
+	}
+}
+
+func TestSeal_FailedChain(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := testKeys{}
+	keys.add(t, "example.org", "arc", edKey)
+
+	h, body := readMsg(t, testMsg)
+	seal(t, &h, body, "example.org", edKey, ChainNone)
+	seal(t, &h, body, "example.org", edKey, ChainFail)
+
+	res := Verify(context.Background(), keys.lookup, h, body)
+	if res.Value != authres.ResultFail {
+		t.Fatal("Expected fail, got", res.Value)
+	}
+
+	err = Seal(&h, body, &SealOptions{
+		Domain:          "example.org",
+		Selector:        "arc",
+		Signer:          edKey,
+		ChainValidation: ChainPass,
+	})
+	if err != ErrNoSeal {
+		t.Fatal("Expected ErrNoSeal, got", err)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+)
+
+const crlf = "\r\n"
+
+const (
+	CanonSimple  = "simple"
+	CanonRelaxed = "relaxed"
+)
+
+// canonHeader canonicalizes a single header field as described in RFC 6376
+// Section 3.4. The raw field should not include the trailing CRLF, the
+// returned value always does.
+func canonHeader(raw string, canon string) string {
+	if canon == CanonSimple {
+		return raw + crlf
+	}
+
+	k, v, ok := strings.Cut(raw, ":")
+	if !ok {
+		return strings.ToLower(strings.TrimSpace(raw)) + ":" + crlf
+	}
+	k = strings.ToLower(strings.TrimSpace(k))
+	v = strings.Join(strings.FieldsFunc(v, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}), " ")
+	return k + ":" + v + crlf
+}
+
+// canonSigHeader canonicalizes the signature header field with the b= tag
+// value removed and without the trailing CRLF, as required for the
+// signature computation.
+func canonSigHeader(raw string, canon string) string {
+	raw = strings.TrimSuffix(raw, crlf)
+	return strings.TrimSuffix(canonHeader(removeSignature(raw), canon), crlf)
+}
+
+// removeSignature removes the value of the b= tag from the header field
+// keeping everything else intact.
+func removeSignature(raw string) string {
+	name, value, ok := strings.Cut(raw, ":")
+	if !ok {
+		return raw
+	}
+	tags := strings.Split(value, ";")
+	for i, tag := range tags {
+		k, _, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		if strings.TrimSpace(k) == "b" {
+			tags[i] = k + "="
+		}
+	}
+	return name + ":" + strings.Join(tags, ";")
+}
+
+// hashBody writes the canonicalized body to w. If limit is not negative, at
+// most limit bytes of canonicalized body are written.
+func hashBody(w io.Writer, body io.Reader, canon string, limit int64) error {
+	if limit >= 0 {
+		w = &limitedWriter{W: w, N: limit}
+	}
+
+	br := bufio.NewReader(body)
+	var (
+		pendingEmpty = 0
+		written      = false
+	)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if len(line) == 0 && errors.Is(err, io.EOF) {
+			break
+		}
+
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if canon == CanonRelaxed {
+			line = relaxLine(line)
+		}
+
+		if len(line) == 0 {
+			pendingEmpty++
+		} else {
+			for ; pendingEmpty > 0; pendingEmpty-- {
+				if _, err := io.WriteString(w, crlf); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, crlf); err != nil {
+				return err
+			}
+			written = true
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+
+	// RFC 6376 Section 3.4.3: an empty body is canonicalized to a single
+	// CRLF in simple mode.
+	if !written && canon == CanonSimple {
+		if _, err := io.WriteString(w, crlf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// relaxLine reduces all whitespace sequences to a single space and removes
+// trailing whitespace.
+func relaxLine(line []byte) []byte {
+	res := make([]byte, 0, len(line))
+	wsp := false
+	for _, ch := range line {
+		if ch == ' ' || ch == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			res = append(res, ' ')
+			wsp = false
+		}
+		res = append(res, ch)
+	}
+	return res
+}
+
+type limitedWriter struct {
+	W io.Writer
+	N int64
+}
+
+func (lw *limitedWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	if lw.N <= 0 {
+		return n, nil
+	}
+	if int64(len(b)) > lw.N {
+		b = b[:lw.N]
+	}
+	written, err := lw.W.Write(b)
+	lw.N -= int64(written)
+	if err != nil {
+		return written, err
+	}
+	return n, nil
+}
@@ -0,0 +1,181 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// LookupTXT is the function used to fetch public keys.
+type LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+// tempError indicates that the chain can't be validated due to a temporary
+// failure, such as DNS timeout.
+type tempError struct {
+	err error
+}
+
+func (te tempError) Error() string {
+	return te.err.Error()
+}
+
+func (te tempError) Unwrap() error {
+	return te.err
+}
+
+// IsTemporary reports whether the validation error is temporary.
+func IsTemporary(err error) bool {
+	var te tempError
+	return errors.As(err, &te)
+}
+
+func lookupKey(ctx context.Context, lookup LookupTXT, domain, selector string) (crypto.PublicKey, error) {
+	txts, err := lookup(ctx, selector+"._domainkey."+domain+".")
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, fmt.Errorf("arc: no key for %s._domainkey.%s", selector, domain)
+		}
+		return nil, tempError{fmt.Errorf("arc: key unavailable: %w", err)}
+	}
+	if len(txts) != 1 {
+		return nil, fmt.Errorf("arc: expected one key record for %s._domainkey.%s, got %d", selector, domain, len(txts))
+	}
+
+	params, err := parseTags(txts[0])
+	if err != nil {
+		return nil, fmt.Errorf("arc: malformed key record: %w", err)
+	}
+	if v, ok := params["v"]; ok && v != "DKIM1" {
+		return nil, errors.New("arc: incompatible key record version")
+	}
+	p := stripWhitespace(params["p"])
+	if p == "" {
+		return nil, errors.New("arc: key revoked")
+	}
+	blob, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, fmt.Errorf("arc: malformed key record: %w", err)
+	}
+
+	switch params["k"] {
+	case "", "rsa":
+		pub, err := x509.ParsePKIXPublicKey(blob)
+		if err != nil {
+			// Some records contain PKCS #1 RSAPublicKey instead.
+			rsaPub, err := x509.ParsePKCS1PublicKey(blob)
+			if err != nil {
+				return nil, fmt.Errorf("arc: malformed RSA key: %w", err)
+			}
+			return rsaPub, nil
+		}
+		rsaPub, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("arc: not a RSA key")
+		}
+		return rsaPub, nil
+	case "ed25519":
+		if len(blob) != ed25519.PublicKeySize {
+			return nil, errors.New("arc: malformed Ed25519 key")
+		}
+		return ed25519.PublicKey(blob), nil
+	default:
+		return nil, fmt.Errorf("arc: unsupported key type: %s", params["k"])
+	}
+}
+
+func verifySig(pub crypto.PublicKey, algo string, hashed, sig []byte) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if algo != "rsa-sha256" {
+			return fmt.Errorf("arc: algorithm %s does not match the key", algo)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed, sig); err != nil {
+			return errors.New("arc: signature verification failed")
+		}
+	case ed25519.PublicKey:
+		if algo != "ed25519-sha256" {
+			return fmt.Errorf("arc: algorithm %s does not match the key", algo)
+		}
+		if !ed25519.Verify(pub, hashed, sig) {
+			return errors.New("arc: signature verification failed")
+		}
+	default:
+		return errors.New("arc: unsupported key type")
+	}
+	return nil
+}
+
+func signAlgo(signer crypto.Signer) (string, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	default:
+		return "", fmt.Errorf("arc: unsupported key type: %T", signer.Public())
+	}
+}
+
+func sign(signer crypto.Signer, hashed []byte) ([]byte, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		// RFC 8463: Ed25519 signs the SHA-256 hash as a message.
+		opts = crypto.Hash(0)
+	}
+	return signer.Sign(rand.Reader, hashed, opts)
+}
+
+func parseTags(s string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok {
+			if strings.TrimSpace(tag) == "" {
+				continue
+			}
+			return nil, errors.New("malformed tag list")
+		}
+		k = strings.TrimSpace(k)
+		if _, ok := params[k]; ok {
+			return nil, fmt.Errorf("duplicate tag: %s", k)
+		}
+		params[k] = strings.TrimSpace(v)
+	}
+	return params, nil
+}
+
+func stripWhitespace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,162 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/sirrchat/SirrMesh/framework/buffer"
+)
+
+// ErrNoSeal is returned by Seal if the message should not be sealed, because
+// the chain is already failed or the maximum number of sets is reached.
+var ErrNoSeal = errors.New("arc: message can't be sealed")
+
+// SealOptions contains the parameters used to add a new ARC Set.
+type SealOptions struct {
+	Domain   string
+	Selector string
+	Signer   crypto.Signer
+
+	// HeaderKeys is the list of header fields covered by
+	// ARC-Message-Signature.
+	HeaderKeys []string
+
+	HeaderCanon string
+	BodyCanon   string
+
+	// AuthServID and AuthResults are used as the content of
+	// ARC-Authentication-Results. AuthResults should be the part of the
+	// Authentication-Results field value after the authserv-id.
+	AuthServID  string
+	AuthResults string
+
+	// ChainValidation is the cv= value: none, pass or fail.
+	ChainValidation string
+
+	// Now is used for the t= tag. Defaults to time.Now.
+	Now func() time.Time
+}
+
+// Seal adds a new ARC Set to the message header.
+//
+// Sets already present in the message are not validated, opts.ChainValidation
+// should contain the result of the Verify call.
+func Seal(h *textproto.Header, body buffer.Buffer, opts *SealOptions) error {
+	fields, err := rawFields(*h)
+	if err != nil {
+		return err
+	}
+	sets, err := parseSets(fields)
+	if err != nil {
+		// Malformed chain is treated as failed one.
+		sets = nil
+		opts.ChainValidation = ChainFail
+	}
+	if len(sets) != 0 && sets[len(sets)-1].sealTags["cv"] == ChainFail {
+		return ErrNoSeal
+	}
+	instance := len(sets) + 1
+	if instance > MaxInstance {
+		return ErrNoSeal
+	}
+	switch {
+	case instance == 1 && opts.ChainValidation != ChainFail:
+		opts.ChainValidation = ChainNone
+	case instance != 1 && opts.ChainValidation == ChainNone:
+		opts.ChainValidation = ChainFail
+	}
+
+	algo, err := signAlgo(opts.Signer)
+	if err != nil {
+		return err
+	}
+	headerCanon, bodyCanon := opts.HeaderCanon, opts.BodyCanon
+	if headerCanon == "" {
+		headerCanon = CanonRelaxed
+	}
+	if bodyCanon == "" {
+		bodyCanon = CanonRelaxed
+	}
+	now := time.Now
+	if opts.Now != nil {
+		now = opts.Now
+	}
+	ts := strconv.FormatInt(now().Unix(), 10)
+
+	set := &Set{Instance: instance}
+
+	authResults := strings.TrimSpace(opts.AuthResults)
+	if authResults == "" {
+		authResults = "none"
+	}
+	set.AAR = fmt.Sprintf("%s: i=%d; %s;\r\n %s\r\n", headerAAR, instance, opts.AuthServID, authResults)
+
+	// ARC-Message-Signature.
+	bh, err := bodyHashValue(body, bodyCanon, -1)
+	if err != nil {
+		return err
+	}
+	ams := fmt.Sprintf("%s: i=%d; a=%s; c=%s/%s;\r\n d=%s; s=%s; t=%s;\r\n h=%s;\r\n bh=%s;\r\n b=",
+		headerAMS, instance, algo, headerCanon, bodyCanon,
+		opts.Domain, opts.Selector, ts,
+		strings.Join(opts.HeaderKeys, ":"), bh)
+	hasher := sha256.New()
+	hashHeaders(hasher, fields, opts.HeaderKeys, headerCanon)
+	_, _ = io.WriteString(hasher, canonSigHeader(ams, headerCanon))
+	sig, err := sign(opts.Signer, hasher.Sum(nil))
+	if err != nil {
+		return fmt.Errorf("arc: signing failed: %w", err)
+	}
+	set.AMS = ams + base64.StdEncoding.EncodeToString(sig) + crlf
+
+	// ARC-Seal.
+	seal := fmt.Sprintf("%s: i=%d; a=%s; t=%s; cv=%s;\r\n d=%s; s=%s;\r\n b=",
+		headerSeal, instance, algo, ts, opts.ChainValidation,
+		opts.Domain, opts.Selector)
+	set.Seal = seal + crlf
+	sealed := append(sets, set)
+	if opts.ChainValidation == ChainFail {
+		// RFC 8617 Section 5.1.2: with cv=fail, the seal covers only the
+		// set it belongs to.
+		sealed = []*Set{set}
+	}
+	hasher = sha256.New()
+	hashSeal(hasher, sealed)
+	sig, err = sign(opts.Signer, hasher.Sum(nil))
+	if err != nil {
+		return fmt.Errorf("arc: signing failed: %w", err)
+	}
+	set.Seal = seal + base64.StdEncoding.EncodeToString(sig) + crlf
+
+	// AddRaw prepends the field, so ARC-Seal ends up at the top.
+	h.AddRaw([]byte(set.AAR))
+	h.AddRaw([]byte(set.AMS))
+	h.AddRaw([]byte(set.Seal))
+	return nil
+}
@@ -0,0 +1,351 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package app_passwords implements the auth.app_passwords module that stores
+// application-specific passwords for accounts that normally authenticate
+// using other means (e.g. wallet signatures).
+package app_passwords
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	modconfig "github.com/sirrchat/SirrMesh/framework/config/module"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"golang.org/x/text/secure/precis"
+)
+
+const modName = "auth.app_passwords"
+
+// Scopes is the list of services an app password can be restricted to.
+var Scopes = []string{module.AuthScopeIMAP, module.AuthScopeSubmission}
+
+// lastUsedPrecision limits how often the last use timestamp is written back
+// to the table.
+const lastUsedPrecision = time.Minute
+
+var nameRe = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,64}$`)
+
+// AppPassword is the stored application-specific password.
+type AppPassword struct {
+	Name string `json:"name"`
+	// Scopes the password can be used for, empty means any service.
+	Scopes   []string  `json:"scopes,omitempty"`
+	Hash     string    `json:"hash"`
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used,omitempty"`
+}
+
+func (p AppPassword) allows(scope string) bool {
+	if len(p.Scopes) == 0 {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type Auth struct {
+	modName    string
+	instName   string
+	inlineArgs []string
+	log        log.Logger
+
+	table module.Table
+
+	// Serializes read-modify-write updates of table entries.
+	updateLck sync.Mutex
+
+	now func() time.Time
+}
+
+func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	return &Auth{
+		modName:    modName,
+		instName:   instName,
+		inlineArgs: inlineArgs,
+		log:        log.Logger{Name: modName},
+		now:        time.Now,
+	}, nil
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	if len(a.inlineArgs) != 0 {
+		return modconfig.ModuleFromNode("table", a.inlineArgs, cfg.Block, cfg.Globals, &a.table)
+	}
+
+	cfg.Logger(true, false, &a.log)
+	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &a.table)
+	_, err := cfg.Process()
+	return err
+}
+
+func (a *Auth) Name() string {
+	return a.modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+// hashPassword hashes the generated password. Generated passwords have enough
+// entropy for a plain SHA-256 hash to be sufficient.
+func hashPassword(password string) string {
+	// Dashes and case are ignored so the password can be typed as displayed
+	// or without separators.
+	password = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(password), "-", ""))
+	sum := sha256.Sum256([]byte(password))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// generatePassword returns a password formatted as four groups of four
+// lowercase letters (~75 bits of entropy).
+func generatePassword() (string, error) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyz"
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for i, c := range raw {
+		if i != 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		// Modulo bias is negligible for a 256/26 ratio at this length.
+		b.WriteByte(alphabet[int(c)%len(alphabet)])
+	}
+	return b.String(), nil
+}
+
+func (a *Auth) mutableTable() (module.MutableTable, error) {
+	tbl, ok := a.table.(module.MutableTable)
+	if !ok {
+		return nil, fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
+	}
+	return tbl, nil
+}
+
+func (a *Auth) load(ctx context.Context, key string) ([]AppPassword, error) {
+	blob, ok, err := a.table.Lookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || blob == "" {
+		return nil, nil
+	}
+	var passwords []AppPassword
+	if err := json.Unmarshal([]byte(blob), &passwords); err != nil {
+		return nil, fmt.Errorf("%s: malformed entry for %s: %w", a.modName, key, err)
+	}
+	return passwords, nil
+}
+
+func (a *Auth) store(key string, passwords []AppPassword) error {
+	tbl, err := a.mutableTable()
+	if err != nil {
+		return err
+	}
+	if len(passwords) == 0 {
+		return tbl.RemoveKey(key)
+	}
+	blob, err := json.Marshal(passwords)
+	if err != nil {
+		return err
+	}
+	return tbl.SetKey(key, string(blob))
+}
+
+func (a *Auth) AuthPlain(username, password string) error {
+	return a.AuthPlainScoped("", username, password)
+}
+
+// AuthPlainScoped checks the password against app passwords of the user
+// allowed for the service. Empty scope matches only unrestricted passwords.
+func (a *Auth) AuthPlainScoped(scope, username, password string) error {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return err
+	}
+
+	passwords, err := a.load(context.TODO(), key)
+	if err != nil {
+		return err
+	}
+
+	hash := hashPassword(password)
+	for _, p := range passwords {
+		if subtle.ConstantTimeCompare([]byte(p.Hash), []byte(hash)) != 1 {
+			continue
+		}
+		if !p.allows(scope) {
+			a.log.Msg("app password used for a wrong service", "username", key, "name", p.Name, "scope", scope)
+			return module.ErrUnknownCredentials
+		}
+		a.log.DebugMsg("authenticated using app password", "username", key, "name", p.Name, "scope", scope)
+		a.touch(key, p.Name)
+		return nil
+	}
+	return module.ErrUnknownCredentials
+}
+
+// touch updates the last use timestamp of the password.
+func (a *Auth) touch(key, name string) {
+	if _, err := a.mutableTable(); err != nil {
+		return
+	}
+
+	a.updateLck.Lock()
+	defer a.updateLck.Unlock()
+
+	passwords, err := a.load(context.TODO(), key)
+	if err != nil {
+		a.log.Error("failed to update last use time", err, "username", key)
+		return
+	}
+	now := a.now()
+	for i := range passwords {
+		if passwords[i].Name != name {
+			continue
+		}
+		if now.Sub(passwords[i].LastUsed) < lastUsedPrecision {
+			return
+		}
+		passwords[i].LastUsed = now.UTC().Truncate(time.Second)
+		if err := a.store(key, passwords); err != nil {
+			a.log.Error("failed to update last use time", err, "username", key)
+		}
+		return
+	}
+}
+
+// CreateAppPassword generates a new password for the user and returns it.
+// The password cannot be retrieved later.
+func (a *Auth) CreateAppPassword(username, name string, scopes []string) (string, error) {
+	if !nameRe.MatchString(name) {
+		return "", fmt.Errorf("%s: invalid name %q, only letters, digits, '.', '_' and '-' are allowed", a.modName, name)
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, s := range Scopes {
+			if scope == s {
+				known = true
+			}
+		}
+		if !known {
+			return "", fmt.Errorf("%s: unknown scope %q, available: %s", a.modName, scope, strings.Join(Scopes, ", "))
+		}
+	}
+
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return "", fmt.Errorf("%s: create %s (raw): %w", a.modName, username, err)
+	}
+	if _, err := a.mutableTable(); err != nil {
+		return "", err
+	}
+
+	a.updateLck.Lock()
+	defer a.updateLck.Unlock()
+
+	passwords, err := a.load(context.TODO(), key)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range passwords {
+		if p.Name == name {
+			return "", fmt.Errorf("%s: app password %s already exists for %s", a.modName, name, key)
+		}
+	}
+
+	password, err := generatePassword()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", a.modName, err)
+	}
+	passwords = append(passwords, AppPassword{
+		Name:    name,
+		Scopes:  scopes,
+		Hash:    hashPassword(password),
+		Created: a.now().UTC().Truncate(time.Second),
+	})
+	if err := a.store(key, passwords); err != nil {
+		return "", fmt.Errorf("%s: create %s: %w", a.modName, key, err)
+	}
+	return password, nil
+}
+
+// ListAppPasswords returns app passwords of the user.
+func (a *Auth) ListAppPasswords(username string) ([]AppPassword, error) {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return nil, fmt.Errorf("%s: list %s (raw): %w", a.modName, username, err)
+	}
+	return a.load(context.TODO(), key)
+}
+
+// ListUsers returns users that have at least one app password.
+func (a *Auth) ListUsers() ([]string, error) {
+	tbl, err := a.mutableTable()
+	if err != nil {
+		return nil, err
+	}
+	return tbl.Keys()
+}
+
+var ErrNoSuchPassword = errors.New("no such app password")
+
+// RevokeAppPassword removes the app password.
+func (a *Auth) RevokeAppPassword(username, name string) error {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return fmt.Errorf("%s: revoke %s (raw): %w", a.modName, username, err)
+	}
+
+	a.updateLck.Lock()
+	defer a.updateLck.Unlock()
+
+	passwords, err := a.load(context.TODO(), key)
+	if err != nil {
+		return err
+	}
+	for i, p := range passwords {
+		if p.Name == name {
+			passwords = append(passwords[:i], passwords[i+1:]...)
+			return a.store(key, passwords)
+		}
+	}
+	return fmt.Errorf("%s: %s: %w", a.modName, name, ErrNoSuchPassword)
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,137 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package app_passwords
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+)
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (m mutableTable) Keys() ([]string, error) {
+	var keys []string
+	for k := range m.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m mutableTable) SetKey(k, v string) error {
+	m.M[k] = v
+	return nil
+}
+
+func (m mutableTable) RemoveKey(k string) error {
+	delete(m.M, k)
+	return nil
+}
+
+func newTestAuth(t *testing.T) (*Auth, mutableTable) {
+	mod, err := New(modName, "", nil, []string{"dummy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mod.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	a.log = testutils.Logger(t, modName)
+	tbl := mutableTable{testutils.Table{M: map[string]string{}}}
+	a.table = tbl
+	return a, tbl
+}
+
+func TestAppPasswords(t *testing.T) {
+	a, tbl := newTestAuth(t)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	phone, err := a.CreateAppPassword("0xABC@example.org", "phone", []string{module.AuthScopeIMAP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[a-z]{4}-[a-z]{4}-[a-z]{4}-[a-z]{4}$`).MatchString(phone) {
+		t.Errorf("Unexpected password format: %s", phone)
+	}
+	laptop, err := a.CreateAppPassword("0xabc@example.org", "laptop", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(tbl.M["0xabc@example.org"], phone) {
+		t.Error("Password is stored in plain text")
+	}
+
+	if _, err := a.CreateAppPassword("0xabc@example.org", "phone", nil); err == nil {
+		t.Error("Duplicate name accepted")
+	}
+	if _, err := a.CreateAppPassword("0xabc@example.org", "bad name", nil); err == nil {
+		t.Error("Invalid name accepted")
+	}
+	if _, err := a.CreateAppPassword("0xabc@example.org", "tablet", []string{"pop3"}); err == nil {
+		t.Error("Unknown scope accepted")
+	}
+
+	check := func(scope, user, pass string, ok bool) {
+		t.Helper()
+		err := a.AuthPlainScoped(scope, user, pass)
+		if (err == nil) != ok {
+			t.Errorf("scope=%q user=%s: ok=%v, err: %v", scope, user, ok, err)
+		}
+	}
+	check(module.AuthScopeIMAP, "0xabc@example.org", phone, true)
+	check(module.AuthScopeIMAP, "0xabc@example.org", strings.ToUpper(strings.ReplaceAll(phone, "-", "")), true)
+	check(module.AuthScopeSubmission, "0xabc@example.org", phone, false)
+	check("", "0xabc@example.org", phone, false)
+	check(module.AuthScopeSubmission, "0xabc@example.org", laptop, true)
+	check("", "0xabc@example.org", laptop, true)
+	check(module.AuthScopeIMAP, "0xabc@example.org", "wrong", false)
+	check(module.AuthScopeIMAP, "0xdef@example.org", phone, false)
+
+	list, err := a.ListAppPasswords("0xabc@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "phone" || !list[0].LastUsed.Equal(now) || !list[0].Created.Equal(now) {
+		t.Errorf("Wrong list: %+v", list)
+	}
+
+	if err := a.RevokeAppPassword("0xabc@example.org", "phone"); err != nil {
+		t.Fatal(err)
+	}
+	check(module.AuthScopeIMAP, "0xabc@example.org", phone, false)
+	if err := a.RevokeAppPassword("0xabc@example.org", "phone"); !errors.Is(err, ErrNoSuchPassword) {
+		t.Errorf("Expected ErrNoSuchPassword, got %v", err)
+	}
+	if err := a.RevokeAppPassword("0xabc@example.org", "laptop"); err != nil {
+		t.Fatal(err)
+	}
+	if users, _ := a.ListUsers(); len(users) != 0 {
+		t.Errorf("Empty entry is not removed: %v", users)
+	}
+}
@@ -64,7 +64,7 @@ func (ea *ExternalAuth) InstanceName() string {
 }
 
 func (ea *ExternalAuth) Init(cfg *config.Map) error {
-	cfg.Bool("debug", false, false, &ea.Log.Debug)
+	cfg.Logger(false, false, &ea.Log)
 	cfg.Bool("perdomain", false, false, &ea.perDomain)
 	cfg.StringList("domains", false, false, nil, &ea.domains)
 	cfg.String("helper", false, false, "", &ea.helperPath)
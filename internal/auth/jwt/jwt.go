@@ -0,0 +1,270 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package jwt implements the auth.jwt module that authenticates users using
+// JSON Web Tokens (RFC 7519) signed by keys from the local JWKS file.
+package jwt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+const modName = "auth.jwt"
+
+type Auth struct {
+	instName string
+	log      log.Logger
+
+	jwksPath      string
+	issuer        string
+	audience      string
+	usernameClaim string
+	leeway        time.Duration
+
+	keysLck   sync.Mutex
+	keys      []verificationKey
+	keysMtime time.Time
+
+	// Used in tests.
+	now func() time.Time
+}
+
+func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	a := &Auth{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		now:      time.Now,
+	}
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		a.jwksPath = inlineArgs[0]
+	default:
+		return nil, fmt.Errorf("%s: at most one argument expected", modName)
+	}
+	return a, nil
+}
+
+func (a *Auth) Name() string {
+	return modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	cfg.Logger(true, false, &a.log)
+	cfg.String("jwks_file", false, a.jwksPath == "", a.jwksPath, &a.jwksPath)
+	cfg.String("issuer", false, false, "", &a.issuer)
+	cfg.String("audience", false, false, "", &a.audience)
+	cfg.String("username_claim", false, false, "sub", &a.usernameClaim)
+	cfg.Duration("leeway", false, false, time.Minute, &a.leeway)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if _, err := a.loadKeys(); err != nil {
+		return fmt.Errorf("%s: %w", modName, err)
+	}
+	return nil
+}
+
+// loadKeys returns keys from the JWKS file, re-reading it if it was
+// changed since the last call.
+func (a *Auth) loadKeys() ([]verificationKey, error) {
+	a.keysLck.Lock()
+	defer a.keysLck.Unlock()
+
+	info, err := os.Stat(a.jwksPath)
+	if err != nil {
+		if a.keys != nil {
+			a.log.Error("failed to stat JWKS file, using old keys", err)
+			return a.keys, nil
+		}
+		return nil, err
+	}
+	if a.keys != nil && info.ModTime().Equal(a.keysMtime) {
+		return a.keys, nil
+	}
+
+	blob, err := os.ReadFile(a.jwksPath)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(blob)
+	if err != nil {
+		if a.keys != nil {
+			a.log.Error("malformed JWKS file, using old keys", err)
+			return a.keys, nil
+		}
+		return nil, fmt.Errorf("%s: %w", a.jwksPath, err)
+	}
+	a.log.DebugMsg("loaded JWKS", "path", a.jwksPath, "keys", len(keys))
+	a.keys = keys
+	a.keysMtime = info.ModTime()
+	return keys, nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// numericDate accepts both integer and fractional timestamps.
+type numericDate float64
+
+func (d numericDate) Time() time.Time {
+	sec := int64(d)
+	return time.Unix(sec, int64((float64(d)-float64(sec))*1e9))
+}
+
+// audience is either a single string or an array of strings (RFC 7519
+// Section 4.1.3).
+type audience []string
+
+func (aud *audience) UnmarshalJSON(b []byte) error {
+	if bytes.HasPrefix(b, []byte("[")) {
+		return json.Unmarshal(b, (*[]string)(aud))
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*aud = audience{s}
+	return nil
+}
+
+type claims struct {
+	Issuer    string       `json:"iss"`
+	Audience  audience     `json:"aud"`
+	ExpiresAt *numericDate `json:"exp"`
+	NotBefore *numericDate `json:"nbf"`
+}
+
+func decodePart(part string, v interface{}) error {
+	blob, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(blob, v)
+}
+
+// AuthToken verifies the token signature and claims and returns the
+// value of the username claim.
+func (a *Auth) AuthToken(_ context.Context, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%s: malformed token", modName)
+	}
+
+	var hdr header
+	if err := decodePart(parts[0], &hdr); err != nil {
+		return "", fmt.Errorf("%s: malformed header: %w", modName, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%s: malformed signature: %w", modName, err)
+	}
+
+	keys, err := a.loadKeys()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", modName, err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if hdr.Kid != "" && key.id != hdr.Kid {
+			continue
+		}
+		if key.alg != "" && key.alg != hdr.Alg {
+			continue
+		}
+		if err := verifySignature(hdr.Alg, key.key, signed, sig); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", fmt.Errorf("%s: signature verification failed (alg: %s, kid: %s)", modName, hdr.Alg, hdr.Kid)
+	}
+
+	var c claims
+	if err := decodePart(parts[1], &c); err != nil {
+		return "", fmt.Errorf("%s: malformed claims: %w", modName, err)
+	}
+	if err := a.checkClaims(c); err != nil {
+		return "", fmt.Errorf("%s: %w", modName, err)
+	}
+
+	var all map[string]interface{}
+	if err := decodePart(parts[1], &all); err != nil {
+		return "", fmt.Errorf("%s: malformed claims: %w", modName, err)
+	}
+	username, _ := all[a.usernameClaim].(string)
+	if username == "" {
+		return "", fmt.Errorf("%s: missing %s claim", modName, a.usernameClaim)
+	}
+	return username, nil
+}
+
+func (a *Auth) checkClaims(c claims) error {
+	now := a.now()
+	if c.ExpiresAt == nil {
+		return errors.New("missing exp claim")
+	}
+	if now.After(c.ExpiresAt.Time().Add(a.leeway)) {
+		return errors.New("token is expired")
+	}
+	if c.NotBefore != nil && now.Add(a.leeway).Before(c.NotBefore.Time()) {
+		return errors.New("token is not valid yet")
+	}
+	if a.issuer != "" && c.Issuer != a.issuer {
+		return fmt.Errorf("wrong issuer: %s", c.Issuer)
+	}
+	if a.audience != "" {
+		found := false
+		for _, aud := range c.Audience {
+			if aud == a.audience {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("token is not issued for %s", a.audience)
+		}
+	}
+	return nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,234 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := b64(hdr) + "." + b64(body)
+
+	var sig []byte
+	var err error
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestAuthToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "alg": "RS256", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64(edPub)},
+			{"kty": "oct", "kid": "hmac", "k": "c2VjcmV0"},
+		},
+	})
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(jwksPath, jwks, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := New(modName, "", nil, []string{jwksPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	a.log = testutils.Logger(t, modName)
+	err = a.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "issuer", Args: []string{"https://app.example.org"}},
+			{Name: "audience", Args: []string{"mail"}},
+			{Name: "username_claim", Args: []string{"email"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return now }
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   "https://app.example.org",
+			"aud":   []string{"web", "mail"},
+			"exp":   now.Add(time.Hour).Unix(),
+			"email": "user@example.org",
+		}
+	}
+	with := func(key string, value interface{}) map[string]interface{} {
+		c := valid()
+		if value == nil {
+			delete(c, key)
+		} else {
+			c[key] = value
+		}
+		return c
+	}
+
+	test := func(name, token string, fail bool) {
+		t.Helper()
+		username, err := a.AuthToken(context.Background(), token)
+		if fail {
+			if err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+			return
+		}
+		if username != "user@example.org" {
+			t.Errorf("%s: wrong username: %s", name, username)
+		}
+	}
+
+	test("RS256", sign(t, "RS256", "rsa", rsaKey, valid()), false)
+	test("ES256", sign(t, "ES256", "ec", ecKey, valid()), false)
+	test("EdDSA", sign(t, "EdDSA", "ed", edKey, valid()), false)
+	test("no kid", sign(t, "EdDSA", "", edKey, valid()), false)
+	test("single audience", sign(t, "EdDSA", "ed", edKey, with("aud", "mail")), false)
+	test("expired within leeway", sign(t, "EdDSA", "ed", edKey, with("exp", now.Add(-30*time.Second).Unix())), false)
+
+	test("unknown key", sign(t, "EdDSA", "ed", otherKey, valid()), true)
+	test("wrong kid", sign(t, "EdDSA", "rsa", edKey, valid()), true)
+	test("alg mismatch", sign(t, "RS384", "rsa", rsaKey, valid()), true)
+	test("alg none", b64([]byte(`{"alg":"none"}`))+"."+b64([]byte(`{"email":"user@example.org"}`))+".", true)
+	test("expired", sign(t, "EdDSA", "ed", edKey, with("exp", now.Add(-time.Hour).Unix())), true)
+	test("no exp", sign(t, "EdDSA", "ed", edKey, with("exp", nil)), true)
+	test("not yet valid", sign(t, "EdDSA", "ed", edKey, with("nbf", now.Add(time.Hour).Unix())), true)
+	test("wrong issuer", sign(t, "EdDSA", "ed", edKey, with("iss", "https://evil.example.org")), true)
+	test("wrong audience", sign(t, "EdDSA", "ed", edKey, with("aud", "web")), true)
+	test("no username", sign(t, "EdDSA", "ed", edKey, with("email", nil)), true)
+	test("malformed", "not.a.token", true)
+
+	// Tampered claims.
+	token := sign(t, "EdDSA", "ed", edKey, valid())
+	otherToken := sign(t, "EdDSA", "ed", edKey, with("email", "admin@example.org"))
+	parts, otherParts := strings.Split(token, "."), strings.Split(otherToken, ".")
+	test("tampered", parts[0]+"."+otherParts[1]+"."+parts[2], true)
+}
+
+func TestReloadKeys(t *testing.T) {
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPub, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeJWKS := func(path string, pub ed25519.PublicKey, mtime time.Time) {
+		t.Helper()
+		jwks, _ := json.Marshal(map[string]interface{}{
+			"keys": []map[string]string{{"kty": "OKP", "crv": "Ed25519", "x": b64(pub)}},
+		})
+		if err := os.WriteFile(path, jwks, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(jwksPath, edPub, time.Now().Add(-time.Hour))
+
+	mod, err := New(modName, "", nil, []string{jwksPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	a.log = testutils.Logger(t, modName)
+	if err := a.Init(config.NewMap(nil, config.Node{})); err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]interface{}{"sub": "user", "exp": time.Now().Add(time.Hour).Unix()}
+	if _, err := a.AuthToken(context.Background(), sign(t, "EdDSA", "", edKey, claims)); err != nil {
+		t.Fatal(err)
+	}
+
+	writeJWKS(jwksPath, newPub, time.Now())
+	if _, err := a.AuthToken(context.Background(), sign(t, "EdDSA", "", edKey, claims)); err == nil {
+		t.Error("Token signed using the removed key is accepted")
+	}
+	if _, err := a.AuthToken(context.Background(), sign(t, "EdDSA", "", newKey, claims)); err != nil {
+		t.Error("Token signed using the new key is rejected:", err)
+	}
+}
@@ -51,7 +51,7 @@ func New(modName, instName string, _, inlineArgs []string) (module.Module, error
 func (a *Auth) Init(cfg *config.Map) error {
 	a.dialer = &net.Dialer{}
 
-	cfg.Bool("debug", true, false, &a.log.Debug)
+	cfg.Logger(true, false, &a.log)
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
 		return tls.Config{}, nil
 	}, tls2.TLSClientBlock, &a.tlsCfg)
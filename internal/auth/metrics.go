@@ -0,0 +1,64 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package auth
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirrchat/SirrMesh/framework/exterrors"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+var authAttempts = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "sirrmesh",
+		Subsystem: "auth",
+		Name:      "attempts_total",
+		Help:      "Authentication attempts by provider, method (plain, token, scram) and result (success, failure, error)",
+	},
+	[]string{"provider", "method", "result"},
+)
+
+// providerName returns the name used in the provider label, it is the same
+// as the name used in the log messages.
+func providerName(p interface{}) string {
+	if mod, ok := p.(module.Module); ok {
+		if mod.InstanceName() == "" || mod.InstanceName() == mod.Name() {
+			return mod.Name()
+		}
+		return mod.Name() + ":" + mod.InstanceName()
+	}
+	return fmt.Sprintf("%T", p)
+}
+
+func recordAttempt(provider interface{}, method string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+		if exterrors.IsTemporary(err) {
+			result = "error"
+		}
+	}
+	authAttempts.WithLabelValues(providerName(provider), method, result).Inc()
+}
+
+func init() {
+	prometheus.MustRegister(authAttempts)
+}
@@ -48,7 +48,7 @@ func (a *Auth) Init(cfg *config.Map) error {
 	a.nacl = n
 	a.nacl.SetServiceName("sirrmesh")
 	cfg.String("require_group", false, false, "", &a.mustGroup)
-	cfg.Bool("debug", true, false, &a.log.Debug)
+	cfg.Logger(true, false, &a.log)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -0,0 +1,201 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package oauth2_introspect implements the auth.oauth2_introspect module that
+// validates bearer tokens using the OAuth 2.0 Token Introspection endpoint
+// (RFC 7662).
+package oauth2_introspect
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	tls2 "github.com/sirrchat/SirrMesh/framework/config/tls"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+const modName = "auth.oauth2_introspect"
+
+type Auth struct {
+	instName string
+	log      log.Logger
+
+	endpoint      string
+	clientID      string
+	clientSecret  string
+	usernameField string
+	audience      string
+	tlsCfg        tls.Config
+	timeout       time.Duration
+
+	client *http.Client
+}
+
+func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	a := &Auth{
+		instName: instName,
+		log:      log.Logger{Name: modName},
+	}
+	switch len(inlineArgs) {
+	case 0:
+	case 1:
+		a.endpoint = inlineArgs[0]
+	default:
+		return nil, fmt.Errorf("%s: at most one argument expected", modName)
+	}
+	return a, nil
+}
+
+func (a *Auth) Name() string {
+	return modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	cfg.Logger(true, false, &a.log)
+	cfg.String("endpoint", false, a.endpoint == "", a.endpoint, &a.endpoint)
+	cfg.String("client_id", false, false, "", &a.clientID)
+	cfg.String("client_secret", false, false, "", &a.clientSecret)
+	cfg.String("username_field", false, false, "username", &a.usernameField)
+	cfg.String("audience", false, false, "", &a.audience)
+	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
+		return tls.Config{}, nil
+	}, tls2.TLSClientBlock, &a.tlsCfg)
+	cfg.Duration("timeout", false, false, 10*time.Second, &a.timeout)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	u, err := url.Parse(a.endpoint)
+	if err != nil {
+		return fmt.Errorf("%s: malformed endpoint: %w", modName, err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return fmt.Errorf("%s: endpoint should be a HTTP(S) URL", modName)
+	}
+	if u.Scheme == "http" {
+		a.log.Msg("using plaintext HTTP for token introspection, tokens can be intercepted", "endpoint", a.endpoint)
+	}
+
+	a.client = &http.Client{
+		Timeout: a.timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &a.tlsCfg,
+		},
+	}
+	return nil
+}
+
+// introspectionResponse contains fields of the RFC 7662 response used by
+// the module.
+type introspectionResponse struct {
+	Active   bool            `json:"active"`
+	Subject  string          `json:"sub"`
+	Audience json.RawMessage `json:"aud"`
+}
+
+func (r introspectionResponse) hasAudience(aud string) bool {
+	var list []string
+	if err := json.Unmarshal(r.Audience, &list); err != nil {
+		var single string
+		if err := json.Unmarshal(r.Audience, &single); err != nil {
+			return false
+		}
+		list = []string{single}
+	}
+	for _, a := range list {
+		if a == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthToken asks the introspection endpoint whether the token is active and
+// returns the associated username.
+func (a *Auth) AuthToken(ctx context.Context, token string) (string, error) {
+	form := url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", modName, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", modName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: unexpected status: %s", modName, resp.Status)
+	}
+
+	blob, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", modName, err)
+	}
+	var introResp introspectionResponse
+	if err := json.Unmarshal(blob, &introResp); err != nil {
+		return "", fmt.Errorf("%s: malformed response: %w", modName, err)
+	}
+	if !introResp.Active {
+		return "", fmt.Errorf("%s: %w", modName, module.ErrUnknownCredentials)
+	}
+	if a.audience != "" && !introResp.hasAudience(a.audience) {
+		return "", fmt.Errorf("%s: token is not issued for %s", modName, a.audience)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(blob, &fields); err != nil {
+		return "", fmt.Errorf("%s: malformed response: %w", modName, err)
+	}
+	username, _ := fields[a.usernameField].(string)
+	if username == "" {
+		username = introResp.Subject
+	}
+	if username == "" {
+		return "", errors.New(modName + ": no username in the introspection response")
+	}
+	a.log.DebugMsg("token is active", "username", username)
+	return username, nil
+}
+
+func init() {
+	module.Register(modName, New)
+}
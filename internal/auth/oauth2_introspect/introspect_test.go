@@ -0,0 +1,104 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package oauth2_introspect
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+)
+
+func TestAuthToken(t *testing.T) {
+	tokens := map[string]map[string]interface{}{
+		"valid":     {"active": true, "username": "user@example.org", "aud": "mail"},
+		"sub-only":  {"active": true, "sub": "0xabc", "aud": []string{"web", "mail"}},
+		"revoked":   {"active": false},
+		"other-aud": {"active": true, "username": "user@example.org", "aud": "web"},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if user, pass, _ := req.BasicAuth(); user != "sirrmesh" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.Method != http.MethodPost || req.PostFormValue("token_type_hint") != "access_token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp, ok := tokens[req.PostFormValue("token")]
+		if !ok {
+			resp = map[string]interface{}{"active": false}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	newAuth := func(secret string) *Auth {
+		mod, err := New(modName, "", nil, []string{srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := mod.(*Auth)
+		a.log = testutils.Logger(t, modName)
+		err = a.Init(config.NewMap(nil, config.Node{
+			Children: []config.Node{
+				{Name: "client_id", Args: []string{"sirrmesh"}},
+				{Name: "client_secret", Args: []string{secret}},
+				{Name: "audience", Args: []string{"mail"}},
+			},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	a := newAuth("secret")
+
+	test := func(token, username string) {
+		t.Helper()
+		got, err := a.AuthToken(context.Background(), token)
+		if username == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", token, got)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", token, err)
+			return
+		}
+		if got != username {
+			t.Errorf("%s: got %s, want %s", token, got, username)
+		}
+	}
+
+	test("valid", "user@example.org")
+	test("sub-only", "0xabc")
+	test("revoked", "")
+	test("other-aud", "")
+	test("unknown", "")
+
+	a = newAuth("wrong")
+	test("valid", "")
+}
@@ -57,7 +57,7 @@ func (a *Auth) InstanceName() string {
 }
 
 func (a *Auth) Init(cfg *config.Map) error {
-	cfg.Bool("debug", true, false, &a.Log.Debug)
+	cfg.Logger(true, false, &a.Log)
 	cfg.Bool("use_helper", false, false, &a.useHelper)
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -28,6 +28,8 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/auth/saslscram"
 	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -36,9 +38,14 @@ const (
 	HashSHA256 = "sha256"
 	HashBcrypt = "bcrypt"
 	HashArgon2 = "argon2"
+	HashSCRAM  = "scram-sha-256"
 
 	DefaultHash = HashBcrypt
 
+	// CredsSeparator separates multiple hashes of the same password stored
+	// for the user, e.g. bcrypt hash and SCRAM keys.
+	CredsSeparator = "|"
+
 	Argon2Salt = 16
 	Argon2Size = 64
 )
@@ -56,6 +63,11 @@ type (
 		Argon2Time    uint32
 		Argon2Memory  uint32
 		Argon2Threads uint8
+
+		// PBKDF2 iteration count for SCRAM keys, at least 4096.
+		SCRAMIterations int
+		// Also store SCRAM keys next to the password hash.
+		WithSCRAM bool
 	}
 
 	FuncHashCompute func(opts HashOpts, pass string) (string, error)
@@ -66,13 +78,15 @@ var (
 	HashCompute = map[string]FuncHashCompute{
 		HashBcrypt: computeBcrypt,
 		HashArgon2: computeArgon2,
+		HashSCRAM:  computeSCRAM,
 	}
 	HashVerify = map[string]FuncHashVerify{
 		HashBcrypt: verifyBcrypt,
 		HashArgon2: verifyArgon2,
+		HashSCRAM:  verifySCRAM,
 	}
 
-	Hashes = []string{HashSHA256, HashBcrypt, HashArgon2}
+	Hashes = []string{HashSHA256, HashBcrypt, HashArgon2, HashSCRAM}
 )
 
 func computeArgon2(opts HashOpts, pass string) (string, error) {
@@ -174,6 +188,78 @@ func verifyBcrypt(pass, hashSalt string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashSalt), []byte(pass))
 }
 
+// computeSCRAM stores SCRAM-SHA-256 keys in the iterations:salt:StoredKey:ServerKey
+// format. The password can be verified using StoredKey, so SCRAM keys can be
+// used without any other hash.
+func computeSCRAM(opts HashOpts, pass string) (string, error) {
+	creds, err := saslscram.NewCredentials(pass, opts.SCRAMIterations)
+	if err != nil {
+		return "", fmt.Errorf("pass_table: %w", err)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(creds.Iterations),
+		base64.StdEncoding.EncodeToString(creds.Salt),
+		base64.StdEncoding.EncodeToString(creds.StoredKey),
+		base64.StdEncoding.EncodeToString(creds.ServerKey),
+	}, ":"), nil
+}
+
+func parseSCRAM(hashSalt string) (module.SCRAMCredentials, error) {
+	parts := strings.Split(hashSalt, ":")
+	if len(parts) != 4 {
+		return module.SCRAMCredentials{}, fmt.Errorf("pass_table: malformed SCRAM keys")
+	}
+	iterations, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return module.SCRAMCredentials{}, fmt.Errorf("pass_table: malformed SCRAM keys: %w", err)
+	}
+	creds := module.SCRAMCredentials{Iterations: iterations}
+	for i, dst := range []*[]byte{&creds.Salt, &creds.StoredKey, &creds.ServerKey} {
+		*dst, err = base64.StdEncoding.DecodeString(parts[i+1])
+		if err != nil {
+			return module.SCRAMCredentials{}, fmt.Errorf("pass_table: malformed SCRAM keys: %w", err)
+		}
+	}
+	return creds, nil
+}
+
+func verifySCRAM(pass, hashSalt string) error {
+	creds, err := parseSCRAM(hashSalt)
+	if err != nil {
+		return err
+	}
+	storedKey, _, err := saslscram.SaltedKeys(pass, creds.Salt, creds.Iterations)
+	if err != nil {
+		return fmt.Errorf("pass_table: %w", err)
+	}
+	if subtle.ConstantTimeCompare(storedKey, creds.StoredKey) != 1 {
+		return fmt.Errorf("pass_table: hash mismatch")
+	}
+	return nil
+}
+
+// ComputeCreds returns the value stored in the table for the password. SCRAM
+// keys are appended if opts.WithSCRAM is set.
+func ComputeCreds(hashAlgo string, opts HashOpts, pass string) (string, error) {
+	compute := HashCompute[hashAlgo]
+	if compute == nil {
+		return "", fmt.Errorf("pass_table: unknown hash function: %v", hashAlgo)
+	}
+	hash, err := compute(opts, pass)
+	if err != nil {
+		return "", err
+	}
+	creds := hashAlgo + ":" + hash
+	if opts.WithSCRAM && hashAlgo != HashSCRAM {
+		scram, err := computeSCRAM(opts, pass)
+		if err != nil {
+			return "", err
+		}
+		creds += CredsSeparator + HashSCRAM + ":" + scram
+	}
+	return creds, nil
+}
+
 func addSHA256() {
 	HashCompute[HashSHA256] = computeSHA256
 	HashVerify[HashSHA256] = verifySHA256
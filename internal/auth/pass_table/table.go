@@ -36,6 +36,7 @@ type Auth struct {
 	inlineArgs []string
 
 	table module.Table
+	scram bool
 }
 
 func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
@@ -52,6 +53,7 @@ func (a *Auth) Init(cfg *config.Map) error {
 	}
 
 	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &a.table)
+	cfg.Bool("scram", false, false, &a.scram)
 	_, err := cfg.Process()
 	return err
 }
@@ -87,6 +89,8 @@ func (a *Auth) AuthPlain(username, password string) error {
 		return err
 	}
 
+	// The first hash is used if there are multiple.
+	hash, _, _ = strings.Cut(hash, CredsSeparator)
 	parts := strings.SplitN(hash, ":", 2)
 	if len(parts) != 2 {
 		return fmt.Errorf("%s: auth plain %s: no hash tag", a.modName, key)
@@ -98,6 +102,34 @@ func (a *Auth) AuthPlain(username, password string) error {
 	return hashVerify(password, parts[1])
 }
 
+func (a *Auth) SCRAMSHA256Credentials(ctx context.Context, username string) (module.SCRAMCredentials, error) {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+
+	creds, ok, err := a.table.Lookup(ctx, key)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+	if !ok {
+		return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+	}
+
+	for _, hash := range strings.Split(creds, CredsSeparator) {
+		if keys, ok := strings.CutPrefix(hash, HashSCRAM+":"); ok {
+			return parseSCRAM(keys)
+		}
+	}
+	return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+}
+
+// SCRAMEnabled reports whether the scram option is set. The table does not
+// have to contain SCRAM keys for all users.
+func (a *Auth) SCRAMEnabled() bool {
+	return a.scram
+}
+
 func (a *Auth) ListUsers() ([]string, error) {
 	tbl, ok := a.table.(module.MutableTable)
 	if !ok {
@@ -123,10 +155,6 @@ func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts H
 		return fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
 	}
 
-	if _, ok := HashCompute[hashAlgo]; !ok {
-		return fmt.Errorf("%s: unknown hash function: %v", a.modName, hashAlgo)
-	}
-
 	key, err := precis.UsernameCaseMapped.CompareKey(username)
 	if err != nil {
 		return fmt.Errorf("%s: create user %s (raw): %w", a.modName, username, err)
@@ -140,18 +168,26 @@ func (a *Auth) CreateUserHash(username, password string, hashAlgo string, opts H
 		return fmt.Errorf("%s: credentials for %s already exist", a.modName, key)
 	}
 
-	hash, err := HashCompute[hashAlgo](opts, password)
+	hash, err := ComputeCreds(hashAlgo, opts, password)
 	if err != nil {
 		return fmt.Errorf("%s: create user %s: hash generation: %w", a.modName, key, err)
 	}
 
-	if err := tbl.SetKey(key, hashAlgo+":"+hash); err != nil {
+	if err := tbl.SetKey(key, hash); err != nil {
 		return fmt.Errorf("%s: create user %s: %w", a.modName, key, err)
 	}
 	return nil
 }
 
+// SetUserPassword changes the user password using bcrypt. SCRAM keys are
+// updated too if the user had them.
 func (a *Auth) SetUserPassword(username, password string) error {
+	return a.SetUserPasswordHash(username, password, HashBcrypt, HashOpts{
+		BcryptCost: bcrypt.DefaultCost,
+	})
+}
+
+func (a *Auth) SetUserPasswordHash(username, password string, hashAlgo string, opts HashOpts) error {
 	tbl, ok := a.table.(module.MutableTable)
 	if !ok {
 		return fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
@@ -162,15 +198,18 @@ func (a *Auth) SetUserPassword(username, password string) error {
 		return fmt.Errorf("%s: set password %s (raw): %w", a.modName, username, err)
 	}
 
-	// TODO: Allow to customize hash function.
-	hash, err := HashCompute[HashBcrypt](HashOpts{
-		BcryptCost: bcrypt.DefaultCost,
-	}, password)
+	if !opts.WithSCRAM {
+		if _, err := a.SCRAMSHA256Credentials(context.TODO(), key); err == nil {
+			opts.WithSCRAM = true
+		}
+	}
+
+	hash, err := ComputeCreds(hashAlgo, opts, password)
 	if err != nil {
 		return fmt.Errorf("%s: set password %s: hash generation: %w", a.modName, key, err)
 	}
 
-	if err := tbl.SetKey(key, "bcrypt:"+hash); err != nil {
+	if err := tbl.SetKey(key, hash); err != nil {
 		return fmt.Errorf("%s: set password %s: %w", a.modName, key, err)
 	}
 	return nil
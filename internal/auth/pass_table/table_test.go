@@ -19,6 +19,8 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package pass_table
 
 import (
+	"context"
+	"strings"
 	"testing"
 
 	"github.com/sirrchat/SirrMesh/framework/config"
@@ -62,3 +64,94 @@ func TestAuth_AuthPlain(t *testing.T) {
 	check("not-foxcpp", "different-password", false)
 	check("not-foxcpp-2", "password", true)
 }
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (m mutableTable) Keys() ([]string, error) {
+	var keys []string
+	for k := range m.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m mutableTable) SetKey(k, v string) error {
+	m.M[k] = v
+	return nil
+}
+
+func (m mutableTable) RemoveKey(k string) error {
+	delete(m.M, k)
+	return nil
+}
+
+func TestAuth_SCRAM(t *testing.T) {
+	mod, err := New("pass_table", "", nil, []string{"dummy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := mod.(*Auth)
+	tbl := mutableTable{testutils.Table{M: map[string]string{}}}
+	a.table = tbl
+	if a.SCRAMEnabled() {
+		t.Error("SCRAM is enabled without the scram option")
+	}
+
+	opts := HashOpts{BcryptCost: 4, SCRAMIterations: 4096}
+	if err := a.CreateUserHash("bcrypt-only", "password", HashBcrypt, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CreateUserHash("scram-only", "password", HashSCRAM, opts); err != nil {
+		t.Fatal(err)
+	}
+	opts.WithSCRAM = true
+	if err := a.CreateUserHash("both", "password", HashBcrypt, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tbl.M["both"], "bcrypt:") || !strings.Contains(tbl.M["both"], "|scram-sha-256:4096:") {
+		t.Errorf("Wrong stored value: %s", tbl.M["both"])
+	}
+
+	for _, user := range []string{"bcrypt-only", "scram-only", "both"} {
+		if err := a.AuthPlain(user, "password"); err != nil {
+			t.Errorf("%s: unexpected error: %v", user, err)
+		}
+		if err := a.AuthPlain(user, "wrong"); err == nil {
+			t.Errorf("%s: wrong password accepted", user)
+		}
+	}
+
+	if _, err := a.SCRAMSHA256Credentials(context.Background(), "bcrypt-only"); err == nil {
+		t.Error("Expected an error for user without SCRAM keys")
+	}
+	creds, err := a.SCRAMSHA256Credentials(context.Background(), "both")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Iterations != 4096 || len(creds.Salt) == 0 || len(creds.StoredKey) != 32 || len(creds.ServerKey) != 32 {
+		t.Errorf("Wrong credentials: %+v", creds)
+	}
+
+	// SCRAM keys are kept on password change.
+	if err := a.SetUserPassword("both", "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	newCreds, err := a.SCRAMSHA256Credentials(context.Background(), "both")
+	if err != nil {
+		t.Fatal("SCRAM keys are dropped on password change:", err)
+	}
+	if string(newCreds.StoredKey) == string(creds.StoredKey) {
+		t.Error("SCRAM keys are not updated")
+	}
+	if err := a.AuthPlain("both", "new-password"); err != nil {
+		t.Error("New password is not accepted:", err)
+	}
+}
@@ -65,7 +65,7 @@ func (a *Auth) InstanceName() string {
 }
 
 func (a *Auth) Init(cfg *config.Map) error {
-	cfg.Bool("debug", false, false, &a.Log.Debug)
+	cfg.Logger(false, false, &a.Log)
 	cfg.Callback("user", func(m *config.Map, node config.Node) error {
 		var tbl module.Table
 		err := modconfig.ModuleFromNode("table", node.Args, node, m.Globals, &tbl)
@@ -20,16 +20,22 @@ package auth
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/sirrchat/SirrMesh/framework/config"
 	modconfig "github.com/sirrchat/SirrMesh/framework/config/module"
+	"github.com/sirrchat/SirrMesh/framework/exterrors"
 	"github.com/sirrchat/SirrMesh/framework/log"
 	"github.com/sirrchat/SirrMesh/framework/module"
 	"github.com/sirrchat/SirrMesh/internal/auth/sasllogin"
+	"github.com/sirrchat/SirrMesh/internal/auth/saslscram"
+	"github.com/sirrchat/SirrMesh/internal/auth/saslxoauth2"
+	"github.com/sirrchat/SirrMesh/internal/authguard"
 	"github.com/sirrchat/SirrMesh/internal/authz"
 )
 
@@ -55,17 +61,41 @@ type SASLAuth struct {
 	AuthNormalize authz.NormalizeFunc
 
 	Plain []module.PlainAuth
+	Token []module.TokenAuth
+	SCRAM []module.SCRAMAuth
+
+	// Scope is the service name passed to module.ScopedPlainAuth providers,
+	// e.g. module.AuthScopeIMAP.
+	Scope string
+
+	// TLSConfig is the server TLS configuration, it is used to get
+	// channel binding data for SCRAM-SHA-256-PLUS. -PLUS mechanisms are not
+	// offered if it is nil.
+	TLSConfig *tls.Config
+
+	// Guard is used to track authentication failures and reject banned
+	// clients. Optional.
+	Guard *authguard.Guard
 }
 
 func (s *SASLAuth) SASLMechanisms() []string {
 	var mechs []string
 
+	if len(s.SCRAM) != 0 {
+		mechs = append(mechs, saslscram.SHA256)
+		if s.TLSConfig != nil {
+			mechs = append(mechs, saslscram.SHA256Plus)
+		}
+	}
 	if len(s.Plain) != 0 {
 		mechs = append(mechs, sasl.Plain)
 		if s.EnableLogin {
 			mechs = append(mechs, sasl.Login)
 		}
 	}
+	if len(s.Token) != 0 {
+		mechs = append(mechs, sasl.OAuthBearer, saslxoauth2.XOAuth2)
+	}
 
 	return mechs
 }
@@ -103,7 +133,7 @@ func (s *SASLAuth) AuthPlain(username, password string) error {
 		return ErrUnsupportedMech
 	}
 
-	var lastErr error
+	var lastErr, secondFactorErr error
 	for _, p := range s.Plain {
 		mappedUsername, err := s.usernameForAuth(context.TODO(), username)
 		if err != nil {
@@ -114,15 +144,190 @@ func (s *SASLAuth) AuthPlain(username, password string) error {
 			"mapped_username", mappedUsername, "original_username", username,
 			"module", p)
 
-		lastErr = p.AuthPlain(mappedUsername, password)
+		if scoped, ok := p.(module.ScopedPlainAuth); ok && s.Scope != "" {
+			lastErr = scoped.AuthPlainScoped(s.Scope, mappedUsername, password)
+		} else {
+			lastErr = p.AuthPlain(mappedUsername, password)
+		}
+		recordAttempt(p, "plain", lastErr)
 		if lastErr == nil {
 			return nil
 		}
+		if errors.Is(lastErr, module.ErrSecondFactorRequired) {
+			secondFactorErr = lastErr
+		}
+	}
+
+	// Providers checked after the one asking for the code (e.g. app
+	// passwords) do not know the password, that should not hide the code
+	// request.
+	if secondFactorErr != nil && errors.Is(lastErr, module.ErrUnknownCredentials) {
+		lastErr = secondFactorErr
 	}
 
 	return fmt.Errorf("no auth. provider accepted creds, last err: %w", lastErr)
 }
 
+// Authenticate checks the credentials sent by the client at remoteAddr using
+// AuthPlain. Failures are recorded and delayed by Guard, if it is set.
+func (s *SASLAuth) Authenticate(remoteAddr net.Addr, username, password string) error {
+	if err := s.guardCheck(remoteAddr, username); err != nil {
+		return err
+	}
+	err := s.AuthPlain(username, password)
+	s.guardResult(remoteAddr, username, err)
+	return err
+}
+
+func (s *SASLAuth) guardCheck(remoteAddr net.Addr, username string) error {
+	if s.Guard == nil {
+		return nil
+	}
+	if err := s.Guard.Check(remoteAddr, username); err != nil {
+		s.Log.Msg("rejecting banned client", "username", username, "src_ip", remoteAddr)
+		return err
+	}
+	return nil
+}
+
+// guardResult records the authentication result. Temporary errors are not
+// counted as failures since they are not the client's fault.
+//
+// Attempts without the one-time code and wrong codes are counted as well,
+// the counters are reset once the code is accepted.
+func (s *SASLAuth) guardResult(remoteAddr net.Addr, username string, err error) {
+	if s.Guard == nil {
+		return
+	}
+	if err == nil {
+		s.Guard.Success(remoteAddr, username)
+		return
+	}
+	if exterrors.IsTemporary(err) {
+		return
+	}
+	time.Sleep(s.Guard.Failure(remoteAddr, username))
+}
+
+// AuthToken validates the bearer token using configured token providers and
+// returns the username it was issued for.
+func (s *SASLAuth) AuthToken(ctx context.Context, token string) (string, error) {
+	if len(s.Token) == 0 {
+		return "", ErrUnsupportedMech
+	}
+
+	var lastErr error
+	for _, p := range s.Token {
+		s.Log.DebugMsg("attempting token authentication", "module", p)
+
+		username, err := p.AuthToken(ctx, token)
+		recordAttempt(p, "token", err)
+		if err == nil {
+			return username, nil
+		}
+		lastErr = err
+	}
+
+	return "", fmt.Errorf("no auth. provider accepted token, last err: %w", lastErr)
+}
+
+// authToken validates the token and checks that the username requested by
+// the client (if any) matches the one the token is issued for.
+func (s *SASLAuth) authToken(ctx context.Context, saslUsername, token string) (string, error) {
+	username, err := s.AuthToken(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	if saslUsername == "" {
+		return username, nil
+	}
+
+	requested, tokenUser := saslUsername, username
+	if s.AuthNormalize != nil {
+		if requested, err = s.AuthNormalize(requested); err != nil {
+			return "", err
+		}
+		if tokenUser, err = s.AuthNormalize(tokenUser); err != nil {
+			return "", err
+		}
+	}
+	if requested != tokenUser {
+		return "", fmt.Errorf("token is issued for %s, not %s", username, saslUsername)
+	}
+	return username, nil
+}
+
+// scramCredentials returns SCRAM-SHA-256 keys for the user from the first
+// provider that has them.
+func (s *SASLAuth) scramCredentials(ctx context.Context, username string) (module.SCRAMCredentials, error) {
+	mappedUsername, err := s.usernameForAuth(ctx, username)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+
+	var lastErr error
+	for _, p := range s.SCRAM {
+		creds, err := p.SCRAMSHA256Credentials(ctx, mappedUsername)
+		recordAttempt(p, "scram", err)
+		if err == nil {
+			return creds, nil
+		}
+		lastErr = err
+	}
+
+	return module.SCRAMCredentials{}, fmt.Errorf("no auth. provider has SCRAM credentials, last err: %w", lastErr)
+}
+
+func (s *SASLAuth) createSCRAM(mech string, remoteAddr net.Addr, tlsState *tls.ConnectionState, successCb func(identity string, data ContextData) error) sasl.Server {
+	var (
+		saslUsername string
+		banned       bool
+	)
+	lookup := func(username string) (module.SCRAMCredentials, error) {
+		saslUsername = username
+		if err := s.guardCheck(remoteAddr, username); err != nil {
+			banned = true
+			return module.SCRAMCredentials{}, err
+		}
+		creds, err := s.scramCredentials(context.TODO(), username)
+		if err != nil {
+			s.Log.DebugMsg("no SCRAM credentials", "username", username, "reason", err)
+		}
+		return creds, err
+	}
+	authenticate := func(identity, username string) error {
+		if identity != "" && identity != username {
+			return ErrInvalidAuthCred
+		}
+		if s.Guard != nil {
+			s.Guard.Success(remoteAddr, username)
+		}
+		return successCb(username, ContextData{Username: username})
+	}
+
+	var srv sasl.Server
+	if mech == saslscram.SHA256Plus {
+		if s.TLSConfig == nil || tlsState == nil {
+			return FailingSASLServ{Err: ErrUnsupportedMech}
+		}
+		cert, err := saslscram.ServerCertificate(s.TLSConfig, tlsState)
+		if err != nil {
+			s.Log.Error("cannot get channel binding data", err, "src_ip", remoteAddr)
+			return FailingSASLServ{Err: ErrUnsupportedMech}
+		}
+		srv = saslscram.NewPlusServer(lookup, authenticate, saslscram.ServerEndPoint(cert))
+	} else {
+		srv = saslscram.NewServer(lookup, authenticate, s.TLSConfig != nil && tlsState != nil)
+	}
+
+	return failureLogger{Server: srv, log: func(err error) {
+		s.Log.Error("authentication failed", err, "mech", mech, "username", saslUsername, "src_ip", remoteAddr)
+		if !banned {
+			s.guardResult(remoteAddr, saslUsername, err)
+		}
+	}}
+}
+
 type ContextData struct {
 	// Authentication username. May be different from identity.
 	Username string
@@ -132,8 +337,19 @@ type ContextData struct {
 }
 
 // CreateSASL creates the sasl.Server instance for the corresponding mechanism.
-func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(identity string, data ContextData) error) sasl.Server {
+//
+// tlsState should be nil for connections not using TLS.
+func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, tlsState *tls.ConnectionState, successCb func(identity string, data ContextData) error) sasl.Server {
+	if err := s.guardCheck(remoteAddr, ""); err != nil {
+		return FailingSASLServ{Err: err}
+	}
+
 	switch mech {
+	case saslscram.SHA256, saslscram.SHA256Plus:
+		if len(s.SCRAM) == 0 {
+			return FailingSASLServ{Err: ErrUnsupportedMech}
+		}
+		return s.createSCRAM(mech, remoteAddr, tlsState, successCb)
 	case sasl.Plain:
 		return sasl.NewPlainServer(func(identity, username, password string) error {
 			if identity == "" {
@@ -143,9 +359,12 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 				return ErrInvalidAuthCred
 			}
 
-			err := s.AuthPlain(username, password)
+			err := s.Authenticate(remoteAddr, username, password)
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				if errors.Is(err, authguard.ErrBanned) {
+					return err
+				}
 				return ErrInvalidAuthCred
 			}
 
@@ -165,9 +384,16 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 				return err
 			}
 
-			err = s.AuthPlain(username, password)
+			err = s.Authenticate(remoteAddr, username, password)
+			if errors.Is(err, module.ErrSecondFactorRequired) {
+				s.Log.DebugMsg("one-time code required", "username", username, "src_ip", remoteAddr)
+				return module.ErrSecondFactorRequired
+			}
 			if err != nil {
 				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				if errors.Is(err, authguard.ErrBanned) {
+					return err
+				}
 				return ErrInvalidAuthCred
 			}
 
@@ -176,6 +402,46 @@ func (s *SASLAuth) CreateSASL(mech string, remoteAddr net.Addr, successCb func(i
 				Password: password,
 			})
 		})
+	case sasl.OAuthBearer:
+		if len(s.Token) == 0 {
+			return FailingSASLServ{Err: ErrUnsupportedMech}
+		}
+
+		return sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+			if err := s.guardCheck(remoteAddr, opts.Username); err != nil {
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			username, err := s.authToken(context.TODO(), opts.Username, opts.Token)
+			s.guardResult(remoteAddr, opts.Username, err)
+			if err != nil {
+				s.Log.Error("authentication failed", err, "username", opts.Username, "src_ip", remoteAddr)
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+
+			if err := successCb(username, ContextData{Username: username}); err != nil {
+				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+			}
+			return nil
+		})
+	case saslxoauth2.XOAuth2:
+		if len(s.Token) == 0 {
+			return FailingSASLServ{Err: ErrUnsupportedMech}
+		}
+
+		return saslxoauth2.NewXOAuth2Server(func(username, token string) error {
+			if err := s.guardCheck(remoteAddr, username); err != nil {
+				return err
+			}
+			authUser, err := s.authToken(context.TODO(), username, token)
+			s.guardResult(remoteAddr, username, err)
+			if err != nil {
+				s.Log.Error("authentication failed", err, "username", username, "src_ip", remoteAddr)
+				return ErrInvalidAuthCred
+			}
+
+			return successCb(authUser, ContextData{Username: authUser})
+		})
 	}
 	return FailingSASLServ{Err: ErrUnsupportedMech}
 }
@@ -193,6 +459,14 @@ func (s *SASLAuth) AddProvider(m *config.Map, node config.Node) error {
 		s.Plain = append(s.Plain, plainAuth)
 		hasAny = true
 	}
+	if scramAuth, ok := any.(module.SCRAMAuth); ok && scramAuth.SCRAMEnabled() {
+		s.SCRAM = append(s.SCRAM, scramAuth)
+		hasAny = true
+	}
+	if tokenAuth, ok := any.(module.TokenAuth); ok {
+		s.Token = append(s.Token, tokenAuth)
+		hasAny = true
+	}
 
 	if !hasAny {
 		return config.NodeErr(node, "auth: specified module does not provide any SASL mechanism")
@@ -205,3 +479,17 @@ type FailingSASLServ struct{ Err error }
 func (s FailingSASLServ) Next([]byte) ([]byte, bool, error) {
 	return nil, true, s.Err
 }
+
+// failureLogger logs errors returned by the wrapped sasl.Server.
+type failureLogger struct {
+	sasl.Server
+	log func(err error)
+}
+
+func (f failureLogger) Next(response []byte) ([]byte, bool, error) {
+	challenge, done, err := f.Server.Next(response)
+	if err != nil {
+		f.log(err)
+	}
+	return challenge, done, err
+}
@@ -19,11 +19,17 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package auth
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"net"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/sirrchat/SirrMesh/framework/config"
 	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/authguard"
 	"github.com/sirrchat/SirrMesh/internal/testutils"
 )
 
@@ -39,6 +45,18 @@ func (m mockAuth) AuthPlain(username, _ string) error {
 	return nil
 }
 
+type mockTokenAuth struct {
+	db map[string]string
+}
+
+func (m mockTokenAuth) AuthToken(_ context.Context, token string) (string, error) {
+	username, ok := m.db[token]
+	if !ok {
+		return "", errors.New("invalid token")
+	}
+	return username, nil
+}
+
 func TestCreateSASL(t *testing.T) {
 	a := SASLAuth{
 		Log: testutils.Logger(t, "saslauth"),
@@ -52,7 +70,7 @@ func TestCreateSASL(t *testing.T) {
 	}
 
 	t.Run("XWHATEVER", func(t *testing.T) {
-		srv := a.CreateSASL("XWHATEVER", &net.TCPAddr{}, func(string, ContextData) error { return nil })
+		srv := a.CreateSASL("XWHATEVER", &net.TCPAddr{}, nil, func(string, ContextData) error { return nil })
 		_, _, err := srv.Next([]byte(""))
 		if err == nil {
 			t.Error("No error for XWHATEVER use")
@@ -60,7 +78,7 @@ func TestCreateSASL(t *testing.T) {
 	})
 
 	t.Run("PLAIN", func(t *testing.T) {
-		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string, data ContextData) error {
+		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, nil, func(id string, data ContextData) error {
 			if id != "user1" {
 				t.Fatal("Wrong auth. identities passed to callback:", id)
 			}
@@ -74,7 +92,7 @@ func TestCreateSASL(t *testing.T) {
 	})
 
 	t.Run("PLAIN with authorization identity", func(t *testing.T) {
-		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, func(id string, data ContextData) error {
+		srv := a.CreateSASL("PLAIN", &net.TCPAddr{}, nil, func(id string, data ContextData) error {
 			if id != "user1" {
 				t.Fatal("Wrong authorization identity passed:", id)
 			}
@@ -87,3 +105,333 @@ func TestCreateSASL(t *testing.T) {
 		}
 	})
 }
+
+func TestCreateSASL_Token(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Token: []module.TokenAuth{
+			&mockTokenAuth{
+				db: map[string]string{
+					"token1": "user1",
+				},
+			},
+		},
+	}
+
+	mechs := a.SASLMechanisms()
+	if len(mechs) != 2 || mechs[0] != "OAUTHBEARER" || mechs[1] != "XOAUTH2" {
+		t.Fatal("Wrong mechanisms:", mechs)
+	}
+
+	oauthBearer := func(response string) (string, error) {
+		var identity string
+		srv := a.CreateSASL("OAUTHBEARER", &net.TCPAddr{}, nil, func(id string, data ContextData) error {
+			identity = id
+			return nil
+		})
+		challenge, done, err := srv.Next([]byte(response))
+		if err != nil || done {
+			return identity, err
+		}
+		if !strings.Contains(string(challenge), `"status":"invalid_token"`) {
+			t.Errorf("Wrong error challenge: %s", challenge)
+		}
+		_, _, err = srv.Next([]byte{0x01})
+		return identity, err
+	}
+
+	t.Run("OAUTHBEARER", func(t *testing.T) {
+		id, err := oauthBearer("n,a=user1,\x01host=mx.example.org\x01port=143\x01auth=Bearer token1\x01\x01")
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if id != "user1" {
+			t.Error("Wrong identity passed to callback:", id)
+		}
+	})
+
+	t.Run("OAUTHBEARER without username", func(t *testing.T) {
+		id, err := oauthBearer("n,,\x01auth=Bearer token1\x01\x01")
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if id != "user1" {
+			t.Error("Wrong identity passed to callback:", id)
+		}
+	})
+
+	t.Run("OAUTHBEARER invalid token", func(t *testing.T) {
+		if _, err := oauthBearer("n,a=user1,\x01auth=Bearer token2\x01\x01"); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+
+	t.Run("OAUTHBEARER username mismatch", func(t *testing.T) {
+		if _, err := oauthBearer("n,a=user2,\x01auth=Bearer token1\x01\x01"); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+
+	t.Run("XOAUTH2", func(t *testing.T) {
+		srv := a.CreateSASL("XOAUTH2", &net.TCPAddr{}, nil, func(id string, data ContextData) error {
+			if id != "user1" {
+				t.Fatal("Wrong identity passed to callback:", id)
+			}
+			return nil
+		})
+		_, done, err := srv.Next([]byte("user=user1\x01auth=Bearer token1\x01\x01"))
+		if err != nil || !done {
+			t.Error("Unexpected result:", done, err)
+		}
+	})
+
+	t.Run("XOAUTH2 invalid token", func(t *testing.T) {
+		srv := a.CreateSASL("XOAUTH2", &net.TCPAddr{}, nil, func(id string, data ContextData) error {
+			t.Fatal("Callback called for invalid token")
+			return nil
+		})
+		challenge, done, err := srv.Next([]byte("user=user1\x01auth=Bearer token2\x01\x01"))
+		if err != nil || done || !strings.Contains(string(challenge), `"status":"401"`) {
+			t.Fatal("Unexpected result:", string(challenge), done, err)
+		}
+		if _, _, err := srv.Next([]byte{}); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
+
+type mockSCRAMAuth struct{}
+
+func (mockSCRAMAuth) SCRAMSHA256Credentials(context.Context, string) (module.SCRAMCredentials, error) {
+	return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+}
+
+func (mockSCRAMAuth) SCRAMEnabled() bool {
+	return true
+}
+
+func TestCreateSASL_SCRAM(t *testing.T) {
+	a := SASLAuth{
+		Log:   testutils.Logger(t, "saslauth"),
+		SCRAM: []module.SCRAMAuth{mockSCRAMAuth{}},
+	}
+
+	if mechs := a.SASLMechanisms(); len(mechs) != 1 || mechs[0] != "SCRAM-SHA-256" {
+		t.Error("Wrong mechanisms without TLS:", mechs)
+	}
+	a.TLSConfig = &tls.Config{}
+	if mechs := a.SASLMechanisms(); len(mechs) != 2 || mechs[1] != "SCRAM-SHA-256-PLUS" {
+		t.Error("Wrong mechanisms with TLS:", mechs)
+	}
+
+	srv := a.CreateSASL("SCRAM-SHA-256-PLUS", &net.TCPAddr{}, nil, func(string, ContextData) error {
+		t.Fatal("Callback called")
+		return nil
+	})
+	if _, _, err := srv.Next([]byte("p=tls-server-end-point,,n=user,r=nonce")); err == nil {
+		t.Error("No error for SCRAM-SHA-256-PLUS without TLS")
+	}
+
+	srv = a.CreateSASL("SCRAM-SHA-256", &net.TCPAddr{}, nil, func(string, ContextData) error {
+		t.Fatal("Callback called")
+		return nil
+	})
+	challenge, done, err := srv.Next([]byte("n,,n=user,r=nonce"))
+	if err != nil || done || !strings.HasPrefix(string(challenge), "r=nonce") {
+		t.Fatal("Unexpected server-first message:", string(challenge), done, err)
+	}
+	if _, _, err := srv.Next([]byte("c=biws,r=" + strings.Split(string(challenge), ",")[0][2:] + ",p=AAAA")); err == nil {
+		t.Error("Unknown user accepted")
+	}
+}
+
+type mockScopedAuth struct {
+	mockAuth
+	scopes map[string]string
+}
+
+func (m mockScopedAuth) AuthPlainScoped(scope, username, _ string) error {
+	if m.scopes[username] != scope {
+		return errors.New("wrong scope")
+	}
+	return nil
+}
+
+func TestAuthPlain_Scope(t *testing.T) {
+	a := SASLAuth{
+		Log: testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{
+			&mockAuth{db: map[string]bool{"user1": true}},
+			mockScopedAuth{
+				mockAuth: mockAuth{db: map[string]bool{"user2": true}},
+				scopes:   map[string]string{"user2": module.AuthScopeIMAP},
+			},
+		},
+	}
+
+	if err := a.AuthPlain("user2", "aa"); err != nil {
+		t.Error("Unscoped authentication failed:", err)
+	}
+	a.Scope = module.AuthScopeIMAP
+	if err := a.AuthPlain("user2", "aa"); err != nil {
+		t.Error("Scoped authentication failed:", err)
+	}
+	if err := a.AuthPlain("user1", "aa"); err != nil {
+		t.Error("Fallback to the first provider failed:", err)
+	}
+	a.Scope = module.AuthScopeSubmission
+	if err := a.AuthPlain("user2", "aa"); err == nil {
+		t.Error("Credentials accepted for the wrong scope")
+	}
+}
+
+func TestCreateSASL_Guard(t *testing.T) {
+	mod, err := authguard.New("auth_guard", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := mod.(*authguard.Guard)
+	err = guard.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "ip_threshold", Args: []string{"2"}},
+			{Name: "delay", Args: []string{"0s"}},
+			{Name: "state_file", Args: []string{filepath.Join(t.TempDir(), "bans.json")}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guard.Close()
+
+	a := SASLAuth{
+		Log:   testutils.Logger(t, "saslauth"),
+		Plain: []module.PlainAuth{&mockAuth{db: map[string]bool{"user1": true}}},
+		Guard: guard,
+	}
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}
+
+	for i := 0; i < 2; i++ {
+		srv := a.CreateSASL("PLAIN", client, nil, func(string, ContextData) error { return nil })
+		if _, _, err := srv.Next([]byte("\x00user2\x00aa")); !errors.Is(err, ErrInvalidAuthCred) {
+			t.Fatalf("Expected ErrInvalidAuthCred, got %v", err)
+		}
+	}
+
+	srv := a.CreateSASL("PLAIN", client, nil, func(string, ContextData) error { return nil })
+	if _, _, err := srv.Next([]byte("\x00user1\x00aa")); !errors.Is(err, authguard.ErrBanned) {
+		t.Fatalf("Expected ErrBanned, got %v", err)
+	}
+	if err := a.Authenticate(client, "user1", "aa"); !errors.Is(err, authguard.ErrBanned) {
+		t.Fatalf("Expected ErrBanned, got %v", err)
+	}
+	if err := a.Authenticate(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 2)}, "user1", "aa"); err != nil {
+		t.Fatalf("Unexpected error for other client: %v", err)
+	}
+}
+
+type mockSecondFactorAuth struct{}
+
+func (mockSecondFactorAuth) AuthPlain(username, password string) error {
+	switch password {
+	case "aa":
+		return module.ErrSecondFactorRequired
+	case "aa+123456":
+		return nil
+	}
+	return module.ErrUnknownCredentials
+}
+
+type mockUnknownAuth struct{}
+
+func (mockUnknownAuth) AuthPlain(string, string) error {
+	return module.ErrUnknownCredentials
+}
+
+func TestCreateSASL_LoginCode(t *testing.T) {
+	t.Run("second factor", func(t *testing.T) {
+		testLoginCode(t, mockSecondFactorAuth{})
+	})
+	// Providers that do not know the password should not hide the code
+	// request, e.g. app passwords checked after the second factor.
+	t.Run("second factor with app passwords", func(t *testing.T) {
+		testLoginCode(t, mockSecondFactorAuth{}, mockUnknownAuth{})
+	})
+}
+
+func testLoginCode(t *testing.T, providers ...module.PlainAuth) {
+	a := SASLAuth{
+		Log:         testutils.Logger(t, "saslauth"),
+		Plain:       providers,
+		EnableLogin: true,
+	}
+
+	test := func(code string, expectOk bool) {
+		t.Helper()
+		srv := a.CreateSASL("LOGIN", &net.TCPAddr{}, nil, func(string, ContextData) error { return nil })
+		if _, _, err := srv.Next([]byte("user1")); err != nil {
+			t.Fatal(err)
+		}
+		challenge, done, err := srv.Next([]byte("aa"))
+		if err != nil || done || string(challenge) != "Code:" {
+			t.Fatalf("Expected code prompt, got %q %v %v", challenge, done, err)
+		}
+		_, done, err = srv.Next([]byte(code))
+		if !done {
+			t.Fatal("Exchange is not finished")
+		}
+		if expectOk && err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if !expectOk && !errors.Is(err, ErrInvalidAuthCred) {
+			t.Errorf("Expected ErrInvalidAuthCred, got %v", err)
+		}
+	}
+	test("123456", true)
+	test("654321", false)
+}
+
+func TestCreateSASL_GuardSecondFactor(t *testing.T) {
+	mod, err := authguard.New("auth_guard", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := mod.(*authguard.Guard)
+	err = guard.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "ip_threshold", Args: []string{"3"}},
+			{Name: "delay", Args: []string{"0s"}},
+			{Name: "state_file", Args: []string{filepath.Join(t.TempDir(), "bans.json")}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guard.Close()
+
+	a := SASLAuth{
+		Log:         testutils.Logger(t, "saslauth"),
+		Plain:       []module.PlainAuth{mockSecondFactorAuth{}},
+		EnableLogin: true,
+		Guard:       guard,
+	}
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 12345}
+
+	// Each wrong code counts twice: for the attempt without the code and
+	// for the code itself.
+	srv := a.CreateSASL("LOGIN", client, nil, func(string, ContextData) error { return nil })
+	if _, _, err := srv.Next([]byte("user1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := srv.Next([]byte("aa")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := srv.Next([]byte("000000")); !errors.Is(err, ErrInvalidAuthCred) {
+		t.Fatalf("Expected ErrInvalidAuthCred, got %v", err)
+	}
+	if err := a.Authenticate(client, "user1", "aa"); !errors.Is(err, module.ErrSecondFactorRequired) {
+		t.Fatalf("Expected ErrSecondFactorRequired, got %v", err)
+	}
+	if err := a.Authenticate(client, "user1", "aa+123456"); !errors.Is(err, authguard.ErrBanned) {
+		t.Fatalf("Expected ErrBanned, got %v", err)
+	}
+}
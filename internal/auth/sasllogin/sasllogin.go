@@ -1,6 +1,11 @@
 package sasllogin
 
-import "github.com/emersion/go-sasl"
+import (
+	"errors"
+
+	"github.com/emersion/go-sasl"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
 
 // Copy-pasted from old emersion/go-sasl version
 
@@ -12,6 +17,7 @@ const (
 	loginNotStarted loginState = iota
 	loginWaitingUsername
 	loginWaitingPassword
+	loginWaitingCode
 )
 
 type loginServer struct {
@@ -45,6 +51,15 @@ func (a *loginServer) Next(response []byte) (challenge []byte, done bool, err er
 	case loginWaitingPassword:
 		a.password = string(response)
 		err = a.authenticate(a.username, a.password)
+		if errors.Is(err, module.ErrSecondFactorRequired) {
+			// The account requires the one-time code, the password is
+			// checked together with it.
+			challenge, err = []byte("Code:"), nil
+			break
+		}
+		done = true
+	case loginWaitingCode:
+		err = a.authenticate(a.username, a.password+module.SecondFactorSeparator+string(response))
 		done = true
 	default:
 		err = sasl.ErrUnexpectedClientResponse
@@ -0,0 +1,102 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package saslscram
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"hash"
+)
+
+// ServerEndPoint returns tls-server-end-point channel binding data for the
+// server certificate (RFC 5929 Section 4.1).
+func ServerEndPoint(cert *x509.Certificate) []byte {
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		h = sha512.New()
+	default:
+		// MD5 and SHA-1 are replaced with SHA-256.
+		h = sha256.New()
+	}
+	h.Write(cert.Raw)
+	return h.Sum(nil)
+}
+
+// ServerCertificate returns the certificate presented to the client on the
+// connection described by state.
+//
+// crypto/tls does not expose the local certificate, so it is selected again
+// using the server configuration and the SNI value from the connection.
+func ServerCertificate(cfg *tls.Config, state *tls.ConnectionState) (*x509.Certificate, error) {
+	hello := &tls.ClientHelloInfo{ServerName: state.ServerName}
+	if cfg.GetConfigForClient != nil {
+		clientCfg, err := cfg.GetConfigForClient(hello)
+		if err != nil {
+			return nil, err
+		}
+		if clientCfg != nil {
+			cfg = clientCfg
+		}
+	}
+
+	var cert *tls.Certificate
+	if cfg.GetCertificate != nil {
+		var err error
+		cert, err = cfg.GetCertificate(hello)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cert == nil {
+		for i := range cfg.Certificates {
+			c := &cfg.Certificates[i]
+			if cert == nil {
+				cert = c
+			}
+			if state.ServerName == "" {
+				break
+			}
+			leaf, err := leafCertificate(c)
+			if err == nil && leaf.VerifyHostname(state.ServerName) == nil {
+				cert = c
+				break
+			}
+		}
+	}
+	if cert == nil {
+		return nil, errors.New("sasl: no server certificate")
+	}
+	return leafCertificate(cert)
+}
+
+func leafCertificate(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("sasl: empty certificate chain")
+	}
+	return x509.ParseCertificate(cert.Certificate[0])
+}
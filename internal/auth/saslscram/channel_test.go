@@ -0,0 +1,88 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package saslscram
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestServerCertificate(t *testing.T) {
+	first, second := testCert(t, "mx1.example.org"), testCert(t, "mx2.example.org")
+	base := &tls.Config{Certificates: []tls.Certificate{first, second}}
+	wrapped := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return base, nil
+		},
+	}
+
+	test := func(cfg *tls.Config, sni string, expected tls.Certificate) {
+		t.Helper()
+		cert, err := ServerCertificate(cfg, &tls.ConnectionState{ServerName: sni})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cert.Raw, expected.Certificate[0]) {
+			t.Errorf("%s: wrong certificate selected: %s", sni, cert.Subject.CommonName)
+		}
+
+		sum := sha256.Sum256(expected.Certificate[0])
+		if !bytes.Equal(ServerEndPoint(cert), sum[:]) {
+			t.Errorf("%s: wrong channel binding data", sni)
+		}
+	}
+
+	test(base, "", first)
+	test(base, "mx2.example.org", second)
+	test(wrapped, "mx2.example.org", second)
+	test(wrapped, "unknown.example.org", first)
+
+	if _, err := ServerCertificate(&tls.Config{}, &tls.ConnectionState{}); err == nil {
+		t.Error("Expected an error for empty configuration")
+	}
+}
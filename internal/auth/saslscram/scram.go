@@ -0,0 +1,395 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package saslscram implements the server side of SCRAM-SHA-256 and
+// SCRAM-SHA-256-PLUS SASL mechanisms (RFC 5802, RFC 7677).
+package saslscram
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-sasl"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+const (
+	SHA256     = "SCRAM-SHA-256"
+	SHA256Plus = "SCRAM-SHA-256-PLUS"
+
+	// ChannelBindingType is the only channel binding type supported for
+	// -PLUS mechanisms (RFC 5929).
+	ChannelBindingType = "tls-server-end-point"
+
+	MinIterations = 4096
+	SaltSize      = 16
+)
+
+var (
+	ErrInvalidProof = errors.New("sasl: invalid proof")
+	ErrMalformed    = errors.New("sasl: malformed SCRAM message")
+)
+
+// SaltedKeys derives StoredKey and ServerKey from the password.
+func SaltedKeys(password string, salt []byte, iterations int) (storedKey, serverKey []byte, err error) {
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientKey := hmacSum(salted, []byte("Client Key"))
+	stored := sha256.Sum256(clientKey)
+	return stored[:], hmacSum(salted, []byte("Server Key")), nil
+}
+
+// NewCredentials generates a random salt and derives keys from the password.
+func NewCredentials(password string, iterations int) (module.SCRAMCredentials, error) {
+	if iterations < MinIterations {
+		iterations = MinIterations
+	}
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+	stored, server, err := SaltedKeys(password, salt, iterations)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+	return module.SCRAMCredentials{
+		Iterations: iterations,
+		Salt:       salt,
+		StoredKey:  stored,
+		ServerKey:  server,
+	}, nil
+}
+
+// fakeKeyFile is the name of the file in the state directory that keeps the
+// key used to derive credentials for unknown users.
+const fakeKeyFile = "scram_fake_key"
+
+var (
+	fakeKeyOnce sync.Once
+	fakeKeyVal  []byte
+)
+
+// fakeKey returns the key used to derive credentials for unknown users. It
+// is kept in the state directory so unknown users get the same salt after
+// a restart, as existing users do.
+func fakeKey() []byte {
+	fakeKeyOnce.Do(func() {
+		var err error
+		if config.StateDirectory != "" {
+			fakeKeyVal, err = loadFakeKey(filepath.Join(config.StateDirectory, fakeKeyFile))
+			if err != nil {
+				log.DefaultLogger.Error("saslscram: failed to load the key for unknown users, salts will change after restart", err)
+			}
+		}
+		if fakeKeyVal == nil {
+			fakeKeyVal = make([]byte, sha256.Size)
+			if _, err := rand.Read(fakeKeyVal); err != nil {
+				panic(err)
+			}
+		}
+	})
+	return fakeKeyVal
+}
+
+// loadFakeKey reads the key from path, generating it if the file does not
+// exist. The file is created atomically so concurrently started processes
+// end up using the same key.
+func loadFakeKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil {
+		if len(key) != sha256.Size {
+			return nil, fmt.Errorf("malformed key in %s", path)
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key = make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), fakeKeyFile+".*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(key); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return loadFakeKey(path)
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// fakeCredentials returns credentials for users that have no SCRAM keys.
+// They never match a client proof.
+func fakeCredentials(username string) module.SCRAMCredentials {
+	fakeKey := fakeKey()
+	return module.SCRAMCredentials{
+		Iterations: MinIterations,
+		Salt:       hmacSum(fakeKey, []byte("salt\x00"+username))[:SaltSize],
+		StoredKey:  hmacSum(fakeKey, []byte("stored\x00"+username)),
+		ServerKey:  hmacSum(fakeKey, []byte("server\x00"+username)),
+	}
+}
+
+func hmacSum(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// CredentialsLookup returns the stored credentials for the authentication
+// identity.
+type CredentialsLookup func(username string) (module.SCRAMCredentials, error)
+
+// Authenticator is called once the client proof is verified.
+//
+// identity is the authorization identity requested by the client, it is
+// empty if none is specified.
+type Authenticator func(identity, username string) error
+
+type scramState int
+
+const (
+	scramNotStarted scramState = iota
+	scramWaitingClientFinal
+	scramWaitingAck
+	scramDone
+)
+
+type scramServer struct {
+	state scramState
+
+	lookup       CredentialsLookup
+	authenticate Authenticator
+
+	plus           bool
+	plusAdvertised bool
+	cbData         []byte
+
+	gs2Header       string
+	identity        string
+	username        string
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+	creds           module.SCRAMCredentials
+	credsErr        error
+}
+
+// NewServer creates the server for SCRAM-SHA-256.
+//
+// plusAdvertised should be set if SCRAM-SHA-256-PLUS is offered to the client,
+// this is required to detect downgrade attacks.
+func NewServer(lookup CredentialsLookup, authenticate Authenticator, plusAdvertised bool) sasl.Server {
+	return &scramServer{lookup: lookup, authenticate: authenticate, plusAdvertised: plusAdvertised}
+}
+
+// NewPlusServer creates the server for SCRAM-SHA-256-PLUS using
+// tls-server-end-point channel binding data.
+func NewPlusServer(lookup CredentialsLookup, authenticate Authenticator, cbData []byte) sasl.Server {
+	return &scramServer{lookup: lookup, authenticate: authenticate, plus: true, cbData: cbData}
+}
+
+func (s *scramServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch s.state {
+	case scramNotStarted:
+		// Client-first message should be sent as the initial response.
+		if response == nil {
+			return []byte{}, false, nil
+		}
+		challenge, err = s.clientFirst(string(response))
+		if err != nil {
+			return nil, true, err
+		}
+		s.state = scramWaitingClientFinal
+		return challenge, false, nil
+	case scramWaitingClientFinal:
+		challenge, err = s.clientFinal(string(response))
+		if err != nil {
+			return nil, true, err
+		}
+		// SMTP and IMAP do not allow to send additional data with the
+		// success response, so server-final message is sent as a challenge.
+		s.state = scramWaitingAck
+		return challenge, false, nil
+	case scramWaitingAck:
+		s.state = scramDone
+		if len(response) != 0 {
+			return nil, true, sasl.ErrUnexpectedClientResponse
+		}
+		return nil, true, nil
+	}
+	return nil, true, sasl.ErrUnexpectedClientResponse
+}
+
+func decodeName(s string) (string, error) {
+	if strings.Contains(strings.NewReplacer("=2C", "", "=3D", "").Replace(s), "=") {
+		return "", ErrMalformed
+	}
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(s), nil
+}
+
+func (s *scramServer) clientFirst(msg string) ([]byte, error) {
+	// gs2-cbind-flag "," [ authzid ] "," client-first-message-bare
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	cbFlag, authzid := parts[0], parts[1]
+	switch {
+	case cbFlag == "p="+ChannelBindingType:
+		if !s.plus {
+			return nil, errors.New("sasl: channel binding is not supported by this mechanism")
+		}
+	case strings.HasPrefix(cbFlag, "p="):
+		return nil, fmt.Errorf("sasl: unsupported channel binding type: %s", strings.TrimPrefix(cbFlag, "p="))
+	case cbFlag == "y":
+		// Client supports channel binding but thinks the server does not.
+		if s.plus || s.plusAdvertised {
+			return nil, errors.New("sasl: channel binding downgrade detected")
+		}
+	case cbFlag == "n":
+		if s.plus {
+			return nil, errors.New("sasl: channel binding is required")
+		}
+	default:
+		return nil, ErrMalformed
+	}
+	if authzid != "" {
+		if !strings.HasPrefix(authzid, "a=") {
+			return nil, ErrMalformed
+		}
+		var err error
+		s.identity, err = decodeName(authzid[2:])
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.gs2Header = cbFlag + "," + authzid + ","
+	s.clientFirstBare = parts[2]
+
+	attrs := strings.Split(s.clientFirstBare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, ErrMalformed
+	}
+	var err error
+	s.username, err = decodeName(attrs[0][2:])
+	if err != nil {
+		return nil, err
+	}
+	clientNonce := attrs[1][2:]
+	if s.username == "" || clientNonce == "" {
+		return nil, ErrMalformed
+	}
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	s.nonce = clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+
+	s.creds, s.credsErr = s.lookup(s.username)
+	if s.credsErr != nil {
+		// Continue the exchange with fake credentials so the client cannot
+		// tell whether the user exists.
+		s.creds = fakeCredentials(s.username)
+	}
+
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(s.creds.Salt) +
+		",i=" + strconv.Itoa(s.creds.Iterations)
+	return []byte(s.serverFirst), nil
+}
+
+func (s *scramServer) clientFinal(msg string) ([]byte, error) {
+	// channel-binding "," nonce ["," extensions] "," proof
+	proofIdx := strings.LastIndex(msg, ",p=")
+	if proofIdx == -1 {
+		return nil, ErrMalformed
+	}
+	withoutProof := msg[:proofIdx]
+	proof, err := base64.StdEncoding.DecodeString(msg[proofIdx+3:])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, ErrMalformed
+	}
+	cbind, err := base64.StdEncoding.DecodeString(attrs[0][2:])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	expectedCbind := []byte(s.gs2Header)
+	if s.plus {
+		expectedCbind = append(expectedCbind, s.cbData...)
+	}
+	if !bytes.Equal(cbind, expectedCbind) {
+		return nil, errors.New("sasl: channel binding mismatch")
+	}
+	if attrs[1][2:] != s.nonce {
+		return nil, errors.New("sasl: nonce mismatch")
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientSig := hmacSum(s.creds.StoredKey, authMessage)
+	if len(proof) != len(clientSig) {
+		return nil, ErrInvalidProof
+	}
+	clientKey := make([]byte, len(proof))
+	subtle.XORBytes(clientKey, proof, clientSig)
+	storedKey := sha256.Sum256(clientKey)
+	if s.credsErr != nil || subtle.ConstantTimeCompare(storedKey[:], s.creds.StoredKey) != 1 {
+		return nil, ErrInvalidProof
+	}
+
+	if err := s.authenticate(s.identity, s.username); err != nil {
+		return nil, err
+	}
+
+	serverSig := hmacSum(s.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSig)), nil
+}
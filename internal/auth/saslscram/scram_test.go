@@ -0,0 +1,250 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package saslscram
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+// clientProof computes the client proof and the expected server signature.
+func clientProof(password string, salt []byte, iterations int, authMessage string) (proof, serverSig []byte) {
+	storedKey, serverKey, err := SaltedKeys(password, salt, iterations)
+	if err != nil {
+		panic(err)
+	}
+	clientSig := hmacSum(storedKey, []byte(authMessage))
+
+	// ClientKey is recovered from the stored key by the server, client
+	// computes it directly.
+	salted := saltedPassword(password, salt, iterations)
+	clientKey := hmacSum(salted, []byte("Client Key"))
+	proof = make([]byte, len(clientKey))
+	subtle.XORBytes(proof, clientKey, clientSig)
+	return proof, hmacSum(serverKey, []byte(authMessage))
+}
+
+func saltedPassword(password string, salt []byte, iterations int) []byte {
+	// PBKDF2 with a single block is HMAC iterated, see RFC 5802 Hi().
+	u := hmacSum([]byte(password), append(append([]byte{}, salt...), 0, 0, 0, 1))
+	res := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = hmacSum([]byte(password), u)
+		for j := range res {
+			res[j] ^= u[j]
+		}
+	}
+	return res
+}
+
+func TestSaltedKeys_RFC7677(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	authMessage := "n=user,r=rOprNGfwEbeRWgbNEkqO," +
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096," +
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+
+	proof, serverSig := clientProof("pencil", salt, 4096, authMessage)
+	if got := base64.StdEncoding.EncodeToString(proof); got != "dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Errorf("Wrong proof: %s", got)
+	}
+	if got := base64.StdEncoding.EncodeToString(serverSig); got != "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" {
+		t.Errorf("Wrong server signature: %s", got)
+	}
+}
+
+type exchange struct {
+	gs2Header string
+	cbData    []byte
+	username  string
+	password  string
+}
+
+func (e exchange) run(t *testing.T, srv interface {
+	Next([]byte) ([]byte, bool, error)
+}) error {
+	t.Helper()
+
+	clientFirstBare := "n=" + e.username + ",r=clientnonce"
+	serverFirst, done, err := srv.Next([]byte(e.gs2Header + clientFirstBare))
+	if err != nil {
+		return err
+	}
+	if done {
+		t.Fatal("Unexpected done after client-first")
+	}
+
+	attrs := strings.Split(string(serverFirst), ",")
+	nonce := strings.TrimPrefix(attrs[0], "r=")
+	if !strings.HasPrefix(nonce, "clientnonce") || len(nonce) == len("clientnonce") {
+		t.Fatalf("Malformed server nonce: %s", serverFirst)
+	}
+	salt, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(attrs[1], "s="))
+
+	cbind := base64.StdEncoding.EncodeToString(append([]byte(e.gs2Header), e.cbData...))
+	withoutProof := "c=" + cbind + ",r=" + nonce
+	authMessage := clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	proof, serverSig := clientProof(e.password, salt, MinIterations, authMessage)
+
+	serverFinal, done, err := srv.Next([]byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	if done {
+		t.Fatal("Unexpected done after client-final")
+	}
+	if string(serverFinal) != "v="+base64.StdEncoding.EncodeToString(serverSig) {
+		t.Errorf("Wrong server signature: %s", serverFinal)
+	}
+
+	_, done, err = srv.Next([]byte{})
+	if err != nil {
+		return err
+	}
+	if !done {
+		t.Error("Exchange is not done")
+	}
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	creds, err := NewCredentials("password", MinIterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(username string) (module.SCRAMCredentials, error) {
+		if username != "user,1" {
+			return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+		}
+		return creds, nil
+	}
+	var authenticated string
+	authenticate := func(identity, username string) error {
+		authenticated = username
+		return nil
+	}
+	cbData := []byte("certificate hash")
+
+	test := func(name string, srv interface {
+		Next([]byte) ([]byte, bool, error)
+	}, e exchange, fail bool) {
+		t.Helper()
+		authenticated = ""
+		err := e.run(t, srv)
+		if fail {
+			if err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+			if authenticated != "" {
+				t.Errorf("%s: authenticate called", name)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		if authenticated != "user,1" {
+			t.Errorf("%s: wrong username: %q", name, authenticated)
+		}
+	}
+
+	valid := exchange{gs2Header: "n,,", username: "user=2C1", password: "password"}
+	test("valid", NewServer(lookup, authenticate, false), valid, false)
+	test("wrong password", NewServer(lookup, authenticate, false), exchange{gs2Header: "n,,", username: "user=2C1", password: "wrong"}, true)
+	test("unknown user", NewServer(lookup, authenticate, false), exchange{gs2Header: "n,,", username: "user2", password: "password"}, true)
+	test("client supports cb", NewServer(lookup, authenticate, false), exchange{gs2Header: "y,,", username: "user=2C1", password: "password"}, false)
+	test("downgrade", NewServer(lookup, authenticate, true), exchange{gs2Header: "y,,", username: "user=2C1", password: "password"}, true)
+	test("cb on non-plus", NewServer(lookup, authenticate, true), exchange{gs2Header: "p=tls-server-end-point,,", cbData: cbData, username: "user=2C1", password: "password"}, true)
+
+	plus := exchange{gs2Header: "p=tls-server-end-point,,", cbData: cbData, username: "user=2C1", password: "password"}
+	test("plus", NewPlusServer(lookup, authenticate, cbData), plus, false)
+	test("plus without cb", NewPlusServer(lookup, authenticate, cbData), valid, true)
+	test("plus cb mismatch", NewPlusServer(lookup, authenticate, cbData), exchange{gs2Header: "p=tls-server-end-point,,", cbData: []byte("other"), username: "user=2C1", password: "password"}, true)
+	test("plus unknown cb type", NewPlusServer(lookup, authenticate, cbData), exchange{gs2Header: "p=tls-unique,,", cbData: cbData, username: "user=2C1", password: "password"}, true)
+
+	denied := errors.New("denied")
+	srv := NewServer(lookup, func(identity, username string) error { return denied }, false)
+	if err := valid.run(t, srv); !errors.Is(err, denied) {
+		t.Errorf("Authenticator error is not returned: %v", err)
+	}
+}
+
+func TestServer_UnknownUserSalt(t *testing.T) {
+	lookup := func(string) (module.SCRAMCredentials, error) {
+		return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+	}
+	serverFirst := func(username string) string {
+		t.Helper()
+		srv := NewServer(lookup, func(string, string) error { return nil }, false)
+		challenge, _, err := srv.Next([]byte("n,,n=" + username + ",r=nonce"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Strip the nonce.
+		return strings.SplitN(string(challenge), ",", 2)[1]
+	}
+
+	first := serverFirst("user")
+	if second := serverFirst("user"); first != second {
+		t.Errorf("Salt for unknown user changes between attempts: %s, %s", first, second)
+	}
+	if other := serverFirst("other"); first == other {
+		t.Error("Same salt is used for different users")
+	}
+	if !strings.HasSuffix(first, ",i=4096") {
+		t.Errorf("Unexpected iteration count: %s", first)
+	}
+}
+
+func TestLoadFakeKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), fakeKeyFile)
+	key, err := loadFakeKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same key is used after restart.
+	again, err := loadFakeKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, again) {
+		t.Fatal("Key changes after restart")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Errorf("Key file is readable by others: %v", info.Mode())
+	}
+
+	if err := os.WriteFile(path, []byte("short"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadFakeKey(path); err == nil {
+		t.Error("Malformed key is accepted")
+	}
+}
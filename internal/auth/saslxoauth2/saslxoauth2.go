@@ -0,0 +1,101 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package saslxoauth2
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// XOAuth2 is the name of the mechanism.
+const XOAuth2 = "XOAUTH2"
+
+// Authenticates users with an username and a bearer token.
+type XOAuth2Authenticator func(username, token string) error
+
+// errorChallenge is sent to the client on authentication failure, the client
+// is expected to reply with an empty response.
+var errorChallenge = []byte(`{"status":"401","schemes":"bearer"}`)
+
+type xoauth2Server struct {
+	done         bool
+	failErr      error
+	authenticate XOAuth2Authenticator
+}
+
+// A server implementation of the XOAUTH2 authentication mechanism, as
+// described in https://developers.google.com/gmail/imap/xoauth2-protocol.
+//
+// XOAUTH2 predates OAUTHBEARER (RFC 7628) and is still used by a number of
+// clients that do not support the latter.
+func NewXOAuth2Server(authenticator XOAuth2Authenticator) sasl.Server {
+	return &xoauth2Server{authenticate: authenticator}
+}
+
+func (a *xoauth2Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if a.failErr != nil {
+		if len(response) != 0 {
+			return nil, true, sasl.ErrUnexpectedClientResponse
+		}
+		return nil, true, a.failErr
+	}
+	if a.done {
+		return nil, true, sasl.ErrUnexpectedClientResponse
+	}
+
+	// Generate empty challenge.
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	a.done = true
+
+	// user=username\x01auth=Bearer token\x01\x01
+	var username, token string
+	for _, p := range bytes.Split(response, []byte{0x01}) {
+		if len(p) == 0 {
+			continue
+		}
+		key, value, ok := bytes.Cut(p, []byte{'='})
+		if !ok {
+			return nil, true, errors.New("sasl: invalid response, missing '='")
+		}
+		switch string(key) {
+		case "user":
+			username = string(value)
+		case "auth":
+			const prefix = "bearer "
+			if !strings.HasPrefix(strings.ToLower(string(value)), prefix) {
+				return nil, true, errors.New("sasl: unsupported token type")
+			}
+			token = string(value[len(prefix):])
+		}
+	}
+	if username == "" || token == "" {
+		return nil, true, errors.New("sasl: invalid response, missing user or auth")
+	}
+
+	if err := a.authenticate(username, token); err != nil {
+		a.failErr = err
+		return errorChallenge, false, nil
+	}
+	return nil, true, nil
+}
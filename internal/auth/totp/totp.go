@@ -0,0 +1,406 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package totp implements the auth.totp module that requires a time-based
+// one-time code (RFC 6238) in addition to the password checked by wrapped
+// providers, e.g. auth.pass_table or auth.ldap.
+//
+// The code is either appended to the password as "password+123456" or, for
+// SASL LOGIN, sent in response to a separate prompt. Users without an
+// enrolled secret authenticate using the password only.
+//
+// SCRAM mechanisms cannot carry the code, so SCRAM keys of wrapped providers
+// are available only for users without an enrolled secret.
+package totp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	modconfig "github.com/sirrchat/SirrMesh/framework/config/module"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"golang.org/x/text/secure/precis"
+)
+
+const modName = "auth.totp"
+
+// CodeSeparator separates the password and the code.
+const CodeSeparator = module.SecondFactorSeparator
+
+var (
+	ErrNotEnrolled = errors.New("TOTP is not enrolled")
+	ErrSCRAMDenied = errors.New("SCRAM cannot be used with TOTP enrolled")
+)
+
+// Enrollment is the stored TOTP secret of the user.
+type Enrollment struct {
+	Secret  string    `json:"secret"`
+	Created time.Time `json:"created"`
+	// LastStep is the time step of the last accepted code, codes cannot be
+	// reused.
+	LastStep int64 `json:"last_step,omitempty"`
+}
+
+type Auth struct {
+	modName  string
+	instName string
+	log      log.Logger
+
+	providers []module.PlainAuth
+	table     module.Table
+	issuer    string
+	skew      int
+
+	// Serializes read-modify-write updates of table entries.
+	updateLck sync.Mutex
+
+	now func() time.Time
+}
+
+func New(modName, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, fmt.Errorf("%s: inline arguments are not used", modName)
+	}
+	return &Auth{
+		modName:  modName,
+		instName: instName,
+		log:      log.Logger{Name: modName},
+		now:      time.Now,
+	}, nil
+}
+
+func (a *Auth) Init(cfg *config.Map) error {
+	var hostname string
+
+	cfg.Logger(true, false, &a.log)
+	cfg.Callback("auth", func(m *config.Map, node config.Node) error {
+		var p module.PlainAuth
+		if err := modconfig.ModuleFromNode("auth", node.Args, node, m.Globals, &p); err != nil {
+			return err
+		}
+		a.providers = append(a.providers, p)
+		return nil
+	})
+	cfg.Custom("table", false, true, nil, modconfig.TableDirective, &a.table)
+	cfg.String("hostname", true, false, "", &hostname)
+	cfg.String("issuer", false, false, "", &a.issuer)
+	cfg.Int("skew", false, false, 1, &a.skew)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(a.providers) == 0 {
+		return fmt.Errorf("%s: at least one auth directive is required", a.modName)
+	}
+	if a.skew < 0 {
+		return fmt.Errorf("%s: skew should not be negative", a.modName)
+	}
+	// The last used step is saved to the table so codes cannot be
+	// replayed within the skew window.
+	if _, ok := a.table.(module.MutableTable); !ok {
+		return fmt.Errorf("%s: table should be mutable to prevent reuse of codes", a.modName)
+	}
+	if a.issuer == "" {
+		a.issuer = hostname
+	}
+	return nil
+}
+
+func (a *Auth) Name() string {
+	return a.modName
+}
+
+func (a *Auth) InstanceName() string {
+	return a.instName
+}
+
+func (a *Auth) mutableTable() (module.MutableTable, error) {
+	tbl, ok := a.table.(module.MutableTable)
+	if !ok {
+		return nil, fmt.Errorf("%s: table is not mutable, no management functionality available", a.modName)
+	}
+	return tbl, nil
+}
+
+func (a *Auth) load(ctx context.Context, key string) (*Enrollment, error) {
+	blob, ok, err := a.table.Lookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || blob == "" {
+		return nil, nil
+	}
+	var e Enrollment
+	if err := json.Unmarshal([]byte(blob), &e); err != nil {
+		return nil, fmt.Errorf("%s: malformed entry for %s: %w", a.modName, key, err)
+	}
+	return &e, nil
+}
+
+func (a *Auth) store(key string, e *Enrollment) error {
+	tbl, err := a.mutableTable()
+	if err != nil {
+		return err
+	}
+	blob, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return tbl.SetKey(key, string(blob))
+}
+
+// splitCode splits "password+123456" into the password and the code.
+func splitCode(password string) (string, string, bool) {
+	i := strings.LastIndex(password, CodeSeparator)
+	if i == -1 {
+		return password, "", false
+	}
+	code := password[i+len(CodeSeparator):]
+	if len(code) != Digits {
+		return password, "", false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return password, "", false
+		}
+	}
+	return password[:i], code, true
+}
+
+func (a *Auth) authInner(scope, username, password string) error {
+	var lastErr error
+	for _, p := range a.providers {
+		if scoped, ok := p.(module.ScopedPlainAuth); ok && scope != "" {
+			lastErr = scoped.AuthPlainScoped(scope, username, password)
+		} else {
+			lastErr = p.AuthPlain(username, password)
+		}
+		if lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+func (a *Auth) AuthPlain(username, password string) error {
+	return a.AuthPlainScoped("", username, password)
+}
+
+// AuthPlainScoped checks the password using wrapped providers, passing the
+// scope to them, and then the one-time code if the user has TOTP enrolled.
+//
+// module.ErrSecondFactorRequired is returned if the code is missing. The
+// password is not checked in this case so the result does not tell whether
+// it is correct. It does tell that the user has TOTP enrolled, such
+// attempts are counted as failures by auth_guard.
+func (a *Auth) AuthPlainScoped(scope, username, password string) error {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return err
+	}
+	e, err := a.load(context.TODO(), key)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return a.authInner(scope, username, password)
+	}
+
+	pass, code, ok := splitCode(password)
+	if !ok {
+		return module.ErrSecondFactorRequired
+	}
+	if err := a.authInner(scope, username, pass); err != nil {
+		return err
+	}
+	return a.checkCode(key, code)
+}
+
+// SCRAMEnabled reports whether any wrapped provider offers SCRAM.
+func (a *Auth) SCRAMEnabled() bool {
+	for _, p := range a.providers {
+		if scram, ok := p.(module.SCRAMAuth); ok && scram.SCRAMEnabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// SCRAMSHA256Credentials returns SCRAM keys from wrapped providers.
+// ErrSCRAMDenied is returned for users with TOTP enrolled since the code
+// cannot be checked.
+func (a *Auth) SCRAMSHA256Credentials(ctx context.Context, username string) (module.SCRAMCredentials, error) {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+	e, err := a.load(ctx, key)
+	if err != nil {
+		return module.SCRAMCredentials{}, err
+	}
+	if e != nil {
+		a.log.DebugMsg("refusing SCRAM for enrolled user", "username", key)
+		return module.SCRAMCredentials{}, ErrSCRAMDenied
+	}
+
+	lastErr := module.ErrUnknownCredentials
+	for _, p := range a.providers {
+		scram, ok := p.(module.SCRAMAuth)
+		if !ok || !scram.SCRAMEnabled() {
+			continue
+		}
+		creds, err := scram.SCRAMSHA256Credentials(ctx, username)
+		if err == nil {
+			return creds, nil
+		}
+		lastErr = err
+	}
+	return module.SCRAMCredentials{}, lastErr
+}
+
+func (a *Auth) checkCode(key, code string) error {
+	a.updateLck.Lock()
+	defer a.updateLck.Unlock()
+
+	// Reload to see the last step stored by a concurrent login.
+	e, err := a.load(context.TODO(), key)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return module.ErrUnknownCredentials
+	}
+	secret, err := DecodeSecret(e.Secret)
+	if err != nil {
+		return fmt.Errorf("%s: malformed secret for %s: %w", a.modName, key, err)
+	}
+
+	step, ok := Verify(secret, code, a.now(), a.skew)
+	if !ok {
+		a.log.Msg("wrong one-time code", "username", key)
+		return module.ErrUnknownCredentials
+	}
+	if step <= e.LastStep {
+		a.log.Msg("one-time code reused", "username", key)
+		return module.ErrUnknownCredentials
+	}
+
+	e.LastStep = step
+	if err := a.store(key, e); err != nil {
+		a.log.Error("failed to save the last used code", err, "username", key)
+	}
+	return nil
+}
+
+// URI returns the otpauth:// URI for the user and secret.
+func (a *Auth) URI(username, secret string) string {
+	return URI(a.issuer, username, secret)
+}
+
+// Enroll verifies the code generated using the secret and saves the secret
+// for the user, replacing the existing one. Code is not checked if it is
+// empty.
+func (a *Auth) Enroll(username, secret, code string) error {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return fmt.Errorf("%s: enroll %s (raw): %w", a.modName, username, err)
+	}
+	decoded, err := DecodeSecret(secret)
+	if err != nil {
+		return fmt.Errorf("%s: malformed secret: %w", a.modName, err)
+	}
+
+	e := &Enrollment{
+		Secret:  secret,
+		Created: a.now().UTC().Truncate(time.Second),
+	}
+	if code != "" {
+		step, ok := Verify(decoded, code, a.now(), a.skew)
+		if !ok {
+			return fmt.Errorf("%s: wrong code, check the clock of the device", a.modName)
+		}
+		e.LastStep = step
+	}
+
+	a.updateLck.Lock()
+	defer a.updateLck.Unlock()
+	if err := a.store(key, e); err != nil {
+		return fmt.Errorf("%s: enroll %s: %w", a.modName, key, err)
+	}
+	return nil
+}
+
+// Enrollment returns the stored enrollment of the user or ErrNotEnrolled.
+func (a *Auth) Enrollment(username string) (*Enrollment, error) {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return nil, err
+	}
+	e, err := a.load(context.TODO(), key)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return nil, ErrNotEnrolled
+	}
+	return e, nil
+}
+
+// ListUsers returns users having TOTP enrolled.
+func (a *Auth) ListUsers() ([]string, error) {
+	tbl, err := a.mutableTable()
+	if err != nil {
+		return nil, err
+	}
+	return tbl.Keys()
+}
+
+// Unenroll removes the TOTP secret of the user.
+func (a *Auth) Unenroll(username string) error {
+	key, err := precis.UsernameCaseMapped.CompareKey(username)
+	if err != nil {
+		return fmt.Errorf("%s: remove %s (raw): %w", a.modName, username, err)
+	}
+	tbl, err := a.mutableTable()
+	if err != nil {
+		return err
+	}
+
+	a.updateLck.Lock()
+	defer a.updateLck.Unlock()
+
+	e, err := a.load(context.TODO(), key)
+	if err != nil {
+		return err
+	}
+	if e == nil {
+		return fmt.Errorf("%s: %s: %w", a.modName, key, ErrNotEnrolled)
+	}
+	return tbl.RemoveKey(key)
+}
+
+func init() {
+	module.Register(modName, New)
+}
@@ -0,0 +1,265 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package totp
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+)
+
+type mutableTable struct {
+	testutils.Table
+}
+
+func (m mutableTable) Keys() ([]string, error) {
+	var keys []string
+	for k := range m.M {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (m mutableTable) SetKey(k, v string) error {
+	m.M[k] = v
+	return nil
+}
+
+func (m mutableTable) RemoveKey(k string) error {
+	delete(m.M, k)
+	return nil
+}
+
+type mockAuth struct {
+	passwords map[string]string
+	scopes    map[string]string
+	scram     bool
+}
+
+func (m mockAuth) SCRAMSHA256Credentials(_ context.Context, username string) (module.SCRAMCredentials, error) {
+	if _, ok := m.passwords[username]; !ok {
+		return module.SCRAMCredentials{}, module.ErrUnknownCredentials
+	}
+	return module.SCRAMCredentials{Iterations: 4096}, nil
+}
+
+func (m mockAuth) SCRAMEnabled() bool {
+	return m.scram
+}
+
+func (m mockAuth) AuthPlain(username, password string) error {
+	return m.AuthPlainScoped("", username, password)
+}
+
+func (m mockAuth) AuthPlainScoped(scope, username, password string) error {
+	if m.passwords[username] != password {
+		return module.ErrUnknownCredentials
+	}
+	if s := m.scopes[username]; s != "" && scope != s {
+		return module.ErrUnknownCredentials
+	}
+	return nil
+}
+
+func TestCode(t *testing.T) {
+	// RFC 6238 Appendix B, SHA1.
+	secret := []byte("12345678901234567890")
+	test := func(unix int64, code string) {
+		t.Helper()
+		if got := Code(secret, Step(time.Unix(unix, 0)), 8); got != code {
+			t.Errorf("%d: got %s, want %s", unix, got, code)
+		}
+	}
+	test(59, "94287082")
+	test(1111111109, "07081804")
+	test(1111111111, "14050471")
+	test(1234567890, "89005924")
+	test(2000000000, "69279037")
+	test(20000000000, "65353130")
+
+	if _, ok := Verify(secret, "287082", time.Unix(59+Period, 0), 1); !ok {
+		t.Error("Code from the previous step is not accepted")
+	}
+	if _, ok := Verify(secret, "287082", time.Unix(59+2*Period, 0), 1); ok {
+		t.Error("Code outside of skew is accepted")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := URI("mx.example.org", "user@example.org", "JBSWY3DPEHPK3PXP")
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/mx.example.org:user@example.org" {
+		t.Errorf("Wrong URI: %s", uri)
+	}
+	if q := u.Query(); q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != "mx.example.org" || q.Get("digits") != "6" {
+		t.Errorf("Wrong URI parameters: %s", uri)
+	}
+}
+
+func TestSplitCode(t *testing.T) {
+	test := func(in, pass, code string, ok bool) {
+		t.Helper()
+		gotPass, gotCode, gotOk := splitCode(in)
+		if gotPass != pass || gotCode != code || gotOk != ok {
+			t.Errorf("%q: got %q %q %v, want %q %q %v", in, gotPass, gotCode, gotOk, pass, code, ok)
+		}
+	}
+	test("secret+123456", "secret", "123456", true)
+	test("a+b+123456", "a+b", "123456", true)
+	test("secret", "secret", "", false)
+	test("secret+12345", "secret+12345", "", false)
+	test("secret+12345a", "secret+12345a", "", false)
+}
+
+func TestAuth(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tbl := mutableTable{testutils.Table{M: map[string]string{}}}
+	a := &Auth{
+		modName: modName,
+		log:     testutils.Logger(t, modName),
+		providers: []module.PlainAuth{mockAuth{
+			passwords: map[string]string{"user@example.org": "secret", "other@example.org": "pass", "imap@example.org": "pass"},
+			scopes:    map[string]string{"imap@example.org": module.AuthScopeIMAP},
+		}},
+		table: tbl,
+		skew:  1,
+		now:   func() time.Time { return now },
+	}
+
+	secretB32, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := DecodeSecret(secretB32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codeAt := func(t time.Time) string {
+		return Code(secret, Step(t), Digits)
+	}
+
+	if err := a.Enroll("User@example.org", secretB32, codeAt(now.Add(time.Hour))); err == nil {
+		t.Fatal("Enrollment with a wrong code succeeded")
+	}
+	if err := a.Enroll("User@example.org", secretB32, codeAt(now)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users without TOTP are not affected.
+	if err := a.AuthPlain("other@example.org", "pass"); err != nil {
+		t.Errorf("Password-only user rejected: %v", err)
+	}
+
+	// The result without the code does not depend on the password.
+	for _, pass := range []string{"secret", "wrong"} {
+		if err := a.AuthPlain("user@example.org", pass); !errors.Is(err, module.ErrSecondFactorRequired) {
+			t.Errorf("Expected ErrSecondFactorRequired for %s, got %v", pass, err)
+		}
+	}
+	if err := a.AuthPlain("user@example.org", "wrong+"+codeAt(now.Add(Period*time.Second))); err == nil {
+		t.Error("Wrong password with a correct code is accepted")
+	}
+
+	// The code used for enrollment cannot be reused.
+	if err := a.AuthPlain("user@example.org", "secret+"+codeAt(now)); err == nil {
+		t.Error("Code reuse is accepted")
+	}
+	now = now.Add(Period * time.Second)
+	if err := a.AuthPlain("user@example.org", "secret+"+codeAt(now)); err != nil {
+		t.Errorf("Correct password and code rejected: %v", err)
+	}
+	if err := a.AuthPlain("user@example.org", "secret+"+codeAt(now)); err == nil {
+		t.Error("Code reuse is accepted")
+	}
+
+	// Scope is passed to wrapped providers.
+	if err := a.Enroll("imap@example.org", secretB32, ""); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(Period * time.Second)
+	if err := a.AuthPlainScoped(module.AuthScopeSubmission, "imap@example.org", "pass+"+codeAt(now)); err == nil {
+		t.Error("Scope is not passed to the wrapped provider")
+	}
+	if err := a.AuthPlainScoped(module.AuthScopeIMAP, "imap@example.org", "pass+"+codeAt(now)); err != nil {
+		t.Errorf("Scoped authentication failed: %v", err)
+	}
+
+	users, err := a.ListUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 {
+		t.Errorf("Wrong enrolled users: %v", users)
+	}
+	if err := a.Unenroll("user@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Unenroll("user@example.org"); !errors.Is(err, ErrNotEnrolled) {
+		t.Errorf("Expected ErrNotEnrolled, got %v", err)
+	}
+	if err := a.AuthPlain("user@example.org", "secret"); err != nil {
+		t.Errorf("Password rejected after TOTP removal: %v", err)
+	}
+}
+
+func TestAuth_SCRAM(t *testing.T) {
+	inner := mockAuth{passwords: map[string]string{"user@example.org": "secret", "other@example.org": "pass"}}
+	a := &Auth{
+		modName:   modName,
+		log:       testutils.Logger(t, modName),
+		providers: []module.PlainAuth{inner},
+		table:     mutableTable{testutils.Table{M: map[string]string{}}},
+		skew:      1,
+		now:       time.Now,
+	}
+	if a.SCRAMEnabled() {
+		t.Error("SCRAM is enabled without wrapped SCRAM providers")
+	}
+	inner.scram = true
+	a.providers = []module.PlainAuth{inner}
+	if !a.SCRAMEnabled() {
+		t.Error("SCRAM is not enabled")
+	}
+
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Enroll("user@example.org", secret, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.SCRAMSHA256Credentials(context.Background(), "other@example.org"); err != nil {
+		t.Errorf("SCRAM keys are not returned for user without TOTP: %v", err)
+	}
+	if _, err := a.SCRAMSHA256Credentials(context.Background(), "user@example.org"); !errors.Is(err, ErrSCRAMDenied) {
+		t.Errorf("Expected ErrSCRAMDenied, got %v", err)
+	}
+	if _, err := a.SCRAMSHA256Credentials(context.Background(), "unknown@example.org"); !errors.Is(err, module.ErrUnknownCredentials) {
+		t.Errorf("Expected ErrUnknownCredentials, got %v", err)
+	}
+}
@@ -0,0 +1,428 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package authguard implements tracking of authentication failures and
+// temporary bans of clients that fail too often.
+//
+// Failures are counted per client IP (/64 for IPv6) and per username within
+// a sliding window. Each failure makes the next response slower and reaching
+// the threshold bans the IP or username for ban_time. The ban time doubles
+// for each repeated ban up to max_ban_time. Bans are kept in the state file
+// so they survive restarts and can be removed using 'sirrmeshd ban remove'.
+package authguard
+
+import (
+	"errors"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	modconfig "github.com/sirrchat/SirrMesh/framework/config/module"
+	"github.com/sirrchat/SirrMesh/framework/exterrors"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+// ErrBanned is returned by Guard.Check for banned clients.
+var ErrBanned = exterrors.WithTemporary(errors.New("auth_guard: too many authentication failures"), true)
+
+type Guard struct {
+	instName string
+	log      log.Logger
+
+	ipThreshold   int
+	userThreshold int
+	window        time.Duration
+	banTime       time.Duration
+	maxBanTime    time.Duration
+	forgetAfter   time.Duration
+	delay         time.Duration
+	maxDelay      time.Duration
+	exempt        []net.IPNet
+	statePath     string
+
+	lck      sync.Mutex
+	failures map[string][]time.Time
+	state    *guardState
+	// Creation times of bans as of the last read or write of the state
+	// file, used to detect bans removed by 'sirrmeshd ban remove'.
+	synced map[string]time.Time
+
+	now  func() time.Time
+	stop chan struct{}
+	done chan struct{}
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("auth_guard: inline arguments are not used")
+	}
+	return &Guard{
+		instName: instName,
+		log:      log.Logger{Name: "auth_guard"},
+		failures: make(map[string][]time.Time),
+		now:      time.Now,
+	}, nil
+}
+
+func (g *Guard) Name() string {
+	return "auth_guard"
+}
+
+func (g *Guard) InstanceName() string {
+	return g.instName
+}
+
+func (g *Guard) Init(cfg *config.Map) error {
+	var exempt []string
+
+	cfg.Logger(true, false, &g.log)
+	cfg.Int("ip_threshold", false, false, 10, &g.ipThreshold)
+	cfg.Int("user_threshold", false, false, 30, &g.userThreshold)
+	cfg.Duration("window", false, false, 15*time.Minute, &g.window)
+	cfg.Duration("ban_time", false, false, 15*time.Minute, &g.banTime)
+	cfg.Duration("max_ban_time", false, false, 24*time.Hour, &g.maxBanTime)
+	cfg.Duration("forget_after", false, false, 7*24*time.Hour, &g.forgetAfter)
+	cfg.Duration("delay", false, false, 500*time.Millisecond, &g.delay)
+	cfg.Duration("max_delay", false, false, 8*time.Second, &g.maxDelay)
+	cfg.StringList("exempt", false, false, []string{"127.0.0.0/8", "::1/128"}, &exempt)
+	cfg.String("state_file", false, false, DefaultStatePath(config.StateDirectory), &g.statePath)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if g.ipThreshold < 0 || g.userThreshold < 0 {
+		return errors.New("auth_guard: thresholds should not be negative")
+	}
+	if g.maxBanTime < g.banTime {
+		return errors.New("auth_guard: max_ban_time should not be less than ban_time")
+	}
+	for _, e := range exempt {
+		if !strings.Contains(e, "/") {
+			if strings.Contains(e, ":") {
+				e += "/128"
+			} else {
+				e += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(e)
+		if err != nil {
+			return config.NodeErr(cfg.Block, "auth_guard: %v", err)
+		}
+		g.exempt = append(g.exempt, *ipNet)
+	}
+
+	if err := g.load(); err != nil {
+		return err
+	}
+	g.updateMetrics(g.now())
+
+	if !module.NoRun {
+		g.stop = make(chan struct{})
+		g.done = make(chan struct{})
+		go g.maintainLoop()
+	}
+
+	return nil
+}
+
+func (g *Guard) Close() error {
+	if g.stop == nil {
+		return nil
+	}
+	close(g.stop)
+	<-g.done
+	return nil
+}
+
+// Directive parses the configuration directive referencing the auth_guard
+// module, it is used by endpoints.
+func Directive(m *config.Map, node config.Node) (interface{}, error) {
+	var g *Guard
+	if err := modconfig.ModuleFromNode("", node.Args, node, m.Globals, &g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// keys returns ban IDs to check for the client.
+func (g *Guard) keys(addr net.Addr, username string) (ipID, userID string, exempt bool) {
+	if ip := addrIP(addr); ip != nil {
+		for _, e := range g.exempt {
+			if e.Contains(ip) {
+				exempt = true
+			}
+		}
+		if !exempt && g.ipThreshold != 0 {
+			ipID = banID(KindIP, ipKey(ip))
+		}
+	}
+	if username != "" && g.userThreshold != 0 {
+		userID = banID(KindUser, userKey(username))
+	}
+	return
+}
+
+// Check returns ErrBanned if the client IP or username is banned.
+//
+// username can be empty if it is not known yet.
+func (g *Guard) Check(addr net.Addr, username string) error {
+	ipID, userID, exempt := g.keys(addr, username)
+	if exempt {
+		return nil
+	}
+
+	g.lck.Lock()
+	defer g.lck.Unlock()
+
+	now := g.now()
+	for _, id := range []string{ipID, userID} {
+		if id == "" {
+			continue
+		}
+		if b := g.state.Bans[id]; b != nil && b.Active(now) {
+			return ErrBanned
+		}
+	}
+	return nil
+}
+
+// Failure records the authentication failure and returns the delay the
+// caller should wait before replying to the client.
+//
+// Failures of exempt clients are not counted, neither for the IP nor for
+// the username.
+func (g *Guard) Failure(addr net.Addr, username string) time.Duration {
+	ipID, userID, exempt := g.keys(addr, username)
+	if exempt {
+		return 0
+	}
+
+	g.lck.Lock()
+	defer g.lck.Unlock()
+
+	now := g.now()
+	maxFailures := 0
+	for _, id := range []string{ipID, userID} {
+		if id == "" {
+			continue
+		}
+		failures := append(pruneFailures(g.failures[id], now.Add(-g.window)), now)
+		g.failures[id] = failures
+
+		threshold := g.ipThreshold
+		if id == userID {
+			threshold = g.userThreshold
+		}
+		if len(failures) >= threshold {
+			g.ban(id, now)
+			delete(g.failures, id)
+		}
+		if len(failures) > maxFailures {
+			maxFailures = len(failures)
+		}
+	}
+
+	if maxFailures == 0 || g.delay == 0 {
+		return 0
+	}
+	delay := g.delay
+	for i := 1; i < maxFailures && delay < g.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > g.maxDelay {
+		delay = g.maxDelay
+	}
+	return delay
+}
+
+// Success resets failure counters for the client after the successful
+// authentication. Bans are not affected.
+func (g *Guard) Success(addr net.Addr, username string) {
+	ipID, userID, _ := g.keys(addr, username)
+
+	g.lck.Lock()
+	defer g.lck.Unlock()
+
+	delete(g.failures, ipID)
+	delete(g.failures, userID)
+}
+
+func (g *Guard) ban(id string, now time.Time) {
+	kind, key, _ := strings.Cut(id, ":")
+
+	// The history might have been removed by 'sirrmeshd ban remove'.
+	g.syncRemoved()
+	b := g.state.Bans[id]
+	if b == nil || now.After(b.Until.Add(g.forgetAfter)) {
+		b = &Ban{Kind: kind, Key: key}
+		g.state.Bans[id] = b
+	}
+	b.Count++
+
+	banTime := g.banTime
+	for i := 1; i < b.Count && banTime < g.maxBanTime; i++ {
+		banTime *= 2
+	}
+	if banTime > g.maxBanTime {
+		banTime = g.maxBanTime
+	}
+	b.Created = now
+	b.Until = now.Add(banTime)
+
+	g.log.Msg("banned", "kind", kind, "key", key, "until", b.Until, "count", b.Count)
+	bansTotal.WithLabelValues(g.instName, kind).Inc()
+
+	g.save()
+	g.updateMetrics(now)
+}
+
+func pruneFailures(failures []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(failures) && failures[i].Before(since) {
+		i++
+	}
+	return failures[i:]
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+func (g *Guard) load() error {
+	state, err := readState(g.statePath)
+	if err != nil {
+		return err
+	}
+	g.state = state
+	g.markSynced()
+	return nil
+}
+
+func (g *Guard) markSynced() {
+	g.synced = make(map[string]time.Time, len(g.state.Bans))
+	for id, b := range g.state.Bans {
+		g.synced[id] = b.Created
+	}
+}
+
+// syncRemoved drops bans removed from the state file by 'sirrmeshd ban
+// remove' since it was last read or written. Bans issued or extended
+// since then are kept. lck should be held.
+func (g *Guard) syncRemoved() {
+	onDisk, err := readState(g.statePath)
+	if err != nil {
+		g.log.Error("failed to reload state", err, "path", g.statePath)
+		return
+	}
+	for id, created := range g.synced {
+		if _, ok := onDisk.Bans[id]; ok {
+			continue
+		}
+		if b := g.state.Bans[id]; b != nil && b.Created.Equal(created) {
+			g.log.Msg("ban removed", "kind", b.Kind, "key", b.Key)
+			delete(g.state.Bans, id)
+		}
+		delete(g.synced, id)
+	}
+}
+
+// save writes the state file, lck should be held.
+//
+// Bans removed from the file in the meantime are not written back.
+func (g *Guard) save() {
+	g.syncRemoved()
+	if err := writeState(g.statePath, g.state); err != nil {
+		g.log.Error("failed to save state", err, "path", g.statePath)
+		return
+	}
+	g.markSynced()
+}
+
+// maintain drops expired failures and ban history and picks up bans removed
+// by 'sirrmeshd ban remove'.
+func (g *Guard) maintain(now time.Time) {
+	g.lck.Lock()
+	defer g.lck.Unlock()
+
+	g.syncRemoved()
+
+	for id, failures := range g.failures {
+		failures = pruneFailures(failures, now.Add(-g.window))
+		if len(failures) == 0 {
+			delete(g.failures, id)
+			continue
+		}
+		g.failures[id] = failures
+	}
+
+	dirty := false
+	for id, b := range g.state.Bans {
+		if now.After(b.Until.Add(g.forgetAfter)) {
+			delete(g.state.Bans, id)
+			dirty = true
+		}
+	}
+	if dirty {
+		g.save()
+	}
+
+	g.updateMetrics(now)
+}
+
+func (g *Guard) maintainLoop() {
+	defer close(g.done)
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during auth_guard maintenance: %v\n%s", err, stack)
+			log.Printf("auth_guard state reloading disabled due to critical error")
+		}
+	}()
+
+	t := time.NewTicker(10 * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			g.maintain(g.now())
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+func init() {
+	module.Register("auth_guard", New)
+}
@@ -0,0 +1,243 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package authguard
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+)
+
+func testGuard(t *testing.T, statePath string) *Guard {
+	return &Guard{
+		instName:      "test",
+		log:           testutils.Logger(t, "auth_guard"),
+		ipThreshold:   3,
+		userThreshold: 5,
+		window:        time.Minute,
+		banTime:       time.Hour,
+		maxBanTime:    3 * time.Hour,
+		forgetAfter:   24 * time.Hour,
+		delay:         time.Second,
+		maxDelay:      3 * time.Second,
+		exempt:        []net.IPNet{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}},
+		statePath:     statePath,
+		failures:      map[string][]time.Time{},
+		state:         &guardState{Bans: map[string]*Ban{}},
+		now:           time.Now,
+	}
+}
+
+func tcpAddr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}
+}
+
+func TestGuard_IPBan(t *testing.T) {
+	g := testGuard(t, filepath.Join(t.TempDir(), "bans.json"))
+	now := time.Now()
+	g.now = func() time.Time { return now }
+	client := tcpAddr("192.0.2.1")
+
+	for i, expectDelay := range []time.Duration{time.Second, 2 * time.Second} {
+		if err := g.Check(client, "user"+strconv.Itoa(i)); err != nil {
+			t.Fatalf("Check failed before the threshold: %v", err)
+		}
+		if delay := g.Failure(client, "user"+strconv.Itoa(i)); delay != expectDelay {
+			t.Errorf("Failure %d: delay %v, want %v", i, delay, expectDelay)
+		}
+	}
+	if delay := g.Failure(client, "user2"); delay != 3*time.Second {
+		t.Errorf("Delay is not capped: %v", delay)
+	}
+
+	if err := g.Check(client, ""); err != ErrBanned {
+		t.Fatalf("Expected ErrBanned, got %v", err)
+	}
+	if err := g.Check(tcpAddr("192.0.2.2"), "user0"); err != nil {
+		t.Fatalf("Other client is banned: %v", err)
+	}
+
+	// Ban expires, repeated ban is twice as long.
+	now = now.Add(time.Hour + time.Second)
+	if err := g.Check(client, ""); err != nil {
+		t.Fatalf("Ban is not expired: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		g.Failure(client, "")
+	}
+	b := g.state.Bans[banID(KindIP, "192.0.2.1")]
+	if b == nil || b.Count != 2 || b.Until.Sub(now) != 2*time.Hour {
+		t.Fatalf("Wrong repeated ban: %+v", b)
+	}
+
+	// History is dropped after forget_after.
+	g.maintain(now.Add(27 * time.Hour))
+	if len(g.state.Bans) != 0 {
+		t.Errorf("Expired ban is not forgotten: %+v", g.state.Bans)
+	}
+}
+
+func TestGuard_Window(t *testing.T) {
+	g := testGuard(t, filepath.Join(t.TempDir(), "bans.json"))
+	now := time.Now()
+	g.now = func() time.Time { return now }
+	client := tcpAddr("192.0.2.1")
+
+	g.Failure(client, "")
+	g.Failure(client, "")
+	now = now.Add(2 * time.Minute)
+	g.Failure(client, "")
+	if err := g.Check(client, ""); err != nil {
+		t.Fatalf("Failures outside of window are counted: %v", err)
+	}
+
+	g.Failure(client, "")
+	g.Success(client, "")
+	g.Failure(client, "")
+	if err := g.Check(client, ""); err != nil {
+		t.Fatalf("Failures are not reset on success: %v", err)
+	}
+}
+
+func TestGuard_UserBan(t *testing.T) {
+	g := testGuard(t, filepath.Join(t.TempDir(), "bans.json"))
+
+	// Distributed attack against a single account.
+	for i := 0; i < 5; i++ {
+		g.Failure(tcpAddr("192.0.2."+strconv.Itoa(i+1)), "Victim")
+	}
+	if err := g.Check(tcpAddr("198.51.100.1"), "victim"); err != ErrBanned {
+		t.Fatalf("Expected ErrBanned, got %v", err)
+	}
+	if err := g.Check(tcpAddr("198.51.100.1"), "other"); err != nil {
+		t.Fatalf("Other user is banned: %v", err)
+	}
+	if err := g.Check(tcpAddr("127.0.0.1"), "victim"); err != nil {
+		t.Fatalf("Exempt client is banned: %v", err)
+	}
+}
+
+func TestGuard_Exempt(t *testing.T) {
+	g := testGuard(t, filepath.Join(t.TempDir(), "bans.json"))
+	client := tcpAddr("127.0.0.1")
+
+	for i := 0; i < 10; i++ {
+		if delay := g.Failure(client, "user"); delay != 0 {
+			t.Fatalf("Exempt client is delayed: %v", delay)
+		}
+	}
+	if err := g.Check(client, ""); err != nil {
+		t.Fatalf("Exempt client is banned: %v", err)
+	}
+	// Failures of exempt clients are not counted for the username either.
+	if err := g.Check(tcpAddr("192.0.2.1"), "user"); err != nil {
+		t.Fatalf("Username is banned due to exempt client failures: %v", err)
+	}
+}
+
+func TestGuard_IPv6Network(t *testing.T) {
+	g := testGuard(t, filepath.Join(t.TempDir(), "bans.json"))
+
+	for i := 0; i < 3; i++ {
+		g.Failure(tcpAddr("2001:db8::"+strconv.Itoa(i+1)), "")
+	}
+	if err := g.Check(tcpAddr("2001:db8::ffff"), ""); err != ErrBanned {
+		t.Fatalf("Expected ErrBanned for the same /64, got %v", err)
+	}
+	if err := g.Check(tcpAddr("2001:db8:0:1::1"), ""); err != nil {
+		t.Fatalf("Other /64 is banned: %v", err)
+	}
+}
+
+func TestGuard_Persistence(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "bans.json")
+	g := testGuard(t, statePath)
+	for i := 0; i < 3; i++ {
+		g.Failure(tcpAddr("192.0.2.1"), "")
+		g.Failure(tcpAddr("2001:db8::1"), "")
+	}
+
+	bans, err := ReadBans(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 2 {
+		t.Fatalf("Expected 2 saved bans, got %+v", bans)
+	}
+
+	// Restart.
+	g2 := testGuard(t, statePath)
+	if err := g2.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g2.Check(tcpAddr("192.0.2.1"), ""); err != ErrBanned {
+		t.Fatalf("Ban is not restored: %v", err)
+	}
+
+	// Removal using the CLI is picked up by the running server.
+	for _, key := range []string{"192.0.2.1", "2001:db8::1"} {
+		removed, err := RemoveBan(statePath, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !removed {
+			t.Errorf("Ban for %s is not removed", key)
+		}
+	}
+	if removed, _ := RemoveBan(statePath, "192.0.2.1"); removed {
+		t.Error("Non-existent ban removed")
+	}
+	g2.maintain(time.Now())
+	if err := g2.Check(tcpAddr("192.0.2.1"), ""); err != nil {
+		t.Fatalf("Removed ban is still active: %v", err)
+	}
+	if err := g2.Check(tcpAddr("2001:db8::1"), ""); err != nil {
+		t.Fatalf("Removed ban is still active: %v", err)
+	}
+}
+
+func TestGuard_RemoveBeforeSave(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "bans.json")
+	g := testGuard(t, statePath)
+	for i := 0; i < 3; i++ {
+		g.Failure(tcpAddr("192.0.2.1"), "")
+	}
+	if removed, err := RemoveBan(statePath, "192.0.2.1"); err != nil || !removed {
+		t.Fatal("RemoveBan:", removed, err)
+	}
+
+	// Another ban is saved before the removal is picked up by maintain.
+	for i := 0; i < 3; i++ {
+		g.Failure(tcpAddr("192.0.2.2"), "")
+	}
+	bans, err := ReadBans(statePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].Key != "192.0.2.2" {
+		t.Fatalf("Removed ban is written back: %+v", bans)
+	}
+	if err := g.Check(tcpAddr("192.0.2.1"), ""); err != nil {
+		t.Fatalf("Removed ban is still active: %v", err)
+	}
+}
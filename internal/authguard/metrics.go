@@ -0,0 +1,64 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package authguard
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	activeBans = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "auth_guard",
+			Name:      "active_bans",
+			Help:      "Amount of currently banned IPs and usernames",
+		},
+		[]string{"module", "kind"},
+	)
+	bansTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "auth_guard",
+			Name:      "bans",
+			Help:      "Amount of bans issued due to authentication failures",
+		},
+		[]string{"module", "kind"},
+	)
+)
+
+// updateMetrics sets the active bans gauge, lck should be held.
+func (g *Guard) updateMetrics(now time.Time) {
+	counts := map[string]int{KindIP: 0, KindUser: 0}
+	for _, b := range g.state.Bans {
+		if b.Active(now) {
+			counts[b.Kind]++
+		}
+	}
+	for kind, count := range counts {
+		activeBans.WithLabelValues(g.instName, kind).Set(float64(count))
+	}
+}
+
+func init() {
+	prometheus.MustRegister(activeBans)
+	prometheus.MustRegister(bansTotal)
+}
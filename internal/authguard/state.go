@@ -0,0 +1,162 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package authguard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Ban kinds.
+const (
+	KindIP   = "ip"
+	KindUser = "user"
+)
+
+// Ban is a temporary ban of a client IP address (network for IPv6) or a
+// username.
+//
+// Expired bans are kept in the state file for forget_after so the ban time
+// is increased if the client continues.
+type Ban struct {
+	Kind    string    `json:"kind"`
+	Key     string    `json:"key"`
+	Count   int       `json:"count"`
+	Created time.Time `json:"created"`
+	Until   time.Time `json:"until"`
+}
+
+func (b Ban) Active(now time.Time) bool {
+	return now.Before(b.Until)
+}
+
+type guardState struct {
+	Bans map[string]*Ban `json:"bans"`
+}
+
+func banID(kind, key string) string {
+	return kind + ":" + key
+}
+
+// DefaultStatePath returns the state file location used if the state_file
+// directive is not specified.
+func DefaultStatePath(stateDir string) string {
+	return filepath.Join(stateDir, "auth_guard", "bans.json")
+}
+
+func readState(path string) (*guardState, error) {
+	state := &guardState{Bans: map[string]*Ban{}}
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return state, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(blob, state); err != nil {
+		return nil, fmt.Errorf("auth_guard: %s: %w", path, err)
+	}
+	if state.Bans == nil {
+		state.Bans = map[string]*Ban{}
+	}
+	return state, nil
+}
+
+func writeState(path string, state *guardState) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	blob, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, blob, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ReadBans returns bans active at the moment from the state file.
+func ReadBans(path string) ([]Ban, error) {
+	state, err := readState(path)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	bans := make([]Ban, 0, len(state.Bans))
+	for _, b := range state.Bans {
+		if b.Active(now) {
+			bans = append(bans, *b)
+		}
+	}
+	return bans, nil
+}
+
+// RemoveBan removes the ban for the IP address or username from the state
+// file, including its history. Running server picks up the change within
+// a few seconds.
+//
+// It returns false if there is no such ban.
+func RemoveBan(path, key string) (bool, error) {
+	state, err := readState(path)
+	if err != nil {
+		return false, err
+	}
+
+	ip := net.ParseIP(key)
+	if ip == nil {
+		ip, _, _ = net.ParseCIDR(key)
+	}
+
+	removed := false
+	for _, id := range []string{banID(KindIP, ipKey(ip)), banID(KindUser, userKey(key))} {
+		if _, ok := state.Bans[id]; ok {
+			delete(state.Bans, id)
+			removed = true
+		}
+	}
+	if !removed {
+		return false, nil
+	}
+	return true, writeState(path, state)
+}
+
+// ipKey returns the key used to track failures from the address. IPv6
+// clients usually control the whole /64 so it is tracked as one.
+func ipKey(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+func userKey(username string) string {
+	return strings.ToLower(username)
+}
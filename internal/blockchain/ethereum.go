@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
@@ -59,10 +60,32 @@ func (b *EVMBlockChain) SendRawTx(ctx context.Context, rawTx string) error {
 		return err
 	}
 	defer client.Close()
+	start := time.Now()
 	err = client.Client().CallContext(ctx, nil, "eth_sendRawTransaction", rawTx)
+	observeRPC(b.instName, "eth_sendRawTransaction", start, err)
 	return err
 }
 
+// CheckHealth verifies that the RPC node is reachable and serves the
+// configured chain.
+func (b *EVMBlockChain) CheckHealth(ctx context.Context) error {
+	client, err := ethclient.DialContext(ctx, b.rpcURL)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	start := time.Now()
+	chainID, err := client.ChainID(ctx)
+	observeRPC(b.instName, "eth_chainId", start, err)
+	if err != nil {
+		return err
+	}
+	if chainID.Int64() != b.chainID {
+		return fmt.Errorf("RPC node serves chain %v, expected %v", chainID, b.chainID)
+	}
+	return nil
+}
+
 func (b *EVMBlockChain) CheckSign(ctx context.Context, pk, sign, message string) (bool, error) {
 	return verifySignature(message, sign, pk)
 }
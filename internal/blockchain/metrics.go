@@ -0,0 +1,43 @@
+package blockchain
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	rpcCalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "blockchain",
+			Name:      "rpc_calls_total",
+			Help:      "JSON-RPC calls to the blockchain node by method and result (ok or error)",
+		},
+		[]string{"module", "method", "result"},
+	)
+	rpcDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "blockchain",
+			Name:      "rpc_duration_seconds",
+			Help:      "Time taken by JSON-RPC calls to the blockchain node",
+			Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"module", "method"},
+	)
+)
+
+func observeRPC(instName, method string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	rpcCalls.WithLabelValues(instName, method, result).Inc()
+	rpcDuration.WithLabelValues(instName, method).Observe(time.Since(start).Seconds())
+}
+
+func init() {
+	prometheus.MustRegister(rpcCalls)
+	prometheus.MustRegister(rpcDuration)
+}
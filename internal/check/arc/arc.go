@@ -0,0 +1,206 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package arc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime/trace"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/sirrchat/SirrMesh/framework/buffer"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	modconfig "github.com/sirrchat/SirrMesh/framework/config/module"
+	"github.com/sirrchat/SirrMesh/framework/dns"
+	"github.com/sirrchat/SirrMesh/framework/exterrors"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/arc"
+	"github.com/sirrchat/SirrMesh/internal/target"
+)
+
+type Check struct {
+	instName string
+	log      log.Logger
+
+	trustedSealers    map[string]struct{}
+	brokenChainAction modconfig.FailAction
+	failOpen          bool
+
+	resolver dns.Resolver
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("check.arc: inline arguments are not used")
+	}
+	return &Check{
+		instName: instName,
+		log:      log.Logger{Name: "check.arc"},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (c *Check) Init(cfg *config.Map) error {
+	var trustedSealers []string
+
+	cfg.Logger(true, false, &c.log)
+	cfg.StringList("trusted_sealers", false, false, nil, &trustedSealers)
+	cfg.Bool("fail_open", false, false, &c.failOpen)
+	cfg.Custom("broken_chain_action", false, false,
+		func() (interface{}, error) {
+			return modconfig.FailAction{}, nil
+		}, modconfig.FailActionDirective, &c.brokenChainAction)
+	_, err := cfg.Process()
+	if err != nil {
+		return err
+	}
+
+	c.trustedSealers = make(map[string]struct{}, len(trustedSealers))
+	for _, sealer := range trustedSealers {
+		c.trustedSealers[strings.ToLower(strings.TrimSuffix(sealer, "."))] = struct{}{}
+	}
+
+	return nil
+}
+
+func (c *Check) Name() string {
+	return "check.arc"
+}
+
+func (c *Check) InstanceName() string {
+	return c.instName
+}
+
+type arcCheckState struct {
+	c       *Check
+	msgMeta *module.MsgMetadata
+	log     log.Logger
+}
+
+func (a *arcCheckState) CheckConnection(ctx context.Context) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (a *arcCheckState) CheckSender(ctx context.Context, mailFrom string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (a *arcCheckState) CheckRcpt(ctx context.Context, rcptTo string) module.CheckResult {
+	return module.CheckResult{}
+}
+
+func (a *arcCheckState) CheckBody(ctx context.Context, header textproto.Header, body buffer.Buffer) module.CheckResult {
+	defer trace.StartRegion(ctx, "check.arc/CheckBody").End()
+
+	if !header.Has("ARC-Seal") && !header.Has("ARC-Message-Signature") {
+		a.log.Debugf("no ARC sets present")
+		return module.CheckResult{
+			AuthResult: []authres.Result{a.authResult(&arc.Result{Value: authres.ResultNone})},
+		}
+	}
+
+	res := arc.Verify(ctx, a.c.resolver.LookupTXT, header, body)
+	switch res.Value {
+	case authres.ResultPass:
+		a.log.DebugMsg("chain validated", "sets", len(res.Sets), "sealer", res.Latest().Sealer())
+	case authres.ResultTempError:
+		if !a.c.failOpen {
+			return module.CheckResult{
+				Reject: true,
+				Reason: &exterrors.SMTPError{
+					Code:         421,
+					EnhancedCode: exterrors.EnhancedCode{4, 7, 29},
+					Message:      "Temporary error during ARC validation",
+					CheckName:    "check.arc",
+					Err:          res.Err,
+				},
+			}
+		}
+	}
+
+	checkRes := module.CheckResult{
+		AuthResult: []authres.Result{a.authResult(res)},
+	}
+	if res.Value != authres.ResultPass {
+		a.log.Msg("broken chain", "reason", res.Reason, "err", res.Err)
+		checkRes.Reason = &exterrors.SMTPError{
+			Code:         550,
+			EnhancedCode: exterrors.EnhancedCode{5, 7, 29},
+			Message:      "ARC chain validation failed",
+			CheckName:    "check.arc",
+			Err:          res.Err,
+		}
+		return a.c.brokenChainAction.Apply(checkRes)
+	}
+
+	sealer := strings.ToLower(res.Latest().Sealer())
+	if _, ok := a.c.trustedSealers[sealer]; ok {
+		_, results, err := res.Latest().AuthResults()
+		if err != nil {
+			a.log.Error("malformed ARC-Authentication-Results from trusted sealer", err, "sealer", sealer)
+		} else {
+			checkRes.ARCSealer = sealer
+			checkRes.ARCAuthResult = results
+		}
+	}
+
+	return checkRes
+}
+
+func (a *arcCheckState) authResult(res *arc.Result) authres.Result {
+	params := map[string]string{}
+	if a.msgMeta.Conn != nil {
+		if tcpAddr, ok := a.msgMeta.Conn.RemoteAddr.(*net.TCPAddr); ok {
+			params["smtp.remote-ip"] = tcpAddr.IP.String()
+		}
+	}
+	if res.Value == authres.ResultPass && res.OldestPass != 0 {
+		params["header.oldest-pass"] = strconv.Itoa(res.OldestPass)
+	}
+	return &authres.GenericResult{
+		Method: "arc",
+		Value:  res.Value,
+		Params: params,
+	}
+}
+
+func (a *arcCheckState) Name() string {
+	return "check.arc"
+}
+
+func (a *arcCheckState) Close() error {
+	return nil
+}
+
+func (c *Check) CheckStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.CheckState, error) {
+	return &arcCheckState{
+		c:       c,
+		msgMeta: msgMeta,
+		log:     target.DeliveryLogger(c.log, msgMeta),
+	}, nil
+}
+
+func init() {
+	module.Register("check.arc", New)
+}
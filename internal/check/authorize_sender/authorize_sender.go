@@ -67,7 +67,7 @@ func (c *Check) InstanceName() string {
 }
 
 func (c *Check) Init(cfg *config.Map) error {
-	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Logger(true, false, &c.log)
 
 	cfg.Bool("check_header", false, true, &c.checkHeader)
 
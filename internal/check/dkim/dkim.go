@@ -66,7 +66,7 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 func (c *Check) Init(cfg *config.Map) error {
 	var requiredFields []string
 
-	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Logger(true, false, &c.log)
 	cfg.StringList("required_fields", false, false, []string{"From", "Subject"}, &requiredFields)
 	cfg.Bool("fail_open", false, false, &c.failOpen)
 	cfg.Custom("broken_sig_action", false, false,
@@ -87,7 +87,7 @@ func (bl *DNSBL) InstanceName() string {
 }
 
 func (bl *DNSBL) Init(cfg *config.Map) error {
-	cfg.Bool("debug", false, false, &bl.log.Debug)
+	cfg.Logger(false, false, &bl.log)
 	cfg.Bool("check_early", false, false, &bl.checkEarly)
 	cfg.Int("quarantine_threshold", false, false, 1, &bl.quarantineThres)
 	cfg.Int("reject_threshold", false, false, 9999, &bl.rejectThres)
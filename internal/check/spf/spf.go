@@ -77,7 +77,7 @@ func (c *Check) InstanceName() string {
 }
 
 func (c *Check) Init(cfg *config.Map) error {
-	cfg.Bool("debug", true, false, &c.log.Debug)
+	cfg.Logger(true, false, &c.log)
 	cfg.Bool("enforce_early", true, false, &c.enforceEarly)
 	cfg.Custom("none_action", false, false,
 		func() (interface{}, error) {
@@ -107,6 +107,22 @@ type EvalResult struct {
 	// Whether there is a DKIM signature with the d= field matching the
 	// RFC5322.From domain.
 	DKIMAligned bool
+
+	// Whether the policy was not applied because the message authenticated
+	// using the results recorded by a trusted ARC sealer.
+	ARCOverride bool
+
+	// The domain of the trusted ARC sealer if ARCOverride is set.
+	ARCSealer string
+
+	// Whether the policy was not applied because of the pct= tag.
+	SampledOut bool
+
+	// The domain the policy record was found for and the record itself.
+	// Set by Verifier.Apply if the record is present, used for aggregate
+	// reports generation.
+	PolicyDomain string
+	Record       *Record
 }
 
 // EvaluateAlignment checks whether identifiers authenticated by SPF and DKIM are in alignment
@@ -0,0 +1,260 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package report
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/sirrchat/SirrMesh/internal/dmarc"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+)
+
+func testEntry(ip string, dkim authres.ResultValue, rua ...string) Entry {
+	return NewEntry(net.ParseIP(ip), "bounce@example.org", []authres.Result{
+		&authres.DKIMResult{Value: dkim, Domain: "example.org"},
+		&authres.SPFResult{Value: authres.ResultPass, From: "example.org"},
+	}, dmarc.EvalResult{
+		Authres:      authres.DMARCResult{Value: authres.ResultPass, From: "example.org"},
+		DKIMAligned:  dkim == authres.ResultPass,
+		SPFAligned:   true,
+		PolicyDomain: "example.org",
+		Record: &dmarc.Record{
+			Policy:             dmarc.PolicyReject,
+			ReportURIAggregate: rua,
+		},
+	}, dmarc.PolicyNone)
+}
+
+func TestBuild(t *testing.T) {
+	entries := []Entry{
+		testEntry("192.0.2.1", authres.ResultPass),
+		testEntry("192.0.2.1", authres.ResultPass),
+		testEntry("192.0.2.2", authres.ResultFail),
+		testEntry("192.0.2.1", authres.ResultPass),
+	}
+	fb := Build(Metadata{OrgName: "Test", Email: "postmaster@example.net", ReportID: "1"}, entries)
+
+	if fb.PolicyPublished.Domain != "example.org" || fb.PolicyPublished.P != "reject" || fb.PolicyPublished.Pct != 100 {
+		t.Errorf("Wrong published policy: %+v", fb.PolicyPublished)
+	}
+	if len(fb.Records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(fb.Records))
+	}
+	if fb.Records[0].Row.SourceIP != "192.0.2.1" || fb.Records[0].Row.Count != 3 {
+		t.Errorf("Wrong first record: %+v", fb.Records[0].Row)
+	}
+	if fb.Records[1].Row.PolicyEvaluated.DKIM != "fail" || fb.Records[1].Row.Count != 1 {
+		t.Errorf("Wrong second record: %+v", fb.Records[1].Row)
+	}
+	if fb.Records[0].Identifiers.EnvelopeFrom != "example.org" {
+		t.Errorf("Wrong envelope_from: %s", fb.Records[0].Identifiers.EnvelopeFrom)
+	}
+
+	blob, err := fb.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed Feedback
+	if err := xml.Unmarshal(blob, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed.Records) != 2 || parsed.Metadata.OrgName != "Test" {
+		t.Errorf("Report does not survive serialization: %+v", parsed)
+	}
+}
+
+func TestParseReportURI(t *testing.T) {
+	test := func(uri, addr string, size int64, fail bool) {
+		t.Helper()
+		gotAddr, gotSize, err := parseReportURI(uri)
+		if fail {
+			if err == nil {
+				t.Errorf("%s: expected an error", uri)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", uri, err)
+			return
+		}
+		if gotAddr != addr || gotSize != size {
+			t.Errorf("%s: got %s %d, want %s %d", uri, gotAddr, gotSize, addr, size)
+		}
+	}
+
+	test("mailto:dmarc@example.org", "dmarc@example.org", 0, false)
+	test("mailto:dmarc@example.org!10m", "dmarc@example.org", 10<<20, false)
+	test("mailto:dmarc@example.org!512", "dmarc@example.org", 512, false)
+	test("mailto:dmarc%2Brua@example.org", "dmarc+rua@example.org", 0, false)
+	test("https://example.org/dmarc", "", 0, true)
+	test("mailto:dmarc@example.org!xm", "", 0, true)
+}
+
+func TestStore(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := store.Add(testEntry("192.0.2.1", authres.ResultPass)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	domains, err := store.Domains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0] != "example.org" {
+		t.Fatalf("Wrong domains: %v", domains)
+	}
+
+	batch, err := store.Take("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(batch.Entries))
+	}
+	entries, err := store.Read("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expected no entries after Take, got %d", len(entries))
+	}
+
+	e := testEntry("192.0.2.1", authres.ResultPass)
+	e.Policy.Domain = "../example.org"
+	if err := store.Add(e); err == nil {
+		t.Fatal("Expected an error for malformed domain")
+	}
+}
+
+func TestSendDue(t *testing.T) {
+	tgt := testutils.Target{}
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Reporter{
+		log:      testutils.Logger(t, "dmarc_reports"),
+		hostname: "mx.example.net",
+		orgName:  "Example Net",
+		email:    "dmarc-noreply@example.net",
+		interval: 24 * time.Hour,
+		target:   &tgt,
+		store:    store,
+		resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"example.org._report._dmarc.reports.example.com.": {
+				TXT: []string{"v=DMARC1"},
+			},
+		}},
+	}
+
+	rua := []string{
+		"mailto:dmarc@example.org",
+		"mailto:rua@reports.example.com",
+		"mailto:rua@unauthorized.example.com",
+		"mailto:small@example.org!10",
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.Add(testEntry("192.0.2.1", authres.ResultPass, rua...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Not due yet.
+	r.SendDue(context.Background(), time.Now())
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Report sent before it is due")
+	}
+
+	// Entries are kept if delivery fails.
+	tgt.StartErr = errors.New("delivery failed")
+	r.SendDue(context.Background(), time.Now().Add(25*time.Hour))
+	tgt.StartErr = nil
+	if entries, err := store.Read("example.org"); err != nil || len(entries) != 2 {
+		t.Fatalf("Entries are lost after failed delivery: %d %v", len(entries), err)
+	}
+
+	r.SendDue(context.Background(), time.Now().Add(25*time.Hour))
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MailFrom != "dmarc-noreply@example.net" {
+		t.Errorf("Wrong MAIL FROM: %s", msg.MailFrom)
+	}
+	if len(msg.RcptTo) != 2 || msg.RcptTo[0] != "dmarc@example.org" || msg.RcptTo[1] != "rua@reports.example.com" {
+		t.Errorf("Wrong recipients: %v", msg.RcptTo)
+	}
+
+	if subject := msg.Header.Get("Subject"); !strings.HasPrefix(subject, "Report Domain: example.org Submitter: mx.example.net") {
+		t.Errorf("Wrong Subject: %s", subject)
+	}
+
+	ent, err := message.New(message.Header{Header: msg.Header}, bytes.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var xmlBlob []byte
+	err = ent.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		if ct, _, _ := part.Header.ContentType(); ct != "application/gzip" {
+			return nil
+		}
+		gzr, err := gzip.NewReader(part.Body)
+		if err != nil {
+			return err
+		}
+		xmlBlob, err = io.ReadAll(gzr)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fb Feedback
+	if err := xml.Unmarshal(xmlBlob, &fb); err != nil {
+		t.Fatal(err)
+	}
+	if len(fb.Records) != 1 || fb.Records[0].Row.Count != 2 {
+		t.Errorf("Wrong report content: %+v", fb.Records)
+	}
+
+	// Entries are removed after sending.
+	r.SendDue(context.Background(), time.Now().Add(50*time.Hour))
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Report sent twice")
+	}
+}
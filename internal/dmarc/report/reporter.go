@@ -0,0 +1,512 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package report implements DMARC aggregate reports (RFC 7489 Section 7.2).
+//
+// The message pipeline records DMARC evaluation results using
+// Reporter.Record, they are kept in the Store until the report for the policy
+// domain is due. Reports are then aggregated, gzip-compressed and sent to the
+// rua= addresses using the configured delivery target.
+package report
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-smtp"
+	"github.com/sirrchat/SirrMesh/framework/address"
+	"github.com/sirrchat/SirrMesh/framework/buffer"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	modconfig "github.com/sirrchat/SirrMesh/framework/config/module"
+	"github.com/sirrchat/SirrMesh/framework/dns"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/dmarc"
+	"github.com/sirrchat/SirrMesh/internal/reportstore"
+	"golang.org/x/net/publicsuffix"
+)
+
+type Reporter struct {
+	instName string
+	log      log.Logger
+
+	hostname         string
+	orgName          string
+	email            string
+	extraContactInfo string
+	interval         time.Duration
+	target           module.DeliveryTarget
+
+	store    *Store
+	resolver dns.Resolver
+
+	sched *reportstore.Scheduler
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("dmarc_reports: inline arguments are not used")
+	}
+	return &Reporter{
+		instName: instName,
+		log:      log.Logger{Name: "dmarc_reports"},
+		resolver: dns.DefaultResolver(),
+	}, nil
+}
+
+func (r *Reporter) Name() string {
+	return "dmarc_reports"
+}
+
+func (r *Reporter) InstanceName() string {
+	return r.instName
+}
+
+func (r *Reporter) Init(cfg *config.Map) error {
+	var storeDir string
+
+	cfg.Logger(true, false, &r.log)
+	cfg.String("hostname", true, true, "", &r.hostname)
+	cfg.String("org_name", false, true, "", &r.orgName)
+	cfg.String("email", false, true, "", &r.email)
+	cfg.String("extra_contact_info", false, false, "", &r.extraContactInfo)
+	cfg.Duration("interval", false, false, 24*time.Hour, &r.interval)
+	cfg.String("store_dir", false, false, DefaultStoreDir(config.StateDirectory), &storeDir)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &r.target)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if _, _, err := address.Split(r.email); err != nil {
+		return fmt.Errorf("dmarc_reports: invalid email: %w", err)
+	}
+	if r.interval < time.Hour {
+		return errors.New("dmarc_reports: interval should be at least 1h")
+	}
+
+	if module.DryRun {
+		return nil
+	}
+
+	var err error
+	r.store, err = NewStore(storeDir)
+	if err != nil {
+		return fmt.Errorf("dmarc_reports: %w", err)
+	}
+
+	r.sched = reportstore.StartScheduler("DMARC reports", r.interval, r.SendDue)
+	return nil
+}
+
+func (r *Reporter) Close() error {
+	r.sched.Close()
+	return nil
+}
+
+// Record saves the DMARC evaluation result for the message. Results for
+// policies without rua= addresses are ignored.
+func (r *Reporter) Record(msgMeta *module.MsgMetadata, mailFrom string, authRes []authres.Result, res dmarc.EvalResult, policy dmarc.Policy) {
+	if res.Record == nil || len(res.Record.ReportURIAggregate) == 0 {
+		return
+	}
+	if msgMeta.Conn == nil {
+		return
+	}
+	tcpAddr, ok := msgMeta.Conn.RemoteAddr.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+
+	e := NewEntry(tcpAddr.IP, mailFrom, authRes, res, policy)
+	if err := r.store.Add(e); err != nil {
+		r.log.Error("failed to record evaluation result", err, "msg_id", msgMeta.ID)
+	}
+}
+
+// NewEntry converts the DMARC evaluation result into the report entry.
+func NewEntry(sourceIP net.IP, mailFrom string, authRes []authres.Result, res dmarc.EvalResult, policy dmarc.Policy) Entry {
+	pct := 100
+	if res.Record.Percent != nil {
+		pct = *res.Record.Percent
+	}
+	alignment := func(mode dmarc.AlignmentMode) string {
+		if mode == "" {
+			return "r"
+		}
+		return string(mode)
+	}
+	passFail := func(pass bool) string {
+		if pass {
+			return "pass"
+		}
+		return "fail"
+	}
+
+	e := Entry{
+		Time:     time.Now(),
+		SourceIP: sourceIP.String(),
+		Policy: PolicyPublished{
+			Domain: res.PolicyDomain,
+			ADKIM:  alignment(res.Record.DKIMAlignment),
+			ASPF:   alignment(res.Record.SPFAlignment),
+			P:      string(res.Record.Policy),
+			SP:     string(res.Record.SubdomainPolicy),
+			Pct:    pct,
+		},
+		RUA: res.Record.ReportURIAggregate,
+		PolicyEvaluated: PolicyEvaluated{
+			Disposition: string(policy),
+			DKIM:        passFail(res.DKIMAligned),
+			SPF:         passFail(res.SPFAligned),
+		},
+		Identifiers: Identifiers{
+			HeaderFrom: res.Authres.From,
+		},
+	}
+	if e.PolicyEvaluated.Disposition == "" {
+		e.PolicyEvaluated.Disposition = string(dmarc.PolicyNone)
+	}
+	if _, domain, err := address.Split(mailFrom); err == nil {
+		e.Identifiers.EnvelopeFrom = domain
+	}
+
+	if res.SampledOut {
+		e.PolicyEvaluated.Reasons = append(e.PolicyEvaluated.Reasons, Reason{Type: ReasonSampledOut})
+	}
+	if res.ARCOverride {
+		e.PolicyEvaluated.Reasons = append(e.PolicyEvaluated.Reasons, Reason{
+			Type:    ReasonTrustedForwarder,
+			Comment: "arc=pass as.d=" + res.ARCSealer,
+		})
+	}
+
+	for _, r := range authRes {
+		switch r := r.(type) {
+		case *authres.DKIMResult:
+			e.AuthResults.DKIM = append(e.AuthResults.DKIM, DKIMAuthResult{
+				Domain: r.Domain,
+				Result: string(r.Value),
+			})
+		case *authres.SPFResult:
+			spf := SPFAuthResult{
+				Domain: r.From,
+				Scope:  "mfrom",
+				Result: string(r.Value),
+			}
+			if r.From == "" {
+				spf.Domain = r.Helo
+				spf.Scope = "helo"
+			}
+			e.AuthResults.SPF = append(e.AuthResults.SPF, spf)
+		}
+	}
+
+	return e
+}
+
+// SendDue sends reports for all policy domains that have entries older than
+// the reporting interval. Entries of reports that failed to send are kept
+// and sent on the next call.
+func (r *Reporter) SendDue(ctx context.Context, now time.Time) {
+	r.store.SendDue(ctx, r.log, now, r.interval, r.sendReport)
+}
+
+// Preview returns the report that would be sent for the domain if it was due
+// now. Pending entries are not modified.
+func Preview(store *Store, meta Metadata, domain string, now time.Time) (*Feedback, error) {
+	entries, err := store.Read(domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no pending entries for %s", domain)
+	}
+	meta.DateRange = dateRange(entries, now)
+	return Build(meta, entries), nil
+}
+
+func dateRange(entries []Entry, now time.Time) DateRange {
+	begin := now
+	for _, e := range entries {
+		if e.Time.Before(begin) {
+			begin = e.Time
+		}
+	}
+	return DateRange{Begin: begin.Unix(), End: now.Unix()}
+}
+
+func (r *Reporter) sendReport(ctx context.Context, domain string, entries []Entry, now time.Time) error {
+	defer trace.StartRegion(ctx, "dmarc_reports/sendReport").End()
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	reportID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	fb := Build(Metadata{
+		OrgName:          r.orgName,
+		Email:            r.email,
+		ExtraContactInfo: r.extraContactInfo,
+		ReportID:         reportID,
+		DateRange:        dateRange(entries, now),
+	}, entries)
+
+	xmlBlob, err := fb.Marshal()
+	if err != nil {
+		return err
+	}
+	var gzBlob bytes.Buffer
+	gzw := gzip.NewWriter(&gzBlob)
+	if _, err := gzw.Write(xmlBlob); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+
+	// Most recent entry contains the actual list of addresses.
+	rua := entries[len(entries)-1].RUA
+	rcpts := r.reportRecipients(ctx, domain, rua, int64(gzBlob.Len()))
+	if len(rcpts) == 0 {
+		r.log.Msg("no usable report addresses, discarding report", "domain", domain, "rua", rua)
+		return nil
+	}
+
+	header, body, err := r.composeMessage(fb, domain, rcpts, gzBlob.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if err := r.deliver(ctx, reportID, rcpts, header, body); err != nil {
+		return err
+	}
+	r.log.Msg("sent aggregate report", "domain", domain, "report_id", reportID, "rcpts", rcpts, "records", len(fb.Records))
+	return nil
+}
+
+// parseReportURI parses the mailto: URI with the optional size limit
+// (RFC 7489 Section 6.2).
+func parseReportURI(uri string) (addr string, maxSize int64, err error) {
+	uri = strings.TrimSpace(uri)
+	if idx := strings.LastIndexByte(uri, '!'); idx != -1 {
+		sizeStr := uri[idx+1:]
+		uri = uri[:idx]
+
+		mult := int64(1)
+		if len(sizeStr) != 0 {
+			switch sizeStr[len(sizeStr)-1] {
+			case 'k':
+				mult = 1 << 10
+			case 'm':
+				mult = 1 << 20
+			case 'g':
+				mult = 1 << 30
+			case 't':
+				mult = 1 << 40
+			}
+			if mult != 1 {
+				sizeStr = sizeStr[:len(sizeStr)-1]
+			}
+		}
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil {
+			return "", 0, fmt.Errorf("malformed size limit: %s", sizeStr)
+		}
+		maxSize = size * mult
+	}
+
+	if !strings.HasPrefix(strings.ToLower(uri), "mailto:") {
+		return "", 0, fmt.Errorf("unsupported URI scheme: %s", uri)
+	}
+	addr, err = url.PathUnescape(uri[len("mailto:"):])
+	if err != nil {
+		return "", 0, err
+	}
+	if _, _, err := address.Split(addr); err != nil {
+		return "", 0, err
+	}
+	return addr, maxSize, nil
+}
+
+// reportRecipients returns the list of addresses the report can be sent to.
+func (r *Reporter) reportRecipients(ctx context.Context, policyDomain string, rua []string, reportSize int64) []string {
+	var rcpts []string
+	for _, uri := range rua {
+		addr, maxSize, err := parseReportURI(uri)
+		if err != nil {
+			r.log.Msg("ignoring report URI", "domain", policyDomain, "uri", uri, "reason", err)
+			continue
+		}
+		if maxSize != 0 && reportSize > maxSize {
+			r.log.Msg("report is too big for the URI", "domain", policyDomain, "uri", uri)
+			continue
+		}
+
+		_, rcptDomain, _ := address.Split(addr)
+		ok, err := r.verifyExternalDest(ctx, policyDomain, rcptDomain)
+		if err != nil {
+			r.log.Error("failed to verify external report destination", err, "domain", policyDomain, "uri", uri)
+			continue
+		}
+		if !ok {
+			r.log.Msg("external report destination is not authorized", "domain", policyDomain, "uri", uri)
+			continue
+		}
+		rcpts = append(rcpts, addr)
+	}
+	return rcpts
+}
+
+// verifyExternalDest implements the check from RFC 7489 Section 7.1.
+func (r *Reporter) verifyExternalDest(ctx context.Context, policyDomain, rcptDomain string) (bool, error) {
+	policyOrg, err := publicsuffix.EffectiveTLDPlusOne(policyDomain)
+	if err != nil {
+		policyOrg = policyDomain
+	}
+	rcptOrg, err := publicsuffix.EffectiveTLDPlusOne(rcptDomain)
+	if err != nil {
+		rcptOrg = rcptDomain
+	}
+	if strings.EqualFold(policyOrg, rcptOrg) {
+		return true, nil
+	}
+
+	txts, err := r.resolver.LookupTXT(ctx, policyDomain+"._report._dmarc."+rcptDomain+".")
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=DMARC1") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *Reporter) composeMessage(fb *Feedback, domain string, rcpts []string, gzBlob []byte) (textproto.Header, buffer.Buffer, error) {
+	filename := fmt.Sprintf("%s!%s!%d!%d!%s.xml.gz", r.hostname, domain,
+		fb.Metadata.DateRange.Begin, fb.Metadata.DateRange.End, fb.Metadata.ReportID)
+
+	var h message.Header
+	h.Set("From", r.email)
+	h.Set("To", strings.Join(rcpts, ", "))
+	h.Set("Subject", fmt.Sprintf("Report Domain: %s Submitter: %s Report-ID: <%s>", domain, r.hostname, fb.Metadata.ReportID))
+	h.Set("Date", time.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	h.Set("Message-Id", "<"+fb.Metadata.ReportID+"@"+r.hostname+">")
+	h.Set("MIME-Version", "1.0")
+	h.SetContentType("multipart/mixed", nil)
+
+	var msg bytes.Buffer
+	mw, err := message.CreateWriter(&msg, h)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	var textH message.Header
+	textH.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+	pw, err := mw.CreatePart(textH)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	fmt.Fprintf(pw, "This is an aggregate DMARC report for %s generated by %s.\r\n"+
+		"It covers %s to %s.\r\n", domain, r.hostname,
+		time.Unix(fb.Metadata.DateRange.Begin, 0).UTC().Format(time.RFC3339),
+		time.Unix(fb.Metadata.DateRange.End, 0).UTC().Format(time.RFC3339))
+	pw.Close()
+
+	var attachH message.Header
+	attachH.SetContentType("application/gzip", nil)
+	attachH.SetContentDisposition("attachment", map[string]string{"filename": filename})
+	attachH.Set("Content-Transfer-Encoding", "base64")
+	pw, err = mw.CreatePart(attachH)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	if _, err := pw.Write(gzBlob); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	pw.Close()
+	if err := mw.Close(); err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	br := bufio.NewReader(&msg)
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	return header, buffer.MemoryBuffer{Slice: body}, nil
+}
+
+func (r *Reporter) deliver(ctx context.Context, reportID string, rcpts []string, header textproto.Header, body buffer.Buffer) (err error) {
+	msgMeta := &module.MsgMetadata{
+		ID:       reportID,
+		SMTPOpts: smtp.MailOptions{},
+	}
+
+	delivery, err := r.target.Start(ctx, msgMeta, r.email)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if err := delivery.Abort(ctx); err != nil {
+				r.log.Error("failed to abort report delivery", err, "report_id", reportID)
+			}
+		}
+	}()
+
+	for _, rcpt := range rcpts {
+		if err = delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			return err
+		}
+	}
+	if err = delivery.Body(ctx, header, body); err != nil {
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func init() {
+	module.Register("dmarc_reports", New)
+}
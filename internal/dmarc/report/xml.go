@@ -0,0 +1,195 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package report
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"sort"
+	"time"
+)
+
+// The structures below follow the XML schema from RFC 7489 Appendix C.
+
+type Feedback struct {
+	XMLName         xml.Name        `xml:"feedback"`
+	Metadata        Metadata        `xml:"report_metadata"`
+	PolicyPublished PolicyPublished `xml:"policy_published"`
+	Records         []Record        `xml:"record"`
+}
+
+type Metadata struct {
+	OrgName          string    `xml:"org_name"`
+	Email            string    `xml:"email"`
+	ExtraContactInfo string    `xml:"extra_contact_info,omitempty"`
+	ReportID         string    `xml:"report_id"`
+	DateRange        DateRange `xml:"date_range"`
+}
+
+type DateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+type PolicyPublished struct {
+	Domain string `xml:"domain" json:"domain"`
+	ADKIM  string `xml:"adkim,omitempty" json:"adkim,omitempty"`
+	ASPF   string `xml:"aspf,omitempty" json:"aspf,omitempty"`
+	P      string `xml:"p" json:"p"`
+	SP     string `xml:"sp,omitempty" json:"sp,omitempty"`
+	Pct    int    `xml:"pct" json:"pct"`
+}
+
+type Record struct {
+	Row         Row         `xml:"row"`
+	Identifiers Identifiers `xml:"identifiers"`
+	AuthResults AuthResults `xml:"auth_results"`
+}
+
+type Row struct {
+	SourceIP        string          `xml:"source_ip"`
+	Count           int             `xml:"count"`
+	PolicyEvaluated PolicyEvaluated `xml:"policy_evaluated"`
+}
+
+type PolicyEvaluated struct {
+	Disposition string   `xml:"disposition" json:"disposition"`
+	DKIM        string   `xml:"dkim" json:"dkim"`
+	SPF         string   `xml:"spf" json:"spf"`
+	Reasons     []Reason `xml:"reason,omitempty" json:"reasons,omitempty"`
+}
+
+// Reason types defined by RFC 7489 (PolicyOverrideType).
+const (
+	ReasonForwarded        = "forwarded"
+	ReasonSampledOut       = "sampled_out"
+	ReasonTrustedForwarder = "trusted_forwarder"
+	ReasonMailingList      = "mailing_list"
+	ReasonLocalPolicy      = "local_policy"
+	ReasonOther            = "other"
+)
+
+type Reason struct {
+	Type    string `xml:"type" json:"type"`
+	Comment string `xml:"comment,omitempty" json:"comment,omitempty"`
+}
+
+type Identifiers struct {
+	EnvelopeFrom string `xml:"envelope_from,omitempty" json:"envelope_from,omitempty"`
+	HeaderFrom   string `xml:"header_from" json:"header_from"`
+}
+
+type AuthResults struct {
+	DKIM []DKIMAuthResult `xml:"dkim,omitempty" json:"dkim,omitempty"`
+	SPF  []SPFAuthResult  `xml:"spf" json:"spf"`
+}
+
+type DKIMAuthResult struct {
+	Domain   string `xml:"domain" json:"domain"`
+	Selector string `xml:"selector,omitempty" json:"selector,omitempty"`
+	Result   string `xml:"result" json:"result"`
+}
+
+type SPFAuthResult struct {
+	Domain string `xml:"domain" json:"domain"`
+	Scope  string `xml:"scope,omitempty" json:"scope,omitempty"`
+	Result string `xml:"result" json:"result"`
+}
+
+// Entry is a single DMARC evaluation result recorded by the message
+// pipeline.
+type Entry struct {
+	Time            time.Time       `json:"time"`
+	SourceIP        string          `json:"source_ip"`
+	Policy          PolicyPublished `json:"policy"`
+	RUA             []string        `json:"rua"`
+	PolicyEvaluated PolicyEvaluated `json:"evaluated"`
+	Identifiers     Identifiers     `json:"identifiers"`
+	AuthResults     AuthResults     `json:"auth_results"`
+}
+
+// Build aggregates entries into the report. All entries are expected to
+// belong to the same policy domain.
+//
+// The published policy is taken from the most recent entry.
+func Build(meta Metadata, entries []Entry) *Feedback {
+	fb := &Feedback{Metadata: meta}
+	if len(entries) == 0 {
+		return fb
+	}
+
+	type rowKey struct {
+		sourceIP    string
+		evaluated   string
+		identifiers Identifiers
+		authResults string
+	}
+	var (
+		records = make(map[rowKey]*Record)
+		order   []rowKey
+		latest  time.Time
+	)
+	for _, e := range entries {
+		if !e.Time.Before(latest) {
+			latest = e.Time
+			fb.PolicyPublished = e.Policy
+		}
+
+		evaluated, _ := json.Marshal(e.PolicyEvaluated)
+		authRes, _ := json.Marshal(e.AuthResults)
+		key := rowKey{
+			sourceIP:    e.SourceIP,
+			evaluated:   string(evaluated),
+			identifiers: e.Identifiers,
+			authResults: string(authRes),
+		}
+		rec := records[key]
+		if rec == nil {
+			rec = &Record{
+				Row: Row{
+					SourceIP:        e.SourceIP,
+					PolicyEvaluated: e.PolicyEvaluated,
+				},
+				Identifiers: e.Identifiers,
+				AuthResults: e.AuthResults,
+			}
+			records[key] = rec
+			order = append(order, key)
+		}
+		rec.Row.Count++
+	}
+
+	fb.Records = make([]Record, 0, len(order))
+	for _, key := range order {
+		fb.Records = append(fb.Records, *records[key])
+	}
+	sort.SliceStable(fb.Records, func(i, j int) bool {
+		return fb.Records[i].Row.Count > fb.Records[j].Row.Count
+	})
+	return fb
+}
+
+// Marshal returns the report serialized as XML document.
+func (fb *Feedback) Marshal() ([]byte, error) {
+	blob, err := xml.MarshalIndent(fb, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(blob, '\n')...), nil
+}
@@ -127,6 +127,16 @@ func (v *Verifier) FetchRecord(ctx context.Context, header textproto.Header) {
 // Additionally, it relies on the math/rand default source to be initialized to determine
 // whether to apply a policy with the pct key.
 func (v *Verifier) Apply(authRes []authres.Result) (EvalResult, Policy) {
+	return v.ApplyWithARC(authRes, "", nil)
+}
+
+// ApplyWithARC is similar to Apply, but additionally considers the results
+// recorded in the ARC-Authentication-Results field by a trusted ARC sealer.
+//
+// If the message fails the DMARC check on its own, but is aligned according to
+// the arcRes, the local policy override is applied (RFC 7489 Section 6.7) and
+// PolicyNone is returned. The DMARC result itself is still fail.
+func (v *Verifier) ApplyWithARC(authRes []authres.Result, arcSealer string, arcRes []authres.Result) (EvalResult, Policy) {
 	data := <-v.fetchCh
 	if data.recordErr != nil {
 		result := authres.DMARCResult{
@@ -157,11 +167,24 @@ func (v *Verifier) Apply(authRes []authres.Result) (EvalResult, Policy) {
 	}
 
 	result := EvaluateAlignment(data.fromDomain, data.record, authRes)
+	result.PolicyDomain = data.policyDomain
+	result.Record = data.record
 	if result.Authres.Value == authres.ResultPass || result.Authres.Value == authres.ResultNone {
 		return result, dmarc.PolicyNone
 	}
 
+	if len(arcRes) != 0 && result.Authres.Value == authres.ResultFail {
+		arcResult := EvaluateAlignment(data.fromDomain, data.record, arcRes)
+		if arcResult.Authres.Value == authres.ResultPass {
+			result.ARCOverride = true
+			result.ARCSealer = arcSealer
+			result.Authres.Reason = "policy overridden: authenticated by trusted ARC sealer " + arcSealer
+			return result, dmarc.PolicyNone
+		}
+	}
+
 	if data.record.Percent != nil && rand.Int31n(100) > int32(*data.record.Percent) {
+		result.SampledOut = true
 		return result, dmarc.PolicyNone
 	}
 
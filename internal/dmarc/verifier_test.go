@@ -217,3 +217,49 @@ func TestDMARC(t *testing.T) {
 		&authres.SPFResult{Value: authres.ResultNone, From: "example.org", Helo: "mx.example.org"},
 	}, PolicyQuarantine, authres.ResultFail)
 }
+
+func TestDMARC_ARCOverride(t *testing.T) {
+	zones := map[string]mockdns.Zone{
+		"_dmarc.example.org.": {
+			TXT: []string{"v=DMARC1; p=reject"},
+		},
+	}
+	local := []authres.Result{
+		&authres.DKIMResult{Value: authres.ResultFail, Domain: "example.org"},
+		&authres.SPFResult{Value: authres.ResultPass, From: "lists.example.net", Helo: "mx.example.net"},
+	}
+	arcRes := []authres.Result{
+		&authres.DKIMResult{Value: authres.ResultPass, Domain: "example.org"},
+		&authres.SPFResult{Value: authres.ResultPass, From: "example.org", Helo: "mx.example.org"},
+	}
+
+	test := func(arcRes []authres.Result, policyApplied Policy, override bool) {
+		t.Helper()
+		v := NewVerifier(&mockdns.Resolver{Zones: zones})
+		defer v.Close()
+
+		hdrParsed, err := textproto.ReadHeader(bufio.NewReader(strings.NewReader("From: hello@example.org\r\n\r\n")))
+		if err != nil {
+			panic(err)
+		}
+		v.FetchRecord(context.Background(), hdrParsed)
+		evalRes, policy := v.ApplyWithARC(local, "lists.example.net", arcRes)
+
+		if policy != policyApplied {
+			t.Errorf("expected applied policy to be '%v', got '%v'", policyApplied, policy)
+		}
+		if evalRes.Authres.Value != authres.ResultFail {
+			t.Errorf("expected DMARC result to be 'fail', got '%v'", evalRes.Authres.Value)
+		}
+		if evalRes.ARCOverride != override {
+			t.Errorf("expected ARCOverride to be %v", override)
+		}
+	}
+
+	test(nil, PolicyReject, false)
+	test(arcRes, PolicyNone, true)
+	test([]authres.Result{
+		&authres.DKIMResult{Value: authres.ResultPass, Domain: "example.com"},
+		&authres.SPFResult{Value: authres.ResultFail, From: "example.org", Helo: "mx.example.org"},
+	}, PolicyReject, false)
+}
@@ -0,0 +1,661 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package dnscheck verifies the DNS records of a mail domain the way remote
+// senders see them.
+package dnscheck
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+	"github.com/sirrchat/SirrMesh/framework/dns"
+	"github.com/sirrchat/SirrMesh/internal/tlsrpt"
+)
+
+// Status is the outcome of a single check.
+type Status string
+
+const (
+	StatusOK   Status = "ok"
+	StatusSkip Status = "skip"
+	StatusWarn Status = "warn"
+	StatusFail Status = "fail"
+)
+
+func (s Status) severity() int {
+	switch s {
+	case StatusWarn:
+		return 1
+	case StatusFail:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// Resolver is the subset of dns.ExtResolver used by the checks.
+type Resolver interface {
+	AuthLookupIPAddr(ctx context.Context, host string) (ad bool, addrs []net.IPAddr, err error)
+	AuthLookupMX(ctx context.Context, name string) (ad bool, mxs []*net.MX, err error)
+	AuthLookupTXT(ctx context.Context, name string) (ad bool, recs []string, err error)
+	AuthLookupAddr(ctx context.Context, addr string) (ad bool, names []string, err error)
+	AuthLookupTLSA(ctx context.Context, service, network, domain string) (ad bool, recs []dns.TLSA, err error)
+}
+
+// Result is the outcome of a check against one DNS name.
+type Result struct {
+	Check  string   `json:"check"`
+	Name   string   `json:"name"`
+	Status Status   `json:"status"`
+	DNSSEC bool     `json:"dnssec"`
+	Code   string   `json:"code"`
+	Args   []string `json:"-"`
+	Text   string   `json:"message,omitempty"`
+	Values []string `json:"values,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// Message returns the human-readable description of the result in the
+// language (see Languages).
+func (r Result) Message(lang string) string {
+	return message(lang, r.Code, r.Args...)
+}
+
+// Report is the outcome of all checks for a domain.
+type Report struct {
+	Domain  string   `json:"domain"`
+	Results []Result `json:"results"`
+}
+
+// Status returns the worst status among the results.
+func (r *Report) Status() Status {
+	worst := StatusOK
+	for _, res := range r.Results {
+		if res.Status.severity() > worst.severity() {
+			worst = res.Status
+		}
+	}
+	return worst
+}
+
+// Localize sets the Text of each result to the message in the language.
+func (r *Report) Localize(lang string) {
+	for i := range r.Results {
+		r.Results[i].Text = r.Results[i].Message(lang)
+	}
+}
+
+// DKIMKey is the DKIM record expected to be published for a selector.
+type DKIMKey struct {
+	Selector string
+	Record   string
+}
+
+// Checker runs the checks for a domain.
+type Checker struct {
+	Resolver Resolver
+
+	// Hostname is the name the server uses in SMTP, it is expected to be
+	// listed among MX records. Optional.
+	Hostname string
+
+	// DKIM contains records from the local key files. If empty, only the
+	// presence of the "default" selector is checked.
+	DKIM []DKIMKey
+
+	// Certificate is compared against TLSA records of Hostname. If nil, the
+	// certificate presented during the SMTP probe is used.
+	Certificate *x509.Certificate
+
+	// ProbeAddr is the "host:port" address of the SMTP endpoint to connect
+	// to. Probing is skipped if empty.
+	ProbeAddr string
+
+	// Timeout limits each network operation. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// FetchPolicy downloads the MTA-STS policy. Defaults to an HTTPS request
+	// to the policy host.
+	FetchPolicy func(ctx context.Context, domain string) (*mtasts.Policy, error)
+
+	// Dial is used for the SMTP probe. Defaults to net.Dialer.DialContext.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+type check struct {
+	c      *Checker
+	ctx    context.Context
+	domain string
+	report *Report
+	mxs    []string
+}
+
+func (ch *check) add(res Result) {
+	ch.report.Results = append(ch.report.Results, res)
+}
+
+// Run checks the DNS configuration of the domain.
+func (c *Checker) Run(ctx context.Context, domain string) *Report {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	ch := &check{
+		c:      c,
+		ctx:    ctx,
+		domain: domain,
+		report: &Report{Domain: domain},
+	}
+
+	ch.checkAddress(domain, "address", StatusWarn)
+	ch.checkMX()
+	for _, mx := range ch.mxs {
+		ch.checkMXHost(mx)
+	}
+	ch.checkSPF()
+	ch.checkDKIM()
+	ch.checkDMARC()
+	ch.checkMTASTS()
+	ch.checkTLSRPT()
+	cert := ch.probe()
+	if c.Certificate != nil {
+		cert = c.Certificate
+	}
+	ch.checkTLSA(cert)
+
+	return ch.report
+}
+
+func (c *Checker) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return c.Timeout
+}
+
+func (ch *check) lookupCtx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ch.ctx, ch.c.timeout())
+}
+
+// lookupErr fills the result for a failed lookup, distinguishing missing
+// records from resolution errors.
+func lookupErr(res Result, err error, missingStatus Status, missingCode string) Result {
+	if dns.IsNotFound(err) {
+		res.Status = missingStatus
+		res.Code = missingCode
+		return res
+	}
+	res.Status = StatusFail
+	res.Code = "lookup_error"
+	res.Error = err.Error()
+	return res
+}
+
+func (ch *check) lookupTXT(name string) (bool, []string, error) {
+	ctx, cancel := ch.lookupCtx()
+	defer cancel()
+	return ch.c.Resolver.AuthLookupTXT(ctx, name)
+}
+
+func (ch *check) lookupIPs(host string) (bool, []net.IPAddr, error) {
+	ctx, cancel := ch.lookupCtx()
+	defer cancel()
+	return ch.c.Resolver.AuthLookupIPAddr(ctx, host)
+}
+
+func (ch *check) checkAddress(host, checkName string, missing Status) []net.IPAddr {
+	res := Result{Check: checkName, Name: host}
+	ad, addrs, err := ch.lookupIPs(host)
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if err != nil {
+		ch.add(lookupErr(res, err, missing, "address.missing"))
+		return nil
+	}
+	res.DNSSEC = ad
+	for _, addr := range addrs {
+		res.Values = append(res.Values, addr.IP.String())
+	}
+	res.Status = StatusOK
+	res.Code = "address.ok"
+	ch.add(res)
+	return addrs
+}
+
+func (ch *check) checkMX() {
+	res := Result{Check: "mx", Name: ch.domain}
+	ctx, cancel := ch.lookupCtx()
+	ad, mxs, err := ch.c.Resolver.AuthLookupMX(ctx, ch.domain)
+	cancel()
+	if err == nil && len(mxs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: ch.domain, IsNotFound: true}
+	}
+	if err != nil {
+		ch.add(lookupErr(res, err, StatusFail, "mx.missing"))
+		return
+	}
+	sort.Slice(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+
+	res.DNSSEC = ad
+	hostListed := ch.c.Hostname == ""
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(strings.ToLower(mx.Host), ".")
+		res.Values = append(res.Values, strconv.Itoa(int(mx.Pref))+" "+host)
+		ch.mxs = append(ch.mxs, host)
+		if dns.Equal(host, ch.c.Hostname) {
+			hostListed = true
+		}
+	}
+	if !hostListed {
+		res.Status = StatusWarn
+		res.Code = "mx.hostname_missing"
+		res.Args = []string{ch.c.Hostname}
+	} else {
+		res.Status = StatusOK
+		res.Code = "mx.ok"
+	}
+	ch.add(res)
+}
+
+// checkMXHost checks that the MX host resolves and that each of its
+// addresses has forward-confirmed reverse DNS.
+func (ch *check) checkMXHost(host string) {
+	for _, addr := range ch.checkAddress(host, "mx_address", StatusFail) {
+		ch.checkPTR(addr.IP)
+	}
+}
+
+func (ch *check) checkPTR(ip net.IP) {
+	res := Result{Check: "ptr", Name: ip.String()}
+	ctx, cancel := ch.lookupCtx()
+	ad, names, err := ch.c.Resolver.AuthLookupAddr(ctx, ip.String())
+	cancel()
+	if err == nil && len(names) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: ip.String(), IsNotFound: true}
+	}
+	if err != nil {
+		ch.add(lookupErr(res, err, StatusFail, "ptr.missing"))
+		return
+	}
+	res.DNSSEC = ad
+	for _, name := range names {
+		res.Values = append(res.Values, strings.TrimSuffix(name, "."))
+	}
+
+	// FCrDNS: at least one of the PTR names should resolve back to the IP.
+	for _, name := range res.Values {
+		_, addrs, err := ch.lookupIPs(name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				res.Status = StatusOK
+				res.Code = "ptr.ok"
+				res.Args = []string{name}
+				ch.add(res)
+				return
+			}
+		}
+	}
+	res.Status = StatusFail
+	res.Code = "ptr.mismatch"
+	ch.add(res)
+}
+
+// findTXT returns TXT records of the name that start with the prefix.
+func (ch *check) findTXT(res *Result, name, prefix string) ([]string, error) {
+	ad, txts, err := ch.lookupTXT(name)
+	if err != nil {
+		return nil, err
+	}
+	res.DNSSEC = ad
+	var found []string
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.ToLower(txt), strings.ToLower(prefix)) {
+			found = append(found, txt)
+		}
+	}
+	return found, nil
+}
+
+// checkSingleTXT implements the common "exactly one record with the version
+// tag" check used for SPF and DMARC.
+func (ch *check) checkSingleTXT(checkName, name, prefix string, missing Status) {
+	res := Result{Check: checkName, Name: name}
+	found, err := ch.findTXT(&res, name, prefix)
+	if err != nil {
+		ch.add(lookupErr(res, err, missing, checkName+".missing"))
+		return
+	}
+	res.Values = found
+	switch len(found) {
+	case 0:
+		res.Status = missing
+		res.Code = checkName + ".missing"
+	case 1:
+		res.Status = StatusOK
+		res.Code = checkName + ".ok"
+	default:
+		res.Status = StatusFail
+		res.Code = "txt.multiple"
+	}
+	ch.add(res)
+}
+
+func (ch *check) checkSPF() {
+	ch.checkSingleTXT("spf", ch.domain, "v=spf1", StatusFail)
+}
+
+func (ch *check) checkDMARC() {
+	ch.checkSingleTXT("dmarc", "_dmarc."+ch.domain, "v=DMARC1", StatusWarn)
+}
+
+// dkimKeyData returns the p= tag value of a DKIM record.
+func dkimKeyData(record string) string {
+	for _, tag := range strings.Split(record, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(tag), "=")
+		if ok && strings.TrimSpace(key) == "p" {
+			return strings.Join(strings.Fields(value), "")
+		}
+	}
+	return ""
+}
+
+func (ch *check) checkDKIM() {
+	keys := ch.c.DKIM
+	if len(keys) == 0 {
+		keys = []DKIMKey{{Selector: "default"}}
+	}
+	for _, key := range keys {
+		name := key.Selector + "._domainkey." + ch.domain
+		res := Result{Check: "dkim", Name: name}
+		ad, txts, err := ch.lookupTXT(name)
+		if err != nil {
+			ch.add(lookupErr(res, err, StatusFail, "dkim.missing"))
+			continue
+		}
+		res.DNSSEC = ad
+
+		published := ""
+		for _, txt := range txts {
+			if dkimKeyData(txt) != "" {
+				published = txt
+				break
+			}
+		}
+		switch {
+		case published == "":
+			res.Status = StatusFail
+			res.Code = "dkim.missing"
+		case key.Record == "":
+			res.Values = []string{published}
+			res.Status = StatusOK
+			res.Code = "dkim.ok"
+		case dkimKeyData(published) != dkimKeyData(key.Record):
+			res.Values = []string{published}
+			res.Status = StatusFail
+			res.Code = "dkim.mismatch"
+		default:
+			res.Values = []string{published}
+			res.Status = StatusOK
+			res.Code = "dkim.match"
+		}
+		ch.add(res)
+	}
+}
+
+func (ch *check) checkMTASTS() {
+	name := "_mta-sts." + ch.domain
+	res := Result{Check: "mta_sts", Name: name}
+	found, err := ch.findTXT(&res, name, "v=STSv1")
+	if err != nil {
+		ch.add(lookupErr(res, err, StatusWarn, "mta_sts.missing"))
+		return
+	}
+	res.Values = found
+	switch len(found) {
+	case 0:
+		res.Status = StatusWarn
+		res.Code = "mta_sts.missing"
+		ch.add(res)
+		return
+	case 1:
+	default:
+		res.Status = StatusFail
+		res.Code = "txt.multiple"
+		ch.add(res)
+		return
+	}
+
+	fetch := ch.c.FetchPolicy
+	if fetch == nil {
+		fetch = ch.c.fetchPolicy
+	}
+	ctx, cancel := ch.lookupCtx()
+	policy, err := fetch(ctx, ch.domain)
+	cancel()
+	if err != nil {
+		res.Status = StatusFail
+		res.Code = "mta_sts.fetch_failed"
+		res.Error = err.Error()
+		ch.add(res)
+		return
+	}
+	res.Values = append(res.Values, "mode: "+string(policy.Mode))
+	for _, mx := range policy.MX {
+		res.Values = append(res.Values, "mx: "+mx)
+	}
+
+	if policy.Mode != mtasts.ModeNone {
+		for _, mx := range ch.mxs {
+			if !policy.Match(mx) {
+				res.Status = StatusFail
+				res.Code = "mta_sts.mx_mismatch"
+				res.Args = []string{mx}
+				ch.add(res)
+				return
+			}
+		}
+	}
+	res.Status = StatusOK
+	res.Code = "mta_sts.ok"
+	res.Args = []string{string(policy.Mode)}
+	ch.add(res)
+}
+
+func (ch *check) checkTLSRPT() {
+	name := tlsrpt.RecordName(ch.domain)
+	res := Result{Check: "tls_rpt", Name: name}
+	ad, txts, err := ch.lookupTXT(name)
+	if err != nil {
+		ch.add(lookupErr(res, err, StatusWarn, "tls_rpt.missing"))
+		return
+	}
+	res.DNSSEC = ad
+	rec, err := tlsrpt.FindRecord(txts)
+	switch {
+	case err != nil:
+		res.Status = StatusFail
+		res.Code = "tls_rpt.invalid"
+		res.Error = err.Error()
+	case rec == nil:
+		res.Status = StatusWarn
+		res.Code = "tls_rpt.missing"
+	default:
+		res.Values = rec.RUA
+		res.Status = StatusOK
+		res.Code = "tls_rpt.ok"
+	}
+	ch.add(res)
+}
+
+// probe connects to the SMTP endpoint, negotiates STARTTLS and returns the
+// presented certificate.
+func (ch *check) probe() *x509.Certificate {
+	if ch.c.ProbeAddr == "" {
+		return nil
+	}
+	res := Result{Check: "smtp", Name: ch.c.ProbeAddr}
+
+	dial := ch.c.Dial
+	if dial == nil {
+		dialer := &net.Dialer{}
+		dial = dialer.DialContext
+	}
+	ctx, cancel := ch.lookupCtx()
+	defer cancel()
+	conn, err := dial(ctx, "tcp", ch.c.ProbeAddr)
+	if err != nil {
+		res.Status = StatusFail
+		res.Code = "smtp.unreachable"
+		res.Error = err.Error()
+		ch.add(res)
+		return nil
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(ch.c.ProbeAddr)
+	cl, err := smtp.NewClient(conn, host)
+	if err != nil {
+		res.Status = StatusFail
+		res.Code = "smtp.error"
+		res.Error = err.Error()
+		ch.add(res)
+		return nil
+	}
+	defer cl.Close()
+	if err := cl.Hello("dnscheck.invalid"); err != nil {
+		res.Status = StatusFail
+		res.Code = "smtp.error"
+		res.Error = err.Error()
+		ch.add(res)
+		return nil
+	}
+	if ok, _ := cl.Extension("STARTTLS"); !ok {
+		res.Status = StatusWarn
+		res.Code = "smtp.no_starttls"
+		ch.add(res)
+		return nil
+	}
+	if err := cl.StartTLS(&tls.Config{
+		ServerName: host,
+		// Only the certificate is collected here, it is verified against
+		// TLSA records by checkTLSA.
+		InsecureSkipVerify: true,
+	}); err != nil {
+		res.Status = StatusFail
+		res.Code = "smtp.tls_failed"
+		res.Error = err.Error()
+		ch.add(res)
+		return nil
+	}
+	_ = cl.Quit()
+
+	state, _ := cl.TLSConnectionState()
+	res.Status = StatusOK
+	res.Code = "smtp.ok"
+	if len(state.PeerCertificates) == 0 {
+		ch.add(res)
+		return nil
+	}
+	cert := state.PeerCertificates[0]
+	res.Values = []string{"subject: " + cert.Subject.CommonName, "expires: " + cert.NotAfter.UTC().Format(time.RFC3339)}
+	ch.add(res)
+	return cert
+}
+
+func (ch *check) checkTLSA(cert *x509.Certificate) {
+	host := ch.c.Hostname
+	if host == "" {
+		if len(ch.mxs) == 0 {
+			return
+		}
+		host = ch.mxs[0]
+	}
+	res := Result{Check: "tlsa", Name: "_25._tcp." + host}
+
+	ctx, cancel := ch.lookupCtx()
+	ad, recs, err := ch.c.Resolver.AuthLookupTLSA(ctx, "25", "tcp", host)
+	cancel()
+	if err == nil && len(recs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: res.Name, IsNotFound: true}
+	}
+	if err != nil {
+		ch.add(lookupErr(res, err, StatusSkip, "tlsa.missing"))
+		return
+	}
+	res.DNSSEC = ad
+	for _, rec := range recs {
+		res.Values = append(res.Values, fmt.Sprintf("%d %d %d %s", rec.Usage, rec.Selector, rec.MatchingType, rec.Certificate))
+	}
+
+	switch {
+	case !ad:
+		// DANE is ignored by senders without DNSSEC (RFC 7672 Section 2.2).
+		res.Status = StatusFail
+		res.Code = "tlsa.insecure"
+	case !hasDANEEE(recs):
+		res.Status = StatusWarn
+		res.Code = "tlsa.unchecked"
+	case cert == nil:
+		res.Status = StatusWarn
+		res.Code = "tlsa.no_certificate"
+	case matchTLSA(recs, cert):
+		res.Status = StatusOK
+		res.Code = "tlsa.match"
+	default:
+		res.Status = StatusFail
+		res.Code = "tlsa.mismatch"
+	}
+	ch.add(res)
+}
+
+func hasDANEEE(recs []dns.TLSA) bool {
+	for _, rec := range recs {
+		if rec.Usage == 3 {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTLSA reports whether any DANE-EE record matches the certificate.
+// DANE-TA records are not checked since the chain is not available.
+func matchTLSA(recs []dns.TLSA, cert *x509.Certificate) bool {
+	for _, rec := range recs {
+		if rec.Usage != 3 {
+			continue
+		}
+		if rec.Verify(cert) == nil {
+			return true
+		}
+	}
+	return false
+}
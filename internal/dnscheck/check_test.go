@@ -0,0 +1,362 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnscheck
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mtasts"
+	"github.com/sirrchat/SirrMesh/framework/dns"
+)
+
+type fakeResolver struct {
+	ad   bool
+	ip   map[string][]string
+	mx   map[string][]*net.MX
+	txt  map[string][]string
+	ptr  map[string][]string
+	tlsa map[string][]dns.TLSA
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) AuthLookupIPAddr(_ context.Context, host string) (bool, []net.IPAddr, error) {
+	ips, ok := r.ip[host]
+	if !ok {
+		return false, nil, notFound(host)
+	}
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return r.ad, addrs, nil
+}
+
+func (r *fakeResolver) AuthLookupMX(_ context.Context, name string) (bool, []*net.MX, error) {
+	mxs, ok := r.mx[name]
+	if !ok {
+		return false, nil, notFound(name)
+	}
+	return r.ad, mxs, nil
+}
+
+func (r *fakeResolver) AuthLookupTXT(_ context.Context, name string) (bool, []string, error) {
+	txts, ok := r.txt[name]
+	if !ok {
+		return false, nil, notFound(name)
+	}
+	return r.ad, txts, nil
+}
+
+func (r *fakeResolver) AuthLookupAddr(_ context.Context, addr string) (bool, []string, error) {
+	names, ok := r.ptr[addr]
+	if !ok {
+		return false, nil, notFound(addr)
+	}
+	return r.ad, names, nil
+}
+
+func (r *fakeResolver) AuthLookupTLSA(_ context.Context, _, _, domain string) (bool, []dns.TLSA, error) {
+	recs, ok := r.tlsa[domain]
+	if !ok {
+		return false, nil, notFound(domain)
+	}
+	return r.ad, recs, nil
+}
+
+func testCert(t *testing.T) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.org"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func tlsaFor(cert *x509.Certificate) dns.TLSA {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return dns.TLSA{Usage: 3, Selector: 1, MatchingType: 1, Certificate: hex.EncodeToString(sum[:])}
+}
+
+const dkimRecord = "v=DKIM1; k=rsa; p=MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA"
+
+func goodZone(cert *x509.Certificate) *fakeResolver {
+	return &fakeResolver{
+		ad: true,
+		ip: map[string][]string{
+			"example.org":    {"192.0.2.1"},
+			"mx.example.org": {"192.0.2.1"},
+		},
+		mx: map[string][]*net.MX{
+			"example.org": {{Host: "mx.example.org.", Pref: 10}},
+		},
+		txt: map[string][]string{
+			"example.org":                      {"v=spf1 mx -all", "google-site-verification=x"},
+			"default._domainkey.example.org":   {dkimRecord},
+			"_dmarc.example.org":               {"v=DMARC1; p=reject"},
+			"_mta-sts.example.org":             {"v=STSv1; id=1"},
+			"_smtp._tls.example.org":           {"v=TLSRPTv1; rua=mailto:tlsrpt@example.org"},
+			"selector2._domainkey.example.org": {"v=DKIM1; p=AAAA"},
+		},
+		ptr: map[string][]string{
+			"192.0.2.1": {"mx.example.org."},
+		},
+		tlsa: map[string][]dns.TLSA{
+			"mx.example.org": {tlsaFor(cert)},
+		},
+	}
+}
+
+func goodPolicy(context.Context, string) (*mtasts.Policy, error) {
+	return &mtasts.Policy{Mode: mtasts.ModeEnforce, MaxAge: 86400, MX: []string{"mx.example.org"}}, nil
+}
+
+func results(r *Report) map[string]Result {
+	m := make(map[string]Result, len(r.Results))
+	for _, res := range r.Results {
+		m[res.Check+" "+res.Name] = res
+	}
+	return m
+}
+
+func TestChecker_Good(t *testing.T) {
+	cert := testCert(t)
+	c := &Checker{
+		Resolver:    goodZone(cert),
+		Hostname:    "mx.example.org",
+		DKIM:        []DKIMKey{{Selector: "default", Record: dkimRecord}},
+		Certificate: cert,
+		FetchPolicy: goodPolicy,
+	}
+	report := c.Run(context.Background(), "Example.org.")
+	for _, res := range report.Results {
+		if res.Status != StatusOK {
+			t.Errorf("%s %s: %s (%s): %s", res.Check, res.Name, res.Status, res.Code, res.Error)
+		}
+		if !res.DNSSEC {
+			t.Errorf("%s %s: DNSSEC flag not set", res.Check, res.Name)
+		}
+	}
+	if report.Status() != StatusOK {
+		t.Fatal("Report status:", report.Status())
+	}
+	if len(report.Results) != 10 {
+		t.Fatal("Unexpected number of results:", len(report.Results))
+	}
+}
+
+func TestChecker_Problems(t *testing.T) {
+	cert := testCert(t)
+	zone := goodZone(cert)
+	zone.txt["default._domainkey.example.org"] = []string{"v=DKIM1; k=rsa; p=BBBB"}
+	zone.txt["example.org"] = []string{"v=spf1 mx -all", "v=spf1 a -all"}
+	delete(zone.txt, "_dmarc.example.org")
+	zone.ptr["192.0.2.1"] = []string{"host.isp.example."}
+	zone.tlsa["mx.example.org"] = []dns.TLSA{tlsaFor(testCert(t))}
+
+	c := &Checker{
+		Resolver:    zone,
+		Hostname:    "mail.example.org",
+		DKIM:        []DKIMKey{{Selector: "default", Record: dkimRecord}},
+		Certificate: cert,
+		FetchPolicy: func(context.Context, string) (*mtasts.Policy, error) {
+			return &mtasts.Policy{Mode: mtasts.ModeEnforce, MX: []string{"mx2.example.org"}}, nil
+		},
+	}
+	report := c.Run(context.Background(), "example.org")
+	if report.Status() != StatusFail {
+		t.Fatal("Report status:", report.Status())
+	}
+	res := results(report)
+
+	expect := func(key string, status Status, code string) {
+		t.Helper()
+		r, ok := res[key]
+		if !ok {
+			t.Errorf("%s: missing", key)
+			return
+		}
+		if r.Status != status || r.Code != code {
+			t.Errorf("%s: got %s (%s), want %s (%s)", key, r.Status, r.Code, status, code)
+		}
+	}
+	expect("mx example.org", StatusWarn, "mx.hostname_missing")
+	expect("ptr 192.0.2.1", StatusFail, "ptr.mismatch")
+	expect("spf example.org", StatusFail, "txt.multiple")
+	expect("dkim default._domainkey.example.org", StatusFail, "dkim.mismatch")
+	expect("dmarc _dmarc.example.org", StatusWarn, "dmarc.missing")
+	expect("mta_sts _mta-sts.example.org", StatusFail, "mta_sts.mx_mismatch")
+	// Hostname has no TLSA records.
+	expect("tlsa _25._tcp.mail.example.org", StatusSkip, "tlsa.missing")
+
+	c.Hostname = "mx.example.org"
+	report = c.Run(context.Background(), "example.org")
+	expectTLSA := results(report)["tlsa _25._tcp.mx.example.org"]
+	if expectTLSA.Code != "tlsa.mismatch" {
+		t.Error("TLSA mismatch not detected:", expectTLSA.Code)
+	}
+
+	zone.ad = false
+	zone.tlsa["mx.example.org"] = []dns.TLSA{tlsaFor(cert)}
+	report = c.Run(context.Background(), "example.org")
+	expectTLSA = results(report)["tlsa _25._tcp.mx.example.org"]
+	if expectTLSA.Code != "tlsa.insecure" {
+		t.Error("Unsigned TLSA not detected:", expectTLSA.Code)
+	}
+}
+
+func TestChecker_NoMX(t *testing.T) {
+	c := &Checker{
+		Resolver: &fakeResolver{},
+		FetchPolicy: func(context.Context, string) (*mtasts.Policy, error) {
+			return nil, errors.New("should not be called")
+		},
+	}
+	report := c.Run(context.Background(), "example.invalid")
+	res := results(report)
+	if r := res["mx example.invalid"]; r.Status != StatusFail || r.Code != "mx.missing" {
+		t.Error("Missing MX not reported:", r.Status, r.Code)
+	}
+	if r := res["mta_sts _mta-sts.example.invalid"]; r.Status != StatusWarn {
+		t.Error("Missing MTA-STS should be a warning:", r.Status)
+	}
+	if _, ok := res["tlsa _25._tcp.example.invalid"]; ok {
+		t.Error("TLSA should not be checked without MX")
+	}
+}
+
+func TestChecker_Probe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("220 mx.example.org ESMTP\r\n"))
+		buf := make([]byte, 512)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			cmd := strings.ToUpper(string(buf[:n]))
+			switch {
+			case strings.HasPrefix(cmd, "EHLO"):
+				_, _ = conn.Write([]byte("250-mx.example.org\r\n250 PIPELINING\r\n"))
+			default:
+				_, _ = conn.Write([]byte("221 bye\r\n"))
+				return
+			}
+		}
+	}()
+
+	c := &Checker{
+		Resolver:  &fakeResolver{},
+		ProbeAddr: l.Addr().String(),
+		Timeout:   5 * time.Second,
+	}
+	res := results(c.Run(context.Background(), "example.invalid"))["smtp "+l.Addr().String()]
+	if res.Status != StatusWarn || res.Code != "smtp.no_starttls" {
+		t.Error("Unexpected probe result:", res.Status, res.Code, res.Error)
+	}
+
+	l.Close()
+	res = results(c.Run(context.Background(), "example.invalid"))["smtp "+l.Addr().String()]
+	if res.Status != StatusFail || res.Code != "smtp.unreachable" {
+		t.Error("Unexpected probe result for closed port:", res.Status, res.Code)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := parsePolicy(strings.NewReader("version: STSv1\r\nmode: enforce\r\nmx: mx.example.org\r\nmx: *.example.net\r\nmax_age: 604800\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Mode != mtasts.ModeEnforce || p.MaxAge != 604800 || len(p.MX) != 2 {
+		t.Fatalf("Unexpected policy: %+v", p)
+	}
+	if !p.Match("a.example.net") {
+		t.Error("Wildcard MX not matched")
+	}
+
+	for _, text := range []string{
+		"mode: enforce\nmx: mx.example.org\nmax_age: 1\n",
+		"version: STSv1\nmode: enforce\nmax_age: 1\n",
+		"version: STSv1\nmode: strict\nmx: a\nmax_age: 1\n",
+		"version: STSv1\nmode: none\n",
+	} {
+		if _, err := parsePolicy(strings.NewReader(text)); err == nil {
+			t.Errorf("Expected error for %q", text)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	res := Result{Code: "mx.hostname_missing", Args: []string{"mx.example.org"}}
+	if msg := res.Message("en"); msg != "server hostname mx.example.org is not listed in MX records" {
+		t.Error("Unexpected message:", msg)
+	}
+	if msg := res.Message("zh"); !strings.Contains(msg, "mx.example.org") || msg == res.Message("en") {
+		t.Error("Unexpected zh message:", msg)
+	}
+	for lang, msgs := range messages {
+		for code := range messages["en"] {
+			if _, ok := msgs[code]; !ok {
+				t.Errorf("%s: missing translation for %s", lang, code)
+			}
+		}
+	}
+	if NormalizeLanguage("zh_CN.UTF-8") != "zh" || NormalizeLanguage("C") != "en" {
+		t.Error("NormalizeLanguage")
+	}
+}
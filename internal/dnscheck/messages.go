@@ -0,0 +1,181 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnscheck
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Languages lists the supported message languages. The first one is the
+// default.
+var Languages = []string{"en", "zh"}
+
+var messages = map[string]map[string]string{
+	"en": {
+		"check.address":    "Domain address",
+		"check.mx":         "MX",
+		"check.mx_address": "MX host address",
+		"check.ptr":        "Reverse DNS",
+		"check.spf":        "SPF",
+		"check.dkim":       "DKIM",
+		"check.dmarc":      "DMARC",
+		"check.mta_sts":    "MTA-STS",
+		"check.tls_rpt":    "TLS-RPT",
+		"check.smtp":       "SMTP endpoint",
+		"check.tlsa":       "DANE TLSA",
+
+		"status.ok":   "OK",
+		"status.skip": "SKIP",
+		"status.warn": "WARN",
+		"status.fail": "FAIL",
+
+		"lookup_error":         "DNS lookup failed",
+		"txt.multiple":         "multiple records are published, receivers will ignore all of them",
+		"address.ok":           "resolves",
+		"address.missing":      "no A or AAAA records",
+		"mx.ok":                "MX records found",
+		"mx.missing":           "no MX records, the domain cannot receive mail",
+		"mx.hostname_missing":  "server hostname %s is not listed in MX records",
+		"ptr.ok":               "forward-confirmed as %s",
+		"ptr.missing":          "no PTR record, many receivers will reject mail from this address",
+		"ptr.mismatch":         "PTR name does not resolve back to the address",
+		"spf.ok":               "SPF record found",
+		"spf.missing":          "no SPF record",
+		"dkim.ok":              "DKIM key is published",
+		"dkim.match":           "published key matches the local key",
+		"dkim.mismatch":        "published key does not match the local key",
+		"dkim.missing":         "no DKIM key is published",
+		"dmarc.ok":             "DMARC record found",
+		"dmarc.missing":        "no DMARC record",
+		"mta_sts.ok":           "policy fetched, mode %s",
+		"mta_sts.missing":      "no MTA-STS record",
+		"mta_sts.fetch_failed": "cannot fetch the policy",
+		"mta_sts.mx_mismatch":  "MX %s is not allowed by the policy",
+		"tls_rpt.ok":           "TLS-RPT record found",
+		"tls_rpt.missing":      "no TLS-RPT record",
+		"tls_rpt.invalid":      "invalid TLS-RPT record",
+		"smtp.ok":              "reachable, STARTTLS works",
+		"smtp.unreachable":     "cannot connect",
+		"smtp.error":           "SMTP handshake failed",
+		"smtp.no_starttls":     "STARTTLS is not offered",
+		"smtp.tls_failed":      "STARTTLS failed",
+		"tlsa.match":           "matches the server certificate",
+		"tlsa.mismatch":        "no record matches the server certificate",
+		"tlsa.missing":         "no TLSA records, DANE is not used",
+		"tlsa.insecure":        "records are not DNSSEC-signed, senders will ignore them",
+		"tlsa.unchecked":       "no DANE-EE records to compare with the certificate",
+		"tlsa.no_certificate":  "no certificate to compare with",
+	},
+	"zh": {
+		"check.address":    "域名地址",
+		"check.mx":         "MX",
+		"check.mx_address": "MX主机地址",
+		"check.ptr":        "反向解析",
+		"check.spf":        "SPF",
+		"check.dkim":       "DKIM",
+		"check.dmarc":      "DMARC",
+		"check.mta_sts":    "MTA-STS",
+		"check.tls_rpt":    "TLS-RPT",
+		"check.smtp":       "SMTP端口",
+		"check.tlsa":       "DANE TLSA",
+
+		"status.ok":   "正常",
+		"status.skip": "跳过",
+		"status.warn": "警告",
+		"status.fail": "失败",
+
+		"lookup_error":         "DNS查询失败",
+		"txt.multiple":         "存在多条记录，接收方将全部忽略",
+		"address.ok":           "解析正常",
+		"address.missing":      "没有A或AAAA记录",
+		"mx.ok":                "已找到MX记录",
+		"mx.missing":           "没有MX记录，域名无法接收邮件",
+		"mx.hostname_missing":  "服务器主机名 %s 不在MX记录中",
+		"ptr.ok":               "正反向解析一致: %s",
+		"ptr.missing":          "没有PTR记录，许多接收方会拒收来自该地址的邮件",
+		"ptr.mismatch":         "PTR名称无法解析回该地址",
+		"spf.ok":               "已找到SPF记录",
+		"spf.missing":          "没有SPF记录",
+		"dkim.ok":              "已发布DKIM密钥",
+		"dkim.match":           "已发布的密钥与本地密钥一致",
+		"dkim.mismatch":        "已发布的密钥与本地密钥不一致",
+		"dkim.missing":         "未发布DKIM密钥",
+		"dmarc.ok":             "已找到DMARC记录",
+		"dmarc.missing":        "没有DMARC记录",
+		"mta_sts.ok":           "已获取策略，模式 %s",
+		"mta_sts.missing":      "没有MTA-STS记录",
+		"mta_sts.fetch_failed": "无法获取策略",
+		"mta_sts.mx_mismatch":  "策略不允许MX %s",
+		"tls_rpt.ok":           "已找到TLS-RPT记录",
+		"tls_rpt.missing":      "没有TLS-RPT记录",
+		"tls_rpt.invalid":      "TLS-RPT记录无效",
+		"smtp.ok":              "可连接，STARTTLS正常",
+		"smtp.unreachable":     "无法连接",
+		"smtp.error":           "SMTP握手失败",
+		"smtp.no_starttls":     "未提供STARTTLS",
+		"smtp.tls_failed":      "STARTTLS失败",
+		"tlsa.match":           "与服务器证书一致",
+		"tlsa.mismatch":        "没有与服务器证书一致的记录",
+		"tlsa.missing":         "没有TLSA记录，未使用DANE",
+		"tlsa.insecure":        "记录未经DNSSEC签名，发送方将忽略",
+		"tlsa.unchecked":       "没有可与证书比较的DANE-EE记录",
+		"tlsa.no_certificate":  "没有可比较的证书",
+	},
+}
+
+// NormalizeLanguage maps a locale such as "zh_CN.UTF-8" to one of Languages,
+// falling back to the default.
+func NormalizeLanguage(locale string) string {
+	locale = strings.ToLower(locale)
+	for _, lang := range Languages {
+		if strings.HasPrefix(locale, lang) {
+			return lang
+		}
+	}
+	return Languages[0]
+}
+
+func message(lang, code string, args ...string) string {
+	tmpl, ok := messages[lang][code]
+	if !ok {
+		tmpl, ok = messages[Languages[0]][code]
+	}
+	if !ok {
+		return code
+	}
+	if len(args) == 0 {
+		return tmpl
+	}
+	fmtArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		fmtArgs[i] = arg
+	}
+	return fmt.Sprintf(tmpl, fmtArgs...)
+}
+
+// Title returns the display name of the check.
+func Title(lang, check string) string {
+	return message(lang, "check."+check)
+}
+
+// StatusLabel returns the display name of the status.
+func StatusLabel(lang string, s Status) string {
+	return message(lang, "status."+string(s))
+}
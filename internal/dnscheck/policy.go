@@ -0,0 +1,121 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dnscheck
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/foxcpp/go-mtasts"
+)
+
+// fetchPolicy downloads the MTA-STS policy from the policy host.
+//
+// Unlike mtasts.Cache, the cause of the failure is returned to be shown to
+// the user.
+func (c *Checker) fetchPolicy(ctx context.Context, domain string) (*mtasts.Policy, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://mta-sts."+domain+"/.well-known/mta-sts.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	cl := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return errors.New("redirects are forbidden for MTA-STS policies")
+		},
+		Timeout: c.timeout(),
+	}
+	resp, err := cl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	contentType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || contentType != "text/plain" {
+		return nil, fmt.Errorf("unexpected Content-Type %q", resp.Header.Get("Content-Type"))
+	}
+	return parsePolicy(io.LimitReader(resp.Body, 64*1024))
+}
+
+// parsePolicy parses the policy text (RFC 8461 Section 3.2).
+func parsePolicy(r io.Reader) (*mtasts.Policy, error) {
+	policy := &mtasts.Policy{}
+	var version, maxAge bool
+
+	scnr := bufio.NewScanner(r)
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("malformed policy line: %s", line)
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "version":
+			if value != "STSv1" {
+				return nil, fmt.Errorf("unsupported policy version: %s", value)
+			}
+			version = true
+		case "mode":
+			switch mtasts.Mode(value) {
+			case mtasts.ModeEnforce, mtasts.ModeTesting, mtasts.ModeNone:
+				policy.Mode = mtasts.Mode(value)
+			default:
+				return nil, fmt.Errorf("invalid policy mode: %s", value)
+			}
+		case "max_age":
+			age, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid max_age: %s", value)
+			}
+			policy.MaxAge = age
+			maxAge = true
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		}
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case !version:
+		return nil, errors.New("policy version is missing")
+	case policy.Mode == "":
+		return nil, errors.New("policy mode is missing")
+	case !maxAge:
+		return nil, errors.New("policy max_age is missing")
+	case policy.Mode != mtasts.ModeNone && len(policy.MX) == 0:
+		return nil, errors.New("policy lists no mx")
+	}
+	return policy, nil
+}
@@ -0,0 +1,266 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package adminapi implements the authenticated HTTP endpoint exposing
+// administrative operations: credentials, storage accounts, mailboxes,
+// messages, queue status and loaded module instances.
+//
+// It performs the same operations as the creds, imap-acct, imap-mboxes and
+// imap-msgs commands but against the modules of the running server.
+package adminapi
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	modconfig "github.com/sirrchat/SirrMesh/framework/config/module"
+	tls2 "github.com/sirrchat/SirrMesh/framework/config/tls"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+const modName = "admin_api"
+
+const (
+	// APIPrefix is the path prefix of all API routes.
+	APIPrefix = "/api/v1"
+	// OpenAPIPath is the path of the OpenAPI description, served without
+	// authentication.
+	OpenAPIPath = APIPrefix + "/openapi.json"
+
+	maxRequestSz = 64 * 1024
+	maxMessageSz = 32 * 1024 * 1024
+)
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	hostname  string
+	tokens    [][sha256.Size]byte
+	userDB    module.PlainUserDB
+	storage   module.ManageableStorage
+	tlsConfig *tls.Config
+	started   time.Time
+
+	// queues returns queue instances to report, replaced in tests.
+	queues func() []QueueLister
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:   args,
+		logger:  log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		queues:  initializedQueues,
+		started: time.Now(),
+	}, nil
+}
+
+// defaultInstance returns the default value function for a module
+// reference directive: the named instance if it is defined and implements
+// iface.
+func defaultInstance(name string, iface reflect.Type) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		if !module.HasInstance(name) {
+			return nil, nil
+		}
+		mod, err := module.GetInstance(name)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.TypeOf(mod).Implements(iface) {
+			return nil, nil
+		}
+		return mod, nil
+	}
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	var tokenFile string
+	cfg.String("hostname", true, false, "", &e.hostname)
+	cfg.String("token_file", false, true, "", &tokenFile)
+	cfg.Custom("credentials", false, false, defaultInstance("local_authdb", reflect.TypeFor[module.PlainUserDB]()), userDBDirective, &e.userDB)
+	cfg.Custom("storage", false, false, defaultInstance("local_mailboxes", reflect.TypeFor[module.ManageableStorage]()), storageDirective, &e.storage)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
+	cfg.Logger(true, false, &e.logger)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	tokens, err := readTokens(tokenFile)
+	if err != nil {
+		return fmt.Errorf("%s: %v", modName, err)
+	}
+	e.tokens = tokens
+
+	e.serv.Handler = e.handler()
+	e.serv.ReadHeaderTimeout = 10 * time.Second
+	e.serv.ErrorLog = stdlog.New(e.logger.DebugWriter(), "", 0)
+
+	for _, a := range e.addrs {
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		// Bearer tokens are sent in clear text over plain TCP.
+		if endp.Scheme == "tcp" && !isLoopback(endp.Host) {
+			return fmt.Errorf("%s: refusing to listen on %s without TLS, use tls:// or a loopback address", modName, endp)
+		}
+		l, err := module.Listen(e, endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			if e.tlsConfig == nil {
+				l.Close()
+				return fmt.Errorf("%s: can't bind on TLS endpoint without TLS configuration", modName)
+			}
+			l = tls.NewListener(l, e.tlsConfig)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func userDBDirective(m *config.Map, node config.Node) (interface{}, error) {
+	var db module.PlainUserDB
+	if err := modconfig.ModuleFromNode("auth", node.Args, node, m.Globals, &db); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func storageDirective(m *config.Map, node config.Node) (interface{}, error) {
+	var st module.ManageableStorage
+	if err := modconfig.ModuleFromNode("storage", node.Args, node, m.Globals, &st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// readTokens reads API tokens from the file, one per line. Empty lines and
+// lines starting with # are ignored.
+func readTokens(path string) ([][sha256.Size]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var tokens [][sha256.Size]byte
+	scnr := bufio.NewScanner(f)
+	for scnr.Scan() {
+		line := strings.TrimSpace(scnr.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, sha256.Sum256([]byte(line)))
+	}
+	if err := scnr.Err(); err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("no tokens in %s", path)
+	}
+	return tokens, nil
+}
+
+// authorized checks the bearer token of the request.
+//
+// Tokens are compared by their hashes in constant time and all tokens are
+// always checked.
+func (e *Endpoint) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	sum := sha256.Sum256([]byte(strings.TrimSpace(token)))
+
+	match := 0
+	for _, t := range e.tokens {
+		match |= subtle.ConstantTimeCompare(sum[:], t[:])
+	}
+	return match == 1
+}
+
+func (e *Endpoint) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !e.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+modName+`"`)
+			writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+			return
+		}
+		e.logger.Debugf("%s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,359 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package adminapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/target/queue"
+)
+
+const testToken = "s3cret-token"
+
+type testUserDB struct {
+	module.PlainUserDB
+	users map[string]string
+}
+
+func (db *testUserDB) ListUsers() ([]string, error) {
+	var list []string
+	for name := range db.users {
+		list = append(list, name)
+	}
+	return list, nil
+}
+
+func (db *testUserDB) CreateUser(username, password string) error {
+	if _, ok := db.users[username]; ok {
+		return errors.New("credentials already exist")
+	}
+	db.users[username] = password
+	return nil
+}
+
+func (db *testUserDB) SetUserPassword(username, password string) error {
+	db.users[username] = password
+	return nil
+}
+
+func (db *testUserDB) DeleteUser(username string) error {
+	delete(db.users, username)
+	return nil
+}
+
+// testStorage exposes the single "username" account of the go-imap memory
+// backend.
+type testStorage struct {
+	module.ManageableStorage
+	be *memory.Backend
+}
+
+func (s *testStorage) GetIMAPAcct(username string) (backend.User, error) {
+	if username != "username" {
+		return nil, imapsql.ErrUserDoesntExists
+	}
+	return s.be.Login(nil, "username", "password")
+}
+
+func (s *testStorage) ListIMAPAccts() ([]string, error) {
+	return []string{"username"}, nil
+}
+
+func (s *testStorage) CreateIMAPAcct(username string) error {
+	return imapsql.ErrUserAlreadyExists
+}
+
+type testQueue struct {
+	module.Module
+	entries []queue.Entry
+}
+
+func (q *testQueue) InstanceName() string {
+	return "remote_queue"
+}
+
+func (q *testQueue) Entries() ([]queue.Entry, error) {
+	return q.entries, nil
+}
+
+func testEndpoint(t *testing.T) *Endpoint {
+	t.Helper()
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokenFile, []byte("# dashboards\n"+testToken+"\n\nother-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	mod, err := New(modName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := mod.(*Endpoint)
+	err = e.Init(config.NewMap(map[string]interface{}{"hostname": "mx.example.org"}, config.Node{
+		Children: []config.Node{
+			{Name: "token_file", Args: []string{tokenFile}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+
+	e.userDB = &testUserDB{users: map[string]string{"user@example.org": "123"}}
+	e.storage = &testStorage{be: memory.New()}
+	e.queues = func() []QueueLister {
+		return []QueueLister{&testQueue{entries: []queue.Entry{
+			{ID: "msg1", From: "a@example.org", To: []string{"b@example.com"}, FirstAttempt: time.Now()},
+		}}}
+	}
+	return e
+}
+
+func TestInit_PlainTCP(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(tokenFile, []byte(testToken+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for addr, ok := range map[string]bool{
+		"tcp://127.0.0.1:0": true,
+		"tcp://[::1]:0":     true,
+		"tcp://0.0.0.0:0":   false,
+		"tcp://:0":          false,
+	} {
+		mod, err := New(modName, []string{addr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := mod.(*Endpoint)
+		err = e.Init(config.NewMap(map[string]interface{}{"hostname": "mx.example.org"}, config.Node{
+			Children: []config.Node{
+				{Name: "token_file", Args: []string{tokenFile}},
+			},
+		}))
+		e.Close()
+		if ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", addr, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("%s: plain TCP listener is accepted", addr)
+		}
+	}
+}
+
+func do(e *Endpoint, method, target, token, body string) (*http.Response, string) {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	e.serv.Handler.ServeHTTP(rec, req)
+	resp := rec.Result()
+	b, _ := io.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func TestAuth(t *testing.T) {
+	e := testEndpoint(t)
+
+	for _, token := range []string{"", "wrong", "# dashboards", testToken + "x"} {
+		resp, _ := do(e, "GET", "/api/v1/users", token, "")
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("token %q: expected 401, got %d", token, resp.StatusCode)
+		}
+	}
+	for _, token := range []string{testToken, "other-token"} {
+		resp, _ := do(e, "GET", "/api/v1/users", token, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("token %q: expected 200, got %d", token, resp.StatusCode)
+		}
+	}
+
+	resp, body := do(e, "GET", OpenAPIPath, "", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("openapi: expected 200, got %d", resp.StatusCode)
+	}
+	var spec map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &spec); err != nil {
+		t.Fatal("openapi:", err)
+	}
+}
+
+func TestUsers(t *testing.T) {
+	e := testEndpoint(t)
+	db := e.userDB.(*testUserDB)
+
+	resp, _ := do(e, "POST", "/api/v1/users", testToken, `{"username":"new@example.org","password":"pass"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d", resp.StatusCode)
+	}
+	if db.users["new@example.org"] != "pass" {
+		t.Fatal("user not created")
+	}
+
+	resp, _ = do(e, "POST", "/api/v1/users", testToken, `{"username":"new@example.org"}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("create without password: expected 400, got %d", resp.StatusCode)
+	}
+	resp, _ = do(e, "POST", "/api/v1/users", testToken, `{"username":"x","password":"y","admin":true}`)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("create with unknown field: expected 400, got %d", resp.StatusCode)
+	}
+
+	resp, _ = do(e, "PUT", "/api/v1/users/new@example.org/password", testToken, `{"password":"changed"}`)
+	if resp.StatusCode != http.StatusNoContent || db.users["new@example.org"] != "changed" {
+		t.Fatalf("set password: got %d", resp.StatusCode)
+	}
+
+	resp, _ = do(e, "DELETE", "/api/v1/users/new@example.org", testToken, "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete: expected 204, got %d", resp.StatusCode)
+	}
+	if _, ok := db.users["new@example.org"]; ok {
+		t.Fatal("user not deleted")
+	}
+
+	e.userDB = nil
+	resp, _ = do(e, "GET", "/api/v1/users", testToken, "")
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("no credentials: expected 501, got %d", resp.StatusCode)
+	}
+}
+
+func TestMailboxesAndMessages(t *testing.T) {
+	e := testEndpoint(t)
+
+	resp, _ := do(e, "GET", "/api/v1/accounts/nobody/mailboxes", testToken, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown account: expected 404, got %d", resp.StatusCode)
+	}
+	resp, _ = do(e, "POST", "/api/v1/accounts", testToken, `{"username":"username"}`)
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("existing account: expected 409, got %d", resp.StatusCode)
+	}
+
+	resp, _ = do(e, "POST", "/api/v1/accounts/username/mailboxes", testToken, `{"name":"Work/Reports"}`)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create mailbox: expected 201, got %d", resp.StatusCode)
+	}
+	resp, _ = do(e, "PATCH", "/api/v1/accounts/username/mailboxes/Work%2FReports", testToken, `{"name":"Reports"}`)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("rename mailbox: expected 204, got %d", resp.StatusCode)
+	}
+
+	resp, body := do(e, "GET", "/api/v1/accounts/username/mailboxes", testToken, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("list mailboxes: expected 200, got %d", resp.StatusCode)
+	}
+	var mboxes []mailboxInfo
+	if err := json.Unmarshal([]byte(body), &mboxes); err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, mbox := range mboxes {
+		names[mbox.Name] = true
+	}
+	if !names["INBOX"] || !names["Reports"] || names["Work/Reports"] {
+		t.Errorf("wrong mailboxes: %v", body)
+	}
+
+	resp, body = do(e, "POST", "/api/v1/accounts/username/mailboxes/Reports/messages?flag=%5CFlagged", testToken,
+		"From: a@example.org\r\nSubject: Hi\r\n\r\nHello\r\n")
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("add message: expected 201, got %d: %s", resp.StatusCode, body)
+	}
+
+	resp, _ = do(e, "POST", "/api/v1/accounts/username/mailboxes/Reports/messages/flags", testToken,
+		`{"set":"1","op":"add","flags":["\\Seen"]}`)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("add flags: expected 204, got %d", resp.StatusCode)
+	}
+
+	resp, body = do(e, "GET", "/api/v1/accounts/username/mailboxes/Reports/messages", testToken, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("list messages: expected 200, got %d", resp.StatusCode)
+	}
+	var msgs []messageInfo
+	if err := json.Unmarshal([]byte(body), &msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %s", body)
+	}
+	flags := strings.Join(msgs[0].Flags, " ")
+	if !strings.Contains(flags, `\Flagged`) || !strings.Contains(flags, `\Seen`) {
+		t.Errorf("wrong flags: %v", msgs[0].Flags)
+	}
+
+	resp, _ = do(e, "GET", "/api/v1/accounts/username/mailboxes/Nonexistent/messages", testToken, "")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown mailbox: expected 404, got %d", resp.StatusCode)
+	}
+
+	// The memory backend can't remove messages without EXPUNGE.
+	resp, _ = do(e, "DELETE", "/api/v1/accounts/username/mailboxes/Reports/messages?set=1", testToken, "")
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("delete messages: expected 501, got %d", resp.StatusCode)
+	}
+
+	resp, _ = do(e, "DELETE", "/api/v1/accounts/username/mailboxes/Reports", testToken, "")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete mailbox: expected 204, got %d", resp.StatusCode)
+	}
+}
+
+func TestQueueAndStatus(t *testing.T) {
+	e := testEndpoint(t)
+
+	resp, body := do(e, "GET", "/api/v1/queue", testToken, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("queue: expected 200, got %d", resp.StatusCode)
+	}
+	var queues []queueStatus
+	if err := json.Unmarshal([]byte(body), &queues); err != nil {
+		t.Fatal(err)
+	}
+	if len(queues) != 1 || queues[0].Name != "remote_queue" || len(queues[0].Entries) != 1 || queues[0].Entries[0].ID != "msg1" {
+		t.Errorf("wrong queue status: %s", body)
+	}
+
+	resp, body = do(e, "GET", "/api/v1/status", testToken, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status: expected 200, got %d", resp.StatusCode)
+	}
+	var st status
+	if err := json.Unmarshal([]byte(body), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Hostname != "mx.example.org" || st.Queued != 1 {
+		t.Errorf("wrong status: %s", body)
+	}
+}
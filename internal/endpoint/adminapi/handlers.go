@@ -0,0 +1,711 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package adminapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/target/queue"
+)
+
+// QueueLister is implemented by queue modules that can report the messages
+// waiting for delivery.
+type QueueLister interface {
+	module.Module
+	Entries() ([]queue.Entry, error)
+}
+
+// specialUseUser is implemented by storage accounts supporting the
+// SPECIAL-USE IMAP extension.
+type specialUseUser interface {
+	CreateMailboxSpecial(name, specialUseAttr string) error
+}
+
+// appendLimitUser is implemented by storage accounts supporting per-user
+// APPENDLIMIT.
+type appendLimitUser interface {
+	imapbackend.AppendLimitUser
+	SetMessageLimit(val *uint32) error
+}
+
+// messageRemover is implemented by mailboxes that can delete messages
+// without the \Deleted flag and EXPUNGE.
+type messageRemover interface {
+	DelMessages(uid bool, seqset *imap.SeqSet) error
+}
+
+var specialUseAttrs = map[string]string{
+	"archive": imap.ArchiveAttr,
+	"drafts":  imap.DraftsAttr,
+	"junk":    imap.JunkAttr,
+	"sent":    imap.SentAttr,
+	"trash":   imap.TrashAttr,
+}
+
+// defaultSpecialUse lists mailboxes created for new accounts, matching the
+// imap-acct create command.
+var defaultSpecialUse = map[string]string{
+	"sent":    "Sent",
+	"trash":   "Trash",
+	"junk":    "Junk",
+	"drafts":  "Drafts",
+	"archive": "Archive",
+}
+
+var (
+	errNoUserDB  = errors.New("credentials management is not configured")
+	errNoStorage = errors.New("storage management is not configured")
+)
+
+func initializedQueues() []QueueLister {
+	var queues []QueueLister
+	for _, info := range module.Instances() {
+		if !info.Initialized {
+			continue
+		}
+		mod, err := module.GetInstance(info.Name)
+		if err != nil {
+			continue
+		}
+		if q, ok := mod.(QueueLister); ok {
+			queues = append(queues, q)
+		}
+	}
+	return queues
+}
+
+func (e *Endpoint) handler() http.Handler {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /api/v1/status", e.getStatus)
+	api.HandleFunc("GET /api/v1/modules", e.getModules)
+	api.HandleFunc("GET /api/v1/queue", e.getQueue)
+
+	api.HandleFunc("GET /api/v1/users", e.listUsers)
+	api.HandleFunc("POST /api/v1/users", e.createUser)
+	api.HandleFunc("PUT /api/v1/users/{username}/password", e.setPassword)
+	api.HandleFunc("DELETE /api/v1/users/{username}", e.deleteUser)
+
+	api.HandleFunc("GET /api/v1/accounts", e.listAccounts)
+	api.HandleFunc("POST /api/v1/accounts", e.createAccount)
+	api.HandleFunc("DELETE /api/v1/accounts/{username}", e.deleteAccount)
+	api.HandleFunc("GET /api/v1/accounts/{username}/appendlimit", e.getAppendLimit)
+	api.HandleFunc("PUT /api/v1/accounts/{username}/appendlimit", e.setAppendLimit)
+
+	api.HandleFunc("GET /api/v1/accounts/{username}/mailboxes", e.listMailboxes)
+	api.HandleFunc("POST /api/v1/accounts/{username}/mailboxes", e.createMailbox)
+	api.HandleFunc("PATCH /api/v1/accounts/{username}/mailboxes/{mailbox}", e.renameMailbox)
+	api.HandleFunc("DELETE /api/v1/accounts/{username}/mailboxes/{mailbox}", e.deleteMailbox)
+
+	api.HandleFunc("GET /api/v1/accounts/{username}/mailboxes/{mailbox}/messages", e.listMessages)
+	api.HandleFunc("POST /api/v1/accounts/{username}/mailboxes/{mailbox}/messages", e.addMessage)
+	api.HandleFunc("POST /api/v1/accounts/{username}/mailboxes/{mailbox}/messages/flags", e.updateFlags)
+	api.HandleFunc("DELETE /api/v1/accounts/{username}/mailboxes/{mailbox}/messages", e.deleteMessages)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+OpenAPIPath, serveOpenAPI)
+	mux.Handle(APIPrefix+"/", e.requireAuth(api))
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if v != nil {
+		_ = json.NewEncoder(w).Encode(v)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// fail writes the error using the status code matching the error value.
+func (e *Endpoint) fail(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errNoUserDB), errors.Is(err, errNoStorage):
+		status = http.StatusNotImplemented
+	case errors.Is(err, imapsql.ErrUserDoesntExists), errors.Is(err, imapbackend.ErrNoSuchMailbox):
+		status = http.StatusNotFound
+	case errors.Is(err, imapsql.ErrUserAlreadyExists), errors.Is(err, imapbackend.ErrMailboxAlreadyExists):
+		status = http.StatusConflict
+	}
+	if status == http.StatusInternalServerError {
+		e.logger.Error("request failed", err, "method", r.Method, "path", r.URL.Path)
+	}
+	writeError(w, status, err)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSz))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("malformed request body: %w", err))
+		return false
+	}
+	return true
+}
+
+type status struct {
+	Hostname  string    `json:"hostname"`
+	Started   time.Time `json:"started"`
+	Modules   int       `json:"modules"`
+	Queued    int       `json:"queued"`
+	Endpoints []string  `json:"client_endpoints,omitempty"`
+}
+
+func (e *Endpoint) getStatus(w http.ResponseWriter, r *http.Request) {
+	st := status{
+		Hostname: e.hostname,
+		Started:  e.started,
+		Modules:  len(module.Instances()),
+	}
+	for _, q := range e.queues() {
+		entries, err := q.Entries()
+		if err != nil {
+			e.fail(w, r, err)
+			return
+		}
+		st.Queued += len(entries)
+	}
+	for _, proto := range []string{module.ClientIMAP, module.ClientSubmission} {
+		for _, endp := range module.ClientEndpoints(proto) {
+			st.Endpoints = append(st.Endpoints, endp.Protocol+"/"+strconv.Itoa(endp.Port))
+		}
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+func (e *Endpoint) getModules(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, module.Instances())
+}
+
+type queueStatus struct {
+	Name    string        `json:"name"`
+	Entries []queue.Entry `json:"entries"`
+}
+
+func (e *Endpoint) getQueue(w http.ResponseWriter, r *http.Request) {
+	queues := []queueStatus{}
+	for _, q := range e.queues() {
+		entries, err := q.Entries()
+		if err != nil {
+			e.fail(w, r, fmt.Errorf("%s: %w", q.InstanceName(), err))
+			return
+		}
+		queues = append(queues, queueStatus{Name: q.InstanceName(), Entries: entries})
+	}
+	writeJSON(w, http.StatusOK, queues)
+}
+
+type userRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (e *Endpoint) listUsers(w http.ResponseWriter, r *http.Request) {
+	if e.userDB == nil {
+		e.fail(w, r, errNoUserDB)
+		return
+	}
+	list, err := e.userDB.ListUsers()
+	if err != nil {
+		e.fail(w, r, err)
+		return
+	}
+	if list == nil {
+		list = []string{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (e *Endpoint) createUser(w http.ResponseWriter, r *http.Request) {
+	if e.userDB == nil {
+		e.fail(w, r, errNoUserDB)
+		return
+	}
+	var req userRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		writeError(w, http.StatusBadRequest, errors.New("username and password are required"))
+		return
+	}
+	if err := e.userDB.CreateUser(req.Username, req.Password); err != nil {
+		e.fail(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, nil)
+}
+
+func (e *Endpoint) setPassword(w http.ResponseWriter, r *http.Request) {
+	if e.userDB == nil {
+		e.fail(w, r, errNoUserDB)
+		return
+	}
+	var req userRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Password == "" {
+		writeError(w, http.StatusBadRequest, errors.New("password is required"))
+		return
+	}
+	if err := e.userDB.SetUserPassword(r.PathValue("username"), req.Password); err != nil {
+		e.fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (e *Endpoint) deleteUser(w http.ResponseWriter, r *http.Request) {
+	if e.userDB == nil {
+		e.fail(w, r, errNoUserDB)
+		return
+	}
+	if err := e.userDB.DeleteUser(r.PathValue("username")); err != nil {
+		e.fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type accountRequest struct {
+	Username string `json:"username"`
+	// SpecialUse maps special-use names (sent, trash, junk, drafts,
+	// archive) to mailbox names. If nil, defaultSpecialUse is used.
+	SpecialUse map[string]string `json:"special_use"`
+}
+
+func (e *Endpoint) listAccounts(w http.ResponseWriter, r *http.Request) {
+	if e.storage == nil {
+		e.fail(w, r, errNoStorage)
+		return
+	}
+	list, err := e.storage.ListIMAPAccts()
+	if err != nil {
+		e.fail(w, r, err)
+		return
+	}
+	if list == nil {
+		list = []string{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (e *Endpoint) createAccount(w http.ResponseWriter, r *http.Request) {
+	if e.storage == nil {
+		e.fail(w, r, errNoStorage)
+		return
+	}
+	var req accountRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Username == "" {
+		writeError(w, http.StatusBadRequest, errors.New("username is required"))
+		return
+	}
+	if req.SpecialUse == nil {
+		req.SpecialUse = defaultSpecialUse
+	}
+	for special := range req.SpecialUse {
+		if _, ok := specialUseAttrs[special]; !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown special-use attribute: %s", special))
+			return
+		}
+	}
+
+	if err := e.storage.CreateIMAPAcct(req.Username); err != nil {
+		e.fail(w, r, err)
+		return
+	}
+	u, err := e.storage.GetIMAPAcct(req.Username)
+	if err != nil {
+		e.fail(w, r, err)
+		return
+	}
+	defer u.Logout()
+
+	for special, name := range req.SpecialUse {
+		if name == "" {
+			continue
+		}
+		var err error
+		if suu, ok := u.(specialUseUser); ok {
+			err = suu.CreateMailboxSpecial(name, specialUseAttrs[special])
+		} else {
+			err = u.CreateMailbox(name)
+		}
+		if err != nil {
+			e.logger.Error("failed to create special-use mailbox", err, "username", req.Username, "mailbox", name)
+		}
+	}
+	writeJSON(w, http.StatusCreated, nil)
+}
+
+func (e *Endpoint) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	if e.storage == nil {
+		e.fail(w, r, errNoStorage)
+		return
+	}
+	if err := e.storage.DeleteIMAPAcct(r.PathValue("username")); err != nil {
+		e.fail(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// account calls f with the storage account named in the request path.
+func (e *Endpoint) account(w http.ResponseWriter, r *http.Request, f func(u imapbackend.User) error) {
+	if e.storage == nil {
+		e.fail(w, r, errNoStorage)
+		return
+	}
+	u, err := e.storage.GetIMAPAcct(r.PathValue("username"))
+	if err != nil {
+		e.fail(w, r, err)
+		return
+	}
+	defer u.Logout()
+	if err := f(u); err != nil {
+		e.fail(w, r, err)
+	}
+}
+
+type appendLimit struct {
+	// Limit is the maximum message size in bytes, null means no limit.
+	Limit *uint32 `json:"limit"`
+}
+
+func (e *Endpoint) getAppendLimit(w http.ResponseWriter, r *http.Request) {
+	e.account(w, r, func(u imapbackend.User) error {
+		userAL, ok := u.(appendLimitUser)
+		if !ok {
+			writeError(w, http.StatusNotImplemented, errors.New("storage does not support per-user append limit"))
+			return nil
+		}
+		writeJSON(w, http.StatusOK, appendLimit{Limit: userAL.CreateMessageLimit()})
+		return nil
+	})
+}
+
+func (e *Endpoint) setAppendLimit(w http.ResponseWriter, r *http.Request) {
+	var req appendLimit
+	if !readJSON(w, r, &req) {
+		return
+	}
+	e.account(w, r, func(u imapbackend.User) error {
+		userAL, ok := u.(appendLimitUser)
+		if !ok {
+			writeError(w, http.StatusNotImplemented, errors.New("storage does not support per-user append limit"))
+			return nil
+		}
+		if err := userAL.SetMessageLimit(req.Limit); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+}
+
+type mailboxInfo struct {
+	Name       string   `json:"name"`
+	Attributes []string `json:"attributes"`
+	Delimiter  string   `json:"delimiter"`
+}
+
+type mailboxRequest struct {
+	Name       string `json:"name"`
+	SpecialUse string `json:"special_use,omitempty"`
+}
+
+func (e *Endpoint) listMailboxes(w http.ResponseWriter, r *http.Request) {
+	subscribed, _ := strconv.ParseBool(r.URL.Query().Get("subscribed"))
+	e.account(w, r, func(u imapbackend.User) error {
+		mboxes, err := u.ListMailboxes(subscribed)
+		if err != nil {
+			return err
+		}
+		list := make([]mailboxInfo, 0, len(mboxes))
+		for _, mbox := range mboxes {
+			attrs := mbox.Attributes
+			if attrs == nil {
+				attrs = []string{}
+			}
+			list = append(list, mailboxInfo{Name: mbox.Name, Attributes: attrs, Delimiter: mbox.Delimiter})
+		}
+		writeJSON(w, http.StatusOK, list)
+		return nil
+	})
+}
+
+func (e *Endpoint) createMailbox(w http.ResponseWriter, r *http.Request) {
+	var req mailboxRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("name is required"))
+		return
+	}
+	e.account(w, r, func(u imapbackend.User) error {
+		if req.SpecialUse != "" {
+			attr, ok := specialUseAttrs[req.SpecialUse]
+			if !ok {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("unknown special-use attribute: %s", req.SpecialUse))
+				return nil
+			}
+			suu, ok := u.(specialUseUser)
+			if !ok {
+				writeError(w, http.StatusNotImplemented, errors.New("storage does not support SPECIAL-USE IMAP extension"))
+				return nil
+			}
+			if err := suu.CreateMailboxSpecial(req.Name, attr); err != nil {
+				return err
+			}
+		} else if err := u.CreateMailbox(req.Name); err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, nil)
+		return nil
+	})
+}
+
+func (e *Endpoint) renameMailbox(w http.ResponseWriter, r *http.Request) {
+	var req mailboxRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("name is required"))
+		return
+	}
+	e.account(w, r, func(u imapbackend.User) error {
+		if err := u.RenameMailbox(r.PathValue("mailbox"), req.Name); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+}
+
+func (e *Endpoint) deleteMailbox(w http.ResponseWriter, r *http.Request) {
+	e.account(w, r, func(u imapbackend.User) error {
+		if err := u.DeleteMailbox(r.PathValue("mailbox")); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+}
+
+// mailbox calls f with the mailbox named in the request path.
+func (e *Endpoint) mailbox(w http.ResponseWriter, r *http.Request, readOnly bool, f func(mbox imapbackend.Mailbox) error) {
+	e.account(w, r, func(u imapbackend.User) error {
+		_, mbox, err := u.GetMailbox(r.PathValue("mailbox"), readOnly, nil)
+		if err != nil {
+			return err
+		}
+		defer mbox.Close()
+		return f(mbox)
+	})
+}
+
+// seqSet parses the set and uid query parameters. The set defaults to all
+// messages, uid to false.
+func seqSet(r *http.Request) (*imap.SeqSet, bool, error) {
+	setStr := r.URL.Query().Get("set")
+	if setStr == "" {
+		setStr = "1:*"
+	}
+	seq, err := imap.ParseSeqSet(setStr)
+	if err != nil {
+		return nil, false, err
+	}
+	useUID, _ := strconv.ParseBool(r.URL.Query().Get("uid"))
+	return seq, useUID, nil
+}
+
+type messageInfo struct {
+	SeqNum uint32    `json:"seq_num"`
+	UID    uint32    `json:"uid"`
+	Flags  []string  `json:"flags"`
+	Date   time.Time `json:"date"`
+	Size   uint32    `json:"size"`
+}
+
+func (e *Endpoint) listMessages(w http.ResponseWriter, r *http.Request) {
+	seq, useUID, err := seqSet(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	e.mailbox(w, r, true, func(mbox imapbackend.Mailbox) error {
+		items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size}
+		ch := make(chan *imap.Message, 1)
+		done := make(chan error, 1)
+		go func() {
+			done <- mbox.ListMessages(useUID, seq, items, ch)
+		}()
+
+		list := []messageInfo{}
+		for msg := range ch {
+			flags := msg.Flags
+			if flags == nil {
+				flags = []string{}
+			}
+			list = append(list, messageInfo{
+				SeqNum: msg.SeqNum,
+				UID:    msg.Uid,
+				Flags:  flags,
+				Date:   msg.InternalDate,
+				Size:   msg.Size,
+			})
+		}
+		if err := <-done; err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, list)
+		return nil
+	})
+}
+
+// addMessage appends the message in the request body to the mailbox.
+// Flags are taken from the repeated flag query parameter, the internal date
+// from the RFC 3339 date parameter.
+func (e *Endpoint) addMessage(w http.ResponseWriter, r *http.Request) {
+	flags := r.URL.Query()["flag"]
+	if flags == nil {
+		flags = []string{}
+	}
+	date := time.Now()
+	if dateStr := r.URL.Query().Get("date"); dateStr != "" {
+		parsed, err := time.Parse(time.RFC3339, dateStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid date format: %w", err))
+			return
+		}
+		date = parsed
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, http.MaxBytesReader(w, r.Body, maxMessageSz)); err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if buf.Len() == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("empty message"))
+		return
+	}
+
+	e.account(w, r, func(u imapbackend.User) error {
+		name := r.PathValue("mailbox")
+		status, err := u.Status(name, []imap.StatusItem{imap.StatusUidNext})
+		if err != nil {
+			return err
+		}
+		if err := u.CreateMessage(name, flags, date, &buf, nil); err != nil {
+			return err
+		}
+		// TODO: Use APPENDUID
+		writeJSON(w, http.StatusCreated, map[string]uint32{"uid": status.UidNext})
+		return nil
+	})
+}
+
+type flagsRequest struct {
+	Set string `json:"set"`
+	UID bool   `json:"uid"`
+	// Op is one of "add", "remove" or "set".
+	Op    string   `json:"op"`
+	Flags []string `json:"flags"`
+}
+
+func (e *Endpoint) updateFlags(w http.ResponseWriter, r *http.Request) {
+	var req flagsRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	var op imap.FlagsOp
+	switch req.Op {
+	case "add":
+		op = imap.AddFlags
+	case "remove":
+		op = imap.RemoveFlags
+	case "set":
+		op = imap.SetFlags
+	default:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown flags operation: %q", req.Op))
+		return
+	}
+	seq, err := imap.ParseSeqSet(req.Set)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Flags == nil {
+		req.Flags = []string{}
+	}
+
+	e.mailbox(w, r, false, func(mbox imapbackend.Mailbox) error {
+		if err := mbox.UpdateMessagesFlags(req.UID, seq, op, true, req.Flags); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+}
+
+func (e *Endpoint) deleteMessages(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("set") == "" {
+		writeError(w, http.StatusBadRequest, errors.New("set is required"))
+		return
+	}
+	seq, useUID, err := seqSet(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	e.mailbox(w, r, false, func(mbox imapbackend.Mailbox) error {
+		remover, ok := mbox.(messageRemover)
+		if !ok {
+			writeError(w, http.StatusNotImplemented, errors.New("storage does not support messages removal"))
+			return nil
+		}
+		if err := remover.DelMessages(useUID, seq); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	})
+}
@@ -0,0 +1,289 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package autoconfig implements the endpoint serving mail client
+// configuration: Thunderbird autoconfig, Outlook Autodiscover and Apple
+// configuration profiles.
+//
+// Server ports are taken from imap and submission endpoints running in the
+// same process.
+package autoconfig
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/address"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	tls2 "github.com/sirrchat/SirrMesh/framework/config/tls"
+	"github.com/sirrchat/SirrMesh/framework/dns"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+const modName = "autoconfig"
+
+const (
+	ThunderbirdPath   = "/mail/config-v1.1.xml"
+	WellKnownPath     = "/.well-known/autoconfig/mail/config-v1.1.xml"
+	AutodiscoverPath  = "/autodiscover/autodiscover.xml"
+	MobileconfigPath  = "/mobileconfig"
+	maxAutodiscoverSz = 64 * 1024
+)
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	hostname    string
+	displayName string
+	domains     map[string]struct{}
+	tlsConfig   *tls.Config
+
+	// endpoints returns client endpoints of the protocol, replaced in tests.
+	endpoints func(protocol string) []module.ClientEndpoint
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:     args,
+		logger:    log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		endpoints: module.ClientEndpoints,
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	var domains []string
+	cfg.String("hostname", true, true, "", &e.hostname)
+	cfg.String("display_name", false, false, "", &e.displayName)
+	cfg.StringList("domains", false, false, nil, &domains)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
+	cfg.Logger(true, false, &e.logger)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if len(domains) != 0 {
+		e.domains = make(map[string]struct{}, len(domains))
+		for _, d := range domains {
+			domain, err := dns.ForLookup(d)
+			if err != nil {
+				return fmt.Errorf("%s: invalid domain %s: %v", modName, d, err)
+			}
+			e.domains[domain] = struct{}{}
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(ThunderbirdPath, e.serveThunderbird)
+	mux.HandleFunc(WellKnownPath, e.serveThunderbird)
+	mux.HandleFunc(MobileconfigPath, e.serveMobileconfig)
+	e.serv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Outlook uses both /autodiscover/ and /Autodiscover/Autodiscover.xml.
+		if strings.EqualFold(r.URL.Path, AutodiscoverPath) {
+			e.serveAutodiscover(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+	e.serv.ReadHeaderTimeout = 10 * time.Second
+	e.serv.ErrorLog = stdlog.New(e.logger.DebugWriter(), "", 0)
+
+	for _, a := range e.addrs {
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		l, err := module.Listen(e, endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			if e.tlsConfig == nil {
+				l.Close()
+				return fmt.Errorf("%s: can't bind on TLS endpoint without TLS configuration", modName)
+			}
+			l = tls.NewListener(l, e.tlsConfig)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	return nil
+}
+
+// hostDomain returns the mail domain for the autoconfig.<domain> or
+// autodiscover.<domain> Host header value.
+func hostDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, prefix := range []string{"autoconfig.", "autodiscover."} {
+		if strings.HasPrefix(strings.ToLower(host), prefix) {
+			return host[len(prefix):]
+		}
+	}
+	return ""
+}
+
+// account returns the configuration for the email address. If email is
+// empty, the domain is taken from the Host header.
+func (e *Endpoint) account(email, host string) (*account, error) {
+	var domain string
+	if email != "" {
+		_, d, err := address.Split(email)
+		if err != nil || d == "" {
+			return nil, fmt.Errorf("malformed email address: %s", email)
+		}
+		domain = d
+	} else {
+		domain = hostDomain(host)
+	}
+	domain, err := dns.ForLookup(domain)
+	if err != nil || domain == "" {
+		return nil, errors.New("unknown domain")
+	}
+	if e.domains != nil {
+		if _, ok := e.domains[domain]; !ok {
+			return nil, errors.New("unknown domain")
+		}
+	}
+
+	displayName := e.displayName
+	if displayName == "" {
+		displayName = domain
+	}
+	return &account{
+		Email:       email,
+		Domain:      domain,
+		DisplayName: displayName,
+		Hostname:    e.hostname,
+		IMAP:        e.endpoints(module.ClientIMAP),
+		Submission:  e.endpoints(module.ClientSubmission),
+	}, nil
+}
+
+func (e *Endpoint) write(w http.ResponseWriter, contentType string, body []byte, err error) {
+	if err != nil {
+		e.logger.Error("failed to generate configuration", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(body); err != nil {
+		e.logger.Debugf("write failed: %v", err)
+	}
+}
+
+func (e *Endpoint) serveThunderbird(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	acct, err := e.account(r.URL.Query().Get("emailaddress"), r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	body, err := acct.thunderbird()
+	e.write(w, "application/xml; charset=utf-8", body, err)
+}
+
+func (e *Endpoint) serveAutodiscover(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var req adRequest
+	if err := xml.NewDecoder(io.LimitReader(r.Body, maxAutodiscoverSz)).Decode(&req); err != nil {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return
+	}
+	email := strings.TrimSpace(req.Request.EMailAddress)
+	if email == "" {
+		http.Error(w, "email address is required", http.StatusBadRequest)
+		return
+	}
+	acct, err := e.account(email, r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	body, err := acct.autodiscover()
+	e.write(w, "application/xml; charset=utf-8", body, err)
+}
+
+func (e *Endpoint) serveMobileconfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		http.Error(w, "email parameter is required", http.StatusBadRequest)
+		return
+	}
+	acct, err := e.account(email, r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	body, err := acct.mobileconfig()
+	w.Header().Set("Content-Disposition", `attachment; filename="`+acct.Domain+`.mobileconfig"`)
+	e.write(w, "application/x-apple-aspen-config", body, err)
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
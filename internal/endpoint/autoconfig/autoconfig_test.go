@@ -0,0 +1,201 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package autoconfig
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+func testEndpoint(t *testing.T) *Endpoint {
+	t.Helper()
+	mod, err := New(modName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := mod.(*Endpoint)
+	e.endpoints = func(protocol string) []module.ClientEndpoint {
+		endps := map[string][]module.ClientEndpoint{
+			module.ClientIMAP: {
+				{Protocol: module.ClientIMAP, Port: 143, StartTLS: true},
+				{Protocol: module.ClientIMAP, Port: 993, TLS: true},
+			},
+			module.ClientSubmission: {
+				{Protocol: module.ClientSubmission, Port: 587, StartTLS: true},
+			},
+		}[protocol]
+		module.SortClientEndpoints(endps)
+		return endps
+	}
+	err = e.Init(config.NewMap(map[string]interface{}{"hostname": "mx.example.org"}, config.Node{
+		Children: []config.Node{
+			{Name: "domains", Args: []string{"example.org"}},
+			{Name: "display_name", Args: []string{"Example & Co"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+func do(e *Endpoint, method, target, body string) (*http.Response, string) {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	e.serv.Handler.ServeHTTP(rec, req)
+	resp := rec.Result()
+	b, _ := io.ReadAll(resp.Body)
+	return resp, string(b)
+}
+
+func TestThunderbird(t *testing.T) {
+	e := testEndpoint(t)
+
+	for _, target := range []string{
+		"https://autoconfig.example.org" + ThunderbirdPath,
+		"https://example.org" + WellKnownPath + "?emailaddress=user%40Example.org",
+	} {
+		resp, body := do(e, http.MethodGet, target, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(target, resp.Status, body)
+		}
+		var cfg tbConfig
+		if err := xml.Unmarshal([]byte(body), &cfg); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Provider.Domain != "example.org" || cfg.Provider.DisplayName != "Example & Co" {
+			t.Errorf("Unexpected provider: %+v", cfg.Provider)
+		}
+		if len(cfg.Provider.Incoming) != 2 || cfg.Provider.Incoming[0].Port != 993 || cfg.Provider.Incoming[0].SocketType != "SSL" {
+			t.Errorf("Unexpected incoming servers: %+v", cfg.Provider.Incoming)
+		}
+		if len(cfg.Provider.Outgoing) != 1 || cfg.Provider.Outgoing[0].SocketType != "STARTTLS" || cfg.Provider.Outgoing[0].Hostname != "mx.example.org" {
+			t.Errorf("Unexpected outgoing servers: %+v", cfg.Provider.Outgoing)
+		}
+	}
+
+	if resp, _ := do(e, http.MethodGet, "https://autoconfig.example.com"+ThunderbirdPath, ""); resp.StatusCode != http.StatusNotFound {
+		t.Error("Unexpected status for unknown domain:", resp.Status)
+	}
+}
+
+func TestAutodiscover(t *testing.T) {
+	e := testEndpoint(t)
+
+	req := `<?xml version="1.0" encoding="utf-8"?>
+<Autodiscover xmlns="http://schemas.microsoft.com/exchange/autodiscover/outlook/requestschema/2006">
+  <Request>
+    <EMailAddress>user@example.org</EMailAddress>
+    <AcceptableResponseSchema>http://schemas.microsoft.com/exchange/autodiscover/outlook/responseschema/2006a</AcceptableResponseSchema>
+  </Request>
+</Autodiscover>`
+	resp, body := do(e, http.MethodPost, "https://autodiscover.example.org/Autodiscover/Autodiscover.xml", req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status, body)
+	}
+	var ad adResponse
+	if err := xml.Unmarshal([]byte(body), &ad); err != nil {
+		t.Fatal(err)
+	}
+	protos := ad.Response.Account.Protocol
+	if len(protos) != 2 {
+		t.Fatalf("Unexpected protocols: %+v", protos)
+	}
+	if protos[0].Type != "IMAP" || protos[0].Port != 993 || protos[0].Encryption != "SSL" || protos[0].LoginName != "user@example.org" {
+		t.Errorf("Unexpected IMAP settings: %+v", protos[0])
+	}
+	if protos[1].Type != "SMTP" || protos[1].Port != 587 || protos[1].Encryption != "TLS" {
+		t.Errorf("Unexpected SMTP settings: %+v", protos[1])
+	}
+	if !strings.Contains(body, `xmlns="`+adOutlookNS+`"`) {
+		t.Error("Response schema namespace is missing")
+	}
+
+	if resp, _ := do(e, http.MethodPost, "https://autodiscover.example.org"+AutodiscoverPath, "garbage"); resp.StatusCode != http.StatusBadRequest {
+		t.Error("Unexpected status for malformed request:", resp.Status)
+	}
+	if resp, _ := do(e, http.MethodGet, "https://autodiscover.example.org"+AutodiscoverPath, ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Unexpected status for GET:", resp.Status)
+	}
+}
+
+func TestMobileconfig(t *testing.T) {
+	e := testEndpoint(t)
+
+	resp, body := do(e, http.MethodGet, "https://example.org"+MobileconfigPath+"?email=user%40example.org", "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-apple-aspen-config" {
+		t.Error("Unexpected Content-Type:", ct)
+	}
+	if err := xml.Unmarshal([]byte(body), new(struct{})); err != nil {
+		t.Fatal("Invalid XML:", err)
+	}
+	for _, want := range []string{
+		"<string>mx.example.org</string>",
+		"<integer>993</integer>",
+		"<integer>587</integer>",
+		"<string>Example &amp; Co</string>",
+		"<string>org.example.mail.user.example.org</string>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("%s is missing in the profile", want)
+		}
+	}
+
+	// The profile should be stable so that reinstalling replaces it.
+	_, again := do(e, http.MethodGet, "https://example.org"+MobileconfigPath+"?email=user%40example.org", "")
+	if again != body {
+		t.Error("Profile is not stable")
+	}
+
+	if resp, _ := do(e, http.MethodGet, "https://example.org"+MobileconfigPath, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Error("Unexpected status without email:", resp.Status)
+	}
+}
+
+func TestClientEndpoint(t *testing.T) {
+	parse := func(s string) config.Endpoint {
+		endp, err := config.ParseEndpoint(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return endp
+	}
+	ce, ok := module.NewClientEndpoint(module.ClientSubmission, parse("tls://0.0.0.0:465"), true)
+	if !ok || ce.SRVName() != "_submissions._tcp" || !ce.TLS || ce.StartTLS {
+		t.Errorf("Unexpected endpoint: %+v %v", ce, ok)
+	}
+	ce, ok = module.NewClientEndpoint(module.ClientIMAP, parse("tcp://0.0.0.0:143"), true)
+	if !ok || ce.SRVName() != "_imap._tcp" || !ce.StartTLS {
+		t.Errorf("Unexpected endpoint: %+v %v", ce, ok)
+	}
+	if _, ok := module.NewClientEndpoint(module.ClientIMAP, parse("tcp://127.0.0.1:143"), true); ok {
+		t.Error("Loopback endpoint should be skipped")
+	}
+}
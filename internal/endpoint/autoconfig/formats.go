@@ -0,0 +1,317 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package autoconfig
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+// account is the client configuration for an email address.
+type account struct {
+	Email       string
+	Domain      string
+	DisplayName string
+	Hostname    string
+	IMAP        []module.ClientEndpoint
+	Submission  []module.ClientEndpoint
+}
+
+type (
+	tbServer struct {
+		Type           string `xml:"type,attr"`
+		Hostname       string `xml:"hostname"`
+		Port           int    `xml:"port"`
+		SocketType     string `xml:"socketType"`
+		Username       string `xml:"username"`
+		Authentication string `xml:"authentication"`
+	}
+	tbProvider struct {
+		ID               string     `xml:"id,attr"`
+		Domain           string     `xml:"domain"`
+		DisplayName      string     `xml:"displayName"`
+		DisplayShortName string     `xml:"displayShortName"`
+		Incoming         []tbServer `xml:"incomingServer"`
+		Outgoing         []tbServer `xml:"outgoingServer"`
+	}
+	tbConfig struct {
+		XMLName  xml.Name   `xml:"clientConfig"`
+		Version  string     `xml:"version,attr"`
+		Provider tbProvider `xml:"emailProvider"`
+	}
+)
+
+func tbSocketType(e module.ClientEndpoint) string {
+	switch {
+	case e.TLS:
+		return "SSL"
+	case e.StartTLS:
+		return "STARTTLS"
+	default:
+		return "plain"
+	}
+}
+
+func tbServers(typ, hostname string, endps []module.ClientEndpoint) []tbServer {
+	servers := make([]tbServer, 0, len(endps))
+	for _, e := range endps {
+		servers = append(servers, tbServer{
+			Type:           typ,
+			Hostname:       hostname,
+			Port:           e.Port,
+			SocketType:     tbSocketType(e),
+			Username:       "%EMAILADDRESS%",
+			Authentication: "password-cleartext",
+		})
+	}
+	return servers
+}
+
+// thunderbird returns the Thunderbird autoconfig file (config-v1.1.xml).
+func (a *account) thunderbird() ([]byte, error) {
+	cfg := tbConfig{
+		Version: "1.1",
+		Provider: tbProvider{
+			ID:               a.Domain,
+			Domain:           a.Domain,
+			DisplayName:      a.DisplayName,
+			DisplayShortName: a.DisplayName,
+			Incoming:         tbServers("imap", a.Hostname, a.IMAP),
+			Outgoing:         tbServers("smtp", a.Hostname, a.Submission),
+		},
+	}
+	return marshalXML(cfg)
+}
+
+const (
+	adRequestNS  = "http://schemas.microsoft.com/exchange/autodiscover/outlook/requestschema/2006"
+	adResponseNS = "http://schemas.microsoft.com/exchange/autodiscover/responseschema/2006"
+	adOutlookNS  = "http://schemas.microsoft.com/exchange/autodiscover/outlook/responseschema/2006a"
+)
+
+type (
+	adRequest struct {
+		XMLName xml.Name `xml:"Autodiscover"`
+		Request struct {
+			EMailAddress             string
+			AcceptableResponseSchema string
+		}
+	}
+	adProtocol struct {
+		Type           string
+		Server         string
+		Port           int
+		DomainRequired string
+		LoginName      string
+		SPA            string
+		SSL            string
+		Encryption     string
+		AuthRequired   string
+	}
+	adResponse struct {
+		XMLName  xml.Name `xml:"Autodiscover"`
+		XMLNS    string   `xml:"xmlns,attr"`
+		Response struct {
+			XMLNS   string `xml:"xmlns,attr"`
+			Account struct {
+				AccountType string
+				Action      string
+				Protocol    []adProtocol
+			}
+		}
+	}
+)
+
+func adProtocolFor(typ, hostname, email string, e module.ClientEndpoint) adProtocol {
+	p := adProtocol{
+		Type:           typ,
+		Server:         hostname,
+		Port:           e.Port,
+		DomainRequired: "off",
+		LoginName:      email,
+		SPA:            "off",
+		SSL:            "off",
+		Encryption:     "None",
+		AuthRequired:   "on",
+	}
+	switch {
+	case e.TLS:
+		p.SSL = "on"
+		p.Encryption = "SSL"
+	case e.StartTLS:
+		p.SSL = "on"
+		p.Encryption = "TLS"
+	}
+	return p
+}
+
+// autodiscover returns the Outlook Autodiscover (POX) response.
+func (a *account) autodiscover() ([]byte, error) {
+	var resp adResponse
+	resp.XMLNS = adResponseNS
+	resp.Response.XMLNS = adOutlookNS
+	resp.Response.Account.AccountType = "email"
+	resp.Response.Account.Action = "settings"
+	if len(a.IMAP) != 0 {
+		resp.Response.Account.Protocol = append(resp.Response.Account.Protocol,
+			adProtocolFor("IMAP", a.Hostname, a.Email, a.IMAP[0]))
+	}
+	if len(a.Submission) != 0 {
+		resp.Response.Account.Protocol = append(resp.Response.Account.Protocol,
+			adProtocolFor("SMTP", a.Hostname, a.Email, a.Submission[0]))
+	}
+	return marshalXML(resp)
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// uuidFor returns a stable UUID-formatted identifier for the name so that
+// downloading the profile again replaces the installed one.
+func uuidFor(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// reverseDomain returns "org.example" for "example.org".
+func reverseDomain(domain string) string {
+	labels := strings.Split(domain, ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".")
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	_ = xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+var mobileconfigTmpl = template.Must(template.New("mobileconfig").Funcs(template.FuncMap{
+	"x": xmlEscape,
+}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>EmailAccountDescription</key>
+			<string>{{x .Email}}</string>
+			<key>EmailAccountType</key>
+			<string>EmailTypeIMAP</string>
+			<key>EmailAddress</key>
+			<string>{{x .Email}}</string>
+			<key>IncomingMailServerAuthentication</key>
+			<string>EmailAuthPassword</string>
+			<key>IncomingMailServerHostName</key>
+			<string>{{x .Hostname}}</string>
+			<key>IncomingMailServerPortNumber</key>
+			<integer>{{.IMAP.Port}}</integer>
+			<key>IncomingMailServerUseSSL</key>
+			<{{.IMAPSecure}}/>
+			<key>IncomingMailServerUsername</key>
+			<string>{{x .Email}}</string>
+			<key>OutgoingMailServerAuthentication</key>
+			<string>EmailAuthPassword</string>
+			<key>OutgoingMailServerHostName</key>
+			<string>{{x .Hostname}}</string>
+			<key>OutgoingMailServerPortNumber</key>
+			<integer>{{.Submission.Port}}</integer>
+			<key>OutgoingMailServerUseSSL</key>
+			<{{.SubmissionSecure}}/>
+			<key>OutgoingMailServerUsername</key>
+			<string>{{x .Email}}</string>
+			<key>OutgoingPasswordSameAsIncomingPassword</key>
+			<true/>
+			<key>PayloadDisplayName</key>
+			<string>{{x .Email}}</string>
+			<key>PayloadIdentifier</key>
+			<string>{{x .Identifier}}.account</string>
+			<key>PayloadType</key>
+			<string>com.apple.mail.managed</string>
+			<key>PayloadUUID</key>
+			<string>{{.AccountUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>{{x .DisplayName}}</string>
+	<key>PayloadIdentifier</key>
+	<string>{{x .Identifier}}</string>
+	<key>PayloadRemovalDisallowed</key>
+	<false/>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.ProfileUUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+func plistBool(e module.ClientEndpoint) string {
+	if e.TLS || e.StartTLS {
+		return "true"
+	}
+	return "false"
+}
+
+// mobileconfig returns the unsigned Apple configuration profile with the
+// mail account.
+func (a *account) mobileconfig() ([]byte, error) {
+	if len(a.IMAP) == 0 || len(a.Submission) == 0 {
+		return nil, fmt.Errorf("no IMAP or submission endpoints")
+	}
+	identifier := reverseDomain(a.Domain) + ".mail." + strings.ReplaceAll(a.Email, "@", ".")
+	var buf bytes.Buffer
+	err := mobileconfigTmpl.Execute(&buf, map[string]interface{}{
+		"Email":            a.Email,
+		"Hostname":         a.Hostname,
+		"DisplayName":      a.DisplayName,
+		"IMAP":             a.IMAP[0],
+		"IMAPSecure":       plistBool(a.IMAP[0]),
+		"Submission":       a.Submission[0],
+		"SubmissionSecure": plistBool(a.Submission[0]),
+		"Identifier":       identifier,
+		"AccountUUID":      uuidFor(identifier + ".account"),
+		"ProfileUUID":      uuidFor(identifier),
+	})
+	return buf.Bytes(), err
+}
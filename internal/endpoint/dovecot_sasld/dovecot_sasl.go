@@ -32,6 +32,7 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/log"
 	"github.com/sirrchat/SirrMesh/framework/module"
 	"github.com/sirrchat/SirrMesh/internal/auth"
+	"github.com/sirrchat/SirrMesh/internal/authguard"
 	"github.com/sirrchat/SirrMesh/internal/authz"
 )
 
@@ -73,6 +74,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.saslAuth.AuthNormalize)
 	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.saslAuth.AuthMap)
+	cfg.Custom("auth_guard", false, false, nil, authguard.Directive, &endp.saslAuth.Guard)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
@@ -88,7 +90,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 				remoteAddr = &net.TCPAddr{IP: req.RemoteIP, Port: int(req.RemotePort)}
 			}
 
-			return endp.saslAuth.CreateSASL(mech, remoteAddr, func(_ string, _ auth.ContextData) error { return nil })
+			return endp.saslAuth.CreateSASL(mech, remoteAddr, nil, func(_ string, _ auth.ContextData) error { return nil })
 		})
 	}
 
@@ -98,7 +100,7 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 			return fmt.Errorf("%s: %v", modName, err)
 		}
 
-		l, err := net.Listen(parsed.Network(), parsed.Address())
+		l, err := module.Listen(endp, parsed.Network(), parsed.Address())
 		if err != nil {
 			return fmt.Errorf("%s: %v", modName, err)
 		}
@@ -21,13 +21,24 @@ package dovecotsasld
 import (
 	"github.com/emersion/go-sasl"
 	dovecotsasl "github.com/foxcpp/go-dovecot-sasl"
+	"github.com/sirrchat/SirrMesh/internal/auth/saslscram"
+	"github.com/sirrchat/SirrMesh/internal/auth/saslxoauth2"
 )
 
 var mechInfo = map[string]dovecotsasl.Mechanism{
+	saslscram.SHA256: {
+		MutualAuth: true,
+	},
 	sasl.Plain: {
 		Plaintext: true,
 	},
 	sasl.Login: {
 		Plaintext: true,
 	},
+	sasl.OAuthBearer: {
+		Plaintext: true,
+	},
+	saslxoauth2.XOAuth2: {
+		Plaintext: true,
+	},
 }
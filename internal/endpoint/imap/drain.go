@@ -0,0 +1,102 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"sync"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+var byeShuttingDown = &imap.StatusResp{
+	Type: imap.StatusRespBye,
+	Info: "Server is shutting down",
+}
+
+// drainState tracks commands in progress so that BYE is sent to each
+// connection only once its current command is finished.
+type drainState struct {
+	lock     sync.Mutex
+	draining bool
+	// busy counts commands in progress per connection. IDLE is not counted
+	// since it lasts until the client decides to stop it.
+	busy map[*imapserver.Context]int
+}
+
+// begin is called before the command is executed. It returns false if the
+// endpoint is draining and the command should not be executed.
+func (d *drainState) begin(conn imapserver.Conn, name string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.draining && name != "LOGOUT" {
+		return false
+	}
+	if name != "IDLE" {
+		if d.busy == nil {
+			d.busy = make(map[*imapserver.Context]int)
+		}
+		d.busy[conn.Context()]++
+	}
+	return true
+}
+
+// end is called after the command is executed, before its tagged response
+// is written. If the endpoint started draining in the meantime, BYE is sent
+// and the connection is closed after the tagged response, the same way as
+// for LOGOUT.
+func (d *drainState) end(conn imapserver.Conn, name string) {
+	d.lock.Lock()
+	if name != "IDLE" {
+		ctx := conn.Context()
+		d.busy[ctx]--
+		if d.busy[ctx] <= 0 {
+			delete(d.busy, ctx)
+		}
+	}
+	draining := d.draining
+	d.lock.Unlock()
+
+	if draining && name != "LOGOUT" {
+		bye(conn)
+	}
+}
+
+func bye(conn imapserver.Conn) {
+	conn.WriteResp(byeShuttingDown) //nolint:errcheck
+	conn.Context().State = imap.LogoutState
+}
+
+// start marks the endpoint as draining and sends BYE to connections without
+// commands in progress (including connections in IDLE).
+func (d *drainState) start(serv *imapserver.Server) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.draining = true
+	serv.ForEachConn(func(c imapserver.Conn) {
+		if d.busy[c.Context()] != 0 {
+			return
+		}
+		// The connection is waiting for the next command in the serve
+		// goroutine, the response is queued to its writer.
+		go c.WriteResp(byeShuttingDown) //nolint:errcheck
+	})
+}
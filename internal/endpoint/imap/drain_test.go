@@ -0,0 +1,132 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// blockExt provides the BLOCK command that waits until release is closed.
+type blockExt struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+type blockHandler struct{ ext *blockExt }
+
+func (blockHandler) Parse([]interface{}) error { return nil }
+
+func (h blockHandler) Handle(imapserver.Conn) error {
+	close(h.ext.started)
+	<-h.ext.release
+	return nil
+}
+
+func (*blockExt) Capabilities(imapserver.Conn) []string { return nil }
+
+func (e *blockExt) Command(name string) imapserver.HandlerFactory {
+	if name != "BLOCK" {
+		return nil
+	}
+	return func() imapserver.Handler { return blockHandler{e} }
+}
+
+func dialTest(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	if line, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(line, "* OK") {
+		t.Fatalf("unexpected greeting: %q %v", line, err)
+	}
+	return conn, r
+}
+
+func expectLine(t *testing.T, r *bufio.Reader, prefix string) {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("expected %q, got %v", prefix, err)
+	}
+	if !strings.HasPrefix(line, prefix) {
+		t.Fatalf("expected %q, got %q", prefix, line)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	var d drainState
+	ext := &blockExt{started: make(chan struct{}), release: make(chan struct{})}
+	serv := imapserver.New(memory.New())
+	serv.AllowInsecureAuth = true
+	serv.Enable(instrumentedExt{ext, "test", &d})
+	builtins := newBuiltinExt(serv)
+	serv.Enable(instrumentedExt{builtins, "test", &d})
+	builtins.enabled = true
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serv.Serve(l)
+	defer serv.Close()
+
+	_, idleR := dialTest(t, l.Addr().String())
+	busy, busyR := dialTest(t, l.Addr().String())
+	if _, err := busy.Write([]byte("a1 BLOCK\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-ext.started
+
+	d.start(serv)
+
+	// The idle connection is told to disconnect right away...
+	expectLine(t, idleR, "* BYE")
+
+	// ... the busy one once the command is finished.
+	busy.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if line, err := busyR.ReadString('\n'); err == nil {
+		t.Fatalf("unexpected response during the command: %q", line)
+	}
+	busy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	close(ext.release)
+	expectLine(t, busyR, "* BYE")
+	expectLine(t, busyR, "a1 OK")
+	if _, err := busyR.ReadString('\n'); err == nil {
+		t.Fatal("connection is not closed after BYE")
+	}
+
+	// New commands are not executed.
+	conn, r := dialTest(t, l.Addr().String())
+	if _, err := conn.Write([]byte("a2 NOOP\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	expectLine(t, r, "* BYE")
+	expectLine(t, r, "a2 NO")
+}
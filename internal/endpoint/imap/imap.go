@@ -43,7 +43,9 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/log"
 	"github.com/sirrchat/SirrMesh/framework/module"
 	"github.com/sirrchat/SirrMesh/internal/auth"
+	"github.com/sirrchat/SirrMesh/internal/authguard"
 	"github.com/sirrchat/SirrMesh/internal/authz"
+	"github.com/sirrchat/SirrMesh/internal/imapext"
 	"github.com/sirrchat/SirrMesh/internal/proxy_protocol"
 	"github.com/sirrchat/SirrMesh/internal/updatepipe"
 )
@@ -63,6 +65,10 @@ type Endpoint struct {
 	storageNormalize authz.NormalizeFunc
 	storageMap       module.Table
 
+	ext *imapext.Extension
+
+	drain drainState
+
 	Log log.Logger
 }
 
@@ -71,7 +77,8 @@ func New(modName string, addrs []string) (module.Module, error) {
 		addrs: addrs,
 		Log:   log.Logger{Name: modName},
 		saslAuth: auth.SASLAuth{
-			Log: log.Logger{Name: modName + "/sasl"},
+			Log:   log.Logger{Name: modName + "/sasl"},
+			Scope: module.AuthScopeIMAP,
 		},
 	}
 
@@ -95,24 +102,26 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	cfg.Bool("insecure_auth", false, false, &insecureAuth)
 	cfg.Bool("io_debug", false, false, &ioDebug)
 	cfg.Bool("io_errors", false, false, &ioErrors)
-	cfg.Bool("debug", true, false, &endp.Log.Debug)
+	cfg.Logger(true, false, &endp.Log)
 	config.EnumMapped(cfg, "storage_map_normalize", false, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.storageNormalize)
 	modconfig.Table(cfg, "storage_map", false, false, nil, &endp.storageMap)
 	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.saslAuth.AuthNormalize)
 	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.saslAuth.AuthMap)
+	cfg.Custom("auth_guard", false, false, nil, authguard.Directive, &endp.saslAuth.Guard)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
-	if updBe, ok := endp.Store.(updatepipe.Backend); ok {
+	if updBe, ok := endp.Store.(updatepipe.Backend); ok && !module.DryRun {
 		if err := updBe.EnableUpdatePipe(updatepipe.ModeReplicate); err != nil {
 			endp.Log.Error("failed to initialize updates pipe", err)
 		}
 	}
 
 	endp.saslAuth.Log.Debug = endp.Log.Debug
+	endp.saslAuth.Log.Level = endp.Log.Level
 
 	addresses := make([]config.Endpoint, 0, len(endp.addrs))
 	for _, addr := range endp.addrs {
@@ -124,8 +133,10 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	}
 
 	endp.serv = imapserver.New(endp)
+	builtins := newBuiltinExt(endp.serv)
 	endp.serv.AllowInsecureAuth = insecureAuth
 	endp.serv.TLSConfig = endp.tlsConfig
+	endp.saslAuth.TLSConfig = endp.tlsConfig
 	if ioErrors {
 		endp.serv.ErrorLog = &endp.Log
 	} else {
@@ -139,10 +150,15 @@ func (endp *Endpoint) Init(cfg *config.Map) error {
 	if err := endp.enableExtensions(); err != nil {
 		return err
 	}
+	endp.serv.Enable(instrumentedExt{builtins, endp.Name(), &endp.drain})
+	builtins.enabled = true
+	if endp.ext != nil {
+		endp.ext.Start()
+	}
 
 	for _, mech := range endp.saslAuth.SASLMechanisms() {
 		endp.serv.EnableAuth(mech, func(c imapserver.Conn) sasl.Server {
-			return endp.saslAuth.CreateSASL(mech, c.Info().RemoteAddr, func(identity string, data auth.ContextData) error {
+			return endp.saslAuth.CreateSASL(mech, c.Info().RemoteAddr, c.Info().TLS, func(identity string, data auth.ContextData) error {
 				return endp.openAccount(c, identity)
 			})
 		})
@@ -155,7 +171,7 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 	for _, addr := range addresses {
 		var l net.Listener
 		var err error
-		l, err = net.Listen(addr.Network(), addr.Address())
+		l, err = module.Listen(endp, addr.Network(), addr.Address())
 		if err != nil {
 			return fmt.Errorf("imap: %v", err)
 		}
@@ -171,8 +187,12 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		if endp.proxyProtocol != nil {
 			l = proxy_protocol.NewListener(l, endp.proxyProtocol, endp.Log)
 		}
+		l = countingListener{Listener: l, module: endp.Name()}
 
 		endp.listeners = append(endp.listeners, l)
+		if ce, ok := module.NewClientEndpoint(module.ClientIMAP, addr, endp.tlsConfig != nil); ok {
+			module.RegisterClientEndpoint(endp, ce)
+		}
 
 		endp.listenersWg.Add(1)
 		go func() {
@@ -202,7 +222,15 @@ func (endp *Endpoint) InstanceName() string {
 	return "imap"
 }
 
+// Drain sends the untagged BYE response to all connected clients so they
+// disconnect instead of waiting in IDLE until the drain period ends. Clients
+// executing a command receive BYE once the command is finished.
+func (endp *Endpoint) Drain() {
+	endp.drain.start(endp.serv)
+}
+
 func (endp *Endpoint) Close() error {
+	module.UnregisterClientEndpoints(endp)
 	for _, l := range endp.listeners {
 		l.Close()
 	}
@@ -260,7 +288,7 @@ func (endp *Endpoint) openAccount(c imapserver.Conn, identity string) error {
 
 func (endp *Endpoint) Login(connInfo *imap.ConnInfo, username, password string) (imapbackend.User, error) {
 	// saslAuth handles AuthMap calling.
-	err := endp.saslAuth.AuthPlain(username, password)
+	err := endp.saslAuth.Authenticate(connInfo.RemoteAddr, username, password)
 	if err != nil {
 		endp.Log.Error("authentication failed", err, "username", username, "src_ip", connInfo.RemoteAddr)
 		return nil, imapbackend.ErrInvalidCredentials
@@ -291,21 +319,38 @@ func (endp *Endpoint) enableExtensions() error {
 	for _, ext := range exts {
 		switch ext {
 		case "I18NLEVEL=1", "I18NLEVEL=2":
-			endp.serv.Enable(i18nlevel.NewExtension())
+			endp.enable(i18nlevel.NewExtension())
 		case "SORT":
-			endp.serv.Enable(sortthread.NewSortExtension())
+			endp.enable(sortthread.NewSortExtension())
 		}
 		if strings.HasPrefix(ext, "THREAD") {
-			endp.serv.Enable(sortthread.NewThreadExtension())
+			endp.enable(sortthread.NewThreadExtension())
 		}
 	}
 
-	endp.serv.Enable(compress.NewExtension())
-	endp.serv.Enable(namespace.NewExtension())
+	// CONDSTORE, QRESYNC, NOTIFY and CREATE-SPECIAL-USE override built-in
+	// commands, so the extension is enabled before them.
+	endp.ext = imapext.New(endp.Store, exts, endp.Log)
+	if endp.ext != nil {
+		endp.enable(endp.ext)
+	}
+
+	endp.enable(compress.NewExtension())
+	endp.enable(namespace.NewExtension())
 
 	return nil
 }
 
+// enable enables the extension with command metrics recorded for its
+// handlers.
+func (endp *Endpoint) enable(ext imapserver.Extension) {
+	if _, ok := ext.(imapserver.ConnExtension); ok {
+		endp.serv.Enable(instrumentedConnExt{instrumentedExt{ext, endp.Name(), &endp.drain}})
+		return
+	}
+	endp.serv.Enable(instrumentedExt{ext, endp.Name(), &endp.drain})
+}
+
 func (endp *Endpoint) SupportedThreadAlgorithms() []sortthread.ThreadAlgorithm {
 	be, ok := endp.Store.(sortthread.ThreadBackend)
 	if !ok {
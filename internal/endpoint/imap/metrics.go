@@ -0,0 +1,235 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imap
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	activeSessions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "imap",
+			Name:      "sessions",
+			Help:      "Amount of currently open IMAP connections",
+		},
+		[]string{"module"},
+	)
+	commandsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "imap",
+			Name:      "commands_total",
+			Help:      "IMAP commands executed by command name and result (ok, no or bad)",
+		},
+		[]string{"module", "command", "result"},
+	)
+	commandDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "imap",
+			Name:      "command_duration_seconds",
+			Help:      "Time taken to execute IMAP commands",
+			Buckets:   []float64{.001, .005, .01, .05, .1, .5, 1, 5, 30},
+		},
+		[]string{"module", "command"},
+	)
+)
+
+// builtinCommands lists commands implemented by go-imap server itself, UID
+// is not included since the commands it wraps are instrumented.
+var builtinCommands = []string{
+	"NOOP", "CAPABILITY", "LOGOUT", "STARTTLS", "LOGIN", "AUTHENTICATE",
+	"SELECT", "EXAMINE", "CREATE", "DELETE", "RENAME", "SUBSCRIBE",
+	"UNSUBSCRIBE", "LIST", "LSUB", "STATUS", "APPEND", "UNSELECT", "IDLE",
+	"CHECK", "CLOSE", "EXPUNGE", "SEARCH", "FETCH", "STORE", "COPY", "MOVE",
+}
+
+// countingListener tracks the amount of open connections in the sessions
+// gauge.
+type countingListener struct {
+	net.Listener
+	module string
+}
+
+type countedConn struct {
+	net.Conn
+	once   sync.Once
+	module string
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	activeSessions.WithLabelValues(l.module).Inc()
+	return &countedConn{Conn: conn, module: l.module}, nil
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() {
+		activeSessions.WithLabelValues(c.module).Dec()
+	})
+	return c.Conn.Close()
+}
+
+// instrumentedExt wraps handlers returned by the extension to record command
+// metrics and track commands in progress for Drain.
+type instrumentedExt struct {
+	imapserver.Extension
+	module string
+	drain  *drainState
+}
+
+func (e instrumentedExt) Command(name string) imapserver.HandlerFactory {
+	f := e.Extension.Command(name)
+	if f == nil {
+		return nil
+	}
+	return func() imapserver.Handler {
+		hdlr := f()
+		wrapped := instrumentedHandler{Handler: hdlr, module: e.module, name: name, drain: e.drain}
+		if _, ok := hdlr.(imapserver.Upgrader); ok {
+			return instrumentedUpgrader{wrapped}
+		}
+		return wrapped
+	}
+}
+
+// instrumentedConnExt is instrumentedExt for extensions that also wrap
+// connections.
+type instrumentedConnExt struct {
+	instrumentedExt
+}
+
+func (e instrumentedConnExt) NewConn(c imapserver.Conn) imapserver.Conn {
+	return e.Extension.(imapserver.ConnExtension).NewConn(c)
+}
+
+// builtinExt exposes built-in command handlers as an extension so they can be
+// wrapped using instrumentedExt.
+//
+// Server.Enable ignores extensions providing the built-in UNSELECT, MOVE and
+// IDLE commands, so handlers are returned only after enabled is set.
+type builtinExt struct {
+	handlers map[string]imapserver.HandlerFactory
+	enabled  bool
+}
+
+func newBuiltinExt(serv *imapserver.Server) *builtinExt {
+	ext := &builtinExt{handlers: make(map[string]imapserver.HandlerFactory, len(builtinCommands))}
+	for _, name := range builtinCommands {
+		ext.handlers[name] = serv.Command(name)
+	}
+	return ext
+}
+
+func (*builtinExt) Capabilities(imapserver.Conn) []string {
+	return nil
+}
+
+func (e *builtinExt) Command(name string) imapserver.HandlerFactory {
+	if !e.enabled {
+		return nil
+	}
+	return e.handlers[name]
+}
+
+type instrumentedHandler struct {
+	imapserver.Handler
+	module string
+	name   string
+	drain  *drainState
+}
+
+func (h instrumentedHandler) observe(name string, start time.Time, err error) {
+	result := "ok"
+	var statusErr *imap.ErrStatusResp
+	if errors.As(err, &statusErr) {
+		switch statusErr.Resp.Type {
+		case imap.StatusRespNo:
+			result = "no"
+		case imap.StatusRespBad:
+			result = "bad"
+		}
+	} else if err != nil {
+		result = "no"
+	}
+	commandsTotal.WithLabelValues(h.module, name, result).Inc()
+	commandDuration.WithLabelValues(h.module, name).Observe(time.Since(start).Seconds())
+}
+
+var errShuttingDown = &imap.ErrStatusResp{Resp: &imap.StatusResp{
+	Type: imap.StatusRespNo,
+	Info: "Server is shutting down",
+}}
+
+func (h instrumentedHandler) Handle(conn imapserver.Conn) error {
+	if !h.drain.begin(conn, h.name) {
+		bye(conn)
+		return errShuttingDown
+	}
+	defer h.drain.end(conn, h.name)
+
+	start := time.Now()
+	err := h.Handler.Handle(conn)
+	h.observe(h.name, start, err)
+	return err
+}
+
+func (h instrumentedHandler) UidHandle(conn imapserver.Conn) error {
+	uidHdlr, ok := h.Handler.(imapserver.UidHandler)
+	if !ok {
+		return errors.New("Command unsupported with UID")
+	}
+
+	if !h.drain.begin(conn, h.name) {
+		bye(conn)
+		return errShuttingDown
+	}
+	defer h.drain.end(conn, h.name)
+
+	start := time.Now()
+	err := uidHdlr.UidHandle(conn)
+	h.observe("UID "+h.name, start, err)
+	return err
+}
+
+type instrumentedUpgrader struct {
+	instrumentedHandler
+}
+
+func (h instrumentedUpgrader) Upgrade(conn imapserver.Conn) error {
+	return h.Handler.(imapserver.Upgrader).Upgrade(conn)
+}
+
+func init() {
+	prometheus.MustRegister(activeSessions)
+	prometheus.MustRegister(commandsTotal)
+	prometheus.MustRegister(commandDuration)
+}
@@ -0,0 +1,194 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package mtasts implements the endpoint serving the MTA-STS policy of the
+// server domains (RFC 8461 Section 3.3).
+package mtasts
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	tls2 "github.com/sirrchat/SirrMesh/framework/config/tls"
+	"github.com/sirrchat/SirrMesh/framework/dns"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+const (
+	modName = "mta_sts"
+
+	// PolicyPath is the well-known location of the policy on the policy host.
+	PolicyPath = "/.well-known/mta-sts.txt"
+)
+
+type Endpoint struct {
+	addrs  []string
+	logger log.Logger
+
+	policy     Policy
+	policyText []byte
+	domains    map[string]struct{}
+	tlsConfig  *tls.Config
+
+	listenersWg sync.WaitGroup
+	serv        http.Server
+}
+
+func New(_ string, args []string) (module.Module, error) {
+	return &Endpoint{
+		addrs:  args,
+		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+	}, nil
+}
+
+func (e *Endpoint) Init(cfg *config.Map) error {
+	var (
+		hostname string
+		domains  []string
+	)
+	policyDirectives(cfg, &e.policy, &hostname)
+	cfg.StringList("domains", false, false, nil, &domains)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
+	cfg.Logger(true, false, &e.logger)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+	if err := e.policy.finish(hostname); err != nil {
+		return err
+	}
+	e.policyText = []byte(e.policy.String())
+
+	if len(domains) != 0 {
+		e.domains = make(map[string]struct{}, len(domains))
+		for _, d := range domains {
+			domain, err := dns.ForLookup(d)
+			if err != nil {
+				return fmt.Errorf("%s: invalid domain %s: %v", modName, d, err)
+			}
+			e.domains[domain] = struct{}{}
+		}
+	}
+
+	e.serv.Handler = e
+	e.serv.ReadHeaderTimeout = 10 * time.Second
+	// TLS handshake errors from scanners are not interesting.
+	e.serv.ErrorLog = stdlog.New(e.logger.DebugWriter(), "", 0)
+
+	for _, a := range e.addrs {
+		endp, err := config.ParseEndpoint(a)
+		if err != nil {
+			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
+		}
+		l, err := module.Listen(e, endp.Network(), endp.Address())
+		if err != nil {
+			return fmt.Errorf("%s: %v", modName, err)
+		}
+		if endp.IsTLS() {
+			if e.tlsConfig == nil {
+				l.Close()
+				return fmt.Errorf("%s: can't bind on TLS endpoint without TLS configuration", modName)
+			}
+			l = tls.NewListener(l, e.tlsConfig)
+		}
+
+		e.listenersWg.Add(1)
+		go func() {
+			e.logger.Println("listening on", endp.String())
+			err := e.serv.Serve(l)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+				e.logger.Error("serve failed", err, "endpoint", a)
+			}
+			e.listenersWg.Done()
+		}()
+	}
+
+	e.logger.Debugf("serving policy with id %s:\n%s", e.policy.ID(), e.policyText)
+	return nil
+}
+
+// policyDomain returns the policy domain for the Host header value or empty
+// string if the host is not a policy host served by the endpoint.
+func (e *Endpoint) policyDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host, err := dns.ForLookup(host)
+	if err != nil {
+		return ""
+	}
+	domain := strings.TrimPrefix(host, "mta-sts.")
+	if domain == host || domain == "" {
+		return ""
+	}
+	if e.domains != nil {
+		if _, ok := e.domains[domain]; !ok {
+			return ""
+		}
+	}
+	return domain
+}
+
+func (e *Endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != PolicyPath || e.policyDomain(r.Host) == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(e.policyText); err != nil {
+		e.logger.Debugf("write failed: %v", err)
+	}
+}
+
+func (e *Endpoint) Name() string {
+	return modName
+}
+
+func (e *Endpoint) InstanceName() string {
+	return ""
+}
+
+func (e *Endpoint) Close() error {
+	if err := e.serv.Close(); err != nil {
+		return err
+	}
+	e.listenersWg.Wait()
+	return nil
+}
+
+func init() {
+	module.RegisterEndpoint(modName, New)
+}
@@ -0,0 +1,122 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mtasts
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+)
+
+var testGlobals = map[string]interface{}{"hostname": "MX.example.org"}
+
+func TestEndpoint(t *testing.T) {
+	mod, err := New(modName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := mod.(*Endpoint)
+	err = e.Init(config.NewMap(testGlobals, config.Node{Children: []config.Node{
+		{Name: "mode", Args: []string{"enforce"}},
+		{Name: "domains", Args: []string{"example.org", "EXAMPLE.net"}},
+	}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	get := func(method, host, path string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(method, "https://"+host+path, nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	resp := get(http.MethodGet, "mta-sts.example.org", PolicyPath)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal("Unexpected status:", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Error("Unexpected Content-Type:", ct)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	want := "version: STSv1\r\nmode: enforce\r\nmx: mx.example.org\r\nmax_age: 604800\r\n"
+	if string(body) != want {
+		t.Errorf("Unexpected policy:\n%q\nwant:\n%q", body, want)
+	}
+
+	if resp := get(http.MethodGet, "MTA-STS.example.net:443", PolicyPath); resp.StatusCode != http.StatusOK {
+		t.Error("Host with port and different case not served:", resp.Status)
+	}
+	for _, host := range []string{"mta-sts.example.com", "example.org", "mta-sts."} {
+		if resp := get(http.MethodGet, host, PolicyPath); resp.StatusCode != http.StatusNotFound {
+			t.Error("Unexpected status for", host, resp.Status)
+		}
+	}
+	if resp := get(http.MethodGet, "mta-sts.example.org", "/"); resp.StatusCode != http.StatusNotFound {
+		t.Error("Unexpected status for other path:", resp.Status)
+	}
+	if resp := get(http.MethodPost, "mta-sts.example.org", PolicyPath); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Unexpected status for POST:", resp.Status)
+	}
+}
+
+func TestReadPolicy(t *testing.T) {
+	block := config.Node{
+		Name: modName,
+		Args: []string{"tls://0.0.0.0:443"},
+		Children: []config.Node{
+			{Name: "mx", Args: []string{"mx1.example.org.", "*.mx.example.org"}},
+			{Name: "max_age", Args: []string{"24h"}},
+			{Name: "tls", Args: []string{"file", "cert.pem", "key.pem"}},
+		},
+	}
+	p, err := ReadPolicy(testGlobals, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "version: STSv1\r\nmode: testing\r\nmx: mx1.example.org\r\nmx: *.mx.example.org\r\nmax_age: 86400\r\n"
+	if p.String() != want {
+		t.Errorf("Unexpected policy:\n%q\nwant:\n%q", p.String(), want)
+	}
+
+	id := p.ID()
+	if len(id) == 0 || len(id) > 32 {
+		t.Fatal("Invalid policy ID:", id)
+	}
+	if p.Record() != "v=STSv1; id="+id {
+		t.Error("Unexpected record:", p.Record())
+	}
+	p.Mode = ModeEnforce
+	if p.ID() == id {
+		t.Error("Policy ID did not change with the policy")
+	}
+
+	block.Children = []config.Node{{Name: "max_age", Args: []string{"500000h"}}}
+	if _, err := ReadPolicy(testGlobals, block); err == nil {
+		t.Error("Expected error for too large max_age")
+	}
+	if _, err := ReadPolicy(nil, config.Node{Name: modName}); err == nil {
+		t.Error("Expected error for missing mx")
+	}
+}
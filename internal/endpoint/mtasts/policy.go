@@ -0,0 +1,114 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package mtasts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+)
+
+const (
+	ModeEnforce = "enforce"
+	ModeTesting = "testing"
+	ModeNone    = "none"
+)
+
+// maxMaxAge is the largest max_age value allowed by RFC 8461.
+const maxMaxAge = 31557600 * time.Second
+
+// Policy is the MTA-STS policy published by the server.
+type Policy struct {
+	Mode   string
+	MX     []string
+	MaxAge time.Duration
+}
+
+// String returns the policy text as served at /.well-known/mta-sts.txt
+// (RFC 8461 Section 3.2).
+func (p *Policy) String() string {
+	var sb strings.Builder
+	sb.WriteString("version: STSv1\r\n")
+	sb.WriteString("mode: " + p.Mode + "\r\n")
+	for _, mx := range p.MX {
+		sb.WriteString("mx: " + mx + "\r\n")
+	}
+	sb.WriteString("max_age: " + strconv.FormatInt(int64(p.MaxAge/time.Second), 10) + "\r\n")
+	return sb.String()
+}
+
+// ID returns the policy identifier for the _mta-sts TXT record. It changes
+// whenever the policy text changes.
+func (p *Policy) ID() string {
+	sum := sha256.Sum256([]byte(p.String()))
+	return hex.EncodeToString(sum[:10])
+}
+
+// Record returns the value of the _mta-sts TXT record for the policy.
+func (p *Policy) Record() string {
+	return "v=STSv1; id=" + p.ID()
+}
+
+// policyDirectives registers the directives defining the policy.
+func policyDirectives(cfg *config.Map, p *Policy, hostname *string) {
+	cfg.String("hostname", true, false, "", hostname)
+	cfg.StringList("mx", false, false, nil, &p.MX)
+	cfg.Enum("mode", false, false, []string{ModeEnforce, ModeTesting, ModeNone}, ModeTesting, &p.Mode)
+	cfg.Duration("max_age", false, false, 7*24*time.Hour, &p.MaxAge)
+}
+
+func (p *Policy) finish(hostname string) error {
+	if len(p.MX) == 0 && hostname != "" {
+		p.MX = []string{hostname}
+	}
+	for i, mx := range p.MX {
+		p.MX[i] = strings.TrimSuffix(strings.ToLower(mx), ".")
+	}
+	if p.Mode != ModeNone && len(p.MX) == 0 {
+		return fmt.Errorf("%s: at least one mx is required", modName)
+	}
+	if p.MaxAge < time.Second || p.MaxAge > maxMaxAge {
+		return fmt.Errorf("%s: max_age should be between 1s and %v", modName, maxMaxAge)
+	}
+	return nil
+}
+
+// ReadPolicy reads the policy from the mta_sts configuration block without
+// initializing the endpoint.
+func ReadPolicy(globals map[string]interface{}, block config.Node) (*Policy, error) {
+	var (
+		p        Policy
+		hostname string
+	)
+	cfg := config.NewMap(globals, block)
+	cfg.AllowUnknown()
+	policyDirectives(cfg, &p, &hostname)
+	if _, err := cfg.Process(); err != nil {
+		return nil, err
+	}
+	if err := p.finish(hostname); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
@@ -0,0 +1,86 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package openmetrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+// healthz reports that the process is alive and serving HTTP requests.
+func healthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz reports whether the server finished the initialization, is not
+// shutting down and all modules implementing module.HealthChecker consider
+// themselves healthy.
+func (e *Endpoint) readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if !e.ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "not ready: server is starting or shutting down")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), e.healthTimeout)
+	defer cancel()
+	results := e.checkHealth(ctx)
+
+	names := make([]string, 0, len(results))
+	failed := false
+	for name, err := range results {
+		names = append(names, name)
+		if err != nil {
+			failed = true
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		if err := results[name]; err != nil {
+			e.logger.Error("health check failed", err, "module", name)
+			fmt.Fprintf(&b, "%s: %v\n", name, err)
+		} else {
+			fmt.Fprintf(&b, "%s: ok\n", name)
+		}
+	}
+
+	if failed {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		b.WriteString("ok\n")
+	}
+	_, _ = w.Write([]byte(b.String()))
+}
+
+func defaultReady() bool {
+	return module.Ready()
+}
+
+const defaultHealthTimeout = 5 * time.Second
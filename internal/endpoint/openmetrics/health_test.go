@@ -0,0 +1,76 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package openmetrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/log"
+)
+
+func testEndpoint(ready bool, results map[string]error) *Endpoint {
+	return &Endpoint{
+		logger:        log.Logger{Name: modName},
+		healthTimeout: time.Second,
+		ready:         func() bool { return ready },
+		checkHealth: func(context.Context) map[string]error {
+			return results
+		},
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	healthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	test := func(e *Endpoint, code int, body ...string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		e.readyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		if rec.Code != code {
+			t.Errorf("expected %d, got %d (%s)", code, rec.Code, rec.Body.String())
+		}
+		for _, b := range body {
+			if !strings.Contains(rec.Body.String(), b) {
+				t.Errorf("body does not contain %q: %s", b, rec.Body.String())
+			}
+		}
+	}
+
+	test(testEndpoint(false, nil), http.StatusServiceUnavailable, "not ready")
+	test(testEndpoint(true, nil), http.StatusOK, "ok")
+	test(testEndpoint(true, map[string]error{
+		"imapsql:local_mailboxes": nil,
+	}), http.StatusOK, "imapsql:local_mailboxes: ok")
+	test(testEndpoint(true, map[string]error{
+		"imapsql:local_mailboxes": nil,
+		"blockchain:ethereum":     errors.New("chain ID mismatch"),
+	}), http.StatusServiceUnavailable, "blockchain:ethereum: chain ID mismatch", "imapsql:local_mailboxes: ok")
+}
@@ -19,15 +19,20 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 package openmetrics
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/sirrchat/SirrMesh/framework/config"
+	tls2 "github.com/sirrchat/SirrMesh/framework/config/tls"
 	"github.com/sirrchat/SirrMesh/framework/log"
 	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/framework/tracing"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -37,26 +42,52 @@ type Endpoint struct {
 	addrs  []string
 	logger log.Logger
 
+	tlsConfig     *tls.Config
+	healthTimeout time.Duration
+
+	// ready and checkHealth are used by /readyz, replaced in tests.
+	ready       func() bool
+	checkHealth func(context.Context) map[string]error
+
 	listenersWg sync.WaitGroup
 	serv        http.Server
 	mux         *http.ServeMux
+
+	shutdownTracing func(context.Context) error
 }
 
 func New(_ string, args []string) (module.Module, error) {
 	return &Endpoint{
-		addrs:  args,
-		logger: log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		addrs:       args,
+		logger:      log.Logger{Name: modName, Debug: log.DefaultLogger.Debug},
+		ready:       defaultReady,
+		checkHealth: module.CheckHealth,
 	}, nil
 }
 
 func (e *Endpoint) Init(cfg *config.Map) error {
-	cfg.Bool("debug", false, false, &e.logger.Debug)
+	cfg.Logger(false, false, &e.logger)
+	cfg.Custom("tls", true, false, nil, tls2.TLSDirective, &e.tlsConfig)
+	cfg.Duration("health_timeout", false, false, defaultHealthTimeout, &e.healthTimeout)
+	var tracingCfg *tracing.Config
+	cfg.Custom("tracing", false, false, nil, tracingBlock, &tracingCfg)
 	if _, err := cfg.Process(); err != nil {
 		return err
 	}
 
+	if tracingCfg != nil && !module.DryRun {
+		shutdown, err := tracing.Setup(*tracingCfg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", modName, err)
+		}
+		e.shutdownTracing = shutdown
+		e.logger.Msg("exporting traces", "endpoint", tracingCfg.Endpoint, "sample_ratio", tracingCfg.SampleRatio)
+	}
+
 	e.mux = http.NewServeMux()
 	e.mux.Handle("/metrics", promhttp.Handler())
+	e.mux.HandleFunc("/healthz", healthz)
+	e.mux.HandleFunc("/readyz", e.readyz)
 	e.serv.Handler = e.mux
 
 	for _, a := range e.addrs {
@@ -64,19 +95,23 @@ func (e *Endpoint) Init(cfg *config.Map) error {
 		if err != nil {
 			return fmt.Errorf("%s: malformed endpoint: %v", modName, err)
 		}
-		if endp.IsTLS() {
-			return fmt.Errorf("%s: TLS is not supported yet", modName)
-		}
-		l, err := net.Listen(endp.Network(), endp.Address())
+		l, err := module.Listen(e, endp.Network(), endp.Address())
 		if err != nil {
 			return fmt.Errorf("%s: %v", modName, err)
 		}
+		if endp.IsTLS() {
+			if e.tlsConfig == nil {
+				l.Close()
+				return fmt.Errorf("%s: can't bind on TLS endpoint without TLS configuration", modName)
+			}
+			l = tls.NewListener(l, e.tlsConfig)
+		}
 
 		e.listenersWg.Add(1)
 		go func() {
 			e.logger.Println("listening on", endp.String())
 			err := e.serv.Serve(l)
-			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			if err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
 				e.logger.Error("serve failed", err, "endpoint", a)
 			}
 			e.listenersWg.Done()
@@ -99,6 +134,14 @@ func (e *Endpoint) Close() error {
 		return err
 	}
 	e.listenersWg.Wait()
+
+	if e.shutdownTracing != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := e.shutdownTracing(ctx); err != nil {
+			e.logger.Error("failed to flush traces", err)
+		}
+	}
 	return nil
 }
 
@@ -0,0 +1,72 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package openmetrics
+
+import (
+	"os"
+	"strings"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/tracing"
+)
+
+func otlpTracesEndpoint() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		return endpoint
+	}
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+	}
+	return "http://localhost:4318/v1/traces"
+}
+
+// tracingBlock parses the tracing configuration block:
+//
+//	tracing {
+//	    endpoint http://localhost:4318/v1/traces
+//	    sample_ratio 1.0
+//	    service_name sirrmesh
+//	    header Authorization "Bearer ..."
+//	}
+func tracingBlock(_ *config.Map, node config.Node) (interface{}, error) {
+	cfg := &tracing.Config{
+		Headers: map[string]string{},
+	}
+	m := config.NewMap(nil, node)
+	m.String("endpoint", false, false, otlpTracesEndpoint(), &cfg.Endpoint)
+	m.Float("sample_ratio", false, false, 1, &cfg.SampleRatio)
+	m.String("service_name", false, false, "sirrmesh", &cfg.ServiceName)
+	m.Callback("header", func(_ *config.Map, node config.Node) error {
+		if len(node.Args) != 2 {
+			return config.NodeErr(node, "expected two arguments: name and value")
+		}
+		cfg.Headers[node.Args[0]] = node.Args[1]
+		return nil
+	})
+	if _, err := m.Process(); err != nil {
+		return nil, err
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, config.NodeErr(node, "sample_ratio should be in [0, 1] range")
+	}
+	if !strings.HasPrefix(cfg.Endpoint, "http://") && !strings.HasPrefix(cfg.Endpoint, "https://") {
+		return nil, config.NodeErr(node, "endpoint should be a http:// or https:// URL")
+	}
+	return cfg, nil
+}
@@ -21,6 +21,7 @@ package smtp
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -29,6 +30,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/emersion/go-sasl"
@@ -39,7 +41,11 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/exterrors"
 	"github.com/sirrchat/SirrMesh/framework/log"
 	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/framework/tracing"
 	"github.com/sirrchat/SirrMesh/internal/auth"
+	"github.com/sirrchat/SirrMesh/internal/msgtrack"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 func limitReader(r io.Reader, n int64, err error) *limitedReader {
@@ -70,12 +76,20 @@ func (l *limitedReader) Read(p []byte) (n int, err error) {
 	return
 }
 
+var errShuttingDown = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "Service shutting down, try again later",
+}
+
 type Session struct {
 	endp *Endpoint
+	conn *smtp.Conn
 
 	// Specific for this session.
 	// sessionCtx is not used for cancellation or timeouts, only for tracing.
 	sessionCtx       context.Context
+	sessionSpan      oteltrace.Span
 	cancelRDNS       func()
 	connState        module.ConnState
 	repeatedMailErrs int
@@ -89,12 +103,19 @@ type Session struct {
 	msgLock     sync.Mutex
 	msgCtx      context.Context
 	msgTask     *trace.Task
+	msgSpan     oteltrace.Span
 	mailFrom    string
 	opts        smtp.MailOptions
 	msgMeta     *module.MsgMetadata
 	delivery    module.Delivery
 	deliveryErr error
 
+	// Usage charged against the authenticated user quotas for the
+	// currently handled message, returned if the message is not accepted.
+	quotaUser  string
+	quotaMsgs  int
+	quotaRcpts int
+
 	log log.Logger
 }
 
@@ -103,7 +124,11 @@ func (s *Session) AuthMechanisms() []string {
 }
 
 func (s *Session) Auth(mech string) (sasl.Server, error) {
-	return s.endp.saslAuth.CreateSASL(mech, s.connState.RemoteAddr, func(identity string, data auth.ContextData) error {
+	var tlsState *tls.ConnectionState
+	if s.connState.TLS.HandshakeComplete {
+		tlsState = &s.connState.TLS
+	}
+	return s.endp.saslAuth.CreateSASL(mech, s.connState.RemoteAddr, tlsState, func(identity string, data auth.ContextData) error {
 		s.connState.AuthUser = identity
 		s.connState.AuthPassword = data.Password
 		return nil
@@ -135,6 +160,20 @@ func (s *Session) releaseLimits() {
 		addr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
 	}
 	s.endp.limits.ReleaseMsg(addr.IP, domain)
+	if s.quotaUser != "" {
+		s.endp.limits.ReleaseUser(s.quotaUser)
+	}
+}
+
+// refundQuota returns usage charged against the user quotas for the
+// message that was not accepted.
+func (s *Session) refundQuota() {
+	if s.quotaUser == "" {
+		return
+	}
+	s.endp.limits.RefundUser(s.quotaUser, s.quotaMsgs, s.quotaRcpts)
+	s.quotaMsgs = 0
+	s.quotaRcpts = 0
 }
 
 func (s *Session) abort(ctx context.Context) {
@@ -143,6 +182,7 @@ func (s *Session) abort(ctx context.Context) {
 	}
 	s.log.Msg("aborted", "msg_id", s.msgMeta.ID)
 	abortedSMTPTransactions.WithLabelValues(s.endp.name).Inc()
+	s.refundQuota()
 	s.cleanSession()
 }
 
@@ -154,8 +194,12 @@ func (s *Session) cleanSession() {
 	s.msgMeta = nil
 	s.delivery = nil
 	s.deliveryErr = nil
+	s.quotaUser = ""
+	s.quotaMsgs = 0
+	s.quotaRcpts = 0
 	s.msgCtx = nil
 	s.msgTask.End()
+	s.msgSpan.End()
 }
 
 func (s *Session) AuthPlain(username, password string) error {
@@ -165,7 +209,7 @@ func (s *Session) AuthPlain(username, password string) error {
 	}
 
 	// saslAuth will handle AuthMap and AuthNormalize.
-	err := s.endp.saslAuth.AuthPlain(username, password)
+	err := s.endp.saslAuth.Authenticate(s.connState.RemoteAddr, username, password)
 	if err != nil {
 		s.endp.Log.Error("authentication failed", err, "username", username, "src_ip", s.connState.RemoteAddr)
 
@@ -219,6 +263,7 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 			"msg_id", msgMeta.ID,
 		)
 	}
+	s.trackReceived(msgMeta, from)
 
 	// INTERNATIONALIZATION: Do not permit non-ASCII addresses unless SMTPUTF8 is
 	// used.
@@ -263,8 +308,16 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	if err := s.endp.limits.TakeMsg(context.Background(), remoteIP.IP, domain); err != nil {
 		return "", err
 	}
+	if s.connState.AuthUser != "" {
+		if err := s.endp.limits.TakeUser(context.Background(), s.connState.AuthUser); err != nil {
+			s.endp.limits.ReleaseMsg(remoteIP.IP, domain)
+			return "", err
+		}
+	}
 
-	s.msgCtx, s.msgTask = trace.NewTask(ctx, "Incoming Message")
+	s.msgCtx, s.msgTask = trace.NewTask(tracing.WithMsgID(ctx, msgMeta.ID), "Incoming Message")
+	s.msgCtx, s.msgSpan = tracing.Start(s.msgCtx, "smtp message",
+		attribute.String("sirrmesh.sender", cleanFrom))
 
 	mailCtx, mailTask := trace.NewTask(s.msgCtx, "MAIL FROM")
 	defer mailTask.End()
@@ -273,7 +326,12 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	if err != nil {
 		s.msgCtx = nil
 		s.msgTask.End()
+		tracing.End(s.msgSpan, err)
 		s.endp.limits.ReleaseMsg(remoteIP.IP, domain)
+		if s.connState.AuthUser != "" {
+			s.endp.limits.ReleaseUser(s.connState.AuthUser)
+			s.endp.limits.RefundUser(s.connState.AuthUser, 1, 0)
+		}
 		return msgMeta.ID, err
 	}
 
@@ -282,11 +340,18 @@ func (s *Session) startDelivery(ctx context.Context, from string, opts smtp.Mail
 	s.msgMeta = msgMeta
 	s.mailFrom = cleanFrom
 	s.delivery = delivery
+	if s.connState.AuthUser != "" {
+		s.quotaUser = s.connState.AuthUser
+		s.quotaMsgs = 1
+	}
 
 	return msgMeta.ID, nil
 }
 
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	if s.endp.draining.Load() {
+		return errShuttingDown
+	}
 	if s.endp.authAlwaysRequired && s.connState.AuthUser == "" {
 		return smtp.ErrAuthRequired
 	}
@@ -301,6 +366,7 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 			if !errors.Is(err, context.DeadlineExceeded) {
 				s.log.Error("MAIL FROM error", err, "msg_id", msgID)
 			}
+			s.trackRejected(msgID, from, "", err)
 			return s.endp.wrapErr(msgID, !opts.UTF8, "MAIL", err)
 		}
 	}
@@ -365,6 +431,7 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 			if !errors.Is(err, context.DeadlineExceeded) {
 				s.log.Error("MAIL FROM error (deferred)", err, "rcpt", to, "msg_id", msgID)
 			}
+			s.trackRejected(msgID, s.mailFrom, to, err)
 			s.deliveryErr = s.endp.wrapErr(msgID, !s.opts.UTF8, "RCPT", err)
 			return s.deliveryErr
 		}
@@ -376,6 +443,7 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	if err := s.rcpt(rcptCtx, to, opts); err != nil {
 		if s.loggedRcptErrors < s.endp.maxLoggedRcptErrors {
 			s.log.Error("RCPT error", err, "rcpt", to, "msg_id", s.msgMeta.ID)
+			s.trackRejected(s.msgMeta.ID, s.mailFrom, to, err)
 			s.loggedRcptErrors++
 			if s.loggedRcptErrors == s.endp.maxLoggedRcptErrors {
 				s.log.Msg("too many RCPT errors, possible dictonary attack", "src_ip", s.connState.RemoteAddr, "msg_id", s.msgMeta.ID)
@@ -384,10 +452,35 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "RCPT", err)
 	}
 	s.endp.Log.Msg("RCPT ok", "rcpt", to, "msg_id", s.msgMeta.ID)
+	msgtrack.Record(msgtrack.Event{
+		MsgID:  s.msgMeta.ID,
+		Kind:   msgtrack.KindRcpt,
+		Module: s.endp.name,
+		Sender: s.mailFrom,
+		Rcpt:   to,
+	})
 	return nil
 }
 
 func (s *Session) rcpt(ctx context.Context, to string, opts *smtp.RcptOptions) error {
+	if s.quotaUser != "" {
+		if err := s.endp.limits.TakeUserRcpt(s.quotaUser); err != nil {
+			return err
+		}
+	}
+	if err := s.addRcpt(ctx, to, opts); err != nil {
+		if s.quotaUser != "" {
+			s.endp.limits.RefundUser(s.quotaUser, 0, 1)
+		}
+		return err
+	}
+	if s.quotaUser != "" {
+		s.quotaRcpts++
+	}
+	return nil
+}
+
+func (s *Session) addRcpt(ctx context.Context, to string, opts *smtp.RcptOptions) error {
 	// INTERNATIONALIZATION: Do not permit non-ASCII addresses unless SMTPUTF8 is
 	// used.
 	if !address.IsASCII(to) && !s.opts.UTF8 {
@@ -409,6 +502,20 @@ func (s *Session) rcpt(ctx context.Context, to string, opts *smtp.RcptOptions) e
 	return s.delivery.AddRcpt(ctx, cleanTo, *opts)
 }
 
+// wakeIfIdle interrupts waiting for the next command if no transaction is in
+// progress. go-smtp then replies 421 and closes the connection, so the reply
+// is sent at the command boundary through the connection writer.
+func (s *Session) wakeIfIdle() bool {
+	if s.conn == nil || !s.msgLock.TryLock() {
+		return false
+	}
+	defer s.msgLock.Unlock()
+	if s.mailFrom != "" || s.delivery != nil {
+		return false
+	}
+	return s.conn.Conn().SetReadDeadline(time.Now()) == nil
+}
+
 func (s *Session) Logout() error {
 	s.msgLock.Lock()
 	defer s.msgLock.Unlock()
@@ -425,6 +532,13 @@ func (s *Session) Logout() error {
 	}
 
 	s.endp.sessionCnt.Add(-1)
+	s.endp.sessionsLck.Lock()
+	delete(s.endp.sessions, s)
+	s.endp.sessionsLck.Unlock()
+
+	if s.sessionSpan != nil {
+		s.sessionSpan.End()
+	}
 
 	return nil
 }
@@ -469,6 +583,9 @@ func (s *Session) Data(r io.Reader) error {
 
 	wrapErr := func(err error) error {
 		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
+		s.trackRejected(s.msgMeta.ID, s.mailFrom, "", err)
+		tracing.SetError(s.msgSpan, err)
+		s.refundQuota()
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
 	}
 
@@ -502,6 +619,12 @@ func (s *Session) Data(r io.Reader) error {
 	}
 
 	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
+	msgtrack.Record(msgtrack.Event{
+		MsgID:  s.msgMeta.ID,
+		Kind:   msgtrack.KindAccepted,
+		Module: s.endp.name,
+		Sender: s.mailFrom,
+	})
 
 	return nil
 }
@@ -524,6 +647,9 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 
 	wrapErr := func(err error) error {
 		s.log.Error("DATA error", err, "msg_id", s.msgMeta.ID)
+		s.trackRejected(s.msgMeta.ID, s.mailFrom, "", err)
+		tracing.SetError(s.msgSpan, err)
+		s.refundQuota()
 		return s.endp.wrapErr(s.msgMeta.ID, !s.opts.UTF8, "DATA", err)
 	}
 
@@ -557,10 +683,51 @@ func (s *Session) LMTPData(r io.Reader, sc smtp.StatusCollector) error {
 	}
 
 	s.log.Msg("accepted", "msg_id", s.msgMeta.ID)
+	msgtrack.Record(msgtrack.Event{
+		MsgID:  s.msgMeta.ID,
+		Kind:   msgtrack.KindAccepted,
+		Module: s.endp.name,
+		Sender: s.mailFrom,
+	})
 
 	return nil
 }
 
+func (s *Session) trackReceived(msgMeta *module.MsgMetadata, from string) {
+	if !msgtrack.Enabled() {
+		return
+	}
+	detail := "src_ip=" + msgMeta.Conn.RemoteAddr.String()
+	if msgMeta.Conn.Hostname != "" {
+		detail += " src_host=" + msgMeta.Conn.Hostname
+	}
+	if s.connState.AuthUser != "" {
+		detail += " username=" + s.connState.AuthUser
+	}
+	msgtrack.Record(msgtrack.Event{
+		MsgID:  msgMeta.ID,
+		Kind:   msgtrack.KindReceived,
+		Module: s.endp.name,
+		Sender: from,
+		Detail: detail,
+	})
+}
+
+// trackRejected records the rejection of MAIL, RCPT or DATA. The module is
+// set to the name of the check or target that generated err, if any.
+func (s *Session) trackRejected(msgID, sender, rcpt string, err error) {
+	ev := msgtrack.Event{
+		MsgID:  msgID,
+		Kind:   msgtrack.KindRejected,
+		Sender: sender,
+		Rcpt:   rcpt,
+	}.WithError(err)
+	if ev.Module == "" {
+		ev.Module = s.endp.name
+	}
+	msgtrack.Record(ev)
+}
+
 func (s *Session) checkRoutingLoops(header textproto.Header) error {
 	// RFC 5321 Section 6.3:
 	// >Simple counting of the number of "Received:" header fields in a
@@ -41,11 +41,14 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/future"
 	"github.com/sirrchat/SirrMesh/framework/log"
 	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/framework/tracing"
 	"github.com/sirrchat/SirrMesh/internal/auth"
+	"github.com/sirrchat/SirrMesh/internal/authguard"
 	"github.com/sirrchat/SirrMesh/internal/authz"
 	"github.com/sirrchat/SirrMesh/internal/limits"
 	"github.com/sirrchat/SirrMesh/internal/msgpipeline"
 	"github.com/sirrchat/SirrMesh/internal/proxy_protocol"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/idna"
 )
 
@@ -72,6 +75,12 @@ type Endpoint struct {
 
 	sessionCnt atomic.Int32
 
+	// Set when the endpoint is shutting down, new transactions are
+	// rejected then.
+	draining    atomic.Bool
+	sessionsLck sync.Mutex
+	sessions    map[*Session]struct{}
+
 	listenersWg sync.WaitGroup
 
 	Log log.Logger
@@ -97,6 +106,7 @@ func New(modName string, addrs []string) (module.Module, error) {
 		saslAuth: auth.SASLAuth{
 			Log: log.Logger{Name: modName + "/sasl"},
 		},
+		sessions: make(map[*Session]struct{}),
 	}
 	return endp, nil
 }
@@ -250,6 +260,7 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	config.EnumMapped(cfg, "auth_map_normalize", true, false, authz.NormalizeFuncs, authz.NormalizeAuto,
 		&endp.saslAuth.AuthNormalize)
 	modconfig.Table(cfg, "auth_map", true, false, nil, &endp.saslAuth.AuthMap)
+	cfg.Custom("auth_guard", false, false, nil, authguard.Directive, &endp.saslAuth.Guard)
 	cfg.Duration("write_timeout", false, false, 1*time.Minute, &endp.serv.WriteTimeout)
 	cfg.Duration("read_timeout", false, false, 10*time.Minute, &endp.serv.ReadTimeout)
 	cfg.DataSize("max_message_size", false, false, 32*1024*1024, &endp.serv.MaxMessageBytes)
@@ -268,7 +279,7 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	cfg.Bool("insecure_auth", endp.name == "lmtp", false, &endp.serv.AllowInsecureAuth)
 	cfg.Int("smtp_max_line_length", false, false, 4000, &endp.serv.MaxLineLength)
 	cfg.Bool("io_debug", false, false, &ioDebug)
-	cfg.Bool("debug", true, false, &endp.Log.Debug)
+	cfg.Logger(true, false, &endp.Log)
 	cfg.Bool("defer_sender_reject", false, true, &endp.deferServerReject)
 	cfg.Int("max_logged_rcpt_errors", false, false, 5, &endp.maxLoggedRcptErrors)
 	cfg.Custom("limits", false, false, func() (interface{}, error) {
@@ -287,6 +298,8 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	}
 
 	endp.saslAuth.Log.Debug = endp.Log.Debug
+	endp.saslAuth.Log.Level = endp.Log.Level
+	endp.saslAuth.TLSConfig = endp.serv.TLSConfig
 
 	// INTERNATIONALIZATION: See RFC 6531 Section 3.3.
 	endp.serv.Domain, err = idna.ToASCII(hostname)
@@ -300,11 +313,12 @@ func (endp *Endpoint) setConfig(cfg *config.Map) error {
 	}
 	endp.pipeline.Hostname = endp.serv.Domain
 	endp.pipeline.Resolver = endp.resolver
-	endp.pipeline.Log = log.Logger{Name: "smtp/pipeline", Debug: endp.Log.Debug}
+	endp.pipeline.Log = log.Logger{Name: "smtp/pipeline", Debug: endp.Log.Debug, Level: endp.Log.Level}
 	endp.pipeline.FirstPipeline = true
 
 	if endp.submission {
 		endp.authAlwaysRequired = true
+		endp.saslAuth.Scope = module.AuthScopeSubmission
 		if len(endp.saslAuth.SASLMechanisms()) == 0 {
 			return fmt.Errorf("%s: auth. provider must be set for submission endpoint", endp.name)
 		}
@@ -322,7 +336,7 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 	for _, addr := range addresses {
 		var l net.Listener
 		var err error
-		l, err = net.Listen(addr.Network(), addr.Address())
+		l, err = module.Listen(endp, addr.Network(), addr.Address())
 		if err != nil {
 			return fmt.Errorf("%s: %w", endp.name, err)
 		}
@@ -340,10 +354,15 @@ func (endp *Endpoint) setupListeners(addresses []config.Endpoint) error {
 		}
 
 		endp.listeners = append(endp.listeners, l)
+		if endp.submission {
+			if ce, ok := module.NewClientEndpoint(module.ClientSubmission, addr, endp.serv.TLSConfig != nil); ok {
+				module.RegisterClientEndpoint(endp, ce)
+			}
+		}
 
 		endp.listenersWg.Add(1)
 		go func() {
-			if err := endp.serv.Serve(l); err != nil {
+			if err := endp.serv.Serve(l); err != nil && !strings.HasSuffix(err.Error(), "use of closed network connection") {
 				endp.Log.Printf("failed to serve %s: %s", addr, err)
 			}
 			endp.listenersWg.Done()
@@ -365,6 +384,9 @@ func (endp *Endpoint) NewSession(conn *smtp.Conn) (smtp.Session, error) {
 	}
 
 	endp.sessionCnt.Add(1)
+	endp.sessionsLck.Lock()
+	endp.sessions[sess] = struct{}{}
+	endp.sessionsLck.Unlock()
 
 	return sess, nil
 }
@@ -380,6 +402,7 @@ func (endp *Endpoint) newSession(conn *smtp.Conn) *Session {
 	if conn == nil {
 		return s
 	}
+	s.conn = conn
 
 	s.connState = module.ConnState{
 		Hostname:   conn.Hostname(),
@@ -402,6 +425,12 @@ func (endp *Endpoint) newSession(conn *smtp.Conn) *Session {
 		}
 	}
 
+	s.sessionCtx, s.sessionSpan = tracing.Start(s.sessionCtx, "smtp session",
+		attribute.String("sirrmesh.endpoint", endp.name),
+		attribute.String("net.protocol.name", s.connState.Proto),
+		attribute.String("client.address", s.connState.RemoteAddr.String()),
+	)
+
 	if endp.resolver != nil {
 		rdnsCtx, cancelRDNS := context.WithCancel(s.sessionCtx)
 		s.connState.RDNSName = future.New()
@@ -416,7 +445,44 @@ func (endp *Endpoint) ConnectionCount() int {
 	return int(endp.sessionCnt.Load())
 }
 
+// Drain makes the endpoint reject new transactions with 421 so clients
+// disconnect once they finish the current one. Sessions waiting for the
+// next command are closed with 421 right away.
+func (endp *Endpoint) Drain() {
+	endp.draining.Store(true)
+	endp.wakeIdleSessions()
+}
+
+// wakeIdleSessions calls wakeIfIdle for all sessions and returns the number
+// of sessions that were woken up.
+func (endp *Endpoint) wakeIdleSessions() int {
+	endp.sessionsLck.Lock()
+	defer endp.sessionsLck.Unlock()
+
+	woken := 0
+	for sess := range endp.sessions {
+		if sess.wakeIfIdle() {
+			woken++
+		}
+	}
+	return woken
+}
+
 func (endp *Endpoint) Close() error {
+	module.UnregisterClientEndpoints(endp)
+	endp.draining.Store(true)
+
+	// Let idle sessions reply 421 (RFC 5321 Section 3.8) before the
+	// remaining connections are closed.
+	if woken := endp.wakeIdleSessions(); woken != 0 {
+		target := endp.sessionCnt.Load() - int32(woken)
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if endp.sessionCnt.Load() <= target {
+				break
+			}
+		}
+	}
+
 	endp.serv.Close()
 	endp.listenersWg.Wait()
 	return nil
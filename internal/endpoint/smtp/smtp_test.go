@@ -22,7 +22,9 @@ import (
 	"flag"
 	"math/rand"
 	"net"
+	"net/textproto"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -485,6 +487,104 @@ func TestSMTPDelivery_AbortLogout(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_Drain(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+	defer endp.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Hello("mx.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Mail("sender@example.org", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Rcpt("test@example.com", &smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	idle, err := net.Dial("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idleText := textproto.NewConn(idle)
+	if _, _, err := idleText.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if err := idleText.PrintfLine("EHLO mx.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := idleText.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+
+	// The current transaction is finished...
+	endp.Drain()
+
+	// ... while the idle session is closed right away.
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := idleText.ReadResponse(220); err == nil {
+		t.Fatal("Expected an error")
+	} else if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 421 {
+		t.Fatal("Expected 421 reply, got", err)
+	}
+	w, err := cl.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+
+	// ... but the new one is rejected.
+	err = cl.Mail("sender@example.org", nil)
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok || smtpErr.Code != 421 {
+		t.Fatal("Expected 421 error, got", err)
+	}
+}
+
+func TestSMTPDelivery_CloseNotify(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	if _, _, err := text.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if err := text.PrintfLine("EHLO mx.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := text.ReadResponse(250); err != nil {
+		t.Fatal(err)
+	}
+
+	endp.Close()
+
+	if _, _, err := text.ReadResponse(220); err == nil {
+		t.Fatal("Expected an error")
+	} else if protoErr, ok := err.(*textproto.Error); !ok || protoErr.Code != 421 {
+		t.Fatal("Expected 421 reply, got", err)
+	}
+}
+
 func TestSMTPDelivery_Reset(t *testing.T) {
 	tgt := testutils.Target{}
 	endp := testEndpoint(t, "smtp", nil, &tgt, nil, nil)
@@ -578,6 +678,65 @@ func TestSMTPDelivery_SubmissionAuthOK(t *testing.T) {
 	}
 }
 
+func TestSMTPDelivery_SubmissionUserQuota(t *testing.T) {
+	tgt := testutils.Target{}
+	endp := testEndpoint(t, "submission", &module.Dummy{}, &tgt, nil, []config.Node{
+		{
+			Name: "limits",
+			Children: []config.Node{
+				{Name: "user", Args: []string{"messages", "1", "24h"}},
+				{Name: "user", Args: []string{"recipients", "2", "1h"}},
+				{Name: "quota_state", Args: []string{filepath.Join(t.TempDir(), "quota.json")}},
+			},
+		},
+	})
+	defer endp.Close()
+	defer endp.limits.Close()
+
+	cl, err := smtp.Dial("127.0.0.1:" + testPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if err := cl.Auth(sasl.NewPlainClient("", "user", "password")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recipients over the quota are rejected, the message is still accepted.
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org", "rcpt3@example.org"}, testMsg)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 452 {
+		t.Fatal("Wrong error:", err)
+	}
+	data, err := cl.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := data.Write([]byte(testMsg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := data.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Daily messages quota is exhausted.
+	err = submitMsg(t, cl, "sender@example.org", []string{"rcpt1@example.org"}, testMsg)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != 451 {
+		t.Fatal("Wrong error:", err)
+	}
+
+	if len(tgt.Messages) != 1 {
+		t.Fatal("Expected a message, got", len(tgt.Messages))
+	}
+	testutils.CheckMsgID(t, &tgt.Messages[0], "sender@example.org", []string{"rcpt1@example.org", "rcpt2@example.org"}, "")
+}
+
 func TestMain(m *testing.M) {
 	remoteSmtpPort := flag.String("test.smtpport", "random", "(sirrmesh) SMTP port to use for connections in tests")
 	flag.Parse()
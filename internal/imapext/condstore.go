@@ -0,0 +1,850 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapext
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+const (
+	codeHighestModSeq imap.StatusRespCode = "HIGHESTMODSEQ"
+	codeModified      imap.StatusRespCode = "MODIFIED"
+	codeClosed        imap.StatusRespCode = "CLOSED"
+
+	statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+	fetchModSeq         imap.FetchItem  = "MODSEQ"
+)
+
+func parseModSeq(f interface{}) (uint64, error) {
+	switch f := f.(type) {
+	case uint32:
+		return uint64(f), nil
+	case string:
+		// mod-sequence-value is limited to 63 bits.
+		val, err := strconv.ParseUint(f, 10, 63)
+		if err != nil {
+			return 0, fmt.Errorf("invalid mod-sequence value: %v", f)
+		}
+		return val, nil
+	default:
+		return 0, errors.New("mod-sequence value must be a number")
+	}
+}
+
+func formatModSeq(val uint64) imap.RawString {
+	return imap.RawString(strconv.FormatUint(val, 10))
+}
+
+func badResp(info string) error {
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespBad,
+		Info: info,
+	})
+}
+
+func hasFetchItem(items []imap.FetchItem, item imap.FetchItem) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// listMessages writes FETCH responses for the messages in the set adding
+// MODSEQ to each of them. UID is included only if keepUID is set.
+func listMessages(write func(imap.WriterTo) error, sel *selected, uid bool, set *imap.SeqSet, items []imap.FetchItem, keepUID bool) error {
+	// Modification sequences are looked up before the messages are
+	// fetched. If a message is changed in between, the client sees a lower
+	// value and requests the message again later, never the other way
+	// around.
+	lookup := set
+	if !uid {
+		lookup = &imap.SeqSet{}
+		lookup.AddRange(1, 0)
+	}
+	modSeqs, err := sel.modSeq.ModSeqs(lookup)
+	if err != nil {
+		return err
+	}
+
+	if !hasFetchItem(items, imap.FetchUid) {
+		items = append(items[:len(items):len(items)], imap.FetchUid)
+	}
+
+	ch := make(chan *imap.Message)
+	out := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- write(&responses.Fetch{Messages: out})
+		for range out {
+		}
+	}()
+	go func() {
+		defer close(out)
+		for msg := range ch {
+			modSeq, ok := modSeqs[msg.Uid]
+			if !ok {
+				// Message appended after the lookup.
+				var single imap.SeqSet
+				single.AddNum(msg.Uid)
+				if m, err := sel.modSeq.ModSeqs(&single); err == nil {
+					modSeq, ok = m[msg.Uid]
+				}
+			}
+			if ok {
+				setModSeq(msg, modSeq)
+			}
+			if !keepUID {
+				delete(msg.Items, imap.FetchUid)
+			}
+			out <- msg
+		}
+	}()
+
+	if err := sel.mbox.ListMessages(uid, set, items, ch); err != nil {
+		return err
+	}
+	return <-done
+}
+
+type qresyncParams struct {
+	uidValidity uint32
+	modSeq      uint64
+	knownUIDs   *imap.SeqSet
+}
+
+func parseQresyncParams(f interface{}) (*qresyncParams, error) {
+	list, ok := f.([]interface{})
+	if !ok || len(list) < 2 {
+		return nil, errors.New("QRESYNC parameter must be a list")
+	}
+
+	var (
+		p   qresyncParams
+		err error
+	)
+	if p.uidValidity, err = imap.ParseNumber(list[0]); err != nil {
+		return nil, err
+	}
+	if p.modSeq, err = parseModSeq(list[1]); err != nil {
+		return nil, err
+	}
+	if p.modSeq == 0 {
+		return nil, errors.New("QRESYNC mod-sequence must be non-zero")
+	}
+	// The optional sequence match data is not used: the known UIDs set is
+	// checked directly.
+	if len(list) >= 3 {
+		if s, ok := list[2].(string); ok {
+			if p.knownUIDs, err = imap.ParseSeqSet(s); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &p, nil
+}
+
+type selectHandler struct {
+	commands.Select
+	ext *Extension
+
+	condStore bool
+	qresync   *qresyncParams
+}
+
+func (h *selectHandler) Parse(fields []interface{}) error {
+	if err := h.Select.Parse(fields); err != nil {
+		return err
+	}
+	if len(fields) < 2 {
+		return nil
+	}
+	params, ok := fields[1].([]interface{})
+	if !ok || len(fields) > 2 {
+		return errors.New("SELECT parameters must be a list")
+	}
+
+	for i := 0; i < len(params); i++ {
+		name, _ := params[i].(string)
+		switch strings.ToUpper(name) {
+		case "CONDSTORE":
+			h.condStore = true
+		case "QRESYNC":
+			if i+1 >= len(params) {
+				return errors.New("missing QRESYNC parameter")
+			}
+			i++
+			p, err := parseQresyncParams(params[i])
+			if err != nil {
+				return err
+			}
+			h.qresync = p
+		default:
+			return fmt.Errorf("unknown SELECT parameter: %v", params[i])
+		}
+	}
+	return nil
+}
+
+func (h *selectHandler) Handle(conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	ctx := conn.Context()
+
+	if h.qresync != nil && !c.qresyncEnabled() {
+		return badResp("QRESYNC is not enabled")
+	}
+
+	// RFC 3501 requires the currently selected mailbox to be deselected
+	// even if the command fails.
+	prev := c.setSelected(nil)
+	if ctx.Mailbox != nil {
+		ctx.Mailbox.Close()
+	}
+	ctx.Mailbox = nil
+	ctx.MailboxReadOnly = false
+	if prev != nil {
+		c.selectionChanged()
+	}
+	if prev != nil && c.qresyncEnabled() {
+		if err := conn.WriteResp(&imap.StatusResp{
+			Type: imap.StatusRespOk,
+			Code: codeClosed,
+			Info: "Previous mailbox is now closed",
+		}); err != nil {
+			return err
+		}
+	}
+
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+	if h.condStore {
+		c.enableCondStore()
+	}
+
+	ms, err := h.ext.modSeq.ModSeqMailbox(ctx.User, h.Mailbox)
+	if err != nil {
+		return err
+	}
+	status, mbox, err := ctx.User.GetMailbox(h.Mailbox, h.ReadOnly, conn)
+	if err != nil {
+		return err
+	}
+	sel := &selected{name: h.Mailbox, mbox: mbox, modSeq: ms}
+	if c.qresyncEnabled() || c.notifyEnabled() {
+		if err := c.trackUIDs(sel); err != nil {
+			mbox.Close()
+			return err
+		}
+	}
+
+	ctx.Mailbox = mbox
+	ctx.MailboxReadOnly = h.ReadOnly || status.ReadOnly
+	c.setSelected(sel)
+	c.selectionChanged()
+
+	if err := conn.WriteResp(&responses.Select{Mailbox: status}); err != nil {
+		return err
+	}
+
+	if c.condStoreEnabled() {
+		highest, err := ms.HighestModSeq()
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteResp(&imap.StatusResp{
+			Type:      imap.StatusRespOk,
+			Code:      codeHighestModSeq,
+			Arguments: []interface{}{formatModSeq(highest)},
+			Info:      "Highest",
+		}); err != nil {
+			return err
+		}
+	}
+
+	if h.qresync != nil && h.qresync.uidValidity == status.UidValidity {
+		if err := h.resync(conn, sel); err != nil {
+			return err
+		}
+	}
+
+	code := imap.CodeReadWrite
+	if ctx.MailboxReadOnly {
+		code = imap.CodeReadOnly
+	}
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Code: code,
+	})
+}
+
+// resync sends changes made since the mod-sequence provided by the client,
+// as described in RFC 7162, Section 3.2.5.
+func (h *selectHandler) resync(conn imapserver.Conn, sel *selected) error {
+	all := &imap.SeqSet{}
+	all.AddRange(1, 0)
+
+	known := h.qresync.knownUIDs
+	if known == nil {
+		known = all
+	}
+	vanished, err := sel.modSeq.Vanished(known, h.qresync.modSeq)
+	if err != nil {
+		return err
+	}
+	if len(vanished) != 0 {
+		if err := conn.WriteResp(&vanishedResp{earlier: true, uids: seqSet(vanished)}); err != nil {
+			return err
+		}
+	}
+
+	changed, err := sel.modSeq.Changed(all, h.qresync.modSeq)
+	if err != nil {
+		return err
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	return listMessages(conn.WriteResp, sel, true, seqSet(changed), []imap.FetchItem{imap.FetchFlags}, true)
+}
+
+type fetchHandler struct {
+	commands.Fetch
+	ext *Extension
+
+	modSeq          bool
+	changedSince    uint64
+	hasChangedSince bool
+	vanished        bool
+}
+
+func (h *fetchHandler) Parse(fields []interface{}) error {
+	if len(fields) < 2 {
+		return errors.New("No enough arguments")
+	}
+	if err := h.Fetch.Parse(fields[:2]); err != nil {
+		return err
+	}
+
+	items := h.Items[:0]
+	for _, item := range h.Items {
+		if item == fetchModSeq {
+			h.modSeq = true
+			continue
+		}
+		items = append(items, item)
+	}
+	h.Items = items
+
+	if len(fields) == 2 {
+		return nil
+	}
+	mods, ok := fields[2].([]interface{})
+	if !ok || len(fields) > 3 {
+		return errors.New("FETCH modifiers must be a list")
+	}
+	for i := 0; i < len(mods); i++ {
+		name, _ := mods[i].(string)
+		switch strings.ToUpper(name) {
+		case "CHANGEDSINCE":
+			if i+1 >= len(mods) {
+				return errors.New("missing CHANGEDSINCE value")
+			}
+			i++
+			val, err := parseModSeq(mods[i])
+			if err != nil {
+				return err
+			}
+			h.changedSince = val
+			h.hasChangedSince = true
+		case "VANISHED":
+			h.vanished = true
+		default:
+			return fmt.Errorf("unknown FETCH modifier: %v", mods[i])
+		}
+	}
+	return nil
+}
+
+func (h *fetchHandler) handle(uid bool, conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	if h.vanished {
+		// RFC 7162, Section 3.2.6.
+		if !uid || !h.hasChangedSince || !c.qresyncEnabled() {
+			return badResp("VANISHED requires UID FETCH with CHANGEDSINCE and enabled QRESYNC")
+		}
+	}
+	if h.modSeq || h.hasChangedSince {
+		c.enableCondStore()
+	}
+
+	sel := c.sel
+	withModSeq := h.modSeq || h.hasChangedSince || (c.condStoreEnabled() && hasFetchItem(h.Items, imap.FetchFlags))
+	if !withModSeq || sel == nil {
+		builtin := &imapserver.Fetch{Fetch: h.Fetch}
+		if uid {
+			return builtin.UidHandle(conn)
+		}
+		return builtin.Handle(conn)
+	}
+
+	set := h.SeqSet
+	setUID := uid
+	if h.hasChangedSince {
+		uids := h.SeqSet
+		if !uid {
+			found, err := ctx.Mailbox.SearchMessages(true, &imap.SearchCriteria{SeqNum: h.SeqSet})
+			if err != nil {
+				return err
+			}
+			uids = seqSet(found)
+		}
+
+		if h.vanished {
+			vanished, err := sel.modSeq.Vanished(uids, h.changedSince)
+			if err != nil {
+				return err
+			}
+			if len(vanished) != 0 {
+				if err := conn.WriteResp(&vanishedResp{earlier: true, uids: seqSet(vanished)}); err != nil {
+					return err
+				}
+			}
+		}
+
+		changed, err := sel.modSeq.Changed(uids, h.changedSince)
+		if err != nil {
+			return err
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		set = seqSet(changed)
+		setUID = true
+	}
+
+	return listMessages(conn.WriteResp, sel, setUID, set, h.Items, uid)
+}
+
+func (h *fetchHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *fetchHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+type storeHandler struct {
+	commands.Store
+	ext *Extension
+
+	unchangedSince    uint64
+	hasUnchangedSince bool
+}
+
+func (h *storeHandler) Parse(fields []interface{}) error {
+	if len(fields) >= 2 {
+		if mods, ok := fields[1].([]interface{}); ok {
+			if len(mods) != 2 {
+				return errors.New("invalid STORE modifiers")
+			}
+			name, _ := mods[0].(string)
+			if !strings.EqualFold(name, "UNCHANGEDSINCE") {
+				return fmt.Errorf("unknown STORE modifier: %v", mods[0])
+			}
+			val, err := parseModSeq(mods[1])
+			if err != nil {
+				return err
+			}
+			h.unchangedSince = val
+			h.hasUnchangedSince = true
+
+			fields = append([]interface{}{fields[0]}, fields[2:]...)
+		}
+	}
+	return h.Store.Parse(fields)
+}
+
+func (h *storeHandler) handle(uid bool, conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return imapserver.ErrMailboxReadOnly
+	}
+	_, silent, err := imap.ParseFlagsOp(h.Item)
+	if err != nil {
+		return err
+	}
+
+	if h.hasUnchangedSince {
+		c.enableCondStore()
+	}
+
+	// Non-silent STORE gets MODSEQ in FETCH responses from SendUpdate.
+	sel := c.sel
+	if sel == nil || !c.condStoreEnabled() || (!h.hasUnchangedSince && !silent) {
+		builtin := &imapserver.Store{Store: h.Store}
+		if uid {
+			return builtin.UidHandle(conn)
+		}
+		return builtin.Handle(conn)
+	}
+
+	uids := h.SeqSet
+	if !uid {
+		found, err := ctx.Mailbox.SearchMessages(true, &imap.SearchCriteria{SeqNum: h.SeqSet})
+		if err != nil {
+			return err
+		}
+		uids = seqSet(found)
+	}
+	modSeqs, err := sel.modSeq.ModSeqs(uids)
+	if err != nil {
+		return err
+	}
+
+	var passed, failed []uint32
+	for msgUID, modSeq := range modSeqs {
+		if h.hasUnchangedSince && modSeq > h.unchangedSince {
+			failed = append(failed, msgUID)
+			continue
+		}
+		passed = append(passed, msgUID)
+	}
+
+	if len(passed) != 0 {
+		builtin := &imapserver.Store{Store: h.Store}
+		builtin.SeqSet = seqSet(passed)
+		if err := builtin.UidHandle(conn); err != nil {
+			return err
+		}
+
+		// RFC 7162, Section 3.1.3: MODSEQ is reported even for
+		// .SILENT.
+		if silent {
+			if err := listMessages(conn.WriteResp, sel, true, seqSet(passed), nil, uid); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	modified := seqSet(failed)
+	if !uid {
+		seqs, err := ctx.Mailbox.SearchMessages(false, &imap.SearchCriteria{Uid: modified})
+		if err != nil {
+			return err
+		}
+		modified = seqSet(seqs)
+	}
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      codeModified,
+		Arguments: []interface{}{modified},
+		Info:      "Conditional STORE failed",
+	})
+}
+
+func (h *storeHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *storeHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+type searchHandler struct {
+	commands.Search
+	ext *Extension
+
+	modSeq    uint64
+	hasModSeq bool
+}
+
+func (h *searchHandler) Parse(fields []interface{}) error {
+	// go-imap does not know about the MODSEQ search key, only the
+	// top-level one is supported.
+	rest := make([]interface{}, 0, len(fields))
+	for i := 0; i < len(fields); i++ {
+		key, _ := fields[i].(string)
+		if !strings.EqualFold(key, "MODSEQ") {
+			rest = append(rest, fields[i])
+			continue
+		}
+
+		// MODSEQ [<entry-name> <entry-type-req>] <mod-sequence-valzer>,
+		// the entry is ignored since per-flag mod-sequences are not
+		// stored.
+		if i+3 < len(fields) {
+			if _, err := parseModSeq(fields[i+1]); err != nil {
+				i += 2
+			}
+		}
+		if i+1 >= len(fields) {
+			return errors.New("missing MODSEQ value")
+		}
+		i++
+		val, err := parseModSeq(fields[i])
+		if err != nil {
+			return err
+		}
+		h.modSeq = val
+		h.hasModSeq = true
+	}
+	if len(rest) == 0 {
+		rest = append(rest, "ALL")
+	}
+	return h.Search.Parse(rest)
+}
+
+func (h *searchHandler) handle(uid bool, conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	sel := c.sel
+	if !h.hasModSeq || sel == nil {
+		builtin := &imapserver.Search{Search: h.Search}
+		if uid {
+			return builtin.UidHandle(conn)
+		}
+		return builtin.Handle(conn)
+	}
+	c.enableCondStore()
+
+	uids, err := ctx.Mailbox.SearchMessages(true, h.Criteria)
+	if err != nil {
+		return err
+	}
+	modSeqs, err := sel.modSeq.ModSeqs(seqSet(uids))
+	if err != nil {
+		return err
+	}
+
+	var (
+		matched []uint32
+		highest uint64
+	)
+	for _, msgUID := range uids {
+		modSeq, ok := modSeqs[msgUID]
+		if !ok || modSeq < h.modSeq {
+			continue
+		}
+		matched = append(matched, msgUID)
+		if modSeq > highest {
+			highest = modSeq
+		}
+	}
+
+	ids := matched
+	if !uid && len(matched) != 0 {
+		ids, err = ctx.Mailbox.SearchMessages(false, &imap.SearchCriteria{Uid: seqSet(matched)})
+		if err != nil {
+			return err
+		}
+	}
+	return conn.WriteResp(&searchResp{ids: ids, highest: highest})
+}
+
+func (h *searchHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *searchHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+// searchResp is the SEARCH response with the MODSEQ data defined by
+// CONDSTORE.
+type searchResp struct {
+	ids     []uint32
+	highest uint64
+}
+
+func (r *searchResp) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString("SEARCH")}
+	for _, id := range r.ids {
+		fields = append(fields, id)
+	}
+	if len(r.ids) != 0 {
+		fields = append(fields, []interface{}{imap.RawString("MODSEQ"), formatModSeq(r.highest)})
+	}
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+type statusHandler struct {
+	commands.Status
+	ext *Extension
+}
+
+func (h *statusHandler) Handle(conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	items := make([]imap.StatusItem, 0, len(h.Items))
+	withModSeq := false
+	for _, item := range h.Items {
+		if item == statusHighestModSeq {
+			withModSeq = true
+			continue
+		}
+		items = append(items, item)
+	}
+	if !withModSeq {
+		builtin := &imapserver.Status{Status: h.Status}
+		return builtin.Handle(conn)
+	}
+	c.enableCondStore()
+
+	status, err := mailboxStatus(h.ext, ctx.User, h.Mailbox, items, true)
+	if err != nil {
+		return err
+	}
+	return conn.WriteResp(&responses.Status{Mailbox: status})
+}
+
+// mailboxStatus returns the mailbox status containing only requested items
+// and optionally HIGHESTMODSEQ.
+func mailboxStatus(ext *Extension, u backend.User, name string, items []imap.StatusItem, withModSeq bool) (*imap.MailboxStatus, error) {
+	status, err := u.Status(name, items)
+	if err != nil {
+		return nil, err
+	}
+	filtered := make(map[imap.StatusItem]interface{}, len(items)+1)
+	for _, k := range items {
+		filtered[k] = status.Items[k]
+	}
+	status.Items = filtered
+
+	if withModSeq {
+		ms, err := ext.modSeq.ModSeqMailbox(u, name)
+		if err != nil {
+			return nil, err
+		}
+		highest, err := ms.HighestModSeq()
+		if err != nil {
+			return nil, err
+		}
+		status.Items[statusHighestModSeq] = formatModSeq(highest)
+	}
+	return status, nil
+}
+
+type closeHandler struct {
+	commands.Close
+	ext *Extension
+}
+
+func (h *closeHandler) Handle(conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	c.setSelected(nil)
+	c.selectionChanged()
+	mbox := ctx.Mailbox
+	readOnly := ctx.MailboxReadOnly
+	ctx.Mailbox = nil
+	ctx.MailboxReadOnly = false
+	defer mbox.Close()
+
+	if readOnly {
+		return nil
+	}
+
+	// The mailbox is no longer selected, so EXPUNGE (or VANISHED) responses
+	// generated by Expunge must not reach the client.
+	c.lck.Lock()
+	c.discard = true
+	c.lck.Unlock()
+	defer func() {
+		c.lck.Lock()
+		c.discard = false
+		c.lck.Unlock()
+	}()
+	return mbox.Expunge()
+}
+
+type unselectHandler struct {
+	commands.Unselect
+	ext *Extension
+}
+
+func (h *unselectHandler) Handle(conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return imapserver.ErrNoMailboxSelected
+	}
+
+	c.setSelected(nil)
+	c.selectionChanged()
+	ctx.Mailbox.Close()
+	ctx.Mailbox = nil
+	ctx.MailboxReadOnly = false
+	return nil
+}
@@ -0,0 +1,245 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapext
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+var errNoConnState = errors.New("imapext: connection is not wrapped by the extension")
+
+// selected is the state of the selected mailbox.
+type selected struct {
+	name   string
+	mbox   backend.Mailbox
+	modSeq ModSeqMailbox
+
+	// uids maps sequence numbers to UIDs. It is maintained only if tracking
+	// is set (QRESYNC or NOTIFY is enabled) and is needed to report UIDs of
+	// expunged and new messages.
+	uids     []uint32
+	tracking bool
+}
+
+// Conn is the connection wrapper keeping per-session state of the
+// extensions.
+type Conn struct {
+	imapserver.Conn
+	ext *Extension
+
+	// selLck is held while the selected mailbox is used outside of
+	// command handlers (by the NOTIFY worker) and while it is changed.
+	selLck sync.Mutex
+
+	// lck protects fields below. It is also taken in SendUpdate, so
+	// mailbox methods should never be called while holding it.
+	lck       sync.Mutex
+	condStore bool
+	qresync   bool
+	sel       *selected
+	// discard makes SendUpdate drop all updates, it is set while CLOSE
+	// expunges the mailbox that is no longer selected.
+	discard bool
+	notify  *notifyState
+}
+
+func (c *Conn) enableCondStore() {
+	c.lck.Lock()
+	c.condStore = true
+	c.lck.Unlock()
+}
+
+func (c *Conn) condStoreEnabled() bool {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.condStore
+}
+
+func (c *Conn) qresyncEnabled() bool {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.qresync
+}
+
+// setSelected replaces the selected mailbox state. The previous mailbox is
+// not closed.
+func (c *Conn) setSelected(sel *selected) *selected {
+	c.selLck.Lock()
+	defer c.selLck.Unlock()
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	prev := c.sel
+	c.sel = sel
+	return prev
+}
+
+// trackUIDs builds the sequence number to UID map for the selected mailbox.
+// It should be called from the command handler since the mailbox handle is
+// used.
+func (c *Conn) trackUIDs(sel *selected) error {
+	// UID SEARCH ALL returns UIDs as seen by the client, including expunged
+	// messages not reported yet.
+	uids, err := sel.mbox.SearchMessages(true, &imap.SearchCriteria{})
+	if err != nil {
+		return err
+	}
+	c.lck.Lock()
+	sel.uids = uids
+	sel.tracking = true
+	c.lck.Unlock()
+	return nil
+}
+
+func (c *Conn) loggedOut() bool {
+	select {
+	case <-c.Context().LoggedOut:
+		return true
+	default:
+		return false
+	}
+}
+
+// write sends the response without blocking forever if the connection is
+// closed concurrently. It is used for responses sent outside of command
+// handlers.
+func (c *Conn) write(resp imap.WriterTo) {
+	done := make(chan struct{})
+	go func() {
+		c.Conn.WriteResp(resp)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-c.Context().LoggedOut:
+	}
+}
+
+func (c *Conn) SendUpdate(upd backend.Update) error {
+	if c.loggedOut() {
+		return nil
+	}
+
+	c.lck.Lock()
+	if c.discard {
+		c.lck.Unlock()
+		return nil
+	}
+	sel := c.sel
+
+	switch upd := upd.(type) {
+	case *backend.ExpungeUpdate:
+		if sel == nil || !sel.tracking {
+			break
+		}
+		if upd.SeqNum == 0 || int(upd.SeqNum) > len(sel.uids) {
+			c.ext.log.Msg("sequence number map is out of sync", "seq", upd.SeqNum, "len", len(sel.uids))
+			break
+		}
+		uid := sel.uids[upd.SeqNum-1]
+		sel.uids = append(sel.uids[:upd.SeqNum-1], sel.uids[upd.SeqNum:]...)
+		if c.qresync {
+			c.lck.Unlock()
+			var set imap.SeqSet
+			set.AddNum(uid)
+			return c.Conn.WriteResp(&vanishedResp{uids: &set})
+		}
+	case *backend.MailboxUpdate:
+		if sel == nil || !sel.tracking || upd.MailboxStatus == nil {
+			break
+		}
+		if _, ok := upd.Items[imap.StatusMessages]; !ok {
+			break
+		}
+		count := int(upd.Messages)
+		if count <= len(sel.uids) {
+			sel.uids = sel.uids[:count]
+			break
+		}
+		var last uint32
+		if len(sel.uids) != 0 {
+			last = sel.uids[len(sel.uids)-1]
+		}
+		newUIDs, err := sel.modSeq.UIDs(last, count-len(sel.uids))
+		if err != nil {
+			c.ext.log.Error("failed to update sequence number map", err)
+			break
+		}
+		sel.uids = append(sel.uids, newUIDs...)
+		if c.notify != nil {
+			c.notify.newUIDs = append(c.notify.newUIDs, newUIDs...)
+		}
+	case *backend.MessageUpdate:
+		if !c.condStore || sel == nil || upd.Message == nil || upd.Uid == 0 {
+			break
+		}
+		if _, ok := upd.Items[imap.FetchFlags]; !ok {
+			break
+		}
+		var set imap.SeqSet
+		set.AddNum(upd.Uid)
+		modSeqs, err := sel.modSeq.ModSeqs(&set)
+		if err != nil {
+			c.ext.log.Error("failed to get message modseq", err)
+			break
+		}
+		if modSeq, ok := modSeqs[upd.Uid]; ok {
+			setModSeq(upd.Message, modSeq)
+		}
+	}
+	c.lck.Unlock()
+
+	return c.Conn.SendUpdate(upd)
+}
+
+func (c *Conn) Close() error {
+	c.stopNotify()
+	return c.Conn.Close()
+}
+
+// setModSeq adds the MODSEQ item to the FETCH response.
+func setModSeq(msg *imap.Message, modSeq uint64) {
+	msg.Items["MODSEQ"] = []interface{}{imap.RawString(strconv.FormatUint(modSeq, 10))}
+}
+
+// vanishedResp is the VANISHED response defined by QRESYNC.
+type vanishedResp struct {
+	earlier bool
+	uids    *imap.SeqSet
+}
+
+func (r *vanishedResp) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString("VANISHED")}
+	if r.earlier {
+		fields = append(fields, imap.RawString("(EARLIER)"))
+	}
+	fields = append(fields, r.uids)
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+func seqSet(nums []uint32) *imap.SeqSet {
+	set := &imap.SeqSet{}
+	set.AddNum(nums...)
+	return set
+}
@@ -0,0 +1,68 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapext
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+type enableHandler struct {
+	commands.Enable
+	ext *Extension
+}
+
+func (h *enableHandler) Handle(conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+	if ctx.Mailbox != nil {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespBad,
+			Info: "ENABLE is not allowed in the selected state",
+		})
+	}
+
+	var enabled []string
+	c.lck.Lock()
+	for _, capName := range h.Caps {
+		switch strings.ToUpper(capName) {
+		case "CONDSTORE":
+			c.condStore = true
+			enabled = append(enabled, "CONDSTORE")
+		case "QRESYNC":
+			// RFC 7162, Section 3.2.3: enabling QRESYNC implies CONDSTORE.
+			c.condStore = true
+			c.qresync = true
+			enabled = append(enabled, "QRESYNC")
+		}
+	}
+	c.lck.Unlock()
+
+	return conn.WriteResp(&responses.Enabled{Caps: enabled})
+}
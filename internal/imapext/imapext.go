@@ -0,0 +1,227 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package imapext implements IMAP extensions that are not provided by go-imap
+// itself and need storage support: ENABLE (RFC 5161), CONDSTORE and QRESYNC
+// (RFC 7162), NOTIFY (RFC 5465) and CREATE-SPECIAL-USE (RFC 6154).
+//
+// Storage backends expose the necessary data using ModSeqBackend and
+// NotifyBackend interfaces, everything protocol-related is handled here.
+package imapext
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/sirrchat/SirrMesh/framework/log"
+)
+
+// Event is a message event reported by NotifyBackend.
+type Event int
+
+const (
+	MessageNew Event = iota
+	MessageExpunge
+	FlagChange
+)
+
+// ModSeqBackend is implemented by storage backends that maintain per-message
+// modification sequences.
+type ModSeqBackend interface {
+	ModSeqMailbox(u backend.User, mbox string) (ModSeqMailbox, error)
+}
+
+// ModSeqMailbox provides access to modification sequences of a single
+// mailbox. UID sets passed to the methods may use * to refer to the highest
+// UID in the mailbox.
+type ModSeqMailbox interface {
+	// HighestModSeq returns the highest modification sequence used in the
+	// mailbox.
+	HighestModSeq() (uint64, error)
+
+	// ModSeqs returns modification sequences of existing messages in the
+	// set.
+	ModSeqs(uids *imap.SeqSet) (map[uint32]uint64, error)
+
+	// Changed returns UIDs of existing messages in the set modified after
+	// since.
+	Changed(uids *imap.SeqSet, since uint64) ([]uint32, error)
+
+	// Vanished returns UIDs of messages in the set expunged after since.
+	Vanished(uids *imap.SeqSet, since uint64) ([]uint32, error)
+
+	// UIDs returns up to limit UIDs of existing messages greater than after
+	// in ascending order.
+	UIDs(after uint32, limit int) ([]uint32, error)
+}
+
+// NotifyBackend is implemented by storage backends that can report changes
+// made to mailboxes by other sessions and server instances.
+type NotifyBackend interface {
+	// WatchMailboxes calls fn for each message event in the listed
+	// mailboxes until the returned function is called. Non-existent
+	// mailboxes are ignored.
+	//
+	// fn is called from a goroutine owned by the backend and should not
+	// block.
+	WatchMailboxes(u backend.User, mboxes []string, fn func(mbox string, ev Event)) (func(), error)
+}
+
+// Extension implements the server side of the supported extensions.
+type Extension struct {
+	modSeq     ModSeqBackend
+	notify     NotifyBackend
+	specialUse bool
+	started    bool
+
+	log log.Logger
+
+	// sessions contains connections with NOTIFY enabled, indexed by the
+	// username. It is used to deliver mailbox events.
+	sessionsLck sync.Mutex
+	sessions    map[string]map[*Conn]struct{}
+}
+
+// New creates the Extension providing features advertised by the storage in
+// caps. nil is returned if none of the features is supported.
+//
+// CONDSTORE, QRESYNC and NOTIFY require the store to implement
+// ModSeqBackend, NOTIFY additionally requires NotifyBackend.
+func New(store interface{}, caps []string, logger log.Logger) *Extension {
+	ext := &Extension{
+		log:      logger,
+		sessions: make(map[string]map[*Conn]struct{}),
+	}
+
+	modSeq, _ := store.(ModSeqBackend)
+	notify, _ := store.(NotifyBackend)
+	for _, c := range caps {
+		switch strings.ToUpper(c) {
+		case "CONDSTORE", "QRESYNC":
+			ext.modSeq = modSeq
+		case "CREATE-SPECIAL-USE":
+			ext.specialUse = true
+		}
+	}
+	for _, c := range caps {
+		if strings.EqualFold(c, "NOTIFY") && ext.modSeq != nil {
+			ext.notify = notify
+		}
+	}
+
+	if ext.modSeq == nil && ext.notify == nil && !ext.specialUse {
+		return nil
+	}
+	return ext
+}
+
+// Start should be called after the built-in command handlers are enabled on
+// the server.
+//
+// Server.Enable ignores extensions overriding UNSELECT, so the override is
+// provided only after Start.
+func (ext *Extension) Start() {
+	ext.started = true
+}
+
+func (ext *Extension) Capabilities(c imapserver.Conn) []string {
+	var caps []string
+	if ext.modSeq != nil {
+		caps = append(caps, "ENABLE", "CONDSTORE", "QRESYNC")
+	}
+	if ext.notify != nil {
+		caps = append(caps, "NOTIFY")
+	}
+	if ext.specialUse {
+		caps = append(caps, "SPECIAL-USE", "CREATE-SPECIAL-USE")
+	}
+	return caps
+}
+
+func (ext *Extension) Command(name string) imapserver.HandlerFactory {
+	if ext.modSeq != nil {
+		switch name {
+		case "ENABLE":
+			return func() imapserver.Handler { return &enableHandler{ext: ext} }
+		case "SELECT":
+			return func() imapserver.Handler { return &selectHandler{ext: ext} }
+		case "EXAMINE":
+			return func() imapserver.Handler {
+				hdlr := &selectHandler{ext: ext}
+				hdlr.ReadOnly = true
+				return hdlr
+			}
+		case "FETCH":
+			return func() imapserver.Handler { return &fetchHandler{ext: ext} }
+		case "STORE":
+			return func() imapserver.Handler { return &storeHandler{ext: ext} }
+		case "SEARCH":
+			return func() imapserver.Handler { return &searchHandler{ext: ext} }
+		case "STATUS":
+			return func() imapserver.Handler { return &statusHandler{ext: ext} }
+		case "CLOSE":
+			return func() imapserver.Handler { return &closeHandler{ext: ext} }
+		case "UNSELECT":
+			if !ext.started {
+				return nil
+			}
+			return func() imapserver.Handler { return &unselectHandler{ext: ext} }
+		}
+	}
+
+	switch name {
+	case "CREATE":
+		if ext.specialUse || ext.notify != nil {
+			return func() imapserver.Handler { return &createHandler{ext: ext} }
+		}
+	case "NOTIFY", "DELETE", "RENAME", "SUBSCRIBE", "UNSUBSCRIBE":
+		if ext.notify == nil {
+			return nil
+		}
+		switch name {
+		case "NOTIFY":
+			return func() imapserver.Handler { return &notifyHandler{ext: ext} }
+		case "DELETE":
+			return func() imapserver.Handler { return &deleteHandler{ext: ext} }
+		case "RENAME":
+			return func() imapserver.Handler { return &renameHandler{ext: ext} }
+		case "SUBSCRIBE":
+			return func() imapserver.Handler { return &subscribeHandler{ext: ext} }
+		case "UNSUBSCRIBE":
+			return func() imapserver.Handler { return &unsubscribeHandler{ext: ext} }
+		}
+	}
+
+	return nil
+}
+
+func (ext *Extension) NewConn(c imapserver.Conn) imapserver.Conn {
+	return &Conn{Conn: c, ext: ext}
+}
+
+// conn returns the connection state created by NewConn.
+func (ext *Extension) conn(c imapserver.Conn) (*Conn, error) {
+	conn, ok := c.(*Conn)
+	if !ok {
+		return nil, errNoConnState
+	}
+	return conn, nil
+}
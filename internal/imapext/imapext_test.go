@@ -0,0 +1,328 @@
+//go:build !nosqlite3
+// +build !nosqlite3
+
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapext_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/internal/imapext"
+	_ "github.com/sirrchat/SirrMesh/internal/storage/blob/fs"
+	"github.com/sirrchat/SirrMesh/internal/storage/imapsql"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+	"github.com/sirrchat/SirrMesh/internal/updatepipe"
+)
+
+type testBackend struct {
+	store *imapsql.Storage
+}
+
+func (be testBackend) Login(_ *imap.ConnInfo, username, _ string) (backend.User, error) {
+	return be.store.GetOrCreateIMAPAcct(username)
+}
+
+func testServer(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "messages"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := imapsql.New("imapsql", "test_imapsql", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := mod.(*imapsql.Storage)
+	store.Log = testutils.Logger(t, "imapsql")
+	err = store.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "driver", Args: []string{"sqlite3"}},
+			{Name: "dsn", Args: []string{filepath.Join(dir, "imapsql.db")}},
+			{Name: "msg_store", Args: []string{"fs", filepath.Join(dir, "messages")}},
+			{Name: "update_pipe", Args: []string{"unix", filepath.Join(dir, "updates.sock")}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.EnableUpdatePipe(updatepipe.ModeReplicate); err != nil {
+		t.Fatal(err)
+	}
+
+	ext := imapext.New(store, store.IMAPExtensions(), testutils.Logger(t, "imapext"))
+	if ext == nil {
+		t.Fatal("extension is not enabled for imapsql")
+	}
+
+	srv := imapserver.New(testBackend{store: store})
+	srv.AllowInsecureAuth = true
+	srv.Enable(ext)
+	ext.Start()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() {
+		srv.Close()
+		store.Close()
+	})
+
+	return l.Addr().String()
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.readLine() // greeting
+	c.mustOK("LOGIN test@example.org password")
+	return c
+}
+
+func (c *testClient) readLine() string {
+	c.t.Helper()
+	if err := c.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		c.t.Fatal(err)
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+// cmd sends the command and returns untagged responses and the tagged
+// status line without the tag.
+func (c *testClient) cmd(format string, args ...interface{}) ([]string, string) {
+	c.t.Helper()
+	c.tag++
+	tag := fmt.Sprintf("A%d", c.tag)
+	if _, err := fmt.Fprintf(c.conn, tag+" "+format+"\r\n", args...); err != nil {
+		c.t.Fatal(err)
+	}
+
+	var untagged []string
+	for {
+		line := c.readLine()
+		if strings.HasPrefix(line, tag+" ") {
+			return untagged, strings.TrimPrefix(line, tag+" ")
+		}
+		untagged = append(untagged, line)
+	}
+}
+
+func (c *testClient) mustOK(format string, args ...interface{}) []string {
+	c.t.Helper()
+	untagged, status := c.cmd(format, args...)
+	if !strings.HasPrefix(status, "OK") {
+		c.t.Fatalf("%s: %s", fmt.Sprintf(format, args...), status)
+	}
+	return untagged
+}
+
+func (c *testClient) appendMsg(mbox string) {
+	c.t.Helper()
+	msg := "From: <sender@example.org>\r\nSubject: Test\r\n\r\nHello!\r\n"
+	c.mustOK("APPEND %s {%d+}\r\n%s", mbox, len(msg), msg)
+}
+
+// waitFor reads unsolicited responses until one matches re.
+func (c *testClient) waitFor(re string) []string {
+	c.t.Helper()
+	exp := regexp.MustCompile(re)
+	for {
+		line := c.readLine()
+		if m := exp.FindStringSubmatch(line); m != nil {
+			return m
+		}
+	}
+}
+
+func find(t *testing.T, lines []string, re string) []string {
+	t.Helper()
+	exp := regexp.MustCompile(re)
+	for _, l := range lines {
+		if m := exp.FindStringSubmatch(l); m != nil {
+			return m
+		}
+	}
+	t.Fatalf("no response matching %q in %q", re, lines)
+	return nil
+}
+
+func TestCondStore(t *testing.T) {
+	c := dial(t, testServer(t))
+	for i := 0; i < 3; i++ {
+		c.appendMsg("INBOX")
+	}
+
+	untagged := c.mustOK("SELECT INBOX (CONDSTORE)")
+	highest := find(t, untagged, `^\* OK \[HIGHESTMODSEQ (\d+)\]`)[1]
+
+	untagged = c.mustOK("STORE 1 +FLAGS (\\Seen)")
+	find(t, untagged, `^\* 1 FETCH \(.*MODSEQ \(\d+\)`)
+
+	_, status := c.cmd("UID STORE 1,2 (UNCHANGEDSINCE %s) +FLAGS (\\Flagged)", highest)
+	if !strings.HasPrefix(status, "OK [MODIFIED 1]") {
+		t.Fatalf("unexpected conditional STORE status: %s", status)
+	}
+
+	untagged = c.mustOK("FETCH 1:* (FLAGS) (CHANGEDSINCE %s)", highest)
+	if len(untagged) != 2 {
+		t.Fatalf("expected 2 changed messages, got %q", untagged)
+	}
+	find(t, untagged, `^\* 1 FETCH \(.*\\Seen.*MODSEQ`)
+	find(t, untagged, `^\* 2 FETCH \(.*\\Flagged.*MODSEQ`)
+
+	// MODSEQ matches messages with mod-sequence greater or equal to the
+	// value, message 3 is not changed since SELECT.
+	highestVal, err := strconv.ParseUint(highest, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untagged = c.mustOK("SEARCH MODSEQ %d", highestVal+1)
+	find(t, untagged, `^\* SEARCH 1 2 \(MODSEQ \d+\)$`)
+
+	untagged = c.mustOK("STATUS INBOX (MESSAGES HIGHESTMODSEQ)")
+	find(t, untagged, `^\* STATUS INBOX \(.*HIGHESTMODSEQ \d+`)
+}
+
+func TestQresync(t *testing.T) {
+	addr := testServer(t)
+	c := dial(t, addr)
+	for i := 0; i < 3; i++ {
+		c.appendMsg("INBOX")
+	}
+
+	_, status := c.cmd("SELECT INBOX (QRESYNC (1 1))")
+	if !strings.HasPrefix(status, "BAD") {
+		t.Fatalf("QRESYNC should not be accepted before ENABLE: %s", status)
+	}
+
+	untagged := c.mustOK("ENABLE QRESYNC")
+	find(t, untagged, `^\* ENABLED QRESYNC$`)
+
+	untagged = c.mustOK("SELECT INBOX")
+	uidValidity := find(t, untagged, `\[UIDVALIDITY (\d+)\]`)[1]
+	highest := find(t, untagged, `^\* OK \[HIGHESTMODSEQ (\d+)\]`)[1]
+
+	c.mustOK("STORE 2 +FLAGS.SILENT (\\Deleted)")
+	untagged = c.mustOK("EXPUNGE")
+	find(t, untagged, `^\* VANISHED 2$`)
+	c.mustOK("STORE 1 +FLAGS (\\Answered)")
+
+	untagged = c.mustOK("UID FETCH 1:* (FLAGS) (CHANGEDSINCE %s VANISHED)", highest)
+	find(t, untagged, `^\* VANISHED \(EARLIER\) 2$`)
+	find(t, untagged, `^\* 1 FETCH \(.*UID 1.*MODSEQ`)
+
+	// Another session resynchronizes after the changes.
+	c2 := dial(t, addr)
+	c2.mustOK("ENABLE QRESYNC")
+	untagged = c2.mustOK("SELECT INBOX (QRESYNC (%s %s 1:3))", uidValidity, highest)
+	find(t, untagged, `^\* VANISHED \(EARLIER\) 2$`)
+	find(t, untagged, `^\* 1 FETCH \(.*\\Answered.*MODSEQ`)
+	for _, l := range untagged {
+		if strings.Contains(l, "UID 3") {
+			t.Fatalf("unchanged message reported: %s", l)
+		}
+	}
+
+	untagged = c2.mustOK("SELECT INBOX")
+	find(t, untagged, `^\* OK \[CLOSED\]`)
+}
+
+func TestNotify(t *testing.T) {
+	addr := testServer(t)
+	c := dial(t, addr)
+	other := dial(t, addr)
+	other.mustOK("CREATE Work")
+
+	_, status := c.cmd("NOTIFY SET (PERSONAL (MessageNew))")
+	if !strings.HasPrefix(status, "BAD") {
+		t.Fatalf("MessageNew without MessageExpunge accepted: %s", status)
+	}
+	_, status = c.cmd("NOTIFY SET (PERSONAL (AnnotationChange))")
+	if !strings.HasPrefix(status, "NO [BADEVENT") {
+		t.Fatalf("unexpected status for unsupported event: %s", status)
+	}
+
+	untagged := c.mustOK("NOTIFY SET STATUS (PERSONAL (MessageNew MessageExpunge MailboxName))")
+	find(t, untagged, `^\* STATUS INBOX \(`)
+	find(t, untagged, `^\* STATUS "Work" \(`)
+
+	other.appendMsg("Work")
+	m := c.waitFor(`^\* STATUS "Work" \(.*MESSAGES (\d+)`)
+	if m[1] != "1" {
+		t.Fatalf("unexpected message count: %v", m[1])
+	}
+
+	other.mustOK("CREATE Projects")
+	c.waitFor(`^\* LIST \(\) ".*" "Projects"$`)
+
+	// New messages in the selected mailbox are reported with EXISTS and
+	// the requested FETCH data.
+	c.mustOK("SELECT INBOX")
+	c.mustOK("NOTIFY SET (SELECTED (MessageNew (UID FLAGS) MessageExpunge))")
+	other.appendMsg("INBOX")
+	c.waitFor(`^\* 1 EXISTS$`)
+	c.waitFor(`^\* 1 FETCH \(.*UID 1`)
+
+	c.mustOK("NOTIFY NONE")
+}
+
+func TestCreateSpecialUse(t *testing.T) {
+	c := dial(t, testServer(t))
+
+	c.mustOK("CREATE Archived (USE (\\Archive))")
+	untagged := c.mustOK("LIST \"\" Archived")
+	find(t, untagged, `^\* LIST \(.*\\Archive.*\) ".*" "Archived"$`)
+
+	_, status := c.cmd("CREATE Everything (USE (\\All))")
+	if !strings.HasPrefix(status, "NO [USEATTR]") {
+		t.Fatalf("unexpected status for unsupported attribute: %s", status)
+	}
+}
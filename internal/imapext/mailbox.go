@@ -0,0 +1,202 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapext
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+const codeUseAttr imap.StatusRespCode = "USEATTR"
+
+// SpecialUseUser is implemented by backend users that can create mailboxes
+// with a special-use attribute.
+type SpecialUseUser interface {
+	CreateMailboxSpecial(name, specialUseAttr string) error
+}
+
+// createAttrs are the special-use attributes accepted by CREATE. \All and
+// \Flagged are virtual mailboxes and cannot be created.
+var createAttrs = []string{
+	imap.ArchiveAttr,
+	imap.DraftsAttr,
+	imap.JunkAttr,
+	imap.SentAttr,
+	imap.TrashAttr,
+}
+
+type createHandler struct {
+	commands.Create
+	ext *Extension
+
+	useAttrs []string
+}
+
+func (h *createHandler) Parse(fields []interface{}) error {
+	if err := h.Create.Parse(fields); err != nil {
+		return err
+	}
+	if len(fields) < 2 {
+		return nil
+	}
+	if !h.ext.specialUse {
+		return errors.New("CREATE parameters are not supported")
+	}
+
+	params, ok := fields[1].([]interface{})
+	if !ok || len(fields) > 2 || len(params) != 2 {
+		return errors.New("CREATE parameters must be a list")
+	}
+	name, _ := params[0].(string)
+	if !strings.EqualFold(name, "USE") {
+		return fmt.Errorf("unknown CREATE parameter: %v", params[0])
+	}
+	attrs, err := imap.ParseStringList(params[1])
+	if err != nil {
+		return err
+	}
+	h.useAttrs = attrs
+	return nil
+}
+
+func (h *createHandler) Handle(conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	switch len(h.useAttrs) {
+	case 0:
+		if err := ctx.User.CreateMailbox(h.Mailbox); err != nil {
+			return err
+		}
+	case 1:
+		attr, ok := canonicalUseAttr(h.useAttrs[0])
+		su, isSpecialUse := ctx.User.(SpecialUseUser)
+		if !ok || !isSpecialUse {
+			return useAttrErr("Unsupported special-use attribute")
+		}
+		if err := su.CreateMailboxSpecial(h.Mailbox, attr); err != nil {
+			return err
+		}
+	default:
+		return useAttrErr("Only one special-use attribute can be used")
+	}
+
+	h.ext.mailboxEvent(c, ctx.User, &mailboxEvent{kind: mailboxCreated, name: h.Mailbox})
+	return nil
+}
+
+func canonicalUseAttr(attr string) (string, bool) {
+	for _, a := range createAttrs {
+		if strings.EqualFold(a, attr) {
+			return a, true
+		}
+	}
+	return "", false
+}
+
+func useAttrErr(info string) error {
+	return imapserver.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: codeUseAttr,
+		Info: info,
+	})
+}
+
+type deleteHandler struct {
+	commands.Delete
+	ext *Extension
+}
+
+func (h *deleteHandler) Handle(conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	if err := (&imapserver.Delete{Delete: h.Delete}).Handle(conn); err != nil {
+		return err
+	}
+	h.ext.mailboxEvent(c, conn.Context().User, &mailboxEvent{kind: mailboxDeleted, name: h.Mailbox})
+	return nil
+}
+
+type renameHandler struct {
+	commands.Rename
+	ext *Extension
+}
+
+func (h *renameHandler) Handle(conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	if err := (&imapserver.Rename{Rename: h.Rename}).Handle(conn); err != nil {
+		return err
+	}
+	h.ext.mailboxEvent(c, conn.Context().User, &mailboxEvent{
+		kind:    mailboxRenamed,
+		name:    h.New,
+		oldName: h.Existing,
+	})
+	return nil
+}
+
+type subscribeHandler struct {
+	commands.Subscribe
+	ext *Extension
+}
+
+func (h *subscribeHandler) Handle(conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	if err := (&imapserver.Subscribe{Subscribe: h.Subscribe}).Handle(conn); err != nil {
+		return err
+	}
+	h.ext.mailboxEvent(c, conn.Context().User, &mailboxEvent{kind: mailboxSubscribed, name: h.Mailbox})
+	return nil
+}
+
+type unsubscribeHandler struct {
+	commands.Unsubscribe
+	ext *Extension
+}
+
+func (h *unsubscribeHandler) Handle(conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	if err := (&imapserver.Unsubscribe{Unsubscribe: h.Unsubscribe}).Handle(conn); err != nil {
+		return err
+	}
+	h.ext.mailboxEvent(c, conn.Context().User, &mailboxEvent{kind: mailboxUnsubscribed, name: h.Mailbox})
+	return nil
+}
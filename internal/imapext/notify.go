@@ -0,0 +1,831 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapext
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+)
+
+const (
+	// notifyDelay is the time the worker waits for more events before
+	// sending responses. Backend events are delivered before the update is
+	// available to the mailbox handles, so it also gives them time to catch
+	// up.
+	notifyDelay = 100 * time.Millisecond
+
+	// notifyQueueSize is the maximum amount of events waiting for the
+	// worker. NOTIFICATIONOVERFLOW is reported once it is exceeded.
+	notifyQueueSize = 512
+
+	codeBadEvent             imap.StatusRespCode = "BADEVENT"
+	codeNotificationOverflow imap.StatusRespCode = "NOTIFICATIONOVERFLOW"
+)
+
+// supportedEvents is reported in the BADEVENT response code.
+var supportedEvents = []interface{}{
+	imap.RawString("MessageNew"),
+	imap.RawString("MessageExpunge"),
+	imap.RawString("FlagChange"),
+	imap.RawString("MailboxName"),
+	imap.RawString("SubscriptionChange"),
+}
+
+type filterKind int
+
+const (
+	filterSelected filterKind = iota
+	filterSelectedDelayed
+	filterInboxes
+	filterPersonal
+	filterSubscribed
+	filterSubtree
+	filterMailboxes
+)
+
+type notifyEvents struct {
+	messageNew         bool
+	fetchItems         []imap.FetchItem
+	messageExpunge     bool
+	flagChange         bool
+	mailboxName        bool
+	subscriptionChange bool
+}
+
+func (e notifyEvents) messageEvents() bool {
+	return e.messageNew || e.messageExpunge || e.flagChange
+}
+
+func (e notifyEvents) has(ev Event) bool {
+	switch ev {
+	case MessageNew:
+		return e.messageNew
+	case MessageExpunge:
+		return e.messageExpunge
+	case FlagChange:
+		return e.flagChange
+	}
+	return false
+}
+
+type notifyFilter struct {
+	kind   filterKind
+	mboxes []string
+	events notifyEvents
+}
+
+// match reports whether the filter applies to the mailbox. subscribed is
+// the set of subscribed mailboxes and delim is the hierarchy delimiter.
+func (f *notifyFilter) match(name string, subscribed map[string]bool, delim string) bool {
+	switch f.kind {
+	case filterInboxes:
+		return strings.EqualFold(name, "INBOX")
+	case filterPersonal:
+		return true
+	case filterSubscribed:
+		return subscribed[name]
+	case filterSubtree:
+		for _, root := range f.mboxes {
+			if name == root || strings.HasPrefix(name, root+delim) {
+				return true
+			}
+		}
+	case filterMailboxes:
+		for _, mbox := range f.mboxes {
+			if name == mbox {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type notifySpec struct {
+	status   bool
+	selected *notifyFilter
+	filters  []*notifyFilter
+}
+
+// filterFor returns the first non-selected filter applying to the mailbox.
+func (s *notifySpec) filterFor(name string, subscribed map[string]bool, delim string) *notifyFilter {
+	for _, f := range s.filters {
+		if f.match(name, subscribed, delim) {
+			return f
+		}
+	}
+	return nil
+}
+
+type mailboxEventKind int
+
+const (
+	mailboxCreated mailboxEventKind = iota
+	mailboxDeleted
+	mailboxRenamed
+	mailboxSubscribed
+	mailboxUnsubscribed
+)
+
+type mailboxEvent struct {
+	kind    mailboxEventKind
+	name    string
+	oldName string
+}
+
+type notifyMsg struct {
+	mbox    string
+	ev      Event
+	mboxEv  *mailboxEvent
+	rewatch bool
+}
+
+// notifyState is the state of NOTIFY for a connection, it lives until NOTIFY
+// NONE, overflow or logout.
+type notifyState struct {
+	spec   *notifySpec
+	user   backend.User
+	events chan notifyMsg
+	stop   chan struct{}
+
+	lck      sync.Mutex
+	closed   bool
+	cancel   func()
+	stopOnce sync.Once
+
+	// newUIDs are the new messages in the selected mailbox waiting to be
+	// fetched for MessageNew. Protected by Conn.lck.
+	newUIDs []uint32
+
+	// Fields below are used only by the goroutine calling rewatch.
+	watched    []string
+	subscribed map[string]bool
+	delim      string
+}
+
+func (st *notifyState) close() {
+	st.stopOnce.Do(func() {
+		close(st.stop)
+		st.lck.Lock()
+		st.closed = true
+		if st.cancel != nil {
+			st.cancel()
+			st.cancel = nil
+		}
+		st.lck.Unlock()
+	})
+}
+
+// push queues the message for the worker without blocking.
+func (st *notifyState) push(c *Conn, msg notifyMsg) {
+	select {
+	case <-st.stop:
+		return
+	default:
+	}
+	select {
+	case st.events <- msg:
+	default:
+		go c.notifyOverflow(st)
+	}
+}
+
+func (c *Conn) notifyEnabled() bool {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.notify != nil
+}
+
+// selectionChanged makes the worker watch the newly selected mailbox.
+func (c *Conn) selectionChanged() {
+	c.lck.Lock()
+	st := c.notify
+	if st != nil {
+		st.newUIDs = nil
+	}
+	c.lck.Unlock()
+	if st != nil {
+		st.push(c, notifyMsg{rewatch: true})
+	}
+}
+
+func (c *Conn) stopNotify() {
+	c.lck.Lock()
+	st := c.notify
+	c.notify = nil
+	c.lck.Unlock()
+	if st == nil {
+		return
+	}
+	st.close()
+	c.ext.unregister(c, st.user)
+}
+
+func (c *Conn) notifyOverflow(st *notifyState) {
+	c.lck.Lock()
+	active := c.notify == st
+	c.lck.Unlock()
+	if !active {
+		return
+	}
+	c.stopNotify()
+
+	// RFC 5465, Section 5.8: the server behaves as if NOTIFY NONE was
+	// issued.
+	c.write(&imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Code: codeNotificationOverflow,
+		Info: "Too many events, notifications are disabled",
+	})
+}
+
+// rewatch resolves the set of mailboxes with message events and registers
+// it in the backend.
+func (c *Conn) rewatch(st *notifyState) error {
+	all, err := st.user.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+	subs, err := st.user.ListMailboxes(true)
+	if err != nil {
+		return err
+	}
+
+	st.subscribed = make(map[string]bool, len(subs))
+	for _, info := range subs {
+		st.subscribed[info.Name] = true
+	}
+	for _, info := range all {
+		if info.Delimiter != "" {
+			st.delim = info.Delimiter
+			break
+		}
+	}
+
+	c.lck.Lock()
+	sel := c.sel
+	c.lck.Unlock()
+
+	var names []string
+	for _, info := range all {
+		if hasAttr(info.Attributes, imap.NoSelectAttr) {
+			continue
+		}
+		if sel != nil && info.Name == sel.name {
+			if st.spec.selected != nil && st.spec.selected.events.messageEvents() {
+				names = append(names, info.Name)
+			}
+			continue
+		}
+		if f := st.spec.filterFor(info.Name, st.subscribed, st.delim); f != nil && f.events.messageEvents() {
+			names = append(names, info.Name)
+		}
+	}
+
+	cancel, err := c.ext.notify.WatchMailboxes(st.user, names, func(mbox string, ev Event) {
+		st.push(c, notifyMsg{mbox: mbox, ev: ev})
+	})
+	if err != nil {
+		return err
+	}
+	st.lck.Lock()
+	if st.closed {
+		st.lck.Unlock()
+		cancel()
+		return nil
+	}
+	prev := st.cancel
+	st.cancel = cancel
+	st.lck.Unlock()
+	if prev != nil {
+		prev()
+	}
+
+	st.watched = names
+	return nil
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Conn) notifyLoop(st *notifyState) {
+	var (
+		timer      <-chan time.Time
+		pending    = make(map[string]map[Event]bool)
+		mboxEvents []*mailboxEvent
+		rewatch    bool
+	)
+	for {
+		select {
+		case <-st.stop:
+			return
+		case <-c.Context().LoggedOut:
+			return
+		case msg := <-st.events:
+			switch {
+			case msg.mboxEv != nil:
+				mboxEvents = append(mboxEvents, msg.mboxEv)
+				rewatch = true
+			case msg.rewatch:
+				rewatch = true
+			default:
+				if pending[msg.mbox] == nil {
+					pending[msg.mbox] = make(map[Event]bool)
+				}
+				pending[msg.mbox][msg.ev] = true
+			}
+			if timer == nil {
+				timer = time.After(notifyDelay)
+			}
+		case <-timer:
+			timer = nil
+			c.flushNotify(st, pending, mboxEvents, rewatch)
+			pending = make(map[string]map[Event]bool)
+			mboxEvents = nil
+			rewatch = false
+		}
+	}
+}
+
+func (c *Conn) flushNotify(st *notifyState, pending map[string]map[Event]bool, mboxEvents []*mailboxEvent, rewatch bool) {
+	for _, ev := range mboxEvents {
+		if resp := st.mailboxEventResp(ev); resp != nil {
+			c.write(resp)
+		}
+	}
+	if rewatch {
+		if err := c.rewatch(st); err != nil {
+			c.ext.log.Error("failed to update watched mailboxes", err)
+		}
+	}
+
+	c.lck.Lock()
+	sel := c.sel
+	condStore := c.condStore
+	c.lck.Unlock()
+
+	for name, events := range pending {
+		if sel != nil && name == sel.name {
+			if st.spec.selected != nil {
+				c.pollSelected(st)
+			}
+			continue
+		}
+
+		f := st.spec.filterFor(name, st.subscribed, st.delim)
+		if f == nil {
+			continue
+		}
+		items := statusItemsFor(f.events, events)
+		if len(items) == 0 {
+			continue
+		}
+		status, err := mailboxStatus(c.ext, st.user, name, items, condStore)
+		if err != nil {
+			if !errors.Is(err, backend.ErrNoSuchMailbox) {
+				c.ext.log.Error("failed to get mailbox status", err, "mbox", name)
+			}
+			continue
+		}
+		c.write(&responses.Status{Mailbox: status})
+	}
+}
+
+// statusItemsFor returns the STATUS items sent for events happened in a
+// non-selected mailbox, as described in RFC 5465, Section 5.2.
+func statusItemsFor(filter notifyEvents, happened map[Event]bool) []imap.StatusItem {
+	var counters, flags bool
+	for ev := range happened {
+		if !filter.has(ev) {
+			continue
+		}
+		switch ev {
+		case MessageNew, MessageExpunge:
+			counters = true
+		case FlagChange:
+			flags = true
+		}
+	}
+	switch {
+	case counters:
+		return []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity, imap.StatusUnseen}
+	case flags:
+		return []imap.StatusItem{imap.StatusUidValidity, imap.StatusUnseen}
+	}
+	return nil
+}
+
+// pollSelected sends pending updates for the selected mailbox, followed by
+// FETCH responses requested for MessageNew.
+func (c *Conn) pollSelected(st *notifyState) {
+	c.selLck.Lock()
+	defer c.selLck.Unlock()
+
+	c.lck.Lock()
+	sel := c.sel
+	c.lck.Unlock()
+	if sel == nil {
+		return
+	}
+
+	// SELECTED-DELAYED postpones expunges until a command that allows
+	// them.
+	expunge := st.spec.selected.kind == filterSelected
+	if err := sel.mbox.Poll(expunge); err != nil {
+		c.ext.log.Error("failed to poll the selected mailbox", err, "mbox", sel.name)
+		return
+	}
+
+	c.lck.Lock()
+	uids := st.newUIDs
+	st.newUIDs = nil
+	c.lck.Unlock()
+
+	items := st.spec.selected.events.fetchItems
+	if len(uids) == 0 || len(items) == 0 {
+		return
+	}
+	write := func(resp imap.WriterTo) error {
+		c.write(resp)
+		return nil
+	}
+	if err := listMessages(write, sel, true, seqSet(uids), items, hasFetchItem(items, imap.FetchUid)); err != nil {
+		c.ext.log.Error("failed to fetch new messages", err, "mbox", sel.name)
+	}
+}
+
+// mailboxEventResp returns the LIST response sent for the mailbox event or
+// nil if the client is not interested in it.
+func (st *notifyState) mailboxEventResp(ev *mailboxEvent) imap.WriterTo {
+	match := func(name string) bool {
+		for _, f := range st.spec.filters {
+			if f.kind == filterSubscribed && ev.kind == mailboxSubscribed {
+				return f.events.subscriptionChange
+			}
+			if !f.match(name, st.subscribed, st.delim) {
+				continue
+			}
+			if ev.kind == mailboxSubscribed || ev.kind == mailboxUnsubscribed {
+				return f.events.subscriptionChange
+			}
+			return f.events.mailboxName
+		}
+		return false
+	}
+	if !match(ev.name) && (ev.kind != mailboxRenamed || !match(ev.oldName)) {
+		return nil
+	}
+
+	info := &imap.MailboxInfo{Name: ev.name, Delimiter: st.delim}
+	switch ev.kind {
+	case mailboxDeleted:
+		info.Attributes = []string{"\\NonExistent"}
+	case mailboxSubscribed:
+		info.Attributes = []string{"\\Subscribed"}
+	}
+	fields := append([]interface{}{imap.RawString("LIST")}, info.Format()...)
+	if ev.kind == mailboxRenamed {
+		oldName, _ := utf7.Encoding.NewEncoder().String(ev.oldName)
+		fields = append(fields, []interface{}{"OLDNAME", []interface{}{imap.FormatMailboxName(oldName)}})
+	}
+	return imap.NewUntaggedResp(fields)
+}
+
+func (ext *Extension) register(c *Conn, u backend.User) {
+	ext.sessionsLck.Lock()
+	defer ext.sessionsLck.Unlock()
+	conns := ext.sessions[u.Username()]
+	if conns == nil {
+		conns = make(map[*Conn]struct{})
+		ext.sessions[u.Username()] = conns
+	}
+	conns[c] = struct{}{}
+}
+
+func (ext *Extension) unregister(c *Conn, u backend.User) {
+	ext.sessionsLck.Lock()
+	defer ext.sessionsLck.Unlock()
+	conns := ext.sessions[u.Username()]
+	delete(conns, c)
+	if len(conns) == 0 {
+		delete(ext.sessions, u.Username())
+	}
+}
+
+// mailboxEvent reports the mailbox change made by origin to the sessions of
+// the same user.
+//
+// Unlike message events, these are not propagated through the storage and
+// are seen only by sessions on the same server instance.
+func (ext *Extension) mailboxEvent(origin *Conn, u backend.User, ev *mailboxEvent) {
+	if ext.notify == nil {
+		return
+	}
+
+	ext.sessionsLck.Lock()
+	conns := make([]*Conn, 0, len(ext.sessions[u.Username()]))
+	for c := range ext.sessions[u.Username()] {
+		conns = append(conns, c)
+	}
+	ext.sessionsLck.Unlock()
+
+	for _, c := range conns {
+		c.lck.Lock()
+		st := c.notify
+		c.lck.Unlock()
+		if st == nil {
+			continue
+		}
+
+		msg := notifyMsg{rewatch: true}
+		if c != origin {
+			msg.mboxEv = ev
+		}
+		st.push(c, msg)
+	}
+}
+
+type notifyHandler struct {
+	ext *Extension
+
+	none     bool
+	spec     *notifySpec
+	badEvent bool
+}
+
+func parseNotifyEvents(f interface{}, selected bool) (notifyEvents, bool, error) {
+	var events notifyEvents
+
+	if s, ok := f.(string); ok && strings.EqualFold(s, "NONE") {
+		return events, false, nil
+	}
+	list, ok := f.([]interface{})
+	if !ok || len(list) == 0 {
+		return events, false, errors.New("event list expected")
+	}
+
+	badEvent := false
+	for i := 0; i < len(list); i++ {
+		name, ok := list[i].(string)
+		if !ok {
+			return events, false, errors.New("event name expected")
+		}
+		switch strings.ToLower(name) {
+		case "messagenew":
+			events.messageNew = true
+			if i+1 < len(list) {
+				if items, ok := list[i+1].([]interface{}); ok {
+					if !selected {
+						return events, false, errors.New("MessageNew fetch attributes are allowed only for SELECTED")
+					}
+					i++
+					for _, item := range items {
+						itemStr, _ := item.(string)
+						events.fetchItems = append(events.fetchItems, imap.FetchItem(strings.ToUpper(itemStr)).Expand()...)
+					}
+				}
+			}
+		case "messageexpunge":
+			events.messageExpunge = true
+		case "flagchange":
+			events.flagChange = true
+		case "mailboxname":
+			events.mailboxName = true
+		case "subscriptionchange":
+			events.subscriptionChange = true
+		default:
+			badEvent = true
+		}
+	}
+
+	// RFC 5465, Section 5.
+	if events.messageNew != events.messageExpunge {
+		return events, false, errors.New("MessageNew and MessageExpunge must be requested together")
+	}
+	if events.flagChange && !events.messageNew {
+		return events, false, errors.New("FlagChange requires MessageNew and MessageExpunge")
+	}
+	if selected && (events.mailboxName || events.subscriptionChange) {
+		return events, false, errors.New("mailbox events are not allowed for SELECTED")
+	}
+	return events, badEvent, nil
+}
+
+func parseMailboxList(f interface{}) ([]string, error) {
+	var raw []interface{}
+	if list, ok := f.([]interface{}); ok {
+		raw = list
+	} else {
+		raw = []interface{}{f}
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("mailbox name expected")
+	}
+
+	names := make([]string, 0, len(raw))
+	for _, f := range raw {
+		name, err := imap.ParseString(f)
+		if err != nil {
+			return nil, err
+		}
+		if name, err = utf7.Encoding.NewDecoder().String(name); err != nil {
+			return nil, err
+		}
+		names = append(names, imap.CanonicalMailboxName(name))
+	}
+	return names, nil
+}
+
+func (h *notifyHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("No enough arguments")
+	}
+	op, _ := fields[0].(string)
+	switch strings.ToUpper(op) {
+	case "NONE":
+		if len(fields) != 1 {
+			return errors.New("unexpected arguments for NOTIFY NONE")
+		}
+		h.none = true
+		return nil
+	case "SET":
+	default:
+		return fmt.Errorf("unknown NOTIFY operation: %v", fields[0])
+	}
+
+	fields = fields[1:]
+	spec := &notifySpec{}
+	if len(fields) != 0 {
+		if s, ok := fields[0].(string); ok && strings.EqualFold(s, "STATUS") {
+			spec.status = true
+			fields = fields[1:]
+		}
+	}
+	if len(fields) == 0 {
+		return errors.New("no event groups")
+	}
+
+	for _, f := range fields {
+		group, ok := f.([]interface{})
+		if !ok || len(group) < 2 {
+			return errors.New("event group must be a list")
+		}
+		kind, _ := group[0].(string)
+
+		filter := &notifyFilter{}
+		rest := group[1:]
+		switch strings.ToUpper(kind) {
+		case "SELECTED":
+			filter.kind = filterSelected
+		case "SELECTED-DELAYED":
+			filter.kind = filterSelectedDelayed
+		case "INBOXES":
+			filter.kind = filterInboxes
+		case "PERSONAL":
+			filter.kind = filterPersonal
+		case "SUBSCRIBED":
+			filter.kind = filterSubscribed
+		case "SUBTREE", "MAILBOXES":
+			filter.kind = filterSubtree
+			if strings.EqualFold(kind, "MAILBOXES") {
+				filter.kind = filterMailboxes
+			}
+			mboxes, err := parseMailboxList(group[1])
+			if err != nil {
+				return err
+			}
+			filter.mboxes = mboxes
+			rest = group[2:]
+		default:
+			return fmt.Errorf("unknown filter: %v", group[0])
+		}
+		if len(rest) != 1 {
+			return errors.New("event list expected")
+		}
+
+		isSelected := filter.kind == filterSelected || filter.kind == filterSelectedDelayed
+		events, badEvent, err := parseNotifyEvents(rest[0], isSelected)
+		if err != nil {
+			return err
+		}
+		filter.events = events
+		h.badEvent = h.badEvent || badEvent
+
+		if isSelected {
+			if spec.selected != nil {
+				return errors.New("duplicate SELECTED filter")
+			}
+			spec.selected = filter
+			continue
+		}
+		spec.filters = append(spec.filters, filter)
+	}
+
+	h.spec = spec
+	return nil
+}
+
+func (h *notifyHandler) Handle(conn imapserver.Conn) error {
+	c, err := h.ext.conn(conn)
+	if err != nil {
+		return err
+	}
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	c.stopNotify()
+	if h.none {
+		return nil
+	}
+	if h.badEvent {
+		return imapserver.ErrStatusResp(&imap.StatusResp{
+			Type:      imap.StatusRespNo,
+			Code:      codeBadEvent,
+			Arguments: []interface{}{supportedEvents},
+			Info:      "Unsupported event",
+		})
+	}
+
+	// The sequence number map is needed to fetch new messages.
+	if sel := c.sel; sel != nil && !sel.tracking {
+		c.selLck.Lock()
+		err := c.trackUIDs(sel)
+		c.selLck.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	st := &notifyState{
+		spec:   h.spec,
+		user:   ctx.User,
+		events: make(chan notifyMsg, notifyQueueSize),
+		stop:   make(chan struct{}),
+	}
+	if err := c.rewatch(st); err != nil {
+		st.close()
+		return err
+	}
+	c.lck.Lock()
+	c.notify = st
+	condStore := c.condStore
+	c.lck.Unlock()
+	h.ext.register(c, ctx.User)
+
+	if h.spec.status {
+		// RFC 5465, Section 3.1: STATUS is sent for each mailbox matched by
+		// the message event filters except the selected one.
+		var selName string
+		if c.sel != nil {
+			selName = c.sel.name
+		}
+		items := []imap.StatusItem{imap.StatusMessages, imap.StatusUidNext, imap.StatusUidValidity, imap.StatusUnseen}
+		for _, name := range st.watched {
+			if name == selName {
+				continue
+			}
+			status, err := mailboxStatus(h.ext, ctx.User, name, items, condStore)
+			if err != nil {
+				return err
+			}
+			if err := conn.WriteResp(&responses.Status{Mailbox: status}); err != nil {
+				return err
+			}
+		}
+	}
+
+	go c.notifyLoop(st)
+	return nil
+}
@@ -1,10 +1,18 @@
 package libdns
 
 import (
+	"context"
+	"errors"
+	"fmt"
+
 	"github.com/libdns/libdns"
 	"github.com/sirrchat/SirrMesh/framework/config"
 )
 
+// ErrGetRecordsUnsupported is returned by ProviderModule.GetRecords if the
+// provider cannot list zone records.
+var ErrGetRecordsUnsupported = errors.New("provider does not support listing records")
+
 type ProviderModule struct {
 	libdns.RecordDeleter
 	libdns.RecordAppender
@@ -33,3 +41,13 @@ func (p *ProviderModule) Name() string {
 func (p *ProviderModule) InstanceName() string {
 	return p.instName
 }
+
+// GetRecords returns all records in the zone if the underlying provider
+// implements libdns.RecordGetter.
+func (p *ProviderModule) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	getter, ok := p.RecordAppender.(libdns.RecordGetter)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", p.modName, ErrGetRecordsUnsupported)
+	}
+	return getter.GetRecords(ctx, zone)
+}
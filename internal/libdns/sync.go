@@ -0,0 +1,196 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package libdns
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/libdns/libdns"
+)
+
+// Change actions returned by Plan.
+const (
+	ActionNone   = "ok"
+	ActionCreate = "create"
+	ActionUpdate = "update"
+)
+
+// Change is the difference between a desired record and records currently
+// present in the zone.
+type Change struct {
+	Action  string
+	Desired libdns.Record
+	// Existing records that are replaced by an update.
+	Existing []libdns.Record
+	// Existing records with the same name and type that are not changed.
+	Kept []libdns.Record
+}
+
+// Provider is the set of interfaces used by Apply.
+type Provider interface {
+	libdns.RecordAppender
+	libdns.RecordDeleter
+}
+
+func normName(name, zone string) string {
+	return strings.ToLower(strings.TrimSuffix(libdns.AbsoluteName(name, zone), "."))
+}
+
+func txtValue(value string) string {
+	value = strings.TrimSpace(value)
+	// Some providers return quoted TXT values, long values can also be
+	// split into multiple quoted strings.
+	if strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		value = strings.ReplaceAll(value[1:len(value)-1], `" "`, "")
+	}
+	return value
+}
+
+// txtTag returns the version tag of the TXT record (e.g. "v=spf1"). Records
+// with the same tag at the same name are considered the same record.
+func txtTag(value string) string {
+	tag, _, _ := strings.Cut(txtValue(value), ";")
+	tag, _, _ = strings.Cut(tag, " ")
+	if !strings.HasPrefix(strings.ToLower(tag), "v=") {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+func mxParts(rec libdns.Record) (uint, string) {
+	pref, target := rec.Priority, rec.Value
+	// Some providers keep the preference in the value.
+	if p, t, ok := strings.Cut(strings.TrimSpace(rec.Value), " "); ok {
+		if n, err := strconv.ParseUint(p, 10, 16); err == nil {
+			pref, target = uint(n), t
+		}
+	}
+	return pref, strings.ToLower(strings.TrimSuffix(strings.TrimSpace(target), "."))
+}
+
+func mxValue(rec libdns.Record) string {
+	pref, target := mxParts(rec)
+	return strconv.FormatUint(uint64(pref), 10) + " " + target
+}
+
+func recordValue(rec libdns.Record) string {
+	switch strings.ToUpper(rec.Type) {
+	case "TXT":
+		return txtValue(rec.Value)
+	case "MX":
+		return mxValue(rec)
+	case "CNAME", "NS":
+		return strings.ToLower(strings.TrimSuffix(rec.Value, "."))
+	default:
+		return strings.ToLower(strings.Join(strings.Fields(rec.Value), " "))
+	}
+}
+
+func sameNameType(desired, existing libdns.Record, zone string) bool {
+	return strings.EqualFold(desired.Type, existing.Type) && normName(desired.Name, zone) == normName(existing.Name, zone)
+}
+
+// sameSlot reports whether the existing record is the one that should be
+// replaced by the desired record if their values differ.
+//
+// Only records that are known to be published by this tool are replaced:
+// TXT records with the same version tag and MX records pointing to the same
+// host. Unrelated records at the same name (site verification TXT records,
+// backup MX, additional A records) are not touched.
+func sameSlot(desired, existing libdns.Record, zone string) bool {
+	if !sameNameType(desired, existing, zone) {
+		return false
+	}
+	switch strings.ToUpper(desired.Type) {
+	case "TXT":
+		tag := txtTag(desired.Value)
+		return tag != "" && tag == txtTag(existing.Value)
+	case "MX":
+		_, wantTarget := mxParts(desired)
+		_, target := mxParts(existing)
+		return wantTarget == target
+	default:
+		return false
+	}
+}
+
+// Plan compares desired records against records in the zone and returns
+// changes needed to publish them. Names of desired records are relative to
+// the zone.
+//
+// TXT records with the same name and version tag and MX records pointing to
+// the same host are replaced. Other records are never changed, desired
+// records of other types are added next to them.
+func Plan(ctx context.Context, getter libdns.RecordGetter, zone string, desired []libdns.Record) ([]Change, error) {
+	current, err := getter.GetRecords(ctx, zone)
+	if err != nil {
+		return nil, fmt.Errorf("libdns: get records for %s: %w", zone, err)
+	}
+
+	changes := make([]Change, 0, len(desired))
+	for _, want := range desired {
+		c := Change{Action: ActionCreate, Desired: want}
+		var kept []libdns.Record
+		for _, rec := range current {
+			if !sameNameType(want, rec, zone) {
+				continue
+			}
+			if recordValue(rec) == recordValue(want) {
+				c.Action = ActionNone
+				c.Existing = nil
+				break
+			}
+			if !sameSlot(want, rec, zone) {
+				kept = append(kept, rec)
+				continue
+			}
+			c.Action = ActionUpdate
+			c.Existing = append(c.Existing, rec)
+		}
+		if c.Action != ActionNone {
+			c.Kept = kept
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// Apply publishes the planned changes. The new value of an updated record is
+// added before the old records are deleted so the zone is not left without
+// the record if the provider fails.
+func Apply(ctx context.Context, p Provider, zone string, changes []Change) error {
+	for _, c := range changes {
+		if c.Action != ActionCreate && c.Action != ActionUpdate {
+			continue
+		}
+		if _, err := p.AppendRecords(ctx, zone, []libdns.Record{c.Desired}); err != nil {
+			return fmt.Errorf("libdns: add %s %s: %w", c.Desired.Type, c.Desired.Name, err)
+		}
+		if c.Action != ActionUpdate {
+			continue
+		}
+		if _, err := p.DeleteRecords(ctx, zone, c.Existing); err != nil {
+			return fmt.Errorf("libdns: delete old %s %s, both values are published now: %w", c.Desired.Type, c.Desired.Name, err)
+		}
+	}
+	return nil
+}
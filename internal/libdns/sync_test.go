@@ -0,0 +1,195 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package libdns
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// memoryProvider is an in-memory libdns provider.
+type memoryProvider struct {
+	lck     sync.Mutex
+	records map[string][]libdns.Record
+}
+
+func (p *memoryProvider) GetRecords(_ context.Context, zone string) ([]libdns.Record, error) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	return append([]libdns.Record(nil), p.records[zone]...), nil
+}
+
+func (p *memoryProvider) AppendRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	p.records[zone] = append(p.records[zone], recs...)
+	return recs, nil
+}
+
+func (p *memoryProvider) DeleteRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	kept := p.records[zone][:0]
+	for _, rec := range p.records[zone] {
+		deleted := false
+		for _, del := range recs {
+			if rec.Type == del.Type && rec.Name == del.Name && rec.Value == del.Value {
+				deleted = true
+			}
+		}
+		if !deleted {
+			kept = append(kept, rec)
+		}
+	}
+	p.records[zone] = kept
+	return recs, nil
+}
+
+func (p *memoryProvider) dump(zone string) []string {
+	var res []string
+	for _, rec := range p.records[zone] {
+		res = append(res, rec.Type+" "+rec.Name+" "+rec.Value)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestPlanApply(t *testing.T) {
+	const zone = "example.org."
+	p := &memoryProvider{records: map[string][]libdns.Record{
+		zone: {
+			{Type: "A", Name: "mx1", Value: "192.0.2.1"},
+			// Preference in the value and the trailing dot.
+			{Type: "MX", Name: "@", Value: "20 mx1.example.org."},
+			{Type: "MX", Name: "@", Value: "30 backup.example.net."},
+			{Type: "A", Name: "mx2", Value: "192.0.2.2"},
+			{Type: "TXT", Name: "@", Value: `"v=spf1 a -all"`},
+			{Type: "TXT", Name: "@", Value: "google-site-verification=xxx"},
+			{Type: "TXT", Name: "_dmarc", Value: "v=DMARC1; p=none"},
+			{Type: "A", Name: "www", Value: "192.0.2.10"},
+		},
+	}}
+
+	desired := []libdns.Record{
+		{Type: "A", Name: "mx1", Value: "192.0.2.1", TTL: time.Hour},
+		{Type: "MX", Name: "@", Value: "mx1.example.org.", Priority: 10, TTL: time.Hour},
+		{Type: "A", Name: "mx2", Value: "192.0.2.3", TTL: time.Hour},
+		{Type: "TXT", Name: "@", Value: "v=spf1 mx ~all", TTL: time.Hour},
+		{Type: "TXT", Name: "_dmarc", Value: "v=DMARC1; p=quarantine", TTL: time.Hour},
+		{Type: "TXT", Name: "default._domainkey", Value: "v=DKIM1; k=rsa; p=AAAA", TTL: time.Hour},
+	}
+
+	changes, err := Plan(context.Background(), p, zone, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, c := range changes {
+		actions = append(actions, c.Action)
+	}
+	if got := strings.Join(actions, " "); got != "ok update create update update create" {
+		t.Fatalf("Wrong plan: %s", got)
+	}
+	if len(changes[1].Existing) != 1 || changes[1].Existing[0].Value != "20 mx1.example.org." {
+		t.Errorf("Wrong replaced MX record: %+v", changes[1].Existing)
+	}
+	if len(changes[1].Kept) != 1 || changes[1].Kept[0].Value != "30 backup.example.net." {
+		t.Errorf("Wrong kept MX record: %+v", changes[1].Kept)
+	}
+	if len(changes[3].Existing) != 1 || changes[3].Existing[0].Value != `"v=spf1 a -all"` {
+		t.Errorf("Wrong replaced SPF record: %+v", changes[3].Existing)
+	}
+
+	if err := Apply(context.Background(), p, zone, changes); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"A mx1 192.0.2.1",
+		"A mx2 192.0.2.2",
+		"A mx2 192.0.2.3",
+		"A www 192.0.2.10",
+		"MX @ 30 backup.example.net.",
+		"MX @ mx1.example.org.",
+		"TXT @ google-site-verification=xxx",
+		"TXT @ v=spf1 mx ~all",
+		"TXT _dmarc v=DMARC1; p=quarantine",
+		"TXT default._domainkey v=DKIM1; k=rsa; p=AAAA",
+	}
+	if got := p.dump(zone); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Wrong zone content after apply:\n%s", strings.Join(got, "\n"))
+	}
+
+	// Applying again is a no-op.
+	changes, err = Plan(context.Background(), p, zone, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		if c.Action != ActionNone {
+			t.Errorf("Unexpected change after apply: %s %s %s", c.Action, c.Desired.Type, c.Desired.Name)
+		}
+	}
+}
+
+type failingAppender struct {
+	*memoryProvider
+}
+
+func (p failingAppender) AppendRecords(context.Context, string, []libdns.Record) ([]libdns.Record, error) {
+	return nil, errors.New("provider failure")
+}
+
+func TestApply_AppendFailure(t *testing.T) {
+	const zone = "example.org."
+	p := &memoryProvider{records: map[string][]libdns.Record{
+		zone: {{Type: "TXT", Name: "@", Value: "v=spf1 a -all"}},
+	}}
+	desired := []libdns.Record{{Type: "TXT", Name: "@", Value: "v=spf1 mx ~all"}}
+
+	changes, err := Plan(context.Background(), p, zone, desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Apply(context.Background(), failingAppender{p}, zone, changes); err == nil {
+		t.Fatal("Expected an error")
+	}
+	if got := p.dump(zone); len(got) != 1 || got[0] != "TXT @ v=spf1 a -all" {
+		t.Errorf("Old record is not kept after failure: %v", got)
+	}
+}
+
+func TestTXTTag(t *testing.T) {
+	test := func(value, tag string) {
+		t.Helper()
+		if got := txtTag(value); got != tag {
+			t.Errorf("%s: got %q, want %q", value, got, tag)
+		}
+	}
+	test("v=spf1 mx ~all", "v=spf1")
+	test(`"v=DMARC1; p=none"`, "v=dmarc1")
+	test("v=STSv1; id=1", "v=stsv1")
+	test("google-site-verification=xxx", "")
+}
@@ -18,7 +18,10 @@ along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 // Package limit provides a module object that can be used to restrict the
 // concurrency and rate of the messages flow globally or on per-source,
-// per-destination basis.
+// per-destination, per-user basis.
+//
+// Additionally, per-user message and recipient quotas can be enforced for
+// authenticated users. Quota usage is persisted in the state directory.
 //
 // Note, all domain inputs are interpreted with the assumption they are already
 // normalized.
@@ -44,6 +47,10 @@ type Group struct {
 	ip     *limiters.BucketSet // BucketSet of MultiLimit
 	source *limiters.BucketSet // BucketSet of MultiLimit
 	dest   *limiters.BucketSet // BucketSet of MultiLimit
+	user   *limiters.BucketSet // BucketSet of MultiLimit
+
+	userQuotas []Quota
+	quotaStore *QuotaStore
 }
 
 func New(_, instName string, _, _ []string) (module.Module, error) {
@@ -58,9 +65,20 @@ func (g *Group) Init(cfg *config.Map) error {
 		ipL     []func() limiters.L
 		sourceL []func() limiters.L
 		destL   []func() limiters.L
+		userL   []func() limiters.L
+
+		quotaStatePath = DefaultQuotaStatePath(config.StateDirectory)
 	)
 
 	for _, child := range cfg.Block.Children {
+		if child.Name == "quota_state" {
+			if len(child.Args) != 1 {
+				return config.NodeErr(child, "exactly one argument is required")
+			}
+			quotaStatePath = child.Args[0]
+			continue
+		}
+
 		if len(child.Args) < 1 {
 			return config.NodeErr(child, "at least two arguments are required")
 		}
@@ -74,6 +92,16 @@ func (g *Group) Init(cfg *config.Map) error {
 			ctor, err = rateCtor(child, child.Args[1:])
 		case "concurrency":
 			ctor, err = concurrencyCtor(child, child.Args[1:])
+		case QuotaMessages, QuotaRecipients:
+			if child.Name != "user" {
+				return config.NodeErr(child, "%v quota can be used only with user scope", kind)
+			}
+			q, err := quotaFromArgs(child, kind, child.Args[1:])
+			if err != nil {
+				return err
+			}
+			g.userQuotas = append(g.userQuotas, q)
+			continue
 		default:
 			return config.NodeErr(child, "unknown limit kind: %v", kind)
 		}
@@ -90,6 +118,8 @@ func (g *Group) Init(cfg *config.Map) error {
 			sourceL = append(sourceL, ctor)
 		case "destination":
 			destL = append(destL, ctor)
+		case "user":
+			userL = append(userL, ctor)
 		default:
 			return config.NodeErr(child, "unknown limit scope: %v", scope)
 		}
@@ -125,10 +155,44 @@ func (g *Group) Init(cfg *config.Map) error {
 			return &limiters.MultiLimit{Wrapped: l}
 		}, 1*time.Minute, 20010)
 	}
+	if len(userL) != 0 {
+		g.user = limiters.NewBucketSet(func() limiters.L {
+			l := make([]limiters.L, 0, len(userL))
+			for _, ctor := range userL {
+				l = append(l, ctor())
+			}
+			return &limiters.MultiLimit{Wrapped: l}
+		}, 1*time.Minute, 20010)
+	}
+	if len(g.userQuotas) != 0 && !module.DryRun {
+		var err error
+		g.quotaStore, err = openQuotaStore(quotaStatePath)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+func quotaFromArgs(node config.Node, kind string, args []string) (Quota, error) {
+	if len(args) != 2 {
+		return Quota{}, config.NodeErr(node, "%v quota requires max. value and period", kind)
+	}
+	max, err := strconv.Atoi(args[0])
+	if err != nil {
+		return Quota{}, config.NodeErr(node, "%v", err)
+	}
+	period, err := time.ParseDuration(args[1])
+	if err != nil {
+		return Quota{}, config.NodeErr(node, "%v", err)
+	}
+	if period <= 0 {
+		return Quota{}, config.NodeErr(node, "quota period should be positive")
+	}
+	return Quota{Kind: kind, Max: max, Period: period}, nil
+}
+
 func rateCtor(node config.Node, args []string) (func() limiters.L, error) {
 	period := 1 * time.Second
 	burst := 0
@@ -221,6 +285,68 @@ func (g *Group) ReleaseDest(domain string) {
 	g.dest.Release(domain)
 }
 
+// TakeUser acquires per-user limits and charges one message against
+// the user quotas.
+//
+// It should be called only for authenticated sessions, username
+// is expected to be normalized.
+func (g *Group) TakeUser(ctx context.Context, username string) error {
+	if g.user != nil {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		if err := g.user.TakeContext(ctx, username); err != nil {
+			return err
+		}
+	}
+	if g.quotaStore != nil {
+		if err := g.quotaStore.Take(username, g.userQuotas, QuotaMessages, 1); err != nil {
+			if g.user != nil {
+				g.user.Release(username)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// ReleaseUser releases per-user limits acquired by TakeUser. It does not
+// return the charged message to the quota, use RefundUser for that.
+func (g *Group) ReleaseUser(username string) {
+	if g.user == nil {
+		return
+	}
+	g.user.Release(username)
+}
+
+// TakeUserRcpt charges one recipient against the user quotas.
+func (g *Group) TakeUserRcpt(username string) error {
+	if g.quotaStore == nil {
+		return nil
+	}
+	return g.quotaStore.Take(username, g.userQuotas, QuotaRecipients, 1)
+}
+
+// RefundUser returns messages and recipients charged by TakeUser and
+// TakeUserRcpt for a message that was not accepted.
+func (g *Group) RefundUser(username string, msgs, rcpts int) {
+	if g.quotaStore == nil {
+		return
+	}
+	if msgs != 0 {
+		g.quotaStore.Release(username, g.userQuotas, QuotaMessages, msgs)
+	}
+	if rcpts != 0 {
+		g.quotaStore.Release(username, g.userQuotas, QuotaRecipients, rcpts)
+	}
+}
+
+func (g *Group) Close() error {
+	if g.quotaStore == nil {
+		return nil
+	}
+	return g.quotaStore.Close()
+}
+
 func (g *Group) Name() string {
 	return "limits"
 }
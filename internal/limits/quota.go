@@ -0,0 +1,348 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package limits
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/exterrors"
+	"github.com/sirrchat/SirrMesh/framework/log"
+)
+
+const (
+	QuotaMessages   = "messages"
+	QuotaRecipients = "recipients"
+)
+
+// quotaFlushInterval is the interval at which modified usage counters are
+// written to disk.
+const quotaFlushInterval = 30 * time.Second
+
+// Quota describes a single fixed-window quota, e.g. "500 messages per 24h".
+//
+// Windows are aligned to multiples of Period since the zero time, so a 24h
+// quota is reset at midnight UTC and a 1h quota at the start of each hour.
+type Quota struct {
+	Kind   string
+	Max    int
+	Period time.Duration
+}
+
+func (q Quota) key() string {
+	return q.Kind + " " + q.Period.String()
+}
+
+// QuotaCounter is the usage of a single quota within the current window.
+type QuotaCounter struct {
+	Kind        string    `json:"kind"`
+	Period      string    `json:"period"`
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+	Used        int       `json:"used"`
+}
+
+type quotaState struct {
+	Users map[string]map[string]*QuotaCounter `json:"users"`
+}
+
+// QuotaStore keeps per-user quota counters and persists them on disk so
+// they survive server restarts.
+//
+// Stores are shared between all limit groups that use the same state file,
+// this way quotas are enforced consistently if the same users can submit
+// messages via multiple endpoints.
+type QuotaStore struct {
+	path string
+	log  log.Logger
+
+	lock  sync.Mutex
+	state quotaState
+	dirty bool
+	refs  int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var (
+	quotaStoresLck sync.Mutex
+	quotaStores    = map[string]*QuotaStore{}
+)
+
+// openQuotaStore returns the QuotaStore for the specified state file,
+// loading it from disk if it is not opened already.
+//
+// Each openQuotaStore call should be paired with a Close call.
+func openQuotaStore(path string) (*QuotaStore, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	quotaStoresLck.Lock()
+	defer quotaStoresLck.Unlock()
+
+	if qs := quotaStores[path]; qs != nil {
+		qs.refs++
+		return qs, nil
+	}
+
+	state, err := readQuotaState(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+
+	qs := &QuotaStore{
+		path:  path,
+		log:   log.Logger{Name: "limits/quota"},
+		state: state,
+		refs:  1,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	quotaStores[path] = qs
+	go qs.flushLoop()
+	return qs, nil
+}
+
+func readQuotaState(path string) (quotaState, error) {
+	state := quotaState{Users: map[string]map[string]*QuotaCounter{}}
+
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return state, nil
+		}
+		return state, err
+	}
+	if err := json.Unmarshal(blob, &state); err != nil {
+		return state, fmt.Errorf("limits: malformed quota state %s: %w", path, err)
+	}
+	if state.Users == nil {
+		state.Users = map[string]map[string]*QuotaCounter{}
+	}
+	return state, nil
+}
+
+// ReadQuotaUsage loads the usage counters from the specified state file
+// without opening it for modification.
+//
+// Counters for windows that already ended are omitted.
+func ReadQuotaUsage(path string) (map[string][]QuotaCounter, error) {
+	state, err := readQuotaState(path)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	res := make(map[string][]QuotaCounter, len(state.Users))
+	for user, counters := range state.Users {
+		for _, c := range counters {
+			if !c.WindowEnd.After(now) {
+				continue
+			}
+			res[user] = append(res[user], *c)
+		}
+	}
+	return res, nil
+}
+
+// DefaultQuotaStatePath returns the state file location used if the
+// quota_state directive is not specified.
+func DefaultQuotaStatePath(stateDir string) string {
+	return filepath.Join(stateDir, "limits", "user_quota.json")
+}
+
+func (qs *QuotaStore) counter(user string, q Quota, now time.Time) *QuotaCounter {
+	counters := qs.state.Users[user]
+	if counters == nil {
+		counters = map[string]*QuotaCounter{}
+		qs.state.Users[user] = counters
+	}
+
+	windowStart := now.Truncate(q.Period)
+	c := counters[q.key()]
+	if c == nil || !c.WindowStart.Equal(windowStart) {
+		c = &QuotaCounter{
+			Kind:        q.Kind,
+			Period:      q.Period.String(),
+			WindowStart: windowStart,
+			WindowEnd:   windowStart.Add(q.Period),
+		}
+		counters[q.key()] = c
+	}
+	return c
+}
+
+// Take charges n units of the specified kind against all matching quotas
+// for the user.
+//
+// If any of the quotas would be exceeded, nothing is charged and an error
+// is returned.
+func (qs *QuotaStore) Take(user string, quotas []Quota, kind string, n int) error {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	now := time.Now()
+	for _, q := range quotas {
+		if q.Kind != kind {
+			continue
+		}
+		c := qs.counter(user, q, now)
+		if c.Used+n > q.Max {
+			return quotaErr(q, c)
+		}
+	}
+	for _, q := range quotas {
+		if q.Kind != kind {
+			continue
+		}
+		qs.counter(user, q, now).Used += n
+		qs.dirty = true
+	}
+	return nil
+}
+
+// Release returns n units of the specified kind previously charged using
+// Take.
+//
+// Units charged in a window that already ended are not returned.
+func (qs *QuotaStore) Release(user string, quotas []Quota, kind string, n int) {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	now := time.Now()
+	for _, q := range quotas {
+		if q.Kind != kind {
+			continue
+		}
+		c := qs.counter(user, q, now)
+		c.Used -= n
+		if c.Used < 0 {
+			c.Used = 0
+		}
+		qs.dirty = true
+	}
+}
+
+func quotaErr(q Quota, c *QuotaCounter) error {
+	code := 451
+	enchCode := exterrors.EnhancedCode{4, 7, 0}
+	msg := "Sending quota exceeded, try again later"
+	if q.Kind == QuotaRecipients {
+		code = 452
+		enchCode = exterrors.EnhancedCode{4, 5, 3}
+		msg = "Recipients quota exceeded, try again later"
+	}
+	return &exterrors.SMTPError{
+		Code:         code,
+		EnhancedCode: enchCode,
+		Message:      msg,
+		Reason:       "user quota exceeded",
+		Misc: map[string]interface{}{
+			"quota":        q.Kind,
+			"quota_period": q.Period.String(),
+			"quota_max":    q.Max,
+			"quota_reset":  c.WindowEnd,
+		},
+	}
+}
+
+func (qs *QuotaStore) flushLoop() {
+	defer close(qs.done)
+
+	t := time.NewTicker(quotaFlushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := qs.flush(); err != nil {
+				qs.log.Error("failed to save quota state", err, "path", qs.path)
+			}
+		case <-qs.stop:
+			return
+		}
+	}
+}
+
+func (qs *QuotaStore) flush() error {
+	qs.lock.Lock()
+	defer qs.lock.Unlock()
+
+	if !qs.dirty {
+		return nil
+	}
+
+	// Drop counters for windows that already ended to keep the file small.
+	now := time.Now()
+	for user, counters := range qs.state.Users {
+		for key, c := range counters {
+			if !c.WindowEnd.After(now) {
+				delete(counters, key)
+			}
+		}
+		if len(counters) == 0 {
+			delete(qs.state.Users, user)
+		}
+	}
+
+	blob, err := json.Marshal(qs.state)
+	if err != nil {
+		return err
+	}
+	tmp := qs.path + ".tmp"
+	if err := os.WriteFile(tmp, blob, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, qs.path); err != nil {
+		return err
+	}
+
+	qs.dirty = false
+	return nil
+}
+
+// Close saves the usage counters and stops the background flushing once
+// all users of the store closed it.
+func (qs *QuotaStore) Close() error {
+	quotaStoresLck.Lock()
+	qs.refs--
+	last := qs.refs == 0
+	if last {
+		delete(quotaStores, qs.path)
+	}
+	quotaStoresLck.Unlock()
+
+	if !last {
+		return nil
+	}
+
+	close(qs.stop)
+	<-qs.done
+	return qs.flush()
+}
@@ -0,0 +1,130 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package limits
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/exterrors"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+func TestQuotaStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	quotas := []Quota{
+		{Kind: QuotaMessages, Max: 2, Period: 24 * time.Hour},
+		{Kind: QuotaRecipients, Max: 3, Period: time.Hour},
+	}
+
+	qs, err := openQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := qs.Take("user", quotas, QuotaMessages, 1); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	err = qs.Take("user", quotas, QuotaMessages, 1)
+	if err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+	if !exterrors.IsTemporary(err) {
+		t.Error("Quota error should be temporary:", err)
+	}
+
+	// Other users are not affected.
+	if err := qs.Take("user2", quotas, QuotaMessages, 1); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+
+	qs.Release("user", quotas, QuotaMessages, 1)
+	if err := qs.Take("user", quotas, QuotaMessages, 1); err != nil {
+		t.Fatal("Unexpected error after release:", err)
+	}
+
+	if err := qs.Take("user", quotas, QuotaRecipients, 3); err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if err := qs.Take("user", quotas, QuotaRecipients, 1); err == nil {
+		t.Fatal("Expected an error, got none")
+	}
+
+	if err := qs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := ReadQuotaUsage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage["user"]) != 2 {
+		t.Fatalf("Expected 2 counters for user, got %v", usage["user"])
+	}
+	for _, c := range usage["user"] {
+		switch c.Kind {
+		case QuotaMessages:
+			if c.Used != 2 {
+				t.Error("Wrong messages usage:", c.Used)
+			}
+		case QuotaRecipients:
+			if c.Used != 3 {
+				t.Error("Wrong recipients usage:", c.Used)
+			}
+		}
+	}
+
+	// Usage survives re-opening.
+	qs, err = openQuotaStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qs.Close()
+	if err := qs.Take("user", quotas, QuotaMessages, 1); err == nil {
+		t.Fatal("Expected an error after re-opening, got none")
+	}
+}
+
+func TestQuotaStore_DryRun(t *testing.T) {
+	module.DryRun = true
+	defer func() { module.DryRun = false }()
+
+	dir := filepath.Join(t.TempDir(), "limits")
+	mod, err := New("limits", "", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mod.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "quota_state", Args: []string{filepath.Join(dir, "quota.json")}},
+			{Name: "user", Args: []string{QuotaMessages, "10", "24h"}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("State directory is created in dry run mode:", err)
+	}
+}
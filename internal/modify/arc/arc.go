@@ -0,0 +1,263 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package arc implements modify.arc, the module that adds ARC Sets to
+// messages relayed by the server.
+package arc
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"runtime/trace"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/sirrchat/SirrMesh/framework/buffer"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/dns"
+	"github.com/sirrchat/SirrMesh/framework/exterrors"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/arc"
+	"github.com/sirrchat/SirrMesh/internal/modify/dkim"
+	"github.com/sirrchat/SirrMesh/internal/target"
+)
+
+var signDefault = []string{
+	"From",
+	"To",
+	"Cc",
+	"Subject",
+	"Date",
+	"Message-Id",
+	"Reply-To",
+	"In-Reply-To",
+	"References",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+	"DKIM-Signature",
+}
+
+type Modifier struct {
+	instName string
+
+	domain      string
+	selector    string
+	authservID  string
+	signer      crypto.Signer
+	signHeader  []string
+	headerCanon string
+	bodyCanon   string
+
+	resolver dns.Resolver
+	log      log.Logger
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	m := &Modifier{
+		instName: instName,
+		resolver: dns.DefaultResolver(),
+		log:      log.Logger{Name: "modify.arc"},
+	}
+
+	switch len(inlineArgs) {
+	case 0:
+	case 2:
+		m.domain = inlineArgs[0]
+		m.selector = inlineArgs[1]
+	default:
+		return nil, errors.New("modify.arc: domain and selector are expected as inline arguments")
+	}
+
+	return m, nil
+}
+
+func (m *Modifier) Name() string {
+	return "modify.arc"
+}
+
+func (m *Modifier) InstanceName() string {
+	return m.instName
+}
+
+func (m *Modifier) Init(cfg *config.Map) error {
+	var (
+		keyPathTemplate string
+		newKeyAlgo      string
+	)
+
+	cfg.Logger(true, false, &m.log)
+	cfg.String("hostname", true, true, "", &m.authservID)
+	cfg.String("domain", false, false, m.domain, &m.domain)
+	cfg.String("selector", false, false, m.selector, &m.selector)
+	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
+	cfg.StringList("sign_fields", false, false, signDefault, &m.signHeader)
+	cfg.Enum("header_canon", false, false,
+		[]string{arc.CanonRelaxed, arc.CanonSimple}, arc.CanonRelaxed, &m.headerCanon)
+	cfg.Enum("body_canon", false, false,
+		[]string{arc.CanonRelaxed, arc.CanonSimple}, arc.CanonRelaxed, &m.bodyCanon)
+	cfg.Enum("newkey_algo", false, false,
+		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
+
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if m.domain == "" {
+		return errors.New("modify.arc: domain is not specified")
+	}
+	if m.selector == "" {
+		return errors.New("modify.arc: selector is not specified")
+	}
+
+	keyPath := strings.NewReplacer("{domain}", m.domain, "{selector}", m.selector).Replace(keyPathTemplate)
+	signer, newKey, err := dkim.LoadOrGenerateKey(m.log, keyPath, newKeyAlgo)
+	if err != nil {
+		return err
+	}
+	if newKey {
+		m.log.Printf("generated a new %s keypair for ARC sealing, private key is in %s,\n"+
+			"put the contents of the .dns file into TXT record for %s._domainkey.%s",
+			newKeyAlgo, keyPath, m.selector, m.domain)
+	}
+	m.signer = signer
+
+	return nil
+}
+
+func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
+	seen := make(map[string]struct{})
+	res := make([]string, 0, len(m.signHeader))
+	for _, key := range m.signHeader {
+		if _, ok := seen[strings.ToLower(key)]; ok {
+			continue
+		}
+		seen[strings.ToLower(key)] = struct{}{}
+
+		for field := h.FieldsByKey(key); field.Next(); {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+type state struct {
+	m    *Modifier
+	meta *module.MsgMetadata
+	log  log.Logger
+}
+
+func (m *Modifier) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata) (module.ModifierState, error) {
+	return &state{
+		m:    m,
+		meta: msgMeta,
+		log:  target.DeliveryLogger(m.log, msgMeta),
+	}, nil
+}
+
+func (s *state) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
+	return mailFrom, nil
+}
+
+func (s *state) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
+	return []string{rcptTo}, nil
+}
+
+// localAuthResults returns the results recorded by this server in the
+// topmost Authentication-Results field and the ARC validation status
+// reported by check.arc, if any.
+func (s *state) localAuthResults(h *textproto.Header) (results string, cv string) {
+	for field := h.FieldsByKey("Authentication-Results"); field.Next(); {
+		id, rest, ok := strings.Cut(field.Value(), ";")
+		if !ok || !strings.EqualFold(strings.TrimSpace(id), s.m.authservID) {
+			continue
+		}
+		results = strings.Join(strings.Fields(rest), " ")
+
+		_, parsed, err := authres.Parse(field.Value())
+		if err != nil {
+			s.log.Error("malformed Authentication-Results", err)
+			return results, ""
+		}
+		for _, res := range parsed {
+			if generic, ok := res.(*authres.GenericResult); ok && generic.Method == "arc" {
+				switch generic.Value {
+				case authres.ResultNone:
+					cv = arc.ChainNone
+				case authres.ResultPass:
+					cv = arc.ChainPass
+				default:
+					cv = arc.ChainFail
+				}
+			}
+		}
+		return results, cv
+	}
+	return "", ""
+}
+
+func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
+	defer trace.StartRegion(ctx, "modify.arc/RewriteBody").End()
+
+	results, cv := s.localAuthResults(h)
+	if cv == "" {
+		// check.arc is not used, validate the chain ourselves.
+		res := arc.Verify(ctx, s.m.resolver.LookupTXT, *h, body)
+		switch res.Value {
+		case authres.ResultNone:
+			cv = arc.ChainNone
+		case authres.ResultPass:
+			cv = arc.ChainPass
+		default:
+			cv = arc.ChainFail
+		}
+	}
+
+	err := arc.Seal(h, body, &arc.SealOptions{
+		Domain:          s.m.domain,
+		Selector:        s.m.selector,
+		Signer:          s.m.signer,
+		HeaderKeys:      s.m.fieldsToSign(h),
+		HeaderCanon:     s.m.headerCanon,
+		BodyCanon:       s.m.bodyCanon,
+		AuthServID:      s.m.authservID,
+		AuthResults:     results,
+		ChainValidation: cv,
+	})
+	if err != nil {
+		if errors.Is(err, arc.ErrNoSeal) {
+			s.log.DebugMsg("not sealing, chain is already failed or too long")
+			return nil
+		}
+		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.arc"})
+	}
+
+	s.log.DebugMsg("sealed", "domain", s.m.domain, "cv", cv)
+	return nil
+}
+
+func (s *state) Close() error {
+	return nil
+}
+
+func init() {
+	module.Register("modify.arc", New)
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"github.com/emersion/go-message/textproto"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirrchat/SirrMesh/framework/buffer"
 	"github.com/sirrchat/SirrMesh/framework/config"
 	modconfig "github.com/sirrchat/SirrMesh/framework/config/module"
@@ -15,6 +16,16 @@ const (
 	blockchainTypeHeader      = "X-Blockchain-Type"
 )
 
+var txRelayed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "sirrmesh",
+		Subsystem: "blockchain",
+		Name:      "tx_relayed_total",
+		Help:      "Raw transactions from message headers relayed to the chain by result (ok or error)",
+	},
+	[]string{"module", "chain", "result"},
+)
+
 type blockchainTxSender struct {
 	modName    string
 	instName   string
@@ -66,8 +77,11 @@ func (b *blockchainTxSender) RewriteBody(ctx context.Context, h *textproto.Heade
 	if c.ChainType(ctx) == h.Get(blockchainTypeHeader) && h.Get(blockchainRawTxMailHeader) != "" {
 		err := c.SendRawTx(ctx, h.Get(blockchainRawTxMailHeader))
 		if err == nil {
+			txRelayed.WithLabelValues(b.instName, c.ChainType(ctx), "ok").Inc()
 			h.Del(blockchainRawTxMailHeader)
 			h.Del(blockchainTypeHeader)
+		} else {
+			txRelayed.WithLabelValues(b.instName, c.ChainType(ctx), "error").Inc()
 		}
 		return err
 	}
@@ -79,5 +93,6 @@ func (b *blockchainTxSender) Close() error {
 }
 
 func init() {
+	prometheus.MustRegister(txRelayed)
 	module.Register("modify.blockchain_tx", NewBlockchainTxSender)
 }
@@ -24,9 +24,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"path/filepath"
 	"runtime/trace"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-message/textproto"
@@ -34,6 +34,7 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/address"
 	"github.com/sirrchat/SirrMesh/framework/buffer"
 	"github.com/sirrchat/SirrMesh/framework/config"
+	modconfig "github.com/sirrchat/SirrMesh/framework/config/module"
 	"github.com/sirrchat/SirrMesh/framework/dns"
 	"github.com/sirrchat/SirrMesh/framework/exterrors"
 	"github.com/sirrchat/SirrMesh/framework/log"
@@ -96,9 +97,23 @@ var (
 type Modifier struct {
 	instName string
 
-	domains        []string
-	selector       string
-	signers        map[string]crypto.Signer
+	domains         []string
+	selector        string
+	ed25519Selector string
+	keyPathTemplate string
+	newKeyAlgo      string
+
+	signersLck sync.RWMutex
+	signers    map[string][]signingKey
+
+	rotateInterval time.Duration
+	retireAfter    time.Duration
+	dnsTTL         time.Duration
+	dnsZone        string
+	dnsProvider    dnsProvider
+	rotateStop     chan struct{}
+	rotateDone     chan struct{}
+
 	oversignHeader []string
 	signHeader     []string
 	headerCanon    dkim.Canonicalization
@@ -114,7 +129,7 @@ type Modifier struct {
 func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 	m := &Modifier{
 		instName: instName,
-		signers:  map[string]crypto.Signer{},
+		signers:  map[string][]signingKey{},
 		log:      log.Logger{Name: "modify.dkim"},
 	}
 
@@ -140,16 +155,13 @@ func (m *Modifier) InstanceName() string {
 }
 
 func (m *Modifier) Init(cfg *config.Map) error {
-	var (
-		hashName        string
-		keyPathTemplate string
-		newKeyAlgo      string
-	)
+	var hashName string
 
-	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Logger(true, false, &m.log)
 	cfg.StringList("domains", false, false, m.domains, &m.domains)
 	cfg.String("selector", false, false, m.selector, &m.selector)
-	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &keyPathTemplate)
+	cfg.String("ed25519_selector", false, false, "", &m.ed25519Selector)
+	cfg.String("key_path", false, false, "dkim_keys/{domain}_{selector}.key", &m.keyPathTemplate)
 	cfg.StringList("oversign_fields", false, false, oversignDefault, &m.oversignHeader)
 	cfg.StringList("sign_fields", false, false, signDefault, &m.signHeader)
 	cfg.Enum("header_canon", false, false,
@@ -162,9 +174,20 @@ func (m *Modifier) Init(cfg *config.Map) error {
 	cfg.Enum("hash", false, false,
 		[]string{"sha256"}, "sha256", &hashName)
 	cfg.Enum("newkey_algo", false, false,
-		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &newKeyAlgo)
+		[]string{"rsa4096", "rsa2048", "ed25519"}, "rsa2048", &m.newKeyAlgo)
 	cfg.Bool("allow_multiple_from", false, false, &m.multipleFromOk)
 	cfg.Bool("sign_subdomains", false, false, &m.signSubdomains)
+	cfg.Duration("rotate_interval", false, false, 0, &m.rotateInterval)
+	cfg.Duration("retire_after", false, false, 7*Day, &m.retireAfter)
+	cfg.Duration("dns_ttl", false, false, time.Hour, &m.dnsTTL)
+	cfg.String("dns_zone", false, false, "", &m.dnsZone)
+	cfg.Custom("dns_provider", false, false, func() (interface{}, error) {
+		return nil, nil
+	}, func(m *config.Map, node config.Node) (interface{}, error) {
+		var p dnsProvider
+		err := modconfig.ModuleFromNode("libdns", node.Args, node, m.Globals, &p)
+		return p, err
+	}, &m.dnsProvider)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -185,39 +208,83 @@ func (m *Modifier) Init(cfg *config.Map) error {
 		panic("modify.dkim.Init: Hash function allowed by config matcher but not present in hashFuncs")
 	}
 
+	if m.ed25519Selector == m.selector {
+		return errors.New("modify.dkim: ed25519_selector should be different from selector")
+	}
 	for _, domain := range m.domains {
 		if _, err := idna.ToASCII(domain); err != nil {
 			m.log.Printf("warning: unable to convert domain %s to A-labels form, non-EAI messages will not be signed: %v", domain, err)
 		}
+	}
 
-		keyValues := strings.NewReplacer("{domain}", domain, "{selector}", m.selector)
-		keyPath := keyValues.Replace(keyPathTemplate)
-
-		signer, newKey, err := m.loadOrGenerateKey(keyPath, newKeyAlgo)
-		if err != nil {
+	if m.rotateInterval != 0 {
+		if m.dnsProvider == nil {
+			return errors.New("modify.dkim: rotate_interval requires dns_provider to publish new keys")
+		}
+		if m.rotateInterval < Day {
+			return errors.New("modify.dkim: rotate_interval should be at least 24h")
+		}
+		if !strings.Contains(m.keyPathTemplate, "{selector}") {
+			return errors.New("modify.dkim: key_path should contain {selector} to use key rotation")
+		}
+		if module.DryRun {
+			return nil
+		}
+		if err := m.rotate(context.Background(), time.Now()); err != nil {
 			return err
 		}
+		m.rotateStop = make(chan struct{})
+		m.rotateDone = make(chan struct{})
+		go m.rotator()
+		return nil
+	}
 
-		if newKey {
-			dnsPath := keyPath + ".dns"
-			if filepath.Ext(keyPath) == ".key" {
-				dnsPath = keyPath[:len(keyPath)-4] + ".dns"
+	for _, domain := range m.domains {
+		for _, slot := range m.slots() {
+			keyPath := m.keyPath(domain, slot.selector)
+			signer, newKey, err := m.loadOrGenerateKey(keyPath, slot.algo)
+			if err != nil {
+				return err
 			}
-			m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
-				"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
-				newKeyAlgo, keyPath, dnsPath, m.selector, domain)
-		}
 
-		normDomain, err := dns.ForLookup(domain)
-		if err != nil {
-			return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+			if newKey {
+				m.log.Printf("generated a new %s keypair, private key is in %s, TXT record with public key is in %s,\n"+
+					"put its contents into TXT record for %s._domainkey.%s to make signing and verification work",
+					slot.algo, keyPath, dnsRecordPath(keyPath), slot.selector, domain)
+			}
+
+			if err := m.addSigner(m.signers, domain, slot.selector, signer); err != nil {
+				return err
+			}
 		}
-		m.signers[normDomain] = signer
 	}
 
 	return nil
 }
 
+type signingKey struct {
+	selector string
+	signer   crypto.Signer
+}
+
+func (m *Modifier) addSigner(signers map[string][]signingKey, domain, selector string, signer crypto.Signer) error {
+	normDomain, err := dns.ForLookup(domain)
+	if err != nil {
+		return fmt.Errorf("sign_skim: unable to normalize domain %s: %w", domain, err)
+	}
+	signers[normDomain] = append(signers[normDomain], signingKey{selector: selector, signer: signer})
+	return nil
+}
+
+func (m *Modifier) Close() error {
+	if m.rotateStop == nil {
+		return nil
+	}
+	close(m.rotateStop)
+	<-m.rotateDone
+	return nil
+}
+
 func (m *Modifier) fieldsToSign(h *textproto.Header) []string {
 	// Filter out duplicated fields from configs so they
 	// will not cause panic() in go-msgauth internals.
@@ -290,7 +357,6 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 	if domain == "" {
 		domain = s.m.domains[0]
 	}
-	selector := s.m.selector
 
 	if s.m.signSubdomains {
 		topDomain := s.m.domains[0]
@@ -303,8 +369,10 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		s.log.Error("unable to normalize domain from envelope sender", err, "domain", domain)
 		return nil
 	}
-	keySigner := s.m.signers[normDomain]
-	if keySigner == nil {
+	s.m.signersLck.RLock()
+	keys := s.m.signers[normDomain]
+	s.m.signersLck.RUnlock()
+	if len(keys) == 0 {
 		s.log.Msg("no key for domain", "domain", normDomain)
 		return nil
 	}
@@ -317,13 +385,37 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		if err != nil {
 			return nil
 		}
+	}
 
-		selector, err = idna.ToASCII(selector)
+	// All signatures cover the same set of fields, DKIM-Signature is not
+	// included so signatures are independent of each other.
+	headerKeys := s.m.fieldsToSign(h)
+	sigs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		selector := key.selector
+		if !s.meta.SMTPOpts.UTF8 {
+			selector, err = idna.ToASCII(selector)
+			if err != nil {
+				return nil
+			}
+		}
+
+		sig, err := s.sign(h, body, domain, selector, key.signer, headerKeys)
 		if err != nil {
-			return nil
+			return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
 		}
+		sigs = append(sigs, sig)
+	}
+	for _, sig := range sigs {
+		h.AddRaw([]byte(sig))
 	}
 
+	s.m.log.DebugMsg("signed", "domain", domain, "signatures", len(sigs))
+
+	return nil
+}
+
+func (s *state) sign(h *textproto.Header, body buffer.Buffer, domain, selector string, keySigner crypto.Signer, headerKeys []string) (string, error) {
 	opts := dkim.SignOptions{
 		Domain:                 domain,
 		Selector:               selector,
@@ -332,38 +424,34 @@ func (s *state) RewriteBody(ctx context.Context, h *textproto.Header, body buffe
 		Hash:                   s.m.hash,
 		HeaderCanonicalization: s.m.headerCanon,
 		BodyCanonicalization:   s.m.bodyCanon,
-		HeaderKeys:             s.m.fieldsToSign(h),
+		HeaderKeys:             headerKeys,
 	}
 	if s.m.sigExpiry != 0 {
 		opts.Expiration = time.Now().Add(s.m.sigExpiry)
 	}
 	signer, err := dkim.NewSigner(&opts)
 	if err != nil {
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		return "", err
 	}
 	if err := textproto.WriteHeader(signer, *h); err != nil {
 		signer.Close()
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		return "", err
 	}
 	r, err := body.Open()
 	if err != nil {
 		signer.Close()
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		return "", err
 	}
+	defer r.Close()
 	if _, err := io.Copy(signer, r); err != nil {
 		signer.Close()
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		return "", err
 	}
 
 	if err := signer.Close(); err != nil {
-		return exterrors.WithFields(err, map[string]interface{}{"modifier": "modify.dkim"})
+		return "", err
 	}
-
-	h.AddRaw([]byte(signer.Signature()))
-
-	s.m.log.DebugMsg("signed", "domain", domain)
-
-	return nil
+	return signer.Signature(), nil
 }
 
 func (s state) Close() error {
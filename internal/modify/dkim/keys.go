@@ -31,13 +31,30 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
 )
 
 func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Signer, newKey bool, err error) {
+	return LoadOrGenerateKey(m.log, keyPath, newKeyAlgo)
+}
+
+// LoadOrGenerateKey reads the private key from keyPath. If the file does not
+// exist, a new key of type newKeyAlgo (rsa4096, rsa2048 or ed25519) is
+// generated and written to keyPath together with the .dns file containing
+// the public key record. If module.DryRun is set, the missing key is not
+// generated and nil is returned.
+//
+// It is also used by modify.arc that shares the key format with modify.dkim.
+func LoadOrGenerateKey(logger log.Logger, keyPath, newKeyAlgo string) (pkey crypto.Signer, newKey bool, err error) {
 	f, err := os.Open(keyPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			pkey, err = m.generateAndWrite(keyPath, newKeyAlgo)
+			if module.DryRun {
+				return nil, false, nil
+			}
+			pkey, err = generateAndWrite(logger, keyPath, newKeyAlgo)
 			return pkey, true, err
 		}
 		return nil, false, err
@@ -91,12 +108,12 @@ func (m *Modifier) loadOrGenerateKey(keyPath, newKeyAlgo string) (pkey crypto.Si
 	}
 }
 
-func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer, error) {
+func generateAndWrite(logger log.Logger, keyPath, newKeyAlgo string) (crypto.Signer, error) {
 	wrapErr := func(err error) error {
 		return fmt.Errorf("modify.dkim: generate %s: %w", keyPath, err)
 	}
 
-	m.log.Printf("generating a new %s keypair...", newKeyAlgo)
+	logger.Printf("generating a new %s keypair...", newKeyAlgo)
 
 	var (
 		pkey     crypto.Signer
@@ -151,11 +168,28 @@ func (m *Modifier) generateAndWrite(keyPath, newKeyAlgo string) (crypto.Signer,
 }
 
 func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, error) {
-	var (
-		keyBlob []byte
-		pubkey  = pkey.Public()
-	)
-	switch pubkey := pubkey.(type) {
+	keyRecord, err := publicKeyRecord(dkimAlgoName, pkey)
+	if err != nil {
+		return "", err
+	}
+
+	dnsPath := dnsRecordPath(keyPath)
+	dnsF, err := os.Create(dnsPath)
+	if err != nil {
+		return "", err
+	}
+	defer dnsF.Close()
+	if _, err := io.WriteString(dnsF, keyRecord); err != nil {
+		return "", err
+	}
+	return dnsPath, nil
+}
+
+// publicKeyRecord returns the DKIM key record (RFC 6376 Section 3.6.1) for
+// the public part of pkey.
+func publicKeyRecord(dkimAlgoName string, pkey crypto.Signer) (string, error) {
+	var keyBlob []byte
+	switch pubkey := pkey.Public().(type) {
 	case *rsa.PublicKey:
 		var err error
 		keyBlob, err = x509.MarshalPKIXPublicKey(pubkey)
@@ -165,20 +199,16 @@ func writeDNSRecord(keyPath, dkimAlgoName string, pkey crypto.Signer) (string, e
 	case ed25519.PublicKey:
 		keyBlob = pubkey
 	default:
-		panic("modify.dkim.writeDNSRecord: unknown key algorithm")
+		panic("modify.dkim.publicKeyRecord: unknown key algorithm")
 	}
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", dkimAlgoName, base64.StdEncoding.EncodeToString(keyBlob)), nil
+}
 
-	dnsPath := keyPath + ".dns"
+// dnsRecordPath returns the path of the file containing the DNS record for
+// the key at keyPath.
+func dnsRecordPath(keyPath string) string {
 	if filepath.Ext(keyPath) == ".key" {
-		dnsPath = keyPath[:len(keyPath)-4] + ".dns"
-	}
-	dnsF, err := os.Create(dnsPath)
-	if err != nil {
-		return "", err
+		return keyPath[:len(keyPath)-4] + ".dns"
 	}
-	keyRecord := fmt.Sprintf("v=DKIM1; k=%s; p=%s", dkimAlgoName, base64.StdEncoding.EncodeToString(keyBlob))
-	if _, err := io.WriteString(dnsF, keyRecord); err != nil {
-		return "", err
-	}
-	return dnsPath, nil
+	return keyPath + ".dns"
 }
@@ -0,0 +1,370 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Key states tracked in the KeyRing.
+//
+// A new key is generated and published as pending, it becomes active once
+// the DNS TTL passes and the previously active key is kept published as
+// retiring until signatures made using it expire.
+const (
+	KeyPending  = "pending"
+	KeyActive   = "active"
+	KeyRetiring = "retiring"
+)
+
+// dnsProvider is the subset of libdns interfaces used to publish keys.
+type dnsProvider interface {
+	libdns.RecordAppender
+	libdns.RecordDeleter
+}
+
+// KeyInfo describes a single key managed by modify.dkim.
+type KeyInfo struct {
+	// Slot is the configured selector the key belongs to. Rotated keys get
+	// selectors derived from it.
+	Slot      string    `json:"slot"`
+	Selector  string    `json:"selector"`
+	KeyPath   string    `json:"key_path"`
+	Record    string    `json:"record"`
+	State     string    `json:"state"`
+	Created   time.Time `json:"created"`
+	Published time.Time `json:"published"`
+	Activated time.Time `json:"activated"`
+	Retired   time.Time `json:"retired"`
+}
+
+// KeyRing is the list of keys for the domain.
+//
+// It is kept as JSON next to the key files and is also read by
+// 'sirrmeshd dns export'.
+type KeyRing struct {
+	Domain string    `json:"domain"`
+	Keys   []KeyInfo `json:"keys"`
+}
+
+// KeyRingPath returns the location of the key ring for the domain.
+func KeyRingPath(keyDir, domain string) string {
+	return filepath.Join(keyDir, domain+".keys.json")
+}
+
+// LoadKeyRing reads the key ring from path. Empty key ring is returned if the
+// file does not exist.
+func LoadKeyRing(path string) (*KeyRing, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &KeyRing{}, nil
+		}
+		return nil, err
+	}
+	ring := &KeyRing{}
+	if err := json.Unmarshal(blob, ring); err != nil {
+		return nil, fmt.Errorf("modify.dkim: %s: %w", path, err)
+	}
+	return ring, nil
+}
+
+func (kr *KeyRing) Save(path string) error {
+	blob, err := json.MarshalIndent(kr, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, blob, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (kr *KeyRing) find(slot, state string) *KeyInfo {
+	for i := range kr.Keys {
+		if kr.Keys[i].Slot == slot && kr.Keys[i].State == state {
+			return &kr.Keys[i]
+		}
+	}
+	return nil
+}
+
+type keySlot struct {
+	selector string
+	algo     string
+}
+
+func (m *Modifier) slots() []keySlot {
+	slots := []keySlot{{selector: m.selector, algo: m.newKeyAlgo}}
+	if m.ed25519Selector != "" {
+		slots = append(slots, keySlot{selector: m.ed25519Selector, algo: "ed25519"})
+	}
+	return slots
+}
+
+func (m *Modifier) keyPath(domain, selector string) string {
+	return strings.NewReplacer("{domain}", domain, "{selector}", selector).Replace(m.keyPathTemplate)
+}
+
+func (m *Modifier) keyRingPath(domain string) string {
+	return KeyRingPath(filepath.Dir(m.keyPath(domain, m.selector)), domain)
+}
+
+func dkimAlgoName(pkey crypto.Signer) string {
+	if _, ok := pkey.Public().(ed25519.PublicKey); ok {
+		return "ed25519"
+	}
+	return "rsa"
+}
+
+// recordName returns the zone and the zone-relative name of the key record.
+func (m *Modifier) recordName(domain, selector string) (zone, name string) {
+	zone = m.dnsZone
+	if zone == "" {
+		var err error
+		zone, err = publicsuffix.EffectiveTLDPlusOne(domain)
+		if err != nil {
+			zone = domain
+		}
+	}
+	zone = strings.TrimSuffix(zone, ".")
+
+	name = selector + "._domainkey"
+	if sub := strings.TrimSuffix(domain, zone); sub != "" {
+		name += "." + strings.TrimSuffix(sub, ".")
+	}
+	return zone + ".", name
+}
+
+func (m *Modifier) publish(ctx context.Context, domain string, key *KeyInfo) error {
+	zone, name := m.recordName(domain, key.Selector)
+	_, err := m.dnsProvider.AppendRecords(ctx, zone, []libdns.Record{{
+		Type:  "TXT",
+		Name:  name,
+		Value: key.Record,
+		TTL:   m.dnsTTL,
+	}})
+	if err != nil {
+		return fmt.Errorf("modify.dkim: publish %s: %w", key.Selector, err)
+	}
+	m.log.Msg("published DKIM key", "domain", domain, "selector", key.Selector)
+	return nil
+}
+
+func (m *Modifier) unpublish(ctx context.Context, domain string, key *KeyInfo) error {
+	zone, name := m.recordName(domain, key.Selector)
+	_, err := m.dnsProvider.DeleteRecords(ctx, zone, []libdns.Record{{
+		Type:  "TXT",
+		Name:  name,
+		Value: key.Record,
+	}})
+	if err != nil {
+		return fmt.Errorf("modify.dkim: unpublish %s: %w", key.Selector, err)
+	}
+	m.log.Msg("removed DKIM key record", "domain", domain, "selector", key.Selector)
+	return nil
+}
+
+// bootstrapRing adds keys at the configured selectors to the empty key ring.
+// Existing keys are assumed to be already published.
+func (m *Modifier) bootstrapRing(ctx context.Context, domain string, ring *KeyRing, now time.Time) error {
+	ring.Domain = domain
+	for _, slot := range m.slots() {
+		if ring.find(slot.selector, KeyActive) != nil {
+			continue
+		}
+		keyPath := m.keyPath(domain, slot.selector)
+		signer, newKey, err := m.loadOrGenerateKey(keyPath, slot.algo)
+		if err != nil {
+			return err
+		}
+		record, err := publicKeyRecord(dkimAlgoName(signer), signer)
+		if err != nil {
+			return err
+		}
+		ring.Keys = append(ring.Keys, KeyInfo{
+			Slot:      slot.selector,
+			Selector:  slot.selector,
+			KeyPath:   keyPath,
+			Record:    record,
+			State:     KeyActive,
+			Created:   now,
+			Activated: now,
+		})
+		if newKey {
+			key := &ring.Keys[len(ring.Keys)-1]
+			key.Published = now
+			if err := m.publish(ctx, domain, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rotateRing advances the key state machine for all slots of the domain.
+func (m *Modifier) rotateRing(ctx context.Context, domain string, ring *KeyRing, now time.Time) error {
+	// Drop keys that no longer can be used to verify signatures.
+	kept := ring.Keys[:0]
+	for _, key := range ring.Keys {
+		if key.State == KeyRetiring && !now.Before(key.Retired.Add(m.retireAfter)) {
+			if err := m.unpublish(ctx, domain, &key); err != nil {
+				m.log.Error("failed to remove retired key record", err, "domain", domain, "selector", key.Selector)
+				kept = append(kept, key)
+				continue
+			}
+			if err := os.Remove(key.KeyPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				m.log.Error("failed to remove retired key", err, "domain", domain, "selector", key.Selector)
+			}
+			os.Remove(dnsRecordPath(key.KeyPath))
+			continue
+		}
+		kept = append(kept, key)
+	}
+	ring.Keys = kept
+
+	for _, slot := range m.slots() {
+		active := ring.find(slot.selector, KeyActive)
+		pending := ring.find(slot.selector, KeyPending)
+
+		switch {
+		case pending != nil && pending.Published.IsZero():
+			pending.Published = now
+			if err := m.publish(ctx, domain, pending); err != nil {
+				pending.Published = time.Time{}
+				m.log.Error("failed to publish the new key", err, "domain", domain, "selector", pending.Selector)
+			}
+		case pending != nil && !now.Before(pending.Published.Add(m.dnsTTL)):
+			if active != nil {
+				active.State = KeyRetiring
+				active.Retired = now
+			}
+			pending.State = KeyActive
+			pending.Activated = now
+			m.log.Msg("switched to the new DKIM key", "domain", domain, "selector", pending.Selector)
+		case pending == nil && active != nil && !now.Before(active.Activated.Add(m.rotateInterval)):
+			selector := slot.selector + "-" + now.UTC().Format("20060102")
+			keyPath := m.keyPath(domain, selector)
+			signer, err := generateAndWrite(m.log, keyPath, slot.algo)
+			if err != nil {
+				return err
+			}
+			record, err := publicKeyRecord(dkimAlgoName(signer), signer)
+			if err != nil {
+				return err
+			}
+			key := KeyInfo{
+				Slot:      slot.selector,
+				Selector:  selector,
+				KeyPath:   keyPath,
+				Record:    record,
+				State:     KeyPending,
+				Created:   now,
+				Published: now,
+			}
+			if err := m.publish(ctx, domain, &key); err != nil {
+				// Keep the key, publishing will be retried.
+				key.Published = time.Time{}
+				m.log.Error("failed to publish the new key", err, "domain", domain, "selector", selector)
+			}
+			ring.Keys = append(ring.Keys, key)
+		}
+	}
+	return nil
+}
+
+// rotate runs the rotation for all domains and reloads signing keys.
+func (m *Modifier) rotate(ctx context.Context, now time.Time) error {
+	signers := make(map[string][]signingKey, len(m.domains))
+	for _, domain := range m.domains {
+		ringPath := m.keyRingPath(domain)
+		ring, err := LoadKeyRing(ringPath)
+		if err != nil {
+			return err
+		}
+		if err := m.bootstrapRing(ctx, domain, ring, now); err != nil {
+			return err
+		}
+		if err := m.rotateRing(ctx, domain, ring, now); err != nil {
+			return err
+		}
+		if err := ring.Save(ringPath); err != nil {
+			return fmt.Errorf("modify.dkim: %w", err)
+		}
+
+		for _, slot := range m.slots() {
+			active := ring.find(slot.selector, KeyActive)
+			if active == nil {
+				continue
+			}
+			signer, _, err := m.loadOrGenerateKey(active.KeyPath, slot.algo)
+			if err != nil {
+				return err
+			}
+			if err := m.addSigner(signers, domain, active.Selector, signer); err != nil {
+				return err
+			}
+		}
+	}
+
+	m.signersLck.Lock()
+	m.signers = signers
+	m.signersLck.Unlock()
+	return nil
+}
+
+func (m *Modifier) rotator() {
+	defer close(m.rotateDone)
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during DKIM key rotation: %v\n%s", err, stack)
+			log.Printf("DKIM key rotation disabled due to critical error")
+		}
+	}()
+
+	t := time.NewTicker(10 * time.Minute)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := m.rotate(context.Background(), time.Now()); err != nil {
+				m.log.Error("key rotation failed", err)
+			}
+		case <-m.rotateStop:
+			return
+		}
+	}
+}
@@ -0,0 +1,241 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/libdns/libdns"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+)
+
+type fakeProvider struct {
+	records map[string]string
+}
+
+func (p *fakeProvider) AppendRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	for _, rec := range recs {
+		p.records[rec.Name+"."+zone] = rec.Value
+	}
+	return recs, nil
+}
+
+func (p *fakeProvider) DeleteRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	for _, rec := range recs {
+		delete(p.records, rec.Name+"."+zone)
+	}
+	return recs, nil
+}
+
+func newDualSignModifier(t *testing.T, dir string) *Modifier {
+	mod, err := New("", "test", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mod.(*Modifier)
+	m.log = testutils.Logger(t, m.Name())
+
+	err = m.Init(config.NewMap(nil, config.Node{
+		Children: []config.Node{
+			{Name: "domains", Args: []string{"example.org"}},
+			{Name: "selector", Args: []string{"default"}},
+			{Name: "ed25519_selector", Args: []string{"ed"}},
+			{Name: "key_path", Args: []string{filepath.Join(dir, "{domain}_{selector}.key")}},
+		},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// verifySelectors checks that the message is signed using exactly the
+// specified selectors and all signatures verify using the key ring records.
+func verifySelectors(t *testing.T, ring *KeyRing, hdr textproto.Header, body []byte, selectors ...string) {
+	t.Helper()
+
+	zones := map[string]mockdns.Zone{}
+	for _, key := range ring.Keys {
+		zones[key.Selector+"._domainkey.example.org."] = mockdns.Zone{TXT: []string{key.Record}}
+	}
+
+	var fullBody bytes.Buffer
+	if err := textproto.WriteHeader(&fullBody, hdr); err != nil {
+		t.Fatal(err)
+	}
+	fullBody.Write(body)
+
+	resolver := &mockdns.Resolver{Zones: zones}
+	verifs, err := dkim.VerifyWithOptions(bytes.NewReader(fullBody.Bytes()), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			return resolver.LookupTXT(context.Background(), domain)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(verifs) != len(selectors) {
+		t.Fatalf("Expected %d signatures, got %d", len(selectors), len(verifs))
+	}
+	for _, v := range verifs {
+		if v.Err != nil {
+			t.Errorf("Verification error: %v", v.Err)
+		}
+	}
+
+	var got []string
+	for _, sig := range hdr.Values("DKIM-Signature") {
+		for _, tag := range strings.Split(sig, ";") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(tag), "="); ok && k == "s" {
+				got = append(got, v)
+			}
+		}
+	}
+	sort.Strings(got)
+	sort.Strings(selectors)
+	if strings.Join(got, " ") != strings.Join(selectors, " ") {
+		t.Errorf("Wrong selectors used: %v, want %v", got, selectors)
+	}
+}
+
+func TestDualSign(t *testing.T) {
+	dir := t.TempDir()
+	m := newDualSignModifier(t, dir)
+
+	hdr, body := signTestMsg(t, m, "test@example.org")
+
+	ring := &KeyRing{}
+	for _, sel := range []string{"default", "ed"} {
+		record, err := os.ReadFile(filepath.Join(dir, "example.org_"+sel+".dns"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ring.Keys = append(ring.Keys, KeyInfo{Selector: sel, Record: string(record)})
+	}
+	if !strings.Contains(ring.Keys[1].Record, "k=ed25519") {
+		t.Errorf("Expected Ed25519 key for the second selector: %s", ring.Keys[1].Record)
+	}
+	verifySelectors(t, ring, hdr, body, "default", "ed")
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	m := newDualSignModifier(t, dir)
+	provider := &fakeProvider{records: map[string]string{}}
+	m.dnsProvider = provider
+	m.rotateInterval = 30 * Day
+	m.dnsTTL = time.Hour
+
+	loadRing := func() *KeyRing {
+		t.Helper()
+		ring, err := LoadKeyRing(KeyRingPath(dir, "example.org"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ring
+	}
+	states := func(ring *KeyRing) map[string]string {
+		res := map[string]string{}
+		for _, key := range ring.Keys {
+			res[key.Selector] = key.State
+		}
+		return res
+	}
+
+	t0 := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := m.rotate(context.Background(), t0); err != nil {
+		t.Fatal(err)
+	}
+	ring := loadRing()
+	if len(ring.Keys) != 2 || ring.Keys[0].State != KeyActive || ring.Keys[1].State != KeyActive {
+		t.Fatalf("Wrong bootstrapped key ring: %+v", states(ring))
+	}
+	if len(provider.records) != 0 {
+		t.Errorf("Existing keys should not be published: %v", provider.records)
+	}
+
+	// Rotation is due, new keys are published but not used yet.
+	t1 := t0.Add(31 * Day)
+	if err := m.rotate(context.Background(), t1); err != nil {
+		t.Fatal(err)
+	}
+	ring = loadRing()
+	if s := states(ring); s["default-20240401"] != KeyPending || s["ed-20240401"] != KeyPending {
+		t.Fatalf("Wrong key ring after generation: %v", s)
+	}
+	if _, ok := provider.records["default-20240401._domainkey.example.org."]; !ok {
+		t.Errorf("New key is not published: %v", provider.records)
+	}
+	hdr, body := signTestMsg(t, m, "test@example.org")
+	verifySelectors(t, ring, hdr, body, "default", "ed")
+
+	// DNS TTL passed, switch to new keys.
+	t2 := t1.Add(2 * time.Hour)
+	if err := m.rotate(context.Background(), t2); err != nil {
+		t.Fatal(err)
+	}
+	ring = loadRing()
+	s := states(ring)
+	if s["default-20240401"] != KeyActive || s["default"] != KeyRetiring || s["ed"] != KeyRetiring {
+		t.Fatalf("Wrong key ring after switch: %v", s)
+	}
+	hdr, body = signTestMsg(t, m, "test@example.org")
+	verifySelectors(t, ring, hdr, body, "default-20240401", "ed-20240401")
+
+	// Old keys are removed.
+	t3 := t2.Add(8 * Day)
+	if err := m.rotate(context.Background(), t3); err != nil {
+		t.Fatal(err)
+	}
+	ring = loadRing()
+	if len(ring.Keys) != 2 {
+		t.Fatalf("Retired keys are not removed: %v", states(ring))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.org_default.key")); !os.IsNotExist(err) {
+		t.Errorf("Retired key file is not removed: %v", err)
+	}
+}
+
+func TestRecordName(t *testing.T) {
+	m := &Modifier{}
+	test := func(domain, selector, zone, name string) {
+		t.Helper()
+		gotZone, gotName := m.recordName(domain, selector)
+		if gotZone != zone || gotName != name {
+			t.Errorf("%s: got %s %s, want %s %s", domain, gotZone, gotName, zone, name)
+		}
+	}
+	test("example.org", "default", "example.org.", "default._domainkey")
+	test("mail.example.org", "default", "example.org.", "default._domainkey.mail")
+	test("example.co.uk", "s1", "example.co.uk.", "s1._domainkey")
+
+	m.dnsZone = "mail.example.org"
+	test("mail.example.org", "default", "mail.example.org.", "default._domainkey")
+}
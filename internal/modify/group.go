@@ -20,12 +20,16 @@ package modify
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/emersion/go-message/textproto"
 	"github.com/sirrchat/SirrMesh/framework/buffer"
 	"github.com/sirrchat/SirrMesh/framework/config"
 	modconfig "github.com/sirrchat/SirrMesh/framework/config/module"
 	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/framework/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type (
@@ -40,6 +44,8 @@ type (
 
 	groupState struct {
 		states []module.ModifierState
+		// names contains modifier names used for tracing spans.
+		names []string
 	}
 )
 
@@ -76,14 +82,17 @@ func (g Group) ModStateForMsg(ctx context.Context, msgMeta *module.MsgMetadata)
 			return nil, err
 		}
 		gs.states = append(gs.states, state)
+		gs.names = append(gs.names, modifierName(modifier))
 	}
 	return gs, nil
 }
 
 func (gs groupState) RewriteSender(ctx context.Context, mailFrom string) (string, error) {
 	var err error
-	for _, state := range gs.states {
-		mailFrom, err = state.RewriteSender(ctx, mailFrom)
+	for i, state := range gs.states {
+		modCtx, span := gs.startSpan(ctx, i, "sender")
+		mailFrom, err = state.RewriteSender(modCtx, mailFrom)
+		tracing.End(span, err)
 		if err != nil {
 			return "", err
 		}
@@ -94,30 +103,53 @@ func (gs groupState) RewriteSender(ctx context.Context, mailFrom string) (string
 func (gs groupState) RewriteRcpt(ctx context.Context, rcptTo string) ([]string, error) {
 	var err error
 	var result = []string{rcptTo}
-	for _, state := range gs.states {
+	for i, state := range gs.states {
+		modCtx, span := gs.startSpan(ctx, i, "rcpt")
 		var intermediateResult = []string{}
 		for _, partResult := range result {
 			var partResult_multi []string
-			partResult_multi, err = state.RewriteRcpt(ctx, partResult)
+			partResult_multi, err = state.RewriteRcpt(modCtx, partResult)
 			if err != nil {
+				tracing.End(span, err)
 				return []string{""}, err
 			}
 			intermediateResult = append(intermediateResult, partResult_multi...)
 		}
+		span.End()
 		result = intermediateResult
 	}
 	return result, nil
 }
 
 func (gs groupState) RewriteBody(ctx context.Context, h *textproto.Header, body buffer.Buffer) error {
-	for _, state := range gs.states {
-		if err := state.RewriteBody(ctx, h, body); err != nil {
+	for i, state := range gs.states {
+		modCtx, span := gs.startSpan(ctx, i, "body")
+		err := state.RewriteBody(modCtx, h, body)
+		tracing.End(span, err)
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+func (gs groupState) startSpan(ctx context.Context, i int, stage string) (context.Context, trace.Span) {
+	return tracing.Start(ctx, "modify "+gs.names[i],
+		attribute.String("sirrmesh.modifier", gs.names[i]),
+		attribute.String("sirrmesh.modifier.stage", stage))
+}
+
+func modifierName(modifier module.Modifier) string {
+	mod, ok := modifier.(module.Module)
+	if !ok {
+		return fmt.Sprintf("%T", modifier)
+	}
+	if mod.InstanceName() == "" {
+		return mod.Name()
+	}
+	return mod.Name() + ":" + mod.InstanceName()
+}
+
 func (gs groupState) Close() error {
 	// We still try close all state objects to minimize
 	// resource leaks when Close fails for one object..
@@ -20,6 +20,7 @@ package msgpipeline
 
 import (
 	"context"
+	"errors"
 	"runtime/debug"
 	"sync"
 
@@ -30,7 +31,11 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/exterrors"
 	"github.com/sirrchat/SirrMesh/framework/log"
 	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/framework/tracing"
 	"github.com/sirrchat/SirrMesh/internal/dmarc"
+	"github.com/sirrchat/SirrMesh/internal/dmarc/report"
+	"github.com/sirrchat/SirrMesh/internal/msgtrack"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // checkRunner runs groups of checks, collects and merges results.
@@ -48,10 +53,13 @@ type checkRunner struct {
 	doDMARC       bool
 	didDMARCFetch bool
 	dmarcVerify   *dmarc.Verifier
+	dmarcReports  *report.Reporter
 
 	log log.Logger
 
 	states map[module.Check]module.CheckState
+	// names contains the check names used for tracing spans.
+	names map[module.CheckState]string
 
 	mergedRes module.CheckResult
 }
@@ -64,6 +72,7 @@ func newCheckRunner(msgMeta *module.MsgMetadata, log log.Logger, r dns.Resolver)
 		resolver:             r,
 		dmarcVerify:          dmarc.NewVerifier(r),
 		states:               make(map[module.Check]module.CheckState),
+		names:                make(map[module.CheckState]string),
 	}
 }
 
@@ -93,6 +102,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 		states = append(states, state)
 		newStates = append(newStates, state)
 		newStatesMap[check] = state
+		cr.names[state] = objectName(check)
 	}
 
 	if len(newStates) == 0 {
@@ -105,7 +115,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	// Done outside of check loop above to make sure we can run these for multiple
 	// checks in parallel.
 	if cr.mailFromReceived {
-		err := cr.runAndMergeResults(newStates, func(s module.CheckState) module.CheckResult {
+		err := cr.runAndMergeResults(ctx, "connection", newStates, func(ctx context.Context, s module.CheckState) module.CheckResult {
 			res := s.CheckConnection(ctx)
 			return res
 		})
@@ -113,7 +123,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 			closeStates()
 			return nil, err
 		}
-		err = cr.runAndMergeResults(newStates, func(s module.CheckState) module.CheckResult {
+		err = cr.runAndMergeResults(ctx, "sender", newStates, func(ctx context.Context, s module.CheckState) module.CheckResult {
 			res := s.CheckSender(ctx, cr.mailFrom)
 			return res
 		})
@@ -125,7 +135,7 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 
 	if len(cr.checkedRcpts) != 0 {
 		for _, rcpt := range cr.checkedRcpts {
-			err := cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+			err := cr.runAndMergeResults(ctx, "rcpt", states, func(ctx context.Context, s module.CheckState) module.CheckResult {
 				// Avoid calling CheckRcpt for the same recipient for the same check
 				// multiple times, even if requested.
 				cr.checkedRcptsLock.Lock()
@@ -158,7 +168,10 @@ func (cr *checkRunner) checkStates(ctx context.Context, checks []module.Check) (
 	return states, nil
 }
 
-func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner func(module.CheckState) module.CheckResult) error {
+// runAndMergeResults runs the runner for all states in parallel and merges
+// the results. Each invocation is wrapped into a "check <name>" span, stage
+// is used as the sirrmesh.check.stage attribute value.
+func (cr *checkRunner) runAndMergeResults(ctx context.Context, stage string, states []module.CheckState, runner func(context.Context, module.CheckState) module.CheckResult) error {
 	data := struct {
 		authResLock sync.Mutex
 		headerLock  sync.Mutex
@@ -185,7 +198,27 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 				}
 			}()
 
-			subCheckRes := runner(state)
+			name := cr.names[state]
+			checkCtx, span := tracing.Start(ctx, "check "+name,
+				attribute.String("sirrmesh.check", name),
+				attribute.String("sirrmesh.check.stage", stage))
+			subCheckRes := runner(checkCtx, state)
+			span.SetAttributes(
+				attribute.Bool("sirrmesh.check.reject", subCheckRes.Reject),
+				attribute.Bool("sirrmesh.check.quarantine", subCheckRes.Quarantine))
+			if subCheckRes.Reject || subCheckRes.Quarantine {
+				tracing.SetError(span, subCheckRes.Reason)
+			}
+			span.End()
+
+			switch {
+			case subCheckRes.Reject:
+				cr.track(name, "reject", subCheckRes.Reason)
+			case subCheckRes.Quarantine:
+				cr.track(name, "quarantine", subCheckRes.Reason)
+			case subCheckRes.Reason != nil:
+				cr.track(name, "ignore", subCheckRes.Reason)
+			}
 
 			// We check the length because we don't want to take locks
 			// when it is not necessary.
@@ -194,6 +227,12 @@ func (cr *checkRunner) runAndMergeResults(states []module.CheckState, runner fun
 				cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, subCheckRes.AuthResult...)
 				data.authResLock.Unlock()
 			}
+			if len(subCheckRes.ARCAuthResult) != 0 {
+				data.authResLock.Lock()
+				cr.mergedRes.ARCSealer = subCheckRes.ARCSealer
+				cr.mergedRes.ARCAuthResult = subCheckRes.ARCAuthResult
+				data.authResLock.Unlock()
+			}
 			if subCheckRes.Header.Len() != 0 {
 				data.headerLock.Lock()
 				for field := subCheckRes.Header.Fields(); field.Next(); {
@@ -251,7 +290,7 @@ func (cr *checkRunner) checkRcpt(ctx context.Context, checks []module.Check, rcp
 		return err
 	}
 
-	err = cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	err = cr.runAndMergeResults(ctx, "rcpt", states, func(ctx context.Context, s module.CheckState) module.CheckResult {
 		cr.checkedRcptsLock.Lock()
 		if _, ok := cr.checkedRcptsPerCheck[s][rcptTo]; ok {
 			cr.checkedRcptsLock.Unlock()
@@ -282,7 +321,7 @@ func (cr *checkRunner) checkBody(ctx context.Context, checks []module.Check, hea
 		cr.didDMARCFetch = true
 	}
 
-	return cr.runAndMergeResults(states, func(s module.CheckState) module.CheckResult {
+	return cr.runAndMergeResults(ctx, "body", states, func(ctx context.Context, s module.CheckState) module.CheckResult {
 		res := s.CheckBody(ctx, header, body)
 		return res
 	})
@@ -294,8 +333,15 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 	}
 
 	if cr.doDMARC {
-		dmarcRes, policy := cr.dmarcVerify.Apply(cr.mergedRes.AuthResult)
+		dmarcRes, policy := cr.dmarcVerify.ApplyWithARC(cr.mergedRes.AuthResult,
+			cr.mergedRes.ARCSealer, cr.mergedRes.ARCAuthResult)
 		cr.mergedRes.AuthResult = append(cr.mergedRes.AuthResult, &dmarcRes.Authres)
+		if dmarcRes.ARCOverride {
+			cr.log.Msg("DMARC policy overridden by trusted ARC sealer", "sealer", dmarcRes.ARCSealer)
+		}
+		if cr.dmarcReports != nil {
+			cr.dmarcReports.Record(cr.msgMeta, cr.mailFrom, cr.mergedRes.AuthResult, dmarcRes, policy)
+		}
 		switch policy {
 		case dmarc.PolicyReject:
 			code := 550
@@ -322,6 +368,7 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 
 			// Mimick the message structure for regular checks.
 			cr.log.Msg("quarantined", "reason", dmarcRes.Authres.Reason, "check", "dmarc")
+			cr.track("dmarc", "quarantine", errors.New(dmarcRes.Authres.Reason))
 		}
 	}
 
@@ -341,6 +388,22 @@ func (cr *checkRunner) applyResults(hostname string, header *textproto.Header) e
 	return nil
 }
 
+// track records the check verdict for message tracking. action is one of
+// "reject", "quarantine" or "ignore".
+func (cr *checkRunner) track(check, action string, reason error) {
+	ev := msgtrack.Event{
+		MsgID:  cr.msgMeta.ID,
+		Kind:   msgtrack.KindCheck,
+		Module: check,
+		Sender: cr.mailFrom,
+	}
+	if reason != nil {
+		ev = ev.WithError(reason)
+	}
+	ev.Status = action
+	msgtrack.Record(ev)
+}
+
 func (cr *checkRunner) close() {
 	cr.dmarcVerify.Close()
 	for _, state := range cr.states {
@@ -29,6 +29,7 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/dns"
 	"github.com/sirrchat/SirrMesh/framework/exterrors"
 	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/dmarc/report"
 	"github.com/sirrchat/SirrMesh/internal/modify"
 )
 
@@ -44,6 +45,7 @@ type msgpipelineCfg struct {
 	perSource       map[string]sourceBlock
 	defaultSource   sourceBlock
 	doDMARC         bool
+	dmarcReports    *report.Reporter
 }
 
 func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node) (msgpipelineCfg, error) {
@@ -129,6 +131,10 @@ func parseMsgPipelineRootCfg(globals map[string]interface{}, nodes []config.Node
 			case 0:
 				cfg.doDMARC = true
 			}
+		case "dmarc_reports":
+			if err := modconfig.ModuleFromNode("", node.Args, node, globals, &cfg.dmarcReports); err != nil {
+				return msgpipelineCfg{}, err
+			}
 		case "deliver_to", "reroute", "destination_in", "destination", "default_destination", "reject":
 			othersRaw = append(othersRaw, node)
 		default:
@@ -40,7 +40,7 @@ func NewModule(modName, instName string, aliases, inlineArgs []string) (module.M
 func (m *Module) Init(cfg *config.Map) error {
 	var hostname string
 	cfg.String("hostname", true, true, "", &hostname)
-	cfg.Bool("debug", true, false, &m.log.Debug)
+	cfg.Logger(true, false, &m.log)
 	cfg.AllowUnknown()
 	other, err := cfg.Process()
 	if err != nil {
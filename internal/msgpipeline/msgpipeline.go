@@ -30,8 +30,12 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/exterrors"
 	"github.com/sirrchat/SirrMesh/framework/log"
 	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/framework/tracing"
 	"github.com/sirrchat/SirrMesh/internal/modify"
+	"github.com/sirrchat/SirrMesh/internal/msgtrack"
 	"github.com/sirrchat/SirrMesh/internal/target"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -127,6 +131,7 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 	}
 	dd.checkRunner = newCheckRunner(msgMeta, dd.log, d.Resolver)
 	dd.checkRunner.doDMARC = d.doDMARC
+	dd.checkRunner.dmarcReports = d.dmarcReports
 
 	if msgMeta.OriginalRcpts == nil {
 		msgMeta.OriginalRcpts = map[string]string{}
@@ -140,6 +145,10 @@ func (d *MsgPipeline) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 	return &dd, nil
 }
 
+// TracksDelivery implements msgtrack.SelfTracking. Nested pipelines record
+// deliveries to their own targets.
+func (d *MsgPipeline) TracksDelivery() {}
+
 func (dd *msgpipelineDelivery) start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) error {
 	var err error
 
@@ -258,6 +267,50 @@ type delivery struct {
 	module.Delivery
 	// Recipient addresses this delivery object is used for, original values (not modified by RewriteRcpt).
 	recipients []string
+	// span covers the whole delivery to the target, from Start to
+	// Commit or Abort.
+	span trace.Span
+
+	// target is the target name used for message tracking. It is empty if
+	// the target records deliveries on its own.
+	target string
+	// failed contains recipients (original values) the delivery failed for
+	// in BodyNonAtomic.
+	failed map[string]struct{}
+}
+
+func (d *delivery) markFailed(rcpt string) {
+	if d.failed == nil {
+		d.failed = make(map[string]struct{})
+	}
+	d.failed[rcpt] = struct{}{}
+}
+
+// track records the KindDelivered event for all recipients the delivery
+// did not fail for.
+func (d *delivery) track(msgMeta *module.MsgMetadata) {
+	if d.target == "" {
+		return
+	}
+	for _, rcpt := range d.recipients {
+		if _, ok := d.failed[rcpt]; ok {
+			continue
+		}
+		msgtrack.Record(msgtrack.Event{
+			MsgID:  msgMeta.ID,
+			Kind:   msgtrack.KindDelivered,
+			Module: d.target,
+			Sender: msgMeta.OriginalFrom,
+			Rcpt:   rcpt,
+		})
+	}
+}
+
+// ctx returns the context that should be passed to the methods of the
+// delivery object so that spans created by the target are nested under
+// the target span.
+func (d *delivery) ctx(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(ctx, d.span)
 }
 
 type msgpipelineDelivery struct {
@@ -364,7 +417,7 @@ func (dd *msgpipelineDelivery) AddRcpt(ctx context.Context, to string, opts smtp
 					return wrapErr(err)
 				}
 
-				if err := delivery.AddRcpt(ctx, to, opts); err != nil {
+				if err := delivery.AddRcpt(delivery.ctx(ctx), to, opts); err != nil {
 					return wrapErr(err)
 				}
 				delivery.recipients = append(delivery.recipients, originalTo)
@@ -419,7 +472,8 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 	}
 
 	for _, delivery := range dd.deliveries {
-		if err := delivery.Body(ctx, header, body); err != nil {
+		if err := delivery.Body(delivery.ctx(ctx), header, body); err != nil {
+			tracing.SetError(delivery.span, err)
 			return err
 		}
 		dd.log.Debugf("delivery.Body ok, Delivery object = %T", delivery)
@@ -438,6 +492,7 @@ func (dd *msgpipelineDelivery) Body(ctx context.Context, header textproto.Header
 type statusCollector struct {
 	originalRcpts map[string]string
 	wrapped       module.StatusCollector
+	delivery      *delivery
 }
 
 func (sc statusCollector) SetStatus(rcptTo string, err error) {
@@ -445,6 +500,9 @@ func (sc statusCollector) SetStatus(rcptTo string, err error) {
 	if ok {
 		rcptTo = original
 	}
+	if err != nil {
+		sc.delivery.markFailed(rcptTo)
+	}
 	sc.wrapped.SetStatus(rcptTo, err)
 }
 
@@ -452,6 +510,7 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 	setStatusAll := func(err error) {
 		for _, delivery := range dd.deliveries {
 			for _, rcpt := range delivery.recipients {
+				delivery.markFailed(rcpt)
 				c.SetStatus(rcpt, err)
 			}
 		}
@@ -486,15 +545,18 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 	for _, delivery := range dd.deliveries {
 		partDelivery, ok := delivery.Delivery.(module.PartialDelivery)
 		if ok {
-			partDelivery.BodyNonAtomic(ctx, statusCollector{
+			partDelivery.BodyNonAtomic(delivery.ctx(ctx), statusCollector{
 				originalRcpts: dd.msgMeta.OriginalRcpts,
 				wrapped:       c,
+				delivery:      delivery,
 			}, header, body)
 			continue
 		}
 
-		if err := delivery.Body(ctx, header, body); err != nil {
+		if err := delivery.Body(delivery.ctx(ctx), header, body); err != nil {
+			tracing.SetError(delivery.span, err)
 			for _, rcpt := range delivery.recipients {
+				delivery.markFailed(rcpt)
 				c.SetStatus(rcpt, err)
 			}
 		}
@@ -504,13 +566,20 @@ func (dd *msgpipelineDelivery) BodyNonAtomic(ctx context.Context, c module.Statu
 func (dd msgpipelineDelivery) Commit(ctx context.Context) error {
 	dd.close()
 
+	var err error
 	for _, delivery := range dd.deliveries {
-		if err := delivery.Commit(ctx); err != nil {
+		if err != nil {
 			// No point in Committing remaining deliveries, everything is broken already.
-			return err
+			delivery.span.End()
+			continue
+		}
+		err = delivery.Commit(delivery.ctx(ctx))
+		tracing.End(delivery.span, err)
+		if err == nil {
+			delivery.track(dd.msgMeta)
 		}
 	}
-	return nil
+	return err
 }
 
 func (dd *msgpipelineDelivery) close() {
@@ -532,7 +601,10 @@ func (dd msgpipelineDelivery) Abort(ctx context.Context) error {
 
 	var lastErr error
 	for _, delivery := range dd.deliveries {
-		if err := delivery.Abort(ctx); err != nil {
+		delivery.span.SetAttributes(attribute.Bool("sirrmesh.aborted", true))
+		err := delivery.Abort(delivery.ctx(ctx))
+		tracing.End(delivery.span, err)
+		if err != nil {
 			dd.log.Debugf("delivery.Abort failure, Delivery object = %T: %v", delivery, err)
 			lastErr = err
 			// Continue anyway and try to Abort all remaining delivery objects.
@@ -622,12 +694,18 @@ func (dd *msgpipelineDelivery) getDelivery(ctx context.Context, tgt module.Deliv
 		return delivery_, nil
 	}
 
-	deliveryObj, err := tgt.Start(ctx, dd.msgMeta, dd.sourceAddr)
+	tgtCtx, span := tracing.Start(ctx, "deliver "+objectName(tgt),
+		attribute.String("sirrmesh.target", objectName(tgt)))
+	deliveryObj, err := tgt.Start(tgtCtx, dd.msgMeta, dd.sourceAddr)
 	if err != nil {
+		tracing.End(span, err)
 		dd.log.Debugf("tgt.Start(%s) failure, target = %s: %v", dd.sourceAddr, objectName(tgt), err)
 		return nil, err
 	}
-	delivery_ = &delivery{Delivery: deliveryObj}
+	delivery_ = &delivery{Delivery: deliveryObj, span: span}
+	if _, ok := tgt.(msgtrack.SelfTracking); !ok {
+		delivery_.target = objectName(tgt)
+	}
 
 	dd.log.Debugf("tgt.Start(%s) ok, target = %s", dd.sourceAddr, objectName(tgt))
 
@@ -0,0 +1,106 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/msgtrack"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+)
+
+func TestMsgPipeline_MessageTracking(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tracking.db")
+	store, err := msgtrack.Open(path)
+	if err != nil {
+		t.Skip("message tracking store is not available:", err)
+	}
+	stop := msgtrack.Start(store, 0)
+	stopped := false
+	defer func() {
+		if !stopped {
+			stop()
+		}
+	}()
+
+	target := testutils.Target{}
+	check := testutils.Check{
+		BodyRes: module.CheckResult{
+			Quarantine: true,
+			Reason:     errors.New("looks like spam"),
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	msgID := testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+
+	// Flushes pending events and closes the store.
+	stop()
+	stopped = true
+
+	store, err = msgtrack.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	events, err := store.Query(msgtrack.Filter{MsgID: msgID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivered := map[string]bool{}
+	checks := 0
+	for _, ev := range events {
+		switch ev.Kind {
+		case msgtrack.KindCheck:
+			checks++
+			if ev.Module != "test_check:test_check" || ev.Status != "quarantine" || ev.Detail != "looks like spam" {
+				t.Errorf("wrong check event: %+v", ev)
+			}
+		case msgtrack.KindDelivered:
+			if ev.Module != "test_target:test_instance" || ev.Sender != "sender@example.com" {
+				t.Errorf("wrong delivery event: %+v", ev)
+			}
+			delivered[ev.Rcpt] = true
+		default:
+			t.Errorf("unexpected event: %+v", ev)
+		}
+	}
+	if checks != 1 {
+		t.Errorf("expected 1 check event, got %d", checks)
+	}
+	if !delivered["rcpt1@example.com"] || !delivered["rcpt2@example.com"] || len(delivered) != 2 {
+		t.Errorf("wrong delivered recipients: %v", delivered)
+	}
+}
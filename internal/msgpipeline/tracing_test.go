@@ -0,0 +1,153 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgpipeline
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/framework/tracing"
+	"github.com/sirrchat/SirrMesh/internal/modify"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttr(s tracetest.SpanStub, key attribute.Key) string {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestMsgPipeline_Tracing(t *testing.T) {
+	spans := testutils.Spans(t)
+
+	target := testutils.Target{}
+	check := testutils.Check{}
+	modifier := testutils.Modifier{InstName: "mod"}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			globalModifiers: modify.Group{
+				Modifiers: []module.Modifier{modifier},
+			},
+			perSource: map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	msgID := testutils.DoTestDelivery(t, &d, "sender@example.com", []string{"rcpt1@example.com", "rcpt2@example.com"})
+
+	stages := map[string]int{}
+	var deliverSpan tracetest.SpanStub
+	for _, s := range spans.GetSpans() {
+		if got := spanAttr(s, tracing.MsgIDKey); got != msgID {
+			t.Errorf("span %s: msg_id = %q, want %q", s.Name, got, msgID)
+		}
+		switch s.Name {
+		case "check test_check:test_check":
+			stages["check "+spanAttr(s, "sirrmesh.check.stage")]++
+		case "modify test_modifier:mod":
+			stages["modify "+spanAttr(s, "sirrmesh.modifier.stage")]++
+		case "deliver test_target:test_instance":
+			deliverSpan = s
+		default:
+			t.Errorf("unexpected span: %s", s.Name)
+		}
+	}
+
+	want := map[string]int{
+		"check connection": 1,
+		"check sender":     1,
+		"check rcpt":       2,
+		"check body":       1,
+		"modify sender":    1,
+		"modify rcpt":      2,
+		"modify body":      1,
+	}
+	for k, v := range want {
+		if stages[k] != v {
+			t.Errorf("%s: got %d spans, want %d", k, stages[k], v)
+		}
+	}
+
+	if deliverSpan.Name == "" {
+		t.Fatal("no target span")
+	}
+	if deliverSpan.Status.Code == codes.Error {
+		t.Error("target span is marked as failed")
+	}
+}
+
+func TestMsgPipeline_Tracing_Reject(t *testing.T) {
+	spans := testutils.Spans(t)
+
+	target := testutils.Target{}
+	check := testutils.Check{
+		RcptRes: module.CheckResult{
+			Reject: true,
+			Reason: errors.New("go away"),
+		},
+	}
+	d := MsgPipeline{
+		msgpipelineCfg: msgpipelineCfg{
+			globalChecks: []module.Check{&check},
+			perSource:    map[string]sourceBlock{},
+			defaultSource: sourceBlock{
+				perRcpt: map[string]*rcptBlock{},
+				defaultRcpt: &rcptBlock{
+					targets: []module.DeliveryTarget{&target},
+				},
+			},
+		},
+		Log: testutils.Logger(t, "msgpipeline"),
+	}
+
+	if _, err := testutils.DoTestDeliveryErr(t, &d, "sender@example.com", []string{"rcpt1@example.com"}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	rejected := false
+	for _, s := range spans.GetSpans() {
+		if s.Name != "check test_check:test_check" || spanAttr(s, "sirrmesh.check.stage") != "rcpt" {
+			continue
+		}
+		if spanAttr(s, "sirrmesh.check.reject") != "true" {
+			t.Error("sirrmesh.check.reject is not set")
+		}
+		if s.Status.Code != codes.Error || s.Status.Description != "go away" {
+			t.Errorf("wrong span status: %+v", s.Status)
+		}
+		rejected = true
+	}
+	if !rejected {
+		t.Fatal("no span for the rejecting check")
+	}
+}
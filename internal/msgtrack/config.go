@@ -0,0 +1,66 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgtrack
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+)
+
+// Config is the value of the message_tracking global directive.
+type Config struct {
+	Path      string
+	Retention time.Duration
+}
+
+// DBPath returns the absolute path of the tracking database. Relative paths
+// are interpreted relative to the state directory.
+func (c *Config) DBPath(stateDir string) string {
+	switch {
+	case c.Path == "":
+		return DefaultPath(stateDir)
+	case filepath.IsAbs(c.Path):
+		return c.Path
+	default:
+		return filepath.Join(stateDir, c.Path)
+	}
+}
+
+// ConfigBlock parses the message_tracking block:
+//
+//	message_tracking {
+//	    path message_tracking.db
+//	    retention 720h
+//	}
+func ConfigBlock(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) != 0 {
+		return nil, config.NodeErr(node, "no arguments expected")
+	}
+
+	cfg := &Config{}
+	m := config.NewMap(nil, node)
+	m.String("path", false, false, "", &cfg.Path)
+	m.Duration("retention", false, false, 30*24*time.Hour, &cfg.Retention)
+	if _, err := m.Process(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
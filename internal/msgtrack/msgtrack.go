@@ -0,0 +1,243 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package msgtrack implements the message tracking store.
+//
+// Endpoints, the message pipeline and queues report what happens to each
+// message (acceptance, check verdicts, delivery attempts and their outcome)
+// using Record. Events are written to an SQLite database asynchronously, so
+// the tracking never delays or fails a message delivery.
+package msgtrack
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/exterrors"
+	"github.com/sirrchat/SirrMesh/framework/log"
+)
+
+type Kind string
+
+const (
+	// KindReceived is recorded when the SMTP transaction is started.
+	KindReceived Kind = "received"
+	// KindRcpt is recorded for each recipient accepted by the endpoint.
+	KindRcpt Kind = "rcpt"
+	// KindCheck is recorded for a check that rejected, quarantined or
+	// flagged the message. Status contains the action taken.
+	KindCheck Kind = "check"
+	// KindRejected is recorded when the endpoint rejects MAIL, RCPT or DATA.
+	KindRejected Kind = "rejected"
+	// KindAccepted is recorded when the endpoint accepts the message.
+	KindAccepted Kind = "accepted"
+	// KindQueued is recorded when a queue takes the message for a recipient.
+	KindQueued Kind = "queued"
+	// KindDeferred is recorded for a failed delivery attempt that will be
+	// retried.
+	KindDeferred Kind = "deferred"
+	// KindDelivered is recorded once the message is delivered to the final
+	// target for a recipient.
+	KindDelivered Kind = "delivered"
+	// KindFailed is recorded when the delivery failed permanently or the
+	// queue ran out of attempts.
+	KindFailed Kind = "failed"
+)
+
+// Event is a single message tracking record.
+type Event struct {
+	Time  time.Time `json:"time"`
+	MsgID string    `json:"msg_id"`
+	Kind  Kind      `json:"kind"`
+	// Module is the name of the endpoint, check or delivery target the event
+	// originates from.
+	Module string `json:"module,omitempty"`
+	Sender string `json:"sender,omitempty"`
+	Rcpt   string `json:"rcpt,omitempty"`
+	// Status is the SMTP status code of the error or the check action.
+	Status string `json:"status,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// WithError returns a copy of ev with Status and Detail filled from err.
+// If Module is not set, the name of the check or delivery target that
+// generated err is used.
+func (ev Event) WithError(err error) Event {
+	fields := exterrors.Fields(err)
+	var smtpErr *exterrors.SMTPError
+	if errors.As(err, &smtpErr) {
+		ev.Status = fmt.Sprintf("%d %d.%d.%d", smtpErr.Code,
+			smtpErr.EnhancedCode[0], smtpErr.EnhancedCode[1], smtpErr.EnhancedCode[2])
+	}
+	if reason, ok := fields["reason"].(string); ok {
+		ev.Detail = reason
+	} else {
+		ev.Detail = err.Error()
+	}
+	if ev.Module == "" {
+		if check, ok := fields["check"].(string); ok {
+			ev.Module = check
+		} else if tgt, ok := fields["target"].(string); ok {
+			ev.Module = tgt
+		}
+	}
+	return ev
+}
+
+// SelfTracking is implemented by delivery targets that record the delivery
+// outcome on their own (queues). The message pipeline records the
+// KindDelivered event only for targets not implementing it.
+type SelfTracking interface {
+	TracksDelivery()
+}
+
+const (
+	bufferSize    = 4096
+	batchSize     = 256
+	flushInterval = time.Second
+	pruneInterval = time.Hour
+)
+
+type recorder struct {
+	store     *Store
+	retention time.Duration
+	log       log.Logger
+
+	events  chan Event
+	dropped atomic.Int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+var current atomic.Pointer[recorder]
+
+// Enabled reports whether the message tracking is enabled.
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+// Record queues the event for writing to the store. It is a no-op if the
+// message tracking is not enabled. Events are dropped if the store does not
+// keep up with the rate of incoming events.
+func Record(ev Event) {
+	r := current.Load()
+	if r == nil || ev.MsgID == "" {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	select {
+	case r.events <- ev:
+	default:
+		r.dropped.Add(1)
+	}
+}
+
+// Start enables the recording of events to the store and starts the
+// removal of events older than retention (if it is not zero).
+//
+// The returned function stops the recording, writes pending events
+// and closes the store.
+func Start(store *Store, retention time.Duration) (stop func()) {
+	r := &recorder{
+		store:     store,
+		retention: retention,
+		log:       log.Logger{Name: "msgtrack"},
+		events:    make(chan Event, bufferSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	current.Store(r)
+	go r.run()
+
+	return func() {
+		current.CompareAndSwap(r, nil)
+		close(r.stop)
+		<-r.done
+	}
+}
+
+func (r *recorder) run() {
+	defer close(r.done)
+
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+	r.prune()
+
+	batch := make([]Event, 0, batchSize)
+	write := func() {
+		if dropped := r.dropped.Swap(0); dropped != 0 {
+			r.log.Msg("events dropped, store is too slow", "count", dropped)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := r.store.Add(batch); err != nil {
+			r.log.Error("failed to write events", err, "count", len(batch))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case ev := <-r.events:
+			batch = append(batch, ev)
+			if len(batch) >= batchSize {
+				write()
+			}
+		case <-flush.C:
+			write()
+		case <-prune.C:
+			r.prune()
+		case <-r.stop:
+		drain:
+			for {
+				select {
+				case ev := <-r.events:
+					batch = append(batch, ev)
+				default:
+					break drain
+				}
+			}
+			write()
+			if err := r.store.Close(); err != nil {
+				r.log.Error("failed to close store", err)
+			}
+			return
+		}
+	}
+}
+
+func (r *recorder) prune() {
+	if r.retention == 0 {
+		return
+	}
+	removed, err := r.store.Prune(time.Now().Add(-r.retention))
+	if err != nil {
+		r.log.Error("failed to remove old events", err)
+		return
+	}
+	if removed != 0 {
+		r.log.DebugMsg("removed old events", "count", removed)
+	}
+}
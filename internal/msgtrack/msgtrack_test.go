@@ -0,0 +1,157 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgtrack
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/exterrors"
+)
+
+func testStore(t *testing.T, path string) *Store {
+	t.Helper()
+	if sqliteDriver == "" {
+		t.Skip("SQLite support is not compiled in")
+	}
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func msgIDs(events []Event) []string {
+	var ids []string
+	for _, ev := range events {
+		if len(ids) == 0 || ids[len(ids)-1] != ev.MsgID {
+			ids = append(ids, ev.MsgID)
+		}
+	}
+	return ids
+}
+
+func TestStore_Query(t *testing.T) {
+	s := testStore(t, filepath.Join(t.TempDir(), "tracking.db"))
+	defer s.Close()
+
+	base := time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC)
+	err := s.Add([]Event{
+		{Time: base, MsgID: "a", Kind: KindReceived, Module: "smtp", Sender: "alice@example.org"},
+		{Time: base.Add(1 * time.Second), MsgID: "a", Kind: KindRcpt, Module: "smtp", Sender: "alice@example.org", Rcpt: "bob@example.com"},
+		{Time: base.Add(2 * time.Second), MsgID: "a", Kind: KindDelivered, Module: "remote_queue", Sender: "alice@example.org", Rcpt: "bob@example.com", Detail: "attempt 1"},
+		{Time: base.Add(time.Hour), MsgID: "b", Kind: KindReceived, Module: "smtp", Sender: "carol@example.net"},
+		{Time: base.Add(time.Hour + time.Second), MsgID: "b", Kind: KindRejected, Module: "spf", Sender: "carol@example.net", Rcpt: "BOB@example.com", Status: "550 5.7.23"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test := func(f Filter, expectedIDs ...string) {
+		t.Helper()
+		events, err := s.Query(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids := msgIDs(events); !reflect.DeepEqual(ids, expectedIDs) {
+			t.Errorf("filter %+v: expected messages %v, got %v", f, expectedIDs, ids)
+		}
+	}
+
+	test(Filter{}, "a", "b")
+	test(Filter{MsgID: "a"}, "a")
+	test(Filter{Sender: "Alice@example.org"}, "a")
+	test(Filter{Rcpt: "bob@example.com"}, "a", "b")
+	test(Filter{Rcpt: "@EXAMPLE.COM"}, "a", "b")
+	test(Filter{Sender: "@example.net"}, "b")
+	test(Filter{Sender: "@example"})
+	test(Filter{Since: base.Add(30 * time.Minute)}, "b")
+	test(Filter{Until: base.Add(30 * time.Minute)}, "a")
+	test(Filter{Limit: 1}, "b")
+
+	// All events of the matching message are returned, not only the
+	// matching ones.
+	events, err := s.Query(Filter{Rcpt: "bob@example.com", MsgID: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	if events[0].Kind != KindReceived || !events[0].Time.Equal(base) || events[0].Sender != "alice@example.org" {
+		t.Errorf("wrong first event: %+v", events[0])
+	}
+
+	removed, err := s.Prune(base.Add(30 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("expected 3 removed events, got %d", removed)
+	}
+	test(Filter{}, "b")
+}
+
+func TestRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tracking.db")
+	s := testStore(t, path)
+
+	Record(Event{MsgID: "ignored", Kind: KindReceived})
+	stop := Start(s, 0)
+	if !Enabled() {
+		t.Fatal("Enabled() = false after Start")
+	}
+	Record(Event{MsgID: "a", Kind: KindReceived, Sender: "alice@example.org"})
+	Record(Event{Kind: KindReceived})
+	stop()
+	if Enabled() {
+		t.Fatal("Enabled() = true after stop")
+	}
+
+	s = testStore(t, path)
+	defer s.Close()
+	events, err := s.Query(Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].MsgID != "a" || events[0].Time.IsZero() {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+}
+
+func TestEvent_WithError(t *testing.T) {
+	ev := Event{Kind: KindRejected}.WithError(&exterrors.SMTPError{
+		Code:         550,
+		EnhancedCode: exterrors.EnhancedCode{5, 7, 1},
+		Message:      "Sender is not allowed",
+		CheckName:    "dnsbl",
+		Reason:       "listed in zen.example.org",
+	})
+	if ev.Status != "550 5.7.1" || ev.Module != "dnsbl" || ev.Detail != "listed in zen.example.org" {
+		t.Errorf("wrong event for SMTPError: %+v", ev)
+	}
+
+	ev = Event{Kind: KindRejected, Module: "smtp"}.WithError(errors.New("I/O error"))
+	if ev.Status != "" || ev.Module != "smtp" || ev.Detail != "I/O error" {
+		t.Errorf("wrong event for plain error: %+v", ev)
+	}
+}
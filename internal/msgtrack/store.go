@@ -0,0 +1,211 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package msgtrack
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultPath returns the path of the tracking database if it is not set
+// explicitly.
+func DefaultPath(stateDir string) string {
+	return filepath.Join(stateDir, "message_tracking.db")
+}
+
+const schema = `
+CREATE TABLE IF NOT EXISTS events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time INTEGER NOT NULL,
+	msg_id TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	module TEXT NOT NULL DEFAULT '',
+	sender TEXT NOT NULL DEFAULT '' COLLATE NOCASE,
+	rcpt TEXT NOT NULL DEFAULT '' COLLATE NOCASE,
+	status TEXT NOT NULL DEFAULT '',
+	detail TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS events_msg_id ON events(msg_id);
+CREATE INDEX IF NOT EXISTS events_time ON events(time);
+CREATE INDEX IF NOT EXISTS events_sender ON events(sender);
+CREATE INDEX IF NOT EXISTS events_rcpt ON events(rcpt);
+`
+
+// Store keeps message tracking events in an SQLite database.
+type Store struct {
+	db *sql.DB
+}
+
+func Open(path string) (*Store, error) {
+	if sqliteDriver == "" {
+		return nil, errors.New("msgtrack: SQLite is not supported, recompile without nosqlite3 tag set")
+	}
+
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, err
+	}
+	// Writes are serialized anyway, a single connection makes the pragmas
+	// below apply to all queries.
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{
+		"PRAGMA busy_timeout = 5000",
+		"PRAGMA journal_mode = WAL",
+		schema,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &Store{db: db}, nil
+}
+
+// Add writes events to the store in a single transaction.
+func (s *Store) Add(events []Event) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	stmt, err := tx.Prepare(`INSERT INTO events(time, msg_id, kind, module, sender, rcpt, status, detail)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, ev := range events {
+		if _, err := stmt.Exec(ev.Time.UnixNano(), ev.MsgID, string(ev.Kind), ev.Module,
+			ev.Sender, ev.Rcpt, ev.Status, ev.Detail); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Filter selects messages returned by Store.Query. Empty fields are not
+// used for matching.
+type Filter struct {
+	MsgID string
+	// Sender and Rcpt are matched case-insensitively. Values starting with
+	// '@' match all addresses in the domain.
+	Sender string
+	Rcpt   string
+	// Since and Until limit the time of the matching events.
+	Since time.Time
+	Until time.Time
+	// Limit is the maximum number of messages returned, most recent ones
+	// are preferred.
+	Limit int
+}
+
+func addressCond(column, value string) (string, interface{}) {
+	if strings.HasPrefix(value, "@") {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+		return column + ` LIKE ? ESCAPE '\'`, "%" + escaped
+	}
+	return column + " = ?", value
+}
+
+// Query returns all events of the messages with at least one event
+// matching the filter. Events are ordered by time.
+func (s *Store) Query(f Filter) ([]Event, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	if f.MsgID != "" {
+		conds = append(conds, "msg_id = ?")
+		args = append(args, f.MsgID)
+	}
+	if f.Sender != "" {
+		cond, arg := addressCond("sender", f.Sender)
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+	if f.Rcpt != "" {
+		cond, arg := addressCond("rcpt", f.Rcpt)
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "time >= ?")
+		args = append(args, f.Since.UnixNano())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "time < ?")
+		args = append(args, f.Until.UnixNano())
+	}
+	where := ""
+	if len(conds) != 0 {
+		where = "WHERE " + strings.Join(conds, " AND ")
+	}
+	limit := f.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	args = append(args, limit)
+
+	rows, err := s.db.Query(`SELECT time, msg_id, kind, module, sender, rcpt, status, detail FROM events
+		WHERE msg_id IN (
+			SELECT msg_id FROM events `+where+`
+			GROUP BY msg_id ORDER BY MAX(time) DESC LIMIT ?
+		)
+		ORDER BY time, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		var (
+			ev    Event
+			stamp int64
+			kind  string
+		)
+		if err := rows.Scan(&stamp, &ev.MsgID, &kind, &ev.Module, &ev.Sender, &ev.Rcpt, &ev.Status, &ev.Detail); err != nil {
+			return nil, err
+		}
+		ev.Time = time.Unix(0, stamp)
+		ev.Kind = Kind(kind)
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// Prune removes events recorded before the specified time and returns
+// their count.
+func (s *Store) Prune(before time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM events WHERE time < ?`, before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,145 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package reportstore
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+// SendFunc sends the report for the domain built from entries.
+type SendFunc[E Entry] func(ctx context.Context, domain string, entries []E, now time.Time) error
+
+// SendDue sends reports for all domains that have entries older than
+// interval. Entries of reports that failed to send are kept and sent on the
+// next call.
+//
+// It should not be called before the previous server process exits, see
+// module.HandoverDone.
+func (s *Store[E]) SendDue(ctx context.Context, l log.Logger, now time.Time, interval time.Duration, send SendFunc[E]) {
+	if s.recoverPending {
+		s.lock.Lock()
+		err := s.recoverTaken()
+		s.lock.Unlock()
+		if err != nil {
+			l.Error("failed to recover pending reports", err)
+			return
+		}
+		s.recoverPending = false
+	}
+
+	domains, err := s.Domains()
+	if err != nil {
+		l.Error("failed to list pending reports", err)
+		return
+	}
+
+	for _, domain := range domains {
+		entries, err := s.Read(domain)
+		if err != nil {
+			l.Error("failed to read pending report", err, "domain", domain)
+			continue
+		}
+		if len(entries) == 0 || now.Sub(entries[0].ReportTime()) < interval {
+			continue
+		}
+
+		batch, err := s.Take(domain)
+		if err != nil {
+			l.Error("failed to read pending report", err, "domain", domain)
+			continue
+		}
+		if err := send(ctx, domain, batch.Entries, now); err != nil {
+			l.Error("failed to send report, will retry later", err, "domain", domain)
+			if err := batch.Restore(); err != nil {
+				l.Error("failed to restore pending report", err, "domain", domain)
+			}
+			continue
+		}
+		if err := batch.Commit(); err != nil {
+			l.Error("failed to remove sent report", err, "domain", domain)
+		}
+	}
+}
+
+// Scheduler calls the function 24 times per reporting interval, but not
+// more often than once a minute.
+type Scheduler struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartScheduler starts calling sendDue in a separate goroutine once the
+// previous server process exited. what describes reports in the log
+// messages, e.g. "DMARC reports".
+func StartScheduler(what string, interval time.Duration, sendDue func(ctx context.Context, now time.Time)) *Scheduler {
+	s := &Scheduler{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run(what, interval, sendDue)
+	return s
+}
+
+func (s *Scheduler) run(what string, interval time.Duration, sendDue func(ctx context.Context, now time.Time)) {
+	defer close(s.done)
+	defer func() {
+		if err := recover(); err != nil {
+			stack := debug.Stack()
+			log.Printf("panic during %s sending: %v\n%s", what, err, stack)
+			log.Printf("%s sending disabled due to critical error", what)
+		}
+	}()
+
+	checkInterval := interval / 24
+	if checkInterval < time.Minute {
+		checkInterval = time.Minute
+	}
+	select {
+	case <-module.HandoverDone():
+	case <-s.stop:
+		return
+	}
+
+	t := time.NewTicker(checkInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			sendDue(context.Background(), time.Now())
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Close stops the scheduler and waits for the running send to complete.
+// It is no-op for a nil Scheduler.
+func (s *Scheduler) Close() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
@@ -0,0 +1,294 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package reportstore implements the storage of results recorded for
+// aggregate reports (DMARC, TLS-RPT) and periodic sending of the reports
+// that are due.
+package reportstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/module"
+)
+
+const entriesExt = ".jsonl"
+
+// Entry is implemented by recorded results.
+type Entry interface {
+	// ReportDomain returns the domain the result is reported to.
+	ReportDomain() string
+	// ReportTime returns the time the result was recorded.
+	ReportTime() time.Time
+}
+
+// Store keeps recorded results until they are sent.
+//
+// Results are appended to a file per report domain, one JSON object per line.
+type Store[E Entry] struct {
+	name string
+	dir  string
+	lock sync.Mutex
+
+	// Set if recoverTaken is deferred until the previous server process
+	// exits, see SendDue.
+	recoverPending bool
+}
+
+// NewStore opens the store in dir, creating the directory if needed. name
+// is the module name used in error messages.
+//
+// If the previous server process is still running (restart), the batches it
+// has taken might be in use and are recovered by the first SendDue call
+// instead.
+func NewStore[E Entry](name, dir string) (*Store[E], error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &Store[E]{name: name, dir: dir}
+	if module.HandoverPending() {
+		s.recoverPending = true
+		return s, nil
+	}
+	if err := s.recoverTaken(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store[E]) Dir() string {
+	return s.dir
+}
+
+func (s *Store[E]) domainPath(domain string) (string, error) {
+	if domain == "" || strings.ContainsAny(domain, `/\`) || strings.HasPrefix(domain, ".") {
+		return "", fmt.Errorf("%s: invalid policy domain: %q", s.name, domain)
+	}
+	return filepath.Join(s.dir, domain+entriesExt), nil
+}
+
+// Add appends the entry to the store.
+func (s *Store[E]) Add(e E) error {
+	path, err := s.domainPath(e.ReportDomain())
+	if err != nil {
+		return err
+	}
+	blob, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(blob, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Domains returns the list of report domains with pending entries.
+func (s *Store[E]) Domains() ([]string, error) {
+	dirents, err := os.ReadDir(s.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	domains := make([]string, 0, len(dirents))
+	for _, ent := range dirents {
+		if ent.IsDir() || !strings.HasSuffix(ent.Name(), entriesExt) {
+			continue
+		}
+		domains = append(domains, strings.TrimSuffix(ent.Name(), entriesExt))
+	}
+	sort.Strings(domains)
+	return domains, nil
+}
+
+// Read returns pending entries for the domain without removing them.
+func (s *Store[E]) Read(domain string) ([]E, error) {
+	path, err := s.domainPath(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return readEntries[E](path)
+}
+
+// Batch is the set of entries detached from the store by Take.
+type Batch[E Entry] struct {
+	Entries []E
+
+	store *Store[E]
+	path  string
+	taken string
+}
+
+// Take detaches pending entries for the domain from the store. Entries added
+// after the call are kept for the next report.
+//
+// The batch should be either committed once the report is sent or restored
+// so that entries are not lost if sending fails.
+func (s *Store[E]) Take(domain string) (*Batch[E], error) {
+	path, err := s.domainPath(domain)
+	if err != nil {
+		return nil, err
+	}
+	takenPath := path + "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+
+	s.lock.Lock()
+	err = os.Rename(path, takenPath)
+	s.lock.Unlock()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &Batch[E]{store: s}, nil
+		}
+		return nil, err
+	}
+
+	b := &Batch[E]{store: s, path: path, taken: takenPath}
+	b.Entries, err = readEntries[E](takenPath)
+	if err != nil {
+		if restoreErr := b.Restore(); restoreErr != nil {
+			return nil, errors.Join(err, restoreErr)
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// Commit removes the entries from the store.
+func (b *Batch[E]) Commit() error {
+	if b.taken == "" {
+		return nil
+	}
+	return os.Remove(b.taken)
+}
+
+// Restore returns the entries to the store, before the entries added since
+// Take.
+func (b *Batch[E]) Restore() error {
+	if b.taken == "" {
+		return nil
+	}
+	b.store.lock.Lock()
+	defer b.store.lock.Unlock()
+	return restoreTaken(b.taken, b.path)
+}
+
+// restoreTaken prepends the contents of takenPath to path and removes
+// takenPath.
+func restoreTaken(takenPath, path string) error {
+	taken, err := os.ReadFile(takenPath)
+	if err != nil {
+		return err
+	}
+	current, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(taken) != 0 && taken[len(taken)-1] != '\n' {
+		taken = append(taken, '\n')
+	}
+
+	tmpPath := takenPath + ".tmp"
+	if err := os.WriteFile(tmpPath, append(taken, current...), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Remove(takenPath)
+}
+
+// recoverTaken restores entries left by Take if the process stopped before
+// the batch was committed or restored.
+func (s *Store[E]) recoverTaken() error {
+	dirents, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range dirents {
+		name := ent.Name()
+		idx := strings.LastIndex(name, entriesExt+".")
+		if ent.IsDir() || idx == -1 {
+			continue
+		}
+		suffix := name[idx+len(entriesExt)+1:]
+		if _, err := strconv.ParseInt(suffix, 10, 64); err != nil {
+			// Temporary file of an interrupted restoreTaken, the taken
+			// file is still there.
+			if strings.HasSuffix(suffix, ".tmp") {
+				os.Remove(filepath.Join(s.dir, name))
+			}
+			continue
+		}
+		takenPath := filepath.Join(s.dir, name)
+		if err := restoreTaken(takenPath, filepath.Join(s.dir, name[:idx+len(entriesExt)])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readEntries[E Entry](path string) ([]E, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []E
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var e E
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Partially written line, most likely due to a crash.
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
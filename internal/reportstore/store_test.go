@@ -0,0 +1,175 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package reportstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+)
+
+type testEntry struct {
+	Domain string    `json:"domain"`
+	Time   time.Time `json:"time"`
+	ID     int       `json:"id"`
+}
+
+func (e testEntry) ReportDomain() string  { return e.Domain }
+func (e testEntry) ReportTime() time.Time { return e.Time }
+
+func TestStore_TakeRestore(t *testing.T) {
+	store, err := NewStore[testEntry]("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := store.Add(testEntry{Domain: "example.org", ID: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch, err := store.Take("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(batch.Entries))
+	}
+
+	// Restored entries are kept before the ones added after Take.
+	if err := store.Add(testEntry{Domain: "example.org", ID: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := store.Read("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range entries {
+		if e.ID != i {
+			t.Fatalf("Wrong entries after Restore: %+v", entries)
+		}
+	}
+	if len(entries) != 4 {
+		t.Fatalf("Expected 4 entries, got %d", len(entries))
+	}
+
+	// Entries taken before a crash are recovered.
+	if _, err := store.Take("example.org"); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewStore[testEntry]("test", store.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err = store.Take("example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Entries) != 4 {
+		t.Fatalf("Expected 4 recovered entries, got %d", len(batch.Entries))
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if domains, err := store.Domains(); err != nil || len(domains) != 0 {
+		t.Fatalf("Entries are left after Commit: %v %v", domains, err)
+	}
+}
+
+func TestStore_SendDue(t *testing.T) {
+	store, err := NewStore[testEntry]("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := store.Add(testEntry{Domain: "old.example.org", Time: now.Add(-25 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add(testEntry{Domain: "new.example.org", Time: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []string
+	sendErr := errors.New("delivery failed")
+	send := func(_ context.Context, domain string, entries []testEntry, _ time.Time) error {
+		if sendErr != nil {
+			return sendErr
+		}
+		sent = append(sent, domain)
+		return nil
+	}
+	l := testutils.Logger(t, "test")
+
+	store.SendDue(context.Background(), l, now, 24*time.Hour, send)
+	if entries, err := store.Read("old.example.org"); err != nil || len(entries) != 1 {
+		t.Fatalf("Entries are lost after failed send: %v %v", entries, err)
+	}
+
+	sendErr = nil
+	store.SendDue(context.Background(), l, now, 24*time.Hour, send)
+	if len(sent) != 1 || sent[0] != "old.example.org" {
+		t.Fatalf("Wrong domains sent: %v", sent)
+	}
+	if entries, err := store.Read("old.example.org"); err != nil || len(entries) != 0 {
+		t.Fatalf("Entries are kept after send: %v %v", entries, err)
+	}
+}
+
+func TestStore_RecoverAfterHandover(t *testing.T) {
+	store, err := NewStore[testEntry]("test", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if err := store.Add(testEntry{Domain: "example.org", Time: now.Add(-25 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	// Taken by the previous process that is still sending the report.
+	if _, err := store.Take("example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	module.BeginHandover()
+	defer module.EndHandover()
+	store, err = NewStore[testEntry]("test", store.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := store.Read("example.org"); err != nil || len(entries) != 0 {
+		t.Fatalf("Entries are recovered before the previous process exits: %v %v", entries, err)
+	}
+	module.EndHandover()
+
+	var sent []string
+	store.SendDue(context.Background(), testutils.Logger(t, "test"), now, 24*time.Hour,
+		func(_ context.Context, domain string, entries []testEntry, _ time.Time) error {
+			sent = append(sent, domain)
+			return nil
+		})
+	if len(sent) != 1 || sent[0] != "example.org" {
+		t.Fatalf("Recovered entries are not sent: %v", sent)
+	}
+}
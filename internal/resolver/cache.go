@@ -0,0 +1,130 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package resolver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type cacheEntry struct {
+	answer
+	added   time.Time
+	expires time.Time
+}
+
+// cache keeps lookup results until their TTL expires. Once the size limit is
+// reached, expired entries are dropped and then arbitrary ones if that was
+// not enough.
+//
+// Lookups get copies of the cached records with TTLs reduced by the time
+// spent in the cache.
+type cache struct {
+	lck     sync.Mutex
+	size    int
+	entries map[cacheKey]cacheEntry
+	now     func() time.Time
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		entries: make(map[cacheKey]cacheEntry),
+		now:     time.Now,
+	}
+}
+
+func (c *cache) get(key cacheKey) (answer, bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return answer{}, false
+	}
+	now := c.now()
+	if !now.Before(e.expires) {
+		delete(c.entries, key)
+		cacheEntries.Set(float64(len(c.entries)))
+		return answer{}, false
+	}
+	return e.answer.copy(uint32(now.Sub(e.added) / time.Second)), true
+}
+
+func (c *cache) put(key cacheKey, a answer, ttl time.Duration) {
+	if c.size <= 0 || ttl <= 0 {
+		return
+	}
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	now := c.now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{answer: a, added: now, expires: now.Add(ttl)}
+	cacheEntries.Set(float64(len(c.entries)))
+}
+
+// positiveTTL returns the smallest TTL of the records.
+func positiveTTL(rrs []dns.RR) time.Duration {
+	var ttl uint32
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// negativeTTL returns the TTL for a NXDOMAIN or NODATA response as defined
+// in RFC 2308 Section 5. Zero is returned if there is no SOA record in the
+// response.
+func negativeTTL(resp *dns.Msg) time.Duration {
+	for _, rr := range resp.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		return time.Duration(ttl) * time.Second
+	}
+	return 0
+}
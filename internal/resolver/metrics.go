@@ -0,0 +1,67 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package resolver
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	queriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "dns",
+			Name:      "queries_total",
+			Help:      "DNS lookups by record type and the source of the answer",
+		},
+		[]string{"type", "source"},
+	)
+	upstreamDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "dns",
+			Name:      "upstream_duration_seconds",
+			Help:      "Time taken by upstream servers to answer queries",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		},
+		[]string{"upstream"},
+	)
+	upstreamErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "dns",
+			Name:      "upstream_errors_total",
+			Help:      "Queries that failed at an upstream server",
+		},
+		[]string{"upstream"},
+	)
+	cacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "dns",
+			Name:      "cache_entries",
+			Help:      "Lookup results currently kept in the cache",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(queriesTotal)
+	prometheus.MustRegister(upstreamDuration)
+	prometheus.MustRegister(upstreamErrors)
+	prometheus.MustRegister(cacheEntries)
+}
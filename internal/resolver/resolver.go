@@ -0,0 +1,461 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package resolver implements the DNS resolver configured using the global
+// dns block.
+//
+// Answers from upstream servers are cached according to their TTLs
+// (including negative answers, RFC 2308). Upstream servers can be reached
+// over plain DNS, DNS-over-TLS or DNS-over-HTTPS. Static zones can be defined
+// to serve names locally, which is mostly useful for testing.
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	sdns "github.com/sirrchat/SirrMesh/framework/dns"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"golang.org/x/sync/singleflight"
+)
+
+// answer is the result of a lookup for a single record type.
+type answer struct {
+	rrs []dns.RR
+	// cnames is the CNAME chain leading to rrs. It is kept separately so
+	// rrs contain only records of the looked up type.
+	cnames   []dns.RR
+	nxdomain bool
+	// ad is the AD flag of the upstream response, if the upstream is
+	// trusted to perform DNSSEC validation.
+	ad bool
+}
+
+func (a answer) notFound() bool {
+	return a.nxdomain || len(a.rrs) == 0
+}
+
+// copy returns a deep copy of the answer with TTLs of the records reduced
+// by elapsed seconds. Answers are cached and shared between concurrent
+// lookups, so callers should never get the records themselves.
+func (a answer) copy(elapsed uint32) answer {
+	a.rrs = copyRRs(a.rrs, elapsed)
+	a.cnames = copyRRs(a.cnames, elapsed)
+	return a
+}
+
+func copyRRs(rrs []dns.RR, elapsed uint32) []dns.RR {
+	if rrs == nil {
+		return nil
+	}
+	res := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		if hdr := rr.Header(); hdr.Ttl > elapsed {
+			hdr.Ttl -= elapsed
+		} else {
+			hdr.Ttl = 0
+		}
+		res = append(res, rr)
+	}
+	return res
+}
+
+// Resolver implements dns.Resolver using the configured static zones,
+// cache and upstream servers.
+type Resolver struct {
+	upstreams   []upstream
+	zones       []*zone
+	staticOnly  bool
+	cache       *cache
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	// resolveTimeout limits upstream queries shared between lookups, it
+	// is enough to try all upstream servers.
+	resolveTimeout time.Duration
+	inflight       singleflight.Group
+	log            log.Logger
+}
+
+var (
+	_ sdns.Resolver  = &Resolver{}
+	_ sdns.Exchanger = &Resolver{}
+)
+
+// ConfigBlock parses the dns block:
+//
+//	dns {
+//	    upstream tls://1.1.1.1 https://dns.google/dns-query
+//	    timeout 5s
+//	    cache_size 10000
+//	    min_ttl 0s
+//	    max_ttl 24h
+//	    negative_ttl 5m
+//	    static_only no
+//	    zone mesh.test {
+//	        ...
+//	    }
+//	}
+//
+// Upstream servers are tried in order. If none are set, servers from
+// /etc/resolv.conf are used.
+func ConfigBlock(_ *config.Map, node config.Node) (interface{}, error) {
+	r := &Resolver{
+		log: log.Logger{Name: "dns"},
+	}
+
+	var (
+		upstreams []string
+		timeout   time.Duration
+		cacheSize int
+	)
+	m := config.NewMap(nil, node)
+	m.StringList("upstream", false, false, nil, &upstreams)
+	m.Duration("timeout", false, false, 5*time.Second, &timeout)
+	m.Int("cache_size", false, false, 10000, &cacheSize)
+	m.Duration("min_ttl", false, false, 0, &r.minTTL)
+	m.Duration("max_ttl", false, false, 24*time.Hour, &r.maxTTL)
+	m.Duration("negative_ttl", false, false, 5*time.Minute, &r.negativeTTL)
+	m.Bool("static_only", false, false, &r.staticOnly)
+	m.Callback("zone", func(_ *config.Map, node config.Node) error {
+		z, err := parseZone(node)
+		if err != nil {
+			return err
+		}
+		r.zones = append(r.zones, z)
+		return nil
+	})
+	if _, err := m.Process(); err != nil {
+		return nil, err
+	}
+
+	if len(upstreams) == 0 && !r.staticOnly {
+		upstreams = systemUpstreams()
+	}
+	for _, addr := range upstreams {
+		u, err := parseUpstream(addr, timeout)
+		if err != nil {
+			return nil, config.NodeErr(node, "%v", err)
+		}
+		r.upstreams = append(r.upstreams, u)
+	}
+	// UDP queries may be retried over TCP.
+	r.resolveTimeout = 2 * timeout * time.Duration(len(r.upstreams))
+	r.cache = newCache(cacheSize)
+
+	return r, nil
+}
+
+func systemUpstreams() []string {
+	cfg, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+	if err != nil || len(cfg.Servers) == 0 {
+		return []string{"127.0.0.1:53"}
+	}
+	addrs := make([]string, 0, len(cfg.Servers))
+	for _, srv := range cfg.Servers {
+		addrs = append(addrs, net.JoinHostPort(srv, cfg.Port))
+	}
+	return addrs
+}
+
+// zoneFor returns the most specific static zone containing the name.
+func (r *Resolver) zoneFor(name string) *zone {
+	var best *zone
+	for _, z := range r.zones {
+		if !dns.IsSubDomain(z.origin, name) {
+			continue
+		}
+		if best == nil || dns.CountLabel(z.origin) > dns.CountLabel(best.origin) {
+			best = z
+		}
+	}
+	return best
+}
+
+func (r *Resolver) lookupStatic(z *zone, name string, qtype uint16) answer {
+	var a answer
+	for i := 0; i < maxCNAMEChain; i++ {
+		rrs, cname, ok := z.lookup(name, qtype)
+		if !ok {
+			a.nxdomain = true
+			break
+		}
+		if len(rrs) != 0 {
+			a.rrs = rrs
+			break
+		}
+		if cname == nil || qtype == dns.TypeCNAME {
+			break
+		}
+		a.cnames = append(a.cnames, cname)
+		name = dns.CanonicalName(cname.Target)
+		if z = r.zoneFor(name); z == nil {
+			break
+		}
+	}
+	return a.copy(0)
+}
+
+func (r *Resolver) lookup(ctx context.Context, name string, qtype uint16) (answer, error) {
+	name = dns.CanonicalName(name)
+	typ := dns.TypeToString[qtype]
+
+	if z := r.zoneFor(name); z != nil {
+		queriesTotal.WithLabelValues(typ, "static").Inc()
+		return r.lookupStatic(z, name, qtype), nil
+	}
+	if r.staticOnly {
+		queriesTotal.WithLabelValues(typ, "static").Inc()
+		return answer{nxdomain: true}, nil
+	}
+
+	key := cacheKey{name: name, qtype: qtype}
+	if a, ok := r.cache.get(key); ok {
+		queriesTotal.WithLabelValues(typ, "cache").Inc()
+		return a, nil
+	}
+
+	queriesTotal.WithLabelValues(typ, "upstream").Inc()
+	// Concurrent lookups of the same name (e.g. SPF and DMARC checks of
+	// the same message) share a single upstream query. It is not bound to
+	// the context of the lookup that started it, so a cancelled lookup
+	// does not fail the others.
+	ch := r.inflight.DoChan(typ+" "+name, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), r.resolveTimeout)
+		defer cancel()
+		return r.resolve(ctx, key)
+	})
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return answer{}, res.Err
+		}
+		return res.Val.(answer).copy(0), nil
+	case <-ctx.Done():
+		return answer{}, ctx.Err()
+	}
+}
+
+func (r *Resolver) resolve(ctx context.Context, key cacheKey) (answer, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(key.name, key.qtype)
+	msg.SetEdns0(4096, false)
+	msg.AuthenticatedData = true
+
+	var lastErr error
+	for _, u := range r.upstreams {
+		start := time.Now()
+		resp, err := u.exchange(ctx, msg)
+		upstreamDuration.WithLabelValues(u.String()).Observe(time.Since(start).Seconds())
+		if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			err = sdns.RCodeError{Name: key.name, Code: resp.Rcode}
+		}
+		if err != nil {
+			upstreamErrors.WithLabelValues(u.String()).Inc()
+			r.log.Debugf("%s: %v", u, err)
+			lastErr = err
+			continue
+		}
+
+		a := answer{
+			nxdomain: resp.Rcode == dns.RcodeNameError,
+			ad:       resp.AuthenticatedData && u.trusted(),
+		}
+		for _, rr := range resp.Answer {
+			switch rr.Header().Rrtype {
+			case key.qtype:
+				a.rrs = append(a.rrs, rr)
+			case dns.TypeCNAME:
+				a.cnames = append(a.cnames, rr)
+			}
+		}
+
+		var ttl time.Duration
+		if len(a.rrs) == 0 {
+			ttl = negativeTTL(resp)
+			if ttl == 0 || ttl > r.negativeTTL {
+				ttl = r.negativeTTL
+			}
+		} else {
+			ttl = positiveTTL(append(a.cnames, a.rrs...))
+			if ttl < r.minTTL {
+				ttl = r.minTTL
+			}
+			if ttl > r.maxTTL {
+				ttl = r.maxTTL
+			}
+		}
+		r.cache.put(key, a, ttl)
+
+		return a, nil
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no upstream servers configured")
+	}
+	return answer{}, lastErr
+}
+
+// Exchange answers the query using the static zones, cache and upstream
+// servers. It makes DNSSEC-aware lookups (see dns.ExtResolver) use the
+// resolver too.
+//
+// The AD flag is set only for answers from upstream servers that are
+// reached over an authenticated channel or on the loopback interface.
+func (r *Resolver) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	if len(msg.Question) != 1 {
+		return nil, errors.New("resolver: exactly one question is expected")
+	}
+	q := msg.Question[0]
+	a, err := r.lookup(ctx, q.Name, q.Qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	resp.RecursionAvailable = true
+	resp.AuthenticatedData = a.ad
+	resp.Answer = append(a.cnames, a.rrs...)
+	if a.nxdomain {
+		resp.Rcode = dns.RcodeNameError
+	}
+	return resp, nil
+}
+
+// lookupErr converts the error into *net.DNSError callers expect from
+// net.Resolver.
+func lookupErr(name string, err error) error {
+	var netErr net.Error
+	return &net.DNSError{
+		Err:         err.Error(),
+		Name:        name,
+		IsTimeout:   errors.As(err, &netErr) && netErr.Timeout(),
+		IsTemporary: true,
+	}
+}
+
+func notFoundErr(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *Resolver) lookupType(ctx context.Context, name string, qtype uint16) ([]dns.RR, error) {
+	a, err := r.lookup(ctx, name, qtype)
+	if err != nil {
+		return nil, lookupErr(name, err)
+	}
+	if a.notFound() {
+		return nil, notFoundErr(name)
+	}
+	return a.rrs, nil
+}
+
+func (r *Resolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	revAddr, err := dns.ReverseAddr(addr)
+	if err != nil {
+		return nil, &net.DNSError{Err: err.Error(), Name: addr}
+	}
+	rrs, err := r.lookupType(ctx, revAddr, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		names = append(names, rr.(*dns.PTR).Ptr)
+	}
+	return names, nil
+}
+
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		res = append(res, addr.String())
+	}
+	return res, nil
+}
+
+func (r *Resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	rrs, err := r.lookupType(ctx, name, dns.TypeMX)
+	if err != nil {
+		return nil, err
+	}
+	mxs := make([]*net.MX, 0, len(rrs))
+	for _, rr := range rrs {
+		mx := rr.(*dns.MX)
+		mxs = append(mxs, &net.MX{Host: mx.Mx, Pref: mx.Preference})
+	}
+	sort.SliceStable(mxs, func(i, j int) bool {
+		return mxs[i].Pref < mxs[j].Pref
+	})
+	return mxs, nil
+}
+
+func (r *Resolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	rrs, err := r.lookupType(ctx, name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		// Same as net.Resolver, strings of a single record are
+		// concatenated.
+		recs = append(recs, strings.Join(rr.(*dns.TXT).Txt, ""))
+	}
+	return recs, nil
+}
+
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	v4, err4 := r.lookup(ctx, host, dns.TypeA)
+	v6, err6 := r.lookup(ctx, host, dns.TypeAAAA)
+	if err4 != nil && err6 != nil {
+		return nil, lookupErr(host, err4)
+	}
+
+	addrs := make([]net.IPAddr, 0, len(v4.rrs)+len(v6.rrs))
+	for _, rr := range v4.rrs {
+		addrs = append(addrs, net.IPAddr{IP: rr.(*dns.A).A})
+	}
+	for _, rr := range v6.rrs {
+		addrs = append(addrs, net.IPAddr{IP: rr.(*dns.AAAA).AAAA})
+	}
+	if len(addrs) == 0 {
+		if err4 != nil {
+			return nil, lookupErr(host, err4)
+		}
+		if err6 != nil {
+			return nil, lookupErr(host, err6)
+		}
+		return nil, notFoundErr(host)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,486 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package resolver
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxcpp/go-mockdns"
+	"github.com/miekg/dns"
+	parser "github.com/sirrchat/SirrMesh/framework/cfgparser"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+)
+
+func parseResolver(t *testing.T, cfg string) *Resolver {
+	t.Helper()
+	nodes, err := parser.Read(strings.NewReader(cfg), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := ConfigBlock(nil, nodes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.(*Resolver)
+}
+
+// fakeUpstream answers queries using the handler and counts them.
+type fakeUpstream struct {
+	handler func(q dns.Question) *dns.Msg
+	calls   int
+}
+
+func (u *fakeUpstream) exchange(_ context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	u.calls++
+	resp := u.handler(msg.Question[0])
+	if resp == nil {
+		return nil, errors.New("connection refused")
+	}
+	rcode := resp.Rcode
+	resp.SetReply(msg)
+	resp.Rcode = rcode
+	return resp, nil
+}
+
+func (u *fakeUpstream) trusted() bool {
+	return true
+}
+
+func (u *fakeUpstream) String() string {
+	return "fake"
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestResolver_StaticZone(t *testing.T) {
+	r := parseResolver(t, `dns {
+		static_only yes
+		zone mesh.test {
+			MX @ 20 mx2
+			MX @ 10 mx
+			A mx 127.0.0.1
+			AAAA mx ::1
+			CNAME mail mx
+			TXT @ "v=spf1 a:mx.mesh.test -all"
+		}
+		zone 0.0.127.in-addr.arpa {
+			PTR 1 mx.mesh.test.
+		}
+	}`)
+	ctx := context.Background()
+
+	mxs, err := r.LookupMX(ctx, "MESH.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mxs) != 2 || mxs[0].Host != "mx.mesh.test." || mxs[0].Pref != 10 || mxs[1].Host != "mx2.mesh.test." {
+		t.Errorf("wrong MX records: %+v %+v", mxs[0], mxs[1])
+	}
+
+	txt, err := r.LookupTXT(ctx, "mesh.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(txt, []string{"v=spf1 a:mx.mesh.test -all"}) {
+		t.Errorf("wrong TXT records: %q", txt)
+	}
+
+	addrs, err := r.LookupHost(ctx, "mail.mesh.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"127.0.0.1", "::1"}) {
+		t.Errorf("wrong addresses: %v", addrs)
+	}
+
+	names, err := r.LookupAddr(ctx, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"mx.mesh.test."}) {
+		t.Errorf("wrong PTR records: %v", names)
+	}
+
+	for _, name := range []string{"mx2.mesh.test", "example.org"} {
+		_, err = r.LookupHost(ctx, name)
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("%s: expected not found error, got %v", name, err)
+		}
+	}
+}
+
+func TestResolver_ZoneOutside(t *testing.T) {
+	nodes, err := parser.Read(strings.NewReader(`dns {
+		zone mesh.test {
+			A mx.example.org. 127.0.0.1
+		}
+	}`), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ConfigBlock(nil, nodes[0]); err == nil {
+		t.Fatal("expected error for a record outside of the zone")
+	}
+}
+
+func TestResolver_Cache(t *testing.T) {
+	r := parseResolver(t, `dns {
+		upstream 127.0.0.1:1
+		max_ttl 1h
+	}`)
+	up := &fakeUpstream{handler: func(q dns.Question) *dns.Msg {
+		resp := new(dns.Msg)
+		switch q.Name {
+		case "example.org.":
+			resp.Answer = []dns.RR{
+				mustRR(t, "example.org. 300 IN TXT \"a\""),
+				mustRR(t, "example.org. 60 IN TXT \"b\""),
+			}
+		case "long.example.org.":
+			resp.Answer = []dns.RR{mustRR(t, "long.example.org. 86400 IN TXT \"c\"")}
+		case "missing.example.org.":
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = []dns.RR{mustRR(t, "example.org. 3600 IN SOA ns. host. 1 3600 600 86400 120")}
+		}
+		return resp
+	}}
+	r.upstreams = []upstream{up}
+	now := time.Now()
+	r.cache.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	lookup := func(name string, wantCalls int) {
+		t.Helper()
+		_, _ = r.LookupTXT(ctx, name)
+		if up.calls != wantCalls {
+			t.Fatalf("%s: expected %d upstream queries, got %d", name, wantCalls, up.calls)
+		}
+	}
+
+	lookup("example.org", 1)
+	lookup("Example.Org.", 1)
+	now = now.Add(59 * time.Second)
+	lookup("example.org", 1)
+
+	// Cached records are copies with TTLs reduced by the time spent in
+	// the cache.
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.org.", dns.TypeTXT)
+	resp, err := r.Exchange(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 2 || resp.Answer[0].Header().Ttl != 241 || resp.Answer[1].Header().Ttl != 1 {
+		t.Fatalf("wrong TTLs of cached records: %v", resp.Answer)
+	}
+	resp.Answer[0].(*dns.TXT).Txt[0] = "changed"
+	txts, err := r.LookupTXT(ctx, "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txts[0] != "a" {
+		t.Fatalf("cached record was changed by the caller: %v", txts)
+	}
+
+	now = now.Add(time.Second)
+	lookup("example.org", 2)
+
+	// Negative TTL is the SOA MINIMUM.
+	lookup("missing.example.org", 3)
+	_, err = r.LookupTXT(ctx, "missing.example.org")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	if up.calls != 3 {
+		t.Fatal("negative answer was not cached")
+	}
+	now = now.Add(120 * time.Second)
+	lookup("missing.example.org", 4)
+
+	// TTL is capped at max_ttl.
+	lookup("long.example.org", 5)
+	now = now.Add(time.Hour - time.Second)
+	lookup("long.example.org", 5)
+	now = now.Add(time.Second)
+	lookup("long.example.org", 6)
+}
+
+func TestResolver_Failover(t *testing.T) {
+	r := parseResolver(t, `dns {
+		upstream 127.0.0.1:1
+	}`)
+	down := &fakeUpstream{handler: func(dns.Question) *dns.Msg { return nil }}
+	servfail := &fakeUpstream{handler: func(dns.Question) *dns.Msg {
+		return &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}
+	}}
+	r.upstreams = []upstream{down, servfail}
+
+	_, err := r.LookupMX(context.Background(), "example.org")
+	var dnsErr *net.DNSError
+	if !errors.As(err, &dnsErr) || !dnsErr.Temporary() || dnsErr.IsNotFound {
+		t.Fatalf("expected temporary error, got %v", err)
+	}
+	if down.calls != 1 || servfail.calls != 1 {
+		t.Fatal("not all upstreams were tried")
+	}
+
+	working := &fakeUpstream{handler: func(dns.Question) *dns.Msg {
+		return &dns.Msg{Answer: []dns.RR{mustRR(t, "example.org. 300 IN MX 10 mx.example.org.")}}
+	}}
+	r.upstreams = append(r.upstreams, working)
+	mxs, err := r.LookupMX(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mxs) != 1 || mxs[0].Host != "mx.example.org." {
+		t.Fatalf("wrong MX records: %v", mxs)
+	}
+}
+
+func TestResolver_UDP(t *testing.T) {
+	srv, err := mockdns.NewServerWithLogger(map[string]mockdns.Zone{
+		"example.org.": {
+			A: []string{"192.0.2.1"},
+		},
+	}, testutils.Logger(t, "mockdns"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	r := parseResolver(t, `dns {
+		upstream udp://`+srv.LocalAddr().String()+`
+	}`)
+	addrs, err := r.LookupHost(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs, []string{"192.0.2.1"}) {
+		t.Fatalf("wrong addresses: %v", addrs)
+	}
+}
+
+func TestResolver_DoH(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		blob, _ := io.ReadAll(req.Body)
+		msg := new(dns.Msg)
+		if err := msg.Unpack(blob); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(msg)
+		resp.Answer = []dns.RR{mustRR(t, msg.Question[0].Name+" 300 IN TXT \"doh\"")}
+		blob, _ = resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(blob)
+	}))
+	defer srv.Close()
+
+	u, err := parseUpstream(srv.URL+"/dns-query", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.(*dohUpstream).cl = srv.Client()
+	r := &Resolver{upstreams: []upstream{u}, cache: newCache(0), maxTTL: time.Hour, resolveTimeout: time.Second}
+	txt, err := r.LookupTXT(context.Background(), "example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(txt, []string{"doh"}) {
+		t.Fatalf("wrong TXT records: %q", txt)
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	for addr, want := range map[string]string{
+		"1.1.1.1":                "udp://1.1.1.1:53",
+		"::1":                    "udp://[::1]:53",
+		"[::1]:5353":             "udp://[::1]:5353",
+		"tcp://10.0.0.1":         "tcp://10.0.0.1:53",
+		"tls://1.1.1.1":          "tls://1.1.1.1:853",
+		"tls://dns.example:8853": "tls://dns.example:8853",
+		"https://dns.example/q":  "https://dns.example/q",
+	} {
+		u, err := parseUpstream(addr, time.Second)
+		if err != nil {
+			t.Errorf("%s: %v", addr, err)
+			continue
+		}
+		if u.String() != want {
+			t.Errorf("%s: expected %s, got %s", addr, want, u.String())
+		}
+	}
+
+	for _, addr := range []string{"quic://1.1.1.1", "tls://"} {
+		if _, err := parseUpstream(addr, time.Second); err == nil {
+			t.Errorf("%s: expected error", addr)
+		}
+	}
+}
+
+func TestResolver_Exchange(t *testing.T) {
+	r := parseResolver(t, `dns {
+		upstream 127.0.0.1:1
+		zone mesh.test {
+			A mx 127.0.0.1
+			CNAME smtp mx
+		}
+	}`)
+	r.upstreams = []upstream{&fakeUpstream{handler: func(q dns.Question) *dns.Msg {
+		if q.Name == "alias.example.org." {
+			return &dns.Msg{Answer: []dns.RR{
+				mustRR(t, "alias.example.org. 300 IN CNAME mx.example.org."),
+				mustRR(t, "mx.example.org. 300 IN A 127.0.0.1"),
+			}}
+		}
+		resp := &dns.Msg{Answer: []dns.RR{mustRR(t, q.Name+" 300 IN TLSA 3 1 1 abcd")}}
+		resp.AuthenticatedData = true
+		return resp
+	}}}
+
+	exchange := func(name string, qtype uint16) *dns.Msg {
+		t.Helper()
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qtype)
+		resp, err := r.Exchange(context.Background(), msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Id != msg.Id {
+			t.Fatal("response ID does not match the query")
+		}
+		return resp
+	}
+
+	resp := exchange("_25._tcp.mx.example.org.", dns.TypeTLSA)
+	if !resp.AuthenticatedData || len(resp.Answer) != 1 {
+		t.Errorf("wrong upstream response: %v", resp)
+	}
+
+	resp = exchange("mx.mesh.test.", dns.TypeA)
+	if resp.AuthenticatedData || len(resp.Answer) != 1 {
+		t.Errorf("wrong static response: %v", resp)
+	}
+
+	resp = exchange("missing.mesh.test.", dns.TypeA)
+	if resp.Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN, got %v", dns.RcodeToString[resp.Rcode])
+	}
+
+	resp = exchange("mx.mesh.test.", dns.TypeMX)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("expected NODATA, got %v", resp)
+	}
+
+	for _, name := range []string{"alias.example.org.", "smtp.mesh.test."} {
+		resp = exchange(name, dns.TypeA)
+		if len(resp.Answer) != 2 || resp.Answer[0].Header().Rrtype != dns.TypeCNAME ||
+			resp.Answer[1].Header().Rrtype != dns.TypeA {
+			t.Errorf("%s: CNAME record is missing: %v", name, resp.Answer)
+		}
+	}
+}
+
+// blockingUpstream answers queries once release is closed. It reports the
+// query results to done.
+type blockingUpstream struct {
+	started chan struct{}
+	release chan struct{}
+	done    chan error
+}
+
+func (u *blockingUpstream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	u.started <- struct{}{}
+	select {
+	case <-u.release:
+	case <-ctx.Done():
+		u.done <- ctx.Err()
+		return nil, ctx.Err()
+	}
+	u.done <- nil
+	resp := new(dns.Msg)
+	resp.SetReply(msg)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: msg.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.IPv4(127, 0, 0, 1),
+	}}
+	return resp, nil
+}
+
+func (u *blockingUpstream) trusted() bool {
+	return true
+}
+
+func (u *blockingUpstream) String() string {
+	return "blocking"
+}
+
+func TestResolver_SharedLookupCancel(t *testing.T) {
+	r := parseResolver(t, `dns {
+		upstream 127.0.0.1:1
+	}`)
+	up := &blockingUpstream{
+		started: make(chan struct{}, 2),
+		release: make(chan struct{}),
+		done:    make(chan error, 2),
+	}
+	r.upstreams = []upstream{up}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lookupErr := make(chan error, 1)
+	go func() {
+		_, err := r.LookupMX(ctx, "example.org")
+		lookupErr <- err
+	}()
+	<-up.started
+	cancel()
+	if err := <-lookupErr; err == nil {
+		t.Fatal("cancelled lookup succeeded")
+	}
+
+	// The query is shared with other lookups and so is not cancelled
+	// together with the lookup that started it.
+	close(up.release)
+	if err := <-up.done; err != nil {
+		t.Fatalf("shared query failed: %v", err)
+	}
+}
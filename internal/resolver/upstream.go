@@ -0,0 +1,186 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstream is a recursive DNS server queries are forwarded to.
+type upstream interface {
+	exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+	// trusted reports whether the AD flag in responses can be relied on.
+	trusted() bool
+	String() string
+}
+
+// plainUpstream talks DNS over UDP (falling back to TCP for truncated
+// responses), TCP or TLS (RFC 7858).
+type plainUpstream struct {
+	name     string
+	addr     string
+	secure   bool
+	cl       *dns.Client
+	fallback *dns.Client
+}
+
+func (u *plainUpstream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := u.cl.ExchangeContext(ctx, msg, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated && u.fallback != nil {
+		resp, _, err = u.fallback.ExchangeContext(ctx, msg, u.addr)
+	}
+	return resp, err
+}
+
+func (u *plainUpstream) trusted() bool {
+	return u.secure
+}
+
+func (u *plainUpstream) String() string {
+	return u.name
+}
+
+// dohUpstream talks DNS over HTTPS (RFC 8484).
+type dohUpstream struct {
+	url string
+	cl  *http.Client
+}
+
+func (u *dohUpstream) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 Section 4.1 recommends ID 0 to make responses cache-friendly.
+	req := msg.Copy()
+	req.Id = 0
+	body, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+
+	httpResp, err := u.cl.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("resolver: %s: HTTP status %s", u.url, httpResp.Status)
+	}
+
+	blob, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(blob); err != nil {
+		return nil, fmt.Errorf("resolver: %s: malformed response: %w", u.url, err)
+	}
+	resp.Id = msg.Id
+	return resp, nil
+}
+
+func (u *dohUpstream) trusted() bool {
+	return true
+}
+
+func (u *dohUpstream) String() string {
+	return u.url
+}
+
+// parseUpstream parses the upstream address. Supported forms are
+// udp://host[:port], tcp://host[:port], tls://host[:port], https://host/path
+// and plain host[:port] (same as udp://).
+func parseUpstream(addr string, timeout time.Duration) (upstream, error) {
+	scheme, hostPort := "udp", addr
+	if i := strings.Index(addr, "://"); i != -1 {
+		scheme, hostPort = addr[:i], addr[i+3:]
+	}
+
+	switch scheme {
+	case "https":
+		if _, err := url.Parse(addr); err != nil {
+			return nil, fmt.Errorf("resolver: malformed upstream URL %s: %w", addr, err)
+		}
+		return &dohUpstream{
+			url: addr,
+			cl:  &http.Client{Timeout: timeout},
+		}, nil
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("resolver: unsupported upstream scheme: %s", scheme)
+	}
+
+	if hostPort == "" {
+		return nil, errors.New("resolver: empty upstream address")
+	}
+	defaultPort := "53"
+	if scheme == "tls" {
+		defaultPort = "853"
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host, port = strings.Trim(hostPort, "[]"), defaultPort
+	}
+
+	u := &plainUpstream{
+		name: scheme + "://" + net.JoinHostPort(host, port),
+		addr: net.JoinHostPort(host, port),
+		// Disregard AD flag from non-local resolvers reached over
+		// plain DNS, it can be tampered with.
+		secure: scheme == "tls" || isLoopback(host),
+	}
+	switch scheme {
+	case "udp":
+		u.cl = &dns.Client{Net: "udp", Timeout: timeout}
+		u.fallback = &dns.Client{Net: "tcp", Timeout: timeout}
+	case "tcp":
+		u.cl = &dns.Client{Net: "tcp", Timeout: timeout}
+	case "tls":
+		u.cl = &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   timeout,
+			TLSConfig: &tls.Config{ServerName: host},
+		}
+	}
+	return u, nil
+}
+
+func isLoopback(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,120 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package resolver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirrchat/SirrMesh/framework/config"
+)
+
+// staticTTL is the TTL of records in static zones. It has no effect on
+// caching since static answers are not cached.
+const staticTTL = 3600
+
+// maxCNAMEChain limits the number of CNAME records followed within static
+// zones.
+const maxCNAMEChain = 8
+
+// zone is a set of records configured using the zone directive. Names
+// within the zone that have no records are reported as NXDOMAIN.
+type zone struct {
+	origin  string
+	records map[string][]dns.RR
+}
+
+// parseZone parses the zone block:
+//
+//	zone mesh.test {
+//	    MX @ 10 mx
+//	    A mx 127.0.0.1
+//	    TXT @ "v=spf1 a:mx.mesh.test -all"
+//	}
+//
+// Each directive is TYPE NAME DATA. Names are relative to the zone name
+// unless they end with a dot, @ stands for the zone name itself.
+func parseZone(node config.Node) (*zone, error) {
+	if len(node.Args) != 1 {
+		return nil, config.NodeErr(node, "expected exactly one argument: zone name")
+	}
+	z := &zone{
+		origin:  dns.CanonicalName(node.Args[0]),
+		records: make(map[string][]dns.RR),
+	}
+
+	for _, child := range node.Children {
+		if len(child.Args) < 2 {
+			return nil, config.NodeErr(child, "expected: TYPE NAME DATA")
+		}
+		typ := strings.ToUpper(child.Name)
+		data := child.Args[1:]
+		if typ == "TXT" {
+			quoted := make([]string, 0, len(data))
+			for _, s := range data {
+				quoted = append(quoted, quoteTXT(s))
+			}
+			data = quoted
+		}
+
+		line := fmt.Sprintf("%s %d IN %s %s", child.Args[0], staticTTL, typ, strings.Join(data, " "))
+		zp := dns.NewZoneParser(strings.NewReader(line), z.origin, child.File)
+		rr, ok := zp.Next()
+		if err := zp.Err(); err != nil {
+			return nil, config.NodeErr(child, "%v", err)
+		}
+		if !ok {
+			return nil, config.NodeErr(child, "malformed record")
+		}
+
+		name := dns.CanonicalName(rr.Header().Name)
+		if !dns.IsSubDomain(z.origin, name) {
+			return nil, config.NodeErr(child, "%s is outside of zone %s", name, z.origin)
+		}
+		rr.Header().Name = name
+		z.records[name] = append(z.records[name], rr)
+	}
+
+	return z, nil
+}
+
+func quoteTXT(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + s + `"`
+}
+
+// lookup returns the records of the specified type and the CNAME record
+// for the name (which is expected to be in canonical form).
+func (z *zone) lookup(name string, qtype uint16) (rrs []dns.RR, cname *dns.CNAME, ok bool) {
+	recs, ok := z.records[name]
+	if !ok {
+		return nil, nil, false
+	}
+	for _, rr := range recs {
+		if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+		if c, isCNAME := rr.(*dns.CNAME); isCNAME {
+			cname = c
+		}
+	}
+	return rrs, cname, true
+}
@@ -21,6 +21,7 @@ package imapsql
 import (
 	"context"
 	"runtime/trace"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
@@ -41,6 +42,7 @@ type delivery struct {
 	msgMeta  *module.MsgMetadata
 	d        imapsql.Delivery
 	mailFrom string
+	started  time.Time
 
 	addedRcpts map[string]addedRcpt
 }
@@ -81,6 +83,7 @@ func (d *delivery) AddRcpt(ctx context.Context, rcptTo string, _ smtp.RcptOption
 		if err == imapsql.ErrUserDoesntExists || err == backend.ErrNoSuchMailbox {
 			return userDoesNotExist(err)
 		}
+		dbErrors.WithLabelValues(d.store.instName, "add_rcpt").Inc()
 		if _, ok := err.(imapsql.SerializationError); ok {
 			return &exterrors.SMTPError{
 				Code:         453,
@@ -115,6 +118,7 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 
 	if d.msgMeta.Quarantine {
 		if err := d.d.SpecialMailbox(imap.JunkAttr, d.store.junkMbox); err != nil {
+			dbErrors.WithLabelValues(d.store.instName, "body").Inc()
 			if _, ok := err.(imapsql.SerializationError); ok {
 				return &exterrors.SMTPError{
 					Code:         453,
@@ -131,6 +135,9 @@ func (d *delivery) Body(ctx context.Context, header textproto.Header, body buffe
 	header = header.Copy()
 	header.Add("Return-Path", "<"+target.SanitizeForHeader(d.mailFrom)+">")
 	err := d.d.BodyParsed(header, body.Len(), body)
+	if err != nil {
+		dbErrors.WithLabelValues(d.store.instName, "body").Inc()
+	}
 	if _, ok := err.(imapsql.SerializationError); ok {
 		return &exterrors.SMTPError{
 			Code:         453,
@@ -152,7 +159,12 @@ func (d *delivery) Abort(ctx context.Context) error {
 func (d *delivery) Commit(ctx context.Context) error {
 	defer trace.StartRegion(ctx, "sql/Commit").End()
 
-	return d.d.Commit()
+	if err := d.d.Commit(); err != nil {
+		dbErrors.WithLabelValues(d.store.instName, "commit").Inc()
+		return err
+	}
+	deliveryDuration.WithLabelValues(d.store.instName).Observe(time.Since(d.started).Seconds())
+	return nil
 }
 
 func (store *Storage) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom string) (module.Delivery, error) {
@@ -162,6 +174,7 @@ func (store *Storage) Start(ctx context.Context, msgMeta *module.MsgMetadata, ma
 		store:      store,
 		msgMeta:    msgMeta,
 		mailFrom:   mailFrom,
+		started:    time.Now(),
 		d:          store.Back.NewDelivery(),
 		addedRcpts: map[string]addedRcpt{},
 	}, nil
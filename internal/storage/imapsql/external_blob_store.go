@@ -2,7 +2,9 @@ package imapsql
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"time"
 
 	imapsql "github.com/foxcpp/go-imap-sql"
 	"github.com/sirrchat/SirrMesh/framework/module"
@@ -32,8 +34,22 @@ type ExtBlobStore struct {
 	Base module.BlobStore
 }
 
+// observe records the blob store operation metrics.
+func (e ExtBlobStore) observe(op string, start time.Time, err error) {
+	name := fmt.Sprintf("%T", e.Base)
+	if mod, ok := e.Base.(module.Module); ok {
+		name = mod.InstanceName()
+	}
+	blobDuration.WithLabelValues(name, op).Observe(time.Since(start).Seconds())
+	if err != nil && err != module.ErrNoSuchBlob {
+		blobErrors.WithLabelValues(name, op).Inc()
+	}
+}
+
 func (e ExtBlobStore) Create(key string, objSize int64) (imapsql.ExtStoreObj, error) {
+	start := time.Now()
 	blob, err := e.Base.Create(context.TODO(), key, objSize)
+	e.observe("create", start, err)
 	if err != nil {
 		return nil, imapsql.ExternalError{
 			NonExistent: err == module.ErrNoSuchBlob,
@@ -45,7 +61,9 @@ func (e ExtBlobStore) Create(key string, objSize int64) (imapsql.ExtStoreObj, er
 }
 
 func (e ExtBlobStore) Open(key string) (imapsql.ExtStoreObj, error) {
+	start := time.Now()
 	blob, err := e.Base.Open(context.TODO(), key)
+	e.observe("open", start, err)
 	if err != nil {
 		return nil, imapsql.ExternalError{
 			NonExistent: err == module.ErrNoSuchBlob,
@@ -57,7 +75,9 @@ func (e ExtBlobStore) Open(key string) (imapsql.ExtStoreObj, error) {
 }
 
 func (e ExtBlobStore) Delete(keys []string) error {
+	start := time.Now()
 	err := e.Base.Delete(context.TODO(), keys)
+	e.observe("delete", start, err)
 	if err != nil {
 		return imapsql.ExternalError{
 			Key: "",
@@ -27,11 +27,8 @@ package imapsql
 
 import (
 	"context"
-	"crypto/sha1"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"path/filepath"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -48,7 +45,6 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/module"
 	"github.com/sirrchat/SirrMesh/internal/authz"
 	"github.com/sirrchat/SirrMesh/internal/updatepipe"
-	"github.com/sirrchat/SirrMesh/internal/updatepipe/pubsub"
 
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
@@ -66,9 +62,17 @@ type Storage struct {
 
 	resolver dns.Resolver
 
-	updPipe      updatepipe.P
-	updPushStop  chan struct{}
-	outboundUpds chan mess.Update
+	updPipeCfg     updPipeConfig
+	updPipeBuffer  int
+	updPipeBackend string
+	updPipe        updatepipe.P
+	updPushStop    chan struct{}
+	updPullStop    chan struct{}
+	outboundUpds   chan mess.Update
+	notify         *notifyHub
+
+	// modSeq is set if modification sequences are tracked in the database.
+	modSeq bool
 
 	filters module.IMAPFilter
 
@@ -136,7 +140,7 @@ func (store *Storage) Init(cfg *config.Map) error {
 	}, &blobStore)
 	cfg.StringList("compression", false, false, []string{"off"}, &compression)
 	cfg.DataSize("appendlimit", false, false, 32*1024*1024, &appendlimitVal)
-	cfg.Bool("debug", true, false, &store.Log.Debug)
+	cfg.Logger(true, false, &store.Log)
 	cfg.Int("sqlite3_cache_size", false, false, 0, &opts.CacheSize)
 	cfg.Int("sqlite3_busy_timeout", false, false, 5000, &opts.BusyTimeout)
 	cfg.Bool("disable_recent", false, true, &opts.DisableRecent)
@@ -156,6 +160,10 @@ func (store *Storage) Init(cfg *config.Map) error {
 		return nil, nil
 	}, modconfig.TableDirective, &store.deliveryMap)
 	cfg.String("delivery_normalize", false, false, "precis_casefold_email", &deliveryNormalize)
+	cfg.Custom("update_pipe", false, false, func() (interface{}, error) {
+		return updPipeConfig{Backend: "auto"}, nil
+	}, updatePipeDirective, &store.updPipeCfg)
+	cfg.Int("update_pipe_buffer", false, false, 256, &store.updPipeBuffer)
 
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -164,6 +172,9 @@ func (store *Storage) Init(cfg *config.Map) error {
 	if dsn == nil {
 		return errors.New("imapsql: dsn is required")
 	}
+	if store.updPipeBuffer <= 0 {
+		return errors.New("imapsql: update_pipe_buffer should be positive")
+	}
 	if driver == "" {
 		return errors.New("imapsql: driver is required")
 	}
@@ -264,6 +275,13 @@ func (store *Storage) Init(cfg *config.Map) error {
 		}
 	}
 
+	store.driver = driver
+	store.dsn = dsn
+
+	if module.DryRun {
+		return nil
+	}
+
 	store.Back, err = imapsql.New(driver, dsnStr, ExtBlobStore{Base: blobStore}, opts)
 	if err != nil {
 		return fmt.Errorf("imapsql: %s", err)
@@ -271,8 +289,9 @@ func (store *Storage) Init(cfg *config.Map) error {
 
 	store.Log.Debugln("go-imap-sql version", imapsql.VersionStr)
 
-	store.driver = driver
-	store.dsn = dsn
+	if err := store.initModSeq(); err != nil {
+		return fmt.Errorf("imapsql: %w", err)
+	}
 
 	return nil
 }
@@ -281,38 +300,31 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 	if store.updPipe != nil {
 		return nil
 	}
+	if store.updPipeCfg.Backend == "off" {
+		store.Log.DebugMsg("update pipe is disabled")
+		return nil
+	}
 
-	switch store.driver {
-	case "sqlite3":
-		dbId := sha1.Sum([]byte(strings.Join(store.dsn, " ")))
-		sockPath := filepath.Join(
-			config.RuntimeDirectory,
-			fmt.Sprintf("sql-%s.sock", hex.EncodeToString(dbId[:])))
-		store.Log.DebugMsg("using unix socket for external updates", "path", sockPath)
-		store.updPipe = &updatepipe.UnixSockPipe{
-			SockPath: sockPath,
-			Log:      log.Logger{Name: "storage.imapsql/updpipe", Debug: store.Log.Debug},
-		}
-	case "postgres":
-		store.Log.DebugMsg("using PostgreSQL broker for external updates")
-		ps, err := pubsub.NewPQ(strings.Join(store.dsn, " "))
-		if err != nil {
-			return fmt.Errorf("enable_update_pipe: %w", err)
-		}
-		ps.Log = log.Logger{Name: "storage.imapsql/updpipe/pubsub", Debug: store.Log.Debug}
-		pipe := &updatepipe.PubSubPipe{
-			PubSub: ps,
-			Log:    log.Logger{Name: "storage.imapsql/updpipe", Debug: store.Log.Debug},
-		}
-		store.Back.UpdateManager().ExternalUnsubscribe = pipe.Unsubscribe
-		store.Back.UpdateManager().ExternalSubscribe = pipe.Subscribe
-		store.updPipe = pipe
-	default:
-		return errors.New("imapsql: driver does not have an update pipe implementation")
+	backend, err := store.updPipeCfg.backend(store.driver)
+	if err != nil {
+		return err
+	}
+	pipe, err := store.newUpdatePipe(backend)
+	if err != nil {
+		return fmt.Errorf("enable_update_pipe: %w", err)
+	}
+	hub := &notifyHub{watchers: make(map[uint64]map[*mboxWatch]struct{})}
+	if psPipe, ok := pipe.(*updatepipe.PubSubPipe); ok {
+		hub.subs = &subRefs{pipe: psPipe, counts: make(map[interface{}]int)}
+		store.Back.UpdateManager().ExternalUnsubscribe = hub.subs.unsubscribe
+		store.Back.UpdateManager().ExternalSubscribe = hub.subs.subscribe
 	}
+	store.updPipe = pipe
+	store.updPipeBackend = backend
 
-	inbound := make(chan mess.Update, 32)
+	inbound := make(chan mess.Update, store.updPipeBuffer)
 	outbound := make(chan mess.Update, 10)
+	pushQueue := make(chan mess.Update, store.updPipeBuffer)
 	store.outboundUpds = outbound
 
 	if mode == updatepipe.ModeReplicate {
@@ -326,14 +338,45 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 		store.updPipe = nil
 		return err
 	}
+	if mode == updatepipe.ModeReplicate {
+		store.notify = hub
+	}
 
 	store.Back.UpdateManager().SetExternalSink(outbound)
 
+	// The update manager blocks IMAP operations while the sink is full, so
+	// the updates are moved to the bounded push queue. Updates are never
+	// dropped: a lost EXPUNGE or flag change leaves other servers with a
+	// wrong view of the mailbox. If the pipe does not keep up, IMAP
+	// operations are delayed until it does.
+	go func() {
+		defer close(pushQueue)
+		stalled := false
+		for u := range outbound {
+			if mode == updatepipe.ModeReplicate {
+				hub.dispatch(u)
+			}
+			select {
+			case pushQueue <- u:
+				stalled = false
+				continue
+			default:
+			}
+			if !stalled && mode == updatepipe.ModeReplicate {
+				store.Log.Error("IMAP update pipe is not keeping up, delaying IMAP operations",
+					errors.New("push queue is full"), "queued", len(pushQueue))
+				stalled = true
+			}
+			updatepipe.CountStalled(store.instName, backend, "out")
+			pushQueue <- u
+		}
+	}()
+
 	store.updPushStop = make(chan struct{}, 1)
 	go func() {
 		defer func() {
 			// Ensure we sent all outbound updates.
-			for upd := range outbound {
+			for upd := range pushQueue {
 				if err := store.updPipe.Push(upd); err != nil {
 					store.Log.Error("IMAP update pipe push failed", err)
 				}
@@ -346,19 +389,26 @@ func (store *Storage) EnableUpdatePipe(mode updatepipe.BackendMode) error {
 			}
 		}()
 
+		for u := range pushQueue {
+			store.Log.DebugMsg("sending external update", "type", u.Type, "key", u.Key)
+			if err := store.updPipe.Push(u); err != nil {
+				store.Log.Error("IMAP update pipe push failed", err)
+			}
+		}
+	}()
+
+	// Received updates are applied separately so a stalled push does not
+	// delay them.
+	store.updPullStop = make(chan struct{})
+	go func() {
 		for {
 			select {
 			case u := <-inbound:
 				store.Log.DebugMsg("external update received", "type", u.Type, "key", u.Key)
 				store.Back.UpdateManager().ExternalUpdate(u)
-			case u, ok := <-outbound:
-				if !ok {
-					return
-				}
-				store.Log.DebugMsg("sending external update", "type", u.Type, "key", u.Key)
-				if err := store.updPipe.Push(u); err != nil {
-					store.Log.Error("IMAP update pipe push failed", err)
-				}
+				hub.dispatch(u)
+			case <-store.updPullStop:
+				return
 			}
 		}
 	}()
@@ -371,7 +421,14 @@ func (store *Storage) I18NLevel() int {
 }
 
 func (store *Storage) IMAPExtensions() []string {
-	return []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT"}
+	exts := []string{"APPENDLIMIT", "MOVE", "CHILDREN", "SPECIAL-USE", "CREATE-SPECIAL-USE", "I18NLEVEL=1", "SORT", "THREAD=ORDEREDSUBJECT"}
+	if store.modSeq {
+		exts = append(exts, "CONDSTORE", "QRESYNC")
+	}
+	if store.notify != nil {
+		exts = append(exts, "NOTIFY")
+	}
+	return exts
 }
 
 func (store *Storage) CreateMessageLimit() *uint32 {
@@ -384,7 +441,11 @@ func (store *Storage) GetOrCreateIMAPAcct(username string) (backend.User, error)
 		return nil, backend.ErrInvalidCredentials
 	}
 
-	return store.Back.GetOrCreateUser(accountName)
+	u, err := store.Back.GetOrCreateUser(accountName)
+	if err != nil {
+		dbErrors.WithLabelValues(store.instName, "get_user").Inc()
+	}
+	return u, err
 }
 
 func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, error) {
@@ -398,6 +459,7 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 		if errors.Is(err, imapsql.ErrUserDoesntExists) {
 			return "", false, nil
 		}
+		dbErrors.WithLabelValues(store.instName, "get_user").Inc()
 		return "", false, err
 	}
 	if err := usr.Logout(); err != nil {
@@ -407,7 +469,27 @@ func (store *Storage) Lookup(ctx context.Context, key string) (string, bool, err
 	return "", true, nil
 }
 
+// CheckHealth looks up a nonexistent account to verify that the database is
+// reachable.
+func (store *Storage) CheckHealth(ctx context.Context) error {
+	if store.Back == nil {
+		return nil
+	}
+	u, err := store.Back.GetUser("healthcheck@invalid")
+	if err != nil {
+		if errors.Is(err, imapsql.ErrUserDoesntExists) {
+			return nil
+		}
+		return err
+	}
+	return u.Logout()
+}
+
 func (store *Storage) Close() error {
+	if store.Back == nil {
+		return nil
+	}
+
 	// Stop backend from generating new updates.
 	store.Back.Close()
 
@@ -417,6 +499,7 @@ func (store *Storage) Close() error {
 	if store.updPipe != nil {
 		close(store.outboundUpds)
 		<-store.updPushStop
+		close(store.updPullStop)
 
 		store.updPipe.Close()
 	}
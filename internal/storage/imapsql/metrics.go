@@ -0,0 +1,72 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	deliveryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "imapsql",
+			Name:      "delivery_duration_seconds",
+			Help:      "Time taken to store delivered messages, from Start to Commit",
+			Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		},
+		[]string{"module"},
+	)
+	dbErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "imapsql",
+			Name:      "db_errors_total",
+			Help:      "Database errors by operation",
+		},
+		[]string{"module", "operation"},
+	)
+
+	blobDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "blob",
+			Name:      "operation_duration_seconds",
+			Help:      "Time taken by blob store operations (create, open, delete)",
+			Buckets:   []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		},
+		[]string{"module", "operation"},
+	)
+	blobErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "blob",
+			Name:      "errors_total",
+			Help:      "Failed blob store operations",
+		},
+		[]string{"module", "operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(deliveryDuration)
+	prometheus.MustRegister(dbErrors)
+	prometheus.MustRegister(blobDuration)
+	prometheus.MustRegister(blobErrors)
+}
@@ -0,0 +1,471 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/sirrchat/SirrMesh/internal/imapext"
+)
+
+// Modification sequences (RFC 7162) are not tracked by go-imap-sql. It copies
+// rows of the msgs and flags tables using positional INSERT ... SELECT
+// statements, so no columns can be added there. Instead, mboxes gets the
+// highestmodseq column and per-message values are kept in the msgmodseq
+// table. Both are maintained by triggers so every change made by
+// go-imap-sql, including ones made by other server instances and sirrmesh
+// subcommands, bumps the mod-sequence.
+//
+// Rows of expunged messages are kept with expunged = 1 to answer QRESYNC
+// VANISHED (EARLIER) queries. Triggers do nothing if the mailbox row is gone,
+// which happens while DELETE cascades to messages and flags.
+//
+// The triggers depend on the go-imap-sql tables, so the schema version they
+// were written for is checked and recorded in the modseq_schema table
+// together with the version of the modseq schema itself.
+
+const (
+	// modSeqSchemaVersion is incremented each time the modseq schema
+	// changes.
+	modSeqSchemaVersion = 1
+	// modSeqUpstreamSchema is the go-imap-sql schema version the triggers
+	// are written for.
+	modSeqUpstreamSchema = 6
+)
+
+const modSeqSchemaSQLite = `
+CREATE TABLE IF NOT EXISTS msgmodseq (
+	mboxId BIGINT NOT NULL,
+	msgId BIGINT NOT NULL,
+	modseq BIGINT NOT NULL,
+	expunged INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (mboxId, msgId)
+);
+CREATE INDEX IF NOT EXISTS msgmodseq_modseq ON msgmodseq(mboxId, modseq);
+
+CREATE TRIGGER IF NOT EXISTS modseq_msgs_insert AFTER INSERT ON msgs BEGIN
+	UPDATE mboxes SET highestmodseq = highestmodseq + 1 WHERE id = NEW.mboxId;
+	INSERT OR REPLACE INTO msgmodseq (mboxId, msgId, modseq, expunged)
+	SELECT NEW.mboxId, NEW.msgId, highestmodseq, 0 FROM mboxes WHERE id = NEW.mboxId;
+END;
+CREATE TRIGGER IF NOT EXISTS modseq_msgs_delete AFTER DELETE ON msgs BEGIN
+	UPDATE mboxes SET highestmodseq = highestmodseq + 1 WHERE id = OLD.mboxId;
+	INSERT OR REPLACE INTO msgmodseq (mboxId, msgId, modseq, expunged)
+	SELECT OLD.mboxId, OLD.msgId, highestmodseq, 1 FROM mboxes WHERE id = OLD.mboxId;
+END;
+CREATE TRIGGER IF NOT EXISTS modseq_msgs_seen AFTER UPDATE OF seen ON msgs
+WHEN OLD.seen != NEW.seen AND EXISTS (SELECT 1 FROM mboxes WHERE id = NEW.mboxId) BEGIN
+	UPDATE mboxes SET highestmodseq = highestmodseq + 1 WHERE id = NEW.mboxId;
+	UPDATE msgmodseq SET modseq = (SELECT highestmodseq FROM mboxes WHERE id = NEW.mboxId)
+	WHERE mboxId = NEW.mboxId AND msgId = NEW.msgId AND expunged = 0;
+END;
+CREATE TRIGGER IF NOT EXISTS modseq_flags_insert AFTER INSERT ON flags
+WHEN NEW.flag != '\Recent' AND EXISTS (SELECT 1 FROM mboxes WHERE id = NEW.mboxId) BEGIN
+	UPDATE mboxes SET highestmodseq = highestmodseq + 1 WHERE id = NEW.mboxId;
+	UPDATE msgmodseq SET modseq = (SELECT highestmodseq FROM mboxes WHERE id = NEW.mboxId)
+	WHERE mboxId = NEW.mboxId AND msgId = NEW.msgId AND expunged = 0;
+END;
+CREATE TRIGGER IF NOT EXISTS modseq_flags_delete AFTER DELETE ON flags
+WHEN OLD.flag != '\Recent' AND EXISTS (SELECT 1 FROM mboxes WHERE id = OLD.mboxId) BEGIN
+	UPDATE mboxes SET highestmodseq = highestmodseq + 1 WHERE id = OLD.mboxId;
+	UPDATE msgmodseq SET modseq = (SELECT highestmodseq FROM mboxes WHERE id = OLD.mboxId)
+	WHERE mboxId = OLD.mboxId AND msgId = OLD.msgId AND expunged = 0;
+END;
+CREATE TRIGGER IF NOT EXISTS modseq_mboxes_delete AFTER DELETE ON mboxes BEGIN
+	DELETE FROM msgmodseq WHERE mboxId = OLD.id;
+END;`
+
+const modSeqSchemaPostgres = `
+CREATE TABLE IF NOT EXISTS msgmodseq (
+	mboxId BIGINT NOT NULL,
+	msgId BIGINT NOT NULL,
+	modseq BIGINT NOT NULL,
+	expunged INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (mboxId, msgId)
+);
+CREATE INDEX IF NOT EXISTS msgmodseq_modseq ON msgmodseq(mboxId, modseq);
+
+CREATE OR REPLACE FUNCTION modseq_bump(mbox BIGINT, msg BIGINT, expunge INTEGER, upsert BOOLEAN) RETURNS VOID AS $$
+DECLARE
+	newmodseq BIGINT;
+BEGIN
+	UPDATE mboxes SET highestmodseq = highestmodseq + 1 WHERE id = mbox
+	RETURNING highestmodseq INTO newmodseq;
+	IF newmodseq IS NULL THEN
+		RETURN;
+	END IF;
+	IF upsert THEN
+		INSERT INTO msgmodseq (mboxId, msgId, modseq, expunged) VALUES (mbox, msg, newmodseq, expunge)
+		ON CONFLICT (mboxId, msgId) DO UPDATE SET modseq = EXCLUDED.modseq, expunged = EXCLUDED.expunged;
+	ELSE
+		UPDATE msgmodseq SET modseq = newmodseq WHERE mboxId = mbox AND msgId = msg AND expunged = 0;
+	END IF;
+END $$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION modseq_msgs() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		PERFORM modseq_bump(NEW.mboxId, NEW.msgId, 0, TRUE);
+	ELSIF TG_OP = 'DELETE' THEN
+		PERFORM modseq_bump(OLD.mboxId, OLD.msgId, 1, TRUE);
+	ELSIF OLD.seen != NEW.seen THEN
+		PERFORM modseq_bump(NEW.mboxId, NEW.msgId, 0, FALSE);
+	END IF;
+	RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION modseq_flags() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		IF NEW.flag != '\Recent' THEN
+			PERFORM modseq_bump(NEW.mboxId, NEW.msgId, 0, FALSE);
+		END IF;
+	ELSIF OLD.flag != '\Recent' THEN
+		PERFORM modseq_bump(OLD.mboxId, OLD.msgId, 0, FALSE);
+	END IF;
+	RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION modseq_mboxes() RETURNS trigger AS $$
+BEGIN
+	DELETE FROM msgmodseq WHERE mboxId = OLD.id;
+	RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS modseq_msgs ON msgs;
+CREATE TRIGGER modseq_msgs AFTER INSERT OR DELETE OR UPDATE OF seen ON msgs
+FOR EACH ROW EXECUTE PROCEDURE modseq_msgs();
+DROP TRIGGER IF EXISTS modseq_flags ON flags;
+CREATE TRIGGER modseq_flags AFTER INSERT OR DELETE ON flags
+FOR EACH ROW EXECUTE PROCEDURE modseq_flags();
+DROP TRIGGER IF EXISTS modseq_mboxes ON mboxes;
+CREATE TRIGGER modseq_mboxes AFTER DELETE ON mboxes
+FOR EACH ROW EXECUTE PROCEDURE modseq_mboxes();`
+
+// initModSeq adds modification sequence tracking to the database if the
+// driver supports it. It is a no-op for MySQL and for go-imap-sql schema
+// versions other than modSeqUpstreamSchema, CONDSTORE and QRESYNC are not
+// advertised then.
+func (store *Storage) initModSeq() error {
+	var schema string
+	switch store.driver {
+	case "sqlite3", "sqlite":
+		schema = modSeqSchemaSQLite
+	case "postgres":
+		schema = modSeqSchemaPostgres
+	default:
+		store.Log.DebugMsg("modification sequences are not supported by the driver", "driver", store.driver)
+		return nil
+	}
+
+	if _, err := store.Back.DB.Exec(`CREATE TABLE IF NOT EXISTS modseq_schema (
+		version INTEGER NOT NULL,
+		upstream INTEGER NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("modseq schema version: %w", err)
+	}
+	var (
+		installed, installedUpstream int
+		upstream                     int
+	)
+	err := store.Back.DB.QueryRow(`SELECT version, upstream FROM modseq_schema`).Scan(&installed, &installedUpstream)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("modseq schema version: %w", err)
+	}
+	if err := store.Back.DB.QueryRow(`SELECT version FROM schema_version`).Scan(&upstream); err != nil {
+		return fmt.Errorf("imapsql schema version: %w", err)
+	}
+	if installed > modSeqSchemaVersion {
+		return fmt.Errorf("incompatible modseq schema, too new (%d > %d)", installed, modSeqSchemaVersion)
+	}
+	if upstream != modSeqUpstreamSchema {
+		// Triggers written for another schema may break go-imap-sql
+		// queries, so the database cannot be used if they are installed.
+		if installed != 0 {
+			return fmt.Errorf("modseq triggers are installed for imapsql schema %d, database uses schema %d", installedUpstream, upstream)
+		}
+		store.Log.Msg("modification sequences are not supported for the imapsql schema, CONDSTORE and QRESYNC are disabled",
+			"schema", upstream, "supported", modSeqUpstreamSchema)
+		return nil
+	}
+
+	// Checked outside of the transaction since a failed query aborts the
+	// transaction on PostgreSQL.
+	_, probeErr := store.Back.DB.Exec(`SELECT highestmodseq FROM mboxes LIMIT 0`)
+	migrate := probeErr != nil
+
+	tx, err := store.Back.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if migrate {
+		store.Log.Msg("adding modification sequences to the database")
+		if _, err := tx.Exec(`ALTER TABLE mboxes ADD COLUMN highestmodseq BIGINT NOT NULL DEFAULT 1`); err != nil {
+			return fmt.Errorf("add highestmodseq: %w", err)
+		}
+	}
+	if _, err := tx.Exec(schema); err != nil {
+		return fmt.Errorf("modseq schema: %w", err)
+	}
+	if migrate {
+		// Existing messages start at the mod-sequence of their mailbox.
+		if _, err := tx.Exec(`
+			INSERT INTO msgmodseq (mboxId, msgId, modseq, expunged)
+			SELECT mboxId, msgId, 1, 0 FROM msgs`); err != nil {
+			return fmt.Errorf("modseq backfill: %w", err)
+		}
+	}
+	if installed != modSeqSchemaVersion || installedUpstream != upstream {
+		if _, err := tx.Exec(`DELETE FROM modseq_schema`); err != nil {
+			return fmt.Errorf("modseq schema version: %w", err)
+		}
+		if _, err := tx.Exec(store.rebind(`INSERT INTO modseq_schema (version, upstream) VALUES (?, ?)`),
+			modSeqSchemaVersion, upstream); err != nil {
+			return fmt.Errorf("modseq schema version: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	store.modSeq = true
+	return nil
+}
+
+// rebind replaces '?' placeholders with ones used by the driver.
+func (store *Storage) rebind(query string) string {
+	if store.driver != "postgres" {
+		return query
+	}
+	var (
+		sb  strings.Builder
+		idx = 1
+	)
+	for _, chr := range query {
+		if chr == '?' {
+			sb.WriteString("$" + strconv.Itoa(idx))
+			idx++
+			continue
+		}
+		sb.WriteRune(chr)
+	}
+	return sb.String()
+}
+
+// mboxID returns the internal ID of the user mailbox.
+func (store *Storage) mboxID(u backend.User, name string) (uint64, error) {
+	sqlUser, ok := u.(*imapsql.User)
+	if !ok {
+		return 0, fmt.Errorf("imapsql: unexpected user type %T", u)
+	}
+
+	var (
+		id  uint64
+		err error
+	)
+	if strings.EqualFold(name, "INBOX") {
+		err = store.Back.DB.QueryRow(store.rebind(`SELECT inboxId FROM users WHERE id = ?`), sqlUser.ID()).Scan(&id)
+	} else {
+		err = store.Back.DB.QueryRow(store.rebind(`SELECT id FROM mboxes WHERE uid = ? AND name = ?`), sqlUser.ID(), name).Scan(&id)
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, backend.ErrNoSuchMailbox
+		}
+		dbErrors.WithLabelValues(store.instName, "mbox_id").Inc()
+		return 0, err
+	}
+	return id, nil
+}
+
+// ModSeqMailbox implements imapext.ModSeqBackend.
+func (store *Storage) ModSeqMailbox(u backend.User, name string) (imapext.ModSeqMailbox, error) {
+	if !store.modSeq {
+		return nil, errors.New("imapsql: modification sequences are not supported")
+	}
+	id, err := store.mboxID(u, name)
+	if err != nil {
+		return nil, err
+	}
+	return &modSeqMailbox{store: store, id: id}, nil
+}
+
+type modSeqMailbox struct {
+	store *Storage
+	id    uint64
+}
+
+func (m *modSeqMailbox) HighestModSeq() (uint64, error) {
+	var modSeq uint64
+	err := m.store.Back.DB.QueryRow(m.store.rebind(`SELECT highestmodseq FROM mboxes WHERE id = ?`), m.id).Scan(&modSeq)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, backend.ErrNoSuchMailbox
+		}
+		dbErrors.WithLabelValues(m.store.instName, "modseq").Inc()
+		return 0, err
+	}
+	return modSeq, nil
+}
+
+// uidCond builds the condition matching msgId against the UID set. "*" is
+// replaced with the largest UID in the mailbox.
+func (m *modSeqMailbox) uidCond(uids *imap.SeqSet) (string, []interface{}, error) {
+	var lastUID *uint32
+	last := func() (uint32, error) {
+		if lastUID != nil {
+			return *lastUID, nil
+		}
+		var val sql.NullInt64
+		err := m.store.Back.DB.QueryRow(m.store.rebind(`SELECT MAX(msgId) FROM msgmodseq WHERE mboxId = ? AND expunged = 0`), m.id).Scan(&val)
+		if err != nil {
+			return 0, err
+		}
+		lastUID = new(uint32)
+		*lastUID = uint32(val.Int64)
+		return *lastUID, nil
+	}
+
+	conds := make([]string, 0, len(uids.Set))
+	args := make([]interface{}, 0, len(uids.Set)*2)
+	for _, seq := range uids.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 || stop == 0 {
+			l, err := last()
+			if err != nil {
+				return "", nil, err
+			}
+			if start == 0 {
+				start = l
+			}
+			if stop == 0 {
+				stop = l
+			}
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		conds = append(conds, "msgId BETWEEN ? AND ?")
+		args = append(args, start, stop)
+	}
+	if len(conds) == 0 {
+		return "1 = 0", nil, nil
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args, nil
+}
+
+func (m *modSeqMailbox) query(op, where string, uids *imap.SeqSet, args ...interface{}) (*sql.Rows, error) {
+	cond, condArgs, err := m.uidCond(uids)
+	if err != nil {
+		dbErrors.WithLabelValues(m.store.instName, op).Inc()
+		return nil, err
+	}
+	query := `SELECT msgId, modseq FROM msgmodseq WHERE mboxId = ? AND ` + where + ` AND ` + cond + ` ORDER BY msgId`
+	queryArgs := append([]interface{}{m.id}, args...)
+	rows, err := m.store.Back.DB.Query(m.store.rebind(query), append(queryArgs, condArgs...)...)
+	if err != nil {
+		dbErrors.WithLabelValues(m.store.instName, op).Inc()
+	}
+	return rows, err
+}
+
+func (m *modSeqMailbox) ModSeqs(uids *imap.SeqSet) (map[uint32]uint64, error) {
+	rows, err := m.query("modseq", "expunged = 0", uids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[uint32]uint64)
+	for rows.Next() {
+		var (
+			uid    uint32
+			modSeq uint64
+		)
+		if err := rows.Scan(&uid, &modSeq); err != nil {
+			return nil, err
+		}
+		res[uid] = modSeq
+	}
+	return res, rows.Err()
+}
+
+func (m *modSeqMailbox) scanUIDs(rows *sql.Rows) ([]uint32, error) {
+	defer rows.Close()
+
+	var res []uint32
+	for rows.Next() {
+		var (
+			uid    uint32
+			modSeq uint64
+		)
+		if err := rows.Scan(&uid, &modSeq); err != nil {
+			return nil, err
+		}
+		res = append(res, uid)
+	}
+	return res, rows.Err()
+}
+
+func (m *modSeqMailbox) Changed(uids *imap.SeqSet, since uint64) ([]uint32, error) {
+	rows, err := m.query("modseq", "expunged = 0 AND modseq > ?", uids, clampModSeq(since))
+	if err != nil {
+		return nil, err
+	}
+	return m.scanUIDs(rows)
+}
+
+func (m *modSeqMailbox) Vanished(uids *imap.SeqSet, since uint64) ([]uint32, error) {
+	rows, err := m.query("modseq", "expunged = 1 AND modseq > ?", uids, clampModSeq(since))
+	if err != nil {
+		return nil, err
+	}
+	return m.scanUIDs(rows)
+}
+
+func (m *modSeqMailbox) UIDs(after uint32, limit int) ([]uint32, error) {
+	rows, err := m.store.Back.DB.Query(m.store.rebind(`
+		SELECT msgId, modseq FROM msgmodseq
+		WHERE mboxId = ? AND msgId > ? AND expunged = 0
+		ORDER BY msgId
+		LIMIT `+strconv.Itoa(limit)), m.id, after)
+	if err != nil {
+		dbErrors.WithLabelValues(m.store.instName, "modseq").Inc()
+		return nil, err
+	}
+	return m.scanUIDs(rows)
+}
+
+// clampModSeq keeps client-provided values within the BIGINT range.
+func clampModSeq(val uint64) int64 {
+	if val > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(val)
+}
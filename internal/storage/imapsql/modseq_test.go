@@ -0,0 +1,258 @@
+//go:build !nosqlite3 && cgo
+// +build !nosqlite3,cgo
+
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	backendtests "github.com/foxcpp/go-imap-backend-tests"
+	imapsql "github.com/foxcpp/go-imap-sql"
+	"github.com/sirrchat/SirrMesh/internal/imapext"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+)
+
+func newModSeqStorage(t *testing.T) *Storage {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "messages"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	b, err := imapsql.New("sqlite3", filepath.Join(dir, "imapsql.db"),
+		&imapsql.FSStore{Root: filepath.Join(dir, "messages")}, imapsql.Opts{
+			PRNG: rand.New(rand.NewSource(0)),
+			Log:  testutils.Logger(t, "imapsql"),
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &Storage{Back: b, driver: "sqlite3", Log: testutils.Logger(t, "imapsql")}
+	if err := store.initModSeq(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// TestModSeqBackendTests checks that the modseq triggers do not break any
+// go-imap-sql operation.
+func TestModSeqBackendTests(t *testing.T) {
+	backendtests.RunTests(t, func() backendtests.Backend {
+		return newModSeqStorage(t).Back
+	}, func(b backendtests.Backend) {
+		if err := b.(*imapsql.Backend).Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestModSeq_SchemaVersion(t *testing.T) {
+	store := newModSeqStorage(t)
+	defer store.Back.Close()
+
+	var version, upstream int
+	if err := store.Back.DB.QueryRow(`SELECT version, upstream FROM modseq_schema`).Scan(&version, &upstream); err != nil {
+		t.Fatal(err)
+	}
+	if version != modSeqSchemaVersion || upstream != modSeqUpstreamSchema {
+		t.Fatalf("wrong schema version recorded: %d %d", version, upstream)
+	}
+
+	// Initialization is repeated on each start.
+	if err := store.initModSeq(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Back.DB.Exec(`UPDATE schema_version SET version = ?`, modSeqUpstreamSchema+1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.initModSeq(); err == nil {
+		t.Fatal("installed triggers are used with an unknown imapsql schema")
+	}
+
+	if _, err := store.Back.DB.Exec(`DELETE FROM modseq_schema`); err != nil {
+		t.Fatal(err)
+	}
+	store.modSeq = false
+	if err := store.initModSeq(); err != nil {
+		t.Fatal(err)
+	}
+	if store.modSeq {
+		t.Fatal("modification sequences are enabled for an unknown imapsql schema")
+	}
+}
+
+func TestModSeq(t *testing.T) {
+	store := newModSeqStorage(t)
+	defer store.Back.Close()
+
+	if err := store.Back.CreateUser("test"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := store.Back.GetUser("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms, err := store.ModSeqMailbox(u, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	highest := func() uint64 {
+		t.Helper()
+		val, err := ms.HighestModSeq()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return val
+	}
+	all := &imap.SeqSet{}
+	all.AddRange(1, 0)
+
+	initial := highest()
+	for i := 0; i < 3; i++ {
+		if err := u.CreateMessage("INBOX", nil, time.Now(), bytes.NewBufferString(testMsg), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	afterAppend := highest()
+	if afterAppend <= initial {
+		t.Fatalf("HIGHESTMODSEQ not increased by append: %d -> %d", initial, afterAppend)
+	}
+	uids, err := ms.UIDs(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(uids, []uint32{1, 2, 3}) {
+		t.Fatalf("unexpected UIDs: %v", uids)
+	}
+
+	_, mbox, err := u.GetMailbox("INBOX", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mbox.Close()
+
+	// Flag change.
+	set := &imap.SeqSet{}
+	set.AddNum(2)
+	if err := mbox.UpdateMessagesFlags(true, set, imap.AddFlags, true, []string{imap.SeenFlag}); err != nil {
+		t.Fatal(err)
+	}
+	afterFlags := highest()
+	if afterFlags <= afterAppend {
+		t.Fatalf("HIGHESTMODSEQ not increased by flag change: %d -> %d", afterAppend, afterFlags)
+	}
+	changed, err := ms.Changed(all, afterAppend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changed, []uint32{2}) {
+		t.Fatalf("unexpected changed UIDs: %v", changed)
+	}
+	modSeqs, err := ms.ModSeqs(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(modSeqs) != 3 || modSeqs[2] != afterFlags {
+		t.Fatalf("unexpected modseqs: %v (highest %d)", modSeqs, afterFlags)
+	}
+
+	// Setting the same flag again is not a change.
+	if err := mbox.UpdateMessagesFlags(true, set, imap.AddFlags, true, []string{imap.SeenFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if val := highest(); val != afterFlags {
+		t.Fatalf("HIGHESTMODSEQ changed by no-op STORE: %d -> %d", afterFlags, val)
+	}
+
+	// Expunge.
+	set = &imap.SeqSet{}
+	set.AddNum(1)
+	if err := mbox.UpdateMessagesFlags(true, set, imap.AddFlags, true, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	beforeExpunge := highest()
+	if err := mbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+	if val := highest(); val <= beforeExpunge {
+		t.Fatalf("HIGHESTMODSEQ not increased by expunge: %d -> %d", beforeExpunge, val)
+	}
+
+	vanished, err := ms.Vanished(all, beforeExpunge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(vanished, []uint32{1}) {
+		t.Fatalf("unexpected vanished UIDs: %v", vanished)
+	}
+	vanished, err = ms.Vanished(all, highest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vanished) != 0 {
+		t.Fatalf("unexpected vanished UIDs after HIGHESTMODSEQ: %v", vanished)
+	}
+	changed, err = ms.Changed(all, afterAppend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changed, []uint32{2}) {
+		t.Fatalf("unexpected changed UIDs after expunge: %v", changed)
+	}
+	uids, err = ms.UIDs(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(uids, []uint32{2, 3}) {
+		t.Fatalf("unexpected UIDs after expunge: %v", uids)
+	}
+
+	// Mailbox deletion removes the records.
+	if err := u.CreateMailbox("Other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ModSeqMailbox(u, "Other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.DeleteMailbox("Other"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ModSeqMailbox(u, "Other"); err != backend.ErrNoSuchMailbox {
+		t.Fatalf("expected ErrNoSuchMailbox, got %v", err)
+	}
+}
+
+const testMsg = "From: <sender@example.org>\r\n" +
+	"To: <test@example.org>\r\n" +
+	"Subject: Test\r\n" +
+	"\r\n" +
+	"Hello!\r\n"
+
+var _ imapext.ModSeqBackend = &Storage{}
@@ -0,0 +1,162 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/emersion/go-imap/backend"
+	mess "github.com/foxcpp/go-imap-mess"
+	"github.com/sirrchat/SirrMesh/internal/imapext"
+	"github.com/sirrchat/SirrMesh/internal/updatepipe"
+)
+
+// subRefs counts broker subscriptions of the update pipe so mailboxes
+// watched for NOTIFY and mailboxes selected in local sessions share them.
+type subRefs struct {
+	pipe *updatepipe.PubSubPipe
+
+	mu     sync.Mutex
+	counts map[interface{}]int
+}
+
+func (s *subRefs) subscribe(key interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts[key]++
+	if s.counts[key] == 1 {
+		s.pipe.Subscribe(key)
+	}
+}
+
+func (s *subRefs) unsubscribe(key interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts[key] == 0 {
+		return
+	}
+	s.counts[key]--
+	if s.counts[key] == 0 {
+		delete(s.counts, key)
+		s.pipe.Unsubscribe(key)
+	}
+}
+
+type mboxWatch struct {
+	name string
+	fn   func(mbox string, ev imapext.Event)
+}
+
+// notifyHub dispatches updates passing through the update pipe to the
+// sessions that requested notifications using NOTIFY.
+type notifyHub struct {
+	subs *subRefs
+
+	mu       sync.Mutex
+	watchers map[uint64]map[*mboxWatch]struct{}
+}
+
+func (h *notifyHub) dispatch(upd mess.Update) {
+	key, ok := upd.Key.(uint64)
+	if !ok {
+		return
+	}
+
+	var ev imapext.Event
+	switch upd.Type {
+	case mess.UpdNewMessage:
+		ev = imapext.MessageNew
+	case mess.UpdRemoved:
+		ev = imapext.MessageExpunge
+	case mess.UpdFlags:
+		ev = imapext.FlagChange
+	default:
+		return
+	}
+
+	h.mu.Lock()
+	watches := make([]*mboxWatch, 0, len(h.watchers[key]))
+	for w := range h.watchers[key] {
+		watches = append(watches, w)
+	}
+	h.mu.Unlock()
+
+	for _, w := range watches {
+		w.fn(w.name, ev)
+	}
+}
+
+func (h *notifyHub) watch(key uint64, w *mboxWatch) {
+	h.mu.Lock()
+	if h.watchers[key] == nil {
+		h.watchers[key] = make(map[*mboxWatch]struct{})
+	}
+	h.watchers[key][w] = struct{}{}
+	h.mu.Unlock()
+
+	if h.subs != nil {
+		h.subs.subscribe(key)
+	}
+}
+
+func (h *notifyHub) unwatch(key uint64, w *mboxWatch) {
+	h.mu.Lock()
+	delete(h.watchers[key], w)
+	if len(h.watchers[key]) == 0 {
+		delete(h.watchers, key)
+	}
+	h.mu.Unlock()
+
+	if h.subs != nil {
+		h.subs.unsubscribe(key)
+	}
+}
+
+// WatchMailboxes implements imapext.NotifyBackend.
+func (store *Storage) WatchMailboxes(u backend.User, mboxes []string, fn func(mbox string, ev imapext.Event)) (func(), error) {
+	if store.notify == nil {
+		return nil, errors.New("imapsql: notifications require the update pipe")
+	}
+
+	type watched struct {
+		key uint64
+		w   *mboxWatch
+	}
+	all := make([]watched, 0, len(mboxes))
+	cancel := func() {
+		for _, w := range all {
+			store.notify.unwatch(w.key, w.w)
+		}
+	}
+	for _, name := range mboxes {
+		id, err := store.mboxID(u, name)
+		if err != nil {
+			if errors.Is(err, backend.ErrNoSuchMailbox) {
+				continue
+			}
+			cancel()
+			return nil, err
+		}
+		w := &mboxWatch{name: name, fn: fn}
+		store.notify.watch(id, w)
+		all = append(all, watched{key: id, w: w})
+	}
+	return cancel, nil
+}
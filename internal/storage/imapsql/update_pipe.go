@@ -0,0 +1,143 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package imapsql
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirrchat/SirrMesh/framework/config"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/internal/updatepipe"
+	"github.com/sirrchat/SirrMesh/internal/updatepipe/pubsub"
+)
+
+// updPipeConfig is the value of the update_pipe directive.
+type updPipeConfig struct {
+	// Backend is one of auto, off, unix, postgres or redis.
+	Backend string
+	// Args are backend-specific: socket path for unix, DSN for postgres,
+	// URL and channel prefix for redis.
+	Args []string
+}
+
+func updatePipeDirective(_ *config.Map, node config.Node) (interface{}, error) {
+	if len(node.Args) == 0 {
+		return nil, config.NodeErr(node, "at least one argument required")
+	}
+	cfg := updPipeConfig{Backend: node.Args[0], Args: node.Args[1:]}
+	switch cfg.Backend {
+	case "auto", "off":
+		if len(cfg.Args) != 0 {
+			return nil, config.NodeErr(node, "no additional arguments for '%s'", cfg.Backend)
+		}
+	case "unix":
+		if len(cfg.Args) > 1 {
+			return nil, config.NodeErr(node, "too many arguments for 'unix'")
+		}
+	case "postgres":
+	case "redis":
+		if len(cfg.Args) == 0 || len(cfg.Args) > 2 {
+			return nil, config.NodeErr(node, "'redis' requires the server URL and an optional channel prefix")
+		}
+	default:
+		return nil, config.NodeErr(node, "unknown update pipe backend: %s", cfg.Backend)
+	}
+	return cfg, nil
+}
+
+// backend returns the update pipe backend to use with the storage driver.
+func (cfg updPipeConfig) backend(driver string) (string, error) {
+	if cfg.Backend != "auto" && cfg.Backend != "" {
+		return cfg.Backend, nil
+	}
+	switch driver {
+	case "sqlite3", "sqlite":
+		return "unix", nil
+	case "postgres":
+		return "postgres", nil
+	default:
+		return "", errors.New("imapsql: driver does not have an update pipe implementation, set update_pipe explicitly")
+	}
+}
+
+// newUpdatePipe creates the update pipe for the backend selected by the
+// update_pipe directive.
+func (store *Storage) newUpdatePipe(backend string) (updatepipe.P, error) {
+	pipeLog := log.Logger{Name: "storage.imapsql/updpipe", Debug: store.Log.Debug, Level: store.Log.Level}
+	brokerLog := log.Logger{Name: "storage.imapsql/updpipe/pubsub", Debug: store.Log.Debug, Level: store.Log.Level}
+	args := store.updPipeCfg.Args
+
+	switch backend {
+	case "unix":
+		var sockPath string
+		switch {
+		case len(args) != 0 && filepath.IsAbs(args[0]):
+			sockPath = args[0]
+		case len(args) != 0:
+			sockPath = filepath.Join(config.RuntimeDirectory, args[0])
+		default:
+			dbId := sha1.Sum([]byte(strings.Join(store.dsn, " ")))
+			sockPath = filepath.Join(
+				config.RuntimeDirectory,
+				fmt.Sprintf("sql-%s.sock", hex.EncodeToString(dbId[:])))
+		}
+		store.Log.DebugMsg("using unix socket for external updates", "path", sockPath)
+		return &updatepipe.UnixSockPipe{
+			SockPath: sockPath,
+			Log:      pipeLog,
+			Module:   store.instName,
+		}, nil
+	case "postgres":
+		dsn := args
+		if len(dsn) == 0 {
+			if store.driver != "postgres" {
+				return nil, errors.New("imapsql: update_pipe postgres requires the DSN if driver is not postgres")
+			}
+			dsn = store.dsn
+		}
+		store.Log.DebugMsg("using PostgreSQL broker for external updates")
+		pipe := &updatepipe.PubSubPipe{Log: pipeLog, Module: store.instName, Backend: "postgres"}
+		ps, err := pubsub.NewPQ(strings.Join(dsn, " "), brokerLog, pipe.SetConnected)
+		if err != nil {
+			return nil, err
+		}
+		pipe.PubSub = ps
+		return pipe, nil
+	case "redis":
+		prefix := ""
+		if len(args) == 2 {
+			prefix = args[1]
+		}
+		store.Log.DebugMsg("using Redis broker for external updates")
+		pipe := &updatepipe.PubSubPipe{Log: pipeLog, Module: store.instName, Backend: "redis"}
+		ps, err := pubsub.NewRedis(args[0], prefix, brokerLog, pipe.SetConnected)
+		if err != nil {
+			return nil, err
+		}
+		pipe.PubSub = ps
+		return pipe, nil
+	default:
+		return nil, fmt.Errorf("imapsql: unknown update pipe backend: %s", backend)
+	}
+}
@@ -80,7 +80,7 @@ func (f *File) InstanceName() string {
 
 func (f *File) Init(cfg *config.Map) error {
 	var file string
-	cfg.Bool("debug", true, false, &f.log.Debug)
+	cfg.Logger(true, false, &f.log)
 	cfg.String("file", false, false, "", &file)
 	if _, err := cfg.Process(); err != nil {
 		return err
@@ -89,6 +89,10 @@ func (s *SQL) Init(cfg *config.Map) error {
 		return config.NodeErr(cfg.Block, "PostgreSQL driver does not support named_args")
 	}
 
+	if module.DryRun {
+		return nil
+	}
+
 	db, err := sql.Open(driver, strings.Join(dsnParts, " "))
 	if err != nil {
 		return config.NodeErr(cfg.Block, "failed to open db: %v", err)
@@ -134,6 +138,9 @@ func (s *SQL) Init(cfg *config.Map) error {
 }
 
 func (s *SQL) Close() error {
+	if s.db == nil {
+		return nil
+	}
 	s.lookup.Close()
 	return s.db.Close()
 }
@@ -82,9 +82,13 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/exterrors"
 	"github.com/sirrchat/SirrMesh/framework/log"
 	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/framework/tracing"
 	"github.com/sirrchat/SirrMesh/internal/dsn"
 	"github.com/sirrchat/SirrMesh/internal/msgpipeline"
+	"github.com/sirrchat/SirrMesh/internal/msgtrack"
 	"github.com/sirrchat/SirrMesh/internal/target"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 // partialError describes state of partially successful message delivery.
@@ -153,6 +157,14 @@ type Queue struct {
 	// Buffered channel used to restrict count of deliveries attempted
 	// in parallel.
 	deliverySemaphore chan struct{}
+
+	// IDs of messages queued by this process before the saved queue entries
+	// are loaded, nil once they are loaded. On restart, the entries are
+	// loaded only after the previous process exited so that messages are not
+	// delivered by both processes.
+	ownLck  sync.Mutex
+	own     map[string]struct{}
+	closing chan struct{}
 }
 
 type QueueMetadata struct {
@@ -176,6 +188,10 @@ type QueueMetadata struct {
 
 	FirstAttempt time.Time
 	LastAttempt  time.Time
+
+	// W3C traceparent of the span the message was queued in. Delivery
+	// attempt spans are linked to it.
+	TraceParent string `json:",omitempty"`
 }
 
 type queueSlot struct {
@@ -209,7 +225,7 @@ func NewQueue(_, instName string, _, inlineArgs []string) (module.Module, error)
 
 func (q *Queue) Init(cfg *config.Map) error {
 	var maxParallelism int
-	cfg.Bool("debug", true, false, &q.Log.Debug)
+	cfg.Logger(true, false, &q.Log)
 	cfg.Int("max_tries", false, false, 20, &q.maxTries)
 	cfg.Int("max_parallelism", false, false, 16, &maxParallelism)
 	cfg.String("location", false, false, q.location, &q.location)
@@ -229,7 +245,7 @@ func (q *Queue) Init(cfg *config.Map) error {
 		}
 
 		q.dsnPipeline.(*msgpipeline.MsgPipeline).Hostname = q.hostname
-		q.dsnPipeline.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: "queue/pipeline", Debug: q.Log.Debug}
+		q.dsnPipeline.(*msgpipeline.MsgPipeline).Log = log.Logger{Name: "queue/pipeline", Debug: q.Log.Debug, Level: q.Log.Level}
 	}
 	if q.location == "" && q.name == "" {
 		return errors.New("queue: need explicit location directive or inline argument if defined inline")
@@ -238,6 +254,10 @@ func (q *Queue) Init(cfg *config.Map) error {
 		q.location = filepath.Join(config.StateDirectory, q.name)
 	}
 
+	if module.DryRun {
+		return nil
+	}
+
 	// TODO: Check location write permissions.
 	if err := os.MkdirAll(q.location, os.ModePerm); err != nil {
 		return err
@@ -249,8 +269,12 @@ func (q *Queue) Init(cfg *config.Map) error {
 func (q *Queue) start(maxParallelism int) error {
 	q.wheel = NewTimeWheel(q.dispatch)
 	q.deliverySemaphore = make(chan struct{}, maxParallelism)
+	q.closing = make(chan struct{})
 
-	if err := q.readDiskQueue(); err != nil {
+	if module.HandoverPending() {
+		q.own = make(map[string]struct{})
+		go q.loadAfterHandover()
+	} else if err := q.readDiskQueue(); err != nil {
 		return err
 	}
 
@@ -259,7 +283,40 @@ func (q *Queue) start(maxParallelism int) error {
 	return nil
 }
 
+// loadAfterHandover reads the saved queue entries once the previous server
+// process exited.
+func (q *Queue) loadAfterHandover() {
+	select {
+	case <-module.HandoverDone():
+	case <-q.closing:
+		return
+	}
+	q.Log.DebugMsg("previous process exited, loading saved queue entries")
+	if err := q.readDiskQueue(); err != nil {
+		q.Log.Error("failed to load saved queue entries", err)
+	}
+
+	q.ownLck.Lock()
+	q.own = nil
+	q.ownLck.Unlock()
+}
+
+func (q *Queue) isOwn(id string) bool {
+	q.ownLck.Lock()
+	defer q.ownLck.Unlock()
+	_, ok := q.own[id]
+	return ok
+}
+
 func (q *Queue) Close() error {
+	if q.wheel == nil {
+		return nil
+	}
+	select {
+	case <-q.closing:
+	default:
+		close(q.closing)
+	}
 	q.wheel.Close()
 	q.deliveryWg.Wait()
 
@@ -394,6 +451,7 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 		rcptErr, ok := partialErr.Errs[rcpt]
 		if !ok {
 			dl.Msg("delivered", "rcpt", rcpt, "attempt", meta.TriesCount[rcpt]+1)
+			q.track(meta, msgtrack.KindDelivered, rcpt, nil)
 			continue
 		}
 
@@ -403,11 +461,13 @@ func (q *Queue) tryDelivery(meta *QueueMetadata, header textproto.Header, body b
 
 		temporary := exterrors.IsTemporaryOrUnspec(rcptErr)
 		if !temporary || meta.TriesCount[rcpt]+1 >= q.maxTries {
+			q.track(meta, msgtrack.KindFailed, rcpt, rcptErr)
 			delete(meta.TriesCount, rcpt)
 			dl.Msg("not delivered, permanent error", "rcpt", rcpt)
 			failedRcpts = append(failedRcpts, rcpt)
 			continue
 		}
+		q.track(meta, msgtrack.KindDeferred, rcpt, rcptErr)
 
 		// Temporary error, increase tries counter and requeue.
 		meta.TriesCount[rcpt]++
@@ -469,7 +529,32 @@ func (q *Queue) deliver(meta *QueueMetadata, header textproto.Header, body buffe
 	msgMeta.ID = msgMeta.ID + "-" + strconv.FormatInt(time.Now().Unix(), 16)
 	dl.Debugf("using message ID = %s", msgMeta.ID)
 
-	msgCtx, msgTask := trace.NewTask(context.Background(), "Queue delivery")
+	attempt := 0
+	for _, rcpt := range meta.To {
+		if meta.TriesCount[rcpt] > attempt {
+			attempt = meta.TriesCount[rcpt]
+		}
+	}
+	spanCtx, span := tracing.StartRoot(tracing.WithMsgID(context.Background(), meta.MsgMeta.ID),
+		"queue attempt", tracing.Extract(meta.TraceParent),
+		attribute.String("sirrmesh.queue", q.name),
+		attribute.Int("sirrmesh.queue.attempt", attempt+1),
+		attribute.Int("sirrmesh.queue.rcpts", len(meta.To)))
+	defer func() {
+		failed := 0
+		for _, err := range perr.Errs {
+			if err != nil {
+				failed++
+			}
+		}
+		span.SetAttributes(attribute.Int("sirrmesh.queue.failed_rcpts", failed))
+		if failed != 0 {
+			span.SetStatus(codes.Error, "delivery failed for some recipients")
+		}
+		span.End()
+	}()
+
+	msgCtx, msgTask := trace.NewTask(spanCtx, "Queue delivery")
 	defer msgTask.End()
 
 	mailCtx, mailTask := trace.NewTask(msgCtx, "MAIL FROM")
@@ -594,6 +679,10 @@ func (qd *queueDelivery) Commit(ctx context.Context) error {
 		panic("queue: double Commit")
 	}
 
+	// Record before handing meta over to the delivery goroutine.
+	for _, rcpt := range qd.meta.To {
+		qd.q.track(qd.meta, msgtrack.KindQueued, rcpt, nil)
+	}
 	qd.q.wheel.Add(time.Time{}, queueSlot{
 		ID:   qd.meta.MsgMeta.ID,
 		Meta: qd.meta,
@@ -612,10 +701,36 @@ func (q *Queue) Start(ctx context.Context, msgMeta *module.MsgMetadata, mailFrom
 		RcptErrs:     map[string]*smtp.SMTPError{},
 		FirstAttempt: time.Now(),
 		LastAttempt:  time.Now(),
+		TraceParent:  tracing.Inject(ctx),
 	}
 	return &queueDelivery{q: q, meta: meta}, nil
 }
 
+// TracksDelivery implements msgtrack.SelfTracking. Queue records the
+// outcome of each delivery attempt instead of the acceptance by the queue.
+func (q *Queue) TracksDelivery() {}
+
+// track records the message tracking event for the recipient. The attempt
+// number is added to the details of delivery outcomes.
+func (q *Queue) track(meta *QueueMetadata, kind msgtrack.Kind, rcpt string, err error) {
+	ev := msgtrack.Event{
+		MsgID:  meta.MsgMeta.ID,
+		Kind:   kind,
+		Module: q.name,
+		Sender: meta.From,
+		Rcpt:   rcpt,
+	}
+	switch {
+	case kind == msgtrack.KindQueued:
+	case err != nil:
+		ev = ev.WithError(err)
+		ev.Detail = fmt.Sprintf("attempt %d: %s", meta.TriesCount[rcpt]+1, ev.Detail)
+	default:
+		ev.Detail = fmt.Sprintf("attempt %d", meta.TriesCount[rcpt]+1)
+	}
+	msgtrack.Record(ev)
+}
+
 func (q *Queue) removeFromDisk(msgMeta *module.MsgMetadata) {
 	id := msgMeta.ID
 	dl := target.DeliveryLogger(q.Log, msgMeta)
@@ -654,6 +769,10 @@ func (q *Queue) readDiskQueue() error {
 			continue
 		}
 		id := entry.Name()[:len(entry.Name())-5]
+		if q.isOwn(id) {
+			// Already scheduled by this process.
+			continue
+		}
 
 		meta, err := q.readMessageMeta(id)
 		if err != nil {
@@ -685,16 +804,7 @@ func (q *Queue) readDiskQueue() error {
 			continue
 		}
 
-		smallestTriesCount := 999999
-		for _, count := range meta.TriesCount {
-			if smallestTriesCount > count {
-				smallestTriesCount = count
-			}
-		}
-		nextTryTime := meta.LastAttempt
-		scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
-		nextTryTime = nextTryTime.Add(q.initialRetryTime * scaleFactor)
-
+		nextTryTime := q.nextTryTime(meta)
 		if time.Until(nextTryTime) < q.postInitDelay {
 			nextTryTime = time.Now().Add(q.postInitDelay)
 		}
@@ -716,6 +826,12 @@ func (q *Queue) readDiskQueue() error {
 func (q *Queue) storeNewMessage(meta *QueueMetadata, header textproto.Header, body buffer.Buffer) (buffer.Buffer, error) {
 	id := meta.MsgMeta.ID
 
+	q.ownLck.Lock()
+	if q.own != nil {
+		q.own[id] = struct{}{}
+	}
+	q.ownLck.Unlock()
+
 	headerPath := filepath.Join(q.location, id+".header")
 	headerFile, err := os.Create(headerPath)
 	if err != nil {
@@ -506,6 +506,111 @@ func TestQueueDelivery_SerializationRoundtrip(t *testing.T) {
 	checkQueueDir(t, q, []string{})
 }
 
+func TestQueueDelivery_Handover(t *testing.T) {
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true)},
+		},
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	q.initialRetryTime = time.Hour
+	// Sub-tests are used to get different message IDs.
+	t.Run("saved", func(t *testing.T) {
+		testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+	})
+	msg := readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester2@example.org"}, "")
+	q.Close()
+
+	// The new process is started while the previous one is running.
+	module.BeginHandover()
+	defer module.EndHandover()
+	q = newTestQueueDir(t, &dt, q.location)
+	defer cleanQueue(t, q)
+
+	t.Run("own", func(t *testing.T) {
+		testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester3@example.org"})
+	})
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester3@example.org"}, "")
+
+	// Saved entries are not loaded until the previous process exits...
+	select {
+	case msg := <-dt.committed:
+		t.Fatal("Unexpected delivery:", msg.RcptTo)
+	case <-time.After(100 * time.Millisecond):
+	}
+	module.EndHandover()
+
+	msg = readMsgChanTimeout(t, dt.committed, 5*time.Second)
+	testutils.CheckMsgID(t, msg, "tester@example.com", []string{"tester1@example.org"}, "")
+
+	// ... and the message queued by this process is not scheduled twice.
+	select {
+	case msg := <-dt.committed:
+		t.Fatal("Unexpected delivery:", msg.RcptTo)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestQueueEntries(t *testing.T) {
+	t.Parallel()
+
+	dt := unreliableTarget{
+		rcptFailures: []map[string]error{
+			{
+				"tester1@example.org": exterrors.WithTemporary(errors.New("go away"), true),
+			},
+		},
+		committed: make(chan testutils.Msg, 10),
+	}
+	q := newTestQueue(t, &dt)
+	defer cleanQueue(t, q)
+
+	// Keep the message in the queue until the test ends.
+	q.initialRetryTime = time.Hour
+
+	deliveryID := testutils.DoTestDelivery(t, q, "tester@example.com", []string{"tester1@example.org", "tester2@example.org"})
+	readMsgChanTimeout(t, dt.committed, 5*time.Second)
+
+	// The meta-data is updated after the target commits, wait for it.
+	var (
+		entries []Entry
+		err     error
+	)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		entries, err = q.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 1 && len(entries[0].To) == 1 {
+			break
+		}
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.ID != deliveryID {
+		t.Errorf("wrong ID: %s", entry.ID)
+	}
+	if entry.From != "tester@example.com" {
+		t.Errorf("wrong From: %s", entry.From)
+	}
+	if len(entry.To) != 1 || entry.To[0] != "tester1@example.org" {
+		t.Errorf("wrong To: %v", entry.To)
+	}
+	if entry.Errors["tester1@example.org"] == "" {
+		t.Errorf("missing recipient error: %v", entry.Errors)
+	}
+	if !entry.NextAttempt.After(entry.LastAttempt) {
+		t.Errorf("next attempt %v is not after last attempt %v", entry.NextAttempt, entry.LastAttempt)
+	}
+
+	q.Close()
+}
+
 func TestQueueDelivery_DeserlizationCleanUp(t *testing.T) {
 	t.Parallel()
 
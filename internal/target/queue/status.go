@@ -0,0 +1,104 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package queue
+
+import (
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Entry describes a message waiting in the queue.
+type Entry struct {
+	ID   string   `json:"id"`
+	From string   `json:"from"`
+	To   []string `json:"to"`
+
+	FailedRcpts []string          `json:"failed_rcpts,omitempty"`
+	Errors      map[string]string `json:"errors,omitempty"`
+	TriesCount  map[string]int    `json:"tries_count,omitempty"`
+
+	FirstAttempt time.Time `json:"first_attempt"`
+	LastAttempt  time.Time `json:"last_attempt"`
+	NextAttempt  time.Time `json:"next_attempt"`
+}
+
+// nextTryTime returns the time of the next delivery attempt using the
+// smallest tries count among the recipients:
+// LastAttempt + initialRetryTime * retryTimeScale ^ (TriesCount - 1)
+func (q *Queue) nextTryTime(meta *QueueMetadata) time.Time {
+	smallestTriesCount := 999999
+	for _, count := range meta.TriesCount {
+		if smallestTriesCount > count {
+			smallestTriesCount = count
+		}
+	}
+	scaleFactor := time.Duration(math.Pow(q.retryTimeScale, float64(smallestTriesCount-1)))
+	return meta.LastAttempt.Add(q.initialRetryTime * scaleFactor)
+}
+
+// Entries returns the messages currently stored in the queue directory,
+// ordered by the first delivery attempt.
+//
+// Messages with unreadable meta-data are skipped.
+func (q *Queue) Entries() ([]Entry, error) {
+	dirInfo, err := os.ReadDir(q.location)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(dirInfo)/3)
+	for _, dirEntry := range dirInfo {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), ".meta") {
+			continue
+		}
+		id := strings.TrimSuffix(dirEntry.Name(), ".meta")
+
+		meta, err := q.readMessageMeta(id)
+		if err != nil {
+			q.Log.Debugf("failed to read meta-data: %v (msg ID = %s)", err, id)
+			continue
+		}
+
+		entry := Entry{
+			ID:           id,
+			From:         meta.From,
+			To:           meta.To,
+			FailedRcpts:  meta.FailedRcpts,
+			TriesCount:   meta.TriesCount,
+			FirstAttempt: meta.FirstAttempt,
+			LastAttempt:  meta.LastAttempt,
+			NextAttempt:  q.nextTryTime(meta),
+		}
+		if len(meta.RcptErrs) != 0 {
+			entry.Errors = make(map[string]string, len(meta.RcptErrs))
+			for rcpt, err := range meta.RcptErrs {
+				entry.Errors[rcpt] = err.Error()
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].FirstAttempt.Before(entries[j].FirstAttempt)
+	})
+	return entries, nil
+}
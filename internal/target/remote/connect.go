@@ -161,6 +161,7 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 	for _, p := range rd.policies {
 		policyLevel, err := p.CheckMX(connCtx, mxLevel, conn.domain, record.Host, conn.dnssecOk)
 		if err != nil {
+			rd.reportTLS(connCtx, conn, record.Host, module.TLSNone, nil, nil)
 			return err
 		}
 		if policyLevel > mxLevel {
@@ -184,6 +185,7 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 	for _, p := range rd.policies {
 		policyLevel, err := p.CheckConn(connCtx, mxLevel, tlsLevel, conn.domain, record.Host, tlsState)
 		if err != nil {
+			rd.reportTLS(connCtx, conn, record.Host, tlsLevel, &tlsState, tlsErr)
 			conn.Close()
 			return exterrors.WithFields(err, map[string]interface{}{"tls_err": tlsErr})
 		}
@@ -191,6 +193,7 @@ func (rd *remoteDelivery) attemptMX(ctx context.Context, conn *mxConn, record *n
 			tlsLevel = policyLevel
 		}
 	}
+	rd.reportTLS(connCtx, conn, record.Host, tlsLevel, &tlsState, tlsErr)
 
 	conn.mxLevel = mxLevel
 	conn.tlsLevel = tlsLevel
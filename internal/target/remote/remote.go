@@ -48,6 +48,7 @@ import (
 	"github.com/sirrchat/SirrMesh/internal/limits"
 	"github.com/sirrchat/SirrMesh/internal/smtpconn/pool"
 	"github.com/sirrchat/SirrMesh/internal/target"
+	"github.com/sirrchat/SirrMesh/internal/tlsrpt"
 	"golang.org/x/net/idna"
 )
 
@@ -74,6 +75,7 @@ type Target struct {
 	limits            *limits.Group
 	allowSecOverride  bool
 	relaxedREQUIRETLS bool
+	tlsReports        *tlsrpt.Reporter
 
 	pool           *pool.P
 	connReuseLimit int
@@ -113,7 +115,7 @@ func (rt *Target) Init(cfg *config.Map) error {
 	cfg.String("hostname", true, true, "", &rt.hostname)
 	cfg.String("local_ip", false, false, "", &rt.localIP)
 	cfg.Bool("force_ipv4", false, false, &rt.ipv4)
-	cfg.Bool("debug", true, false, &rt.Log.Debug)
+	cfg.Logger(true, false, &rt.Log)
 	cfg.Custom("tls_client", true, false, func() (interface{}, error) {
 		return &tls.Config{}, nil
 	}, tls2.TLSClientBlock, &rt.tlsConfig)
@@ -138,6 +140,13 @@ func (rt *Target) Init(cfg *config.Map) error {
 		}
 		return g, nil
 	}, &rt.limits)
+	cfg.Custom("tls_reports", false, false, nil, func(cfg *config.Map, n config.Node) (interface{}, error) {
+		var r *tlsrpt.Reporter
+		if err := modconfig.ModuleFromNode("", n.Args, n, cfg.Globals, &r); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}, &rt.tlsReports)
 	cfg.Bool("requiretls_override", false, true, &rt.allowSecOverride)
 	cfg.Bool("relaxed_requiretls", false, true, &rt.relaxedREQUIRETLS)
 	cfg.Int("conn_reuse_limit", false, false, 10, &rt.connReuseLimit)
@@ -354,6 +354,7 @@ type (
 	}
 	daneDelivery struct {
 		c       *danePolicy
+		mx      string
 		tlsaFut *future.Future
 	}
 )
@@ -385,7 +386,7 @@ func (c *danePolicy) Init(cfg *config.Map) error {
 		c.log.Error("DANE support is no-op: unable to init EDNS resolver", err)
 	}
 
-	cfg.Bool("debug", true, log.DefaultLogger.Debug, &c.log.Debug)
+	cfg.Logger(true, log.DefaultLogger.Debug, &c.log)
 	cfg.String("smtp_port", false, false, "25", &c.smtpPort)
 
 	_, err = cfg.Process()
@@ -477,6 +478,7 @@ func (c *daneDelivery) PrepareConn(ctx context.Context, mx string) {
 		return
 	}
 
+	c.mx = mx
 	c.tlsaFut = future.New()
 
 	go func() {
@@ -0,0 +1,190 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/foxcpp/go-mtasts"
+	"github.com/sirrchat/SirrMesh/framework/dns"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/tlsrpt"
+)
+
+// tlsReportPolicy is implemented by MX authentication policies that are
+// described in TLS reports (RFC 8460).
+type tlsReportPolicy interface {
+	// tlsReport returns the policy that applies to the session and the
+	// failure result type (empty for successful sessions). ok is false if
+	// the domain has no such policy.
+	//
+	// tlsState is nil if the connection was not established.
+	tlsReport(ctx context.Context, domain, mx string, tlsState *tls.ConnectionState, tlsErr error) (policy tlsrpt.Policy, resultType string, ok bool)
+}
+
+func (c *mtastsDelivery) tlsReport(ctx context.Context, domain, mx string, tlsState *tls.ConnectionState, tlsErr error) (tlsrpt.Policy, string, bool) {
+	if c.policyFut == nil {
+		return tlsrpt.Policy{}, "", false
+	}
+	policyI, err := c.policyFut.GetContext(ctx)
+	if err != nil {
+		if mtasts.IsNoPolicy(err) || errors.Is(err, context.Canceled) {
+			return tlsrpt.Policy{}, "", false
+		}
+		resultType := tlsrpt.ResultSTSPolicyFetchError
+		var malformedErr mtasts.MalformedPolicyError
+		if errors.As(err, &malformedErr) {
+			resultType = tlsrpt.ResultSTSPolicyInvalid
+		}
+		return tlsrpt.Policy{Type: tlsrpt.PolicySTS, Domain: domain}, resultType, true
+	}
+	policy := policyI.(*mtasts.Policy)
+	if policy.Mode == mtasts.ModeNone {
+		return tlsrpt.Policy{}, "", false
+	}
+
+	p := tlsrpt.Policy{
+		Type:   tlsrpt.PolicySTS,
+		String: []string{"version: STSv1", "mode: " + string(policy.Mode)},
+		Domain: domain,
+		MXHost: policy.MX,
+	}
+	for _, mx := range policy.MX {
+		p.String = append(p.String, "mx: "+mx)
+	}
+	p.String = append(p.String, "max_age: "+strconv.Itoa(policy.MaxAge))
+
+	switch {
+	case !policy.Match(mx):
+		return p, tlsrpt.ResultValidationFailure, true
+	case tlsState == nil:
+		return tlsrpt.Policy{}, "", false
+	case !tlsState.HandshakeComplete:
+		if tlsErr != nil {
+			return p, tlsrpt.ResultTypeForError(tlsErr), true
+		}
+		return p, tlsrpt.ResultSTARTTLSNotSupported, true
+	case tlsState.VerifiedChains == nil:
+		if tlsErr != nil {
+			return p, tlsrpt.ResultTypeForError(tlsErr), true
+		}
+		return p, tlsrpt.ResultSTSWebPKIInvalid, true
+	}
+	return p, "", true
+}
+
+func (c *daneDelivery) tlsReport(ctx context.Context, domain, mx string, tlsState *tls.ConnectionState, tlsErr error) (tlsrpt.Policy, string, bool) {
+	if c.c.extResolver == nil || c.tlsaFut == nil || c.mx != mx || tlsState == nil {
+		return tlsrpt.Policy{}, "", false
+	}
+
+	p := tlsrpt.Policy{
+		Type:   tlsrpt.PolicyTLSA,
+		Domain: domain,
+		MXHost: []string{mx},
+	}
+
+	recsI, err := c.tlsaFut.GetContext(ctx)
+	if err != nil {
+		if dns.IsNotFound(err) || errors.Is(err, context.Canceled) {
+			return tlsrpt.Policy{}, "", false
+		}
+		return p, tlsrpt.ResultDNSSECInvalid, true
+	}
+	recs := recsI.([]dns.TLSA)
+	if len(recs) == 0 {
+		return tlsrpt.Policy{}, "", false
+	}
+	for _, rec := range recs {
+		p.String = append(p.String, fmt.Sprintf("%d %d %d %s", rec.Usage, rec.Selector, rec.MatchingType, rec.Certificate))
+	}
+
+	if _, err := verifyDANE(recs, *tlsState); err != nil {
+		if !tlsState.HandshakeComplete && tlsErr == nil {
+			return p, tlsrpt.ResultSTARTTLSNotSupported, true
+		}
+		return p, tlsrpt.ResultValidationFailure, true
+	}
+	return p, "", true
+}
+
+// reportTLS records the session result for TLS reporting.
+//
+// If there are both DANE and MTA-STS policies for the domain, only DANE is
+// reported since it takes precedence (RFC 8461 Section 2).
+func (rd *remoteDelivery) reportTLS(ctx context.Context, conn *mxConn, mx string, tlsLevel module.TLSLevel, tlsState *tls.ConnectionState, tlsErr error) {
+	if rd.rt.tlsReports == nil {
+		return
+	}
+
+	var (
+		policy     tlsrpt.Policy
+		resultType string
+		found      bool
+	)
+	for _, p := range rd.policies {
+		rp, ok := p.(tlsReportPolicy)
+		if !ok {
+			continue
+		}
+		pol, res, ok := rp.tlsReport(ctx, conn.domain, mx, tlsState, tlsErr)
+		if !ok {
+			continue
+		}
+		if !found || pol.Type == tlsrpt.PolicyTLSA {
+			policy, resultType, found = pol, res, true
+		}
+	}
+	if !found {
+		// Failures not caused by TLS are not reported.
+		if tlsState == nil {
+			return
+		}
+		policy = tlsrpt.Policy{Type: tlsrpt.PolicyNoPolicyFound, Domain: conn.domain}
+		// Plaintext fallback after a failed handshake.
+		if tlsErr != nil && tlsLevel == module.TLSNone {
+			resultType = tlsrpt.ResultTypeForError(tlsErr)
+		}
+	}
+
+	e := tlsrpt.Entry{
+		Policy:     policy,
+		ResultType: resultType,
+		MXHost:     mx,
+	}
+	if resultType != "" {
+		if tlsErr != nil {
+			e.Reason = tlsErr.Error()
+		}
+		if tlsState != nil {
+			if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+				e.SendingIP = addr.IP.String()
+			}
+			if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				e.ReceivingIP = addr.IP.String()
+			}
+		}
+	}
+	rd.rt.tlsReports.Record(e)
+}
@@ -0,0 +1,111 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package remote
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"testing"
+
+	"github.com/foxcpp/go-mtasts"
+	"github.com/sirrchat/SirrMesh/framework/dns"
+	"github.com/sirrchat/SirrMesh/framework/future"
+	"github.com/sirrchat/SirrMesh/internal/tlsrpt"
+)
+
+func TestMTASTS_TLSReport(t *testing.T) {
+	test := func(name string, policy *mtasts.Policy, policyErr error, mx string, state *tls.ConnectionState, tlsErr error, expectOk bool, expectResult string) {
+		t.Helper()
+		fut := future.New()
+		fut.Set(policy, policyErr)
+		c := &mtastsDelivery{policyFut: fut}
+
+		p, res, ok := c.tlsReport(context.Background(), "example.invalid", mx, state, tlsErr)
+		if ok != expectOk {
+			t.Errorf("%s: ok = %v, want %v", name, ok, expectOk)
+			return
+		}
+		if !ok {
+			return
+		}
+		if p.Type != tlsrpt.PolicySTS || p.Domain != "example.invalid" {
+			t.Errorf("%s: wrong policy: %+v", name, p)
+		}
+		if res != expectResult {
+			t.Errorf("%s: result = %q, want %q", name, res, expectResult)
+		}
+	}
+
+	policy := &mtasts.Policy{
+		Mode:   mtasts.ModeTesting,
+		MaxAge: 86400,
+		MX:     []string{"mx.example.invalid"},
+	}
+	verified := &tls.ConnectionState{HandshakeComplete: true, VerifiedChains: [][]*x509.Certificate{{}}}
+
+	test("success", policy, nil, "mx.example.invalid", verified, nil, true, "")
+	test("mx mismatch", policy, nil, "mx.evil.invalid", nil, nil, true, tlsrpt.ResultValidationFailure)
+	test("no connection", policy, nil, "mx.example.invalid", nil, nil, false, "")
+	test("no starttls", policy, nil, "mx.example.invalid", &tls.ConnectionState{}, nil, true, tlsrpt.ResultSTARTTLSNotSupported)
+	test("untrusted", policy, nil, "mx.example.invalid",
+		&tls.ConnectionState{HandshakeComplete: true}, x509.UnknownAuthorityError{}, true, tlsrpt.ResultCertificateNotTrusted)
+	test("host mismatch", policy, nil, "mx.example.invalid",
+		&tls.ConnectionState{HandshakeComplete: true}, x509.HostnameError{Host: "mx.example.invalid"}, true, tlsrpt.ResultCertificateHostMismatch)
+	test("no policy", nil, mtasts.ErrNoPolicy, "mx.example.invalid", verified, nil, false, "")
+	test("malformed policy", nil, mtasts.MalformedPolicyError{Desc: "test"}, "mx.example.invalid", verified, nil, true, tlsrpt.ResultSTSPolicyInvalid)
+	test("fetch error", nil, errors.New("connection refused"), "mx.example.invalid", verified, nil, true, tlsrpt.ResultSTSPolicyFetchError)
+	test("mode none", &mtasts.Policy{Mode: mtasts.ModeNone}, nil, "mx.example.invalid", verified, nil, false, "")
+}
+
+func TestDANE_TLSReport(t *testing.T) {
+	extR, err := dns.NewExtResolver()
+	if err != nil {
+		t.Skip("no ext resolver:", err)
+	}
+
+	test := func(name string, recs []dns.TLSA, recsErr error, state *tls.ConnectionState, expectOk bool, expectResult string) {
+		t.Helper()
+		fut := future.New()
+		fut.Set(recs, recsErr)
+		c := &daneDelivery{c: &danePolicy{extResolver: extR}, mx: "mx.example.invalid", tlsaFut: fut}
+
+		p, res, ok := c.tlsReport(context.Background(), "example.invalid", "mx.example.invalid", state, nil)
+		if ok != expectOk {
+			t.Errorf("%s: ok = %v, want %v", name, ok, expectOk)
+			return
+		}
+		if !ok {
+			return
+		}
+		if p.Type != tlsrpt.PolicyTLSA || len(p.MXHost) != 1 || p.MXHost[0] != "mx.example.invalid" {
+			t.Errorf("%s: wrong policy: %+v", name, p)
+		}
+		if res != expectResult {
+			t.Errorf("%s: result = %q, want %q", name, res, expectResult)
+		}
+	}
+
+	recs := []dns.TLSA{{Usage: 3, Selector: 1, MatchingType: 1, Certificate: "00"}}
+
+	test("no records", nil, nil, &tls.ConnectionState{}, false, "")
+	test("no starttls", recs, nil, &tls.ConnectionState{}, true, tlsrpt.ResultSTARTTLSNotSupported)
+	test("lookup error", nil, errors.New("SERVFAIL"), &tls.ConnectionState{}, true, tlsrpt.ResultDNSSECInvalid)
+}
@@ -51,7 +51,7 @@ func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
 }
 
 func (t *Target) Init(cfg *config.Map) error {
-	cfg.Bool("debug", true, false, &t.log.Debug)
+	cfg.Logger(true, false, &t.log)
 
 	// Read any config directives into Target variables here.
 
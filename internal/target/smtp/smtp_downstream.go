@@ -90,7 +90,7 @@ func (u *Downstream) Init(cfg *config.Map) error {
 	var attemptTLS *bool
 
 	var targetsArg []string
-	cfg.Bool("debug", true, false, &u.log.Debug)
+	cfg.Logger(true, false, &u.log)
 	cfg.Callback("require_tls", func(m *config.Map, node config.Node) error {
 		u.log.Msg("require_tls directive is deprecated and ignored")
 		return nil
@@ -34,6 +34,7 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/config"
 	"github.com/sirrchat/SirrMesh/framework/exterrors"
 	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/framework/tracing"
 )
 
 type Msg struct {
@@ -203,7 +204,7 @@ func DoTestDeliveryNonAtomic(t *testing.T, c module.StatusCollector, tgt module.
 	IDRaw := sha1.Sum([]byte(t.Name()))
 	encodedID := hex.EncodeToString(IDRaw[:])
 
-	testCtx := context.Background()
+	testCtx := tracing.WithMsgID(context.Background(), encodedID)
 
 	body := buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}
 	msgMeta := module.MsgMetadata{
@@ -257,7 +258,7 @@ func DoTestDeliveryErrMeta(t *testing.T, tgt module.DeliveryTarget, from string,
 
 	IDRaw := sha1.Sum([]byte(t.Name()))
 	encodedID := hex.EncodeToString(IDRaw[:])
-	testCtx := context.Background()
+	testCtx := tracing.WithMsgID(context.Background(), encodedID)
 
 	body := buffer.MemoryBuffer{Slice: []byte("foobar\r\n")}
 	msgMeta.DontTraceSender = true
@@ -0,0 +1,43 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package testutils
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sirrchat/SirrMesh/framework/tracing"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// Spans installs the global TracerProvider that records all spans into the
+// returned in-memory exporter. The previous provider is restored when the test
+// completes.
+//
+// Tests using Spans should not be run in parallel.
+func Spans(t *testing.T) *tracetest.InMemoryExporter {
+	exp := tracetest.NewInMemoryExporter()
+	shutdown := tracing.SetupWithExporter(exp)
+	t.Cleanup(func() {
+		if err := shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	return exp
+}
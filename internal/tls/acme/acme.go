@@ -3,6 +3,7 @@ package acme
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"path/filepath"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/sirrchat/SirrMesh/framework/hooks"
 	"github.com/sirrchat/SirrMesh/framework/log"
 	"github.com/sirrchat/SirrMesh/framework/module"
+	tls2 "github.com/sirrchat/SirrMesh/internal/tls"
 )
 
 const modName = "tls.loader.acme"
@@ -23,6 +25,7 @@ type Loader struct {
 	cache        *certmagic.Cache
 	cfg          *certmagic.Config
 	cancelManage context.CancelFunc
+	names        []string
 
 	log log.Logger
 }
@@ -50,7 +53,7 @@ func (l *Loader) Init(cfg *config.Map) error {
 		overrideDomain string
 		provider       certmagic.DNSProvider
 	)
-	cfg.Bool("debug", true, false, &l.log.Debug)
+	cfg.Logger(true, false, &l.log)
 	cfg.String("hostname", true, true, "", &hostname)
 	cfg.StringList("extra_names", false, false, nil, &extraNames)
 	cfg.String("store_path", false, false,
@@ -91,6 +94,7 @@ func (l *Loader) Init(cfg *config.Map) error {
 		Storage:           l.store, // not sure if it is necessary to set these twice
 		Logger:            cmLog,
 		DefaultServerName: hostname,
+		OnEvent:           l.onEvent,
 	})
 	issuer := certmagic.NewACMEIssuer(l.cfg, certmagic.ACMEIssuer{
 		Logger: cmLog,
@@ -122,8 +126,9 @@ func (l *Loader) Init(cfg *config.Map) error {
 		return nil
 	}
 
+	l.names = append([]string{hostname}, extraNames...)
 	manageCtx, cancelManage := context.WithCancel(context.Background())
-	err := l.cfg.ManageAsync(manageCtx, append([]string{hostname}, extraNames...))
+	err := l.cfg.ManageAsync(manageCtx, l.names)
 	if err != nil {
 		cancelManage()
 		return err
@@ -133,6 +138,22 @@ func (l *Loader) Init(cfg *config.Map) error {
 	return nil
 }
 
+// onEvent updates the certificate expiry metric when certificates are
+// loaded into the cache or renewed.
+func (l *Loader) onEvent(_ context.Context, event string, _ map[string]any) error {
+	if event != "cached_managed_cert" && event != "cert_obtained" {
+		return nil
+	}
+	var leaves []*x509.Certificate
+	for _, name := range l.names {
+		for _, cert := range l.cache.AllMatchingCertificates(name) {
+			leaves = append(leaves, cert.Leaf)
+		}
+	}
+	tls2.RecordCertificates(l.instName, leaves)
+	return nil
+}
+
 func (l *Loader) ConfigureTLS(c *tls.Config) error {
 	c.GetCertificate = l.cfg.GetCertificate
 	return nil
@@ -141,6 +162,7 @@ func (l *Loader) ConfigureTLS(c *tls.Config) error {
 func (l *Loader) Close() error {
 	l.cancelManage()
 	l.cache.Stop()
+	tls2.ForgetCertificates(l.instName)
 	return nil
 }
 
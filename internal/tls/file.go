@@ -20,6 +20,7 @@ package tls
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"os"
@@ -111,6 +112,7 @@ func (f *FileLoader) Init(cfg *config.Map) error {
 func (f *FileLoader) Close() error {
 	f.reloadTick.Stop()
 	f.stopTick <- struct{}{}
+	ForgetCertificates(f.instName)
 	return nil
 }
 
@@ -158,6 +160,12 @@ func (f *FileLoader) loadCerts() error {
 		certs = append(certs, cert)
 	}
 
+	leaves := make([]*x509.Certificate, 0, len(certs))
+	for _, cert := range certs {
+		leaves = append(leaves, cert.Leaf)
+	}
+	RecordCertificates(f.instName, leaves)
+
 	f.certsLock.Lock()
 	defer f.certsLock.Unlock()
 	f.certs = certs
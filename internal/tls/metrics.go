@@ -0,0 +1,72 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tls
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var certExpiry = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "sirrmesh",
+		Subsystem: "tls",
+		Name:      "certificate_expiry_timestamp_seconds",
+		Help:      "Expiration time of certificates used by TLS loaders as UNIX timestamp",
+	},
+	[]string{"loader", "name"},
+)
+
+// RecordCertificates replaces the expiration times reported for the loader
+// instance with the ones of the passed certificates. The name label is the
+// first DNS name in the certificate or its subject common name. If there are
+// multiple certificates for the same name, the latest expiration time is
+// reported.
+func RecordCertificates(loader string, certs []*x509.Certificate) {
+	expiry := make(map[string]time.Time, len(certs))
+	for _, cert := range certs {
+		if cert == nil {
+			continue
+		}
+		name := cert.Subject.CommonName
+		if len(cert.DNSNames) != 0 {
+			name = cert.DNSNames[0]
+		}
+		if cert.NotAfter.After(expiry[name]) {
+			expiry[name] = cert.NotAfter
+		}
+	}
+
+	certExpiry.DeletePartialMatch(prometheus.Labels{"loader": loader})
+	for name, notAfter := range expiry {
+		certExpiry.WithLabelValues(loader, name).Set(float64(notAfter.Unix()))
+	}
+}
+
+// ForgetCertificates removes the expiration times reported for the loader
+// instance.
+func ForgetCertificates(loader string) {
+	certExpiry.DeletePartialMatch(prometheus.Labels{"loader": loader})
+}
+
+func init() {
+	prometheus.MustRegister(certExpiry)
+}
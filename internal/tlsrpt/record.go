@@ -0,0 +1,120 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsrpt
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Record is the parsed _smtp._tls TXT record (RFC 8460 Section 3).
+type Record struct {
+	RUA []string
+}
+
+// RecordName returns the DNS name of the TLS-RPT record for the domain.
+func RecordName(domain string) string {
+	return "_smtp._tls." + strings.TrimSuffix(domain, ".")
+}
+
+// ParseRecord parses the TXT record value.
+func ParseRecord(txt string) (*Record, error) {
+	parts := strings.Split(txt, ";")
+	if strings.TrimSpace(parts[0]) != "v=TLSRPTv1" {
+		return nil, errors.New("tlsrpt: record should start with v=TLSRPTv1")
+	}
+
+	rec := &Record{}
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("tlsrpt: malformed field: %s", part)
+		}
+		if strings.TrimSpace(key) != "rua" {
+			// Unknown extensions are ignored.
+			continue
+		}
+		for _, uri := range strings.Split(value, ",") {
+			uri = strings.TrimSpace(uri)
+			u, err := url.Parse(uri)
+			if err != nil {
+				return nil, fmt.Errorf("tlsrpt: malformed rua URI: %w", err)
+			}
+			switch strings.ToLower(u.Scheme) {
+			case "mailto", "https":
+			default:
+				return nil, fmt.Errorf("tlsrpt: unsupported rua URI scheme: %s", uri)
+			}
+			rec.RUA = append(rec.RUA, uri)
+		}
+	}
+	if len(rec.RUA) == 0 {
+		return nil, errors.New("tlsrpt: rua is missing")
+	}
+	return rec, nil
+}
+
+// FindRecord returns the only TLS-RPT record among the TXT records.
+//
+// Per RFC 8460 Section 3, multiple records mean there is no valid policy.
+func FindRecord(txts []string) (*Record, error) {
+	var found []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=TLSRPTv1") {
+			found = append(found, txt)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, nil
+	case 1:
+		return ParseRecord(found[0])
+	default:
+		return nil, errors.New("tlsrpt: multiple records published")
+	}
+}
+
+// ResultTypeForError maps the TLS handshake error to the report result type.
+func ResultTypeForError(err error) string {
+	var (
+		hostErr      x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+		authorityErr x509.UnknownAuthorityError
+	)
+	switch {
+	case errors.As(err, &hostErr):
+		return ResultCertificateHostMismatch
+	case errors.As(err, &invalidErr):
+		if invalidErr.Reason == x509.Expired {
+			return ResultCertificateExpired
+		}
+		return ResultCertificateNotTrusted
+	case errors.As(err, &authorityErr):
+		return ResultCertificateNotTrusted
+	default:
+		return ResultValidationFailure
+	}
+}
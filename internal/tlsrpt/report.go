@@ -0,0 +1,173 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsrpt
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Policy types, RFC 8460 Section 4.3.
+const (
+	PolicySTS           = "sts"
+	PolicyTLSA          = "tlsa"
+	PolicyNoPolicyFound = "no-policy-found"
+)
+
+// Result types, RFC 8460 Section 4.3.
+const (
+	ResultSTARTTLSNotSupported    = "starttls-not-supported"
+	ResultCertificateHostMismatch = "certificate-host-mismatch"
+	ResultCertificateExpired      = "certificate-expired"
+	ResultCertificateNotTrusted   = "certificate-not-trusted"
+	ResultValidationFailure       = "validation-failure"
+	ResultTLSAInvalid             = "tlsa-invalid"
+	ResultDNSSECInvalid           = "dnssec-invalid"
+	ResultDANERequired            = "dane-required"
+	ResultSTSPolicyFetchError     = "sts-policy-fetch-error"
+	ResultSTSPolicyInvalid        = "sts-policy-invalid"
+	ResultSTSWebPKIInvalid        = "sts-webpki-invalid"
+)
+
+// Report is the JSON report defined in RFC 8460 Section 4.
+type Report struct {
+	OrganizationName string         `json:"organization-name"`
+	DateRange        DateRange      `json:"date-range"`
+	ContactInfo      string         `json:"contact-info"`
+	ReportID         string         `json:"report-id"`
+	Policies         []PolicyResult `json:"policies"`
+}
+
+type DateRange struct {
+	Start time.Time `json:"start-datetime"`
+	End   time.Time `json:"end-datetime"`
+}
+
+// Policy describes the policy applied to the session.
+type Policy struct {
+	Type   string   `json:"policy-type"`
+	String []string `json:"policy-string,omitempty"`
+	Domain string   `json:"policy-domain"`
+	MXHost []string `json:"mx-host,omitempty"`
+}
+
+func (p Policy) key() string {
+	return strings.Join([]string{
+		p.Type,
+		p.Domain,
+		strings.Join(p.String, "\n"),
+		strings.Join(p.MXHost, "\n"),
+	}, "\x00")
+}
+
+type PolicyResult struct {
+	Policy         Policy           `json:"policy"`
+	Summary        Summary          `json:"summary"`
+	FailureDetails []FailureDetails `json:"failure-details,omitempty"`
+}
+
+type Summary struct {
+	TotalSuccessful int `json:"total-successful-session-count"`
+	TotalFailure    int `json:"total-failure-session-count"`
+}
+
+type FailureDetails struct {
+	ResultType          string `json:"result-type"`
+	SendingMTAIP        string `json:"sending-mta-ip,omitempty"`
+	ReceivingMXHostname string `json:"receiving-mx-hostname,omitempty"`
+	ReceivingIP         string `json:"receiving-ip,omitempty"`
+	FailedSessionCount  int    `json:"failed-session-count"`
+	FailureReasonCode   string `json:"failure-reason-code,omitempty"`
+}
+
+// Entry is the result of a single delivery attempt as kept in the Store.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Policy Policy    `json:"policy"`
+
+	// ResultType is empty for successful sessions.
+	ResultType  string `json:"result_type,omitempty"`
+	SendingIP   string `json:"sending_ip,omitempty"`
+	MXHost      string `json:"mx_host,omitempty"`
+	ReceivingIP string `json:"receiving_ip,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// Metadata contains report fields that are not derived from entries.
+type Metadata struct {
+	OrgName     string
+	ContactInfo string
+	ReportID    string
+	DateRange   DateRange
+}
+
+// Build aggregates entries into the report.
+func Build(meta Metadata, entries []Entry) *Report {
+	rep := &Report{
+		OrganizationName: meta.OrgName,
+		DateRange: DateRange{
+			Start: meta.DateRange.Start.UTC().Truncate(time.Second),
+			End:   meta.DateRange.End.UTC().Truncate(time.Second),
+		},
+		ContactInfo: meta.ContactInfo,
+		ReportID:    meta.ReportID,
+		Policies:    []PolicyResult{},
+	}
+
+	policyIdx := make(map[string]int)
+	failureIdx := make(map[string]int)
+	for _, e := range entries {
+		pKey := e.Policy.key()
+		idx, ok := policyIdx[pKey]
+		if !ok {
+			idx = len(rep.Policies)
+			policyIdx[pKey] = idx
+			rep.Policies = append(rep.Policies, PolicyResult{Policy: e.Policy})
+		}
+		pr := &rep.Policies[idx]
+
+		if e.ResultType == "" {
+			pr.Summary.TotalSuccessful++
+			continue
+		}
+		pr.Summary.TotalFailure++
+
+		fKey := strings.Join([]string{pKey, e.ResultType, e.SendingIP, e.MXHost, e.ReceivingIP, e.Reason}, "\x00")
+		fIdx, ok := failureIdx[fKey]
+		if !ok {
+			fIdx = len(pr.FailureDetails)
+			failureIdx[fKey] = fIdx
+			pr.FailureDetails = append(pr.FailureDetails, FailureDetails{
+				ResultType:          e.ResultType,
+				SendingMTAIP:        e.SendingIP,
+				ReceivingMXHostname: e.MXHost,
+				ReceivingIP:         e.ReceivingIP,
+				FailureReasonCode:   e.Reason,
+			})
+		}
+		pr.FailureDetails[fIdx].FailedSessionCount++
+	}
+
+	return rep
+}
+
+func (r *Report) Marshal() ([]byte, error) {
+	return json.MarshalIndent(r, "", "  ")
+}
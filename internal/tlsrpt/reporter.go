@@ -0,0 +1,379 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+// Package tlsrpt implements SMTP TLS reporting (RFC 8460).
+//
+// target.remote records the result of MTA-STS and DANE policy evaluation for
+// each outbound session using Reporter.Record, results are kept in the Store
+// until the report for the recipient domain is due. Reports are then
+// aggregated and sent to the rua= URIs from the _smtp._tls TXT record of the
+// domain, either by email using the configured delivery target or via HTTPS.
+package tlsrpt
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime/trace"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/sirrchat/SirrMesh/framework/address"
+	"github.com/sirrchat/SirrMesh/framework/buffer"
+	"github.com/sirrchat/SirrMesh/framework/config"
+	modconfig "github.com/sirrchat/SirrMesh/framework/config/module"
+	"github.com/sirrchat/SirrMesh/framework/dns"
+	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
+	"github.com/sirrchat/SirrMesh/internal/reportstore"
+)
+
+type Reporter struct {
+	instName string
+	log      log.Logger
+
+	hostname string
+	orgName  string
+	email    string
+	interval time.Duration
+	target   module.DeliveryTarget
+
+	store      *Store
+	resolver   dns.Resolver
+	httpClient *http.Client
+
+	sched *reportstore.Scheduler
+}
+
+func New(_, instName string, _, inlineArgs []string) (module.Module, error) {
+	if len(inlineArgs) != 0 {
+		return nil, errors.New("tls_reports: inline arguments are not used")
+	}
+	return &Reporter{
+		instName:   instName,
+		log:        log.Logger{Name: "tls_reports"},
+		resolver:   dns.DefaultResolver(),
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+func (r *Reporter) Name() string {
+	return "tls_reports"
+}
+
+func (r *Reporter) InstanceName() string {
+	return r.instName
+}
+
+func (r *Reporter) Init(cfg *config.Map) error {
+	var storeDir string
+
+	cfg.Logger(true, false, &r.log)
+	cfg.String("hostname", true, true, "", &r.hostname)
+	cfg.String("org_name", false, true, "", &r.orgName)
+	cfg.String("email", false, true, "", &r.email)
+	cfg.Duration("interval", false, false, 24*time.Hour, &r.interval)
+	cfg.String("store_dir", false, false, DefaultStoreDir(config.StateDirectory), &storeDir)
+	cfg.Custom("deliver_to", false, true, nil, modconfig.DeliveryDirective, &r.target)
+	if _, err := cfg.Process(); err != nil {
+		return err
+	}
+
+	if _, _, err := address.Split(r.email); err != nil {
+		return fmt.Errorf("tls_reports: invalid email: %w", err)
+	}
+	if r.interval < time.Hour {
+		return errors.New("tls_reports: interval should be at least 1h")
+	}
+
+	if module.DryRun {
+		return nil
+	}
+
+	var err error
+	r.store, err = NewStore(storeDir)
+	if err != nil {
+		return fmt.Errorf("tls_reports: %w", err)
+	}
+
+	r.sched = reportstore.StartScheduler("TLS reports", r.interval, r.SendDue)
+	return nil
+}
+
+func (r *Reporter) Close() error {
+	r.sched.Close()
+	return nil
+}
+
+// Record saves the result of the outbound session.
+func (r *Reporter) Record(e Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := r.store.Add(e); err != nil {
+		r.log.Error("failed to record session result", err, "domain", e.Policy.Domain)
+	}
+}
+
+// SendDue sends reports for all recipient domains that have entries older
+// than the reporting interval.
+func (r *Reporter) SendDue(ctx context.Context, now time.Time) {
+	r.store.SendDue(ctx, r.log, now, r.interval, r.sendReport)
+}
+
+// Preview returns the report that would be sent for the domain if it was due
+// now. Pending entries are not modified.
+func Preview(store *Store, meta Metadata, domain string, now time.Time) (*Report, error) {
+	entries, err := store.Read(domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no pending entries for %s", domain)
+	}
+	meta.DateRange = dateRange(entries, now)
+	return Build(meta, entries), nil
+}
+
+func dateRange(entries []Entry, now time.Time) DateRange {
+	begin := now
+	for _, e := range entries {
+		if e.Time.Before(begin) {
+			begin = e.Time
+		}
+	}
+	return DateRange{Start: begin, End: now}
+}
+
+func (r *Reporter) lookupRecord(ctx context.Context, domain string) (*Record, error) {
+	txts, err := r.resolver.LookupTXT(ctx, RecordName(domain)+".")
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return FindRecord(txts)
+}
+
+func (r *Reporter) sendReport(ctx context.Context, domain string, entries []Entry, now time.Time) error {
+	defer trace.StartRegion(ctx, "tls_reports/sendReport").End()
+
+	if len(entries) == 0 {
+		return nil
+	}
+
+	rec, err := r.lookupRecord(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if rec == nil {
+		r.log.DebugMsg("no TLS-RPT record, discarding report", "domain", domain)
+		return nil
+	}
+
+	reportID, err := module.GenerateMsgID()
+	if err != nil {
+		return err
+	}
+	rep := Build(Metadata{
+		OrgName:     r.orgName,
+		ContactInfo: r.email,
+		ReportID:    reportID,
+		DateRange:   dateRange(entries, now),
+	}, entries)
+
+	jsonBlob, err := rep.Marshal()
+	if err != nil {
+		return err
+	}
+	var gzBlob bytes.Buffer
+	gzw := gzip.NewWriter(&gzBlob)
+	if _, err := gzw.Write(jsonBlob); err != nil {
+		return err
+	}
+	if err := gzw.Close(); err != nil {
+		return err
+	}
+
+	var rcpts []string
+	for _, uri := range rec.RUA {
+		u, err := url.Parse(uri)
+		if err != nil {
+			continue
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "mailto":
+			addr, err := url.PathUnescape(u.Opaque)
+			if err != nil {
+				r.log.Msg("ignoring report URI", "domain", domain, "uri", uri, "reason", err)
+				continue
+			}
+			if _, _, err := address.Split(addr); err != nil {
+				r.log.Msg("ignoring report URI", "domain", domain, "uri", uri, "reason", err)
+				continue
+			}
+			rcpts = append(rcpts, addr)
+		case "https":
+			if err := r.post(ctx, uri, gzBlob.Bytes()); err != nil {
+				r.log.Error("failed to submit report", err, "domain", domain, "uri", uri)
+				continue
+			}
+			r.log.Msg("submitted TLS report", "domain", domain, "report_id", reportID, "uri", uri)
+		}
+	}
+	if len(rcpts) == 0 {
+		return nil
+	}
+
+	header, body, err := r.composeMessage(rep, domain, rcpts, gzBlob.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := r.deliver(ctx, reportID, rcpts, header, body); err != nil {
+		return err
+	}
+	r.log.Msg("sent TLS report", "domain", domain, "report_id", reportID, "rcpts", rcpts, "policies", len(rep.Policies))
+	return nil
+}
+
+// post submits the report using HTTPS (RFC 8460 Section 5.4).
+func (r *Reporter) post(ctx context.Context, uri string, gzBlob []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewReader(gzBlob))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/tlsrpt+gzip")
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// composeMessage builds the report message as defined in RFC 8460
+// Section 5.3.
+func (r *Reporter) composeMessage(rep *Report, domain string, rcpts []string, gzBlob []byte) (textproto.Header, buffer.Buffer, error) {
+	filename := fmt.Sprintf("%s!%s!%d!%d!%s.json.gz", r.hostname, domain,
+		rep.DateRange.Start.Unix(), rep.DateRange.End.Unix(), rep.ReportID)
+
+	var h message.Header
+	h.Set("From", r.email)
+	h.Set("To", strings.Join(rcpts, ", "))
+	h.Set("Subject", fmt.Sprintf("Report Domain: %s Submitter: %s Report-ID: <%s>", domain, r.hostname, rep.ReportID))
+	h.Set("Date", time.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	h.Set("Message-Id", "<"+rep.ReportID+"@"+r.hostname+">")
+	h.Set("TLS-Report-Domain", domain)
+	h.Set("TLS-Report-Submitter", r.hostname)
+	h.Set("MIME-Version", "1.0")
+	h.SetContentType("multipart/report", map[string]string{"report-type": "tlsrpt"})
+
+	var msg bytes.Buffer
+	mw, err := message.CreateWriter(&msg, h)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	var textH message.Header
+	textH.SetContentType("text/plain", map[string]string{"charset": "utf-8"})
+	pw, err := mw.CreatePart(textH)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	fmt.Fprintf(pw, "This is an aggregate TLS report for %s generated by %s.\r\n"+
+		"It covers %s to %s.\r\n", domain, r.hostname,
+		rep.DateRange.Start.Format(time.RFC3339), rep.DateRange.End.Format(time.RFC3339))
+	pw.Close()
+
+	var attachH message.Header
+	attachH.SetContentType("application/tlsrpt+gzip", nil)
+	attachH.SetContentDisposition("attachment", map[string]string{"filename": filename})
+	attachH.Set("Content-Transfer-Encoding", "base64")
+	pw, err = mw.CreatePart(attachH)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	if _, err := pw.Write(gzBlob); err != nil {
+		return textproto.Header{}, nil, err
+	}
+	pw.Close()
+	if err := mw.Close(); err != nil {
+		return textproto.Header{}, nil, err
+	}
+
+	br := bufio.NewReader(&msg)
+	header, err := textproto.ReadHeader(br)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	body, err := io.ReadAll(br)
+	if err != nil {
+		return textproto.Header{}, nil, err
+	}
+	return header, buffer.MemoryBuffer{Slice: body}, nil
+}
+
+func (r *Reporter) deliver(ctx context.Context, reportID string, rcpts []string, header textproto.Header, body buffer.Buffer) (err error) {
+	msgMeta := &module.MsgMetadata{
+		ID:       reportID,
+		SMTPOpts: smtp.MailOptions{},
+	}
+
+	delivery, err := r.target.Start(ctx, msgMeta, r.email)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if err := delivery.Abort(ctx); err != nil {
+				r.log.Error("failed to abort report delivery", err, "report_id", reportID)
+			}
+		}
+	}()
+
+	for _, rcpt := range rcpts {
+		if err = delivery.AddRcpt(ctx, rcpt, smtp.RcptOptions{}); err != nil {
+			return err
+		}
+	}
+	if err = delivery.Body(ctx, header, body); err != nil {
+		return err
+	}
+	return delivery.Commit(ctx)
+}
+
+func init() {
+	module.Register("tls_reports", New)
+}
@@ -0,0 +1,47 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsrpt
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/internal/reportstore"
+)
+
+// DefaultStoreDir returns the directory used to keep session results if
+// it is not set explicitly.
+func DefaultStoreDir(stateDir string) string {
+	return filepath.Join(stateDir, "tls_reports")
+}
+
+// Store keeps recorded session results until they are sent.
+type Store = reportstore.Store[Entry]
+
+func NewStore(dir string) (*Store, error) {
+	return reportstore.NewStore[Entry]("tls_reports", dir)
+}
+
+func (e Entry) ReportDomain() string {
+	return e.Policy.Domain
+}
+
+func (e Entry) ReportTime() time.Time {
+	return e.Time
+}
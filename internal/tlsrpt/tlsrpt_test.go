@@ -0,0 +1,216 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package tlsrpt
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message"
+	"github.com/foxcpp/go-mockdns"
+	"github.com/sirrchat/SirrMesh/internal/testutils"
+)
+
+var testPolicy = Policy{
+	Type:   PolicySTS,
+	String: []string{"version: STSv1", "mode: enforce", "mx: mx.example.org", "max_age: 86400"},
+	Domain: "example.org",
+	MXHost: []string{"mx.example.org"},
+}
+
+func TestBuild(t *testing.T) {
+	entries := []Entry{
+		{Policy: testPolicy},
+		{Policy: testPolicy},
+		{Policy: testPolicy, ResultType: ResultCertificateExpired, MXHost: "mx.example.org", ReceivingIP: "192.0.2.1"},
+		{Policy: testPolicy, ResultType: ResultCertificateExpired, MXHost: "mx.example.org", ReceivingIP: "192.0.2.1"},
+		{Policy: Policy{Type: PolicyNoPolicyFound, Domain: "example.org"}},
+	}
+	rep := Build(Metadata{OrgName: "Test", ContactInfo: "postmaster@example.net", ReportID: "1"}, entries)
+
+	if len(rep.Policies) != 2 {
+		t.Fatalf("Expected 2 policies, got %d", len(rep.Policies))
+	}
+	sts := rep.Policies[0]
+	if sts.Summary.TotalSuccessful != 2 || sts.Summary.TotalFailure != 2 {
+		t.Errorf("Wrong summary: %+v", sts.Summary)
+	}
+	if len(sts.FailureDetails) != 1 || sts.FailureDetails[0].FailedSessionCount != 2 ||
+		sts.FailureDetails[0].ResultType != ResultCertificateExpired {
+		t.Errorf("Wrong failure details: %+v", sts.FailureDetails)
+	}
+	if rep.Policies[1].Policy.Type != PolicyNoPolicyFound || rep.Policies[1].Summary.TotalSuccessful != 1 {
+		t.Errorf("Wrong second policy: %+v", rep.Policies[1])
+	}
+
+	blob, err := rep.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{`"organization-name"`, `"start-datetime"`, `"policy-type": "sts"`, `"total-failure-session-count": 2`} {
+		if !bytes.Contains(blob, []byte(field)) {
+			t.Errorf("Report does not contain %s:\n%s", field, blob)
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	test := func(txt string, rua []string, fail bool) {
+		t.Helper()
+		rec, err := ParseRecord(txt)
+		if fail {
+			if err == nil {
+				t.Errorf("%s: expected an error", txt)
+			}
+			return
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", txt, err)
+			return
+		}
+		if strings.Join(rec.RUA, " ") != strings.Join(rua, " ") {
+			t.Errorf("%s: got %v, want %v", txt, rec.RUA, rua)
+		}
+	}
+
+	test("v=TLSRPTv1; rua=mailto:tlsrpt@example.org", []string{"mailto:tlsrpt@example.org"}, false)
+	test("v=TLSRPTv1;rua=mailto:a@example.org,https://example.org/tlsrpt", []string{"mailto:a@example.org", "https://example.org/tlsrpt"}, false)
+	test("v=TLSRPTv1; rua=mailto:a@example.org; ext=1", []string{"mailto:a@example.org"}, false)
+	test("v=TLSRPTv1", nil, true)
+	test("rua=mailto:a@example.org; v=TLSRPTv1", nil, true)
+	test("v=TLSRPTv1; rua=ftp://example.org", nil, true)
+
+	if _, err := FindRecord([]string{"v=TLSRPTv1; rua=mailto:a@example.org", "v=TLSRPTv1; rua=mailto:b@example.org"}); err == nil {
+		t.Error("Expected an error for multiple records")
+	}
+	if rec, err := FindRecord([]string{"v=spf1 -all"}); rec != nil || err != nil {
+		t.Errorf("Expected no record, got %v %v", rec, err)
+	}
+}
+
+func TestSendDue(t *testing.T) {
+	var posted []byte
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Type") != "application/tlsrpt+gzip" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		posted, _ = io.ReadAll(req.Body)
+	}))
+	defer srv.Close()
+
+	tgt := testutils.Target{}
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Reporter{
+		log:        testutils.Logger(t, "tls_reports"),
+		hostname:   "mx.example.net",
+		orgName:    "Example Net",
+		email:      "tlsrpt-noreply@example.net",
+		interval:   24 * time.Hour,
+		target:     &tgt,
+		store:      store,
+		httpClient: srv.Client(),
+		resolver: &mockdns.Resolver{Zones: map[string]mockdns.Zone{
+			"_smtp._tls.example.org.": {
+				TXT: []string{"v=TLSRPTv1; rua=mailto:tlsrpt@example.org," + srv.URL + "/report"},
+			},
+		}},
+	}
+
+	r.Record(Entry{Policy: testPolicy})
+	r.Record(Entry{Policy: testPolicy, ResultType: ResultSTARTTLSNotSupported, MXHost: "mx.example.org"})
+	r.Record(Entry{Policy: Policy{Type: PolicyNoPolicyFound, Domain: "example.com"}})
+
+	// Not due yet.
+	r.SendDue(context.Background(), time.Now())
+	if len(tgt.Messages) != 0 {
+		t.Fatal("Report sent before it is due")
+	}
+
+	r.SendDue(context.Background(), time.Now().Add(25*time.Hour))
+	if len(tgt.Messages) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(tgt.Messages))
+	}
+	msg := tgt.Messages[0]
+	if msg.MailFrom != "tlsrpt-noreply@example.net" {
+		t.Errorf("Wrong MAIL FROM: %s", msg.MailFrom)
+	}
+	if len(msg.RcptTo) != 1 || msg.RcptTo[0] != "tlsrpt@example.org" {
+		t.Errorf("Wrong recipients: %v", msg.RcptTo)
+	}
+	if msg.Header.Get("TLS-Report-Domain") != "example.org" || msg.Header.Get("TLS-Report-Submitter") != "mx.example.net" {
+		t.Errorf("Wrong TLS-Report-* fields")
+	}
+
+	ent, err := message.New(message.Header{Header: msg.Header}, bytes.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct, params, _ := ent.Header.ContentType(); ct != "multipart/report" || params["report-type"] != "tlsrpt" {
+		t.Errorf("Wrong Content-Type: %s %v", ct, params)
+	}
+	var attached []byte
+	err = ent.Walk(func(path []int, part *message.Entity, err error) error {
+		if err != nil {
+			return err
+		}
+		if ct, _, _ := part.Header.ContentType(); ct != "application/tlsrpt+gzip" {
+			return nil
+		}
+		attached, err = io.ReadAll(part.Body)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, blob := range [][]byte{attached, posted} {
+		gzr, err := gzip.NewReader(bytes.NewReader(blob))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rep Report
+		if err := json.NewDecoder(gzr).Decode(&rep); err != nil {
+			t.Fatal(err)
+		}
+		if len(rep.Policies) != 1 || rep.Policies[0].Summary.TotalSuccessful != 1 || rep.Policies[0].Summary.TotalFailure != 1 {
+			t.Errorf("Wrong report content: %+v", rep.Policies)
+		}
+	}
+
+	// Domain without the TLS-RPT record is discarded, entries are removed after sending.
+	domains, err := store.Domains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 0 {
+		t.Errorf("Pending entries left: %v", domains)
+	}
+}
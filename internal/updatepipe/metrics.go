@@ -0,0 +1,136 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package updatepipe
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	mess "github.com/foxcpp/go-imap-mess"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirrchat/SirrMesh/framework/log"
+)
+
+var (
+	updatesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "updatepipe",
+			Name:      "updates_total",
+			Help:      "IMAP updates sent (out) and received (in) over the update pipe",
+		},
+		[]string{"module", "backend", "direction"},
+	)
+	stallsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "updatepipe",
+			Name:      "stalls_total",
+			Help:      "IMAP updates delayed because the pipe or the receiver did not keep up",
+		},
+		[]string{"module", "backend", "direction"},
+	)
+	errorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "updatepipe",
+			Name:      "errors_total",
+			Help:      "Failed update pipe operations",
+		},
+		[]string{"module", "backend", "operation"},
+	)
+	reconnectsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "updatepipe",
+			Name:      "reconnects_total",
+			Help:      "Connections to the update pipe broker reestablished after a failure",
+		},
+		[]string{"module", "backend"},
+	)
+	connected = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "sirrmesh",
+			Subsystem: "updatepipe",
+			Name:      "connected",
+			Help:      "Whether the update pipe is connected to the broker (1) or not (0)",
+		},
+		[]string{"module", "backend"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(updatesTotal)
+	prometheus.MustRegister(stallsTotal)
+	prometheus.MustRegister(errorsTotal)
+	prometheus.MustRegister(reconnectsTotal)
+	prometheus.MustRegister(connected)
+}
+
+// CountStalled records an update delayed by the pipe user because its
+// outbound buffer is full. direction is either "in" or "out".
+func CountStalled(module, backend, direction string) {
+	stallsTotal.WithLabelValues(module, backend, direction).Inc()
+}
+
+// connState tracks the broker connection of a pipe for the connected and
+// reconnects_total metrics.
+type connState struct {
+	mu        sync.Mutex
+	connected bool
+	everUp    bool
+
+	// stalled is set while received updates wait for the consumer.
+	stalled atomic.Bool
+}
+
+func (cs *connState) set(module, backend string, up bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if up && !cs.connected && cs.everUp {
+		reconnectsTotal.WithLabelValues(module, backend).Inc()
+	}
+	if up {
+		cs.everUp = true
+		connected.WithLabelValues(module, backend).Set(1)
+	} else {
+		connected.WithLabelValues(module, backend).Set(0)
+	}
+	cs.connected = up
+}
+
+// deliver sends the received update to the channel passed to Listen. Updates
+// are never dropped since a lost EXPUNGE or flag change leaves the mailbox
+// view of IMAP clients wrong, so the reader waits for a slow consumer.
+func (cs *connState) deliver(l log.Logger, module, backend string, upds chan<- mess.Update, upd mess.Update) {
+	select {
+	case upds <- upd:
+		cs.stalled.Store(false)
+	default:
+		if !cs.stalled.Swap(true) {
+			l.Error("IMAP updates are not processed in time, delaying the pipe",
+				errors.New("receive buffer is full"))
+		}
+		stallsTotal.WithLabelValues(module, backend, "in").Inc()
+		upds <- upd
+	}
+	updatesTotal.WithLabelValues(module, backend, "in").Inc()
+}
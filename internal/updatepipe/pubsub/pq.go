@@ -14,6 +14,9 @@ type Msg struct {
 	Payload string
 }
 
+// PqPubSub implements PubSub using PostgreSQL LISTEN/NOTIFY. The listening
+// connection is reestablished automatically, channels are listened again
+// after the reconnection.
 type PqPubSub struct {
 	Notify chan Msg
 
@@ -21,12 +24,22 @@ type PqPubSub struct {
 	sender *sql.DB
 
 	Log log.Logger
+
+	// stateChanged, if not nil, is called when the listening connection is
+	// established or lost.
+	stateChanged func(connected bool)
 }
 
-func NewPQ(dsn string) (*PqPubSub, error) {
+// publishTimeout is the maximum time Publish waits for the broker.
+const publishTimeout = 10 * time.Second
+
+// NewPQ creates the PqPubSub using the PostgreSQL connection string dsn.
+// stateChanged is optional, see PqPubSub.stateChanged.
+func NewPQ(dsn string, logger log.Logger, stateChanged func(connected bool)) (*PqPubSub, error) {
 	l := &PqPubSub{
-		Log:    log.Logger{Name: "pgpubsub"},
-		Notify: make(chan Msg),
+		Log:          logger,
+		Notify:       make(chan Msg),
+		stateChanged: stateChanged,
 	}
 	l.L = pq.NewListener(dsn, 10*time.Second, time.Minute, l.eventHandler)
 	var err error
@@ -59,12 +72,21 @@ func (l *PqPubSub) eventHandler(ev pq.ListenerEventType, err error) {
 	switch ev {
 	case pq.ListenerEventConnected:
 		l.Log.DebugMsg("connected")
+		l.setState(true)
 	case pq.ListenerEventReconnected:
 		l.Log.Msg("connection reestablished")
+		l.setState(true)
 	case pq.ListenerEventConnectionAttemptFailed:
 		l.Log.Error("connection attempt failed", err)
 	case pq.ListenerEventDisconnected:
 		l.Log.Msg("connection closed", "err", err)
+		l.setState(false)
+	}
+}
+
+func (l *PqPubSub) setState(connected bool) {
+	if l.stateChanged != nil {
+		l.stateChanged(connected)
 	}
 }
 
@@ -77,7 +99,9 @@ func (l *PqPubSub) Unsubscribe(_ context.Context, key string) error {
 }
 
 func (l *PqPubSub) Publish(key, payload string) error {
-	_, err := l.sender.Exec(`SELECT pg_notify($1, $2)`, key, payload)
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+	_, err := l.sender.ExecContext(ctx, `SELECT pg_notify($1, $2)`, key, payload)
 	return err
 }
 
@@ -0,0 +1,214 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirrchat/SirrMesh/framework/log"
+)
+
+const (
+	redisMinReconnect  = time.Second
+	redisMaxReconnect  = time.Minute
+	redisHealthCheck   = 30 * time.Second
+	redisDefaultPrefix = "sirrmesh:"
+)
+
+// RedisPubSub implements PubSub using the Pub/Sub commands of Redis and
+// servers speaking the same protocol (Valkey, KeyDB, etc).
+//
+// The subscribing connection is reestablished by the client library, which
+// also subscribes to all channels again. Messages published while it is down
+// are lost.
+type RedisPubSub struct {
+	Notify chan Msg
+	Log    log.Logger
+
+	client *redis.Client
+	sub    *redis.PubSub
+	// prefix is prepended to channel names so several installations can
+	// share one server.
+	prefix string
+
+	stateChanged func(connected bool)
+	connected    bool
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+// NewRedis creates the RedisPubSub for the server at rawURL, which has the
+// following form:
+//
+//	redis://[[username]:password@]host[:port]
+//	rediss://[[username]:password@]host[:port]
+//
+// rediss uses TLS. The database number, if specified in the path, is
+// ignored since Pub/Sub channels are not bound to a database. Channel names
+// are prefixed with prefix ("sirrmesh:" if empty). stateChanged is optional
+// and is called when the subscribing connection is established or lost.
+func NewRedis(rawURL, prefix string, logger log.Logger, stateChanged func(connected bool)) (*RedisPubSub, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: malformed Redis URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, errors.New("pubsub: Redis URL without host")
+	}
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("pubsub: %w", err)
+	}
+	opts.DB = 0
+	if opts.Password == "" {
+		// redis://password@host form.
+		opts.Username, opts.Password = "", opts.Username
+	}
+
+	r := &RedisPubSub{
+		Notify:       make(chan Msg),
+		Log:          logger,
+		client:       redis.NewClient(opts),
+		prefix:       prefix,
+		stateChanged: stateChanged,
+	}
+	if r.prefix == "" {
+		r.prefix = redisDefaultPrefix
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.sub = r.client.Subscribe(r.ctx)
+
+	go r.receive()
+	return r, nil
+}
+
+func (r *RedisPubSub) setState(connected bool) {
+	if r.connected == connected {
+		return
+	}
+	r.connected = connected
+	if r.stateChanged != nil {
+		r.stateChanged(connected)
+	}
+}
+
+// receive reads messages until Close is called. The connection is checked
+// with PING when it is idle, it is reestablished by the next read if the
+// check fails.
+func (r *RedisPubSub) receive() {
+	defer close(r.Notify)
+
+	backoff := redisMinReconnect
+	ping := true
+	for {
+		var (
+			msg interface{}
+			err error
+		)
+		if ping {
+			err = r.sub.Ping(r.ctx)
+			ping = false
+		}
+		if err == nil {
+			msg, err = r.sub.ReceiveTimeout(r.ctx, redisHealthCheck)
+		}
+		if r.ctx.Err() != nil {
+			r.setState(false)
+			return
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			ping = true
+			continue
+		}
+		if err != nil {
+			if r.connected {
+				r.Log.Msg("connection closed", "err", err)
+			} else {
+				r.Log.Error("connection attempt failed", err, "retry_in", backoff)
+			}
+			r.setState(false)
+
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > redisMaxReconnect {
+				backoff = redisMaxReconnect
+			}
+			ping = true
+			continue
+		}
+
+		if !r.connected {
+			r.Log.DebugMsg("connected")
+		}
+		r.setState(true)
+		backoff = redisMinReconnect
+
+		if m, ok := msg.(*redis.Message); ok {
+			select {
+			case r.Notify <- Msg{Key: strings.TrimPrefix(m.Channel, r.prefix), Payload: m.Payload}:
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Subscribe subscribes to the channel. If the connection is down, the error
+// is returned, but the channel is still subscribed to on reconnection.
+func (r *RedisPubSub) Subscribe(ctx context.Context, key string) error {
+	return r.sub.Subscribe(ctx, r.prefix+key)
+}
+
+func (r *RedisPubSub) Unsubscribe(ctx context.Context, key string) error {
+	return r.sub.Unsubscribe(ctx, r.prefix+key)
+}
+
+func (r *RedisPubSub) Publish(key, payload string) error {
+	ctx, cancel := context.WithTimeout(r.ctx, publishTimeout)
+	defer cancel()
+	return r.client.Publish(ctx, r.prefix+key, payload).Err()
+}
+
+func (r *RedisPubSub) Listener() chan Msg {
+	return r.Notify
+}
+
+func (r *RedisPubSub) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		r.cancel()
+		err = errors.Join(r.sub.Close(), r.client.Close())
+	})
+	return err
+}
@@ -0,0 +1,353 @@
+/*
+SirrMesh - Composable all-in-one email server.
+Copyright © 2019-2020 Max Mazurov <fox.cpp@disroot.org>, SirrMesh contributors
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+
+package pubsub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirrchat/SirrMesh/framework/log"
+)
+
+// fakeRedis is a minimal RESP2 broker implementing AUTH, PING, SUBSCRIBE,
+// UNSUBSCRIBE and PUBLISH. Other commands, including HELLO, are rejected.
+type fakeRedis struct {
+	l net.Listener
+
+	lock  sync.Mutex
+	subs  map[string]map[net.Conn]struct{}
+	conns map[net.Conn]struct{}
+}
+
+func newFakeRedis(t *testing.T, addr string) *fakeRedis {
+	t.Helper()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &fakeRedis{
+		l:     l,
+		subs:  make(map[string]map[net.Conn]struct{}),
+		conns: make(map[net.Conn]struct{}),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.lock.Lock()
+			srv.conns[conn] = struct{}{}
+			srv.lock.Unlock()
+			go srv.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		srv.dropConns()
+	})
+	return srv
+}
+
+// dropConns closes all client connections.
+func (srv *fakeRedis) dropConns() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.conns = make(map[net.Conn]struct{})
+	srv.subs = make(map[string]map[net.Conn]struct{})
+}
+
+func (srv *fakeRedis) subscribers(channel string) int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return len(srv.subs[channel])
+}
+
+func (srv *fakeRedis) subscribed(conn net.Conn) bool {
+	for _, conns := range srv.subs {
+		if _, ok := conns[conn]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *fakeRedis) serve(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(br)
+		if err != nil || len(args) == 0 {
+			conn.Close()
+			return
+		}
+
+		srv.lock.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[len(args)-1] == "secret" {
+				io.WriteString(conn, "+OK\r\n")
+			} else {
+				io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+			}
+		case "PING":
+			if srv.subscribed(conn) {
+				writeArray(conn, "pong", "")
+			} else {
+				io.WriteString(conn, "+PONG\r\n")
+			}
+		case "SUBSCRIBE":
+			for _, ch := range args[1:] {
+				if srv.subs[ch] == nil {
+					srv.subs[ch] = make(map[net.Conn]struct{})
+				}
+				srv.subs[ch][conn] = struct{}{}
+				writeArray(conn, "subscribe", ch, 1)
+			}
+		case "UNSUBSCRIBE":
+			for _, ch := range args[1:] {
+				delete(srv.subs[ch], conn)
+				writeArray(conn, "unsubscribe", ch, 0)
+			}
+		case "PUBLISH":
+			for sub := range srv.subs[args[1]] {
+				writeArray(sub, "message", args[1], args[2])
+			}
+			io.WriteString(conn, ":1\r\n")
+		default:
+			io.WriteString(conn, "-ERR unknown command\r\n")
+		}
+		srv.lock.Unlock()
+	}
+}
+
+// readCommand reads the command sent as an array of bulk strings.
+func readCommand(br *bufio.Reader) ([]string, error) {
+	readLine := func(prefix byte) (int, error) {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		if len(line) == 0 || line[0] != prefix {
+			return 0, fmt.Errorf("unexpected line: %q", line)
+		}
+		return strconv.Atoi(line[1:])
+	}
+
+	count, err := readLine('*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		size, err := readLine('$')
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// writeArray writes the array of bulk strings and integers.
+func writeArray(conn net.Conn, elems ...interface{}) {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(elems)) + "\r\n")
+	for _, elem := range elems {
+		switch elem := elem.(type) {
+		case string:
+			b.WriteString("$" + strconv.Itoa(len(elem)) + "\r\n" + elem + "\r\n")
+		case int:
+			b.WriteString(":" + strconv.Itoa(elem) + "\r\n")
+		}
+	}
+	io.WriteString(conn, b.String())
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal("timed out waiting for", what)
+}
+
+func readMsg(t *testing.T, ch <-chan Msg) Msg {
+	t.Helper()
+	select {
+	case m := <-ch:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return Msg{}
+	}
+}
+
+type stateRecorder struct {
+	lock   sync.Mutex
+	states []bool
+}
+
+func (sr *stateRecorder) set(connected bool) {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	sr.states = append(sr.states, connected)
+}
+
+func (sr *stateRecorder) get() []bool {
+	sr.lock.Lock()
+	defer sr.lock.Unlock()
+	return append([]bool(nil), sr.states...)
+}
+
+func TestRedisPubSub(t *testing.T) {
+	srv := newFakeRedis(t, "127.0.0.1:0")
+	url := "redis://:secret@" + srv.l.Addr().String() + "/0"
+
+	var states stateRecorder
+	sub, err := NewRedis(url, "test:", log.Logger{Name: "sub"}, states.set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	pub, err := NewRedis(url, "test:", log.Logger{Name: "pub"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pub.Close()
+
+	if err := sub.Subscribe(context.Background(), "mbox1"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "subscription", func() bool { return srv.subscribers("test:mbox1") == 1 })
+
+	if err := pub.Publish("mbox1", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if m := readMsg(t, sub.Listener()); m.Key != "mbox1" || m.Payload != "hello" {
+		t.Fatalf("wrong message: %+v", m)
+	}
+
+	// Both connections are resubscribed and reconnected after the server
+	// drops them.
+	srv.dropConns()
+	waitFor(t, "resubscription", func() bool { return srv.subscribers("test:mbox1") == 1 })
+	if err := pub.Publish("mbox1", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if m := readMsg(t, sub.Listener()); m.Payload != "again" {
+		t.Fatalf("wrong message: %+v", m)
+	}
+
+	if err := sub.Unsubscribe(context.Background(), "mbox1"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "unsubscription", func() bool { return srv.subscribers("test:mbox1") == 0 })
+
+	waitFor(t, "connection state changes", func() bool { return len(states.get()) >= 3 })
+	if s := states.get(); !s[0] || s[1] || !s[2] {
+		t.Errorf("wrong connection state changes: %v", s)
+	}
+}
+
+func TestRedisPubSub_AuthFailure(t *testing.T) {
+	srv := newFakeRedis(t, "127.0.0.1:0")
+	var states stateRecorder
+	r, err := NewRedis("redis://:wrong@"+srv.l.Addr().String(), "", log.Logger{Name: "pubsub"}, states.set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	err = r.Publish("mbox1", "hello")
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+	err = r.Subscribe(context.Background(), "mbox1")
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("expected auth error, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if srv.subscribers("sirrmesh:mbox1") != 0 {
+		t.Error("subscribed without authentication")
+	}
+	for _, up := range states.get() {
+		if up {
+			t.Error("reported as connected without authentication")
+		}
+	}
+}
+
+func TestRedisPubSub_SubscribeFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	r, err := NewRedis("redis://"+addr, "", log.Logger{Name: "pubsub"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The server is down, the error is reported, but the channel is
+	// subscribed to once it is up.
+	var netErr net.Error
+	if err := r.Subscribe(context.Background(), "mbox1"); !errors.As(err, &netErr) {
+		t.Fatalf("expected network error, got %v", err)
+	}
+	srv := newFakeRedis(t, addr)
+	waitFor(t, "subscription", func() bool { return srv.subscribers("sirrmesh:mbox1") == 1 })
+
+	if err := r.Publish("mbox1", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if m := readMsg(t, r.Listener()); m.Key != "mbox1" || m.Payload != "hello" {
+		t.Fatalf("wrong message: %+v", m)
+	}
+}
+
+func TestNewRedis_URL(t *testing.T) {
+	for _, url := range []string{"http://localhost", "redis://", "redis://%zz"} {
+		if r, err := NewRedis(url, "", log.Logger{}, nil); err == nil {
+			r.Close()
+			t.Errorf("expected error for %s", url)
+		}
+	}
+}
@@ -11,9 +11,19 @@ import (
 	"github.com/sirrchat/SirrMesh/internal/updatepipe/pubsub"
 )
 
+// PubSubPipe implements the UpdatePipe interface on top of a message broker
+// (PostgreSQL LISTEN/NOTIFY or Redis Pub/Sub). Each mailbox gets its own
+// channel, so only the instances that have the mailbox open receive the
+// updates for it.
 type PubSubPipe struct {
 	PubSub pubsub.PubSub
 	Log    log.Logger
+	// Module and Backend are the storage instance name and the broker type
+	// used in metrics.
+	Module  string
+	Backend string
+
+	state connState
 }
 
 func (p *PubSubPipe) Listen(upds chan<- mess.Update) error {
@@ -22,12 +32,13 @@ func (p *PubSubPipe) Listen(upds chan<- mess.Update) error {
 			id, upd, err := parseUpdate(m.Payload)
 			if err != nil {
 				p.Log.Error("failed to parse update", err)
+				errorsTotal.WithLabelValues(p.Module, p.Backend, "parse").Inc()
 				continue
 			}
 			if id == p.myID() {
 				continue
 			}
-			upds <- *upd
+			p.state.deliver(p.Log, p.Module, p.Backend, upds, *upd)
 		}
 	}()
 	return nil
@@ -37,6 +48,13 @@ func (p *PubSubPipe) InitPush() error {
 	return nil
 }
 
+// SetConnected records the state of the broker connection in metrics. It
+// should be called by the PubSub implementation on (re)connection and
+// disconnection.
+func (p *PubSubPipe) SetConnected(up bool) {
+	p.state.set(p.Module, p.Backend, up)
+}
+
 func (p *PubSubPipe) myID() string {
 	return fmt.Sprintf("%d-%p", os.Getpid(), p)
 }
@@ -63,6 +81,7 @@ func (p *PubSubPipe) Subscribe(key interface{}) {
 
 	if err := p.PubSub.Subscribe(context.TODO(), psKey); err != nil {
 		p.Log.Error("pubsub subscribe failed", err)
+		errorsTotal.WithLabelValues(p.Module, p.Backend, "subscribe").Inc()
 	} else {
 		p.Log.DebugMsg("subscribed to pubsub", "channel", psKey)
 	}
@@ -77,6 +96,7 @@ func (p *PubSubPipe) Unsubscribe(key interface{}) {
 
 	if err := p.PubSub.Unsubscribe(context.TODO(), psKey); err != nil {
 		p.Log.Error("pubsub unsubscribe failed", err)
+		errorsTotal.WithLabelValues(p.Module, p.Backend, "unsubscribe").Inc()
 	} else {
 		p.Log.DebugMsg("unsubscribed from pubsub", "channel", psKey)
 	}
@@ -93,7 +113,12 @@ func (p *PubSubPipe) Push(upd mess.Update) error {
 		return err
 	}
 
-	return p.PubSub.Publish(psKey, updBlob)
+	if err := p.PubSub.Publish(psKey, updBlob); err != nil {
+		errorsTotal.WithLabelValues(p.Module, p.Backend, "push").Inc()
+		return err
+	}
+	updatesTotal.WithLabelValues(p.Module, p.Backend, "out").Inc()
+	return nil
 }
 
 func (p *PubSubPipe) Close() error {
@@ -20,13 +20,18 @@ package updatepipe
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"sync"
+	"syscall"
+	"time"
 
 	mess "github.com/foxcpp/go-imap-mess"
 	"github.com/sirrchat/SirrMesh/framework/log"
+	"github.com/sirrchat/SirrMesh/framework/module"
 )
 
 // UnixSockPipe implements the UpdatePipe interface by serializating updates
@@ -41,15 +46,27 @@ import (
 // It is used to deduplicate updates sent to Push and recevied via Listen.
 //
 // The SockPath field specifies the socket path to use. The actual socket
-// is initialized on the first call to Listen or (Init)Push.
+// is initialized on the first call to Listen or (Init)Push. If the write to
+// the socket fails (e.g. the server was restarted), Push reconnects once
+// before returning the error.
 type UnixSockPipe struct {
 	SockPath string
 	Log      log.Logger
+	// Module is the name of the storage instance used in metrics.
+	Module string
 
 	listener net.Listener
-	sender   net.Conn
+	// The socket file created by Listen. It is removed on Close unless
+	// another process replaced it.
+	sockFile os.FileInfo
+
+	senderLock sync.Mutex
+	sender     net.Conn
+	state      connState
 }
 
+const unixWriteTimeout = 5 * time.Second
+
 var _ P = &UnixSockPipe{}
 
 func (usp *UnixSockPipe) myID() string {
@@ -62,6 +79,8 @@ func (usp *UnixSockPipe) readUpdates(conn net.Conn, updCh chan<- mess.Update) {
 		id, upd, err := parseUpdate(scnr.Text())
 		if err != nil {
 			usp.Log.Error("malformed update received", err, "str", scnr.Text())
+			errorsTotal.WithLabelValues(usp.Module, "unix", "parse").Inc()
+			continue
 		}
 
 		// It is our own update, skip.
@@ -69,15 +88,30 @@ func (usp *UnixSockPipe) readUpdates(conn net.Conn, updCh chan<- mess.Update) {
 			continue
 		}
 
-		updCh <- *upd
+		usp.state.deliver(usp.Log, usp.Module, "unix", updCh, *upd)
 	}
 }
 
 func (usp *UnixSockPipe) Listen(upd chan<- mess.Update) error {
 	l, err := net.Listen("unix", usp.SockPath)
+	if errors.Is(err, syscall.EADDRINUSE) && module.HandoverPending() {
+		// The socket is used by the previous server process that is
+		// draining its sessions, take it over.
+		usp.Log.DebugMsg("replacing the socket of the previous process", "path", usp.SockPath)
+		if err := os.Remove(usp.SockPath); err != nil {
+			return err
+		}
+		l, err = net.Listen("unix", usp.SockPath)
+	}
 	if err != nil {
 		return err
 	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	usp.sockFile, err = os.Stat(usp.SockPath)
+	if err != nil {
+		l.Close()
+		return err
+	}
 	usp.listener = l
 	go func() {
 		for {
@@ -92,38 +126,77 @@ func (usp *UnixSockPipe) Listen(upd chan<- mess.Update) error {
 }
 
 func (usp *UnixSockPipe) InitPush() error {
+	usp.senderLock.Lock()
+	defer usp.senderLock.Unlock()
+	return usp.dial()
+}
+
+func (usp *UnixSockPipe) dial() error {
 	sock, err := net.Dial("unix", usp.SockPath)
 	if err != nil {
+		usp.state.set(usp.Module, "unix", false)
 		return err
 	}
 
 	usp.sender = sock
+	usp.state.set(usp.Module, "unix", true)
 	return nil
 }
 
-func (usp *UnixSockPipe) Push(upd mess.Update) error {
+func (usp *UnixSockPipe) write(updStr string) error {
 	if usp.sender == nil {
-		if err := usp.InitPush(); err != nil {
+		if err := usp.dial(); err != nil {
 			return err
 		}
 	}
 
+	if err := usp.sender.SetWriteDeadline(time.Now().Add(unixWriteTimeout)); err != nil {
+		return err
+	}
+	_, err := io.WriteString(usp.sender, updStr)
+	if err != nil {
+		usp.sender.Close()
+		usp.sender = nil
+		usp.state.set(usp.Module, "unix", false)
+	}
+	return err
+}
+
+func (usp *UnixSockPipe) Push(upd mess.Update) error {
 	updStr, err := formatUpdate(usp.myID(), upd)
 	if err != nil {
 		return err
 	}
 
-	_, err = io.WriteString(usp.sender, updStr)
-	return err
+	usp.senderLock.Lock()
+	defer usp.senderLock.Unlock()
+
+	if err := usp.write(updStr); err != nil {
+		// The listening side might have been restarted, try again with the
+		// new connection.
+		usp.Log.DebugMsg("write failed, reconnecting", "reason", err)
+		if err := usp.write(updStr); err != nil {
+			errorsTotal.WithLabelValues(usp.Module, "unix", "push").Inc()
+			return err
+		}
+	}
+	updatesTotal.WithLabelValues(usp.Module, "unix", "out").Inc()
+	return nil
 }
 
 func (usp *UnixSockPipe) Close() error {
+	usp.senderLock.Lock()
+	defer usp.senderLock.Unlock()
+
 	if usp.sender != nil {
 		usp.sender.Close()
+		usp.sender = nil
 	}
 	if usp.listener != nil {
 		usp.listener.Close()
-		os.Remove(usp.SockPath)
+		if fi, err := os.Stat(usp.SockPath); err == nil && os.SameFile(fi, usp.sockFile) {
+			os.Remove(usp.SockPath)
+		}
 	}
 	return nil
 }